@@ -22,16 +22,23 @@ import (
 	"errors"
 	"fmt"
 	"io/ioutil"
+	"net"
+	"net/http"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"sort"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/percona/cloud-protocol/proto/v1"
+	"github.com/percona/percona-agent/bus"
+	"github.com/percona/percona-agent/data"
 	"github.com/percona/percona-agent/pct"
 	pctCmd "github.com/percona/percona-agent/pct/cmd"
+	"github.com/percona/percona-agent/snmp"
+	"github.com/percona/percona-agent/webhook"
 )
 
 // REV="$(git rev-parse HEAD)"
@@ -42,9 +49,18 @@ var REL string = ""
 var MIN_SUPPORTED_MYSQL_VERSION = "5.1.0"
 
 const (
-	CMD_QUEUE_SIZE    = 10
-	STATUS_QUEUE_SIZE = 10
-	MAX_ERRORS        = 3
+	CMD_QUEUE_SIZE        = 10
+	STATUS_QUEUE_SIZE     = 10
+	MAX_ERRORS            = 3
+	FAILBACK_INTERVAL     = 5 * time.Minute
+	UPDATE_CHECK_INTERVAL = 1 * time.Minute
+)
+
+// The agent service sets ENV_INIT_SYSTEM to its init system, e.g. systemd,
+// which restarts the agent when it exits with EXIT_RESTART, see restartSelf.
+const (
+	ENV_INIT_SYSTEM = "PCT_INIT_SYSTEM"
+	EXIT_RESTART    = 75
 )
 
 type Agent struct {
@@ -55,6 +71,7 @@ type Agent struct {
 	client    pct.WebsocketClient
 	api       pct.APIConnector
 	services  map[string]pct.ServiceManager
+	bus       *bus.Bus
 	updater   *pct.Updater
 	keepalive *time.Ticker
 	// --
@@ -66,9 +83,44 @@ type Agent struct {
 	status            *pct.Status
 	statusChan        chan *proto.Cmd
 	statusHandlerSync *pct.SyncChan
+	//
+	localCmdChan chan *localCmd
+	ctlListener  net.Listener
+	httpListener net.Listener
+	//
+	restartByInit bool // see restartSelf
+	//
+	debugServer *http.Server // see DebugHandler
+	debugAddr   string       // debugServer listener address
+	debugMux    *sync.Mutex  // guards debugServer and debugAddr
+	//
+	scheduledUpdate  *scheduledUpdate // see handleUpdate
+	availableVersion string           // newer version in the update channel, see handleUpdate
+	updateMux        *sync.Mutex      // guards scheduledUpdate and availableVersion
+	//
+	paused   time.Time // zero if not paused, see Pause
+	pauseMux *sync.Mutex
+	//
+	auditLog *AuditLog
+	replies  *ReplyCache
+	watchdog *Watchdog
+	//
+	apiProtocol int // see handshake
+	protocolMux *sync.Mutex
+	heartbeat   *heartbeat
+	//
+	dnsHost  string // API host resolved by checkDNS
+	dnsAddrs string // its addresses, sorted
+	dnsMux   *sync.Mutex
 }
 
-func NewAgent(config *Config, logger *pct.Logger, api pct.APIConnector, client pct.WebsocketClient, services map[string]pct.ServiceManager) *Agent {
+func NewAgent(config *Config, logger *pct.Logger, api pct.APIConnector, client pct.WebsocketClient, services map[string]pct.ServiceManager, spool data.Spooler, b *bus.Bus) *Agent {
+	// State is not essential to run, so without the store there's no audit
+	// log, replies are only cached in memory, and update keys are not saved.
+	store, err := pct.Basedir.Store()
+	if err != nil {
+		logger.Warn("Cannot open state store:", err)
+	}
 	agent := &Agent{
 		config:    config,
 		api:       api,
@@ -76,12 +128,35 @@ func NewAgent(config *Config, logger *pct.Logger, api pct.APIConnector, client p
 		logger:    logger,
 		client:    client,
 		services:  services,
+		bus:       b,
 		updater:   pct.NewUpdater(logger, api, pct.PublicKey, os.Args[0], VERSION),
 		// --
 		status:     pct.NewStatus([]string{"agent", "agent-cmd-handler"}),
 		cmdChan:    make(chan *proto.Cmd, CMD_QUEUE_SIZE),
 		statusChan: make(chan *proto.Cmd, STATUS_QUEUE_SIZE),
+		// --
+		localCmdChan: make(chan *localCmd, CTL_QUEUE_SIZE),
+		pauseMux:     &sync.Mutex{},
+		debugMux:     &sync.Mutex{},
+		updateMux:    &sync.Mutex{},
+		protocolMux:  &sync.Mutex{},
+		heartbeat:    newHeartbeat(),
+		dnsMux:       &sync.Mutex{},
+		auditLog:     NewAuditLog(store, AUDIT_LOG_MAX_ENTRIES),
+		replies:      NewReplyCache(store, REPLY_CACHE_SIZE, REPLY_CACHE_TTL),
+	}
+	if err := agent.updater.SetChannel(config.UpdateChannel); err != nil {
+		logger.Warn(err)
 	}
+	if store != nil {
+		if err := agent.updater.LoadKeys(store); err != nil {
+			logger.Warn("Cannot load update keys:", err)
+		}
+	}
+	agent.watchdog = NewWatchdog(pct.NewLogger(logger.LogChan(), "agent-watchdog"), services, spool, agent.isPausedService)
+	pct.AgentMetrics.SetFunc("cmd/queue", func() float64 {
+		return float64(len(agent.cmdChan))
+	})
 	return agent
 }
 
@@ -102,13 +177,24 @@ func (agent *Agent) Run() error {
 	client.Start()
 	cmdChan := client.RecvChan()
 	connected := false
-	go agent.connect()
+	if agent.Offline() {
+		// Offline mode: don't connect to the API, and make sure services
+		// that send to the API are offline, too.  See Online.
+		cmd := &proto.Cmd{Ts: time.Now().UTC(), User: "agent"}
+		for _, err := range agent.setServicesOffline(cmd, true) {
+			logger.Warn(err)
+		}
+		logger.Warn("Offline: not connecting to API; data is spooled until Drain or Online")
+	} else {
+		go agent.connect()
+	}
 
 	/*
 	 * Start the status and cmd handlers.  Most messages must be serialized because,
 	 * for example, handling start-service and stop-service at the same
-	 * time would cause weird problems.  The cmdChan serializes messages,
-	 * so it's "first come, first serve" (i.e. fifo).  Concurrency has
+	 * time would cause weird problems.  cmdHandler serializes messages per
+	 * service, so it's "first come, first serve" (i.e. fifo) for each service,
+	 * but different services handle messages concurrently.  Concurrency has
 	 * consequences: e.g. if user1 sends a start-service and it succeeds
 	 * and user2 send the same start-service, user2 will get a ServiceIsRunningError.
 	 * Status requests are handled concurrently so the user can always see what
@@ -120,6 +206,16 @@ func (agent *Agent) Run() error {
 	agent.statusHandlerSync = pct.NewSyncChan()
 	go agent.statusHandler()
 
+	// Local control via UNIX socket for "percona-agent ctl".
+	agent.startCtl()
+
+	// Apply the config group template, if any, like the ApplyConfigGroup cmd.
+	agent.queueApplyConfigGroup()
+
+	// Optional local HTTP status and config endpoint, see HTTPHandler.
+	agent.startHTTP()
+	agent.startDebugOnRun()
+
 	// Allow those ^ goroutines to crash up to MAX_ERRORS.  Any more and it's
 	// probably a code bug rather than  bad input, network error, etc.
 	cmdHandlerErrors := 0
@@ -129,66 +225,108 @@ func (agent *Agent) Run() error {
 	// https://jira.percona.com/browse/PCT-765
 	agent.keepalive = time.NewTicker(time.Duration(agent.config.Keepalive) * time.Second)
 
+	// Fail back to the primary API host if connected to another one.
+	failbackTicker := time.NewTicker(FAILBACK_INTERVAL)
+	defer failbackTicker.Stop()
+
+	// Measure clock skew against the API, see checkClock.
+	clockTicker := time.NewTicker(CLOCK_CHECK_INTERVAL)
+	defer clockTicker.Stop()
+
+	// Reconnect if the API host resolves to other addresses, see checkDNS.
+	dnsTicker := time.NewTicker(DNS_CHECK_INTERVAL)
+	defer dnsTicker.Stop()
+
+	// Restart MySQL services when their Vault credentials change.  A nil bus
+	// has no events, so the nil chan never receives.
+	var credsChan chan bus.Event
+	if agent.bus != nil {
+		credsSub := agent.bus.Subscribe(bus.CREDS_CHANGED, 0)
+		defer credsSub.Cancel()
+		credsChan = credsSub.C
+	}
+
 	logger.Info("Started version: " + VERSION)
 
+	// After Update, roll back to the previous version if this version does
+	// not connect to the API in time.
+	rollbackTimer := agent.rollbackTimer()
+
+	// Apply an update scheduled by the Update cmd in its window.
+	updateTicker := time.NewTicker(UPDATE_CHECK_INTERVAL)
+	defer updateTicker.Stop()
+
+	// Restart services that crashed, see Watchdog.
+	watchdogTicker := time.NewTicker(WATCHDOG_INTERVAL)
+	defer watchdogTicker.Stop()
+
 	for {
 		logger.Debug("idle")
 		agent.status.Update("agent", "Idle")
 
 		select {
 		case cmd := <-cmdChan: // from API
+			if agent.heartbeat.recv(cmd, time.Now()) {
+				continue // Ping, no reply
+			}
+			if cmd.Cmd == "Handshake" {
+				// API response to handshake, not subject to the cmd policy.
+				agent.handleHandshake(cmd)
+				continue
+			}
+			if cmd.Service == "agent" && !isAgentCmd(cmd.Cmd) {
+				// Refuse now rather than queue a cmd from a newer API.
+				logger.Warn(pct.UnknownCmdError{Cmd: cmd.Cmd})
+				reply := cmd.Reply(nil, pct.UnknownCmdError{Cmd: cmd.Cmd})
+				agent.reply(reply)
+				agent.audit(cmd, reply, time.Now(), false)
+				continue
+			}
+			if err := agent.cmdAllowed(cmd); err != nil {
+				logger.Warn(err)
+				reply := cmd.Reply(nil, err)
+				agent.reply(reply)
+				agent.audit(cmd, reply, time.Now(), false)
+				continue
+			}
 			if cmd.Cmd == "Abort" {
 				panic(cmd)
 			}
 			switch cmd.Cmd {
 			case "Restart":
 				logger.Debug("cmd:restart")
-				agent.status.UpdateRe("agent", "Restarting", cmd)
-
-				// Secure the start-lock file.  This lets us start our self but
-				// wait until this process has exited, at which time the start-lock
-				// is removed and the 2nd self continues starting.
-				if err := pct.MakeStartLock(); err != nil {
-					agent.reply(cmd.Reply(nil, err))
+				if reply := agent.replies.Get(cmd); reply != nil {
+					agent.replyDuplicate(&localCmd{cmd: cmd}, reply)
 					continue
 				}
+				agent.status.UpdateRe("agent", "Restarting", cmd)
+				t0 := time.Now()
 
-				// Start our self with the same args this process was started with.
-				cwd, err := os.Getwd()
+				output, err := agent.restartSelf(cmd)
+				reply := cmd.Reply(output, err)
+				agent.reply(reply)
+				agent.audit(cmd, reply, t0, false)
 				if err != nil {
-					agent.reply(cmd.Reply(nil, err))
+					continue
 				}
-				comment := fmt.Sprintf(
-					"This script was created by percona-agent in response to this Restart command:\n"+
-						"# %s\n"+
-						"# It is safe to delete.", cmd)
-				sh := fmt.Sprintf("#!/bin/sh\n# %s\ncd %s\n%s %s >> %s/percona-agent.log 2>&1 &\n",
-					comment,
-					cwd,
-					os.Args[0],
-					strings.Join(os.Args[1:len(os.Args)], " "),
-					pct.Basedir.Path(),
-				)
-				startScript := pct.Basedir.File("start-script")
-				if err := ioutil.WriteFile(startScript, []byte(sh), os.FileMode(0754)); err != nil {
-					agent.reply(cmd.Reply(nil, err))
+				if err := agent.replies.Add(cmd, reply); err != nil {
+					logger.Warn("Cannot cache reply:", err)
 				}
-				logger.Debug("Restart:sh")
-				self := pctCmd.Factory.Make(startScript)
-				output, err := self.Run()
-				agent.reply(cmd.Reply(output, err))
 				logger.Debug("Restart:done")
 				return nil
 			case "Stop":
 				logger.Debug("cmd:stop")
 				logger.Info("Stopping", cmd)
 				agent.status.UpdateRe("agent", "Stopping", cmd)
+				t0 := time.Now()
 				agent.stop()
-				agent.reply(cmd.Reply(nil))
+				reply := cmd.Reply(nil)
+				agent.reply(reply)
+				agent.audit(cmd, reply, t0, false)
 				logger.Info("Stopped", cmd)
 				agent.status.UpdateRe("agent", "Stopped", cmd)
 				return nil
-			case "Status":
+			case "Status", "StatusHistory":
 				logger.Debug("cmd:status")
 				agent.status.UpdateRe("agent", "Queueing", cmd)
 				select {
@@ -230,24 +368,170 @@ func (agent *Agent) Run() error {
 		case connected = <-client.ConnectChan():
 			if connected {
 				logger.Info("Connected to API")
+				agent.bus.Publish(bus.Event{Topic: bus.API_CONNECTED, Source: "agent"})
 				cmdHandlerErrors = 0
 				statusHandlerErrors = 0
+				agent.heartbeat.reset(time.Now())
+				agent.handshake()
+				go agent.checkClock(time.Now())
+				go agent.checkDNS(false)
+				if rollbackTimer != nil {
+					rollbackTimer = nil
+					if err := agent.updater.Commit(); err != nil {
+						logger.Warn(err)
+					}
+				}
 			} else {
 				// websocket closed/crashed/err
+				agent.bus.Publish(bus.Event{Topic: bus.API_DISCONNECTED, Source: "agent"})
+				if agent.Offline() {
+					logger.Info("Disconnected from API (offline)")
+					continue
+				}
 				logger.Warn("Lost connection to API")
+				pct.AgentMetrics.Add("ws/reconnects", 1)
 				go agent.connect()
 			}
-		case <-agent.keepalive.C:
+		case now := <-agent.keepalive.C:
 			// Send keepalive (i.e. check if ws cmd chan is still open on API end).
 			logger.Debug("pong")
 			if connected {
 				cmd := &proto.Cmd{Cmd: "Pong"}
 				agent.reply(cmd.Reply(nil, nil))
+				if timeout := agent.heartbeatTimeout(); agent.heartbeat.stale(now, timeout) {
+					logger.Warn(fmt.Sprintf("No traffic from API in %s, reconnecting", timeout))
+					pct.AgentMetrics.Add("ws/stale", 1)
+					go client.Disconnect() // Run() reconnects on disconnect
+				}
+			}
+		case <-failbackTicker.C:
+			if connected {
+				go agent.failback()
+			}
+		case now := <-clockTicker.C:
+			if connected {
+				go agent.checkClock(now)
+			}
+		case <-dnsTicker.C:
+			if connected {
+				go agent.checkDNS(true)
+			}
+		case e := <-credsChan:
+			path, _ := e.Data.(string)
+			go agent.restartVaultServices(path)
+		case now := <-updateTicker.C:
+			if agent.applyScheduledUpdate(now) {
+				return nil
+			}
+		case now := <-watchdogTicker.C:
+			// Restarting a service can take awhile; Check serializes itself.
+			go agent.checkWatchdog(now)
+		case <-rollbackTimer:
+			rollbackTimer = nil
+			logger.Error("Version " + VERSION + " did not connect to API after update, rolling back")
+			version, err := agent.updater.Rollback()
+			if err != nil {
+				logger.Error(err)
+				continue
 			}
+			cmd := &proto.Cmd{Ts: time.Now().UTC(), User: "agent", Service: "agent", Cmd: "Restart"}
+			if _, err := agent.restartSelf(cmd); err != nil {
+				logger.Error("Rolled back to version " + version + " but cannot restart: " + err.Error())
+				continue
+			}
+			logger.Info("Rolled back to version " + version + ", restarting")
+			return nil
 		}
 	}
 }
 
+// restartSelf starts another agent with the same args this process was
+// started with.  It waits until this process exits, so Run must return if
+// there's no error.  If there's an error, the agent keeps running.  An agent
+// run by an init system doesn't start another: the init system would kill it
+// when this process exits, so the process exits with EXIT_RESTART instead and
+// the init system starts it again, see RestartByInit.
+// @goroutine[0]
+func (agent *Agent) restartSelf(cmd *proto.Cmd) (output interface{}, err error) {
+	if initSystem := os.Getenv(ENV_INIT_SYSTEM); initSystem != "" {
+		agent.restartByInit = true
+		return "Restarting by " + initSystem, nil
+	}
+
+	// Secure the start-lock file.  This lets us start our self but
+	// wait until this process has exited, at which time the start-lock
+	// is removed and the 2nd self continues starting.
+	if err := pct.MakeStartLock(); err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			os.Remove(pct.Basedir.File("start-lock"))
+		}
+	}()
+
+	// Start our self with the same args this process was started with.
+	cwd, err := os.Getwd()
+	if err != nil {
+		return nil, err
+	}
+	comment := fmt.Sprintf(
+		"This script was created by percona-agent in response to this Restart command:\n"+
+			"# %s\n"+
+			"# It is safe to delete.", cmd)
+	sh := fmt.Sprintf("#!/bin/sh\n# %s\ncd %s\n%s %s >> %s/percona-agent.log 2>&1 &\n",
+		comment,
+		cwd,
+		os.Args[0],
+		strings.Join(os.Args[1:len(os.Args)], " "),
+		pct.Basedir.Path(),
+	)
+	startScript := pct.Basedir.File("start-script")
+	if err := ioutil.WriteFile(startScript, []byte(sh), os.FileMode(0754)); err != nil {
+		return nil, err
+	}
+	agent.logger.Debug("Restart:sh")
+	self := pctCmd.Factory.Make(startScript)
+	return self.Run()
+}
+
+// RestartByInit returns true if Run returned to restart the agent and the
+// process must exit with EXIT_RESTART so its init system starts it again.
+func (agent *Agent) RestartByInit() bool {
+	return agent.restartByInit
+}
+
+// rollbackTimer returns a chan that fires if this version was started after
+// Update and has not connected to the API in UpdateTimeout minutes, else nil.
+// @goroutine[0]
+func (agent *Agent) rollbackTimer() <-chan time.Time {
+	pending, err := agent.updater.Pending()
+	if err != nil {
+		agent.logger.Warn(err)
+		return nil
+	}
+	if pending == nil || pending.Version != VERSION {
+		return nil
+	}
+	if agent.Offline() {
+		// The agent does not connect while offline, so it can't tell if the
+		// update works.
+		if err := agent.updater.Commit(); err != nil {
+			agent.logger.Warn(err)
+		}
+		return nil
+	}
+	agent.configMux.RLock()
+	timeout := agent.config.UpdateTimeout
+	agent.configMux.RUnlock()
+	if timeout == 0 {
+		timeout = DEFAULT_UPDATE_TIMEOUT
+	}
+	agent.logger.Info(fmt.Sprintf("Updated from version %s; rolling back if not connected to API in %d minutes",
+		pending.PrevVersion, timeout))
+	return time.After(time.Duration(timeout) * time.Minute)
+}
+
 // @goroutine[0]
 func (agent *Agent) connect() {
 	defer func() {
@@ -259,9 +543,49 @@ func (agent *Agent) connect() {
 	agent.client.Connect()
 }
 
+// failback reconnects to the primary API host if the agent failed over to
+// another host and the primary responds again.  Disconnecting the cmd ws makes
+// Run() reconnect, and the log ws is told to reconnect, like Reconnect.
+func (agent *Agent) failback() {
+	defer func() {
+		if err := recover(); err != nil {
+			agent.logger.Error("Agent failback crashed: ", err)
+		}
+	}()
+	agent.configMux.RLock()
+	hostnames := pct.ApiHostnames(agent.config.ApiHostname)
+	agent.configMux.RUnlock()
+	if len(hostnames) < 2 || agent.api.Hostname() == hostnames[0] {
+		return
+	}
+	host := agent.api.Hostname()
+	if err := agent.api.Failover(); err != nil {
+		agent.logger.Warn("Failback to", hostnames[0], "failed:", err)
+		return
+	}
+	if agent.api.Hostname() == host {
+		return // primary still down
+	}
+	agent.logger.Info("Failing back from API host", host, "to", agent.api.Hostname())
+	agent.client.Disconnect()
+	if m, ok := agent.services["log"]; ok {
+		reconnectCmd := &proto.Cmd{
+			Ts:      time.Now().UTC(),
+			User:    "agent",
+			Service: "log",
+			Cmd:     "Reconnect",
+		}
+		if reply := m.Handle(reconnectCmd); reply != nil && reply.Error != "" {
+			agent.logger.Warn("Failed to reconnect log:", reply.Error)
+		}
+	}
+}
+
 // @goroutine[0]
 func (agent *Agent) stop() {
 	cmd := &proto.Cmd{Ts: time.Now().UTC(), User: "agent"}
+	agent.stopCtl()
+
 	agent.logger.Info("Stopping cmdHandler")
 	agent.status.UpdateRe("agent", "Stopping cmdHandler", cmd)
 	agent.cmdHandlerSync.Stop()
@@ -278,6 +602,9 @@ func (agent *Agent) stop() {
 		}
 	}
 
+	agent.stopHTTP()
+	agent.stopDebug()
+
 	agent.logger.Info("Stopping statusHandler")
 	agent.status.UpdateRe("agent", "Stopping statusHandler", cmd)
 	agent.statusHandlerSync.Stop()
@@ -295,15 +622,69 @@ func LoadConfig() ([]byte, error) {
 	if config.Keepalive == 0 {
 		config.Keepalive = DEFAULT_KEEPALIVE
 	}
+	if config.HeartbeatTimeout == 0 {
+		config.HeartbeatTimeout = DEFAULT_HEARTBEAT_TIMEOUT
+	}
+	if err := validateHeartbeatTimeout(config.HeartbeatTimeout, config.Keepalive); err != nil {
+		return nil, err
+	}
 	if config.PidFile == "" {
 		config.PidFile = DEFAULT_PIDFILE
 	}
-	if config.ApiKey == "" {
+	if config.ApiAuth != nil {
+		if _, err := pct.NewAuthProvider(*config.ApiAuth); err != nil {
+			return nil, err
+		}
+	} else if config.ApiKey == "" {
 		return nil, errors.New("Missing ApiKey")
 	}
 	if config.AgentUuid == "" {
 		return nil, errors.New("Missing AgentUuid")
 	}
+	for i := range config.Webhooks {
+		if err := webhook.ValidateConfig(&config.Webhooks[i]); err != nil {
+			return nil, err
+		}
+	}
+	for i := range config.SnmpTraps {
+		if err := snmp.ValidateConfig(&config.SnmpTraps[i]); err != nil {
+			return nil, err
+		}
+	}
+	if err := validateStatusTime(config.StatusTime); err != nil {
+		return nil, err
+	}
+	if err := validateCmdPatterns(config.AllowCmds); err != nil {
+		return nil, err
+	}
+	if err := validateCmdPatterns(config.DenyCmds); err != nil {
+		return nil, err
+	}
+	if config.UpdateWindow != "" {
+		if _, err := ParseUpdateWindow(config.UpdateWindow); err != nil {
+			return nil, err
+		}
+	}
+	if err := pct.ValidateUpdateChannel(config.UpdateChannel); err != nil {
+		return nil, err
+	}
+	if _, err := pct.LoadTLSConfig(config.ApiCA, config.ApiCert, config.ApiCertKey, config.ApiPins); err != nil {
+		return nil, err
+	}
+	if err := pct.ValidateExcludeData(config.ExcludeData); err != nil {
+		return nil, err
+	}
+	if config.Secondary != nil {
+		if config.Secondary.ApiKey == "" {
+			return nil, errors.New("Missing Secondary.ApiKey")
+		}
+		if config.Secondary.ApiHostname == "" {
+			config.Secondary.ApiHostname = DEFAULT_API_HOSTNAME
+		}
+		if config.Secondary.AgentUuid == "" {
+			config.Secondary.AgentUuid = config.AgentUuid
+		}
+	}
 	data, err := json.Marshal(config)
 	if err != nil {
 		return nil, err
@@ -311,6 +692,23 @@ func LoadConfig() ([]byte, error) {
 	return data, nil
 }
 
+// validateHeartbeatTimeout returns an error if the timeout is not longer than
+// keepalive: the API pings only in response to the agent keepalive.
+func validateHeartbeatTimeout(timeout, keepalive uint) error {
+	if timeout <= keepalive {
+		return fmt.Errorf("Invalid HeartbeatTimeout: %d.  Must be greater than Keepalive (%d).", timeout, keepalive)
+	}
+	return nil
+}
+
+func validateStatusTime(statusTime string) error {
+	switch statusTime {
+	case "", "utc", "local":
+		return nil
+	}
+	return fmt.Errorf("Invalid StatusTime: '%s'.  Expected 'utc' or 'local'.", statusTime)
+}
+
 func (agent *Agent) GetConfig() ([]proto.AgentConfig, []error) {
 	agent.logger.Debug("GetConfig:call")
 	defer agent.logger.Debug("GetConfig:return")
@@ -341,71 +739,158 @@ func (agent *Agent) GetConfig() ([]proto.AgentConfig, []error) {
 // Command handler
 // --------------------------------------------------------------------------
 
+// cmdHandler dispatches cmds to one worker per service: cmds for a service
+// run one at a time in the order received, but cmds for different services
+// run concurrently, so a slow mm cmd does not block a qan GetConfig.  Agent
+// cmds are serialized by the agent worker.
 // Run:@goroutine[1]
 func (agent *Agent) cmdHandler() {
-	cmdReply := make(chan *proto.Reply, 1)
+	workers := make(map[string]chan *localCmd)
 
 	defer func() {
 		if err := recover(); err != nil {
 			agent.logger.Error("Agent command handler crashed: ", err)
 		}
+		// Workers finish their current cmd, then stop.
+		for _, workerChan := range workers {
+			close(workerChan)
+		}
 		agent.status.Update("agent-cmd-handler", "Stopped")
 		agent.cmdHandlerSync.Done()
 	}()
 
+	agent.status.Update("agent-cmd-handler", "Idle")
 	for {
-		agent.status.Update("agent-cmd-handler", "Idle")
-
+		var lc *localCmd
 		select {
 		case cmd := <-agent.cmdChan:
-			agent.status.UpdateRe("agent-cmd-handler", "Handling", cmd)
-
-			// Handle the cmd in a separate goroutine so if it gets stuck it won't affect us.
-			go func() {
-				var reply *proto.Reply
-				defer func() {
-					if err := recover(); err != nil {
-						agent.logger.Error(fmt.Sprintf("Command %s crashed: %s", cmd, err))
-						reply = cmd.Reply(nil, fmt.Errorf("%s", err))
-					}
-					cmdReply <- reply
-				}()
-				if cmd.Service == "agent" {
-					reply = agent.Handle(cmd)
-				} else {
-					if manager, ok := agent.services[cmd.Service]; ok {
-						reply = manager.Handle(cmd)
-					} else {
-						reply = cmd.Reply(nil, pct.UnknownServiceError{Service: cmd.Service})
-					}
-				}
-			}()
-
-			// Wait for the cmd to complete.
-			var timeout <-chan time.Time
-			if cmd.Cmd == "Update" {
-				timeout = time.After(5 * time.Minute)
-			} else {
-				timeout = time.After(20 * time.Second)
-			}
-			var reply *proto.Reply
-			select {
-			case reply = <-cmdReply:
-				// todo: instrument cmd exec time
-			case <-timeout:
-				reply = cmd.Reply(nil, pct.CmdTimeoutError{Cmd: cmd.Cmd})
-			}
-
-			// Reply to cmd.
-			if reply != nil {
-				agent.reply(reply)
-			} else {
-				agent.logger.Info(cmd, "executed, no reply")
-			}
+			lc = &localCmd{cmd: cmd} // reply to API
+		case lc = <-agent.localCmdChan: // from ctl socket
 		case <-agent.cmdHandlerSync.StopChan: // from stop()
 			agent.cmdHandlerSync.Graceful()
 			return
 		}
+		cmd := lc.cmd
+
+		// Start workers only for known services, not any cmd.Service.
+		service := cmd.Service
+		if service != "agent" {
+			if _, ok := agent.services[service]; !ok {
+				agent.sendReply(lc, cmd.Reply(nil, pct.UnknownServiceError{Service: service}))
+				continue
+			}
+		}
+		workerChan, ok := workers[service]
+		if !ok {
+			workerChan = make(chan *localCmd, CMD_QUEUE_SIZE)
+			workers[service] = workerChan
+			go agent.cmdWorker(service, workerChan)
+		}
+		select {
+		case workerChan <- lc:
+		default:
+			err := pct.QueueFullError{Cmd: cmd.Cmd, Name: service + "CmdQueue", Size: CMD_QUEUE_SIZE}
+			agent.sendReply(lc, cmd.Reply(nil, err))
+		}
+	}
+}
+
+// cmdWorker runs the service's cmds until cmdHandler closes workerChan.
+// cmdHandler:@goroutine[4]
+func (agent *Agent) cmdWorker(service string, workerChan chan *localCmd) {
+	defer func() {
+		if err := recover(); err != nil {
+			agent.logger.Error("Agent "+service+" command worker crashed: ", err)
+		}
+	}()
+	for lc := range workerChan {
+		// A duplicate queues behind the original, so it's cached by now.
+		if reply := agent.replies.Get(lc.cmd); reply != nil {
+			agent.replyDuplicate(lc, reply)
+			continue
+		}
+		if service == "agent" {
+			agent.status.UpdateRe("agent-cmd-handler", "Handling", lc.cmd)
+		}
+		reply := agent.runCmd(lc.cmd)
+		if err := agent.replies.Add(lc.cmd, reply); err != nil {
+			agent.logger.Warn("Cannot cache reply:", err)
+		}
+		agent.sendReply(lc, reply)
+		if service == "agent" {
+			agent.status.Update("agent-cmd-handler", "Idle")
+		}
+	}
+}
+
+// runCmd runs the cmd and returns its reply, or a CmdTimeoutError reply if
+// it takes too long.
+// cmdWorker:@goroutine[4]
+func (agent *Agent) runCmd(cmd *proto.Cmd) *proto.Reply {
+	// Handle the cmd in a separate goroutine so if it gets stuck it won't affect us.
+	// Each cmd has its own reply chan so a reply after a timeout is discarded.
+	cmdReply := make(chan *proto.Reply, 1)
+	t0 := time.Now()
+	go func() {
+		var reply *proto.Reply
+		defer func() {
+			if err := recover(); err != nil {
+				agent.logger.Error(fmt.Sprintf("Command %s crashed: %s", cmd, err))
+				reply = cmd.Reply(nil, fmt.Errorf("%s", err))
+			}
+			cmdReply <- reply
+		}()
+		if cmd.Service == "agent" {
+			reply = agent.Handle(cmd)
+		} else {
+			reply = agent.services[cmd.Service].Handle(cmd) // checked by cmdHandler
+		}
+	}()
+
+	// Wait for the cmd to complete.
+	var timeout <-chan time.Time
+	if cmd.Cmd == "Update" {
+		timeout = time.After(5 * time.Minute)
+	} else {
+		timeout = time.After(20 * time.Second)
+	}
+	var reply *proto.Reply
+	timedOut := false
+	select {
+	case reply = <-cmdReply:
+		pct.AgentMetrics.Add("cmd/count", 1)
+		pct.AgentMetrics.Add("cmd/exec_time", time.Now().Sub(t0).Seconds()*1000)
+	case <-timeout:
+		reply = cmd.Reply(nil, pct.CmdTimeoutError{Cmd: cmd.Cmd})
+		pct.AgentMetrics.Add("cmd/timeouts", 1)
+		timedOut = true
+	}
+	agent.audit(cmd, reply, t0, timedOut)
+	if cmd.Cmd == "SetConfig" && !timedOut && reply != nil && reply.Error == "" {
+		agent.bus.Publish(bus.Event{Topic: bus.CONFIG_CHANGED, Source: "agent", Data: cmd.Service})
+	}
+	return reply
+}
+
+// replyDuplicate sends the cached reply to a re-sent cmd, see ReplyCache.
+func (agent *Agent) replyDuplicate(lc *localCmd, reply *proto.Reply) {
+	agent.logger.Info("Duplicate", lc.cmd, ", replying from cache")
+	pct.AgentMetrics.Add("cmd/duplicates", 1)
+	agent.sendReply(lc, reply)
+}
+
+// sendReply sends the reply to the ctl socket if the cmd is local, else to
+// the API.
+func (agent *Agent) sendReply(lc *localCmd, reply *proto.Reply) {
+	if lc.replyChan != nil {
+		if reply == nil {
+			reply = lc.cmd.Reply(nil) // ctl always waits for a reply
+		}
+		lc.replyChan <- reply
+	} else if reply != nil {
+		agent.reply(reply)
+	} else {
+		agent.logger.Info(lc.cmd, "executed, no reply")
 	}
 }
 
@@ -441,12 +926,38 @@ func (agent *Agent) Handle(cmd *proto.Cmd) *proto.Reply {
 		data, errs = agent.handleGetConfig(cmd)
 	case "GetAllConfigs":
 		data, errs = agent.handleGetAllConfigs(cmd)
+	case "GetConfigSchema":
+		data, errs = agent.handleGetConfigSchema(cmd)
 	case "SetConfig":
 		data, errs = agent.handleSetConfig(cmd)
+	case "ValidateConfig":
+		data, errs = agent.handleValidateConfig(cmd)
 	case "Update":
 		data, errs = agent.handleUpdate(cmd)
 	case "Version":
 		data, errs = agent.handleVersion(cmd)
+	case "Reload":
+		data, errs = agent.handleReload(cmd)
+	case "Pause":
+		data, errs = agent.handlePause(cmd)
+	case "Resume":
+		data, errs = agent.handleResume(cmd)
+	case "Offline":
+		data, errs = agent.handleOffline(cmd)
+	case "Online":
+		data, errs = agent.handleOnline(cmd)
+	case "Drain":
+		data, errs = agent.handleDrain(cmd)
+	case "GetAuditLog":
+		data, errs = agent.handleGetAuditLog(cmd)
+	case "Debug":
+		data, errs = agent.handleDebug(cmd)
+	case "Rollback":
+		data, errs = agent.handleRollback(cmd)
+	case "RotateApiKey":
+		data, errs = agent.handleRotateApiKey(cmd)
+	case "ApplyConfigGroup":
+		data, errs = agent.handleApplyConfigGroup(cmd)
 	case "Reconnect":
 		/*
 			Reconnect is a special case: there's no reply because we can't
@@ -494,6 +1005,10 @@ func (agent *Agent) handleStartService(cmd *proto.Cmd) (interface{}, error) {
 		return nil, pct.UnknownServiceError{Service: s.Name}
 	}
 
+	if agent.isPausedService(s.Name) {
+		return nil, fmt.Errorf("Cannot start %s: agent is paused, Resume first", s.Name)
+	}
+
 	// Start the service.
 	if err := m.Start(); err != nil {
 		return nil, err
@@ -534,6 +1049,10 @@ func (agent *Agent) handleGetConfig(cmd *proto.Cmd) (interface{}, []error) {
 
 // Handle:@goroutine[3]
 func (agent *Agent) handleGetAllConfigs(cmd *proto.Cmd) (interface{}, []error) {
+	return agent.allConfigs()
+}
+
+func (agent *Agent) allConfigs() ([]proto.AgentConfig, []error) {
 	configs, errs := agent.GetConfig()
 	for service, manager := range agent.services {
 		if manager == nil { // should not happen
@@ -553,13 +1072,54 @@ func (agent *Agent) handleGetAllConfigs(cmd *proto.Cmd) (interface{}, []error) {
 	return configs, errs
 }
 
+// Handle:@goroutine[3]
+func (agent *Agent) handleGetConfigSchema(cmd *proto.Cmd) (interface{}, []error) {
+	agent.status.UpdateRe("agent-cmd-handler", "GetConfigSchema", cmd)
+	schemas := []pct.ConfigSchema{agent.ConfigSchema()}
+
+	// Services are in a map, so sort them for a stable reply.
+	names := make([]string, 0, len(agent.services))
+	for service := range agent.services {
+		names = append(names, service)
+	}
+	sort.Strings(names)
+	for _, service := range names {
+		if r, ok := agent.services[service].(pct.ConfigSchemaReporter); ok {
+			schemas = append(schemas, r.ConfigSchema())
+		}
+	}
+	return schemas, nil
+}
+
+// ConfigSchema describes Config.  The constraints must match LoadConfig.
+func (agent *Agent) ConfigSchema() pct.ConfigSchema {
+	s := pct.NewConfigSchema("agent", Config{
+		ApiHostname:      DEFAULT_API_HOSTNAME,
+		Keepalive:        DEFAULT_KEEPALIVE,
+		HeartbeatTimeout: DEFAULT_HEARTBEAT_TIMEOUT,
+		PidFile:          DEFAULT_PIDFILE,
+	})
+	// Links are internal only, not really part of the agent config.
+	fields := []pct.ConfigField{}
+	for _, f := range s.Fields {
+		if f.Name != "Links" {
+			fields = append(fields, f)
+		}
+	}
+	s.Fields = fields
+	s.Field("ApiKey").Required = true
+	s.Field("AgentUuid").Required = true
+	s.Field("StatusTime").Values = []string{"utc", "local"}
+	return s
+}
+
 // Handle:@goroutine[3]
 func (agent *Agent) handleSetConfig(cmd *proto.Cmd) (interface{}, []error) {
 	agent.status.UpdateRe("agent-cmd-handler", "SetConfig", cmd)
 	agent.logger.Info(cmd)
 
 	newConfig := &Config{}
-	if err := json.Unmarshal(cmd.Data, newConfig); err != nil {
+	if err := pct.UnmarshalConfig(cmd.Data, newConfig); err != nil {
 		return nil, []error{err}
 	}
 
@@ -569,10 +1129,22 @@ func (agent *Agent) handleSetConfig(cmd *proto.Cmd) (interface{}, []error) {
 
 	errs := []error{}
 
+	// Change the proxy.  This is dynamic but only new connections, like
+	// the API connect below, use it.
+	if newConfig.Proxy != "" && newConfig.Proxy != finalConfig.Proxy {
+		if err := pct.SetProxy(newConfig.Proxy); err != nil {
+			errs = append(errs, err)
+		} else {
+			agent.logger.Warn("Changing proxy from", finalConfig.Proxy, "to", newConfig.Proxy,
+				"; send Reconnect to use it")
+			finalConfig.Proxy = newConfig.Proxy
+		}
+	}
+
 	// Change the API key.
 	if newConfig.ApiKey != "" && newConfig.ApiKey != finalConfig.ApiKey {
 		agent.logger.Warn("Changing API key from", finalConfig.ApiKey, "to", newConfig.ApiKey)
-		if err := agent.api.Connect(agent.api.Hostname(), newConfig.ApiKey, agent.api.AgentUuid()); err != nil {
+		if err := agent.api.Connect(finalConfig.ApiHostname, newConfig.ApiKey, agent.api.AgentUuid()); err != nil {
 			errs = append(errs, errors.New("agent.api.Connect:ApiKey:"+err.Error()))
 		} else {
 			finalConfig.ApiKey = newConfig.ApiKey
@@ -590,12 +1162,74 @@ func (agent *Agent) handleSetConfig(cmd *proto.Cmd) (interface{}, []error) {
 	}
 
 	// Change keepalive if valid. It is not dynamic.
-	if newConfig.Keepalive > 0 {
+	if newConfig.Keepalive > 0 && newConfig.Keepalive != finalConfig.Keepalive {
 		agent.logger.Warn("Changing keepalive from", finalConfig.Keepalive, "to", newConfig.Keepalive,
 			"; restart agent to take effect")
 		finalConfig.Keepalive = newConfig.Keepalive
 	}
 
+	// Change the heartbeat timeout.  It is dynamic.
+	if newConfig.HeartbeatTimeout > 0 && newConfig.HeartbeatTimeout != finalConfig.HeartbeatTimeout {
+		if err := validateHeartbeatTimeout(newConfig.HeartbeatTimeout, finalConfig.Keepalive); err != nil {
+			errs = append(errs, err)
+		} else {
+			agent.logger.Info("Changing heartbeat timeout from", finalConfig.HeartbeatTimeout, "to", newConfig.HeartbeatTimeout)
+			finalConfig.HeartbeatTimeout = newConfig.HeartbeatTimeout
+		}
+	}
+
+	// Change the local HTTP status address.  It is not dynamic.
+	if newConfig.StatusAddr != "" && newConfig.StatusAddr != finalConfig.StatusAddr {
+		agent.logger.Warn("Changing status address from", finalConfig.StatusAddr, "to", newConfig.StatusAddr,
+			"; restart agent to take effect")
+		finalConfig.StatusAddr = newConfig.StatusAddr
+	}
+
+	// Change the debug listener address.  Use the Debug cmd to start or stop
+	// the debug listener now.
+	if newConfig.DebugAddr != "" && newConfig.DebugAddr != finalConfig.DebugAddr {
+		agent.logger.Warn("Changing debug address from", finalConfig.DebugAddr, "to", newConfig.DebugAddr,
+			"; restart agent or send Debug cmd to take effect")
+		finalConfig.DebugAddr = newConfig.DebugAddr
+	}
+
+	// Change the update rollback timeout.  It applies after the next Update.
+	if newConfig.UpdateTimeout > 0 && newConfig.UpdateTimeout != finalConfig.UpdateTimeout {
+		agent.logger.Info("Changing update timeout from", finalConfig.UpdateTimeout, "to", newConfig.UpdateTimeout)
+		finalConfig.UpdateTimeout = newConfig.UpdateTimeout
+	}
+
+	// Change the update window.  It applies to the next Update.
+	if newConfig.UpdateWindow != "" && newConfig.UpdateWindow != finalConfig.UpdateWindow {
+		if _, err := ParseUpdateWindow(newConfig.UpdateWindow); err != nil {
+			errs = append(errs, err)
+		} else {
+			agent.logger.Info("Changing update window from", finalConfig.UpdateWindow, "to", newConfig.UpdateWindow)
+			finalConfig.UpdateWindow = newConfig.UpdateWindow
+		}
+	}
+
+	// Change the update channel.  It applies to the next Update.
+	if newConfig.UpdateChannel != "" && newConfig.UpdateChannel != finalConfig.UpdateChannel {
+		if err := pct.ValidateUpdateChannel(newConfig.UpdateChannel); err != nil {
+			errs = append(errs, err)
+		} else {
+			agent.logger.Info("Changing update channel from", finalConfig.UpdateChannel, "to", newConfig.UpdateChannel)
+			finalConfig.UpdateChannel = newConfig.UpdateChannel
+		}
+	}
+
+	// Change how times are shown in status.  This is dynamic.
+	if newConfig.StatusTime != "" && newConfig.StatusTime != finalConfig.StatusTime {
+		if err := validateStatusTime(newConfig.StatusTime); err != nil {
+			errs = append(errs, err)
+		} else {
+			agent.logger.Info("Changing status time from", finalConfig.StatusTime, "to", newConfig.StatusTime)
+			finalConfig.StatusTime = newConfig.StatusTime
+			pct.SetLocalTime(finalConfig.StatusTime == "local")
+		}
+	}
+
 	// Write the new, updated config.  If this fails, agent will use old config if restarted.
 	if err := pct.Basedir.WriteConfig("agent", finalConfig); err != nil {
 		errs = append(errs, errors.New("agent.WriteConfig:"+err.Error()))
@@ -609,10 +1243,112 @@ func (agent *Agent) handleSetConfig(cmd *proto.Cmd) (interface{}, []error) {
 	return &finalConfig, errs
 }
 
+// Handle:@goroutine[3]
+func (agent *Agent) handleValidateConfig(cmd *proto.Cmd) (interface{}, []error) {
+	agent.status.UpdateRe("agent-cmd-handler", "ValidateConfig", cmd)
+	agent.logger.Info(cmd)
+
+	newConfig := &Config{}
+	if err := pct.UnmarshalConfig(cmd.Data, newConfig); err != nil {
+		return nil, []error{err}
+	}
+
+	agent.configMux.RLock()
+	currentConfig := *agent.config // copy current config
+	agent.configMux.RUnlock()
+
+	// Same as SetConfig, but change only this copy.
+	finalConfig := currentConfig
+	errs := []error{}
+	if newConfig.ApiKey != "" {
+		finalConfig.ApiKey = newConfig.ApiKey
+	}
+	if newConfig.ApiHostname != "" {
+		finalConfig.ApiHostname = newConfig.ApiHostname
+	}
+	if newConfig.Keepalive > 0 {
+		finalConfig.Keepalive = newConfig.Keepalive
+	}
+	if newConfig.HeartbeatTimeout > 0 {
+		if err := validateHeartbeatTimeout(newConfig.HeartbeatTimeout, finalConfig.Keepalive); err != nil {
+			errs = append(errs, err)
+		} else {
+			finalConfig.HeartbeatTimeout = newConfig.HeartbeatTimeout
+		}
+	}
+	if newConfig.StatusAddr != "" {
+		finalConfig.StatusAddr = newConfig.StatusAddr
+	}
+	if newConfig.DebugAddr != "" {
+		finalConfig.DebugAddr = newConfig.DebugAddr
+	}
+	if newConfig.UpdateTimeout > 0 {
+		finalConfig.UpdateTimeout = newConfig.UpdateTimeout
+	}
+	if newConfig.UpdateWindow != "" {
+		if _, err := ParseUpdateWindow(newConfig.UpdateWindow); err != nil {
+			errs = append(errs, err)
+		} else {
+			finalConfig.UpdateWindow = newConfig.UpdateWindow
+		}
+	}
+	if newConfig.UpdateChannel != "" {
+		if err := pct.ValidateUpdateChannel(newConfig.UpdateChannel); err != nil {
+			errs = append(errs, err)
+		} else {
+			finalConfig.UpdateChannel = newConfig.UpdateChannel
+		}
+	}
+	if newConfig.Proxy != "" {
+		if _, err := pct.ParseProxy(newConfig.Proxy); err != nil {
+			errs = append(errs, err)
+		} else {
+			finalConfig.Proxy = newConfig.Proxy
+		}
+	}
+	if newConfig.StatusTime != "" {
+		if err := validateStatusTime(newConfig.StatusTime); err != nil {
+			errs = append(errs, err)
+		} else {
+			finalConfig.StatusTime = newConfig.StatusTime
+		}
+	}
+
+	// Test connecting to the API with a new API so the current connection
+	// and links are not changed.
+	if finalConfig.ApiKey != currentConfig.ApiKey || finalConfig.ApiHostname != currentConfig.ApiHostname {
+		api := pct.NewAPI()
+		api.SignRequests(finalConfig.SignRequests)
+		if err := api.Connect(finalConfig.ApiHostname, finalConfig.ApiKey, agent.api.AgentUuid()); err != nil {
+			errs = append(errs, errors.New("agent.api.Connect:"+err.Error()))
+		}
+	}
+
+	// Don't report API keys, only that it changes.
+	currentConfig.Links = nil
+	finalConfig.Links = nil
+	if finalConfig.ApiKey != currentConfig.ApiKey {
+		currentConfig.ApiKey = "<old>"
+		finalConfig.ApiKey = "<new>"
+	}
+	changes, err := pct.ConfigChanges(currentConfig, finalConfig)
+	if err != nil {
+		errs = append(errs, err)
+	}
+	return changes, errs
+}
+
 func (agent *Agent) handleVersion(cmd *proto.Cmd) (interface{}, []error) {
-	v := &proto.Version{
-		Running:  VERSION + REL,
-		Revision: REVISION,
+	agent.updateMux.Lock()
+	available := agent.availableVersion
+	agent.updateMux.Unlock()
+	v := &VersionInfo{
+		Version: proto.Version{
+			Running:  VERSION + REL,
+			Revision: REVISION,
+		},
+		Channel:   agent.updater.Channel(),
+		Available: available,
 	}
 	bin, err := filepath.Abs(os.Args[0])
 	if err != nil {
@@ -627,15 +1363,14 @@ func (agent *Agent) handleVersion(cmd *proto.Cmd) (interface{}, []error) {
 }
 
 // Handle:@goroutine[3]
-func (agent *Agent) handleUpdate(cmd *proto.Cmd) (interface{}, []error) {
-	agent.status.UpdateRe("agent-cmd-handler", "Update", cmd)
+func (agent *Agent) handleRollback(cmd *proto.Cmd) (interface{}, []error) {
+	agent.status.UpdateRe("agent-cmd-handler", "Rollback", cmd)
 	agent.logger.Info(cmd)
-	version := string(cmd.Data)
-	if version == "" {
-		return nil, []error{fmt.Errorf("Invalid version: '%s'", version)}
+	version, err := agent.updater.Rollback()
+	if err != nil {
+		return nil, []error{err}
 	}
-	err := agent.updater.Update(version)
-	return nil, []error{err}
+	return version, nil
 }
 
 //---------------------------------------------------------------------------
@@ -658,17 +1393,17 @@ func (agent *Agent) statusHandler() {
 	for {
 		select {
 		case cmd := <-agent.statusChan:
-			switch cmd.Service {
-			case "":
-				replyChan <- cmd.Reply(agent.AllStatus())
-			case "agent":
-				replyChan <- cmd.Reply(agent.Status())
-			default:
-				if manager, ok := agent.services[cmd.Service]; ok {
-					replyChan <- cmd.Reply(manager.Status())
-				} else {
-					replyChan <- cmd.Reply(nil, pct.UnknownServiceError{Service: cmd.Service})
-				}
+			var status interface{}
+			var err error
+			if cmd.Cmd == "StatusHistory" {
+				status, err = agent.ServiceStatusHistory(cmd.Service)
+			} else {
+				status, err = agent.ServiceStatus(cmd.Service)
+			}
+			if err != nil {
+				replyChan <- cmd.Reply(nil, err)
+			} else {
+				replyChan <- cmd.Reply(status)
 			}
 		case <-agent.statusHandlerSync.StopChan:
 			agent.statusHandlerSync.Graceful()
@@ -677,13 +1412,72 @@ func (agent *Agent) statusHandler() {
 	}
 }
 
+// ServiceStatus returns the status of the service: "" for all services,
+// "agent" for only the agent, else the service name.
+func (agent *Agent) ServiceStatus(service string) (map[string]string, error) {
+	switch service {
+	case "":
+		return agent.allStatus(), nil
+	case "agent":
+		return agent.Status(), nil
+	}
+	manager, ok := agent.services[service]
+	if !ok {
+		return nil, pct.UnknownServiceError{Service: service}
+	}
+	return manager.Status(), nil
+}
+
 // statusHandler:@goroutine[2]
 func (agent *Agent) Status() map[string]string {
-	return agent.status.Merge(agent.client.Status())
+	status := agent.status.Merge(agent.client.Status())
+	if paused := agent.Paused(); !paused.IsZero() {
+		status["agent-paused"] = "Paused since " + pct.TimeString(paused)
+	}
+	if v := agent.ApiProtocol(); v > 0 {
+		status["agent-api-protocol"] = fmt.Sprintf("%d (agent %d)", v, PROTOCOL_VERSION)
+	}
+	if hb := agent.heartbeat.status(); hb != "" {
+		status["agent-heartbeat"] = hb
+	}
+	if clock := pct.ClockStatus(); clock != "" {
+		status["agent-clock"] = clock
+	}
+	return status
+}
+
+// ServiceStatusEntries is ServiceStatus structured, see pct.StatusEntry.
+func (agent *Agent) ServiceStatusEntries(service string) (map[string]pct.StatusEntry, error) {
+	status, err := agent.ServiceStatus(service)
+	if err != nil {
+		return nil, err
+	}
+	return pct.StructuredStatus(status), nil
 }
 
+// ServiceStatusHistory returns the last status transitions of the service, like
+// ServiceStatus, see pct.StatusHistory.
+func (agent *Agent) ServiceStatusHistory(service string) (map[string][]pct.StatusEntry, error) {
+	status, err := agent.ServiceStatus(service)
+	if err != nil {
+		return nil, err
+	}
+	procs := make([]string, 0, len(status))
+	for proc := range status {
+		procs = append(procs, proc)
+	}
+	return pct.StatusHistory(procs), nil
+}
+
+// AllStatus returns the structured status of the agent and all services, e.g.
+// to tell an agent idle for 2s from one stuck for 2 hours.  The Status cmd
+// replies with the flat status (see ServiceStatus) for the API.
 // statusHandler:@goroutine[2]
-func (agent *Agent) AllStatus() map[string]string {
+func (agent *Agent) AllStatus() map[string]pct.StatusEntry {
+	return pct.StructuredStatus(agent.allStatus())
+}
+
+func (agent *Agent) allStatus() map[string]string {
 	status := agent.Status()
 	for service, manager := range agent.services {
 		if manager == nil { // should not happen
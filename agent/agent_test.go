@@ -19,8 +19,10 @@ package agent_test
 
 import (
 	"encoding/json"
+	"fmt"
 	"github.com/percona/cloud-protocol/proto/v1"
 	"github.com/percona/percona-agent/agent"
+	"github.com/percona/percona-agent/bus"
 	"github.com/percona/percona-agent/pct"
 	pctCmd "github.com/percona/percona-agent/pct/cmd"
 	"github.com/percona/percona-agent/qan"
@@ -28,9 +30,12 @@ import (
 	"github.com/percona/percona-agent/test/mock"
 	. "gopkg.in/check.v1"
 	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
 	"sort"
+	"strings"
 	"testing"
 	"time"
 )
@@ -57,6 +62,8 @@ type AgentTestSuite struct {
 	sendChan     chan *proto.Cmd
 	recvChan     chan *proto.Reply
 	api          *mock.API
+	spool        *mock.Spooler
+	bus          *bus.Bus
 	agentRunning bool
 	// --
 	readyChan  chan bool
@@ -97,6 +104,8 @@ func (s *AgentTestSuite) SetUpSuite(t *C) {
 	s.recvDataChan = make(chan interface{}, 5)
 	s.client = mock.NewWebsocketClient(s.sendChan, s.recvChan, s.sendDataChan, s.recvDataChan)
 	s.client.ErrChan = make(chan error)
+	s.spool = mock.NewSpooler(nil)
+	s.bus = bus.New()
 
 	s.readyChan = make(chan bool, 2)
 	s.traceChan = make(chan string, 10)
@@ -111,8 +120,9 @@ func (s *AgentTestSuite) SetUpTest(t *C) {
 	s.services["mm"] = mock.NewMockServiceManager("mm", s.readyChan, s.traceChan)
 
 	links := map[string]string{
-		"agent":     "http://localhost/agent",
-		"instances": "http://localhost/instances",
+		"agent":         "http://localhost/agent",
+		"instances":     "http://localhost/instances",
+		"config-groups": "http://localhost/config-groups",
 	}
 	s.api = mock.NewAPI("http://localhost", s.config.ApiHostname, s.config.ApiKey, s.config.AgentUuid, links)
 
@@ -120,7 +130,7 @@ func (s *AgentTestSuite) SetUpTest(t *C) {
 		"mm":  s.services["mm"],
 		"qan": s.services["qan"],
 	}
-	s.agent = agent.NewAgent(s.config, s.logger, s.api, s.client, s.servicesMap)
+	s.agent = agent.NewAgent(s.config, s.logger, s.api, s.client, s.servicesMap, s.spool, s.bus)
 
 	// Run the agent.
 	s.agentRunning = true
@@ -367,6 +377,48 @@ func (s *AgentTestSuite) TestStartStopService(t *C) {
 	t.Check(status["mm"], Equals, "")
 }
 
+func (s *AgentTestSuite) TestDuplicateCmd(t *C) {
+	qanConfigData, _ := json.Marshal(&qan.Config{Interval: 60, MaxWorkers: 2, WorkerRunTime: 120})
+	serviceData, _ := json.Marshal(&proto.ServiceData{Name: "qan", Config: qanConfigData})
+	cmd := &proto.Cmd{
+		Ts:      time.Now(),
+		User:    "daniel",
+		Service: "agent",
+		Cmd:     "StartService",
+		Data:    serviceData,
+	}
+	s.readyChan <- true
+	s.sendChan <- cmd
+	gotReplies := test.WaitReply(s.recvChan)
+	t.Assert(gotReplies, HasLen, 1)
+	t.Check(gotReplies[0].Error, Equals, "")
+	t.Check(test.WaitTrace(s.traceChan), DeepEquals, []string{"Start qan"})
+
+	// API re-sends the cmd after a reconnect: same reply, not started again,
+	// i.e. no ServiceIsRunningError.
+	s.sendChan <- cmd
+	dupReplies := test.WaitReply(s.recvChan)
+	t.Assert(dupReplies, HasLen, 1)
+	t.Check(dupReplies[0], DeepEquals, gotReplies[0])
+	t.Check(test.WaitTrace(s.traceChan), HasLen, 0)
+
+	// The reply is saved for the next agent process, e.g. after Restart.
+	store, err := pct.Basedir.Store()
+	t.Assert(err, IsNil)
+	c := agent.NewReplyCache(store, agent.REPLY_CACHE_SIZE, agent.REPLY_CACHE_TTL)
+	t.Check(c.Get(cmd), NotNil)
+
+	// A new cmd has a new Ts.
+	newCmd := *cmd
+	newCmd.Ts = time.Now()
+	t.Check(c.Get(&newCmd), IsNil)
+
+	// Only DEDUP_CMDS are cached.
+	status := &proto.Cmd{Ts: time.Now(), Service: "agent", Cmd: "Status"}
+	t.Check(c.Add(status, status.Reply(nil)), IsNil)
+	t.Check(c.Get(status), IsNil)
+}
+
 func (s *AgentTestSuite) TestStartServiceSlow(t *C) {
 	// This test is like TestStartService but simulates a slow starting service.
 
@@ -474,11 +526,12 @@ func (s *AgentTestSuite) TestLoadConfig(t *C) {
 		t.Fatal(err)
 	}
 	expect := &agent.Config{
-		AgentUuid:   "abc-123-def",
-		ApiHostname: agent.DEFAULT_API_HOSTNAME,
-		ApiKey:      "123",
-		Keepalive:   agent.DEFAULT_KEEPALIVE,
-		PidFile:     agent.DEFAULT_PIDFILE,
+		AgentUuid:        "abc-123-def",
+		ApiHostname:      agent.DEFAULT_API_HOSTNAME,
+		ApiKey:           "123",
+		Keepalive:        agent.DEFAULT_KEEPALIVE,
+		HeartbeatTimeout: agent.DEFAULT_HEARTBEAT_TIMEOUT,
+		PidFile:          agent.DEFAULT_PIDFILE,
 	}
 	if same, diff := test.IsDeeply(got, expect); !same {
 		// @todo: if expect is not ptr, IsDeeply dies with "got ptr, expected struct"
@@ -496,11 +549,12 @@ func (s *AgentTestSuite) TestLoadConfig(t *C) {
 		t.Fatal(err)
 	}
 	expect = &agent.Config{
-		ApiHostname: "agent hostname",
-		ApiKey:      "api key",
-		AgentUuid:   "agent uuid",
-		Keepalive:   agent.DEFAULT_KEEPALIVE,
-		PidFile:     "pid file",
+		ApiHostname:      "agent hostname",
+		ApiKey:           "api key",
+		AgentUuid:        "agent uuid",
+		Keepalive:        agent.DEFAULT_KEEPALIVE,
+		HeartbeatTimeout: agent.DEFAULT_HEARTBEAT_TIMEOUT,
+		PidFile:          "pid file",
 	}
 	if same, diff := test.IsDeeply(got, expect); !same {
 		test.Dump(got)
@@ -586,6 +640,185 @@ func (s *AgentTestSuite) TestGetAllConfigs(t *C) {
 	}
 }
 
+func (s *AgentTestSuite) TestHTTPStatus(t *C) {
+	server := httptest.NewServer(s.agent.HTTPHandler())
+	defer server.Close()
+
+	get := func(path string, v interface{}) int {
+		resp, err := http.Get(server.URL + path)
+		t.Assert(err, IsNil)
+		defer resp.Body.Close()
+		if resp.StatusCode == http.StatusOK {
+			err = json.NewDecoder(resp.Body).Decode(v)
+			t.Assert(err, IsNil)
+		}
+		return resp.StatusCode
+	}
+
+	// All status, like the Status cmd but structured.
+	status := map[string]pct.StatusEntry{}
+	t.Check(get("/status", &status), Equals, http.StatusOK)
+	agentStatus, ok := status["agent"]
+	t.Check(ok, Equals, true)
+	t.Check(agentStatus.State, Equals, "Idle")
+	t.Check(agentStatus.Since.IsZero(), Equals, false)
+	_, ok = status["mm"]
+	t.Check(ok, Equals, true)
+
+	// Only one service.
+	status = map[string]pct.StatusEntry{}
+	t.Check(get("/status/mm", &status), Equals, http.StatusOK)
+	_, ok = status["mm"]
+	t.Check(ok, Equals, true)
+	_, ok = status["agent"]
+	t.Check(ok, Equals, false)
+
+	t.Check(get("/status/foo", &status), Equals, http.StatusNotFound)
+
+	// Configs, but never the API key.
+	configs := []proto.AgentConfig{}
+	t.Check(get("/config", &configs), Equals, http.StatusOK)
+	t.Check(configs, HasLen, 3) // agent, mm, qan
+	for _, config := range configs {
+		if config.InternalService == "agent" {
+			t.Check(strings.Contains(config.Config, s.config.ApiKey), Equals, false)
+			t.Check(strings.Contains(config.Config, s.config.AgentUuid), Equals, true)
+		}
+	}
+
+	configs = []proto.AgentConfig{}
+	t.Check(get("/config/qan", &configs), Equals, http.StatusOK)
+	t.Assert(configs, HasLen, 1)
+	t.Check(configs[0].InternalService, Equals, "qan")
+}
+
+func (s *AgentTestSuite) TestHTTPUI(t *C) {
+	// The web page is off by default.
+	server := httptest.NewServer(s.agent.HTTPHandler())
+	resp, err := http.Get(server.URL + "/")
+	t.Assert(err, IsNil)
+	resp.Body.Close()
+	server.Close()
+	t.Check(resp.StatusCode, Equals, http.StatusNotFound)
+
+	config := *s.config
+	config.StatusUI = true
+	a := agent.NewAgent(&config, s.logger, s.api, s.client, s.servicesMap, s.spool, s.bus)
+	server = httptest.NewServer(a.HTTPHandler())
+	defer server.Close()
+
+	resp, err = http.Get(server.URL + "/")
+	t.Assert(err, IsNil)
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	t.Assert(err, IsNil)
+	t.Check(resp.StatusCode, Equals, http.StatusOK)
+	t.Check(resp.Header.Get("Content-Type"), Equals, "text/html; charset=utf-8")
+	t.Check(strings.Contains(string(body), "percona-agent "+agent.VERSION), Equals, true)
+	t.Check(strings.Contains(string(body), "<td>mm</td>"), Equals, true)
+	t.Check(strings.Contains(string(body), s.config.ApiKey), Equals, false)
+
+	// The JSON endpoints still work, and other paths are not the page.
+	resp, err = http.Get(server.URL + "/status/mm")
+	t.Assert(err, IsNil)
+	resp.Body.Close()
+	t.Check(resp.StatusCode, Equals, http.StatusOK)
+	resp, err = http.Get(server.URL + "/foo")
+	t.Assert(err, IsNil)
+	resp.Body.Close()
+	t.Check(resp.StatusCode, Equals, http.StatusNotFound)
+}
+
+func (s *AgentTestSuite) TestDebug(t *C) {
+	debugCmd := func(debug *agent.Debug) *agent.Debug {
+		cmd := &proto.Cmd{Ts: time.Now(), User: "daniel", Service: "agent", Cmd: "Debug"}
+		if debug != nil {
+			cmd.Data, _ = json.Marshal(debug)
+		}
+		s.sendChan <- cmd
+		gotReplies := test.WaitReply(s.recvChan)
+		t.Assert(len(gotReplies), Equals, 1)
+		t.Assert(gotReplies[0].Error, Equals, "")
+		got := &agent.Debug{}
+		err := json.Unmarshal(gotReplies[0].Data, got)
+		t.Assert(err, IsNil)
+		return got
+	}
+
+	// Off by default.
+	t.Check(debugCmd(nil), DeepEquals, &agent.Debug{})
+
+	// The API can only start it on a loopback address.
+	data, _ := json.Marshal(&agent.Debug{On: true, Addr: "0.0.0.0:0"})
+	s.sendChan <- &proto.Cmd{Ts: time.Now(), User: "daniel", Service: "agent", Cmd: "Debug", Data: data}
+	gotReplies := test.WaitReply(s.recvChan)
+	t.Assert(gotReplies, HasLen, 1)
+	t.Check(gotReplies[0].Error, Matches, "Invalid debug address 0.0.0.0:0: .+")
+
+	debug := debugCmd(&agent.Debug{On: true, Addr: "127.0.0.1:0"})
+	t.Assert(debug.On, Equals, true)
+	t.Assert(debug.Addr, Not(Equals), "")
+
+	resp, err := http.Get("http://" + debug.Addr + "/debug/runtime")
+	t.Assert(err, IsNil)
+	stats := &agent.RuntimeStats{}
+	err = json.NewDecoder(resp.Body).Decode(stats)
+	resp.Body.Close()
+	t.Assert(err, IsNil)
+	t.Check(stats.NumGoroutine > 0, Equals, true)
+
+	resp, err = http.Get("http://" + debug.Addr + "/debug/pprof/goroutine?debug=1")
+	t.Assert(err, IsNil)
+	resp.Body.Close()
+	t.Check(resp.StatusCode, Equals, http.StatusOK)
+
+	t.Check(debugCmd(&agent.Debug{On: false}), DeepEquals, &agent.Debug{})
+	_, err = http.Get("http://" + debug.Addr + "/debug/runtime")
+	t.Check(err, NotNil)
+}
+
+func (s *AgentTestSuite) TestCtl(t *C) {
+	socket := pct.Basedir.File("ctl-socket")
+
+	// Status is handled immediately.  Run creates the socket, so retry until
+	// the agent is listening.
+	var reply *proto.Reply
+	var err error
+	for i := 0; i < 20; i++ {
+		if reply, err = agent.Ctl(socket, &proto.Cmd{Cmd: "Status", Service: "agent"}); err == nil {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	t.Assert(err, IsNil)
+	t.Check(reply.Error, Equals, "")
+	status := map[string]string{}
+	err = json.Unmarshal(reply.Data, &status)
+	t.Assert(err, IsNil)
+	t.Check(status["agent"], Equals, "Idle")
+
+	reply, err = agent.Ctl(socket, &proto.Cmd{Cmd: "Status", Service: "foo"})
+	t.Assert(err, IsNil)
+	t.Check(reply.Error, Not(Equals), "")
+
+	// Other cmds are handled like cmds from the API, but the reply is
+	// sent back on the socket, not to the API.
+	reply, err = agent.Ctl(socket, &proto.Cmd{Service: "agent", Cmd: "GetAllConfigs"})
+	t.Assert(err, IsNil)
+	t.Check(reply.Error, Equals, "")
+	t.Check(reply.Cmd, Equals, "GetAllConfigs")
+	configs := []proto.AgentConfig{}
+	err = json.Unmarshal(reply.Data, &configs)
+	t.Assert(err, IsNil)
+	t.Check(configs, HasLen, 3) // agent, mm, qan
+
+	select {
+	case reply := <-s.recvChan:
+		t.Errorf("Reply sent to API: %+v", reply)
+	default:
+	}
+}
+
 func (s *AgentTestSuite) TestGetVersion(t *C) {
 	cmd := &proto.Cmd{
 		Ts:      time.Now(),
@@ -644,7 +877,7 @@ func (s *AgentTestSuite) TestSetConfigApiKey(t *C) {
 	/**
 	 * Verify new agent config on disk.
 	 */
-	data, err = ioutil.ReadFile(s.configFile)
+	data, err = pct.Basedir.ConfigData("agent")
 	t.Assert(err, IsNil)
 	gotConfig = &agent.Config{}
 	if err := json.Unmarshal(data, gotConfig); err != nil {
@@ -706,7 +939,7 @@ func (s *AgentTestSuite) TestSetConfigApiHostname(t *C) {
 	/**
 	 * Verify new agent config on disk.
 	 */
-	data, err = ioutil.ReadFile(s.configFile)
+	data, err = pct.Basedir.ConfigData("agent")
 	t.Assert(err, IsNil)
 	gotConfig = &agent.Config{}
 	if err := json.Unmarshal(data, gotConfig); err != nil {
@@ -752,6 +985,51 @@ func (s *AgentTestSuite) TestSetConfigApiHostname(t *C) {
 	t.Check(gotCalled, DeepEquals, expectCalled)
 }
 
+func (s *AgentTestSuite) TestValidateConfig(t *C) {
+	before, _ := pct.Basedir.ConfigData("agent")
+
+	cmd := &proto.Cmd{
+		Ts:      time.Now(),
+		User:    "daniel",
+		Cmd:     "ValidateConfig",
+		Service: "agent",
+		Data:    []byte(`{"Keepalive":5,"StatusTime":"local"}`),
+	}
+	s.sendChan <- cmd
+
+	got := test.WaitReply(s.recvChan)
+	t.Assert(len(got), Equals, 1)
+	t.Check(got[0].Error, Equals, "")
+	var gotChanges []string
+	if err := json.Unmarshal(got[0].Data, &gotChanges); err != nil {
+		t.Fatal(err)
+	}
+	expectChanges := []string{
+		"Keepalive: 1 -> 5",
+		`StatusTime: null -> "local"`,
+	}
+	t.Check(gotChanges, DeepEquals, expectChanges)
+
+	// Nothing should have changed.
+	config, errs := s.agent.GetConfig()
+	t.Assert(errs, HasLen, 0)
+	gotConfig := &agent.Config{}
+	if err := json.Unmarshal([]byte(config[0].Config), gotConfig); err != nil {
+		t.Fatal(err)
+	}
+	t.Check(gotConfig.Keepalive, Equals, uint(1))
+	t.Check(gotConfig.StatusTime, Equals, "")
+	after, _ := pct.Basedir.ConfigData("agent")
+	t.Check(string(after), Equals, string(before))
+
+	// Invalid values are reported like SetConfig.
+	cmd.Data = []byte(`{"StatusTime":"mars"}`)
+	s.sendChan <- cmd
+	got = test.WaitReply(s.recvChan)
+	t.Assert(len(got), Equals, 1)
+	t.Check(got[0].Error, Matches, "Invalid StatusTime.*")
+}
+
 func (s *AgentTestSuite) TestKeepalive(t *C) {
 	// Agent should be sending a Pong every 1s now which is sent as a
 	// reply to no cmd (it's a platypus).
@@ -795,7 +1073,7 @@ func (s *AgentTestSuite) TestRestart(t *C) {
 		os.Remove(pct.Basedir.File("start-script"))
 	}()
 
-	newAgent := agent.NewAgent(s.config, s.logger, s.api, s.client, s.servicesMap)
+	newAgent := agent.NewAgent(s.config, s.logger, s.api, s.client, s.servicesMap, s.spool, s.bus)
 	doneChan := make(chan error, 1)
 	go func() {
 		doneChan <- newAgent.Run()
@@ -831,6 +1109,44 @@ func (s *AgentTestSuite) TestRestart(t *C) {
 	t.Check(cmdFactory.Cmds[0].Args, IsNil)
 }
 
+func (s *AgentTestSuite) TestRestartByInit(t *C) {
+	s.TearDownTest(t)
+
+	cmdFactory := &mock.CmdFactory{}
+	pctCmd.Factory = cmdFactory
+
+	os.Setenv(agent.ENV_INIT_SYSTEM, "systemd")
+	defer os.Unsetenv(agent.ENV_INIT_SYSTEM)
+
+	newAgent := agent.NewAgent(s.config, s.logger, s.api, s.client, s.servicesMap, s.spool, s.bus)
+	doneChan := make(chan error, 1)
+	go func() {
+		doneChan <- newAgent.Run()
+	}()
+
+	s.sendChan <- &proto.Cmd{
+		Service: "agent",
+		Cmd:     "Restart",
+	}
+
+	replies := test.WaitReply(s.recvChan)
+	t.Assert(replies, HasLen, 1)
+	t.Check(replies[0].Error, Equals, "")
+
+	var err error
+	select {
+	case err = <-doneChan:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Agent did not restart")
+	}
+	t.Check(err, IsNil)
+
+	// The init system restarts the agent, so it doesn't start another.
+	t.Check(newAgent.RestartByInit(), Equals, true)
+	t.Check(pct.FileExists(pct.Basedir.File("start-lock")), Equals, false)
+	t.Check(cmdFactory.Cmds, HasLen, 0)
+}
+
 func (s *AgentTestSuite) TestCmdToService(t *C) {
 	cmd := &proto.Cmd{
 		Service: "mm",
@@ -846,3 +1162,527 @@ func (s *AgentTestSuite) TestCmdToService(t *C) {
 	t.Assert(s.services["mm"].Cmds, HasLen, 1)
 	t.Check(s.services["mm"].Cmds[0].Cmd, Equals, "Hello")
 }
+
+func (s *AgentTestSuite) TestCmdsPerService(t *C) {
+	// A slow mm cmd does not block qan cmds.
+	s.services["mm"].HandleChan = make(chan bool)
+	s.sendChan <- &proto.Cmd{Service: "mm", Cmd: "Slow"}
+	s.sendChan <- &proto.Cmd{Service: "qan", Cmd: "Fast"}
+
+	reply := test.WaitReply(s.recvChan)
+	t.Assert(reply, HasLen, 1)
+	t.Check(reply[0].Cmd, Equals, "Fast")
+
+	s.services["mm"].HandleChan <- true
+	reply = test.WaitReply(s.recvChan)
+	t.Assert(reply, HasLen, 1)
+	t.Check(reply[0].Cmd, Equals, "Slow")
+
+	// Unknown services are rejected.
+	s.sendChan <- &proto.Cmd{Service: "foo", Cmd: "Hello"}
+	reply = test.WaitReply(s.recvChan)
+	t.Assert(reply, HasLen, 1)
+	t.Check(reply[0].Error, Equals, pct.UnknownServiceError{Service: "foo"}.Error())
+}
+
+func (s *AgentTestSuite) TestReload(t *C) {
+	// Forget configs changed by previous tests.
+	_, err := pct.Basedir.ChangedConfigs()
+	t.Assert(err, IsNil)
+
+	// Change an mm config by hand, and add a config for an unknown service
+	// which is ignored.
+	err = ioutil.WriteFile(pct.Basedir.ConfigFile("mm-mysql-1"), []byte(`{"Collect":1}`), 0600)
+	t.Assert(err, IsNil)
+	defer pct.Basedir.RemoveConfig("mm-mysql-1")
+	err = ioutil.WriteFile(pct.Basedir.ConfigFile("foo"), []byte(`{}`), 0600)
+	t.Assert(err, IsNil)
+	defer pct.Basedir.RemoveConfig("foo")
+
+	// Only mm is restarted: stopped, then started.
+	s.readyChan <- true
+	s.readyChan <- true
+	cmd := &proto.Cmd{
+		Ts:      time.Now(),
+		User:    "daniel",
+		Service: "agent",
+		Cmd:     "Reload",
+	}
+	s.sendChan <- cmd
+	gotReplies := test.WaitReply(s.recvChan)
+	t.Assert(len(gotReplies), Equals, 1)
+	t.Check(gotReplies[0].Error, Equals, "")
+	reloaded := []string{}
+	t.Assert(json.Unmarshal(gotReplies[0].Data, &reloaded), IsNil)
+	t.Check(reloaded, DeepEquals, []string{"mm"})
+
+	got := test.WaitTrace(s.traceChan)
+	t.Check(got, DeepEquals, []string{"Stop mm", "Start mm"})
+
+	// Nothing changed since, so nothing is reloaded.
+	s.sendChan <- cmd
+	gotReplies = test.WaitReply(s.recvChan)
+	t.Assert(len(gotReplies), Equals, 1)
+	t.Check(gotReplies[0].Error, Equals, "")
+	reloaded = []string{}
+	t.Assert(json.Unmarshal(gotReplies[0].Data, &reloaded), IsNil)
+	t.Check(reloaded, HasLen, 0)
+	t.Check(test.WaitTrace(s.traceChan), HasLen, 0)
+}
+
+func (s *AgentTestSuite) TestPauseResume(t *C) {
+	// Pause stops qan and mm (data and sysconfig aren't in this test).
+	s.readyChan <- true
+	s.readyChan <- true
+	cmd := &proto.Cmd{
+		Ts:      time.Now(),
+		User:    "daniel",
+		Service: "agent",
+		Cmd:     "Pause",
+	}
+	s.sendChan <- cmd
+	gotReplies := test.WaitReply(s.recvChan)
+	t.Assert(len(gotReplies), Equals, 1)
+	t.Check(gotReplies[0].Error, Equals, "")
+	t.Check(test.WaitTrace(s.traceChan), DeepEquals, []string{"Stop qan", "Stop mm"})
+
+	status := s.agent.Status()
+	t.Check(strings.HasPrefix(status["agent-paused"], "Paused since "), Equals, true)
+
+	// Paused services can't be started, and can't be paused again.
+	data, _ := json.Marshal(&proto.ServiceData{Name: "qan"})
+	s.sendChan <- &proto.Cmd{Service: "agent", Cmd: "StartService", Data: data}
+	gotReplies = test.WaitReply(s.recvChan)
+	t.Assert(len(gotReplies), Equals, 1)
+	t.Check(gotReplies[0].Error, Not(Equals), "")
+	s.sendChan <- cmd
+	gotReplies = test.WaitReply(s.recvChan)
+	t.Assert(len(gotReplies), Equals, 1)
+	t.Check(gotReplies[0].Error, Not(Equals), "")
+
+	// Resume starts them in reverse order.
+	s.readyChan <- true
+	s.readyChan <- true
+	cmd.Cmd = "Resume"
+	s.sendChan <- cmd
+	gotReplies = test.WaitReply(s.recvChan)
+	t.Assert(len(gotReplies), Equals, 1)
+	t.Check(gotReplies[0].Error, Equals, "")
+	t.Check(test.WaitTrace(s.traceChan), DeepEquals, []string{"Start mm", "Start qan"})
+
+	status = s.agent.Status()
+	_, ok := status["agent-paused"]
+	t.Check(ok, Equals, false)
+}
+
+func (s *AgentTestSuite) TestGetAuditLog(t *C) {
+	s.sendChan <- &proto.Cmd{
+		Ts:      time.Now(),
+		User:    "daniel",
+		Service: "agent",
+		Cmd:     "GetConfig",
+	}
+	gotReplies := test.WaitReply(s.recvChan)
+	t.Assert(len(gotReplies), Equals, 1)
+	t.Assert(gotReplies[0].Error, Equals, "")
+
+	// GetAuditLog is audited after it replies, so the last entry is GetConfig.
+	data, _ := json.Marshal(1)
+	s.sendChan <- &proto.Cmd{
+		Ts:      time.Now(),
+		User:    "security",
+		Service: "agent",
+		Cmd:     "GetAuditLog",
+		Data:    data,
+	}
+	gotReplies = test.WaitReply(s.recvChan)
+	t.Assert(len(gotReplies), Equals, 1)
+	t.Assert(gotReplies[0].Error, Equals, "")
+	entries := []agent.AuditEntry{}
+	err := json.Unmarshal(gotReplies[0].Data, &entries)
+	t.Assert(err, IsNil)
+	t.Assert(entries, HasLen, 1)
+	t.Check(entries[0].User, Equals, "daniel")
+	t.Check(entries[0].Service, Equals, "agent")
+	t.Check(entries[0].Cmd, Equals, "GetConfig")
+	t.Check(entries[0].Outcome, Equals, "OK")
+}
+
+func (s *AgentTestSuite) TestAuditLogMaxEntries(t *C) {
+	file := filepath.Join(s.tmpDir, "audit-test.db")
+	defer os.Remove(file)
+	store, err := pct.OpenStore(file, "")
+	t.Assert(err, IsNil)
+	defer store.Close()
+
+	// Only the last 6 entries are kept.
+	a := agent.NewAuditLog(store, 6)
+	for i := 1; i <= 8; i++ {
+		err := a.Write(agent.AuditEntry{User: "daniel", Cmd: fmt.Sprintf("Cmd%d", i)})
+		t.Assert(err, IsNil)
+	}
+
+	entries, err := a.Recent(3)
+	t.Assert(err, IsNil)
+	t.Assert(entries, HasLen, 3)
+	t.Check(entries[0].Cmd, Equals, "Cmd6")
+	t.Check(entries[2].Cmd, Equals, "Cmd8")
+
+	entries, err = a.Recent(100)
+	t.Assert(err, IsNil)
+	t.Assert(entries, HasLen, 6)
+	t.Check(entries[0].Cmd, Equals, "Cmd3")
+}
+
+func (s *AgentTestSuite) TestCmdPolicy(t *C) {
+	// The cmd policy is set only by editing agent.conf and reloading.
+	config := *s.config
+	config.DenyCmds = []string{"agent.Version", "*.StopService"}
+	data, _ := json.Marshal(config)
+	err := ioutil.WriteFile(s.configFile, data, 0600)
+	t.Assert(err, IsNil)
+	defer os.Remove(s.configFile)
+
+	cmd := &proto.Cmd{
+		Ts:      time.Now(),
+		User:    "daniel",
+		Service: "agent",
+		Cmd:     "Reload",
+	}
+	s.sendChan <- cmd
+	gotReplies := test.WaitReply(s.recvChan)
+	t.Assert(len(gotReplies), Equals, 1)
+	t.Check(gotReplies[0].Error, Equals, "")
+
+	// Denied cmds are rejected without being handled.
+	cmd.Cmd = "Version"
+	s.sendChan <- cmd
+	gotReplies = test.WaitReply(s.recvChan)
+	t.Assert(len(gotReplies), Equals, 1)
+	t.Check(gotReplies[0].Error, Equals, pct.CmdNotAllowedError{Service: "agent", Cmd: "Version"}.Error())
+
+	data, _ = json.Marshal(&proto.ServiceData{Name: "qan"})
+	s.sendChan <- &proto.Cmd{Service: "agent", Cmd: "StopService", Data: data}
+	gotReplies = test.WaitReply(s.recvChan)
+	t.Assert(len(gotReplies), Equals, 1)
+	t.Check(gotReplies[0].Error, Not(Equals), "")
+	t.Check(test.WaitTrace(s.traceChan), HasLen, 0)
+
+	// SetConfig cannot lift the policy.
+	data, _ = json.Marshal(&agent.Config{})
+	s.sendChan <- &proto.Cmd{Service: "agent", Cmd: "SetConfig", Data: data}
+	gotReplies = test.WaitReply(s.recvChan)
+	t.Assert(len(gotReplies), Equals, 1)
+	t.Check(gotReplies[0].Error, Equals, "")
+	newConfig := &agent.Config{}
+	t.Assert(json.Unmarshal(gotReplies[0].Data, newConfig), IsNil)
+	t.Check(newConfig.DenyCmds, DeepEquals, config.DenyCmds)
+
+	// Other cmds are allowed.
+	cmd.Cmd = "GetConfig"
+	s.sendChan <- cmd
+	gotReplies = test.WaitReply(s.recvChan)
+	t.Assert(len(gotReplies), Equals, 1)
+	t.Check(gotReplies[0].Error, Equals, "")
+}
+
+func (s *AgentTestSuite) TestUpdateWindow(t *C) {
+	w, err := agent.ParseUpdateWindow("02:00-04:30")
+	t.Assert(err, IsNil)
+	t.Check(w, Equals, agent.UpdateWindow{Start: 120, End: 270})
+	t.Check(w.String(), Equals, "02:00-04:30")
+	day := func(hhmm string) time.Time {
+		ts, _ := time.Parse("2006-01-02 15:04", "2015-06-01 "+hhmm)
+		return ts
+	}
+	t.Check(w.Contains(day("01:59")), Equals, false)
+	t.Check(w.Contains(day("02:00")), Equals, true)
+	t.Check(w.Contains(day("04:29")), Equals, true)
+	t.Check(w.Contains(day("04:30")), Equals, false)
+
+	// Wraps at midnight.
+	w, err = agent.ParseUpdateWindow("23:00-01:00")
+	t.Assert(err, IsNil)
+	t.Check(w.Contains(day("23:30")), Equals, true)
+	t.Check(w.Contains(day("00:30")), Equals, true)
+	t.Check(w.Contains(day("12:00")), Equals, false)
+
+	for _, bad := range []string{"", "02:00", "2am-4am", "02:00-02:00", "25:00-01:00"} {
+		_, err = agent.ParseUpdateWindow(bad)
+		t.Check(err, NotNil, Commentf(bad))
+	}
+}
+
+func (s *AgentTestSuite) TestWatchdog(t *C) {
+	t.Check(agent.WatchdogBackoff(1), Equals, time.Minute)
+	t.Check(agent.WatchdogBackoff(3), Equals, 4*time.Minute)
+	t.Check(agent.WatchdogBackoff(10), Equals, agent.WATCHDOG_MAX_BACKOFF)
+
+	readyChan := make(chan bool, 2)
+	traceChan := make(chan string, 10)
+	qan := mock.NewMockServiceManager("qan", readyChan, traceChan)
+	services := map[string]pct.ServiceManager{"qan": qan}
+	logChan := make(chan *proto.LogEntry, 20)
+	spool := mock.NewSpooler(nil)
+	w := agent.NewWatchdog(pct.NewLogger(logChan, "agent-watchdog"), services, spool, nil)
+
+	// Not crashed: nothing to do.
+	now := time.Now()
+	t.Check(w.Check(now), HasLen, 0)
+	t.Check(test.WaitTrace(traceChan), DeepEquals, []string{"Status qan"})
+
+	// Crashed: restart right away.
+	qan.SetStatus("Crashed")
+	readyChan <- true
+	readyChan <- true
+	incidents := w.Check(now)
+	t.Assert(incidents, HasLen, 1)
+	t.Check(incidents[0].Service, Equals, "qan")
+	t.Check(incidents[0].Restarts, Equals, uint(1))
+	t.Check(incidents[0].Status["qan"], Equals, "Crashed")
+	t.Check(test.WaitTrace(traceChan), DeepEquals, []string{"Status qan", "Stop qan", "Start qan"})
+	t.Check(spool.DataIn, HasLen, 1)
+
+	// Crashed again: wait for backoff.
+	qan.SetStatus("Crashed")
+	t.Check(w.Check(now.Add(30*time.Second)), HasLen, 0)
+	test.WaitTrace(traceChan)
+	readyChan <- true
+	readyChan <- true
+	incidents = w.Check(now.Add(time.Minute))
+	t.Assert(incidents, HasLen, 1)
+	t.Check(incidents[0].Restarts, Equals, uint(2))
+	test.WaitTrace(traceChan)
+
+	// Still crashed long after the last restart: the backoff isn't reset
+	// because the service wasn't healthy in between.
+	now = now.Add(3 * time.Hour)
+	qan.SetStatus("Crashed")
+	readyChan <- true
+	readyChan <- true
+	incidents = w.Check(now)
+	t.Assert(incidents, HasLen, 1)
+	t.Check(incidents[0].Restarts, Equals, uint(3))
+	test.WaitTrace(traceChan)
+
+	// Healthy for WATCHDOG_RESET_AFTER: the backoff is reset.
+	t.Check(w.Check(now.Add(time.Minute)), HasLen, 0)
+	now = now.Add(time.Minute + agent.WATCHDOG_RESET_AFTER)
+	t.Check(w.Check(now), HasLen, 0)
+	test.WaitTrace(traceChan)
+	qan.SetStatus("Crashed")
+	readyChan <- true
+	readyChan <- true
+	incidents = w.Check(now.Add(time.Minute))
+	t.Assert(incidents, HasLen, 1)
+	t.Check(incidents[0].Restarts, Equals, uint(1))
+	test.WaitTrace(traceChan)
+
+	// Paused (skipped) services aren't checked.
+	w = agent.NewWatchdog(pct.NewLogger(logChan, "agent-watchdog"), services, spool, func(string) bool { return true })
+	t.Check(w.Check(now), HasLen, 0)
+	t.Check(test.WaitTrace(traceChan), HasLen, 0)
+}
+
+func (s *AgentTestSuite) TestHandshake(t *C) {
+	// Agent sends handshake on connect.
+	var reply *proto.Reply
+	select {
+	case reply = <-s.client.HandshakeChan:
+	case <-time.After(1 * time.Second):
+		t.Fatal("No handshake")
+	}
+	h := &agent.Handshake{}
+	t.Assert(json.Unmarshal(reply.Data, h), IsNil)
+	t.Check(h.Version, Equals, agent.VERSION)
+	t.Check(h.ProtocolVersion, Equals, agent.PROTOCOL_VERSION)
+	t.Check(h.Services, DeepEquals, []string{"mm", "qan"})
+	t.Check(h.Cmds, DeepEquals, agent.AGENT_CMDS)
+	t.Check(h.Limits["CmdQueueSize"], Equals, agent.CMD_QUEUE_SIZE)
+	t.Check(h.Encodings, DeepEquals, []string{"gzip"})
+	t.Check(h.DataEncodings, DeepEquals, []string{"", "gzip", "msgpack", "msgpack+gzip"})
+	t.Check(s.client.CompressMinSize(), Equals, 0)
+
+	// API responds with its protocol version and accepted encodings.  There's no reply.
+	s.sendChan <- &proto.Cmd{
+		Ts:      time.Now(),
+		Service: "agent",
+		Cmd:     "Handshake",
+		Data:    []byte(`{"ProtocolVersion":2,"Encodings":["gzip"]}`),
+	}
+	s.sendChan <- &proto.Cmd{
+		Ts:      time.Now(),
+		Service: "agent",
+		Cmd:     "Status",
+	}
+	got := test.WaitStatusReply(s.recvChan)
+	t.Assert(got, NotNil)
+	t.Check(got["agent-api-protocol"], Equals, fmt.Sprintf("2 (agent %d)", agent.PROTOCOL_VERSION))
+	t.Check(s.agent.ApiProtocol(), Equals, 2)
+	t.Check(s.client.CompressMinSize(), Equals, agent.REPLY_COMPRESS_MIN_SIZE)
+
+	// A newer API can send cmds this agent doesn't know.
+	s.sendChan <- &proto.Cmd{
+		Ts:      time.Now(),
+		Service: "agent",
+		Cmd:     "Foo",
+	}
+	replies := test.WaitReply(s.recvChan)
+	t.Assert(replies, HasLen, 1)
+	t.Check(replies[0].Error, Equals, pct.UnknownCmdError{Cmd: "Foo"}.Error())
+}
+
+func (s *AgentTestSuite) TestHeartbeat(t *C) {
+	hasDisconnect := func(trace []string) bool {
+		for _, s := range trace {
+			if s == "Disconnect" {
+				return true
+			}
+		}
+		return false
+	}
+
+	s.sendChan <- &proto.Cmd{
+		Ts:      time.Now(),
+		Service: "agent",
+		Cmd:     "SetConfig",
+		Data:    []byte(`{"HeartbeatTimeout":2}`),
+	}
+	replies := test.WaitReply(s.recvChan)
+	t.Assert(replies, HasLen, 1)
+	t.Assert(replies[0].Error, Equals, "")
+
+	// The API doesn't ping, so no traffic is not a stale connection.
+	time.Sleep(3 * time.Second)
+	t.Check(hasDisconnect(test.WaitTrace(s.client.TraceChan)), Equals, false)
+
+	// Once the API pings, there's no reply...
+	s.sendChan <- &proto.Cmd{
+		Ts:      time.Now(),
+		Service: "agent",
+		Cmd:     "Ping",
+	}
+	s.sendChan <- &proto.Cmd{
+		Ts:      time.Now(),
+		Service: "agent",
+		Cmd:     "Status",
+	}
+	var got map[string]string
+	timeout := time.After(5 * time.Second)
+	for got == nil {
+		select {
+		case reply := <-s.recvChan:
+			if reply.Cmd != "Status" {
+				continue // keepalive Pong
+			}
+			t.Assert(json.Unmarshal(reply.Data, &got), IsNil)
+		case <-timeout:
+			t.Fatal("No Status reply")
+		}
+	}
+	t.Check(got["agent-heartbeat"], Matches, "Last API traffic at .+")
+
+	// ...and no traffic for HeartbeatTimeout means reconnect.
+	time.Sleep(4 * time.Second)
+	t.Check(hasDisconnect(test.WaitTrace(s.client.TraceChan)), Equals, true)
+}
+
+func (s *AgentTestSuite) TestStatusHistory(t *C) {
+	s.sendChan <- &proto.Cmd{
+		Ts:      time.Now(),
+		Service: "agent",
+		Cmd:     "StatusHistory",
+	}
+	replies := test.WaitReply(s.recvChan)
+	t.Assert(replies, HasLen, 1)
+	t.Assert(replies[0].Error, Equals, "")
+	history := map[string][]pct.StatusEntry{}
+	t.Assert(json.Unmarshal(replies[0].Data, &history), IsNil)
+
+	// Only agent procs, the agent has been idle.
+	_, ok := history["mm"]
+	t.Check(ok, Equals, false)
+	got, ok := history["agent"]
+	t.Assert(ok, Equals, true)
+	t.Assert(len(got) > 0, Equals, true)
+	t.Check(got[len(got)-1].State, Equals, "Idle")
+}
+
+func (s *AgentTestSuite) TestRotateApiKey(t *C) {
+	test.WaitTrace(s.client.TraceChan) // Start, Connect
+
+	cmd := &proto.Cmd{
+		Ts:      time.Now(),
+		User:    "daniel",
+		Cmd:     "RotateApiKey",
+		Service: "agent",
+		Data:    []byte(`{"ApiKey":"101"}`),
+	}
+	s.sendChan <- cmd
+
+	got := test.WaitReply(s.recvChan)
+	t.Assert(got, HasLen, 1)
+	t.Check(got[0].Error, Equals, "")
+
+	// The REST API uses the new key, and it's saved.
+	t.Check(s.api.ApiKey(), Equals, "101")
+	data, err := pct.Basedir.ConfigData("agent")
+	t.Assert(err, IsNil)
+	gotConfig := &agent.Config{}
+	t.Assert(json.Unmarshal(data, gotConfig), IsNil)
+	t.Check(gotConfig.ApiKey, Equals, "101")
+
+	// Unlike SetConfig, the ws reconnects to use the new key.
+	trace := test.WaitTrace(s.client.TraceChan)
+	t.Check(len(trace) > 0 && trace[0] == "Disconnect", Equals, true)
+
+	// A missing key is an error, and the current key is kept.
+	cmd.Data = []byte(`{}`)
+	s.sendChan <- cmd
+	got = test.WaitReply(s.recvChan)
+	t.Assert(got, HasLen, 1)
+	t.Check(got[0].Error, Not(Equals), "")
+	t.Check(s.api.ApiKey(), Equals, "101")
+}
+
+func (s *AgentTestSuite) TestApplyConfigGroup(t *C) {
+	test.WaitTrace(s.client.TraceChan) // Start, Connect
+
+	// Without a config group, there's nothing to apply.
+	cmd := &proto.Cmd{
+		Ts:      time.Now(),
+		User:    "daniel",
+		Cmd:     "ApplyConfigGroup",
+		Service: "agent",
+	}
+	s.sendChan <- cmd
+	got := test.WaitReply(s.recvChan)
+	t.Assert(got, HasLen, 1)
+	t.Check(got[0].Error, Equals, "No ConfigGroup")
+
+	s.config.ConfigGroup = "web"
+	defer func() { s.config.ConfigGroup = "" }()
+
+	// Local overrides win over the template, and the settings are merged
+	// into the current config of each service.
+	err := pct.Basedir.WriteConfig(agent.CONFIG_OVERRIDES, agent.ConfigTemplate{
+		"qan": {"Foo": "local"},
+	})
+	t.Assert(err, IsNil)
+	defer os.Remove(pct.Basedir.ConfigFile(agent.CONFIG_OVERRIDES))
+	s.api.GetData = [][]byte{[]byte(`{"qan":{"Foo":"group","Interval":60},"mm":{"Foo":"group"}}`)}
+
+	s.sendChan <- cmd
+	got = test.WaitReply(s.recvChan)
+	t.Assert(got, HasLen, 1)
+	t.Check(got[0].Error, Equals, "")
+	var set []string
+	t.Assert(json.Unmarshal(got[0].Data, &set), IsNil)
+	t.Check(set, DeepEquals, []string{"mm", "qan"})
+
+	t.Assert(s.services["qan"].Cmds, HasLen, 1)
+	t.Check(s.services["qan"].Cmds[0].Cmd, Equals, "SetConfig")
+	t.Check(string(s.services["qan"].Cmds[0].Data), Equals, `{"Foo":"local","Interval":60}`)
+	t.Assert(s.services["mm"].Cmds, HasLen, 1)
+	t.Check(string(s.services["mm"].Cmds[0].Data), Equals, `{"Foo":"group"}`)
+}
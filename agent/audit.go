@@ -0,0 +1,146 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package agent
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/percona/cloud-protocol/proto/v1"
+	"github.com/percona/percona-agent/pct"
+)
+
+const (
+	AUDIT_LOG_MAX_ENTRIES = 10000 // oldest entries are dropped
+	AUDIT_LOG_RECENT      = 100   // entries returned by GetAuditLog by default
+)
+
+// An AuditEntry records a cmd handled by the agent: who told it to do what,
+// when, and what happened.
+type AuditEntry struct {
+	Ts       time.Time // when the cmd was received, UTC
+	User     string
+	Service  string
+	Cmd      string
+	Outcome  string  // OK, Error, Timeout, or No reply
+	Error    string  `json:",omitempty"`
+	Duration float64 // seconds
+}
+
+// AuditLog is the append-only log of AuditEntry in the state store.  Only
+// the last maxEntries are kept.
+type AuditLog struct {
+	store      *pct.Store
+	maxEntries int
+}
+
+// NewAuditLog returns the audit log in store.  Write fails if store is nil,
+// e.g. because it cannot be opened.
+func NewAuditLog(store *pct.Store, maxEntries int) *AuditLog {
+	a := &AuditLog{
+		store:      store,
+		maxEntries: maxEntries,
+	}
+	return a
+}
+
+// Write appends the entry to the audit log, dropping the oldest entry if
+// needed.
+func (a *AuditLog) Write(entry AuditEntry) error {
+	if a.store == nil {
+		return errors.New("State store is not open")
+	}
+	return a.store.Update(func(tx *pct.StoreTx) error {
+		seq, err := tx.Append(pct.STORE_AUDIT, entry)
+		if err != nil {
+			return err
+		}
+		if seq > uint64(a.maxEntries) {
+			return tx.Delete(pct.STORE_AUDIT, pct.SequenceKey(seq-uint64(a.maxEntries)))
+		}
+		return nil
+	})
+}
+
+// Recent returns the last n entries, oldest first.
+func (a *AuditLog) Recent(n int) ([]AuditEntry, error) {
+	entries := []AuditEntry{}
+	if a.store == nil {
+		return entries, errors.New("State store is not open")
+	}
+	err := a.store.View(func(tx *pct.StoreTx) error {
+		values, err := tx.Last(pct.STORE_AUDIT, n)
+		if err != nil {
+			return err
+		}
+		for _, v := range values {
+			entry := AuditEntry{}
+			if err := json.Unmarshal(v, &entry); err != nil {
+				return err
+			}
+			entries = append(entries, entry)
+		}
+		return nil
+	})
+	return entries, err
+}
+
+// audit records the cmd and its reply in the audit log.  reply is nil if
+// the cmd has no reply, e.g. Reconnect.  Status cmds are not audited: they
+// are frequent and change nothing.
+func (agent *Agent) audit(cmd *proto.Cmd, reply *proto.Reply, t0 time.Time, timeout bool) {
+	entry := AuditEntry{
+		Ts:       t0.UTC(),
+		User:     cmd.User,
+		Service:  cmd.Service,
+		Cmd:      cmd.Cmd,
+		Outcome:  "OK",
+		Duration: time.Now().Sub(t0).Seconds(),
+	}
+	if reply == nil {
+		entry.Outcome = "No reply"
+	} else if reply.Error != "" {
+		entry.Outcome = "Error"
+		entry.Error = reply.Error
+	}
+	if timeout {
+		entry.Outcome = "Timeout"
+	}
+	if err := agent.auditLog.Write(entry); err != nil {
+		agent.logger.Warn("Failed to write audit log:", err)
+	}
+}
+
+// Handle:@goroutine[3]
+func (agent *Agent) handleGetAuditLog(cmd *proto.Cmd) (interface{}, []error) {
+	agent.status.UpdateRe("agent-cmd-handler", "GetAuditLog", cmd)
+
+	// Data is the optional number of recent entries to return.
+	n := AUDIT_LOG_RECENT
+	if len(cmd.Data) > 0 {
+		if err := json.Unmarshal(cmd.Data, &n); err != nil {
+			return nil, []error{err}
+		}
+	}
+	entries, err := agent.auditLog.Recent(n)
+	if err != nil {
+		return nil, []error{err}
+	}
+	return entries, nil
+}
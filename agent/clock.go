@@ -0,0 +1,54 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package agent
+
+import (
+	"time"
+
+	"github.com/percona/percona-agent/pct"
+)
+
+// CLOCK_CHECK_INTERVAL is how often the agent measures its clock against the
+// API clock, see pct.MeasureClock.
+const CLOCK_CHECK_INTERVAL = 1 * time.Hour
+
+// checkClock measures the clock offset if it's older than CLOCK_CHECK_INTERVAL,
+// e.g. on reconnect after a long disconnect, and warns if the local clock is
+// skewed.  Every API request measures it from the Date header, so this only
+// requests the agent resource.  It's not measured until the agent uses the
+// REST API, e.g. on start, so a ws connect alone does not request it.
+func (agent *Agent) checkClock(now time.Time) {
+	defer func() {
+		if err := recover(); err != nil {
+			agent.logger.Error("Agent clock check crashed: ", err)
+		}
+	}()
+	if measured := pct.ClockMeasured(); measured.IsZero() || now.Sub(measured) < CLOCK_CHECK_INTERVAL {
+		return
+	}
+	agent.configMux.RLock()
+	apiKey := agent.config.ApiKey
+	agent.configMux.RUnlock()
+	if _, _, err := agent.api.Get(apiKey, agent.api.AgentLink("self")); err != nil {
+		agent.logger.Warn("Cannot check clock:", err)
+		return
+	}
+	if pct.ClockSkewed(pct.ClockOffset()) {
+		agent.logger.Warn("Clock skew:", pct.ClockStatus())
+	}
+}
@@ -0,0 +1,162 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package agent
+
+import (
+	"encoding/json"
+	"net"
+	"os"
+	"time"
+
+	"github.com/percona/cloud-protocol/proto/v1"
+	"github.com/percona/percona-agent/pct"
+)
+
+const (
+	CTL_QUEUE_SIZE = 5
+	CTL_TIMEOUT    = 6 * time.Minute // longer than the longest cmd, Update
+)
+
+// A localCmd is a cmd from the ctl socket.  Unlike cmds from the API, its
+// reply is sent back on replyChan instead of to the API.  cmdHandler queues
+// cmds from the API as localCmd, too, with a nil replyChan.
+type localCmd struct {
+	cmd       *proto.Cmd
+	replyChan chan *proto.Reply
+}
+
+// Run:@goroutine[0]
+func (agent *Agent) startCtl() {
+	socket := pct.Basedir.File("ctl-socket")
+	os.Remove(socket) // stale socket if agent crashed
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		// Not fatal: the agent works without it.
+		agent.logger.Error("Cannot listen on ctl socket " + socket + ": " + err.Error())
+		return
+	}
+	// Only the agent user can control the agent.
+	if err := os.Chmod(socket, 0600); err != nil {
+		agent.logger.Error("Cannot chmod ctl socket " + socket + ": " + err.Error())
+		listener.Close()
+		return
+	}
+	agent.ctlListener = listener
+	go agent.ctlServer(listener)
+}
+
+// Run:@goroutine[0]
+func (agent *Agent) stopCtl() {
+	if agent.ctlListener != nil {
+		agent.ctlListener.Close() // removes the socket file
+		agent.ctlListener = nil
+	}
+}
+
+func (agent *Agent) ctlServer(listener net.Listener) {
+	defer func() {
+		if err := recover(); err != nil {
+			agent.logger.Error("Agent ctl server crashed: ", err)
+		}
+	}()
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return // listener closed
+		}
+		go agent.ctlConn(conn)
+	}
+}
+
+// A ctl client sends one proto.Cmd and receives one proto.Reply, both JSON.
+func (agent *Agent) ctlConn(conn net.Conn) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(CTL_TIMEOUT))
+	cmd := &proto.Cmd{}
+	if err := json.NewDecoder(conn).Decode(cmd); err != nil {
+		agent.logger.Warn("Invalid ctl cmd: ", err)
+		return
+	}
+	cmd.Ts = time.Now().UTC()
+	cmd.User = "ctl"
+	agent.logger.Info("ctl:", cmd)
+	reply := agent.HandleLocal(cmd)
+	if err := json.NewEncoder(conn).Encode(reply); err != nil {
+		agent.logger.Warn("Cannot send ctl reply: ", err)
+	}
+}
+
+// HandleLocal handles a cmd from this host, e.g. from the ctl socket or a
+// signal, and returns its reply.
+func (agent *Agent) HandleLocal(cmd *proto.Cmd) *proto.Reply {
+	// Status and metrics are handled immediately, like status from the API,
+	// so the user can see what the agent is doing even if it's busy.
+	switch cmd.Cmd {
+	case "Status":
+		status, err := agent.ServiceStatus(cmd.Service)
+		if err != nil {
+			return cmd.Reply(nil, err)
+		}
+		return cmd.Reply(status)
+	case "StatusHistory":
+		history, err := agent.ServiceStatusHistory(cmd.Service)
+		if err != nil {
+			return cmd.Reply(nil, err)
+		}
+		return cmd.Reply(history)
+	case "GetMetrics":
+		// Agent internals, e.g. for percona-agent check thresholds.
+		return cmd.Reply(pct.AgentMetrics.All())
+	}
+
+	// Other cmds are serialized with cmds from the API.
+	lc := &localCmd{
+		cmd:       cmd,
+		replyChan: make(chan *proto.Reply, 1),
+	}
+	select {
+	case agent.localCmdChan <- lc:
+	default:
+		return cmd.Reply(nil, pct.QueueFullError{Cmd: cmd.Cmd, Name: "ctlQueue", Size: CTL_QUEUE_SIZE})
+	}
+	select {
+	case reply := <-lc.replyChan:
+		return reply
+	case <-time.After(CTL_TIMEOUT):
+		return cmd.Reply(nil, pct.CmdTimeoutError{Cmd: cmd.Cmd})
+	}
+}
+
+// Ctl sends the cmd to the agent listening on the ctl socket and returns
+// its reply.  This is used by "percona-agent ctl".
+func Ctl(socket string, cmd *proto.Cmd) (*proto.Reply, error) {
+	conn, err := net.DialTimeout("unix", socket, 5*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(CTL_TIMEOUT))
+	if err := json.NewEncoder(conn).Encode(cmd); err != nil {
+		return nil, err
+	}
+	reply := &proto.Reply{}
+	if err := json.NewDecoder(conn).Decode(reply); err != nil {
+		return nil, err
+	}
+	return reply, nil
+}
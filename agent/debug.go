@@ -0,0 +1,211 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package agent
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	"time"
+
+	"github.com/percona/cloud-protocol/proto/v1"
+)
+
+// Debug listener address if the Debug cmd does not specify one and DebugAddr
+// is not set.  It's localhost only: pprof exposes command line args and
+// can use a lot of CPU.
+const DEFAULT_DEBUG_ADDR = "127.0.0.1:6060"
+
+// Debug is the Data of the Debug cmd and its reply.  On starts the debug
+// listener on Addr, which must be a loopback address, or DebugAddr or
+// DEFAULT_DEBUG_ADDR if empty; !On stops it.  The reply is the current state: Addr is the address the listener is
+// serving on.  A Debug cmd without Data only returns the current state.
+type Debug struct {
+	On   bool
+	Addr string `json:",omitempty"`
+}
+
+// RuntimeStats are returned by GET /debug/runtime.
+type RuntimeStats struct {
+	Ts           time.Time
+	GoVersion    string
+	NumCPU       int
+	GOMAXPROCS   int
+	NumGoroutine int
+	NumCgoCall   int64
+	Alloc        uint64 // bytes allocated and in use
+	TotalAlloc   uint64 // bytes allocated, even if freed
+	Sys          uint64 // bytes obtained from the OS
+	HeapObjects  uint64
+	NumGC        uint32
+	PauseTotalNs uint64
+}
+
+// DebugHandler serves net/http/pprof profiles and runtime stats for
+// troubleshooting the agent in production, e.g. leaked goroutines:
+//
+//	GET /debug/pprof/                    index of profiles
+//	GET /debug/pprof/goroutine?debug=2   stacks of all goroutines
+//	GET /debug/pprof/heap                heap profile
+//	GET /debug/pprof/profile?seconds=N   CPU profile
+//	GET /debug/runtime                   RuntimeStats
+//
+// The debug listener is off by default.  It's started on DebugAddr when the
+// agent starts, or by the Debug cmd.
+func (agent *Agent) DebugHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/runtime", httpRuntime)
+	return mux
+}
+
+// Run:@goroutine[0]
+func (agent *Agent) startDebugOnRun() {
+	agent.configMux.RLock()
+	addr := agent.config.DebugAddr
+	agent.configMux.RUnlock()
+	if addr == "" {
+		return
+	}
+	if err := agent.startDebug(addr); err != nil {
+		// Not fatal: the agent works without it.
+		agent.logger.Error(err)
+	}
+}
+
+func (agent *Agent) startDebug(addr string) error {
+	agent.debugMux.Lock()
+	defer agent.debugMux.Unlock()
+	if agent.debugServer != nil {
+		return errors.New("Debug listener is already running on " + agent.debugAddr)
+	}
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return errors.New("Cannot serve debug on " + addr + ": " + err.Error())
+	}
+	server := &http.Server{Handler: agent.DebugHandler()}
+	agent.debugServer = server
+	agent.debugAddr = listener.Addr().String()
+	go server.Serve(listener) // returns when the server is closed
+	agent.logger.Warn("Serving debug on http://" + agent.debugAddr + "/debug/pprof/")
+	return nil
+}
+
+// stopDebug closes the debug listener and its connections, else a client
+// with a keep-alive connection could still get profiles.
+func (agent *Agent) stopDebug() {
+	agent.debugMux.Lock()
+	defer agent.debugMux.Unlock()
+	if agent.debugServer != nil {
+		agent.debugServer.Close()
+		agent.debugServer = nil
+		agent.debugAddr = ""
+		agent.logger.Info("Stopped debug listener")
+	}
+}
+
+// debugState returns the current state of the debug listener.
+func (agent *Agent) debugState() *Debug {
+	agent.debugMux.Lock()
+	defer agent.debugMux.Unlock()
+	if agent.debugServer == nil {
+		return &Debug{}
+	}
+	return &Debug{On: true, Addr: agent.debugAddr}
+}
+
+// loopbackAddr returns an error if addr is not on a loopback interface.
+// Only DebugAddr, set locally, can serve debug on other interfaces.
+func loopbackAddr(addr string) error {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return errors.New("Invalid debug address " + addr + ": " + err.Error())
+	}
+	if host == "localhost" {
+		return nil
+	}
+	if ip := net.ParseIP(host); ip == nil || !ip.IsLoopback() {
+		return errors.New("Invalid debug address " + addr + ": must be a loopback address like " + DEFAULT_DEBUG_ADDR)
+	}
+	return nil
+}
+
+// Handle:@goroutine[3]
+func (agent *Agent) handleDebug(cmd *proto.Cmd) (interface{}, []error) {
+	agent.status.UpdateRe("agent-cmd-handler", "Debug", cmd)
+	agent.logger.Info(cmd)
+
+	if len(cmd.Data) == 0 {
+		return agent.debugState(), nil
+	}
+	debug := &Debug{}
+	if err := json.Unmarshal(cmd.Data, debug); err != nil {
+		return nil, []error{err}
+	}
+	if !debug.On {
+		agent.stopDebug()
+		return agent.debugState(), nil
+	}
+	addr := debug.Addr
+	if addr != "" {
+		if err := loopbackAddr(addr); err != nil {
+			return agent.debugState(), []error{err}
+		}
+	} else {
+		agent.configMux.RLock()
+		addr = agent.config.DebugAddr
+		agent.configMux.RUnlock()
+	}
+	if addr == "" {
+		addr = DEFAULT_DEBUG_ADDR
+	}
+	if err := agent.startDebug(addr); err != nil {
+		return agent.debugState(), []error{err}
+	}
+	return agent.debugState(), nil
+}
+
+func httpRuntime(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	stats := &RuntimeStats{
+		Ts:           time.Now().UTC(),
+		GoVersion:    runtime.Version(),
+		NumCPU:       runtime.NumCPU(),
+		GOMAXPROCS:   runtime.GOMAXPROCS(0),
+		NumGoroutine: runtime.NumGoroutine(),
+		NumCgoCall:   runtime.NumCgoCall(),
+		Alloc:        mem.Alloc,
+		TotalAlloc:   mem.TotalAlloc,
+		Sys:          mem.Sys,
+		HeapObjects:  mem.HeapObjects,
+		NumGC:        mem.NumGC,
+		PauseTotalNs: mem.PauseTotalNs,
+	}
+	httpJSON(w, stats)
+}
@@ -0,0 +1,130 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package agent
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/percona/cloud-protocol/proto/v1"
+	"github.com/percona/percona-agent/pct"
+)
+
+const (
+	REPLY_CACHE_SIZE = 100            // replies kept, oldest are dropped
+	REPLY_CACHE_TTL  = 24 * time.Hour // replies older than this are dropped
+)
+
+// DEDUP_CMDS are cmds not safe to run twice.  The API re-sends cmds it has
+// no reply for after a reconnect, so a duplicate of one of these is replied
+// to from the ReplyCache instead of run again.
+var DEDUP_CMDS = map[string]bool{
+	"StartService": true,
+	"StopService":  true,
+	"Update":       true,
+	"Restart":      true,
+}
+
+type cachedReply struct {
+	Key   string
+	Ts    time.Time // when cached, UTC
+	Reply *proto.Reply
+}
+
+// A ReplyCache maps DEDUP_CMDS to their replies.  proto.Cmd has no id, so the
+// key is the cmd itself: a re-sent cmd is identical, including Ts, whereas a
+// new cmd has a new Ts.  The cache is saved in the state store because Restart
+// and Update replace the agent process, and the new process must know them.
+type ReplyCache struct {
+	store   *pct.Store
+	size    int
+	ttl     time.Duration
+	replies []cachedReply // oldest first
+	mux     *sync.Mutex
+}
+
+// NewReplyCache returns the reply cache saved in store.  If store is nil, e.g.
+// because it cannot be opened, the cache is not saved.
+func NewReplyCache(store *pct.Store, size int, ttl time.Duration) *ReplyCache {
+	c := &ReplyCache{
+		store:   store,
+		size:    size,
+		ttl:     ttl,
+		replies: []cachedReply{},
+		mux:     &sync.Mutex{},
+	}
+	// The cache is only an optimization, so it's ok if it's missing or
+	// invalid.
+	if store != nil {
+		store.Get(pct.STORE_STATE, "reply-cache", &c.replies)
+	}
+	return c
+}
+
+// Get returns the cached reply to the cmd, or nil if the cmd is not a
+// duplicate.
+func (c *ReplyCache) Get(cmd *proto.Cmd) *proto.Reply {
+	key := replyCacheKey(cmd)
+	if key == "" {
+		return nil
+	}
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	for _, r := range c.replies {
+		if r.Key == key && time.Now().Sub(r.Ts) < c.ttl {
+			return r.Reply
+		}
+	}
+	return nil
+}
+
+// Add caches the reply to the cmd if it's one of DEDUP_CMDS.
+func (c *ReplyCache) Add(cmd *proto.Cmd, reply *proto.Reply) error {
+	key := replyCacheKey(cmd)
+	if key == "" || reply == nil {
+		return nil
+	}
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	now := time.Now().UTC()
+	replies := []cachedReply{}
+	for _, r := range c.replies {
+		if now.Sub(r.Ts) < c.ttl {
+			replies = append(replies, r)
+		}
+	}
+	replies = append(replies, cachedReply{Key: key, Ts: now, Reply: reply})
+	if len(replies) > c.size {
+		replies = replies[len(replies)-c.size:]
+	}
+	c.replies = replies
+	if c.store == nil {
+		return nil
+	}
+	return c.store.Put(pct.STORE_STATE, "reply-cache", c.replies)
+}
+
+// replyCacheKey returns the cache key of the cmd, or "" if it's not cached.
+func replyCacheKey(cmd *proto.Cmd) string {
+	if !DEDUP_CMDS[cmd.Cmd] || cmd.Ts.IsZero() {
+		return ""
+	}
+	return fmt.Sprintf("%d %s %s %s %x", cmd.Ts.UnixNano(), cmd.User, cmd.Service, cmd.Cmd, sha1.Sum(cmd.Data))
+}
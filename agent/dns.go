@@ -0,0 +1,85 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package agent
+
+import (
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/percona/cloud-protocol/proto/v1"
+	"github.com/percona/percona-agent/pct"
+)
+
+// DNS_CHECK_INTERVAL is how often the agent re-resolves the API host while
+// connected, see checkDNS.
+const DNS_CHECK_INTERVAL = 5 * time.Minute
+
+// checkDNS resolves the API host and, if reconnect is true and its addresses
+// changed since the last check, reconnects so the agent does not stay on an
+// API server that was taken out of DNS, e.g. during a migration.  On connect,
+// reconnect is false so the check only records the current addresses.  It does
+// nothing through a proxy, which resolves the API host itself, or if the API
+// host is an IP address.
+func (agent *Agent) checkDNS(reconnect bool) {
+	defer func() {
+		if err := recover(); err != nil {
+			agent.logger.Error("Agent DNS check crashed: ", err)
+		}
+	}()
+	link := agent.api.AgentLink("cmd")
+	if link == "" {
+		return
+	}
+	location, err := url.Parse(link)
+	if err != nil {
+		return
+	}
+	if proxyURL, err := pct.LocationProxy(location); err != nil || proxyURL != nil {
+		return
+	}
+	host := location.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.Trim(host, "[]")
+	if host == "" || net.ParseIP(host) != nil {
+		return
+	}
+	addrs, err := pct.LookupAddrs(host)
+	if err != nil {
+		agent.logger.Warn("Cannot resolve API host", host+":", err)
+		return
+	}
+	newAddrs := strings.Join(addrs, ", ")
+
+	agent.dnsMux.Lock()
+	oldHost := agent.dnsHost
+	oldAddrs := agent.dnsAddrs
+	agent.dnsHost = host
+	agent.dnsAddrs = newAddrs
+	agent.dnsMux.Unlock()
+
+	if !reconnect || host != oldHost || newAddrs == oldAddrs {
+		return
+	}
+	agent.logger.Info("API host", host, "addresses changed from", oldAddrs, "to", newAddrs)
+	pct.AgentMetrics.Add("ws/dns-changes", 1)
+	agent.reconnect(&proto.Cmd{Ts: time.Now().UTC(), User: "agent"})
+}
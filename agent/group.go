@@ -0,0 +1,208 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package agent
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/percona/cloud-protocol/proto/v1"
+	"github.com/percona/percona-agent/bus"
+	"github.com/percona/percona-agent/pct"
+)
+
+// CONFIG_GROUPS_LINK is the API entry link to config groups: GET <link>/<name>
+// returns the ConfigTemplate of the group.
+const CONFIG_GROUPS_LINK = "config-groups"
+
+// CONFIG_OVERRIDES is the local config (config-overrides.conf) of settings,
+// like a ConfigTemplate, which override the config group template.
+const CONFIG_OVERRIDES = "config-overrides"
+
+// A ConfigTemplate is the config of a group of agents: service => settings,
+// e.g. {"data": {"SendInterval": 120}, "log": {"Level": "warning"}}.  The
+// settings are merged into the current config of the service, so a template
+// only needs the settings it changes.  Thousands of agents are reconfigured by
+// editing one template and sending them ApplyConfigGroup.
+type ConfigTemplate map[string]map[string]interface{}
+
+// Handle:@goroutine[3]
+func (agent *Agent) handleApplyConfigGroup(cmd *proto.Cmd) (interface{}, []error) {
+	agent.status.UpdateRe("agent-cmd-handler", "ApplyConfigGroup", cmd)
+	agent.logger.Info(cmd)
+	return agent.applyConfigGroup(cmd)
+}
+
+// queueApplyConfigGroup queues an ApplyConfigGroup cmd if the agent has a
+// config group and is online.  Like cmds from the ctl socket, it's serialized
+// with cmds from the API.
+// Run:@goroutine[0]
+func (agent *Agent) queueApplyConfigGroup() {
+	agent.configMux.RLock()
+	group := agent.config.ConfigGroup
+	agent.configMux.RUnlock()
+	if group == "" || agent.Offline() {
+		return
+	}
+	lc := &localCmd{
+		cmd: &proto.Cmd{
+			Ts:      time.Now().UTC(),
+			User:    "agent",
+			Service: "agent",
+			Cmd:     "ApplyConfigGroup",
+		},
+		replyChan: make(chan *proto.Reply, 1),
+	}
+	select {
+	case agent.localCmdChan <- lc:
+	default:
+		agent.logger.Warn(pct.QueueFullError{Cmd: lc.cmd.Cmd, Name: "ctlQueue", Size: CTL_QUEUE_SIZE})
+		return
+	}
+	go func() {
+		if reply := <-lc.replyChan; reply.Error != "" {
+			agent.logger.Warn("Cannot apply config group " + group + ": " + reply.Error)
+		}
+	}()
+}
+
+// applyConfigGroup gets the template of Config.ConfigGroup from the API,
+// merges it with the local overrides, and sets the config of each service in
+// it like SetConfig.  It returns the services it set.
+func (agent *Agent) applyConfigGroup(cmd *proto.Cmd) ([]string, []error) {
+	agent.configMux.RLock()
+	group := agent.config.ConfigGroup
+	apiKey := agent.config.ApiKey
+	agent.configMux.RUnlock()
+	if group == "" {
+		return nil, []error{errors.New("No ConfigGroup")}
+	}
+
+	link := agent.api.EntryLink(CONFIG_GROUPS_LINK)
+	if link == "" {
+		return nil, []error{errors.New("API has no " + CONFIG_GROUPS_LINK + " link")}
+	}
+	_, data, err := agent.api.Get(apiKey, link+"/"+url.QueryEscape(group))
+	if err != nil {
+		return nil, []error{fmt.Errorf("Cannot get config group %s: %s", group, err)}
+	}
+	template := ConfigTemplate{}
+	if err := json.Unmarshal(data, &template); err != nil {
+		return nil, []error{fmt.Errorf("Invalid config group %s: %s", group, err)}
+	}
+
+	overrides := ConfigTemplate{}
+	if err := pct.Basedir.ReadConfig(CONFIG_OVERRIDES, &overrides); err != nil && !os.IsNotExist(err) {
+		return nil, []error{err}
+	}
+
+	set := []string{}
+	errs := []error{}
+	for _, service := range templateServices(template, overrides) {
+		settings := template[service]
+		for k, v := range overrides[service] {
+			if settings == nil {
+				settings = map[string]interface{}{}
+			}
+			settings[k] = v // local overrides win
+		}
+		if err := agent.setServiceConfig(cmd, service, settings); err != nil {
+			errs = append(errs, fmt.Errorf("Config group %s: %s: %s", group, service, err))
+			continue
+		}
+		set = append(set, service)
+		agent.bus.Publish(bus.Event{Topic: bus.CONFIG_CHANGED, Source: "agent", Data: service})
+	}
+	agent.logger.Info("Applied config group", group, "to", set)
+	return set, errs
+}
+
+// setServiceConfig merges the settings into the current config of the
+// service and sets it with a SetConfig cmd.  The service must have one config.
+func (agent *Agent) setServiceConfig(cmd *proto.Cmd, service string, settings map[string]interface{}) error {
+	var configs []proto.AgentConfig
+	var errs []error
+	var m pct.ServiceManager
+	if service == "agent" {
+		configs, errs = agent.GetConfig()
+	} else {
+		var ok bool
+		if m, ok = agent.services[service]; !ok {
+			return pct.UnknownServiceError{Service: service}
+		}
+		configs, errs = m.GetConfig()
+	}
+	if len(errs) > 0 {
+		return errs[0]
+	}
+	if len(configs) != 1 {
+		return fmt.Errorf("has %d configs, expected 1", len(configs))
+	}
+
+	config := map[string]interface{}{}
+	if err := json.Unmarshal([]byte(configs[0].Config), &config); err != nil {
+		return err
+	}
+	for k, v := range settings {
+		config[k] = v
+	}
+	data, err := json.Marshal(config)
+	if err != nil {
+		return err
+	}
+
+	setConfigCmd := &proto.Cmd{
+		Ts:        time.Now().UTC(),
+		User:      cmd.User,
+		AgentUuid: cmd.AgentUuid,
+		Service:   service,
+		Cmd:       "SetConfig",
+		Data:      data,
+	}
+	if service == "agent" {
+		if _, errs := agent.handleSetConfig(setConfigCmd); len(errs) > 0 {
+			return errs[0]
+		}
+		return nil
+	}
+	if reply := m.Handle(setConfigCmd); reply != nil && reply.Error != "" {
+		return errors.New(reply.Error)
+	}
+	return nil
+}
+
+// templateServices returns the services in the templates, sorted.
+func templateServices(templates ...ConfigTemplate) []string {
+	seen := map[string]bool{}
+	services := []string{}
+	for _, t := range templates {
+		for service := range t {
+			if !seen[service] {
+				seen[service] = true
+				services = append(services, service)
+			}
+		}
+	}
+	sort.Strings(services)
+	return services
+}
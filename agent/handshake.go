@@ -0,0 +1,218 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package agent
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/percona/cloud-protocol/proto/v1"
+	"github.com/percona/percona-agent/data"
+)
+
+// PROTOCOL_VERSION is the version of the cmd protocol: the cmds the agent
+// handles and their data.  Increment it when cmds are added or changed.
+const PROTOCOL_VERSION = 1
+
+// REPLY_COMPRESS_MIN_SIZE is the minimum size, in bytes, of reply data to
+// compress if the API accepts compressed replies in the handshake.
+const REPLY_COMPRESS_MIN_SIZE = 16384
+
+// ENCODINGS are the reply data encodings the agent can send, see
+// client.CompressReply.
+var ENCODINGS = []string{"gzip"}
+
+// AGENT_CMDS are the cmds the agent handles itself (Service: agent), see Run
+// and Handle.
+var AGENT_CMDS = []string{
+	"Abort",
+	"ApplyConfigGroup",
+	"Debug",
+	"Drain",
+	"GetAllConfigs",
+	"GetAuditLog",
+	"GetConfig",
+	"GetConfigSchema",
+	"Handshake",
+	"Offline",
+	"Online",
+	"Pause",
+	"Ping",
+	"Reconnect",
+	"Reload",
+	"Restart",
+	"Resume",
+	"Rollback",
+	"RotateApiKey",
+	"SetConfig",
+	"StartService",
+	"Status",
+	"StatusHistory",
+	"Stop",
+	"StopService",
+	"Update",
+	"ValidateConfig",
+	"Version",
+}
+
+// Handshake is sent to the API after connecting so a mixed-version fleet works
+// during rollouts: the API knows what the agent can do.  The API responds with
+// a Handshake cmd with HandshakeReply data.
+type Handshake struct {
+	Version         string
+	ProtocolVersion int
+	Cmds            []string
+	Services        []string
+	Limits          map[string]int
+	Encodings       []string
+	DataEncodings   []string // data.ENCODINGS
+}
+
+type HandshakeReply struct {
+	ProtocolVersion int
+	Encodings       []string // accepted ENCODINGS, none if empty
+	DataEncoding    string   // one of DataEncodings, or keep current if empty
+}
+
+// handshake announces the agent to the API.
+// @goroutine[0]
+func (agent *Agent) handshake() {
+	agent.setApiProtocol(0) // unknown until the API responds
+	agent.client.SetCompression(0)
+
+	services := make([]string, 0, len(agent.services))
+	for service := range agent.services {
+		services = append(services, service)
+	}
+	sort.Strings(services)
+
+	agent.configMux.RLock()
+	agentUuid := agent.config.AgentUuid
+	agent.configMux.RUnlock()
+
+	h := &Handshake{
+		Version:         VERSION,
+		ProtocolVersion: PROTOCOL_VERSION,
+		Cmds:            AGENT_CMDS,
+		Services:        services,
+		Limits: map[string]int{
+			"CmdQueueSize":    CMD_QUEUE_SIZE,
+			"StatusQueueSize": STATUS_QUEUE_SIZE,
+			"CtlQueueSize":    CTL_QUEUE_SIZE,
+		},
+		Encodings:     ENCODINGS,
+		DataEncodings: data.ENCODINGS,
+	}
+	cmd := &proto.Cmd{
+		Ts:        time.Now().UTC(),
+		User:      "agent",
+		AgentUuid: agentUuid,
+		Service:   "agent",
+		Cmd:       "Handshake",
+	}
+	agent.reply(cmd.Reply(h))
+}
+
+// handleHandshake handles the API response to handshake.  There is no reply.
+// @goroutine[0]
+func (agent *Agent) handleHandshake(cmd *proto.Cmd) {
+	r := &HandshakeReply{}
+	if err := json.Unmarshal(cmd.Data, r); err != nil {
+		agent.logger.Warn("Invalid handshake from API: ", err)
+		return
+	}
+	agent.setApiProtocol(r.ProtocolVersion)
+	if r.ProtocolVersion > PROTOCOL_VERSION {
+		agent.logger.Warn(fmt.Sprintf("API protocol version %d is newer than agent protocol version %d;"+
+			" commands this agent does not know are refused", r.ProtocolVersion, PROTOCOL_VERSION))
+	} else {
+		agent.logger.Info(fmt.Sprintf("API protocol version %d", r.ProtocolVersion))
+	}
+	for _, encoding := range r.Encodings {
+		if encoding == "gzip" {
+			agent.logger.Info(fmt.Sprintf("Compressing replies larger than %d bytes", REPLY_COMPRESS_MIN_SIZE))
+			agent.client.SetCompression(REPLY_COMPRESS_MIN_SIZE)
+		}
+	}
+	if r.DataEncoding != "" {
+		go agent.setDataEncoding(cmd, r.DataEncoding) // not while blocking Run
+	}
+}
+
+// setDataEncoding sets the data Encoding like a data SetConfig cmd, keeping
+// the rest of the data config.
+func (agent *Agent) setDataEncoding(cmd *proto.Cmd, encoding string) {
+	m, ok := agent.services["data"]
+	if !ok {
+		return
+	}
+	configs, errs := m.GetConfig()
+	if len(errs) > 0 || len(configs) != 1 {
+		agent.logger.Warn("Cannot get data config to set encoding", encoding, errs)
+		return
+	}
+	config := map[string]interface{}{}
+	if err := json.Unmarshal([]byte(configs[0].Config), &config); err != nil {
+		agent.logger.Warn("Cannot set data encoding", encoding, err)
+		return
+	}
+	if config["Encoding"] == encoding {
+		return
+	}
+	config["Encoding"] = encoding
+	setConfig, _ := json.Marshal(config)
+	setConfigCmd := &proto.Cmd{
+		Ts:        time.Now().UTC(),
+		User:      cmd.User,
+		AgentUuid: cmd.AgentUuid,
+		Service:   "data",
+		Cmd:       "SetConfig",
+		Data:      setConfig,
+	}
+	if reply := m.Handle(setConfigCmd); reply != nil && reply.Error != "" {
+		agent.logger.Warn("Cannot set data encoding", encoding, reply.Error)
+		return
+	}
+	agent.logger.Info("Data encoding " + encoding)
+}
+
+// ApiProtocol returns the API protocol version from the last handshake, or 0
+// if unknown, e.g. the API does not handshake.
+func (agent *Agent) ApiProtocol() int {
+	agent.protocolMux.Lock()
+	defer agent.protocolMux.Unlock()
+	return agent.apiProtocol
+}
+
+func (agent *Agent) setApiProtocol(version int) {
+	agent.protocolMux.Lock()
+	defer agent.protocolMux.Unlock()
+	agent.apiProtocol = version
+}
+
+// isAgentCmd returns true if the agent handles the cmd, see AGENT_CMDS.
+func isAgentCmd(cmd string) bool {
+	for _, c := range AGENT_CMDS {
+		if c == cmd {
+			return true
+		}
+	}
+	return false
+}
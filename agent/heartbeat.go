@@ -0,0 +1,94 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package agent
+
+import (
+	"sync"
+	"time"
+
+	"github.com/percona/cloud-protocol/proto/v1"
+	"github.com/percona/percona-agent/pct"
+)
+
+// heartbeat detects a stale cmd connection, e.g. half-open TCP, when the agent
+// thinks it's connected but cmds never arrive.  Every Keepalive seconds the
+// agent sends a Pong reply.  An API that knows the Ping cmd (see AGENT_CMDS in
+// the handshake) responds with a Ping cmd.  Once the API has sent a Ping, no
+// traffic from the API for HeartbeatTimeout seconds means the connection is
+// stale, so the agent reconnects.  APIs that don't ping are never stale.
+type heartbeat struct {
+	lastRecv time.Time
+	pinged   bool // API sends Ping on this connection
+	mux      *sync.Mutex
+}
+
+func newHeartbeat() *heartbeat {
+	h := &heartbeat{
+		mux: &sync.Mutex{},
+	}
+	return h
+}
+
+// reset starts over on (re)connect.
+func (h *heartbeat) reset(now time.Time) {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	h.lastRecv = now
+	h.pinged = false
+}
+
+// recv records traffic from the API.  It returns true if the cmd is a Ping,
+// which has no reply.
+func (h *heartbeat) recv(cmd *proto.Cmd, now time.Time) bool {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	h.lastRecv = now
+	if cmd.Cmd == "Ping" && cmd.Service == "agent" {
+		h.pinged = true
+		return true
+	}
+	return false
+}
+
+// stale returns true if the API pings but has sent nothing for timeout.
+func (h *heartbeat) stale(now time.Time, timeout time.Duration) bool {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	return h.pinged && now.Sub(h.lastRecv) > timeout
+}
+
+// status returns the heartbeat status, or "" if the API does not ping.
+func (h *heartbeat) status() string {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	if !h.pinged {
+		return ""
+	}
+	return "Last API traffic at " + pct.TimeString(h.lastRecv)
+}
+
+// heartbeatTimeout returns HeartbeatTimeout as a duration.
+func (agent *Agent) heartbeatTimeout() time.Duration {
+	agent.configMux.RLock()
+	defer agent.configMux.RUnlock()
+	timeout := agent.config.HeartbeatTimeout
+	if timeout == 0 {
+		timeout = DEFAULT_HEARTBEAT_TIMEOUT
+	}
+	return time.Duration(timeout) * time.Second
+}
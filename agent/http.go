@@ -0,0 +1,165 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package agent
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/percona/cloud-protocol/proto/v1"
+	"github.com/percona/percona-agent/chaos"
+	"github.com/percona/percona-agent/pct"
+)
+
+// HTTPHandler serves agent and service status and configs as JSON so operators
+// can check the agent with curl or a load balancer probe without the API:
+//
+//	GET /status            AllStatus()
+//	GET /status/<service>  status of one service, or "agent"
+//	GET /config            all configs, like GetAllConfigs
+//	GET /config/<service>  config of one service, or "agent"
+//	GET /                  read-only web page if StatusUI, see httpUI
+//	/chaos                 fault injection in chaos builds, see package chaos
+//
+// The agent ApiKey is never returned.
+func (agent *Agent) HTTPHandler() http.Handler {
+	agent.configMux.RLock()
+	ui := agent.config.StatusUI
+	agent.configMux.RUnlock()
+
+	mux := http.NewServeMux()
+	if ui {
+		mux.HandleFunc("/", agent.httpUI)
+	}
+	mux.HandleFunc("/status", agent.httpStatus)
+	mux.HandleFunc("/status/", agent.httpStatus)
+	mux.HandleFunc("/config", agent.httpConfig)
+	mux.HandleFunc("/config/", agent.httpConfig)
+	if h := chaos.Handler(); h != nil {
+		mux.Handle("/chaos", h)
+		mux.Handle("/chaos/", h)
+	}
+	return mux
+}
+
+// Run:@goroutine[0]
+func (agent *Agent) startHTTP() {
+	agent.configMux.RLock()
+	addr := agent.config.StatusAddr
+	agent.configMux.RUnlock()
+	if addr == "" {
+		return
+	}
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		// Not fatal: the agent works without it.
+		agent.logger.Error("Cannot serve status on " + addr + ": " + err.Error())
+		return
+	}
+	agent.httpListener = listener
+	go http.Serve(listener, agent.HTTPHandler()) // returns when listener is closed
+	agent.logger.Info("Serving status on http://" + listener.Addr().String())
+}
+
+// Run:@goroutine[0]
+func (agent *Agent) stopHTTP() {
+	if agent.httpListener != nil {
+		agent.httpListener.Close()
+		agent.httpListener = nil
+	}
+}
+
+func (agent *Agent) httpStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	service := httpService(r.URL.Path, "/status")
+	status, err := agent.ServiceStatusEntries(service)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	httpJSON(w, status)
+}
+
+func (agent *Agent) httpConfig(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var configs []proto.AgentConfig
+	var errs []error
+	switch service := httpService(r.URL.Path, "/config"); service {
+	case "":
+		configs, errs = agent.allConfigs()
+	case "agent":
+		configs, errs = agent.GetConfig()
+	default:
+		manager, ok := agent.services[service]
+		if !ok {
+			http.Error(w, pct.UnknownServiceError{Service: service}.Error(), http.StatusNotFound)
+			return
+		}
+		configs, errs = manager.GetConfig()
+	}
+	for _, err := range errs {
+		if err != nil {
+			agent.logger.Warn("HTTP config:", err)
+		}
+	}
+	for i := range configs {
+		if configs[i].InternalService == "agent" {
+			configs[i].Config = redactApiKey(configs[i].Config)
+		}
+	}
+	if configs == nil {
+		configs = []proto.AgentConfig{} // not all services have a config
+	}
+	httpJSON(w, configs)
+}
+
+// httpService returns the service in path after prefix: "/status/qan" = "qan".
+func httpService(path, prefix string) string {
+	return strings.Trim(strings.TrimPrefix(path, prefix), "/")
+}
+
+func httpJSON(w http.ResponseWriter, v interface{}) {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
+
+func redactApiKey(config string) string {
+	c := &Config{}
+	if err := json.Unmarshal([]byte(config), c); err != nil {
+		return ""
+	}
+	c.ApiKey = ""
+	data, err := json.Marshal(c)
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
@@ -0,0 +1,169 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package agent
+
+import (
+	"errors"
+	"time"
+
+	"github.com/percona/cloud-protocol/proto/v1"
+	"github.com/percona/percona-agent/pct"
+)
+
+// Services told to go offline and online by the Offline and Online cmds.
+// Other services keep running: qan, mm, sysconfig, etc. still collect and
+// write reports to the data spool.
+var OFFLINE_SERVICES = []string{"log", "data"}
+
+// Wait this long after replying to Offline before disconnecting from the API
+// so the reply is sent.
+var OFFLINE_DISCONNECT_DELAY = 2 * time.Second
+
+// Offline returns true if the agent is in offline mode: it does not connect
+// to the API, and data is retained in the data spool until Drain or Online.
+func (agent *Agent) Offline() bool {
+	agent.configMux.RLock()
+	defer agent.configMux.RUnlock()
+	return agent.config.Offline
+}
+
+// Handle:@goroutine[3]
+func (agent *Agent) handleOffline(cmd *proto.Cmd) (interface{}, []error) {
+	agent.status.UpdateRe("agent-cmd-handler", "Offline", cmd)
+	agent.logger.Info(cmd)
+
+	if agent.Offline() {
+		return nil, []error{errors.New("Agent is already offline")}
+	}
+	errs := agent.setServicesOffline(cmd, true)
+	if err := agent.writeOffline(true); err != nil {
+		errs = append(errs, err)
+	}
+	agent.logger.Warn("Offline: not connecting to API; data is spooled until Drain or Online")
+
+	// Run() does not reconnect when the cmd ws disconnects while offline.
+	time.AfterFunc(OFFLINE_DISCONNECT_DELAY, func() { agent.client.Disconnect() })
+
+	return nil, errs
+}
+
+// Handle:@goroutine[3]
+func (agent *Agent) handleOnline(cmd *proto.Cmd) (interface{}, []error) {
+	agent.status.UpdateRe("agent-cmd-handler", "Online", cmd)
+	agent.logger.Info(cmd)
+
+	if !agent.Offline() {
+		return nil, []error{errors.New("Agent is not offline")}
+	}
+
+	// Stay offline if the API is not reachable.
+	if err := agent.connectAPI(); err != nil {
+		return nil, []error{err}
+	}
+
+	if err := agent.writeOffline(false); err != nil {
+		return nil, []error{err}
+	}
+	errs := agent.setServicesOffline(cmd, false) // data drains the spool
+	agent.logger.Info("Online: connecting to API")
+	go agent.connect()
+
+	return nil, errs
+}
+
+// Handle:@goroutine[3]
+func (agent *Agent) handleDrain(cmd *proto.Cmd) (interface{}, []error) {
+	agent.status.UpdateRe("agent-cmd-handler", "Drain", cmd)
+	agent.logger.Info(cmd)
+
+	m, ok := agent.services["data"]
+	if !ok {
+		return nil, []error{pct.UnknownServiceError{Service: "data"}}
+	}
+
+	// Offline, the agent may have never connected to the API, so the data
+	// ws does not have its link yet.
+	if err := agent.connectAPI(); err != nil {
+		return nil, []error{err}
+	}
+
+	drainCmd := &proto.Cmd{
+		Ts:      time.Now().UTC(),
+		User:    cmd.User,
+		Service: "data",
+		Cmd:     "Drain",
+	}
+	if reply := m.Handle(drainCmd); reply != nil && reply.Error != "" {
+		return nil, []error{errors.New(reply.Error)}
+	}
+	return nil, nil
+}
+
+// setServicesOffline sends the Offline or Online cmd to OFFLINE_SERVICES.
+func (agent *Agent) setServicesOffline(cmd *proto.Cmd, offline bool) []error {
+	serviceCmd := "Online"
+	if offline {
+		serviceCmd = "Offline"
+	}
+	errs := []error{}
+	for _, service := range OFFLINE_SERVICES {
+		m, ok := agent.services[service]
+		if !ok {
+			continue
+		}
+		c := &proto.Cmd{
+			Ts:      time.Now().UTC(),
+			User:    cmd.User,
+			Service: service,
+			Cmd:     serviceCmd,
+		}
+		if reply := m.Handle(c); reply != nil && reply.Error != "" {
+			errs = append(errs, errors.New(service+": "+reply.Error))
+		}
+	}
+	return errs
+}
+
+// connectAPI connects to the API if the agent does not have the API links,
+// i.e. it started offline.
+func (agent *Agent) connectAPI() error {
+	if agent.api.AgentLink("cmd") != "" {
+		return nil
+	}
+	agent.configMux.RLock()
+	hostname := agent.config.ApiHostname
+	apiKey := agent.config.ApiKey
+	agentUuid := agent.config.AgentUuid
+	agent.configMux.RUnlock()
+	if err := agent.api.Connect(hostname, apiKey, agentUuid); err != nil {
+		return errors.New("Cannot connect to API: " + err.Error())
+	}
+	return nil
+}
+
+func (agent *Agent) writeOffline(offline bool) error {
+	agent.configMux.Lock()
+	defer agent.configMux.Unlock()
+	config := *agent.config
+	config.Offline = offline
+	if err := pct.Basedir.WriteConfig("agent", config); err != nil {
+		return errors.New("agent.WriteConfig:" + err.Error())
+	}
+	agent.config = &config
+	return nil
+}
@@ -0,0 +1,116 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package agent
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/percona/cloud-protocol/proto/v1"
+	"github.com/percona/percona-agent/pct"
+)
+
+// Services that collect or send data, stopped by Pause in this order and
+// started by Resume in reverse order.  The agent, its websocket, and other
+// services keep running so the agent can still be managed.  percona-agent
+// sets this from the service registry, see registry.Service.Pause.
+var PAUSE_SERVICES = []string{"qan", "mm", "sysconfig", "schema", "plan", "index", "sampler", "waits", "memory", "hostcache", "data"}
+
+// Paused returns when the agent was paused, or zero time if it's not paused.
+func (agent *Agent) Paused() time.Time {
+	agent.pauseMux.Lock()
+	defer agent.pauseMux.Unlock()
+	return agent.paused
+}
+
+// Handle:@goroutine[3]
+func (agent *Agent) handlePause(cmd *proto.Cmd) (interface{}, []error) {
+	agent.status.UpdateRe("agent-cmd-handler", "Pause", cmd)
+	agent.logger.Info(cmd)
+
+	agent.pauseMux.Lock()
+	defer agent.pauseMux.Unlock()
+	if !agent.paused.IsZero() {
+		return nil, []error{fmt.Errorf("Agent already paused since %s", pct.TimeString(agent.paused))}
+	}
+
+	// Pause even if some services fail to stop, else it's unclear which are
+	// stopped.  Resume starts all of them.
+	errs := []error{}
+	for _, service := range PAUSE_SERVICES {
+		m, ok := agent.services[service]
+		if !ok {
+			continue
+		}
+		agent.status.UpdateRe("agent-cmd-handler", "Pause: stopping "+service, cmd)
+		agent.logger.Info("Pause: stopping " + service)
+		if err := m.Stop(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	agent.paused = time.Now()
+	agent.logger.Warn("Paused: not collecting or sending data until Resume")
+
+	return nil, errs
+}
+
+// Handle:@goroutine[3]
+func (agent *Agent) handleResume(cmd *proto.Cmd) (interface{}, []error) {
+	agent.status.UpdateRe("agent-cmd-handler", "Resume", cmd)
+	agent.logger.Info(cmd)
+
+	agent.pauseMux.Lock()
+	defer agent.pauseMux.Unlock()
+	if agent.paused.IsZero() {
+		return nil, []error{fmt.Errorf("Agent is not paused")}
+	}
+
+	errs := []error{}
+	for i := len(PAUSE_SERVICES) - 1; i >= 0; i-- {
+		service := PAUSE_SERVICES[i]
+		m, ok := agent.services[service]
+		if !ok {
+			continue
+		}
+		agent.status.UpdateRe("agent-cmd-handler", "Resume: starting "+service, cmd)
+		agent.logger.Info("Resume: starting " + service)
+		if err := m.Start(); err != nil {
+			if _, ok := err.(pct.ServiceIsRunningError); !ok {
+				errs = append(errs, err)
+			}
+		}
+	}
+	agent.logger.Info(fmt.Sprintf("Resumed after pause of %s", time.Now().Sub(agent.paused)))
+	agent.paused = time.Time{}
+
+	return nil, errs
+}
+
+// isPausedService returns true if the agent is paused and the service is one
+// of PAUSE_SERVICES, i.e. it must not be started until Resume.
+func (agent *Agent) isPausedService(service string) bool {
+	if agent.Paused().IsZero() {
+		return false
+	}
+	for _, s := range PAUSE_SERVICES {
+		if s == service {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,91 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package agent
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"reflect"
+
+	"github.com/percona/cloud-protocol/proto/v1"
+	"github.com/percona/percona-agent/pct"
+)
+
+// cmdAllowed returns a pct.CmdNotAllowedError if the agent config does not
+// allow the cmd from the API, else nil.  Cmds are matched as Service.Cmd,
+// e.g. agent.Update, against AllowCmds then DenyCmds.  Status is always
+// allowed so a restricted agent can still be monitored, and cmds from
+// "percona-agent ctl" are not restricted because they're run on the host.
+func (agent *Agent) cmdAllowed(cmd *proto.Cmd) error {
+	if cmd.Cmd == "Status" {
+		return nil
+	}
+	agent.configMux.RLock()
+	allow := agent.config.AllowCmds
+	deny := agent.config.DenyCmds
+	agent.configMux.RUnlock()
+
+	service := cmd.Service
+	if service == "" {
+		service = "agent" // e.g. Stop and Restart
+	}
+	name := service + "." + cmd.Cmd
+	if (len(allow) > 0 && !matchCmd(allow, name)) || matchCmd(deny, name) {
+		return pct.CmdNotAllowedError{Service: service, Cmd: cmd.Cmd}
+	}
+	return nil
+}
+
+func matchCmd(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func validateCmdPatterns(patterns []string) error {
+	for _, pattern := range patterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("Invalid cmd pattern: '%s': %s.  Expected Service.Cmd, e.g. agent.Update or *.StopService.", pattern, err)
+		}
+	}
+	return nil
+}
+
+// setCmdPolicy sets and writes AllowCmds and DenyCmds.  SetConfig does not
+// change them, else the API could lift its own restrictions, so they're
+// changed only by editing agent.conf and reloading.
+func (agent *Agent) setCmdPolicy(allow, deny []string) error {
+	agent.configMux.Lock()
+	defer agent.configMux.Unlock()
+	if reflect.DeepEqual(allow, agent.config.AllowCmds) && reflect.DeepEqual(deny, agent.config.DenyCmds) {
+		return nil
+	}
+	config := *agent.config
+	config.AllowCmds = allow
+	config.DenyCmds = deny
+	if err := pct.Basedir.WriteConfig("agent", config); err != nil {
+		return errors.New("agent.WriteConfig:" + err.Error())
+	}
+	agent.config = &config
+	agent.logger.Warn(fmt.Sprintf("Cmd policy changed: AllowCmds=%v DenyCmds=%v", allow, deny))
+	return nil
+}
@@ -0,0 +1,403 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package agent
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/percona/cloud-protocol/proto/v1"
+	"github.com/percona/percona-agent/bus"
+	"github.com/percona/percona-agent/pct"
+)
+
+// Handle:@goroutine[3]
+func (agent *Agent) handleReload(cmd *proto.Cmd) (interface{}, []error) {
+	agent.status.UpdateRe("agent-cmd-handler", "Reload", cmd)
+	agent.logger.Info(cmd)
+
+	// Configs changed by hand since the agent last read or wrote them.
+	// Configs the agent changes, e.g. on SetConfig, are not reloaded.
+	changed, err := pct.Basedir.ChangedConfigs()
+	if err != nil {
+		return nil, []error{err}
+	}
+
+	// Map config files to services: mm-mysql-1 is an mm config, but
+	// mysql-1 is an instance config.
+	reload := []string{}
+	seen := map[string]bool{}
+	overridesChanged := false
+	for _, name := range changed {
+		if name == CONFIG_OVERRIDES {
+			overridesChanged = true
+			continue
+		}
+		service := agent.configService(name)
+		if service == "" || seen[service] {
+			continue
+		}
+		seen[service] = true
+		if service == "agent" {
+			reload = append([]string{service}, reload...) // first: it can change the API
+		} else {
+			reload = append(reload, service)
+		}
+	}
+	if len(reload) == 0 && !overridesChanged {
+		agent.logger.Info("No configs changed, nothing to reload")
+		return reload, nil
+	}
+
+	errs := []error{}
+	reloaded := []string{}
+	for _, service := range reload {
+		agent.status.UpdateRe("agent-cmd-handler", "Reloading "+service, cmd)
+		if service == "agent" {
+			if reloadErrs := agent.reloadConfig(cmd); len(reloadErrs) > 0 {
+				errs = append(errs, reloadErrs...)
+				continue
+			}
+		} else if agent.isPausedService(service) {
+			// Resume starts the service which loads its new config.
+			agent.logger.Info("Not restarting " + service + " to reload its config: agent is paused")
+			continue
+		} else {
+			// Restart the service.  Managers load their config on Start.
+			agent.logger.Info("Restarting " + service + " to reload its config")
+			m := agent.services[service]
+			if err := m.Stop(); err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			if err := m.Start(); err != nil {
+				errs = append(errs, err)
+				continue
+			}
+		}
+		reloaded = append(reloaded, service)
+		agent.bus.Publish(bus.Event{Topic: bus.CONFIG_CHANGED, Source: "agent", Data: service})
+	}
+
+	// Local overrides of the config group template changed, so re-apply it.
+	agent.configMux.RLock()
+	group := agent.config.ConfigGroup
+	agent.configMux.RUnlock()
+	if overridesChanged && group != "" {
+		agent.status.UpdateRe("agent-cmd-handler", "Reloading "+CONFIG_OVERRIDES, cmd)
+		set, applyErrs := agent.applyConfigGroup(cmd)
+		errs = append(errs, applyErrs...)
+		reloaded = append(reloaded, set...)
+	}
+
+	// Services rewrite their configs on Start (e.g. with defaults), which
+	// does not count as changed by hand.
+	pct.Basedir.ChangedConfigs()
+
+	return reloaded, errs
+}
+
+// configService returns the service of a config file, or "" if unknown.
+func (agent *Agent) configService(name string) string {
+	service := name
+	if i := strings.Index(name, "-"); i > 0 {
+		service = name[0:i]
+	}
+	if service == "agent" {
+		return service
+	}
+	if _, ok := agent.services[service]; ok {
+		return service
+	}
+	if service == "mysql" || service == "server" {
+		if _, ok := agent.services["instance"]; ok {
+			return "instance"
+		}
+	}
+	return ""
+}
+
+// reloadConfig applies agent.conf like SetConfig, sets the cmd policy, TLS
+// options, API timeouts and retries, anonymization, excluded data, and the
+// config group (applying it if changed), goes offline or online if Offline
+// changed, else reconnects to the API if ApiKey, ApiHostname, Proxy, or the
+// TLS options changed.
+func (agent *Agent) reloadConfig(cmd *proto.Cmd) []error {
+	data, err := LoadConfig()
+	if err != nil {
+		return []error{err}
+	}
+
+	agent.configMux.RLock()
+	oldConfig := *agent.config
+	agent.configMux.RUnlock()
+
+	setConfigCmd := &proto.Cmd{
+		Ts:        time.Now().UTC(),
+		User:      cmd.User,
+		AgentUuid: cmd.AgentUuid,
+		Service:   "agent",
+		Cmd:       "SetConfig",
+		Data:      data,
+	}
+	_, errs := agent.handleSetConfig(setConfigCmd)
+	if len(errs) > 0 {
+		return errs
+	}
+
+	// SetConfig does not change Offline, AllowCmds, DenyCmds, or the API TLS
+	// options: the API must not change how the agent trusts it.  Apply the cmd
+	// policy and TLS options first, then go offline or online like the Offline
+	// and Online cmds.
+	fileConfig := &Config{}
+	if err := json.Unmarshal(data, fileConfig); err != nil {
+		return []error{err}
+	}
+	if err := agent.setCmdPolicy(fileConfig.AllowCmds, fileConfig.DenyCmds); err != nil {
+		return []error{err}
+	}
+	tlsChanged, err := agent.setTLS(fileConfig)
+	if err != nil {
+		return []error{err}
+	}
+	if err := agent.setAnonymize(fileConfig.Anonymize); err != nil {
+		return []error{err}
+	}
+	if err := agent.setSeparateCredentials(fileConfig.SeparateCredentials); err != nil {
+		return []error{err}
+	}
+	if err := agent.setUpdateCheckOnly(fileConfig.UpdateCheckOnly); err != nil {
+		return []error{err}
+	}
+	if err := agent.setAPIOptions(fileConfig); err != nil {
+		return []error{err}
+	}
+	if err := agent.setExcludeData(fileConfig.ExcludeData); err != nil {
+		return []error{err}
+	}
+	if changed, err := agent.setConfigGroup(fileConfig.ConfigGroup); err != nil {
+		return []error{err}
+	} else if changed && fileConfig.ConfigGroup != "" {
+		if _, errs := agent.applyConfigGroup(cmd); len(errs) > 0 {
+			return errs
+		}
+	}
+	if fileConfig.Offline && !oldConfig.Offline {
+		_, errs := agent.handleOffline(cmd)
+		return errs
+	} else if !fileConfig.Offline && oldConfig.Offline {
+		_, errs := agent.handleOnline(cmd)
+		return errs
+	}
+
+	agent.configMux.RLock()
+	newConfig := *agent.config
+	agent.configMux.RUnlock()
+
+	if newConfig.ApiKey != oldConfig.ApiKey || newConfig.ApiHostname != oldConfig.ApiHostname ||
+		newConfig.Proxy != oldConfig.Proxy || tlsChanged {
+		agent.reconnect(cmd)
+	}
+	return nil
+}
+
+// reconnect reconnects the cmd and log websockets to the API, e.g. to use a
+// new API key.  Like Reconnect: Run() reconnects when the cmd ws disconnects.
+// The log ws has its own connection, so tell it to reconnect, too.  The data
+// sender connects for each send, so it reconnects on its own.
+func (agent *Agent) reconnect(cmd *proto.Cmd) {
+	agent.logger.Info("Reconnecting to API")
+	agent.client.Disconnect()
+	if m, ok := agent.services["log"]; ok {
+		reconnectCmd := &proto.Cmd{
+			Ts:      time.Now().UTC(),
+			User:    cmd.User,
+			Service: "log",
+			Cmd:     "Reconnect",
+		}
+		if reply := m.Handle(reconnectCmd); reply != nil && reply.Error != "" {
+			agent.logger.Warn("Failed to reconnect log:", reply.Error)
+		}
+	}
+}
+
+// setTLS sets the API TLS options (ApiCA, ApiCert, ApiCertKey, ApiPins) used
+// by new connections and returns true if they changed.
+func (agent *Agent) setTLS(fileConfig *Config) (bool, error) {
+	agent.configMux.Lock()
+	defer agent.configMux.Unlock()
+	if fileConfig.ApiCA == agent.config.ApiCA && fileConfig.ApiCert == agent.config.ApiCert &&
+		fileConfig.ApiCertKey == agent.config.ApiCertKey && reflect.DeepEqual(fileConfig.ApiPins, agent.config.ApiPins) {
+		return false, nil
+	}
+	if err := pct.SetTLS(fileConfig.ApiCA, fileConfig.ApiCert, fileConfig.ApiCertKey, fileConfig.ApiPins); err != nil {
+		return false, err
+	}
+	config := *agent.config
+	config.ApiCA = fileConfig.ApiCA
+	config.ApiCert = fileConfig.ApiCert
+	config.ApiCertKey = fileConfig.ApiCertKey
+	config.ApiPins = fileConfig.ApiPins
+	if err := pct.Basedir.WriteConfig("agent", config); err != nil {
+		return false, errors.New("agent.WriteConfig:" + err.Error())
+	}
+	agent.config = &config
+	agent.logger.Warn("API TLS options changed")
+	return true, nil
+}
+
+// setAnonymize enables or disables anonymization.  Like the TLS options, only
+// agent.conf changes it, not SetConfig: the API must not turn it off.
+func (agent *Agent) setAnonymize(enabled bool) error {
+	agent.configMux.Lock()
+	defer agent.configMux.Unlock()
+	if enabled == agent.config.Anonymize {
+		return nil
+	}
+	if err := pct.SetAnonymize(enabled); err != nil {
+		return err
+	}
+	config := *agent.config
+	config.Anonymize = enabled
+	if err := pct.Basedir.WriteConfig("agent", config); err != nil {
+		return errors.New("agent.WriteConfig:" + err.Error())
+	}
+	agent.config = &config
+	if enabled {
+		agent.logger.Warn("Anonymizing schema, table, and user names")
+	} else {
+		agent.logger.Warn("Not anonymizing schema, table, and user names")
+	}
+	return nil
+}
+
+// setUpdateCheckOnly enables or disables check only updates.  Like the cmd
+// policy, only agent.conf changes it: the API must not make a check only
+// host install updates.
+func (agent *Agent) setUpdateCheckOnly(enabled bool) error {
+	agent.configMux.Lock()
+	defer agent.configMux.Unlock()
+	if enabled == agent.config.UpdateCheckOnly {
+		return nil
+	}
+	config := *agent.config
+	config.UpdateCheckOnly = enabled
+	if err := pct.Basedir.WriteConfig("agent", config); err != nil {
+		return errors.New("agent.WriteConfig:" + err.Error())
+	}
+	agent.config = &config
+	if enabled {
+		agent.logger.Warn("Update only checks for new versions")
+	} else {
+		agent.logger.Warn("Update installs new versions")
+	}
+	return nil
+}
+
+// setSeparateCredentials moves secrets out of or back into the configs.  Like
+// setAnonymize, only agent.conf changes it.
+func (agent *Agent) setSeparateCredentials(enabled bool) error {
+	agent.configMux.Lock()
+	defer agent.configMux.Unlock()
+	if enabled == agent.config.SeparateCredentials {
+		return nil
+	}
+	config := *agent.config
+	config.SeparateCredentials = enabled
+	if err := pct.Basedir.WriteConfig("agent", config); err != nil {
+		return errors.New("agent.WriteConfig:" + err.Error())
+	}
+	if err := pct.Basedir.SeparateCredentials(enabled); err != nil {
+		return err
+	}
+	agent.config = &config
+	if enabled {
+		agent.logger.Warn("Credentials separated from configs")
+	} else {
+		agent.logger.Warn("Credentials stored in configs")
+	}
+	return nil
+}
+
+// setAPIOptions sets the API timeouts, retries, and dialing options
+// (ApiDialTimeout, ApiReadTimeout, ApiRetries, ApiRetryWait, ApiFallbackDelay,
+// ApiAddrTimeout, ApiPreferIPv4) used by new requests and connections.
+func (agent *Agent) setAPIOptions(fileConfig *Config) error {
+	agent.configMux.Lock()
+	defer agent.configMux.Unlock()
+	if fileConfig.APIOptions() == agent.config.APIOptions() {
+		return nil
+	}
+	pct.SetAPIOptions(fileConfig.APIOptions())
+	config := *agent.config
+	config.ApiDialTimeout = fileConfig.ApiDialTimeout
+	config.ApiReadTimeout = fileConfig.ApiReadTimeout
+	config.ApiRetries = fileConfig.ApiRetries
+	config.ApiRetryWait = fileConfig.ApiRetryWait
+	config.ApiFallbackDelay = fileConfig.ApiFallbackDelay
+	config.ApiAddrTimeout = fileConfig.ApiAddrTimeout
+	config.ApiPreferIPv4 = fileConfig.ApiPreferIPv4
+	if err := pct.Basedir.WriteConfig("agent", config); err != nil {
+		return errors.New("agent.WriteConfig:" + err.Error())
+	}
+	agent.config = &config
+	agent.logger.Info("API timeouts and retries changed")
+	return nil
+}
+
+// setExcludeData sets the data categories never spooled or sent.  Like
+// anonymization, only agent.conf changes it, not SetConfig.
+func (agent *Agent) setExcludeData(categories []string) error {
+	agent.configMux.Lock()
+	defer agent.configMux.Unlock()
+	if reflect.DeepEqual(categories, agent.config.ExcludeData) {
+		return nil
+	}
+	if err := pct.SetExcludeData(categories); err != nil {
+		return err
+	}
+	config := *agent.config
+	config.ExcludeData = categories
+	if err := pct.Basedir.WriteConfig("agent", config); err != nil {
+		return errors.New("agent.WriteConfig:" + err.Error())
+	}
+	agent.config = &config
+	agent.logger.Warn("Excluding data:", strings.Join(categories, ", "))
+	return nil
+}
+
+// setConfigGroup sets the config group and returns true if it changed.  Like
+// the cmd policy, only agent.conf changes it, not SetConfig.
+func (agent *Agent) setConfigGroup(group string) (bool, error) {
+	agent.configMux.Lock()
+	defer agent.configMux.Unlock()
+	if group == agent.config.ConfigGroup {
+		return false, nil
+	}
+	config := *agent.config
+	config.ConfigGroup = group
+	if err := pct.Basedir.WriteConfig("agent", config); err != nil {
+		return false, errors.New("agent.WriteConfig:" + err.Error())
+	}
+	agent.config = &config
+	agent.logger.Info("Config group changed to", group)
+	return true, nil
+}
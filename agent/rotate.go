@@ -0,0 +1,93 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package agent
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/percona/cloud-protocol/proto/v1"
+	"github.com/percona/percona-agent/pct"
+)
+
+// RotateApiKey is the data of the RotateApiKey cmd.
+type RotateApiKey struct {
+	ApiKey string
+}
+
+// handleRotateApiKey switches all API connections to a new API key.  The REST
+// API connects with the new key first, which keeps the old key if that fails,
+// so a bad key does not disconnect the agent.  Then the new key is saved and
+// the websockets reconnect with it, see reconnect.  Unlike SetConfig, which
+// only changes the REST API key, nothing keeps using the old key.
+// Handle:@goroutine[3]
+func (agent *Agent) handleRotateApiKey(cmd *proto.Cmd) (interface{}, []error) {
+	agent.status.UpdateRe("agent-cmd-handler", "RotateApiKey", cmd)
+
+	rotate := &RotateApiKey{}
+	if err := json.Unmarshal(cmd.Data, rotate); err != nil {
+		return nil, []error{err}
+	}
+	if rotate.ApiKey == "" {
+		return nil, []error{errors.New("Missing ApiKey")}
+	}
+
+	changed, err := agent.setApiKey(rotate.ApiKey)
+	if err != nil {
+		return nil, []error{err}
+	}
+	if !changed {
+		return nil, nil
+	}
+
+	// Reconnect without holding configMux: Run() reads the config when the
+	// cmd ws disconnects.
+	agent.logger.Warn("Rotated API key")
+	agent.reconnect(cmd)
+	return nil, nil
+}
+
+// setApiKey connects the REST API with the new key and saves it.  It returns
+// false if the key did not change.
+func (agent *Agent) setApiKey(apiKey string) (bool, error) {
+	agent.configMux.Lock()
+	defer agent.configMux.Unlock()
+
+	oldKey := agent.config.ApiKey
+	if apiKey == oldKey {
+		return false, nil
+	}
+	agent.logger.Info("Rotating API key") // not the key
+
+	if err := agent.api.Connect(agent.config.ApiHostname, apiKey, agent.api.AgentUuid()); err != nil {
+		return false, fmt.Errorf("New API key does not work, still using the old key: %s", err)
+	}
+
+	config := *agent.config
+	config.ApiKey = apiKey
+	if err := pct.Basedir.WriteConfig("agent", config); err != nil {
+		// Switch back: the agent would use the old key after a restart.
+		if err := agent.api.Connect(agent.config.ApiHostname, oldKey, agent.api.AgentUuid()); err != nil {
+			agent.logger.Error("Cannot switch back to the old API key:", err)
+		}
+		return false, errors.New("agent.WriteConfig:" + err.Error())
+	}
+	agent.config = &config
+	return true, nil
+}
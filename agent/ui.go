@@ -0,0 +1,155 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package agent
+
+import (
+	"html/template"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/percona/cloud-protocol/proto/v1"
+	"github.com/percona/percona-agent/pct"
+)
+
+// recentLogger is a service that keeps recent log entries, e.g. log.Manager.
+type recentLogger interface {
+	RecentEntries() []proto.LogEntry
+}
+
+type uiStatus struct {
+	Name string
+	pct.StatusEntry
+}
+
+type uiPage struct {
+	Ts      time.Time
+	Version string
+	Status  []uiStatus
+	Spool   []uiStatus
+	QAN     []uiStatus
+	Logs    []proto.LogEntry // newest first
+}
+
+var uiFuncs = template.FuncMap{
+	"level": func(level byte) string {
+		return proto.LogLevelName[level]
+	},
+	"ts": func(ts time.Time) string {
+		if ts.IsZero() {
+			return ""
+		}
+		return ts.UTC().Format("2006-01-02 15:04:05 MST")
+	},
+}
+
+var uiTemplate = template.Must(template.New("ui").Funcs(uiFuncs).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta http-equiv="refresh" content="10">
+<title>percona-agent {{.Version}}</title>
+<style>
+body { font-family: sans-serif; font-size: 13px; }
+table { border-collapse: collapse; margin-bottom: 20px; }
+th, td { border: 1px solid #ccc; padding: 2px 6px; text-align: left; vertical-align: top; }
+th { background: #eee; }
+</style>
+</head>
+<body>
+<h1>percona-agent {{.Version}}</h1>
+<p>{{ts .Ts}}, read-only, refreshes every 10s</p>
+
+<h2>QAN</h2>
+<table>
+<tr><th>Status</th><th>Value</th><th>Since</th></tr>
+{{range .QAN}}<tr><td>{{.Name}}</td><td>{{.State}}</td><td>{{ts .Since}}</td></tr>
+{{else}}<tr><td colspan="3">No QAN intervals</td></tr>
+{{end}}</table>
+
+<h2>Spool</h2>
+<table>
+<tr><th>Status</th><th>Value</th><th>Since</th></tr>
+{{range .Spool}}<tr><td>{{.Name}}</td><td>{{.State}}</td><td>{{ts .Since}}</td></tr>
+{{else}}<tr><td colspan="3">No spooler</td></tr>
+{{end}}</table>
+
+<h2>Status</h2>
+<table>
+<tr><th>Status</th><th>Value</th><th>Since</th></tr>
+{{range .Status}}<tr><td>{{.Name}}</td><td>{{.State}}</td><td>{{ts .Since}}</td></tr>
+{{end}}</table>
+
+<h2>Log</h2>
+<table>
+<tr><th>Ts</th><th>Level</th><th>Service</th><th>Message</th></tr>
+{{range .Logs}}<tr><td>{{ts .Ts}}</td><td>{{level .Level}}</td><td>{{.Service}}</td><td>{{.Msg}}</td></tr>
+{{else}}<tr><td colspan="4">No log entries</td></tr>
+{{end}}</table>
+</body>
+</html>
+`))
+
+// httpUI serves a read-only page with status, the spool backlog, the last QAN
+// intervals, and recent log entries for operators who cannot reach the API web
+// app.  It is served at / on StatusAddr if StatusUI is true.
+func (agent *Agent) httpUI(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	page := &uiPage{
+		Ts:      time.Now(),
+		Version: VERSION,
+	}
+
+	status := agent.AllStatus()
+	names := make([]string, 0, len(status))
+	for name := range status {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		s := uiStatus{Name: name, StatusEntry: status[name]}
+		page.Status = append(page.Status, s)
+		if strings.HasPrefix(name, "data-spooler") {
+			page.Spool = append(page.Spool, s)
+		}
+		if strings.HasPrefix(name, "qan") && (strings.HasSuffix(name, "-last-interval") || strings.HasSuffix(name, "-last-report")) {
+			page.QAN = append(page.QAN, s)
+		}
+	}
+
+	if m, ok := agent.services["log"].(recentLogger); ok {
+		logs := m.RecentEntries()
+		for i := len(logs) - 1; i >= 0; i-- {
+			page.Logs = append(page.Logs, logs[i])
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := uiTemplate.Execute(w, page); err != nil {
+		agent.logger.Warn("HTTP UI:", err)
+	}
+}
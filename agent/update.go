@@ -0,0 +1,207 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package agent
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/percona/cloud-protocol/proto/v1"
+)
+
+// An UpdateRequest is the Data of the Update cmd.  For backwards
+// compatibility, Data can also be only the version, e.g. "1.0.12".
+type UpdateRequest struct {
+	Version   string // or "latest" in Channel
+	ApplyAt   string `json:",omitempty"` // window like Config.UpdateWindow, "now", or empty for Config.UpdateWindow
+	Channel   string `json:",omitempty"` // channel like Config.UpdateChannel, or empty for Config.UpdateChannel
+	CheckOnly bool   `json:",omitempty"` // only check for a newer version, like Config.UpdateCheckOnly
+}
+
+// VersionInfo is the reply of the Version cmd: proto.Version plus the update
+// channel and the newer version in it found by the last Update, if any.
+type VersionInfo struct {
+	proto.Version
+	Channel   string
+	Available string `json:",omitempty"`
+}
+
+// An UpdateWindow is a daily time window, local time, parsed from a string
+// like "02:00-04:00".  The end is exclusive, and the window wraps at
+// midnight if End < Start, e.g. "23:00-01:00".
+type UpdateWindow struct {
+	Start int // minutes since midnight
+	End   int
+}
+
+func ParseUpdateWindow(s string) (UpdateWindow, error) {
+	w := UpdateWindow{}
+	parts := strings.Split(s, "-")
+	if len(parts) != 2 {
+		return w, fmt.Errorf("Invalid update window: %s: expected HH:MM-HH:MM", s)
+	}
+	var err error
+	if w.Start, err = parseClock(parts[0]); err != nil {
+		return w, fmt.Errorf("Invalid update window: %s: %s", s, err)
+	}
+	if w.End, err = parseClock(parts[1]); err != nil {
+		return w, fmt.Errorf("Invalid update window: %s: %s", s, err)
+	}
+	if w.Start == w.End {
+		return w, fmt.Errorf("Invalid update window: %s: start equals end", s)
+	}
+	return w, nil
+}
+
+func parseClock(s string) (int, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(s))
+	if err != nil {
+		return 0, err
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// Contains returns true if t, local time, is in the window.
+func (w UpdateWindow) Contains(t time.Time) bool {
+	m := t.Hour()*60 + t.Minute()
+	if w.Start < w.End {
+		return m >= w.Start && m < w.End
+	}
+	return m >= w.Start || m < w.End
+}
+
+func (w UpdateWindow) String() string {
+	return fmt.Sprintf("%02d:%02d-%02d:%02d", w.Start/60, w.Start%60, w.End/60, w.End%60)
+}
+
+// A scheduledUpdate was downloaded by the Update cmd and is applied by Run
+// in the window.
+type scheduledUpdate struct {
+	version string
+	window  UpdateWindow
+}
+
+// Handle:@goroutine[3]
+func (agent *Agent) handleUpdate(cmd *proto.Cmd) (interface{}, []error) {
+	agent.status.UpdateRe("agent-cmd-handler", "Update", cmd)
+	agent.logger.Info(cmd)
+
+	req := &UpdateRequest{}
+	if len(cmd.Data) > 0 && cmd.Data[0] == '{' {
+		if err := json.Unmarshal(cmd.Data, req); err != nil {
+			return nil, []error{err}
+		}
+	} else {
+		req.Version = string(cmd.Data)
+	}
+
+	agent.configMux.RLock()
+	config := *agent.config
+	agent.configMux.RUnlock()
+
+	channel := req.Channel
+	if channel == "" {
+		channel = config.UpdateChannel
+	}
+	if err := agent.updater.SetChannel(channel); err != nil {
+		return nil, []error{err}
+	}
+
+	// Resolve the latest version in the channel.  Check only mode stops
+	// here: the version is reported by the Version cmd.
+	checkOnly := req.CheckOnly || config.UpdateCheckOnly
+	if req.Version == "" || req.Version == "latest" || checkOnly {
+		_, latest, err := agent.updater.Check()
+		if err != nil {
+			return nil, []error{err}
+		}
+		agent.updateMux.Lock()
+		agent.availableVersion = latest
+		agent.updateMux.Unlock()
+		if latest == "" {
+			return fmt.Sprintf("No version newer than %s in update channel %s", VERSION, agent.updater.Channel()), nil
+		}
+		if checkOnly {
+			msg := fmt.Sprintf("Version %s is available in update channel %s", latest, agent.updater.Channel())
+			agent.logger.Info(msg)
+			return msg, nil
+		}
+		if req.Version == "" || req.Version == "latest" {
+			req.Version = latest
+		}
+	}
+
+	applyAt := req.ApplyAt
+	if applyAt == "" {
+		applyAt = config.UpdateWindow
+	}
+	// Rotate the update keys first: the version may be signed by a new key.
+	if err := agent.updater.UpdateKeys(); err != nil {
+		agent.logger.Warn("Cannot update keys:", err)
+	}
+
+	if applyAt == "" || applyAt == "now" {
+		err := agent.updater.Update(req.Version)
+		return nil, []error{err}
+	}
+	window, err := ParseUpdateWindow(applyAt)
+	if err != nil {
+		return nil, []error{err}
+	}
+
+	// Download now so the update is ready in the window, but don't replace
+	// the binary and restart until then, see Run.
+	if err := agent.updater.Download(req.Version); err != nil {
+		return nil, []error{err}
+	}
+	agent.updateMux.Lock()
+	agent.scheduledUpdate = &scheduledUpdate{version: req.Version, window: window}
+	agent.updateMux.Unlock()
+	msg := fmt.Sprintf("Downloaded version %s; updating and restarting between %s local time", req.Version, window)
+	agent.logger.Info(msg)
+	return msg, nil
+}
+
+// applyScheduledUpdate applies the update scheduled by the Update cmd and
+// restarts the agent if now is in its window.  It returns true if the agent
+// is restarting, so Run must return.
+// Run:@goroutine[0]
+func (agent *Agent) applyScheduledUpdate(now time.Time) bool {
+	agent.updateMux.Lock()
+	update := agent.scheduledUpdate
+	if update == nil || !update.window.Contains(now) {
+		agent.updateMux.Unlock()
+		return false
+	}
+	agent.scheduledUpdate = nil
+	agent.updateMux.Unlock()
+
+	if err := agent.updater.Apply(update.version); err != nil {
+		agent.logger.Error("Scheduled update to version " + update.version + " failed: " + err.Error())
+		return false
+	}
+	cmd := &proto.Cmd{Ts: now.UTC(), User: "agent", Service: "agent", Cmd: "Restart"}
+	if _, err := agent.restartSelf(cmd); err != nil {
+		agent.logger.Error("Updated to version " + update.version + " but cannot restart: " + err.Error())
+		return false
+	}
+	agent.logger.Info("Updated to version " + update.version + ", restarting")
+	return true
+}
@@ -0,0 +1,51 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package agent
+
+import (
+	"fmt"
+)
+
+// vaultServices are the services which connect to MySQL on start with the
+// instance DSN, so they must restart to use new Vault credentials.
+var vaultServices = []string{"qan", "mm", "sysconfig"}
+
+// restartVaultServices restarts the services which connect to MySQL when the
+// Vault credentials at path change (bus.CREDS_CHANGED), so their connections
+// use the new credentials before the old ones are revoked.
+func (agent *Agent) restartVaultServices(path string) {
+	defer func() {
+		if err := recover(); err != nil {
+			agent.logger.Error("Agent restart for new Vault credentials crashed: ", err)
+		}
+	}()
+	for _, service := range vaultServices {
+		m, ok := agent.services[service]
+		if !ok || agent.isPausedService(service) {
+			continue
+		}
+		agent.logger.Info("Restarting " + service + " for new MySQL credentials from Vault " + path)
+		if err := m.Stop(); err != nil {
+			agent.logger.Warn(fmt.Sprintf("Cannot stop %s: %s", service, err))
+			continue
+		}
+		if err := m.Start(); err != nil {
+			agent.logger.Warn(fmt.Sprintf("Cannot start %s: %s", service, err))
+		}
+	}
+}
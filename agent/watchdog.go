@@ -0,0 +1,198 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package agent
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/percona/percona-agent/bus"
+	"github.com/percona/percona-agent/data"
+	"github.com/percona/percona-agent/pct"
+)
+
+const (
+	WATCHDOG_INTERVAL    = 1 * time.Minute
+	WATCHDOG_MIN_BACKOFF = 1 * time.Minute
+	WATCHDOG_MAX_BACKOFF = 1 * time.Hour
+	WATCHDOG_RESET_AFTER = 2 * time.Hour // reset backoff if a service is healthy for this long
+)
+
+// An Incident is a crashed service restarted by the Watchdog.  Incidents are
+// logged and spooled.
+type Incident struct {
+	Ts       time.Time
+	Service  string
+	Status   map[string]string // when crashed
+	Restarts uint              // since backoff reset, including this one
+	Error    string            `json:",omitempty"` // restarting
+}
+
+// A Watchdog restarts service managers with a crashed goroutine, e.g. when the
+// QAN analyzer status is "Crashed".  A service that keeps crashing is restarted
+// after 1m, 2m, 4m, etc. up to WATCHDOG_MAX_BACKOFF.  The backoff is reset when
+// the service has been healthy for WATCHDOG_RESET_AFTER since its last restart,
+// which is longer than the max backoff so a service crashing at the cap stays
+// there.
+type Watchdog struct {
+	logger   *pct.Logger
+	services map[string]pct.ServiceManager
+	spool    data.Spooler
+	skip     func(service string) bool
+	// --
+	crashes map[string]*crash
+	mux     *sync.Mutex // one Check at a time
+}
+
+type crash struct {
+	restarts     uint
+	lastRestart  time.Time
+	healthySince time.Time // zero until seen healthy after lastRestart
+}
+
+// NewWatchdog returns a Watchdog for the services.  It does not check a service
+// if skip returns true, e.g. because the agent is paused.  spool is optional.
+func NewWatchdog(logger *pct.Logger, services map[string]pct.ServiceManager, spool data.Spooler, skip func(string) bool) *Watchdog {
+	w := &Watchdog{
+		logger:   logger,
+		services: services,
+		spool:    spool,
+		skip:     skip,
+		// --
+		crashes: make(map[string]*crash),
+		mux:     &sync.Mutex{},
+	}
+	return w
+}
+
+// Check restarts crashed services if their backoff allows, and returns the
+// incidents.
+func (w *Watchdog) Check(now time.Time) []Incident {
+	w.mux.Lock()
+	defer w.mux.Unlock()
+	defer func() {
+		if err := recover(); err != nil {
+			w.logger.Error("Watchdog crashed: ", err)
+		}
+	}()
+
+	names := make([]string, 0, len(w.services))
+	for name := range w.services {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	incidents := []Incident{}
+	for _, name := range names {
+		if w.skip != nil && w.skip(name) {
+			continue
+		}
+		m := w.services[name]
+		status := m.Status()
+		c, ok := w.crashes[name]
+		if !Crashed(status) {
+			if ok {
+				if c.healthySince.IsZero() {
+					c.healthySince = now
+				} else if now.Sub(c.healthySince) >= WATCHDOG_RESET_AFTER {
+					delete(w.crashes, name)
+				}
+			}
+			continue
+		}
+
+		if !ok {
+			c = &crash{}
+			w.crashes[name] = c
+		}
+		if c.restarts > 0 && now.Before(c.lastRestart.Add(WatchdogBackoff(c.restarts))) {
+			w.logger.Debug(name + " crashed, waiting to restart")
+			continue
+		}
+		c.restarts++
+		c.lastRestart = now
+		c.healthySince = time.Time{}
+
+		incident := Incident{
+			Ts:       now.UTC(),
+			Service:  name,
+			Status:   status,
+			Restarts: c.restarts,
+		}
+		w.logger.Error(fmt.Sprintf("%s crashed, restarting (restart %d): %s", name, c.restarts, crashedStatus(status)))
+		if err := m.Stop(); err != nil {
+			w.logger.Warn("Stopping " + name + ": " + err.Error())
+		}
+		if err := m.Start(); err != nil {
+			incident.Error = err.Error()
+			w.logger.Error("Restarting " + name + ": " + err.Error())
+		} else {
+			w.logger.Info("Restarted " + name)
+		}
+		if w.spool != nil {
+			if err := w.spool.Write("agent", incident); err != nil {
+				w.logger.Warn("Spooling incident: " + err.Error())
+			}
+		}
+		incidents = append(incidents, incident)
+	}
+	return incidents
+}
+
+// checkWatchdog runs the watchdog and publishes its incidents as
+// bus.SERVICE_RESTART events.
+func (agent *Agent) checkWatchdog(now time.Time) {
+	for _, incident := range agent.watchdog.Check(now) {
+		agent.bus.Publish(bus.Event{Topic: bus.SERVICE_RESTART, Source: "agent", Data: incident})
+	}
+}
+
+// WatchdogBackoff returns how long to wait after the nth restart before
+// restarting a service again.
+func WatchdogBackoff(restarts uint) time.Duration {
+	if restarts == 0 {
+		return 0
+	}
+	d := WATCHDOG_MIN_BACKOFF
+	for i := uint(1); i < restarts; i++ {
+		d *= 2
+		if d >= WATCHDOG_MAX_BACKOFF {
+			return WATCHDOG_MAX_BACKOFF
+		}
+	}
+	return d
+}
+
+// Crashed returns true if a service status has a "Crashed" goroutine.
+func Crashed(status map[string]string) bool {
+	return crashedStatus(status) != ""
+}
+
+func crashedStatus(status map[string]string) string {
+	keys := make([]string, 0, len(status))
+	for key, val := range status {
+		if strings.HasPrefix(val, "Crashed") {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return strings.Join(keys, ", ")
+}
@@ -370,3 +370,34 @@ func (a *Api) GetQanConfig(mi *proto.MySQLInstance) (*proto.AgentConfig, error)
 	}
 	return agentConfig, nil
 }
+
+func (a *Api) DeleteAgent(uuid string) error {
+	// DELETE <api>/agents/:uuid
+	url := a.apiConnector.URL("agents", uuid)
+	return a.delete(url, "agent "+uuid)
+}
+
+func (a *Api) DeleteInstance(service string, id uint) error {
+	// DELETE <api>/instances/:service/:id
+	url := a.apiConnector.URL("instances", service, fmt.Sprintf("%d", id))
+	return a.delete(url, fmt.Sprintf("%s instance %d", service, id))
+}
+
+func (a *Api) delete(url, what string) error {
+	resp, _, err := a.apiConnector.Delete(a.apiConnector.ApiKey(), url)
+	if a.debug {
+		log.Printf("resp=%#v\n", resp)
+		log.Printf("err=%s\n", err)
+	}
+	// Already deleted is ok: uninstalling twice must not fail.
+	if apiErr, ok := err.(pct.APIError); ok && apiErr.Code == http.StatusNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNoContent {
+		return fmt.Errorf("Failed to delete %s (status code %d)", what, resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,182 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package installer
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+)
+
+// MYSQL_FLAGS are the flags that can be set per MySQL instance in an answer
+// file.
+var MYSQL_FLAGS = []string{
+	"mysql-defaults-file",
+	"mysql-user",
+	"mysql-pass",
+	"mysql-host",
+	"mysql-port",
+	"mysql-socket",
+	"mysql-max-user-connections",
+	"agent-mysql-user",
+	"agent-mysql-pass",
+	"create-mysql-user",
+	"create-mysql-instance",
+	"auto-detect-mysql",
+	"old-passwords",
+	"start-mysql-services",
+}
+
+// An AnswerFile answers everything the installer would ask, so config
+// management tools can install the agent non-interactively, e.g.:
+//
+//	{
+//	  "Flags": {"api-key": "...", "start-services": true},
+//	  "MySQL": [
+//	    {"mysql-socket": "/var/run/mysqld/mysqld.sock", "mysql-user": "root"},
+//	    {"mysql-host": "127.0.0.1", "mysql-port": "3307", "start-mysql-services": false}
+//	  ]
+//	}
+//
+// Flags are installer flags by name without the leading dash.  Flags given on
+// the command line override them.  MySQL is one set of MYSQL_FLAGS per MySQL
+// instance to install; flags not set for an instance are the installer flags.
+type AnswerFile struct {
+	Flags map[string]interface{}
+	MySQL []map[string]interface{}
+}
+
+// ReadAnswerFile reads and decodes the JSON answer file.
+func ReadAnswerFile(file string) (*AnswerFile, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	answers := &AnswerFile{}
+	if err := json.Unmarshal(data, answers); err != nil {
+		return nil, fmt.Errorf("Invalid answer file %s: %s", file, err)
+	}
+	return answers, nil
+}
+
+// SetFlags sets the answer file flags not already set on the command line.
+// The install is non-interactive unless the answer file or the command line
+// sets -interactive.
+func (a *AnswerFile) SetFlags(fs *flag.FlagSet) error {
+	set := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	for name, value := range a.Flags {
+		if fs.Lookup(name) == nil || name == "answer-file" {
+			return fmt.Errorf("Invalid flag in answer file: %s", name)
+		}
+		if set[name] {
+			continue
+		}
+		if err := fs.Set(name, flagValue(value)); err != nil {
+			return fmt.Errorf("Invalid value for flag %s in answer file: %s", name, err)
+		}
+	}
+	if _, ok := a.Flags["interactive"]; !ok && !set["interactive"] {
+		fs.Set("interactive", "false")
+	}
+	return nil
+}
+
+// MySQLFlags returns the flags of each MySQL instance: a copy of flags with
+// the instance's flags set.
+func (a *AnswerFile) MySQLFlags(flags Flags) ([]Flags, error) {
+	allowed := map[string]bool{}
+	for _, name := range MYSQL_FLAGS {
+		allowed[name] = true
+	}
+	mysqlFlags := make([]Flags, len(a.MySQL))
+	for n, instance := range a.MySQL {
+		f := flags.Copy()
+		for name, value := range instance {
+			if !allowed[name] {
+				return nil, fmt.Errorf("Flag %s cannot be set for MySQL instance %d", name, n+1)
+			}
+			if err := f.Set(name, flagValue(value)); err != nil {
+				return nil, fmt.Errorf("Invalid value for flag %s of MySQL instance %d: %s", name, n+1, err)
+			}
+		}
+		if f.String["mysql-socket"] != "" && (f.String["mysql-host"] != "" || f.String["mysql-port"] != "") {
+			return nil, fmt.Errorf("Flags mysql-socket and mysql-host or mysql-port of MySQL instance %d are exclusive", n+1)
+		}
+		mysqlFlags[n] = f
+	}
+	return mysqlFlags, nil
+}
+
+// Copy returns a copy of the flags.
+func (f Flags) Copy() Flags {
+	c := Flags{
+		Bool:   map[string]bool{},
+		String: map[string]string{},
+		Int64:  map[string]int64{},
+	}
+	for k, v := range f.Bool {
+		c.Bool[k] = v
+	}
+	for k, v := range f.String {
+		c.String[k] = v
+	}
+	for k, v := range f.Int64 {
+		c.Int64[k] = v
+	}
+	return c
+}
+
+// Set sets the flag, parsing the value like the flag package.
+func (f Flags) Set(name, value string) error {
+	if _, ok := f.Bool[name]; ok {
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		f.Bool[name] = b
+		return nil
+	}
+	if _, ok := f.String[name]; ok {
+		f.String[name] = value
+		return nil
+	}
+	if _, ok := f.Int64[name]; ok {
+		n, err := strconv.ParseInt(value, 0, 64)
+		if err != nil {
+			return err
+		}
+		f.Int64[name] = n
+		return nil
+	}
+	return fmt.Errorf("Unknown flag: %s", name)
+}
+
+// flagValue returns a JSON value as a flag value, e.g. 5 not 5e+00.
+func flagValue(value interface{}) string {
+	switch v := value.(type) {
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case string:
+		return v
+	default:
+		return fmt.Sprint(v)
+	}
+}
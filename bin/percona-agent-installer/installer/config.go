@@ -26,7 +26,7 @@ import (
 	"github.com/percona/percona-agent/pct"
 )
 
-func (i *Installer) writeInstances(si *proto.ServerInstance, mi *proto.MySQLInstance) error {
+func (i *Installer) writeInstances(si *proto.ServerInstance, mis ...*proto.MySQLInstance) error {
 	// We could write the instance structs directly, but this is the job of an
 	// instance repo and it's easy enough to create one, so do the right thing.
 	if si != nil {
@@ -38,7 +38,10 @@ func (i *Installer) writeInstances(si *proto.ServerInstance, mi *proto.MySQLInst
 			return err
 		}
 	}
-	if mi != nil {
+	for _, mi := range mis {
+		if mi == nil {
+			continue
+		}
 		bytes, err := json.Marshal(mi)
 		if err != nil {
 			return err
@@ -52,14 +55,7 @@ func (i *Installer) writeInstances(si *proto.ServerInstance, mi *proto.MySQLInst
 
 func (i *Installer) writeConfigs(configs []proto.AgentConfig) error {
 	for _, config := range configs {
-		name := config.InternalService
-		switch name {
-		case "agent", "log", "data", "qan":
-		default:
-			name += fmt.Sprintf("-%s-%d", config.ExternalService.Service, config.ExternalService.InstanceId)
-		}
-
-		if err := pct.Basedir.WriteConfigString(name, config.Config); err != nil {
+		if err := pct.Basedir.WriteConfigString(configName(config), config.Config); err != nil {
 			return err
 		}
 	}
@@ -67,6 +63,17 @@ func (i *Installer) writeConfigs(configs []proto.AgentConfig) error {
 	return nil
 }
 
+// configName returns the config file name of the service, e.g. mm-mysql-1.
+func configName(config proto.AgentConfig) string {
+	name := config.InternalService
+	switch name {
+	case "agent", "log", "data", "qan":
+	default:
+		name += fmt.Sprintf("-%s-%d", config.ExternalService.Service, config.ExternalService.InstanceId)
+	}
+	return name
+}
+
 func (i *Installer) getLogConfig() (*proto.AgentConfig, error) {
 	config := pctLog.Config{
 		File:  pctLog.DEFAULT_LOG_FILE,
@@ -26,6 +26,7 @@ import (
 	"github.com/percona/percona-agent/bin/percona-agent-installer/term"
 	"github.com/percona/percona-agent/instance"
 	"github.com/percona/percona-agent/mysql"
+	"github.com/percona/percona-agent/pct"
 	"log"
 	"net"
 	"net/url"
@@ -52,6 +53,7 @@ type Installer struct {
 	// --
 	hostname   string
 	defaultDSN mysql.DSN
+	mysqlFlags []Flags
 }
 
 func NewInstaller(terminal *term.Terminal, basedir string, api *api.Api, instanceRepo *instance.Repo, agentConfig *agent.Config, flags Flags) *Installer {
@@ -62,13 +64,6 @@ func NewInstaller(terminal *term.Terminal, basedir string, api *api.Api, instanc
 		agentConfig.PidFile = agent.DEFAULT_PIDFILE
 	}
 	hostname, _ := os.Hostname()
-	defaultDSN := mysql.DSN{
-		Username: flags.String["mysql-user"],
-		Password: flags.String["mysql-pass"],
-		Hostname: flags.String["mysql-host"],
-		Port:     flags.String["mysql-port"],
-		Socket:   flags.String["mysql-socket"],
-	}
 	installer := &Installer{
 		term:         terminal,
 		basedir:      basedir,
@@ -78,11 +73,17 @@ func NewInstaller(terminal *term.Terminal, basedir string, api *api.Api, instanc
 		flags:        flags,
 		// --
 		hostname:   hostname,
-		defaultDSN: defaultDSN,
+		defaultDSN: flagsDSN(flags),
 	}
 	return installer
 }
 
+// SetMySQLFlags makes Run install a MySQL instance for each flags, e.g. from
+// an answer file, instead of one MySQL instance for the installer flags.
+func (i *Installer) SetMySQLFlags(mysqlFlags []Flags) {
+	i.mysqlFlags = mysqlFlags
+}
+
 func (i *Installer) Run() (err error) {
 	/**
 	 * Get the API key.
@@ -121,21 +122,31 @@ func (i *Installer) Run() (err error) {
 		return err
 	}
 
-	// MySQL instance
-	var mi *proto.MySQLInstance
+	// MySQL instances, one per MySQL flags.  mis[n] is nil if MySQL n
+	// was not set up.
+	flags := i.flags
+	mysqlFlags := i.mysqlFlags
+	if len(mysqlFlags) == 0 {
+		mysqlFlags = []Flags{flags}
+	}
+	mis := make([]*proto.MySQLInstance, len(mysqlFlags))
 	if i.flags.Bool["mysql"] {
-		mi, err = i.InstallerCreateMySQLInstance()
-		if err != nil {
-			if i.flags.Bool["interactive"] {
-				return err
-			} else {
-				// Automated install, log the error and continue.
-				fmt.Printf("Failed to set up MySQL (ignoring because interactive=false): %s\n", err)
+		for n, f := range mysqlFlags {
+			i.useFlags(f)
+			mis[n], err = i.InstallerCreateMySQLInstance()
+			i.useFlags(flags)
+			if err != nil {
+				if i.flags.Bool["interactive"] {
+					return err
+				} else {
+					// Automated install, log the error and continue.
+					fmt.Printf("Failed to set up MySQL (ignoring because interactive=false): %s\n", err)
+				}
 			}
 		}
 	}
 
-	if err = i.writeInstances(si, mi); err != nil {
+	if err = i.writeInstances(si, mis...); err != nil {
 		return fmt.Errorf("Created agent but failed to write service instances: %s", err)
 	}
 
@@ -146,11 +157,36 @@ func (i *Installer) Run() (err error) {
 		/**
 		 * Get default configs for all services.
 		 */
-		configs, err := i.InstallerGetDefaultConfigs(si, mi)
+		i.useFlags(mysqlFlags[0])
+		configs, err := i.InstallerGetDefaultConfigs(si, mis[0])
+		i.useFlags(flags)
 		if err != nil {
 			return err
 		}
 
+		// Services of the other MySQL instances.  The agent runs only one
+		// QAN, for the first local MySQL instance.
+		if i.flags.Bool["start-services"] {
+			qan := false
+			for _, config := range configs {
+				qan = qan || config.InternalService == "qan"
+			}
+			for n := 1; n < len(mis); n++ {
+				i.useFlags(mysqlFlags[n])
+				for _, config := range i.getMySQLConfigs(mis[n]) {
+					if config.InternalService == "qan" {
+						if qan {
+							fmt.Printf("Not starting Query Analytics for MySQL instance id=%d: it's running for another instance\n", mis[n].Id)
+							continue
+						}
+						qan = true
+					}
+					configs = append(configs, config)
+				}
+				i.useFlags(flags)
+			}
+		}
+
 		// Save configs
 		if err := i.writeConfigs(configs); err != nil {
 			return fmt.Errorf("Created agent but failed to write configs: %s", err)
@@ -159,6 +195,15 @@ func (i *Installer) Run() (err error) {
 		fmt.Println("Not creating agent (-create-agent=false)")
 	}
 
+	/**
+	 * Install the agent service so it starts at boot.
+	 */
+	if i.flags.Bool["install-service"] {
+		if err := i.InstallService(); err != nil {
+			return err
+		}
+	}
+
 	return nil // success
 }
 
@@ -200,7 +245,8 @@ VERIFY_API_KEY:
 		startTime := time.Now()
 		fmt.Printf("Verifying API key %s...\n", i.agentConfig.ApiKey)
 		headers := map[string]string{
-			"X-Percona-Agent-Version": agent.VERSION,
+			"X-Percona-Agent-Version":    agent.VERSION,
+			"X-Percona-Host-Fingerprint": pct.HostFingerprint(),
 		}
 		code, err := i.api.Init(i.agentConfig.ApiHostname, i.agentConfig.ApiKey, headers)
 		elapsedTime := time.Since(startTime)
@@ -360,49 +406,76 @@ func (i *Installer) InstallerGetDefaultConfigs(si *proto.ServerInstance, mi *pro
 			configs = append(configs, *config)
 		}
 
-		if i.flags.Bool["start-mysql-services"] {
-			if mi != nil {
-				// MySQL metrics tracker
-				config, err = i.api.GetMmMySQLConfig(mi)
-				if err != nil {
-					fmt.Println(err)
-					fmt.Println("WARNING: cannot start MySQL metrics monitor")
-				} else {
-					configs = append(configs, *config)
-				}
+		configs = append(configs, i.getMySQLConfigs(mi)...)
+	} else {
+		fmt.Println("Not starting default services (-start-services=false)")
+	}
 
-				// MySQL config tracker
-				config, err = i.api.GetSysconfigMySQLConfig(mi)
-				if err != nil {
-					fmt.Println(err)
-					fmt.Println("WARNING: cannot start MySQL configuration monitor")
-				} else {
-					configs = append(configs, *config)
-				}
+	return configs, nil
+}
 
-				// QAN
-				// MySQL is local if the server hostname == MySQL hostname without port number.
-				if i.hostname == portNumberRe.ReplaceAllLiteralString(mi.Hostname, "") {
-					if i.flags.Bool["debug"] {
-						log.Printf("MySQL is local")
-					}
-					config, err := i.api.GetQanConfig(mi)
-					if err != nil {
-						fmt.Println(err)
-						fmt.Println("WARNING: cannot start Query Analytics")
-					} else {
-						configs = append(configs, *config)
-					}
-				}
-			}
+// getMySQLConfigs returns the default configs of the MySQL services of mi,
+// if any.  Errors are warnings: the service isn't started.
+func (i *Installer) getMySQLConfigs(mi *proto.MySQLInstance) (configs []proto.AgentConfig) {
+	if !i.flags.Bool["start-mysql-services"] {
+		fmt.Println("Not starting MySQL services (-start-mysql-services=false)")
+		return nil
+	}
+	if mi == nil {
+		return nil
+	}
+
+	// MySQL metrics tracker
+	config, err := i.api.GetMmMySQLConfig(mi)
+	if err != nil {
+		fmt.Println(err)
+		fmt.Println("WARNING: cannot start MySQL metrics monitor")
+	} else {
+		configs = append(configs, *config)
+	}
+
+	// MySQL config tracker
+	config, err = i.api.GetSysconfigMySQLConfig(mi)
+	if err != nil {
+		fmt.Println(err)
+		fmt.Println("WARNING: cannot start MySQL configuration monitor")
+	} else {
+		configs = append(configs, *config)
+	}
+
+	// QAN
+	// MySQL is local if the server hostname == MySQL hostname without port number.
+	if i.hostname == portNumberRe.ReplaceAllLiteralString(mi.Hostname, "") {
+		if i.flags.Bool["debug"] {
+			log.Printf("MySQL is local")
+		}
+		config, err := i.api.GetQanConfig(mi)
+		if err != nil {
+			fmt.Println(err)
+			fmt.Println("WARNING: cannot start Query Analytics")
 		} else {
-			fmt.Println("Not starting MySQL services (-start-mysql-services=false)")
+			configs = append(configs, *config)
 		}
-	} else {
-		fmt.Println("Not starting default services (-start-services=false)")
 	}
 
-	return configs, nil
+	return configs
+}
+
+// useFlags makes the installer use the flags, e.g. of one MySQL instance.
+func (i *Installer) useFlags(flags Flags) {
+	i.flags = flags
+	i.defaultDSN = flagsDSN(flags)
+}
+
+// flagsDSN returns the MySQL DSN set by the flags, if any.
+func flagsDSN(flags Flags) mysql.DSN {
+	return mysql.DSN{
+		Username: flags.String["mysql-user"],
+		Password: flags.String["mysql-pass"],
+		Hostname: flags.String["mysql-host"],
+		Port:     flags.String["mysql-port"],
+		Socket:   flags.String["mysql-socket"],
+	}
 }
 
 func (i *Installer) InstallerCreateAgentWithInitialServiceConfigs() (protoAgent *proto.Agent, err error) {
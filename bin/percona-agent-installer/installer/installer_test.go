@@ -18,6 +18,7 @@
 package installer_test
 
 import (
+	"flag"
 	"fmt"
 	"github.com/percona/cloud-protocol/proto/v1"
 	"github.com/percona/percona-agent/agent"
@@ -28,7 +29,9 @@ import (
 	"github.com/percona/percona-agent/pct"
 	"github.com/percona/percona-agent/test/mock"
 	. "gopkg.in/check.v1"
+	"io/ioutil"
 	"os"
+	"strings"
 	"testing"
 )
 
@@ -69,3 +72,109 @@ func (i *InstallerTestSuite) TestIsSupportedMySQLVersion(t *C) {
 
 	conn.Close()
 }
+
+func (i *InstallerTestSuite) TestAnswerFile(t *C) {
+	file, err := ioutil.TempFile("/tmp", "answer-file")
+	t.Assert(err, IsNil)
+	defer os.Remove(file.Name())
+	file.WriteString(`{
+		"Flags": {"api-key": "123", "mysql-max-user-connections": 10, "start-services": false},
+		"MySQL": [
+			{"mysql-socket": "/var/run/mysqld/mysqld.sock"},
+			{"mysql-host": "127.0.0.1", "mysql-port": "3307", "start-mysql-services": false}
+		]
+	}`)
+	file.Close()
+
+	answers, err := installer.ReadAnswerFile(file.Name())
+	t.Assert(err, IsNil)
+
+	// Flags on the command line override the answer file, which makes the
+	// install non-interactive.
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	apiKey := fs.String("api-key", "", "")
+	maxConns := fs.Int64("mysql-max-user-connections", 5, "")
+	startServices := fs.Bool("start-services", true, "")
+	interactive := fs.Bool("interactive", true, "")
+	fs.Bool("answer-file", false, "")
+	t.Assert(fs.Parse([]string{"-start-services=true"}), IsNil)
+	t.Assert(answers.SetFlags(fs), IsNil)
+	t.Check(*apiKey, Equals, "123")
+	t.Check(*maxConns, Equals, int64(10))
+	t.Check(*startServices, Equals, true)
+	t.Check(*interactive, Equals, false)
+
+	flags := installer.Flags{
+		Bool:   map[string]bool{"start-mysql-services": true},
+		String: map[string]string{"mysql-host": "", "mysql-port": "", "mysql-socket": ""},
+		Int64:  map[string]int64{"mysql-max-user-connections": 10},
+	}
+	mysqlFlags, err := answers.MySQLFlags(flags)
+	t.Assert(err, IsNil)
+	t.Assert(mysqlFlags, HasLen, 2)
+	t.Check(mysqlFlags[0].String["mysql-socket"], Equals, "/var/run/mysqld/mysqld.sock")
+	t.Check(mysqlFlags[0].Bool["start-mysql-services"], Equals, true)
+	t.Check(mysqlFlags[1].String["mysql-host"], Equals, "127.0.0.1")
+	t.Check(mysqlFlags[1].String["mysql-port"], Equals, "3307")
+	t.Check(mysqlFlags[1].Bool["start-mysql-services"], Equals, false)
+	t.Check(flags.Bool["start-mysql-services"], Equals, true) // copied
+
+	// Only MySQL flags can be set per instance.
+	answers.MySQL = []map[string]interface{}{{"api-key": "456"}}
+	_, err = answers.MySQLFlags(flags)
+	t.Check(err, NotNil)
+}
+
+func (i *InstallerTestSuite) TestServiceFiles(t *C) {
+	os.Setenv(pct.ENV_LOG_DIR, "/var/log/percona-agent")
+	defer os.Unsetenv(pct.ENV_LOG_DIR)
+	env := installer.ServiceEnv("/opt/percona-agent")
+	t.Check(env, DeepEquals, []string{
+		"PCT_BASEDIR=/opt/percona-agent",
+		"PCT_LOG_DIR=/var/log/percona-agent",
+	})
+
+	unit := string(installer.SystemdUnit("/opt/percona-agent/bin/percona-agent", "/opt/percona-agent", "mysql", env))
+	t.Check(unit, Equals, `[Unit]
+Description=Percona Agent
+After=network.target
+
+[Service]
+Type=simple
+User=mysql
+Environment=PCT_INIT_SYSTEM=systemd
+Environment=PCT_BASEDIR=/opt/percona-agent
+Environment=PCT_LOG_DIR=/var/log/percona-agent
+ExecStart=/opt/percona-agent/bin/percona-agent -basedir /opt/percona-agent
+ExecReload=/bin/kill -HUP $MAINPID
+Restart=on-failure
+RestartSec=10
+
+[Install]
+WantedBy=multi-user.target
+`)
+
+	job := string(installer.UpstartJob("/opt/percona-agent/bin/percona-agent", "/opt/percona-agent", "root", "/var/log/percona-agent/percona-agent.log", env))
+	t.Check(strings.Contains(job, "respawn\n"), Equals, true)
+	t.Check(strings.Contains(job, "setuid"), Equals, false) // root
+	t.Check(strings.Contains(job, "env PCT_INIT_SYSTEM=upstart\n"), Equals, true)
+	t.Check(strings.Contains(job, "env PCT_BASEDIR=/opt/percona-agent\n"), Equals, true)
+	t.Check(strings.Contains(job, "exec /opt/percona-agent/bin/percona-agent -basedir /opt/percona-agent >> /var/log/percona-agent/percona-agent.log 2>&1\n"), Equals, true)
+
+	script := []byte(`#!/bin/sh
+SERVICE="percona-agent"
+USERNAME="${PCT_TEST_AGENT_USER:-root}"
+BASEDIR="${PCT_TEST_AGENT_DIR:-"/usr/local/percona/$SERVICE"}"
+CMD="$BASEDIR/bin/$SERVICE"
+`)
+	got, err := installer.SysvinitScript(script, "/opt/percona-agent", "mysql")
+	t.Assert(err, IsNil)
+	t.Check(string(got), Equals, `#!/bin/sh
+SERVICE="percona-agent"
+USERNAME="${PCT_TEST_AGENT_USER:-mysql}"
+BASEDIR="${PCT_TEST_AGENT_DIR:-"/opt/percona-agent"}"
+CMD="$BASEDIR/bin/$SERVICE"
+`)
+	_, err = installer.SysvinitScript([]byte("#!/bin/sh\n"), "/opt/percona-agent", "mysql")
+	t.Check(err, NotNil)
+}
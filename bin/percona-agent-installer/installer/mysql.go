@@ -31,6 +31,9 @@ import (
 	"strings"
 )
 
+// AGENT_MYSQL_USER is the MySQL user created for the agent, see createMySQLUser.
+const AGENT_MYSQL_USER = "percona-agent"
+
 func MakeGrant(dsn mysql.DSN, user string, pass string, mysqlMaxUserConns int64) []string {
 	host := "%"
 	if dsn.Socket != "" || dsn.Hostname == "localhost" {
@@ -48,6 +51,24 @@ func MakeGrant(dsn mysql.DSN, user string, pass string, mysqlMaxUserConns int64)
 	return grants
 }
 
+// MakeDropUser returns the statements which drop the user created by
+// MakeGrant, and the 2nd user @127.0.0.1 for localhost, see createMySQLUser.
+func MakeDropUser(dsn mysql.DSN, user string) []string {
+	host := "%"
+	if dsn.Socket != "" || dsn.Hostname == "localhost" {
+		host = "localhost"
+	} else if dsn.Hostname == "127.0.0.1" {
+		host = "127.0.0.1"
+	}
+	drops := []string{
+		fmt.Sprintf("DROP USER '%s'@'%s'", user, host),
+	}
+	if dsn.Hostname == "localhost" {
+		drops = append(drops, fmt.Sprintf("DROP USER '%s'@'127.0.0.1'", user))
+	}
+	return drops
+}
+
 func (i *Installer) getAgentDSN() (dsn mysql.DSN, err error) {
 	if i.flags.Bool["create-mysql-user"] && i.flags.String["agent-mysql-user"] == "" {
 		// Connect as root, create percona-agent MySQL user.
@@ -95,8 +116,39 @@ func (i *Installer) getAgentDSN() (dsn mysql.DSN, err error) {
 }
 
 func (i *Installer) createNewMySQLUser() (dsn mysql.DSN, err error) {
+	superUserDSN, err := i.getSuperUserDSN()
+	if err != nil {
+		return dsn, err
+	}
+
+	// Check MySQL Version
+	dsnString, err := superUserDSN.DSN()
+	if err != nil {
+		return dsn, err
+	}
+	tmpConn := mysql.NewConnection(dsnString)
+	isVersionSupported, err := i.IsVersionSupported(tmpConn)
+	if err != nil {
+		return dsn, err
+	}
+
+	if !isVersionSupported {
+		return dsn, fmt.Errorf("MySQL version not supported. It should be > %s", agent.MIN_SUPPORTED_MYSQL_VERSION)
+	}
+
+	dsn, err = i.createMySQLUser(superUserDSN)
+	if err != nil {
+		return dsn, err
+	}
+
+	return dsn, nil
+}
+
+// getSuperUserDSN returns the verified DSN of the root MySQL user, which
+// creates and drops the agent MySQL user.
+func (i *Installer) getSuperUserDSN() (superUserDSN mysql.DSN, err error) {
 	// Auto-detect the root MySQL user connection options.
-	superUserDSN := i.defaultDSN
+	superUserDSN = i.defaultDSN
 	if i.flags.Bool["auto-detect-mysql"] {
 		if err := i.autodetectDSN(&superUserDSN); err != nil {
 			if i.flags.Bool["debug"] {
@@ -118,58 +170,46 @@ func (i *Installer) createNewMySQLUser() (dsn mysql.DSN, err error) {
 			}
 			fmt.Println("Specify a root/super MySQL user to create a user for the agent")
 			if err := i.getDSNFromUser(&superUserDSN); err != nil {
-				return dsn, err
+				return superUserDSN, err
 			}
 		} else {
 			// Can't auto-detect MySQL root user and not interactive, fail.
-			return dsn, err
+			return superUserDSN, err
 		}
 	}
-
-	// Check MySQL Version
-	dsnString, err := superUserDSN.DSN()
-	if err != nil {
-		return dsn, err
-	}
-	tmpConn := mysql.NewConnection(dsnString)
-	isVersionSupported, err := i.IsVersionSupported(tmpConn)
-	if err != nil {
-		return dsn, err
-	}
-
-	if !isVersionSupported {
-		return dsn, fmt.Errorf("MySQL version not supported. It should be > %s", agent.MIN_SUPPORTED_MYSQL_VERSION)
-	}
-
-	dsn, err = i.createMySQLUser(superUserDSN)
-	if err != nil {
-		return dsn, err
-	}
-
-	return dsn, nil
+	return superUserDSN, nil
 }
 
 func (i *Installer) createMySQLUser(dsn mysql.DSN) (mysql.DSN, error) {
 	// Same host:port or socket, but different user and pass.
 	userDSN := dsn
-	userDSN.Username = "percona-agent"
+	userDSN.Username = AGENT_MYSQL_USER
 	userDSN.Password = fmt.Sprintf("%p%d", &dsn, rand.Uint32())
 	userDSN.OldPasswords = i.flags.Bool["old-passwords"]
 
+	if err := i.grantMySQLUser(dsn, userDSN.Username, userDSN.Password); err != nil {
+		return userDSN, err
+	}
+	return userDSN, nil
+}
+
+// grantMySQLUser creates or updates the user with the agent grants, connected
+// as the root/super user dsn.
+func (i *Installer) grantMySQLUser(dsn mysql.DSN, user, pass string) error {
 	dsnString, _ := dsn.DSN()
 	conn := mysql.NewConnection(dsnString)
 	if err := conn.Connect(1); err != nil {
-		return userDSN, err
+		return err
 	}
 	defer conn.Close()
-	grants := MakeGrant(dsn, userDSN.Username, userDSN.Password, i.flags.Int64["mysql-max-user-connections"])
+	grants := MakeGrant(dsn, user, pass, i.flags.Int64["mysql-max-user-connections"])
 	for _, grant := range grants {
 		if i.flags.Bool["debug"] {
 			log.Println(grant)
 		}
 		_, err := conn.DB().Exec(grant)
 		if err != nil {
-			return userDSN, fmt.Errorf("Error executing %s: %s", grant, err)
+			return fmt.Errorf("Error executing %s: %s", grant, err)
 		}
 	}
 
@@ -179,19 +219,19 @@ func (i *Installer) createMySQLUser(dsn mysql.DSN) (mysql.DSN, error) {
 	if dsn.Hostname == "localhost" {
 		dsn2 := dsn
 		dsn2.Hostname = "127.0.0.1"
-		grants := MakeGrant(dsn2, userDSN.Username, userDSN.Password, i.flags.Int64["mysql-max-user-connections"])
+		grants := MakeGrant(dsn2, user, pass, i.flags.Int64["mysql-max-user-connections"])
 		for _, grant := range grants {
 			if i.flags.Bool["debug"] {
 				log.Println(grant)
 			}
 			_, err := conn.DB().Exec(grant)
 			if err != nil {
-				return userDSN, fmt.Errorf("Error executing %s: %s", grant, err)
+				return fmt.Errorf("Error executing %s: %s", grant, err)
 			}
 		}
 	}
 
-	return userDSN, nil
+	return nil
 }
 
 func (i *Installer) useExistingMySQLUser() (mysql.DSN, error) {
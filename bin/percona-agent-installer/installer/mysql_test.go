@@ -92,3 +92,52 @@ func (s *MySQLTestSuite) TestParseMySQLDefaults(t *C) {
 	}
 	t.Check(got, DeepEquals, expect)
 }
+
+func (s *MySQLTestSuite) TestMakeDropUser(t *C) {
+	dsn := mysql.DSN{
+		Username: "user",
+		Password: "pass",
+	}
+
+	dsn.Hostname = "localhost"
+	got := i.MakeDropUser(dsn, "new-user")
+	expect := []string{
+		"DROP USER 'new-user'@'localhost'",
+		"DROP USER 'new-user'@'127.0.0.1'",
+	}
+	t.Check(got, DeepEquals, expect)
+
+	dsn.Hostname = "127.0.0.1"
+	got = i.MakeDropUser(dsn, "new-user")
+	expect = []string{
+		"DROP USER 'new-user'@'127.0.0.1'",
+	}
+	t.Check(got, DeepEquals, expect)
+
+	dsn.Hostname = "10.1.1.1"
+	got = i.MakeDropUser(dsn, "new-user")
+	expect = []string{
+		"DROP USER 'new-user'@'%'",
+	}
+	t.Check(got, DeepEquals, expect)
+
+	dsn.Hostname = ""
+	dsn.Socket = "/var/lib/mysql.sock"
+	got = i.MakeDropUser(dsn, "new-user")
+	expect = []string{
+		"DROP USER 'new-user'@'localhost'",
+	}
+	t.Check(got, DeepEquals, expect)
+}
+
+func (s *MySQLTestSuite) TestDSNUser(t *C) {
+	user, pass := i.DSNUser("percona-agent:pass@tcp(127.0.0.1:3306)/")
+	t.Check(user, Equals, "percona-agent")
+	t.Check(pass, Equals, "pass")
+	user, pass = i.DSNUser("percona-agent@unix(/var/lib/mysql/mysql.sock)/")
+	t.Check(user, Equals, "percona-agent")
+	t.Check(pass, Equals, "")
+	user, pass = i.DSNUser("tcp(127.0.0.1:3306)/")
+	t.Check(user, Equals, "")
+	t.Check(pass, Equals, "")
+}
@@ -0,0 +1,252 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package installer
+
+import (
+	"fmt"
+	"github.com/percona/cloud-protocol/proto/v1"
+	"github.com/percona/percona-agent/agent"
+	"github.com/percona/percona-agent/mysql"
+	"github.com/percona/percona-agent/pct"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Installed returns the config of the agent installed in the basedir, or nil
+// if there's none.
+func Installed() (*agent.Config, error) {
+	config := &agent.Config{}
+	if err := pct.Basedir.ReadConfig("agent", config); err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("Failed to read agent config: %s", err)
+	}
+	return config, nil
+}
+
+// Repair fixes the installed agent instead of installing a new one: it
+// re-verifies the API key, re-creates missing instances and configs, re-grants
+// the MySQL user, and fixes config file permissions.  The agent and existing
+// instances are reused, so repairing never creates duplicates on the API.
+// Restart the agent after repairing.
+func (i *Installer) Repair(installed *agent.Config) (err error) {
+	fmt.Printf("Repairing percona-agent in %s\n", pct.Basedir.Path())
+
+	// Keep the installed config, but a new API key or host replaces the old.
+	apiKey := i.agentConfig.ApiKey
+	apiHostname := i.agentConfig.ApiHostname
+	*i.agentConfig = *installed
+	if apiKey != "" {
+		i.agentConfig.ApiKey = apiKey
+	}
+	if apiHostname != agent.DEFAULT_API_HOSTNAME || i.agentConfig.ApiHostname == "" {
+		i.agentConfig.ApiHostname = apiHostname
+	}
+
+	if err = i.InstallerGetApiKey(); err != nil {
+		return err
+	}
+	if err = i.VerifyApiKey(); err != nil {
+		return err
+	}
+
+	// Update the agent, which verifies that it still exists.  Create it only
+	// if it never was, e.g. installed with -create-agent=false.
+	if i.agentConfig.AgentUuid != "" {
+		protoAgent := &proto.Agent{
+			Uuid:     i.agentConfig.AgentUuid,
+			Hostname: i.hostname,
+			Version:  agent.VERSION,
+			Links:    i.agentConfig.Links,
+		}
+		if _, err := i.api.UpdateAgent(protoAgent, i.agentConfig.AgentUuid); err != nil {
+			return fmt.Errorf("%s\nAgent %s cannot be repaired: uninstall it (-uninstall) and install again", err, i.agentConfig.AgentUuid)
+		}
+		fmt.Printf("Verified agent: uuid=%s\n", i.agentConfig.AgentUuid)
+	} else if i.flags.Bool["create-agent"] {
+		protoAgent, err := i.InstallerCreateAgentWithInitialServiceConfigs()
+		if err != nil {
+			return err
+		}
+		i.agentConfig.AgentUuid = protoAgent.Uuid
+		i.agentConfig.Links = protoAgent.Links
+	}
+
+	// Reuse the instances in the basedir.  The API returns the existing
+	// instance when creating one it already has, so creating a missing
+	// instance doesn't duplicate it.
+	if err = i.instanceRepo.Init(); err != nil {
+		return fmt.Errorf("Failed to load instances: %s", err)
+	}
+	si, mi := i.installedInstances()
+	var newSi *proto.ServerInstance
+	var newMi *proto.MySQLInstance
+	if si == nil {
+		if newSi, err = i.InstallerCreateServerInstance(); err != nil {
+			return err
+		}
+		si = newSi
+	} else {
+		fmt.Printf("Using server instance: hostname=%s id=%d\n", si.Hostname, si.Id)
+	}
+	if i.flags.Bool["mysql"] {
+		if mi == nil {
+			if newMi, err = i.InstallerCreateMySQLInstance(); err != nil {
+				return err
+			}
+			mi = newMi
+		} else {
+			fmt.Printf("Using MySQL instance: hostname=%s id=%d\n", mi.Hostname, mi.Id)
+			if err := i.regrantMySQLUser(mi); err != nil {
+				return err
+			}
+		}
+	}
+	if err = i.writeInstances(newSi, newMi); err != nil {
+		return fmt.Errorf("Failed to write service instances: %s", err)
+	}
+
+	// Write the agent config, it may have a new API key, and the default
+	// configs of services that have none.  Existing configs are kept.
+	if i.agentConfig.AgentUuid != "" {
+		configs, err := i.InstallerGetDefaultConfigs(si, mi)
+		if err != nil {
+			return err
+		}
+		missing := []proto.AgentConfig{}
+		for _, config := range configs {
+			name := configName(config)
+			if name != "agent" && pct.Basedir.ConfigExists(name) {
+				continue
+			}
+			if name != "agent" {
+				fmt.Printf("Re-created config: %s\n", name)
+			}
+			missing = append(missing, config)
+		}
+		if err := i.writeConfigs(missing); err != nil {
+			return fmt.Errorf("Failed to write configs: %s", err)
+		}
+	}
+
+	if err = i.fixPermissions(); err != nil {
+		return err
+	}
+
+	fmt.Println("Repaired percona-agent, restart it to use the changes")
+	return nil
+}
+
+// installedInstances returns the first server and MySQL instance in the
+// instance repo, or nil if there's none.  The installer creates only one of
+// each.
+func (i *Installer) installedInstances() (si *proto.ServerInstance, mi *proto.MySQLInstance) {
+	for _, name := range i.instanceRepo.List() {
+		part := strings.Split(name, "-")
+		id, err := strconv.ParseUint(part[len(part)-1], 10, 32)
+		if err != nil {
+			continue
+		}
+		switch part[0] {
+		case "server":
+			if si == nil {
+				it := &proto.ServerInstance{}
+				if err := i.instanceRepo.Get("server", uint(id), it); err == nil {
+					si = it
+				}
+			}
+		case "mysql":
+			if mi == nil {
+				it := &proto.MySQLInstance{}
+				if err := i.instanceRepo.Get("mysql", uint(id), it); err == nil {
+					mi = it
+				}
+			}
+		}
+	}
+	return si, mi
+}
+
+// regrantMySQLUser grants the agent MySQL user again, e.g. after MySQL was
+// restored from a backup without it, then verifies the instance DSN.  Users
+// not created by the installer are only verified.
+func (i *Installer) regrantMySQLUser(mi *proto.MySQLInstance) error {
+	user, pass := DSNUser(mi.DSN)
+	if user == AGENT_MYSQL_USER {
+		superUserDSN, err := i.getSuperUserDSN()
+		if err != nil {
+			return fmt.Errorf("Failed to re-grant MySQL user %s: %s", user, err)
+		}
+		if err := i.grantMySQLUser(superUserDSN, user, pass); err != nil {
+			return fmt.Errorf("Failed to re-grant MySQL user %s: %s", user, err)
+		}
+		fmt.Printf("Re-granted MySQL user: %s\n", user)
+	} else {
+		fmt.Printf("Not re-granting MySQL user %s: it was not created by the installer\n", user)
+	}
+	conn := mysql.NewConnection(mi.DSN)
+	if err := conn.Connect(1); err != nil {
+		return fmt.Errorf("Error connecting to MySQL %s: %s", mysql.HideDSNPassword(mi.DSN), err)
+	}
+	conn.Close()
+	return nil
+}
+
+// fixPermissions makes the config dir and files, and the store, private again:
+// they have API keys and MySQL passwords.
+func (i *Installer) fixPermissions() error {
+	dir := pct.Basedir.Dir("config")
+	if err := chmod(dir, 0700); err != nil {
+		return err
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, fi := range files {
+		if fi.IsDir() {
+			continue
+		}
+		if err := chmod(filepath.Join(dir, fi.Name()), 0600); err != nil {
+			return err
+		}
+	}
+	if store := pct.Basedir.File("store"); pct.FileExists(store) {
+		return chmod(store, 0600)
+	}
+	return nil
+}
+
+func chmod(file string, perm os.FileMode) error {
+	fi, err := os.Stat(file)
+	if err != nil {
+		return err
+	}
+	if fi.Mode().Perm() == perm {
+		return nil
+	}
+	if err := os.Chmod(file, perm); err != nil {
+		return err
+	}
+	fmt.Printf("Fixed permissions of %s: %s to %s\n", file, fi.Mode().Perm(), perm)
+	return nil
+}
@@ -0,0 +1,315 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package installer
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/percona/percona-agent/agent"
+	"github.com/percona/percona-agent/pct"
+)
+
+const (
+	SERVICE_NAME  = "percona-agent"
+	INIT_SYSTEMD  = "systemd"
+	INIT_UPSTART  = "upstart"
+	INIT_SYSVINIT = "sysvinit"
+	INIT_NONE     = "none"
+)
+
+// SERVICE_FILES are the agent service files of each init system.
+var SERVICE_FILES = map[string]string{
+	INIT_SYSTEMD:  "/etc/systemd/system/" + SERVICE_NAME + ".service",
+	INIT_UPSTART:  "/etc/init/" + SERVICE_NAME + ".conf",
+	INIT_SYSVINIT: "/etc/init.d/" + SERVICE_NAME,
+}
+
+var (
+	initUserRe    = regexp.MustCompile(`(?m)^USERNAME=.*$`)
+	initBasedirRe = regexp.MustCompile(`(?m)^BASEDIR=.*$`)
+)
+
+// DetectInitSystem returns the init system running on this host, or "" if
+// it's unknown.
+func DetectInitSystem() string {
+	// Like sd_booted(3): systemd is running if this dir exists.
+	if fi, err := os.Stat("/run/systemd/system"); err == nil && fi.IsDir() {
+		return INIT_SYSTEMD
+	}
+	if out, err := exec.Command("initctl", "version").Output(); err == nil && strings.Contains(string(out), "upstart") {
+		return INIT_UPSTART
+	}
+	if fi, err := os.Stat("/etc/init.d"); err == nil && fi.IsDir() {
+		return INIT_SYSVINIT
+	}
+	return ""
+}
+
+// ServiceEnv returns the env vars of the agent service: the basedir, and the
+// basedir layout if set by the PCT_*_DIR env vars when installing.
+func ServiceEnv(basedir string) []string {
+	env := []string{pct.ENV_BASEDIR + "=" + basedir}
+	for _, name := range []string{pct.ENV_CONFIG_DIR, pct.ENV_DATA_DIR, pct.ENV_LOG_DIR, pct.ENV_BIN_DIR, pct.ENV_SPOOL_DIR} {
+		if dir := os.Getenv(name); dir != "" {
+			env = append(env, name+"="+dir)
+		}
+	}
+	return env
+}
+
+// SystemdUnit returns a systemd unit which runs the agent as user and
+// restarts it if it fails or exits to restart, see agent.EXIT_RESTART.
+// SIGHUP reloads the agent, so it's ExecReload.
+func SystemdUnit(bin, basedir, user string, env []string) []byte {
+	buf := &bytes.Buffer{}
+	fmt.Fprintf(buf, "[Unit]\n")
+	fmt.Fprintf(buf, "Description=Percona Agent\n")
+	fmt.Fprintf(buf, "After=network.target\n\n")
+	fmt.Fprintf(buf, "[Service]\n")
+	fmt.Fprintf(buf, "Type=simple\n")
+	fmt.Fprintf(buf, "User=%s\n", user)
+	fmt.Fprintf(buf, "Environment=%s=%s\n", agent.ENV_INIT_SYSTEM, INIT_SYSTEMD)
+	for _, e := range env {
+		fmt.Fprintf(buf, "Environment=%s\n", e)
+	}
+	fmt.Fprintf(buf, "ExecStart=%s -basedir %s\n", bin, basedir)
+	fmt.Fprintf(buf, "ExecReload=/bin/kill -HUP $MAINPID\n")
+	fmt.Fprintf(buf, "Restart=on-failure\n")
+	fmt.Fprintf(buf, "RestartSec=10\n\n")
+	fmt.Fprintf(buf, "[Install]\n")
+	fmt.Fprintf(buf, "WantedBy=multi-user.target\n")
+	return buf.Bytes()
+}
+
+// UpstartJob returns an upstart job which runs the agent as user, starts it
+// at boot, and respawns it if it dies or exits to restart, see
+// agent.EXIT_RESTART.  Output is appended to logFile like the sysvinit script
+// does.
+func UpstartJob(bin, basedir, user, logFile string, env []string) []byte {
+	buf := &bytes.Buffer{}
+	fmt.Fprintf(buf, "description \"Percona Agent\"\n\n")
+	fmt.Fprintf(buf, "start on (local-filesystems and net-device-up IFACE!=lo)\n")
+	fmt.Fprintf(buf, "stop on runlevel [!2345]\n\n")
+	fmt.Fprintf(buf, "respawn\n")
+	fmt.Fprintf(buf, "respawn limit 10 60\n\n")
+	if user != "root" {
+		fmt.Fprintf(buf, "setuid %s\n", user)
+	}
+	fmt.Fprintf(buf, "env %s=%s\n", agent.ENV_INIT_SYSTEM, INIT_UPSTART)
+	for _, e := range env {
+		fmt.Fprintf(buf, "env %s\n", e)
+	}
+	fmt.Fprintf(buf, "\nexec %s -basedir %s >> %s 2>&1\n", bin, basedir, logFile)
+	return buf.Bytes()
+}
+
+// SysvinitScript returns the sysvinit script, e.g. install/percona-agent, with
+// its default basedir and user set.  It does not restart the agent if it dies.
+func SysvinitScript(script []byte, basedir, user string) ([]byte, error) {
+	if !initUserRe.Match(script) || !initBasedirRe.Match(script) {
+		return nil, fmt.Errorf("Invalid %s init script: no USERNAME or BASEDIR", SERVICE_NAME)
+	}
+	script = initUserRe.ReplaceAllLiteral(script, []byte(`USERNAME="${PCT_TEST_AGENT_USER:-`+user+`}"`))
+	script = initBasedirRe.ReplaceAllLiteral(script, []byte(`BASEDIR="${PCT_TEST_AGENT_DIR:-"`+basedir+`"}"`))
+	return script, nil
+}
+
+// InstallService writes the agent service of the init system, -init-system or
+// detected, enables it to start at boot if -enable-service, and starts it if
+// -start-agent.  The agent binary must be installed to start it.
+func (i *Installer) InstallService() error {
+	initSystem := i.flags.String["init-system"]
+	if initSystem == "" {
+		if initSystem = DetectInitSystem(); initSystem == "" {
+			return fmt.Errorf("Cannot detect the init system, set it with -init-system or use -install-service=false")
+		}
+		fmt.Printf("Detected init system: %s\n", initSystem)
+	}
+	if initSystem == INIT_NONE {
+		fmt.Println("Not installing percona-agent service (-init-system=none)")
+		return nil
+	}
+	file, ok := SERVICE_FILES[initSystem]
+	if !ok {
+		return fmt.Errorf("Invalid -init-system: %s: expected %s, %s, %s, or %s",
+			initSystem, INIT_SYSTEMD, INIT_UPSTART, INIT_SYSVINIT, INIT_NONE)
+	}
+
+	basedir := pct.Basedir.Path()
+	bin := filepath.Join(pct.Basedir.Dir("bin"), SERVICE_NAME)
+	user := i.flags.String["service-user"]
+	if user == "" {
+		user = "root" // QAN reads the MySQL slow log
+	}
+	env := ServiceEnv(basedir)
+
+	var data []byte
+	var mode os.FileMode = 0644
+	switch initSystem {
+	case INIT_SYSTEMD:
+		data = SystemdUnit(bin, basedir, user, env)
+	case INIT_UPSTART:
+		logFile := filepath.Join(pct.Basedir.Dir("log"), SERVICE_NAME+".log")
+		data = UpstartJob(bin, basedir, user, logFile, env)
+	case INIT_SYSVINIT:
+		script, err := i.sysvinitScript()
+		if err != nil {
+			return err
+		}
+		if data, err = SysvinitScript(script, basedir, user); err != nil {
+			return err
+		}
+		mode = 0755
+		fmt.Println("WARNING: sysvinit does not restart percona-agent if it stops unexpectedly")
+	}
+	if err := pct.WriteFile(file, data, mode); err != nil {
+		return fmt.Errorf("Failed to write %s: %s", file, err)
+	}
+	fmt.Printf("Installed %s service: %s\n", initSystem, file)
+
+	if i.flags.Bool["enable-service"] {
+		if err := i.serviceCmds(enableCmds(initSystem)); err != nil {
+			return fmt.Errorf("Failed to enable %s service: %s", SERVICE_NAME, err)
+		}
+		fmt.Printf("Enabled %s service to start at boot\n", SERVICE_NAME)
+	} else {
+		fmt.Println("Not enabling percona-agent service (-enable-service=false)")
+	}
+
+	if i.flags.Bool["start-agent"] {
+		if !pct.FileExists(bin) {
+			fmt.Printf("Not starting percona-agent: %s is not installed yet\n", bin)
+			return nil
+		}
+		if err := i.serviceCmds(startCmds(initSystem)); err != nil {
+			return fmt.Errorf("Failed to start %s: %s", SERVICE_NAME, err)
+		}
+		fmt.Printf("Started %s\n", SERVICE_NAME)
+	}
+	return nil
+}
+
+// uninstallService stops and disables the agent service of every init system
+// it's installed for, so the init system doesn't restart the agent, and
+// removes its service files.
+func (i *Installer) uninstallService() error {
+	var errs []string
+	for _, initSystem := range []string{INIT_SYSTEMD, INIT_UPSTART, INIT_SYSVINIT} {
+		file := SERVICE_FILES[initSystem]
+		if !pct.FileExists(file) {
+			continue
+		}
+		i.serviceCmds(stopCmds(initSystem)) // not an error if not running
+		if err := i.serviceCmds(disableCmds(initSystem)); err != nil {
+			errs = append(errs, fmt.Sprintf("Cannot disable %s service: %s", initSystem, err))
+		}
+		if err := os.Remove(file); err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+		if initSystem == INIT_SYSTEMD {
+			i.serviceCmds([][]string{{"systemctl", "daemon-reload"}})
+		}
+		fmt.Printf("Removed %s service: %s\n", initSystem, file)
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// sysvinitScript returns the sysvinit script shipped with the installer, in
+// ../init.d relative to the installer binary, or installed in the basedir.
+func (i *Installer) sysvinitScript() ([]byte, error) {
+	files := []string{
+		filepath.Join(filepath.Dir(os.Args[0]), "..", "init.d", SERVICE_NAME),
+		filepath.Join(pct.Basedir.Path(), "init.d", SERVICE_NAME),
+	}
+	for _, file := range files {
+		if data, err := ioutil.ReadFile(file); err == nil {
+			return data, nil
+		}
+	}
+	return nil, fmt.Errorf("Cannot find %s init script in %s", SERVICE_NAME, strings.Join(files, " or "))
+}
+
+// serviceCmds runs the cmds, stopping at the first that fails.
+func (i *Installer) serviceCmds(cmds [][]string) error {
+	for _, args := range cmds {
+		if i.flags.Bool["debug"] {
+			log.Println(strings.Join(args, " "))
+		}
+		out, err := exec.Command(args[0], args[1:]...).CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("%s: %s: %s", strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+		}
+	}
+	return nil
+}
+
+func enableCmds(initSystem string) [][]string {
+	switch initSystem {
+	case INIT_SYSTEMD:
+		return [][]string{{"systemctl", "daemon-reload"}, {"systemctl", "enable", SERVICE_NAME}}
+	case INIT_SYSVINIT:
+		if _, err := exec.LookPath("update-rc.d"); err == nil {
+			return [][]string{{"update-rc.d", SERVICE_NAME, "defaults"}}
+		}
+		return [][]string{{"chkconfig", SERVICE_NAME, "on"}}
+	}
+	return nil // upstart starts the job at boot
+}
+
+func disableCmds(initSystem string) [][]string {
+	switch initSystem {
+	case INIT_SYSTEMD:
+		return [][]string{{"systemctl", "disable", SERVICE_NAME}}
+	case INIT_SYSVINIT:
+		if _, err := exec.LookPath("update-rc.d"); err == nil {
+			return [][]string{{"update-rc.d", "-f", SERVICE_NAME, "remove"}}
+		}
+		return [][]string{{"chkconfig", "--del", SERVICE_NAME}}
+	}
+	return nil
+}
+
+func startCmds(initSystem string) [][]string {
+	return serviceCmd(initSystem, "start")
+}
+
+func stopCmds(initSystem string) [][]string {
+	return serviceCmd(initSystem, "stop")
+}
+
+func serviceCmd(initSystem, cmd string) [][]string {
+	switch initSystem {
+	case INIT_SYSTEMD:
+		return [][]string{{"systemctl", cmd, SERVICE_NAME}}
+	case INIT_UPSTART:
+		return [][]string{{"initctl", cmd, SERVICE_NAME}}
+	}
+	return [][]string{{SERVICE_FILES[INIT_SYSVINIT], cmd}}
+}
@@ -0,0 +1,290 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package installer
+
+import (
+	"fmt"
+	"github.com/percona/cloud-protocol/proto/v1"
+	"github.com/percona/percona-agent/agent"
+	"github.com/percona/percona-agent/mysql"
+	"github.com/percona/percona-agent/pct"
+	"github.com/percona/percona-agent/qan"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// AGENT_STOP_TIMEOUT is how long Uninstall waits for the agent to stop.
+const AGENT_STOP_TIMEOUT = 30 * time.Second
+
+// Uninstall undoes Run: it removes the agent service, stops the agent,
+// disables the slow log settings of QAN, drops the agent MySQL user, deletes
+// the agent and its instances via the API, and removes the basedir and the
+// dirs of its layout.  Steps that fail are reported and skipped so the rest of
+// the agent is still removed.  Nothing is removed if there's no agent config
+// in the basedir, so a wrong -basedir doesn't remove some other dir.
+func (i *Installer) Uninstall() error {
+	basedir := pct.Basedir.Path()
+	config, err := Installed()
+	if err != nil {
+		return err
+	}
+	if config == nil {
+		return fmt.Errorf("percona-agent is not installed in %s", basedir)
+	}
+	fmt.Printf("Uninstalling percona-agent in %s\n", basedir)
+	if i.flags.Bool["interactive"] {
+		ok, err := i.term.PromptBool("Stop and remove percona-agent, its MySQL user, and all its data?", "N")
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return fmt.Errorf("Uninstall canceled")
+		}
+	}
+
+	// The agent config has the API key, agent uuid, and PID file.
+	if i.agentConfig.ApiKey == "" {
+		i.agentConfig.ApiKey = config.ApiKey
+	}
+	if config.ApiHostname != "" && i.agentConfig.ApiHostname == agent.DEFAULT_API_HOSTNAME {
+		i.agentConfig.ApiHostname = config.ApiHostname
+	}
+	if config.PidFile == "" {
+		config.PidFile = agent.DEFAULT_PIDFILE
+	}
+
+	// Stop the agent first, else it recreates what's removed next.  The agent
+	// runs the QAN Stop queries when it stops.  Its service is removed first
+	// so the init system doesn't restart it.
+	warnings := 0
+	if err := i.uninstallService(); err != nil {
+		fmt.Printf("WARNING: %s\n", err)
+		warnings++
+	}
+	if err := i.stopAgent(config.PidFile); err != nil {
+		return err
+	}
+
+	if err := i.instanceRepo.Init(); err != nil {
+		fmt.Printf("WARNING: cannot load instances: %s\n", err)
+		warnings++
+	}
+	mysqlInstances := []*proto.MySQLInstance{}
+	instanceIds := map[string][]uint{}
+	for _, name := range i.instanceRepo.List() {
+		part := strings.Split(name, "-")
+		id, err := strconv.ParseUint(part[len(part)-1], 10, 32)
+		if err != nil {
+			continue
+		}
+		service := part[0]
+		instanceIds[service] = append(instanceIds[service], uint(id))
+		if service == "mysql" {
+			mi := &proto.MySQLInstance{}
+			if err := i.instanceRepo.Get(service, uint(id), mi); err == nil {
+				mysqlInstances = append(mysqlInstances, mi)
+			}
+		}
+	}
+
+	if len(mysqlInstances) > 0 && i.flags.Bool["mysql"] {
+		if err := i.uninstallMySQL(mysqlInstances); err != nil {
+			fmt.Printf("WARNING: %s\n", err)
+			warnings++
+		}
+	}
+
+	if i.agentConfig.ApiKey != "" && config.AgentUuid != "" {
+		if err := i.VerifyApiKey(); err != nil {
+			fmt.Printf("WARNING: not deleting agent %s via the API: %s\n", config.AgentUuid, err)
+			warnings++
+		} else {
+			for service, ids := range instanceIds {
+				for _, id := range ids {
+					if err := i.api.DeleteInstance(service, id); err != nil {
+						fmt.Printf("WARNING: %s\n", err)
+						warnings++
+						continue
+					}
+					fmt.Printf("Deleted %s instance: id=%d\n", service, id)
+				}
+			}
+			if err := i.api.DeleteAgent(config.AgentUuid); err != nil {
+				fmt.Printf("WARNING: %s\n", err)
+				warnings++
+			} else {
+				fmt.Printf("Deleted agent: uuid=%s\n", config.AgentUuid)
+			}
+		}
+	}
+
+	// Dirs of the layout outside the basedir, e.g. /etc/percona-agent, are
+	// removed too, but only if they're the agent's own: the log dir can be
+	// /var/log.
+	layout := pct.Basedir.Layout()
+	removed := map[string]bool{}
+	for _, dir := range []string{layout.ConfigDir, layout.DataDir, layout.LogDir, layout.SpoolDir} {
+		if dir == "" || removed[dir] || dir == basedir || strings.HasPrefix(dir, basedir+string(filepath.Separator)) {
+			continue
+		}
+		removed[dir] = true
+		if !strings.Contains(filepath.Base(dir), "percona") {
+			fmt.Printf("WARNING: not removing %s: not a percona-agent dir\n", dir)
+			warnings++
+			continue
+		}
+		if err := os.RemoveAll(dir); err != nil {
+			fmt.Printf("WARNING: failed to remove %s: %s\n", dir, err)
+			warnings++
+			continue
+		}
+		fmt.Printf("Removed %s\n", dir)
+	}
+
+	if err := pct.Basedir.CloseStore(); err != nil {
+		fmt.Printf("WARNING: %s\n", err)
+		warnings++
+	}
+	if err := os.RemoveAll(basedir); err != nil {
+		return fmt.Errorf("Failed to remove %s: %s", basedir, err)
+	}
+	fmt.Printf("Removed %s\n", basedir)
+
+	if warnings > 0 {
+		return fmt.Errorf("Uninstalled percona-agent with %d warnings", warnings)
+	}
+	fmt.Println("Uninstalled percona-agent")
+	return nil
+}
+
+// stopAgent sends SIGTERM to the agent in the PID file and waits for it to
+// stop.  It's not an error if the agent isn't running.
+func (i *Installer) stopAgent(pidFile string) error {
+	if !filepath.IsAbs(pidFile) {
+		pidFile = filepath.Join(pct.Basedir.Path(), pidFile)
+	}
+	data, err := ioutil.ReadFile(pidFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			fmt.Println("percona-agent is not running")
+			return nil
+		}
+		return err
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		return fmt.Errorf("Invalid PID file %s: %s", pidFile, err)
+	}
+
+	// FindProcess always succeeds on Unix; Signal fails if pid isn't running.
+	p, _ := os.FindProcess(pid)
+	if err := p.Signal(syscall.SIGTERM); err != nil {
+		fmt.Printf("percona-agent is not running (PID %d)\n", pid)
+		return nil
+	}
+	fmt.Printf("Stopping percona-agent (PID %d)...\n", pid)
+	timeout := time.After(AGENT_STOP_TIMEOUT)
+	for {
+		select {
+		case <-timeout:
+			return fmt.Errorf("percona-agent (PID %d) did not stop after %s", pid, AGENT_STOP_TIMEOUT)
+		case <-time.After(500 * time.Millisecond):
+		}
+		if err := p.Signal(syscall.Signal(0)); err != nil {
+			fmt.Println("Stopped percona-agent")
+			return nil
+		}
+	}
+}
+
+// uninstallMySQL runs the QAN Stop queries, in case the agent didn't, and drops
+// the MySQL user created for the agent.  A user not created by the installer,
+// i.e. given with -agent-mysql-user, is not dropped.
+func (i *Installer) uninstallMySQL(instances []*proto.MySQLInstance) error {
+	superUserDSN, err := i.getSuperUserDSN()
+	if err != nil {
+		return fmt.Errorf("Not dropping MySQL user or disabling slow log: %s", err)
+	}
+	dsnString, err := superUserDSN.DSN()
+	if err != nil {
+		return err
+	}
+	conn := mysql.NewConnection(dsnString)
+	if err := conn.Connect(1); err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	var errs []string
+
+	qanConfig := &qan.Config{}
+	if err := pct.Basedir.ReadConfig("qan", qanConfig); err == nil && len(qanConfig.Stop) > 0 {
+		if err := conn.Set(qanConfig.Stop); err != nil {
+			errs = append(errs, fmt.Sprintf("Cannot disable slow log: %s", err))
+		} else {
+			fmt.Println("Disabled slow log settings of Query Analytics")
+		}
+	}
+
+	dropUser := false
+	for _, mi := range instances {
+		if user, _ := DSNUser(mi.DSN); user == AGENT_MYSQL_USER {
+			dropUser = true
+		}
+	}
+	if dropUser {
+		dropped := true
+		for _, drop := range MakeDropUser(superUserDSN, AGENT_MYSQL_USER) {
+			if i.flags.Bool["debug"] {
+				log.Println(drop)
+			}
+			if _, err := conn.DB().Exec(drop); err != nil {
+				errs = append(errs, fmt.Sprintf("Error executing %s: %s", drop, err))
+				dropped = false
+			}
+		}
+		if dropped {
+			fmt.Printf("Dropped MySQL user: %s\n", AGENT_MYSQL_USER)
+		}
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// DSNUser returns the user and password of a Go MySQL driver DSN like
+// user:pass@tcp(host:port)/, which is how instances store the DSN.
+func DSNUser(dsn string) (user, pass string) {
+	at := strings.LastIndex(dsn, "@")
+	if at < 0 {
+		return "", ""
+	}
+	user = dsn[0:at]
+	if n := strings.Index(user, ":"); n >= 0 {
+		user, pass = user[0:n], user[n+1:]
+	}
+	return user, pass
+}
@@ -60,6 +60,14 @@ var (
 	flagMySQLPort               string
 	flagMySQLSocket             string
 	flagMySQLMaxUserConnections int64
+	flagUninstall               bool
+	flagRepair                  bool
+	flagAnswerFile              string
+	flagInstallService          bool
+	flagInitSystem              string
+	flagServiceUser             string
+	flagEnableService           bool
+	flagStartAgent              bool
 )
 
 func init() {
@@ -68,7 +76,7 @@ func init() {
 
 	flag.StringVar(&flagApiHostname, "api-host", agent.DEFAULT_API_HOSTNAME, "API host")
 	flag.StringVar(&flagApiKey, "api-key", "", "API key, it is available at "+DEFAULT_APP_HOSTNAME+"/api-key")
-	flag.StringVar(&flagBasedir, "basedir", pct.DEFAULT_BASEDIR, "Agent basedir")
+	flag.StringVar(&flagBasedir, "basedir", pct.EnvBasedir(pct.DEFAULT_BASEDIR), "Agent basedir (env "+pct.ENV_BASEDIR+")")
 	flag.BoolVar(&flagDebug, "debug", false, "Debug")
 	// --
 	flag.BoolVar(&flagMySQL, "mysql", true, "Install for MySQL")
@@ -91,6 +99,14 @@ func init() {
 	flag.StringVar(&flagMySQLPort, "mysql-port", "", "MySQL port")
 	flag.StringVar(&flagMySQLSocket, "mysql-socket", "", "MySQL socket file")
 	flag.Int64Var(&flagMySQLMaxUserConnections, "mysql-max-user-connections", 5, "Max number of MySQL connections")
+	flag.BoolVar(&flagRepair, "repair", false, "Repair the installed agent: verify the API key, re-create missing instances and configs, re-grant the MySQL user, and fix permissions")
+	flag.BoolVar(&flagInstallService, "install-service", false, "Install the agent service for the init system so it starts at boot")
+	flag.StringVar(&flagInitSystem, "init-system", "", "Init system of -install-service: systemd, upstart, sysvinit, or none (default detected)")
+	flag.StringVar(&flagServiceUser, "service-user", "root", "User to run the agent service as, root to run Query Analytics")
+	flag.BoolVar(&flagEnableService, "enable-service", true, "Enable the agent service to start at boot")
+	flag.BoolVar(&flagStartAgent, "start-agent", false, "Start the agent service after installing it")
+	flag.StringVar(&flagAnswerFile, "answer-file", "", "JSON file with flags and MySQL instances to install non-interactively, flags on the command line override it")
+	flag.BoolVar(&flagUninstall, "uninstall", false, "Stop and remove the agent: delete it via the API, drop its MySQL user, and remove the basedir")
 }
 
 func main() {
@@ -103,6 +119,19 @@ func main() {
 		os.Exit(10)
 	}
 
+	var answers *installer.AnswerFile
+	if flagAnswerFile != "" {
+		var err error
+		if answers, err = installer.ReadAnswerFile(flagAnswerFile); err != nil {
+			log.Println(err)
+			os.Exit(1)
+		}
+		if err := answers.SetFlags(flag.CommandLine); err != nil {
+			log.Println(err)
+			os.Exit(1)
+		}
+	}
+
 	agentConfig := &agent.Config{
 		ApiHostname: flagApiHostname,
 		ApiKey:      flagApiKey,
@@ -137,6 +166,9 @@ func main() {
 			"auto-detect-mysql":      flagAutoDetectMySQL,
 			"create-mysql-user":      flagCreateMySQLUser,
 			"mysql":                  flagMySQL,
+			"install-service":        flagInstallService,
+			"enable-service":         flagEnableService,
+			"start-agent":            flagStartAgent,
 		},
 		String: map[string]string{
 			"app-host":            DEFAULT_APP_HOSTNAME,
@@ -148,6 +180,8 @@ func main() {
 			"mysql-host":          flagMySQLHost,
 			"mysql-port":          flagMySQLPort,
 			"mysql-socket":        flagMySQLSocket,
+			"init-system":         flagInitSystem,
+			"service-user":        flagServiceUser,
 		},
 		Int64: map[string]int64{
 			"mysql-max-user-connections": flagMySQLMaxUserConnections,
@@ -168,7 +202,48 @@ func main() {
 	instanceRepo := instance.NewRepo(logger, pct.Basedir.Dir("config"), apiConnector)
 	terminal := term.NewTerminal(os.Stdin, flagInteractive, flagDebug)
 	agentInstaller := installer.NewInstaller(terminal, flagBasedir, api, instanceRepo, agentConfig, flags)
+	if answers != nil && len(answers.MySQL) > 0 {
+		mysqlFlags, err := answers.MySQLFlags(flags)
+		if err != nil {
+			log.Println(err)
+			os.Exit(1)
+		}
+		agentInstaller.SetMySQLFlags(mysqlFlags)
+	}
 	fmt.Println("CTRL-C at any time to quit")
+	if flagUninstall {
+		if err := agentInstaller.Uninstall(); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	// Offer to repair an installed agent instead of installing another one.
+	installed, err := installer.Installed()
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if installed != nil && !flagRepair && flagInteractive {
+		question := fmt.Sprintf("percona-agent is already installed in %s. Repair it?", pct.Basedir.Path())
+		if flagRepair, err = terminal.PromptBool(question, "Y"); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	}
+	if flagRepair {
+		if installed == nil {
+			fmt.Printf("percona-agent is not installed in %s, installing it\n", pct.Basedir.Path())
+		} else {
+			if err := agentInstaller.Repair(installed); err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+			os.Exit(0)
+		}
+	}
+
 	// todo: catch SIGINT and clean up
 	if err := agentInstaller.Run(); err != nil {
 		fmt.Println(err)
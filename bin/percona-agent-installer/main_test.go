@@ -248,15 +248,15 @@ func (s *MainTestSuite) TestDefaultInstall(t *C) {
 
 	s.expectConfigs(
 		[]string{
-			"agent.conf",
-			"data.conf",
-			"log.conf",
-			fmt.Sprintf("mm-mysql-%d.conf", s.mysqlInstance.Id),
-			fmt.Sprintf("mm-server-%d.conf", s.serverInstance.Id),
-			fmt.Sprintf("mysql-%d.conf", s.mysqlInstance.Id),
-			"qan.conf",
-			fmt.Sprintf("server-%d.conf", s.serverInstance.Id),
-			fmt.Sprintf("sysconfig-mysql-%d.conf", s.mysqlInstance.Id),
+			"agent",
+			"data",
+			"log",
+			fmt.Sprintf("mm-mysql-%d", s.mysqlInstance.Id),
+			fmt.Sprintf("mm-server-%d", s.serverInstance.Id),
+			fmt.Sprintf("mysql-%d", s.mysqlInstance.Id),
+			"qan",
+			fmt.Sprintf("server-%d", s.serverInstance.Id),
+			fmt.Sprintf("sysconfig-mysql-%d", s.mysqlInstance.Id),
 		},
 		t,
 	)
@@ -327,15 +327,15 @@ func (s *MainTestSuite) TestNonInteractiveInstallWithJustCredentialDetailsFlags(
 
 	s.expectConfigs(
 		[]string{
-			"agent.conf",
-			"data.conf",
-			"log.conf",
-			fmt.Sprintf("mm-mysql-%d.conf", s.mysqlInstance.Id),
-			fmt.Sprintf("mm-server-%d.conf", s.serverInstance.Id),
-			fmt.Sprintf("mysql-%d.conf", s.mysqlInstance.Id),
-			"qan.conf",
-			fmt.Sprintf("server-%d.conf", s.serverInstance.Id),
-			fmt.Sprintf("sysconfig-mysql-%d.conf", s.mysqlInstance.Id),
+			"agent",
+			"data",
+			"log",
+			fmt.Sprintf("mm-mysql-%d", s.mysqlInstance.Id),
+			fmt.Sprintf("mm-server-%d", s.serverInstance.Id),
+			fmt.Sprintf("mysql-%d", s.mysqlInstance.Id),
+			"qan",
+			fmt.Sprintf("server-%d", s.serverInstance.Id),
+			fmt.Sprintf("sysconfig-mysql-%d", s.mysqlInstance.Id),
 		},
 		t,
 	)
@@ -432,15 +432,15 @@ func (s *MainTestSuite) TestNonInteractiveInstallWithFlagCreateMySQLUserFalse(t
 
 	s.expectConfigs(
 		[]string{
-			"agent.conf",
-			"data.conf",
-			"log.conf",
-			fmt.Sprintf("mm-mysql-%d.conf", s.mysqlInstance.Id),
-			fmt.Sprintf("mm-server-%d.conf", s.serverInstance.Id),
-			fmt.Sprintf("mysql-%d.conf", s.mysqlInstance.Id),
-			"qan.conf",
-			fmt.Sprintf("server-%d.conf", s.serverInstance.Id),
-			fmt.Sprintf("sysconfig-mysql-%d.conf", s.mysqlInstance.Id),
+			"agent",
+			"data",
+			"log",
+			fmt.Sprintf("mm-mysql-%d", s.mysqlInstance.Id),
+			fmt.Sprintf("mm-server-%d", s.serverInstance.Id),
+			fmt.Sprintf("mysql-%d", s.mysqlInstance.Id),
+			"qan",
+			fmt.Sprintf("server-%d", s.serverInstance.Id),
+			fmt.Sprintf("sysconfig-mysql-%d", s.mysqlInstance.Id),
 		},
 		t,
 	)
@@ -591,15 +591,15 @@ func (s *MainTestSuite) TestInstall(t *C) {
 
 	s.expectConfigs(
 		[]string{
-			"agent.conf",
-			"data.conf",
-			"log.conf",
-			fmt.Sprintf("mm-mysql-%d.conf", s.mysqlInstance.Id),
-			fmt.Sprintf("mm-server-%d.conf", s.serverInstance.Id),
-			fmt.Sprintf("mysql-%d.conf", s.mysqlInstance.Id),
-			"qan.conf",
-			fmt.Sprintf("server-%d.conf", s.serverInstance.Id),
-			fmt.Sprintf("sysconfig-mysql-%d.conf", s.mysqlInstance.Id),
+			"agent",
+			"data",
+			"log",
+			fmt.Sprintf("mm-mysql-%d", s.mysqlInstance.Id),
+			fmt.Sprintf("mm-server-%d", s.serverInstance.Id),
+			fmt.Sprintf("mysql-%d", s.mysqlInstance.Id),
+			"qan",
+			fmt.Sprintf("server-%d", s.serverInstance.Id),
+			fmt.Sprintf("sysconfig-mysql-%d", s.mysqlInstance.Id),
 		},
 		t,
 	)
@@ -738,15 +738,15 @@ func (s *MainTestSuite) TestInstallWorksWithExistingMySQLInstanceAndInstanceIsUp
 
 	s.expectConfigs(
 		[]string{
-			"agent.conf",
-			"data.conf",
-			"log.conf",
-			fmt.Sprintf("mm-mysql-%d.conf", s.mysqlInstance.Id),
-			fmt.Sprintf("mm-server-%d.conf", s.serverInstance.Id),
-			fmt.Sprintf("mysql-%d.conf", s.mysqlInstance.Id),
-			"qan.conf",
-			fmt.Sprintf("server-%d.conf", s.serverInstance.Id),
-			fmt.Sprintf("sysconfig-mysql-%d.conf", s.mysqlInstance.Id),
+			"agent",
+			"data",
+			"log",
+			fmt.Sprintf("mm-mysql-%d", s.mysqlInstance.Id),
+			fmt.Sprintf("mm-server-%d", s.serverInstance.Id),
+			fmt.Sprintf("mysql-%d", s.mysqlInstance.Id),
+			"qan",
+			fmt.Sprintf("server-%d", s.serverInstance.Id),
+			fmt.Sprintf("sysconfig-mysql-%d", s.mysqlInstance.Id),
 		},
 		t,
 	)
@@ -924,12 +924,12 @@ func (s *MainTestSuite) TestInstallWithFlagCreateAgentFalse(t *C) {
 
 	s.expectConfigs(
 		[]string{
-			//fmt.Sprintf("mm-mysql-%d.conf", s.mysqlInstance.Id),
-			//fmt.Sprintf("mm-server-%d.conf", s.serverInstance.Id),
-			fmt.Sprintf("mysql-%d.conf", s.mysqlInstance.Id),
-			//"qan.conf",
-			fmt.Sprintf("server-%d.conf", s.serverInstance.Id),
-			//fmt.Sprintf("sysconfig-mysql-%d.conf", s.mysqlInstance.Id),
+			//fmt.Sprintf("mm-mysql-%d", s.mysqlInstance.Id),
+			//fmt.Sprintf("mm-server-%d", s.serverInstance.Id),
+			fmt.Sprintf("mysql-%d", s.mysqlInstance.Id),
+			//"qan",
+			fmt.Sprintf("server-%d", s.serverInstance.Id),
+			//fmt.Sprintf("sysconfig-mysql-%d", s.mysqlInstance.Id),
 		},
 		t,
 	)
@@ -999,15 +999,15 @@ func (s *MainTestSuite) TestInstallWithFlagOldPasswordsTrue(t *C) {
 
 	s.expectConfigs(
 		[]string{
-			"agent.conf",
-			"data.conf",
-			"log.conf",
-			fmt.Sprintf("mm-mysql-%d.conf", s.mysqlInstance.Id),
-			fmt.Sprintf("mm-server-%d.conf", s.serverInstance.Id),
-			fmt.Sprintf("mysql-%d.conf", s.mysqlInstance.Id),
-			"qan.conf",
-			fmt.Sprintf("server-%d.conf", s.serverInstance.Id),
-			fmt.Sprintf("sysconfig-mysql-%d.conf", s.mysqlInstance.Id),
+			"agent",
+			"data",
+			"log",
+			fmt.Sprintf("mm-mysql-%d", s.mysqlInstance.Id),
+			fmt.Sprintf("mm-server-%d", s.serverInstance.Id),
+			fmt.Sprintf("mysql-%d", s.mysqlInstance.Id),
+			"qan",
+			fmt.Sprintf("server-%d", s.serverInstance.Id),
+			fmt.Sprintf("sysconfig-mysql-%d", s.mysqlInstance.Id),
 		},
 		t,
 	)
@@ -1074,15 +1074,15 @@ func (s *MainTestSuite) TestInstallWithFlagApiKey(t *C) {
 
 	s.expectConfigs(
 		[]string{
-			"agent.conf",
-			"data.conf",
-			"log.conf",
-			fmt.Sprintf("mm-mysql-%d.conf", s.mysqlInstance.Id),
-			fmt.Sprintf("mm-server-%d.conf", s.serverInstance.Id),
-			fmt.Sprintf("mysql-%d.conf", s.mysqlInstance.Id),
-			"qan.conf",
-			fmt.Sprintf("server-%d.conf", s.serverInstance.Id),
-			fmt.Sprintf("sysconfig-mysql-%d.conf", s.mysqlInstance.Id),
+			"agent",
+			"data",
+			"log",
+			fmt.Sprintf("mm-mysql-%d", s.mysqlInstance.Id),
+			fmt.Sprintf("mm-server-%d", s.serverInstance.Id),
+			fmt.Sprintf("mysql-%d", s.mysqlInstance.Id),
+			"qan",
+			fmt.Sprintf("server-%d", s.serverInstance.Id),
+			fmt.Sprintf("sysconfig-mysql-%d", s.mysqlInstance.Id),
 		},
 		t,
 	)
@@ -1147,11 +1147,11 @@ func (s *MainTestSuite) TestInstallWithFlagMysqlFalse(t *C) {
 
 	s.expectConfigs(
 		[]string{
-			"agent.conf",
-			"data.conf",
-			"log.conf",
-			fmt.Sprintf("mm-server-%d.conf", s.serverInstance.Id),
-			fmt.Sprintf("server-%d.conf", s.serverInstance.Id),
+			"agent",
+			"data",
+			"log",
+			fmt.Sprintf("mm-server-%d", s.serverInstance.Id),
+			fmt.Sprintf("server-%d", s.serverInstance.Id),
 		},
 		t,
 	)
@@ -1166,13 +1166,89 @@ func (s *MainTestSuite) TestInstallWithFlagMysqlFalse(t *C) {
 	s.expectMysqlUserNotExists(t)
 }
 
+func (s *MainTestSuite) TestRepair(t *C) {
+	// Register required api handlers.  Count agents created: repairing must
+	// not create another agent.
+	s.fakeApi.AppendPing()
+	serverInstance := &proto.ServerInstance{}
+	s.fakeApi.AppendInstancesServer(s.serverInstance.Id, serverInstance)
+	s.fakeApi.AppendInstancesServerId(s.serverInstance.Id, serverInstance)
+	mysqlInstance := &proto.MySQLInstance{}
+	s.fakeApi.AppendInstancesMysql(s.mysqlInstance.Id, mysqlInstance)
+	s.fakeApi.AppendInstancesMysqlId(s.mysqlInstance.Id, mysqlInstance)
+	s.fakeApi.AppendConfigsMmDefaultServer()
+	s.fakeApi.AppendConfigsMmDefaultMysql()
+	s.fakeApi.AppendConfigsQanDefault()
+	s.fakeApi.AppendSysconfigDefaultMysql()
+	agentsCreated := 0
+	s.fakeApi.Append("/agents", func(w http.ResponseWriter, r *http.Request) {
+		agentsCreated++
+		w.Header().Set("Location", fmt.Sprintf("%s/agents/%s", s.fakeApi.URL(), s.agent.Uuid))
+		w.WriteHeader(http.StatusCreated)
+	})
+	s.fakeApi.AppendAgentsUuid(s.agent)
+
+	args := []string{
+		"-basedir=" + pct.Basedir.Path(),
+		"-api-host=" + s.fakeApi.URL(),
+		"-interactive=false",
+		"-mysql-defaults-file=" + test.RootDir + "/installer/my.cnf-wrong_user",
+		"-mysql-user=" + s.username,
+		"-mysql-socket=/var/run/mysqld/mysqld.sock",
+		"-api-key=" + s.apiKey,
+	}
+	cmd := exec.Command(s.bin, args...)
+	err := cmd.Run()
+	t.Assert(err, IsNil)
+	t.Assert(agentsCreated, Equals, 1)
+
+	// Break the install: lose a config, the MySQL user, and private perms.
+	mmServerConfig := fmt.Sprintf("mm-server-%d", s.serverInstance.Id)
+	err = pct.Basedir.RemoveConfig(mmServerConfig)
+	t.Assert(err, IsNil)
+	_, err = s.rootConn.Exec("DELETE FROM mysql.user WHERE user='percona-agent'")
+	t.Assert(err, IsNil)
+	s.rootConn.Exec("FLUSH PRIVILEGES")
+	s.expectMysqlUserNotExists(t)
+	storeFile := pct.Basedir.File("store")
+	err = os.Chmod(storeFile, 0644)
+	t.Assert(err, IsNil)
+
+	cmd = exec.Command(s.bin, append(args, "-repair")...)
+	cmdTest := cmdtest.NewCmdTest(cmd)
+	if err := cmd.Start(); err != nil {
+		log.Fatal(err)
+	}
+
+	t.Check(cmdTest.ReadLine(), Equals, "CTRL-C at any time to quit\n")
+	t.Check(cmdTest.ReadLine(), Equals, "Repairing percona-agent in "+pct.Basedir.Path()+"\n")
+	t.Check(cmdTest.ReadLine(), Equals, "API host: "+s.fakeApi.URL()+"\n")
+	t.Check(cmdTest.ReadLine(), Equals, "Verifying API key "+s.apiKey+"...\n")
+	t.Check(cmdTest.ReadLine(), Equals, fmt.Sprintf("Verified agent: uuid=%s\n", s.agent.Uuid))
+	t.Check(cmdTest.ReadLine(), Equals, fmt.Sprintf("Using server instance: hostname=%s id=%d\n", s.serverInstance.Hostname, s.serverInstance.Id))
+	t.Check(cmdTest.ReadLine(), Equals, fmt.Sprintf("Using MySQL instance: hostname=%s id=%d\n", s.mysqlInstance.Hostname, s.mysqlInstance.Id))
+	t.Check(cmdTest.ReadLine(), Equals, fmt.Sprintf("MySQL root DSN: %s:<password-hidden>@unix(/var/run/mysqld/mysqld.sock)\n", s.username))
+	t.Check(cmdTest.ReadLine(), Equals, "Re-granted MySQL user: percona-agent\n")
+	t.Check(cmdTest.ReadLine(), Equals, "Re-created config: "+mmServerConfig+"\n")
+	t.Check(cmdTest.ReadLine(), Equals, "Fixed permissions of "+storeFile+": -rw-r--r-- to -rw-------\n")
+	t.Check(cmdTest.ReadLine(), Equals, "Repaired percona-agent, restart it to use the changes\n")
+	t.Check(cmdTest.ReadLine(), Equals, "") // No more data
+
+	err = cmd.Wait()
+	t.Assert(err, IsNil)
+
+	t.Check(agentsCreated, Equals, 1)
+	s.expectDefaultAgentConfig(t)
+	s.expectDefaultMmServerConfig(t)
+	s.expectMysqlUserExists(t)
+	fi, err := os.Stat(storeFile)
+	t.Assert(err, IsNil)
+	t.Check(fi.Mode().Perm(), Equals, os.FileMode(0600))
+}
+
 func (s *MainTestSuite) expectConfigs(expectedConfigs []string, t *C) {
-	gotConfigs := []string{}
-	fileinfos, err := ioutil.ReadDir(pct.Basedir.Dir("config"))
+	gotConfigs, err := pct.Basedir.ConfigNames("*")
 	t.Check(err, IsNil)
-	for _, fileinfo := range fileinfos {
-		gotConfigs = append(gotConfigs, fileinfo.Name())
-	}
 	t.Check(gotConfigs, DeepEquals, expectedConfigs)
 }
 
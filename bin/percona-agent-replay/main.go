@@ -0,0 +1,207 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+// percona-agent-replay plays the API side of a recording (percona-agent
+// -record) to an agent: it sends the recorded cmds and data responses, with
+// the recorded timing, and records what the agent sends back.  Set the agent
+// ApiHostname to the replay address, e.g. localhost:8000, and diff the new
+// recording against the original to reproduce a bug.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"code.google.com/p/go.net/websocket"
+	"github.com/percona/cloud-protocol/proto/v1"
+	"github.com/percona/percona-agent/client"
+)
+
+var (
+	flagAddr  string
+	flagOut   string
+	flagSpeed float64
+)
+
+func init() {
+	flag.StringVar(&flagAddr, "addr", "localhost:8000", "Address to listen on, the agent ApiHostname")
+	flag.StringVar(&flagOut, "out", "", "Record what the agent sends to this file")
+	flag.Float64Var(&flagSpeed, "speed", 1, "Replay speed, e.g. 2 is twice as fast, 0 is no waiting")
+}
+
+type replay struct {
+	frames   map[string][]client.Frame // recorded frames from API, keyed on link
+	recorder *client.Recorder
+	mux      *sync.Mutex // guard frames
+}
+
+func main() {
+	flag.Parse()
+	if flag.NArg() != 1 {
+		fmt.Println("Usage: percona-agent-replay [options] <recording>")
+		flag.PrintDefaults()
+		os.Exit(1)
+	}
+	recording, err := client.ReadRecording(flag.Arg(0))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	r := &replay{
+		frames: map[string][]client.Frame{},
+		mux:    &sync.Mutex{},
+	}
+	for _, f := range recording {
+		if f.Dir == client.RECORD_RECV {
+			r.frames[f.Link] = append(r.frames[f.Link], f)
+		}
+	}
+	log.Printf("%d frames, %d cmds, %d data responses\n", len(recording), len(r.frames["cmd"]), len(r.frames["data"]))
+
+	if flagOut != "" {
+		if r.recorder, err = client.NewRecorder(flagOut); err != nil {
+			log.Fatal(err)
+		}
+		defer r.recorder.Close()
+	}
+
+	// Just enough of the API for the agent to connect: entry links, agent
+	// links, and the cmd, log, and data websockets.
+	base := "http://" + flagAddr
+	http.HandleFunc("/ping", func(w http.ResponseWriter, req *http.Request) {})
+	http.HandleFunc("/", func(w http.ResponseWriter, req *http.Request) {
+		writeLinks(w, map[string]string{
+			"agents":    base + "/agents",
+			"instances": base + "/instances",
+			"download":  base + "/download",
+		})
+	})
+	http.HandleFunc("/agents/", func(w http.ResponseWriter, req *http.Request) {
+		uuid := strings.Trim(strings.TrimPrefix(req.URL.Path, "/agents/"), "/")
+		if strings.Contains(uuid, "/") {
+			http.NotFound(w, req)
+			return
+		}
+		ws := "ws://" + flagAddr + "/ws/" + uuid
+		writeLinks(w, map[string]string{
+			"self": base + "/agents/" + uuid,
+			"cmd":  ws + "/cmd",
+			"log":  ws + "/log",
+			"data": ws + "/data",
+		})
+	})
+	http.Handle("/ws/", websocket.Handler(r.handle))
+
+	log.Println("Listening on " + flagAddr)
+	log.Fatal(http.ListenAndServe(flagAddr, nil))
+}
+
+func writeLinks(w http.ResponseWriter, links map[string]string) {
+	data, _ := json.Marshal(proto.Links{Links: links})
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
+
+func (r *replay) handle(ws *websocket.Conn) {
+	path := ws.Request().URL.Path
+	link := path[strings.LastIndex(path, "/")+1:]
+	log.Println("Connect " + link)
+	defer log.Println("Disconnect " + link)
+
+	switch link {
+	case "cmd":
+		// Send cmds with the recorded timing while receiving replies.
+		go r.send(ws, link)
+		r.recv(ws, link, false)
+	case "data":
+		// Respond to each data frame with the next recorded response.
+		r.recv(ws, link, true)
+	default:
+		r.recv(ws, link, false)
+	}
+}
+
+// next returns the next recorded frame from the API on link.  Frames are not
+// replayed twice if the agent reconnects.
+func (r *replay) next(link string) (client.Frame, bool) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	if len(r.frames[link]) == 0 {
+		return client.Frame{}, false
+	}
+	f := r.frames[link][0]
+	r.frames[link] = r.frames[link][1:]
+	return f, true
+}
+
+func (r *replay) send(ws *websocket.Conn, link string) {
+	var last time.Time
+	for {
+		f, ok := r.next(link)
+		if !ok {
+			log.Println("Replayed all " + link + " frames")
+			return
+		}
+		if !last.IsZero() && flagSpeed > 0 {
+			time.Sleep(time.Duration(float64(f.Ts.Sub(last)) / flagSpeed))
+		}
+		last = f.Ts
+		log.Printf("%s: %s\n", link, f.Json)
+		if err := websocket.Message.Send(ws, string(f.Json)); err != nil {
+			log.Println(err)
+			return
+		}
+	}
+}
+
+func (r *replay) recv(ws *websocket.Conn, link string, respond bool) {
+	for {
+		var data []byte
+		if err := websocket.Message.Receive(ws, &data); err != nil {
+			return
+		}
+		if r.recorder != nil {
+			var v interface{}
+			if err := json.Unmarshal(data, &v); err == nil {
+				raw := json.RawMessage(data)
+				r.recorder.Record(link, client.RECORD_SEND, &raw)
+			} else {
+				r.recorder.RecordBytes(link, client.RECORD_SEND, data)
+			}
+		}
+		if link == "cmd" {
+			log.Printf("%s reply: %s\n", link, data)
+		}
+		if !respond {
+			continue
+		}
+		resp := []byte(`{"Code":200}`) // if the recording has fewer responses
+		if f, ok := r.next(link); ok {
+			resp = f.Json
+		}
+		if err := websocket.Message.Send(ws, string(resp)); err != nil {
+			return
+		}
+	}
+}
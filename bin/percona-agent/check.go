@@ -0,0 +1,188 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/percona/cloud-protocol/proto/v1"
+	"github.com/percona/percona-agent/pct"
+)
+
+// Nagios plugin exit codes, also used by Sensu.
+const (
+	CHECK_OK       = 0
+	CHECK_WARNING  = 1
+	CHECK_CRITICAL = 2
+	CHECK_UNKNOWN  = 3
+)
+
+var checkStateName = []string{"OK", "WARNING", "CRITICAL", "UNKNOWN"}
+
+const checkUsage = `Usage: percona-agent [-basedir dir] check [-warn metric=n] [-crit metric=n]
+
+Check the agent running on this host like a Nagios or Sensu check: print one
+status line and exit 0 (OK), 1 (WARNING), 2 (CRITICAL), or 3 (UNKNOWN).
+
+CRITICAL if the agent is not running or a service crashed, WARNING if it's
+disconnected from the API.  -warn and -crit, which can be repeated, check that
+agent metrics like cmd/queue or ws/reconnects are below the thresholds.
+`
+
+// A checkThreshold is a -warn or -crit metric=n.
+type checkThreshold struct {
+	metric string
+	value  float64
+}
+
+type checkThresholds []checkThreshold
+
+func (t *checkThresholds) String() string {
+	s := make([]string, len(*t))
+	for i, th := range *t {
+		s[i] = fmt.Sprintf("%s=%g", th.metric, th.value)
+	}
+	return strings.Join(s, ",")
+}
+
+func (t *checkThresholds) Set(arg string) error {
+	p := strings.SplitN(arg, "=", 2)
+	if len(p) != 2 || p[0] == "" {
+		return errors.New("expected metric=n")
+	}
+	value, err := strconv.ParseFloat(p[1], 64)
+	if err != nil {
+		return err
+	}
+	*t = append(*t, checkThreshold{metric: p[0], value: value})
+	return nil
+}
+
+// check runs "percona-agent check" and returns the exit code.  args are the
+// args after "check".
+func check(args []string) int {
+	var warn, crit checkThresholds
+	flags := flag.NewFlagSet("check", flag.ContinueOnError)
+	flags.Usage = func() { fmt.Fprint(os.Stderr, checkUsage) }
+	flags.Var(&warn, "warn", "WARNING if metric >= n")
+	flags.Var(&crit, "crit", "CRITICAL if metric >= n")
+	if err := flags.Parse(args); err != nil {
+		return CHECK_UNKNOWN
+	}
+
+	socket := pct.Basedir.File("ctl-socket")
+	status := map[string]string{}
+	metrics := map[string]pct.Metric{}
+	err := ctlCmd(socket, &proto.Cmd{Cmd: "Status"}, &status)
+	if err == nil && len(warn)+len(crit) > 0 {
+		err = ctlCmd(socket, &proto.Cmd{Service: "agent", Cmd: "GetMetrics"}, &metrics)
+	}
+	if err != nil {
+		fmt.Println("PERCONA-AGENT CRITICAL - " + err.Error())
+		return CHECK_CRITICAL
+	}
+
+	state, msg := checkHealth(status, metrics, warn, crit)
+	fmt.Printf("PERCONA-AGENT %s - %s\n", checkStateName[state], msg)
+	return state
+}
+
+// checkHealth returns the check state and message (with Nagios perfdata for
+// the threshold metrics) for the agent status and metrics.
+func checkHealth(status map[string]string, metrics map[string]pct.Metric, warn, crit []checkThreshold) (int, string) {
+	keys := make([]string, 0, len(status))
+	for key := range status {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	// CRITICAL is worse than UNKNOWN.
+	severity := map[int]int{CHECK_OK: 0, CHECK_WARNING: 1, CHECK_UNKNOWN: 2, CHECK_CRITICAL: 3}
+	state := CHECK_OK
+	problems := []string{}
+	raise := func(s int, problem string) {
+		if severity[s] > severity[state] {
+			state = s
+		}
+		problems = append(problems, problem)
+	}
+
+	crashed := []string{}
+	disconnected := []string{}
+	for _, key := range keys {
+		switch {
+		case strings.HasPrefix(status[key], "Crashed"):
+			crashed = append(crashed, key)
+		case strings.HasSuffix(key, "-ws") && status[key] == "Disconnected":
+			disconnected = append(disconnected, key)
+		}
+	}
+	if len(crashed) > 0 {
+		raise(CHECK_CRITICAL, "crashed: "+strings.Join(crashed, ", "))
+	}
+	if len(disconnected) > 0 {
+		raise(CHECK_WARNING, "disconnected: "+strings.Join(disconnected, ", "))
+	}
+
+	// Perfdata is metric=value;warn;crit for each metric with a threshold.
+	perfMetrics := []string{}
+	perfThresholds := map[string][]string{}
+	for _, c := range []struct {
+		state      int
+		i          int // warn or crit in perfdata
+		thresholds []checkThreshold
+	}{
+		{CHECK_CRITICAL, 1, crit},
+		{CHECK_WARNING, 0, warn},
+	} {
+		for _, t := range c.thresholds {
+			m, ok := metrics[t.metric]
+			if !ok {
+				raise(CHECK_UNKNOWN, "no metric "+t.metric)
+				continue
+			}
+			if _, ok := perfThresholds[t.metric]; !ok {
+				perfMetrics = append(perfMetrics, t.metric)
+				perfThresholds[t.metric] = []string{"", ""}
+			}
+			perfThresholds[t.metric][c.i] = fmt.Sprintf("%g", t.value)
+			if m.Number >= t.value {
+				raise(c.state, fmt.Sprintf("%s %g >= %g", t.metric, m.Number, t.value))
+			}
+		}
+	}
+	perfdata := make([]string, len(perfMetrics))
+	for i, metric := range perfMetrics {
+		perfdata[i] = fmt.Sprintf("%s=%g;%s", metric, metrics[metric].Number, strings.Join(perfThresholds[metric], ";"))
+	}
+
+	msg := "agent running"
+	if len(problems) > 0 {
+		msg = strings.Join(problems, "; ")
+	}
+	if len(perfdata) > 0 {
+		msg += " | " + strings.Join(perfdata, " ")
+	}
+	return state, msg
+}
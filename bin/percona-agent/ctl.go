@@ -0,0 +1,335 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/percona/cloud-protocol/proto/v1"
+	"github.com/percona/percona-agent/agent"
+	"github.com/percona/percona-agent/history"
+	"github.com/percona/percona-agent/log"
+	"github.com/percona/percona-agent/pct"
+)
+
+const ctlUsage = `Usage: percona-agent [-basedir dir] ctl <command> [args]
+
+Control the agent running on this host via its UNIX socket in the basedir.
+
+Commands:
+  status [service]         Print agent and service status
+  status-history [service] Print the last status changes, e.g. to find a flapping connection
+  start-service <service>  Start a service
+  stop-service <service>   Stop a service
+  get-config [service]     Print agent and service configs
+  log-level <level>        Set the log level: debug, info, warning, error, etc.
+  reload                   Reload configs changed by hand, like SIGHUP
+  pause                    Stop collecting and sending data, e.g. during maintenance
+  resume                   Start collecting and sending data again
+  offline                  Stop connecting to the API; keep collecting and spooling data
+  online                   Connect to the API again and send spooled data
+  drain                    Send spooled data now, even if offline
+  audit-log [n]            Print the last n (default 100) cmds handled by the agent
+  rollback                 Restore the binary before the last update; restart to run it
+  debug [on [addr]|off]    Start or stop serving pprof and runtime stats, e.g. to find leaks
+  history <metric> [hours] Print the local history (default 24h) of metrics matching a pattern, e.g. mysql/threads_*
+`
+
+// ctl runs "percona-agent ctl": it sends the same proto.Cmd as the API
+// to the local agent.  args are the args after "ctl".
+func ctl(args []string) error {
+	if len(args) == 0 {
+		fmt.Fprint(os.Stderr, ctlUsage)
+		return errors.New("No ctl command")
+	}
+	socket := pct.Basedir.File("ctl-socket")
+
+	switch args[0] {
+	case "status":
+		cmd := &proto.Cmd{Cmd: "Status"}
+		if len(args) > 1 {
+			cmd.Service = args[1]
+		}
+		status := map[string]string{}
+		if err := ctlCmd(socket, cmd, &status); err != nil {
+			return err
+		}
+		keys := make([]string, 0, len(status))
+		for k := range status {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			fmt.Printf("%-24s %s\n", k, status[k])
+		}
+	case "status-history":
+		cmd := &proto.Cmd{Cmd: "StatusHistory"}
+		if len(args) > 1 {
+			cmd.Service = args[1]
+		}
+		history := map[string][]pct.StatusEntry{}
+		if err := ctlCmd(socket, cmd, &history); err != nil {
+			return err
+		}
+		keys := make([]string, 0, len(history))
+		for k := range history {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			for _, e := range history[k] {
+				fmt.Printf("%-24s %s %s\n", k, pct.TimeString(e.Since), e)
+			}
+		}
+	case "start-service", "stop-service":
+		if len(args) < 2 {
+			return fmt.Errorf("Usage: percona-agent ctl %s <service>", args[0])
+		}
+		data, _ := json.Marshal(&proto.ServiceData{Name: args[1]})
+		cmd := &proto.Cmd{
+			Service: "agent",
+			Cmd:     "StartService",
+			Data:    data,
+		}
+		if args[0] == "stop-service" {
+			cmd.Cmd = "StopService"
+		}
+		if err := ctlCmd(socket, cmd, nil); err != nil {
+			return err
+		}
+		fmt.Println("OK")
+	case "get-config":
+		configs, err := ctlConfigs(socket)
+		if err != nil {
+			return err
+		}
+		if len(args) > 1 {
+			service := []proto.AgentConfig{}
+			for _, config := range configs {
+				if config.InternalService == args[1] {
+					service = append(service, config)
+				}
+			}
+			configs = service
+		}
+		bytes, err := json.MarshalIndent(configs, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(bytes))
+	case "log-level":
+		if len(args) < 2 {
+			return errors.New("Usage: percona-agent ctl log-level <level>")
+		}
+		if _, ok := proto.LogLevelNumber[args[1]]; !ok {
+			return errors.New("Invalid log level: " + args[1])
+		}
+		// SetConfig sets the whole log config, so change only the level
+		// of the current config.
+		configs, err := ctlConfigs(socket)
+		if err != nil {
+			return err
+		}
+		logConfig := &log.Config{}
+		for _, config := range configs {
+			if config.InternalService == "log" {
+				if err := json.Unmarshal([]byte(config.Config), logConfig); err != nil {
+					return err
+				}
+			}
+		}
+		logConfig.Level = args[1]
+		data, _ := json.Marshal(logConfig)
+		cmd := &proto.Cmd{
+			Service: "log",
+			Cmd:     "SetConfig",
+			Data:    data,
+		}
+		if err := ctlCmd(socket, cmd, nil); err != nil {
+			return err
+		}
+		fmt.Println("OK")
+	case "pause", "resume":
+		cmd := &proto.Cmd{
+			Service: "agent",
+			Cmd:     "Pause",
+		}
+		if args[0] == "resume" {
+			cmd.Cmd = "Resume"
+		}
+		if err := ctlCmd(socket, cmd, nil); err != nil {
+			return err
+		}
+		fmt.Println("OK")
+	case "offline", "online", "drain":
+		cmds := map[string]string{"offline": "Offline", "online": "Online", "drain": "Drain"}
+		cmd := &proto.Cmd{
+			Service: "agent",
+			Cmd:     cmds[args[0]],
+		}
+		if err := ctlCmd(socket, cmd, nil); err != nil {
+			return err
+		}
+		fmt.Println("OK")
+	case "audit-log":
+		cmd := &proto.Cmd{
+			Service: "agent",
+			Cmd:     "GetAuditLog",
+		}
+		if len(args) > 1 {
+			n, err := strconv.Atoi(args[1])
+			if err != nil {
+				return errors.New("Usage: percona-agent ctl audit-log [n]")
+			}
+			cmd.Data, _ = json.Marshal(n)
+		}
+		entries := []agent.AuditEntry{}
+		if err := ctlCmd(socket, cmd, &entries); err != nil {
+			return err
+		}
+		for _, e := range entries {
+			fmt.Printf("%s %-8s %-10s %-20s %-8s %.3fs %s\n",
+				e.Ts.Format("2006-01-02 15:04:05"), e.User, e.Service, e.Cmd, e.Outcome, e.Duration, e.Error)
+		}
+	case "rollback":
+		cmd := &proto.Cmd{
+			Service: "agent",
+			Cmd:     "Rollback",
+		}
+		var version string
+		if err := ctlCmd(socket, cmd, &version); err != nil {
+			return err
+		}
+		if version == "" {
+			version = "before the last update" // pending update was committed
+		}
+		fmt.Println("Rolled back to version", version+"; restart percona-agent to run it")
+	case "debug":
+		cmd := &proto.Cmd{
+			Service: "agent",
+			Cmd:     "Debug",
+		}
+		if len(args) > 1 {
+			debug := &agent.Debug{}
+			switch args[1] {
+			case "on":
+				debug.On = true
+				if len(args) > 2 {
+					debug.Addr = args[2]
+				}
+			case "off":
+			default:
+				return errors.New("Usage: percona-agent ctl debug [on [addr]|off]")
+			}
+			cmd.Data, _ = json.Marshal(debug)
+		}
+		debug := &agent.Debug{}
+		if err := ctlCmd(socket, cmd, debug); err != nil {
+			return err
+		}
+		if debug.On {
+			fmt.Println("Serving debug on http://" + debug.Addr + "/debug/pprof/")
+		} else {
+			fmt.Println("Debug is off")
+		}
+	case "history":
+		if len(args) < 2 {
+			return errors.New("Usage: percona-agent ctl history <metric> [hours]")
+		}
+		hours := 24
+		if len(args) > 2 {
+			n, err := strconv.Atoi(args[2])
+			if err != nil || n <= 0 {
+				return errors.New("Usage: percona-agent ctl history <metric> [hours]")
+			}
+			hours = n
+		}
+		q := &history.Query{
+			Metrics: []string{args[1]},
+			Begin:   time.Now().Add(-time.Duration(hours) * time.Hour).Unix(),
+		}
+		data, _ := json.Marshal(q)
+		cmd := &proto.Cmd{
+			Service: history.SERVICE_NAME,
+			Cmd:     "Query",
+			Data:    data,
+		}
+		series := []*history.Series{}
+		if err := ctlCmd(socket, cmd, &series); err != nil {
+			return err
+		}
+		for _, ser := range series {
+			instance := fmt.Sprintf("%s-%d", ser.Service, ser.InstanceId)
+			for _, sample := range ser.Samples {
+				fmt.Printf("%s %-12s %-40s %.2f %.2f\n",
+					time.Unix(sample.Ts, 0).Format("2006-01-02 15:04:05"), instance, ser.Metric, sample.Avg, sample.Max)
+			}
+		}
+	case "reload":
+		cmd := &proto.Cmd{
+			Service: "agent",
+			Cmd:     "Reload",
+		}
+		reloaded := []string{}
+		if err := ctlCmd(socket, cmd, &reloaded); err != nil {
+			return err
+		}
+		if len(reloaded) == 0 {
+			fmt.Println("No configs changed")
+		} else {
+			fmt.Println("Reloaded:", strings.Join(reloaded, ", "))
+		}
+	default:
+		fmt.Fprint(os.Stderr, ctlUsage)
+		return errors.New("Unknown ctl command: " + args[0])
+	}
+	return nil
+}
+
+// ctlCmd sends the cmd to the agent and decodes the reply data into data,
+// if not nil.
+func ctlCmd(socket string, cmd *proto.Cmd, data interface{}) error {
+	reply, err := agent.Ctl(socket, cmd)
+	if err != nil {
+		return fmt.Errorf("Cannot connect to agent on %s (is it running?): %s", socket, err)
+	}
+	if reply.Error != "" {
+		return errors.New(reply.Error)
+	}
+	if data != nil && len(reply.Data) > 0 {
+		return json.Unmarshal(reply.Data, data)
+	}
+	return nil
+}
+
+func ctlConfigs(socket string) ([]proto.AgentConfig, error) {
+	configs := []proto.AgentConfig{}
+	cmd := &proto.Cmd{
+		Service: "agent",
+		Cmd:     "GetAllConfigs",
+	}
+	err := ctlCmd(socket, cmd, &configs)
+	return configs, err
+}
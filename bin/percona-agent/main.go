@@ -27,41 +27,41 @@ import (
 	"os/signal"
 	"os/user"
 	"runtime"
+	"strings"
 	"syscall"
 	"time"
 
 	"github.com/percona/cloud-protocol/proto/v1"
 	"github.com/percona/percona-agent/agent"
+	"github.com/percona/percona-agent/bus"
+	"github.com/percona/percona-agent/chaos"
 	"github.com/percona/percona-agent/client"
 	"github.com/percona/percona-agent/data"
+	"github.com/percona/percona-agent/history"
 	"github.com/percona/percona-agent/instance"
 	"github.com/percona/percona-agent/log"
-	"github.com/percona/percona-agent/mm"
-	mmMonitor "github.com/percona/percona-agent/mm/monitor"
 	"github.com/percona/percona-agent/mrms"
 	mrmsMonitor "github.com/percona/percona-agent/mrms/monitor"
 	"github.com/percona/percona-agent/mysql"
 	"github.com/percona/percona-agent/pct"
 	pctCmd "github.com/percona/percona-agent/pct/cmd"
-	"github.com/percona/percona-agent/qan"
-	qanFactory "github.com/percona/percona-agent/qan/factory"
-	"github.com/percona/percona-agent/qan/perfschema"
-	"github.com/percona/percona-agent/qan/slowlog"
-	"github.com/percona/percona-agent/query"
-	"github.com/percona/percona-agent/sysconfig"
-	sysconfigMonitor "github.com/percona/percona-agent/sysconfig/monitor"
-	"github.com/percona/percona-agent/sysinfo"
-	mysqlSysinfo "github.com/percona/percona-agent/sysinfo/mysql"
-	systemSysinfo "github.com/percona/percona-agent/sysinfo/system"
+	"github.com/percona/percona-agent/registry"
+	"github.com/percona/percona-agent/snmp"
 	"github.com/percona/percona-agent/ticker"
+	"github.com/percona/percona-agent/webhook"
 )
 
 var (
-	flagPing    bool
-	flagStatus  bool
-	flagBasedir string
-	flagPidFile string
-	flagVersion bool
+	flagPing      bool
+	flagStatus    bool
+	flagBasedir   string
+	flagPidFile   string
+	flagVersion   bool
+	flagSelfCheck bool
+	flagDemo      bool
+	flagRecord    string
+	flagRelocate  bool
+	flagBackup    string
 )
 
 func init() {
@@ -70,12 +70,17 @@ func init() {
 
 	flag.BoolVar(&flagPing, "ping", false, "Ping API")
 	flag.BoolVar(&flagStatus, "status", false, "Agent status")
-	flag.StringVar(&flagBasedir, "basedir", pct.DEFAULT_BASEDIR, "Agent basedir")
+	flag.StringVar(&flagBasedir, "basedir", pct.EnvBasedir(pct.DEFAULT_BASEDIR), "Agent basedir (env "+pct.ENV_BASEDIR+")")
 	flag.StringVar(&flagPidFile, "pidfile", agent.DEFAULT_PIDFILE, "PID file")
 	flag.BoolVar(&flagVersion, "version", false, "Print version")
+	flag.BoolVar(&flagSelfCheck, "self-check", false, "Check that the agent can run and read its config, print version")
+	flag.BoolVar(&flagDemo, "demo", false, "Send synthetic QAN and metrics data without MySQL, for testing staging APIs")
+	flag.StringVar(&flagRecord, "record", "", "Record all websocket traffic to this file, for percona-agent-replay")
+	flag.BoolVar(&flagRelocate, "relocate", false, "Move configs, data, and the spool from the basedir to the dirs set by the PCT_*_DIR env vars, then exit")
+	flag.StringVar(&flagBackup, "backup-state", "", "Write a copy of the agent state store (configs, audit log, update keys, etc.) to this file, then exit")
 	flag.Parse()
-	// We don't accept any possitional arguments
-	if len(flag.Args()) != 0 {
+	// We don't accept any possitional arguments, except the ctl and check subcommands
+	if len(flag.Args()) != 0 && flag.Arg(0) != "ctl" && flag.Arg(0) != "check" {
 		flag.Usage()
 		os.Exit(1)
 	}
@@ -92,6 +97,76 @@ func run() error {
 		fmt.Println(version)
 		return nil
 	}
+
+	// Run by pct.Updater on a new binary before replacing the running one.
+	if flagSelfCheck {
+		if err := pct.Basedir.Init(flagBasedir); err != nil {
+			return err
+		}
+		if _, err := agent.LoadConfig(); err != nil {
+			return fmt.Errorf("Invalid agent config: %s", err)
+		}
+		fmt.Println(version)
+		return nil
+	}
+
+	// Move the default layout to the env layout.  The agent must be stopped.
+	if flagRelocate {
+		if err := pct.Basedir.InitLayout(flagBasedir, pct.BasedirLayout{}); err != nil {
+			return err
+		}
+		if err := pct.Basedir.Relocate(pct.EnvLayout()); err != nil {
+			return fmt.Errorf("Error relocating basedir %s: %s", flagBasedir, err)
+		}
+		layout := pct.Basedir.Layout()
+		fmt.Printf("Relocated: config %s, data %s, log %s, bin %s, spool %s\n",
+			layout.ConfigDir, layout.DataDir, layout.LogDir, layout.BinDir, layout.SpoolDir)
+		return nil
+	}
+
+	// Back up the state store.  The agent can be running: the store is locked
+	// only during transactions, so the backup is consistent.
+	if flagBackup != "" {
+		if err := pct.Basedir.Init(flagBasedir); err != nil {
+			return err
+		}
+		store, err := pct.Basedir.Store()
+		if err != nil {
+			return err
+		}
+		defer pct.Basedir.CloseStore()
+		file, err := os.OpenFile(flagBackup, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		if _, err := store.Backup(file); err != nil {
+			return fmt.Errorf("Error backing up %s: %s", pct.Basedir.File("store"), err)
+		}
+		if err := file.Sync(); err != nil {
+			return err
+		}
+		fmt.Printf("Backed up %s to %s\n", pct.Basedir.File("store"), flagBackup)
+		return nil
+	}
+
+	// percona-agent ctl <command>: control the running agent and exit.
+	if flag.Arg(0) == "ctl" {
+		if err := pct.Basedir.Init(flagBasedir); err != nil {
+			return err
+		}
+		return ctl(flag.Args()[1:])
+	}
+
+	// percona-agent check: Nagios/Sensu check of the running agent.
+	if flag.Arg(0) == "check" {
+		if err := pct.Basedir.Init(flagBasedir); err != nil {
+			fmt.Println("PERCONA-AGENT UNKNOWN - " + err.Error())
+			os.Exit(CHECK_UNKNOWN)
+		}
+		os.Exit(check(flag.Args()[1:]))
+	}
+
 	golog.Printf("Running %s pid %d\n", version, os.Getpid())
 
 	if err := pct.Basedir.Init(flagBasedir); err != nil {
@@ -111,8 +186,8 @@ func run() error {
 	 * Agent config (require API key and agent UUID)
 	 */
 
-	if !pct.FileExists(pct.Basedir.ConfigFile("agent")) {
-		return fmt.Errorf("Agent config file %s does not exist", pct.Basedir.ConfigFile("agent"))
+	if !pct.Basedir.ConfigExists("agent") {
+		return fmt.Errorf("Agent config does not exist in %s", pct.Basedir.Path())
 	}
 
 	bytes, err := agent.LoadConfig()
@@ -121,11 +196,31 @@ func run() error {
 	}
 	agentConfig := &agent.Config{}
 	if err := json.Unmarshal(bytes, agentConfig); err != nil {
-		return fmt.Errorf("Error parsing "+pct.Basedir.ConfigFile("agent")+": ", err)
+		return fmt.Errorf("Error parsing agent config: %s", err)
 	}
 
 	golog.Println("ApiHostname: " + agentConfig.ApiHostname)
 	golog.Println("AgentUuid: " + agentConfig.AgentUuid)
+	golog.Println("HostFingerprint: " + pct.HostFingerprint())
+
+	// Status shows UTC times, and optionally local times too.
+	pct.SetLocalTime(agentConfig.StatusTime == "local")
+	if agentConfig.Anonymize {
+		golog.Println("Anonymizing schema, table, and user names")
+	}
+	if err := pct.SetAnonymize(agentConfig.Anonymize); err != nil {
+		golog.Fatal(err)
+	}
+	if err := pct.Basedir.SeparateCredentials(agentConfig.SeparateCredentials); err != nil {
+		golog.Fatal(err)
+	}
+	pct.SetAPIOptions(agentConfig.APIOptions())
+	if len(agentConfig.ExcludeData) > 0 {
+		golog.Println("Excluding data: " + strings.Join(agentConfig.ExcludeData, ", "))
+	}
+	if err := pct.SetExcludeData(agentConfig.ExcludeData); err != nil {
+		golog.Fatal(err)
+	}
 
 	/**
 	 * Ping and exit, maybe.
@@ -134,19 +229,44 @@ func run() error {
 	// Set for all connections to API.  X-Percona-API-Key is set automatically
 	// using the pct.APIConnector.
 	headers := map[string]string{
-		"X-Percona-Agent-Version": agent.VERSION,
+		"X-Percona-Agent-Version":    agent.VERSION,
+		"X-Percona-Host-Fingerprint": pct.HostFingerprint(),
 	}
 
 	if flagPing {
-		t0 := time.Now()
-		code, err := pct.Ping(agentConfig.ApiHostname, agentConfig.ApiKey, headers)
-		d := time.Now().Sub(t0)
-		if err != nil || code != 200 {
-			return fmt.Errorf("Ping FAIL (%d %d %s)", d, code, err)
-		} else {
-			golog.Printf("Ping OK (%s)", d)
-			return nil
+		// Ping every API host; OK if any responds.
+		var pingErr error
+		ok := false
+		apiKey := agentConfig.ApiKey
+		if agentConfig.ApiAuth != nil {
+			api, err := newAPI(agentConfig)
+			if err != nil {
+				golog.Fatal(err)
+			}
+			apiKey = api.ApiKey()
+		}
+		for _, host := range pct.ApiHostnames(agentConfig.ApiHostname) {
+			t0 := time.Now()
+			code, err := pct.Ping(host, apiKey, headers)
+			d := time.Now().Sub(t0)
+			if err != nil || code != 200 {
+				pingErr = fmt.Errorf("Ping FAIL (%d %d %s)", d, code, err)
+				golog.Printf("Ping %s FAIL (%d %d %s)", host, d, code, err)
+			} else {
+				ok = true
+				golog.Printf("Ping %s OK (%s)", host, d)
+			}
+		}
+		if !ok {
+			return pingErr
 		}
+		return nil
+	}
+
+	// Cloud metadata is attached to reports.  Outside a cloud, this waits
+	// at most the timeout.
+	if cloud := pct.DetectCloud(2 * time.Second); cloud != nil {
+		golog.Printf("Cloud: %s %s %s %s", cloud.Provider, cloud.InstanceId, cloud.InstanceType, cloud.Zone)
 	}
 
 	/**
@@ -173,19 +293,34 @@ func run() error {
 	if flagStatus {
 		retry = 1
 	}
-	api, err := ConnectAPI(agentConfig, retry)
-	if err != nil {
-		golog.Fatal(err)
+	var api *pct.API
+	if agentConfig.Offline && !flagStatus {
+		// Offline mode: don't connect to API until the Online or Drain cmd.
+		golog.Println("Offline: not connecting to API")
+		if err := pct.SetProxy(agentConfig.Proxy); err != nil {
+			golog.Fatal(err)
+		}
+		if err := pct.SetTLS(agentConfig.ApiCA, agentConfig.ApiCert, agentConfig.ApiCertKey, agentConfig.ApiPins); err != nil {
+			golog.Fatal(err)
+		}
+		api, err = newAPI(agentConfig)
+		if err != nil {
+			golog.Fatal(err)
+		}
+	} else {
+		api, err = ConnectAPI(agentConfig, retry)
+		if err != nil {
+			golog.Fatal(err)
+		}
 	}
 
 	// Get agent status via API and exit.
 	if flagStatus {
-		code, bytes, err := api.Get(agentConfig.ApiKey, api.AgentLink("self")+"/status")
-		if err != nil {
-			return err
-		}
-		if code == 404 {
+		_, bytes, err := api.Get(agentConfig.ApiKey, api.AgentLink("self")+"/status")
+		if apiErr, ok := err.(pct.APIError); ok && apiErr.Code == 404 {
 			return fmt.Errorf("Agent not found")
+		} else if err != nil {
+			return err
 		}
 		status := make(map[string]string)
 		if err := json.Unmarshal(bytes, &status); err != nil {
@@ -206,8 +341,33 @@ func run() error {
 
 	logChan := make(chan *proto.LogEntry, log.BUFFER_SIZE*3)
 
+	// Record websocket traffic, maybe.
+	var recorder *client.Recorder
+	if flagRecord != "" {
+		recorder, err = client.NewRecorder(flagRecord)
+		if err != nil {
+			return fmt.Errorf("Error opening -record file: %s\n", err)
+		}
+		defer recorder.Close()
+		golog.Println("Recording websocket traffic to " + flagRecord)
+	}
+
+	// One websocket for cmd, log, and data if the API has the mux link, else
+	// one websocket each.
+	var wsMux *client.Mux
+	if api.AgentLink(client.MUX_LINK) != "" {
+		wsMux, err = client.NewMux(pct.NewLogger(logChan, "mux-ws"), api, headers)
+		if err != nil {
+			golog.Fatalln(err)
+		}
+		if recorder != nil {
+			wsMux.SetRecorder(recorder)
+		}
+		golog.Println("Multiplexing cmd, log, and data over one websocket")
+	}
+
 	// Log websocket client, possibly disabled later.
-	logClient, err := client.NewWebsocketClient(pct.NewLogger(logChan, "log-ws"), api, "log", headers)
+	logClient, err := newWebsocketClient(pct.NewLogger(logChan, "log-ws"), api, "log", headers, wsMux, recorder)
 	if err != nil {
 		golog.Fatalln(err)
 	}
@@ -219,12 +379,18 @@ func run() error {
 		return fmt.Errorf("Error starting logmanager: %s\n", err)
 	}
 
+	/**
+	 * Event bus between services
+	 */
+	eventBus := bus.New()
+
 	/**
 	 * MRMS (MySQL Restart Monitoring Service)
 	 */
 	mrm := mrmsMonitor.NewMonitor(
 		pct.NewLogger(logChan, "mrms-monitor"),
 		connFactory,
+		eventBus,
 	)
 	mrmsManager := mrms.NewManager(
 		pct.NewLogger(logChan, "mrms-manager"),
@@ -242,7 +408,15 @@ func run() error {
 		pct.Basedir.Dir("config"),
 		api,
 		mrm,
+		eventBus,
 	)
+	vaultConfig := pct.VaultConfig{}
+	if agentConfig.Vault != nil {
+		vaultConfig = *agentConfig.Vault
+	}
+	vaultCreds := instance.NewVaultCreds(pct.NewLogger(logChan, "instance-vault"), pct.NewVault(vaultConfig), eventBus)
+	itManager.Repo().SetVaultCreds(vaultCreds)
+	go vaultCreds.Run(nil)
 	if err := itManager.Start(); err != nil {
 		return fmt.Errorf("Error starting instance manager: %s\n", err)
 	}
@@ -253,120 +427,102 @@ func run() error {
 
 	hostname, _ := os.Hostname()
 
-	dataClient, err := client.NewWebsocketClient(pct.NewLogger(logChan, "data-ws"), api, "data", headers)
+	dataClient, err := newWebsocketClient(pct.NewLogger(logChan, "data-ws"), api, "data", headers, wsMux, recorder)
 	if err != nil {
 		golog.Fatalln(err)
 	}
 	dataManager := data.NewManager(
 		pct.NewLogger(logChan, "data"),
-		pct.Basedir.Dir("data"),
+		pct.Basedir.Dir("spool"),
 		pct.Basedir.Dir("trash"),
 		hostname,
 		dataClient,
 	)
-	if err := dataManager.Start(); err != nil {
-		return fmt.Errorf("Error starting data manager: %s\n", err)
+	if agentConfig.Secondary != nil {
+		// Data only: cmds and logs are primary API only.
+		secondaryAPI := pct.NewAPI()
+		secondaryAPI.SignRequests(agentConfig.SignRequests)
+		go connectSecondaryAPI(secondaryAPI, agentConfig.Secondary, pct.NewLogger(logChan, "secondary-api"))
+		secondaryClient, err := client.NewWebsocketClient(pct.NewLogger(logChan, "secondary-data-ws"), secondaryAPI, "data", headers)
+		if err != nil {
+			golog.Fatalln(err)
+		}
+		dataManager.SetSecondary(secondaryClient)
 	}
-
-	/**
-	 * Collecct/report ticker (master clock)
-	 */
-
-	nowFunc := func() int64 { return time.Now().UTC().UnixNano() }
-	clock := ticker.NewClock(&ticker.RealTickerFactory{}, nowFunc)
-
-	/**
-	 * Metric and system config monitors
-	 */
-
-	mmManager := mm.NewManager(
-		pct.NewLogger(logChan, "mm"),
-		mmMonitor.NewFactory(logChan, itManager.Repo(), mrm),
-		clock,
-		dataManager.Spooler(),
-		itManager.Repo(),
-		mrm,
+	// Local history of mm metrics, recorded as they're spooled.
+	historyManager := history.NewManager(
+		pct.NewLogger(logChan, "history"),
+		pct.Basedir.File("history"),
 	)
-	if err := mmManager.Start(); err != nil {
-		return fmt.Errorf("Error starting mm manager: %s\n", err)
+	dataManager.SetRecorder(historyManager)
+	if err := dataManager.Start(); err != nil {
+		return fmt.Errorf("Error starting data manager: %s\n", err)
 	}
-
-	sysconfigManager := sysconfig.NewManager(
-		pct.NewLogger(logChan, "sysconfig"),
-		sysconfigMonitor.NewFactory(logChan, itManager.Repo()),
-		clock,
-		dataManager.Spooler(),
-		itManager.Repo(),
-	)
-	if err := sysconfigManager.Start(); err != nil {
-		return fmt.Errorf("Error starting sysconfig manager: %s\n", err)
+	if err := historyManager.Start(); err != nil {
+		return fmt.Errorf("Error starting history manager: %s\n", err)
 	}
+	chaos.SetSpool(dataManager.Spooler())
 
 	/**
-	 * Query service (real-time EXPLAIN, SHOW CREATE TABLE, etc.)
+	 * Webhooks and SNMP traps for local events
 	 */
-
-	queryManager := query.NewManager(
-		pct.NewLogger(logChan, "query"),
-		itManager.Repo(),
-		&mysql.RealConnectionFactory{},
-	)
-	if err := queryManager.Start(); err != nil {
-		return fmt.Errorf("Error starting query manager: %s\n", err)
+	for _, webhookConfig := range agentConfig.Webhooks {
+		sink, err := webhook.NewSink(pct.NewLogger(logChan, "webhook"), webhookConfig, hostname, agentConfig.AgentUuid)
+		if err != nil {
+			return err // validated by LoadConfig
+		}
+		go sink.Run(eventBus, nil)
+	}
+	for _, snmpConfig := range agentConfig.SnmpTraps {
+		sender, err := snmp.NewSender(pct.NewLogger(logChan, "snmp"), snmpConfig, hostname, agentConfig.AgentUuid)
+		if err != nil {
+			return err // validated by LoadConfig
+		}
+		go sender.Run(eventBus, nil)
 	}
 
 	/**
-	 * Query Analytics
+	 * Collecct/report ticker (master clock)
 	 */
 
-	qanManager := qan.NewManager(
-		pct.NewLogger(logChan, "qan"),
-		clock,
-		itManager.Repo(),
-		mrm,
-		connFactory,
-		qanFactory.NewRealAnalyzerFactory(
-			logChan,
-			qanFactory.NewRealIntervalIterFactory(logChan),
-			slowlog.NewRealWorkerFactory(logChan),
-			perfschema.NewRealWorkerFactory(logChan),
-			dataManager.Spooler(),
-			clock,
-		),
-	)
-
-	if err := qanManager.Start(); err != nil {
-		return fmt.Errorf("Error starting qan manager: %s\n", err)
-	}
+	nowFunc := func() int64 { return time.Now().UTC().UnixNano() }
+	clock := ticker.NewClock(&ticker.RealTickerFactory{}, nowFunc)
 
 	/**
-	 * Sysinfo
+	 * Registered services: built-in, see services.go, and compiled-in
+	 * third-party services, see the registry package.
 	 */
-	sysinfoManager := sysinfo.NewManager(
-		pct.NewLogger(logChan, "sysinfo"),
-	)
-
-	// MySQL Sysinfo
-	mysqlSysinfoService := mysqlSysinfo.NewMySQL(
-		pct.NewLogger(logChan, "sysinfo-mysql"),
-		itManager.Repo(),
-	)
-	if err := sysinfoManager.RegisterService("MySQLSummary", mysqlSysinfoService); err != nil {
-		return fmt.Errorf("Error registering Mysql Sysinfo service: %s\n", err)
-	}
 
-	// System Sysinfo
-	systemSysinfoService := systemSysinfo.NewSystem(
-		pct.NewLogger(logChan, "sysinfo-system"),
-	)
-	if err := sysinfoManager.RegisterService("SystemSummary", systemSysinfoService); err != nil {
-		return fmt.Errorf("Error registering System Sysinfo service: %s\n", err)
+	services := map[string]pct.ServiceManager{
+		"log":      logManager,
+		"data":     dataManager,
+		"instance": itManager,
+		"mrms":     mrmsManager,
+		"history":  historyManager,
+	}
+	deps := registry.Deps{
+		LogChan:      logChan,
+		API:          api,
+		Clock:        clock,
+		Spool:        dataManager.Spooler(),
+		InstanceRepo: itManager.Repo(),
+		MRMS:         mrm,
+		ConnFactory:  connFactory,
+		Bus:          eventBus,
+		Demo:         flagDemo,
+	}
+	if flagDemo {
+		golog.Println("Demo mode: qan and mm send synthetic data")
+	}
+	registered, err := registry.Start(deps, services)
+	if err != nil {
+		return err
 	}
-
-	// Start Sysinfo manager
-	if err := sysinfoManager.Start(); err != nil {
-		return fmt.Errorf("Error starting Sysinfo manager: %s\n", err)
+	for name, m := range registered {
+		services[name] = m
 	}
+	agent.PAUSE_SERVICES = pauseServices()
+	qanManager := services["qan"]
 
 	/**
 	 * Signal handler
@@ -388,24 +544,30 @@ func run() error {
 	 * Agent
 	 */
 
-	cmdClient, err := client.NewWebsocketClient(pct.NewLogger(logChan, "agent-ws"), api, "cmd", headers)
-	if err != nil {
-		golog.Fatal(err)
+	// Cmd websocket client, or HTTPS long-poll if the websocket cannot be
+	// established, e.g. a proxy rejects Upgrade.  There's no long-poll for the
+	// mux: an API with the mux link must allow websockets.
+	var cmdClient pct.WebsocketClient
+	if wsMux != nil {
+		cmdClient = wsMux.Stream("cmd", pct.NewLogger(logChan, "agent-ws"))
+	} else {
+		cmdWsClient, err := client.NewWebsocketClient(pct.NewLogger(logChan, "agent-ws"), api, "cmd", headers)
+		if err != nil {
+			golog.Fatal(err)
+		}
+		if recorder != nil {
+			cmdWsClient.SetRecorder(recorder) // not the long-poll fallback
+		}
+		cmdPollClient := client.NewPollClient(pct.NewLogger(logChan, "agent-poll"), api, "cmd")
+		cmdClient = client.NewFallbackClient(pct.NewLogger(logChan, "agent-client"), cmdWsClient, cmdPollClient)
 	}
 
-	// The official list of services known to the agent.  Adding a new service
-	// requires a manager, starting the manager as above, and adding the manager
-	// to this map.
-	services := map[string]pct.ServiceManager{
-		"log":       logManager,
-		"data":      dataManager,
-		"qan":       qanManager,
-		"mm":        mmManager,
-		"instance":  itManager,
-		"mrms":      mrmsManager,
-		"sysconfig": sysconfigManager,
-		"query":     queryManager,
-		"sysinfo":   sysinfoManager,
+	// Fault injection hooks, only in chaos builds.
+	if chaos.Enabled {
+		golog.Println("WARNING: chaos build, faults can be injected via the status listener")
+		chaos.AddWebsocket("cmd", cmdClient.Disconnect)
+		chaos.AddWebsocket("log", logClient.Disconnect)
+		chaos.AddWebsocket("data", dataClient.Disconnect)
 	}
 
 	// Set the global pct/cmd.Factory, used for the Restart cmd.
@@ -419,6 +581,8 @@ func run() error {
 		api,
 		cmdClient,
 		services,
+		dataManager.Spooler(),
+		eventBus,
 	)
 
 	/**
@@ -442,8 +606,8 @@ func run() error {
 	agentRunning := true
 	statusSigChan := make(chan os.Signal, 1)
 	signal.Notify(statusSigChan, syscall.SIGUSR1) // kill -USER1 PID
-	reconnectSigChan := make(chan os.Signal, 1)
-	signal.Notify(reconnectSigChan, syscall.SIGHUP) // kill -HUP PID
+	reloadSigChan := make(chan os.Signal, 1)
+	signal.Notify(reloadSigChan, syscall.SIGHUP) // kill -HUP PID
 	for agentRunning {
 		select {
 		case stopErr = <-stopChan: // agent or signal
@@ -453,29 +617,72 @@ func run() error {
 		case <-statusSigChan:
 			status := agent.AllStatus()
 			golog.Printf("Status: %+v\n", status)
-		case <-reconnectSigChan:
+		case <-reloadSigChan:
+			// Reload configs changed by hand.  Reload is serialized with
+			// other cmds, so don't block signal handling while it waits.
 			u, _ := user.Current()
 			cmd := &proto.Cmd{
 				Ts:        time.Now().UTC(),
 				User:      u.Username + " (SIGHUP)",
 				AgentUuid: agentConfig.AgentUuid,
 				Service:   "agent",
-				Cmd:       "Reconnect",
+				Cmd:       "Reload",
 			}
-			agent.Handle(cmd)
+			go func() {
+				reply := agent.HandleLocal(cmd)
+				if reply.Error != "" {
+					golog.Printf("Reload failed: %s\n", reply.Error)
+				} else {
+					golog.Printf("Reloaded: %s\n", string(reply.Data))
+				}
+			}()
 		}
 	}
 
 	qanManager.Stop()           // see Signal handler ^
 	time.Sleep(2 * time.Second) // wait for final replies and log entries
+	if stopErr == nil && agent.RestartByInit() {
+		return errRestartByInit
+	}
 	return stopErr
 }
 
+// newWebsocketClient returns the client for the link: a stream of the mux, if
+// any, else its own websocket.
+func newWebsocketClient(logger *pct.Logger, api pct.APIConnector, link string, headers map[string]string, wsMux *client.Mux, recorder *client.Recorder) (pct.WebsocketClient, error) {
+	if wsMux != nil {
+		return wsMux.Stream(link, logger), nil
+	}
+	ws, err := client.NewWebsocketClient(logger, api, link, headers)
+	if err != nil {
+		return nil, err
+	}
+	if recorder != nil {
+		ws.SetRecorder(recorder)
+	}
+	return ws, nil
+}
+
 func ConnectAPI(agentConfig *agent.Config, retry int) (*pct.API, error) {
 	golog.Println("ApiHostname: " + agentConfig.ApiHostname)
 	golog.Println("ApiKey: " + agentConfig.ApiKey)
+	if agentConfig.Proxy != "" {
+		golog.Println("Proxy: " + agentConfig.Proxy)
+	}
+	if err := pct.SetProxy(agentConfig.Proxy); err != nil {
+		return nil, err
+	}
+	if agentConfig.ApiCA != "" || agentConfig.ApiCert != "" || len(agentConfig.ApiPins) > 0 {
+		golog.Printf("API TLS: CA=%s cert=%s pins=%d\n", agentConfig.ApiCA, agentConfig.ApiCert, len(agentConfig.ApiPins))
+	}
+	if err := pct.SetTLS(agentConfig.ApiCA, agentConfig.ApiCert, agentConfig.ApiCertKey, agentConfig.ApiPins); err != nil {
+		return nil, err
+	}
 
-	api := pct.NewAPI()
+	api, err := newAPI(agentConfig)
+	if err != nil {
+		return nil, err
+	}
 	backoff := pct.NewBackoff(5 * time.Minute)
 	week := time.Hour * 24 * 7
 	t0 := time.Now()
@@ -489,14 +696,57 @@ func ConnectAPI(agentConfig *agent.Config, retry int) (*pct.API, error) {
 			continue
 		}
 		golog.Println("Connected to API")
+		if pct.ClockSkewed(pct.ClockOffset()) {
+			golog.Println("WARNING: clock skew: " + pct.ClockStatus())
+		}
 		return api, nil // success
 	}
 
 	return nil, errors.New("Timeout connecting to " + agentConfig.ApiHostname)
 }
 
+// newAPI returns an API that signs requests and gets the API key from the auth
+// provider, if configured.
+func newAPI(agentConfig *agent.Config) (*pct.API, error) {
+	api := pct.NewAPI()
+	api.SignRequests(agentConfig.SignRequests)
+	if agentConfig.ApiAuth != nil {
+		provider, err := pct.NewAuthProvider(*agentConfig.ApiAuth)
+		if err != nil {
+			return nil, err
+		}
+		golog.Println("API auth: " + provider.Name())
+		api.SetAuth(pct.NewAuth(provider))
+	}
+	return api, nil
+}
+
+// connectSecondaryAPI connects to the secondary API, retrying until it
+// succeeds.  Until then, data for it is spooled but cannot be sent, so unlike
+// ConnectAPI it does not block starting the agent.
+func connectSecondaryAPI(api *pct.API, config *agent.SecondaryAPI, logger *pct.Logger) {
+	backoff := pct.NewBackoff(5 * time.Minute)
+	for {
+		time.Sleep(backoff.Wait())
+		if err := api.Connect(config.ApiHostname, config.ApiKey, config.AgentUuid); err != nil {
+			logger.Warn("Cannot connect to secondary API "+config.ApiHostname+":", err)
+			continue
+		}
+		logger.Info("Connected to secondary API " + config.ApiHostname)
+		return
+	}
+}
+
+// errRestartByInit is returned by run if the agent restarted and its init
+// system must start it again, see agent.EXIT_RESTART.
+var errRestartByInit = errors.New("Restarting by init system")
+
 func main() {
 	if err := run(); err != nil {
+		if err == errRestartByInit {
+			golog.Println(err)
+			os.Exit(agent.EXIT_RESTART)
+		}
 		golog.Fatal(err) // non-zero exit
 		os.Exit(1)
 	}
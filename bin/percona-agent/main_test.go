@@ -117,3 +117,37 @@ func (s *MainTestSuite) TestValidFlag(t *C) {
 	s.cmd = exec.Command(s.bin, "-basedir="+s.basedir, "-ping=false")
 	startWaitIsAlive(s, t)
 }
+
+type CheckTestSuite struct{}
+
+var _ = Suite(&CheckTestSuite{})
+
+func (s *CheckTestSuite) TestCheckHealth(t *C) {
+	status := map[string]string{
+		"agent":        "Idle",
+		"agent-ws":     "Connected ws://localhost/agent",
+		"qan-analyzer": "Idle",
+	}
+	metrics := map[string]pct.Metric{
+		"cmd/queue":     {Type: "gauge", Number: 3},
+		"ws/reconnects": {Type: "counter", Number: 10},
+	}
+
+	state, msg := checkHealth(status, metrics, nil, nil)
+	t.Check(state, Equals, CHECK_OK)
+	t.Check(msg, Equals, "agent running")
+
+	// Thresholds and perfdata.
+	warn := []checkThreshold{{"cmd/queue", 2}}
+	crit := []checkThreshold{{"cmd/queue", 5}}
+	state, msg = checkHealth(status, metrics, warn, crit)
+	t.Check(state, Equals, CHECK_WARNING)
+	t.Check(msg, Equals, "cmd/queue 3 >= 2 | cmd/queue=3;2;5")
+
+	// Crashed is worse than disconnected and unknown metrics.
+	status["agent-ws"] = "Disconnected"
+	status["qan-analyzer"] = "Crashed"
+	state, msg = checkHealth(status, metrics, []checkThreshold{{"foo", 1}}, nil)
+	t.Check(state, Equals, CHECK_CRITICAL)
+	t.Check(msg, Equals, "crashed: qan-analyzer; disconnected: agent-ws; no metric foo")
+}
@@ -0,0 +1,270 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/percona/percona-agent/demo"
+	"github.com/percona/percona-agent/file"
+	"github.com/percona/percona-agent/hostcache"
+	"github.com/percona/percona-agent/index"
+	"github.com/percona/percona-agent/memory"
+	"github.com/percona/percona-agent/mm"
+	mmMonitor "github.com/percona/percona-agent/mm/monitor"
+	"github.com/percona/percona-agent/pct"
+	"github.com/percona/percona-agent/plan"
+	"github.com/percona/percona-agent/qan"
+	qanFactory "github.com/percona/percona-agent/qan/factory"
+	"github.com/percona/percona-agent/qan/perfschema"
+	"github.com/percona/percona-agent/qan/slowlog"
+	"github.com/percona/percona-agent/qan/slowtable"
+	"github.com/percona/percona-agent/query"
+	"github.com/percona/percona-agent/registry"
+	"github.com/percona/percona-agent/sampler"
+	"github.com/percona/percona-agent/schema"
+	"github.com/percona/percona-agent/snapshot"
+	"github.com/percona/percona-agent/sysconfig"
+	sysconfigMonitor "github.com/percona/percona-agent/sysconfig/monitor"
+	"github.com/percona/percona-agent/sysinfo"
+	mysqlSysinfo "github.com/percona/percona-agent/sysinfo/mysql"
+	systemSysinfo "github.com/percona/percona-agent/sysinfo/system"
+	"github.com/percona/percona-agent/waits"
+)
+
+// Built-in services made and started by registry.Start in main, in this
+// order.  Services with Pause are stopped by Pause in this order, too, see
+// pauseServices.  The log, data, instance, and mrms services are made by main
+// because other services depend on them.
+func init() {
+	/**
+	 * Query Analytics
+	 */
+	registry.Register(registry.Service{
+		Name:  "qan",
+		Pause: true,
+		Make: func(deps registry.Deps) (pct.ServiceManager, error) {
+			if deps.Demo {
+				return demo.NewQanManager(pct.NewLogger(deps.LogChan, "qan"), deps.Clock, deps.Spool, demo.Instances(deps.InstanceRepo)), nil
+			}
+			m := qan.NewManager(
+				pct.NewLogger(deps.LogChan, "qan"),
+				deps.Clock,
+				deps.InstanceRepo,
+				deps.MRMS,
+				deps.Bus,
+				deps.ConnFactory,
+				qanFactory.NewRealAnalyzerFactory(
+					deps.LogChan,
+					qanFactory.NewRealIntervalIterFactory(deps.LogChan),
+					slowlog.NewRealWorkerFactory(deps.LogChan),
+					perfschema.NewRealWorkerFactory(deps.LogChan),
+					slowtable.NewRealWorkerFactory(deps.LogChan),
+					deps.Spool,
+					deps.Clock,
+				),
+			)
+			return m, nil
+		},
+	})
+
+	/**
+	 * Metric and system config monitors
+	 */
+	registry.Register(registry.Service{
+		Name:  "mm",
+		Pause: true,
+		Make: func(deps registry.Deps) (pct.ServiceManager, error) {
+			if deps.Demo {
+				return demo.NewMmManager(pct.NewLogger(deps.LogChan, "mm"), deps.Clock, deps.Spool, demo.Instances(deps.InstanceRepo)), nil
+			}
+			m := mm.NewManager(
+				pct.NewLogger(deps.LogChan, "mm"),
+				mmMonitor.NewFactory(deps.LogChan, deps.InstanceRepo, deps.MRMS, deps.Bus),
+				deps.Clock,
+				deps.Spool,
+				deps.InstanceRepo,
+				deps.MRMS,
+			)
+			return m, nil
+		},
+	})
+	registry.Register(registry.Service{
+		Name:  "sysconfig",
+		Pause: true,
+		Make: func(deps registry.Deps) (pct.ServiceManager, error) {
+			m := sysconfig.NewManager(
+				pct.NewLogger(deps.LogChan, "sysconfig"),
+				sysconfigMonitor.NewFactory(deps.LogChan, deps.InstanceRepo),
+				deps.Clock,
+				deps.Spool,
+				deps.InstanceRepo,
+			)
+			return m, nil
+		},
+	})
+
+	/**
+	 * Query service (real-time EXPLAIN, SHOW CREATE TABLE, etc.)
+	 */
+	registry.Register(registry.Service{
+		Name: "query",
+		Make: func(deps registry.Deps) (pct.ServiceManager, error) {
+			return query.NewManager(pct.NewLogger(deps.LogChan, "query"), deps.InstanceRepo, deps.ConnFactory), nil
+		},
+	})
+
+	/**
+	 * Snapshot service (quiesce MySQL for LVM, EBS, etc. snapshots)
+	 */
+	registry.Register(registry.Service{
+		Name: "snapshot",
+		Make: func(deps registry.Deps) (pct.ServiceManager, error) {
+			return snapshot.NewManager(pct.NewLogger(deps.LogChan, "snapshot"), deps.InstanceRepo, deps.ConnFactory), nil
+		},
+	})
+
+	/**
+	 * Schema service (detect table changes by SHOW CREATE TABLE)
+	 */
+	registry.Register(registry.Service{
+		Name:  "schema",
+		Pause: true,
+		Make: func(deps registry.Deps) (pct.ServiceManager, error) {
+			return schema.NewManager(pct.NewLogger(deps.LogChan, "schema"), deps.Clock, deps.Spool, deps.InstanceRepo, deps.ConnFactory), nil
+		},
+	})
+
+	/**
+	 * Plan service (detect EXPLAIN plan changes of tracked queries)
+	 */
+	registry.Register(registry.Service{
+		Name:  "plan",
+		Pause: true,
+		Make: func(deps registry.Deps) (pct.ServiceManager, error) {
+			return plan.NewManager(pct.NewLogger(deps.LogChan, "plan"), deps.Clock, deps.Spool, deps.InstanceRepo, deps.ConnFactory), nil
+		},
+	})
+
+	/**
+	 * Index service (report unused and duplicate indexes)
+	 */
+	registry.Register(registry.Service{
+		Name:  "index",
+		Pause: true,
+		Make: func(deps registry.Deps) (pct.ServiceManager, error) {
+			return index.NewManager(pct.NewLogger(deps.LogChan, "index"), deps.Clock, deps.Spool, deps.InstanceRepo, deps.ConnFactory), nil
+		},
+	})
+
+	/**
+	 * Sampler service (sample long-running statements)
+	 */
+	registry.Register(registry.Service{
+		Name:  "sampler",
+		Pause: true,
+		Make: func(deps registry.Deps) (pct.ServiceManager, error) {
+			return sampler.NewManager(pct.NewLogger(deps.LogChan, "sampler"), deps.Clock, deps.Spool, deps.InstanceRepo, deps.ConnFactory), nil
+		},
+	})
+
+	/**
+	 * Waits service (top wait events from performance_schema)
+	 */
+	registry.Register(registry.Service{
+		Name:  "waits",
+		Pause: true,
+		Make: func(deps registry.Deps) (pct.ServiceManager, error) {
+			return waits.NewManager(pct.NewLogger(deps.LogChan, "waits"), deps.Clock, deps.Spool, deps.InstanceRepo, deps.ConnFactory), nil
+		},
+	})
+
+	/**
+	 * Memory service (memory usage from performance_schema)
+	 */
+	registry.Register(registry.Service{
+		Name:  "memory",
+		Pause: true,
+		Make: func(deps registry.Deps) (pct.ServiceManager, error) {
+			return memory.NewManager(pct.NewLogger(deps.LogChan, "memory"), deps.Clock, deps.Spool, deps.InstanceRepo, deps.ConnFactory), nil
+		},
+	})
+
+	/**
+	 * Host cache service (connection errors and hosts near max_connect_errors)
+	 */
+	registry.Register(registry.Service{
+		Name:  "hostcache",
+		Pause: true,
+		Make: func(deps registry.Deps) (pct.ServiceManager, error) {
+			return hostcache.NewManager(pct.NewLogger(deps.LogChan, "hostcache"), deps.Clock, deps.Spool, deps.InstanceRepo, deps.ConnFactory, deps.Bus), nil
+		},
+	})
+
+	/**
+	 * File service (fetch allowed local files for remote diagnostics)
+	 */
+	registry.Register(registry.Service{
+		Name: "file",
+		Make: func(deps registry.Deps) (pct.ServiceManager, error) {
+			return file.NewManager(pct.NewLogger(deps.LogChan, "file")), nil
+		},
+	})
+
+	/**
+	 * Sysinfo
+	 */
+	registry.Register(registry.Service{
+		Name: "sysinfo",
+		Make: func(deps registry.Deps) (pct.ServiceManager, error) {
+			m := sysinfo.NewManager(
+				pct.NewLogger(deps.LogChan, "sysinfo"),
+			)
+
+			// MySQL Sysinfo
+			mysqlSysinfoService := mysqlSysinfo.NewMySQL(
+				pct.NewLogger(deps.LogChan, "sysinfo-mysql"),
+				deps.InstanceRepo,
+			)
+			if err := m.RegisterService("MySQLSummary", mysqlSysinfoService); err != nil {
+				return nil, fmt.Errorf("Error registering Mysql Sysinfo service: %s", err)
+			}
+
+			// System Sysinfo
+			systemSysinfoService := systemSysinfo.NewSystem(
+				pct.NewLogger(deps.LogChan, "sysinfo-system"),
+			)
+			if err := m.RegisterService("SystemSummary", systemSysinfoService); err != nil {
+				return nil, fmt.Errorf("Error registering System Sysinfo service: %s", err)
+			}
+			return m, nil
+		},
+	})
+}
+
+// pauseServices returns the registered services with Pause, in order, then
+// data last so reports written while stopping are spooled.
+func pauseServices() []string {
+	pause := []string{}
+	for _, s := range registry.Services() {
+		if s.Pause {
+			pause = append(pause, s.Name)
+		}
+	}
+	return append(pause, "data")
+}
@@ -0,0 +1,132 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+// Package bus is a lightweight publish/subscribe bus for events between agent
+// services, e.g. MySQL restarts detected by mrms or API connectivity changes
+// from the agent.  A service subscribes to the topics it reacts to, so new
+// cross-service reactions don't need new channels wired in bin/percona-agent.
+package bus
+
+import (
+	"sync"
+	"time"
+)
+
+// Topics
+const (
+	MYSQL_RESTART       = "mysql-restart"       // Data: DSN without password
+	API_CONNECTED       = "api-connected"       // Data: nil
+	API_DISCONNECTED    = "api-disconnected"    // Data: nil
+	CONFIG_CHANGED      = "config-changed"      // Data: service name, e.g. qan, or agent
+	CREDS_CHANGED       = "creds-changed"       // Data: Vault path of new MySQL credentials, see instance.VaultCreds
+	SERVICE_RESTART     = "service-restart"     // Data: agent.Incident of a crashed service restarted by the watchdog
+	ALERT               = "alert"               // Data: alert, e.g. hostcache.Alert
+	REPLICATION_STOPPED = "replication-stopped" // Data: mm/mysql.ReplicationStatus of the stopped replica
+)
+
+// SUBSCRIPTION_SIZE is the default buffer size of Subscription.C.
+const SUBSCRIPTION_SIZE = 10
+
+type Event struct {
+	Topic  string
+	Ts     time.Time // UTC
+	Source string    // service or component that published it
+	Data   interface{}
+}
+
+type Bus struct {
+	subs map[string][]*Subscription
+	mux  *sync.RWMutex
+}
+
+// A Subscription receives events of its topic on C until Cancel.  Events are
+// dropped if C is full: publishers never block, so subscribers must keep up.
+type Subscription struct {
+	C     chan Event
+	topic string
+	bus   *Bus
+}
+
+func New() *Bus {
+	b := &Bus{
+		subs: make(map[string][]*Subscription),
+		mux:  &sync.RWMutex{},
+	}
+	return b
+}
+
+// Subscribe returns a subscription to the topic with a buffer of size events,
+// or SUBSCRIPTION_SIZE if size is 0.  A nil Bus returns a subscription which
+// never receives events.
+func (b *Bus) Subscribe(topic string, size int) *Subscription {
+	if size <= 0 {
+		size = SUBSCRIPTION_SIZE
+	}
+	s := &Subscription{
+		C:     make(chan Event, size),
+		topic: topic,
+		bus:   b,
+	}
+	if b == nil {
+		return s
+	}
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	b.subs[topic] = append(b.subs[topic], s)
+	return s
+}
+
+// Cancel stops the subscription.  C is not closed because a publisher might
+// be sending to it.
+func (s *Subscription) Cancel() {
+	b := s.bus
+	if b == nil {
+		return
+	}
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	subs := b.subs[s.topic]
+	for i, sub := range subs {
+		if sub == s {
+			b.subs[s.topic] = append(subs[0:i], subs[i+1:]...)
+			break
+		}
+	}
+}
+
+// Publish sends the event to the subscribers of its topic without blocking and
+// returns how many received it.  Ts is set if zero.  A nil Bus is valid and
+// publishes to no one, for tests and optional wiring.
+func (b *Bus) Publish(e Event) int {
+	if b == nil {
+		return 0
+	}
+	if e.Ts.IsZero() {
+		e.Ts = time.Now().UTC()
+	}
+	b.mux.RLock()
+	defer b.mux.RUnlock()
+	n := 0
+	for _, s := range b.subs[e.Topic] {
+		select {
+		case s.C <- e:
+			n++
+		default:
+		}
+	}
+	return n
+}
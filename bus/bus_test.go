@@ -0,0 +1,67 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package bus_test
+
+import (
+	"testing"
+
+	"github.com/percona/percona-agent/bus"
+	. "gopkg.in/check.v1"
+)
+
+// Hook up gocheck into the "go test" runner.
+func Test(t *testing.T) { TestingT(t) }
+
+type BusTestSuite struct{}
+
+var _ = Suite(&BusTestSuite{})
+
+func (s *BusTestSuite) TestPublishSubscribe(t *C) {
+	b := bus.New()
+	sub1 := b.Subscribe(bus.MYSQL_RESTART, 1)
+	sub2 := b.Subscribe(bus.MYSQL_RESTART, 0)
+	other := b.Subscribe(bus.API_CONNECTED, 0)
+
+	n := b.Publish(bus.Event{Topic: bus.MYSQL_RESTART, Source: "mrms", Data: "user@tcp(localhost:3306)/"})
+	t.Check(n, Equals, 2)
+	e := <-sub1.C
+	t.Check(e.Source, Equals, "mrms")
+	t.Check(e.Ts.IsZero(), Equals, false)
+	e = <-sub2.C
+	t.Check(e.Data, Equals, "user@tcp(localhost:3306)/")
+	t.Check(len(other.C), Equals, 0)
+
+	// Full subscription drops events, publisher doesn't block.
+	b.Publish(bus.Event{Topic: bus.MYSQL_RESTART})
+	n = b.Publish(bus.Event{Topic: bus.MYSQL_RESTART})
+	t.Check(n, Equals, 1) // only sub2
+	t.Check(len(sub1.C), Equals, 1)
+
+	// Canceled subscriptions receive nothing.
+	sub2.Cancel()
+	<-sub1.C
+	n = b.Publish(bus.Event{Topic: bus.MYSQL_RESTART})
+	t.Check(n, Equals, 1)
+
+	// Nil bus is a no-op.
+	var nilBus *bus.Bus
+	t.Check(nilBus.Publish(bus.Event{Topic: bus.MYSQL_RESTART}), Equals, 0)
+	nilSub := nilBus.Subscribe(bus.MYSQL_RESTART, 0)
+	t.Check(nilSub.C, NotNil)
+	nilSub.Cancel()
+}
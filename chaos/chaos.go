@@ -0,0 +1,34 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+// Package chaos injects faults to test resilience (buffering, reconnect,
+// back-pressure) end-to-end.  The faults are compiled in only by building with
+// "-tags chaos", else the hooks are no-ops, see nofaults.go.  Faults are
+// controlled via the local status listener (agent Config.StatusAddr):
+//
+//	GET  /chaos                            current faults
+//	POST /chaos/drop-ws?link=cmd           disconnect a websocket, all if no link
+//	POST /chaos/mysql-delay?delay=5s       delay MySQL queries, 0 to stop
+//	POST /chaos/fill-spool?n=100&size=1024 spool n junk data of size bytes
+//
+// Never ship a chaos build.
+package chaos
+
+// Spooler is the part of data.Spooler used to fill the spool.
+type Spooler interface {
+	Write(service string, data interface{}) error
+}
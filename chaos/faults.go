@@ -0,0 +1,179 @@
+// +build chaos
+
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package chaos
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const Enabled = true
+
+var (
+	websockets = map[string]func() error{}
+	spool      Spooler
+	mysqlDelay time.Duration
+	mux        = &sync.Mutex{} // guards all of the above
+)
+
+// AddWebsocket makes a websocket droppable by link, e.g. cmd.
+func AddWebsocket(link string, disconnect func() error) {
+	mux.Lock()
+	defer mux.Unlock()
+	websockets[link] = disconnect
+}
+
+// SetSpool sets the spool to fill.
+func SetSpool(s Spooler) {
+	mux.Lock()
+	defer mux.Unlock()
+	spool = s
+}
+
+// DelayMySQL sleeps for the MySQL delay, if any.
+func DelayMySQL() {
+	mux.Lock()
+	delay := mysqlDelay
+	mux.Unlock()
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+}
+
+// Handler returns the /chaos handler.
+func Handler() http.Handler {
+	return http.HandlerFunc(handle)
+}
+
+type faults struct {
+	Websockets []string
+	MySQLDelay string
+	Spool      bool
+}
+
+func handle(w http.ResponseWriter, r *http.Request) {
+	fault := strings.Trim(strings.TrimPrefix(r.URL.Path, "/chaos"), "/")
+	if fault == "" {
+		if r.Method != "GET" {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		mux.Lock()
+		f := faults{
+			Websockets: []string{},
+			MySQLDelay: mysqlDelay.String(),
+			Spool:      spool != nil,
+		}
+		for link := range websockets {
+			f.Websockets = append(f.Websockets, link)
+		}
+		mux.Unlock()
+		sort.Strings(f.Websockets)
+		data, _ := json.MarshalIndent(f, "", "  ")
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(data)
+		return
+	}
+
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var err error
+	switch fault {
+	case "drop-ws":
+		err = dropWebsocket(r.FormValue("link"))
+	case "mysql-delay":
+		err = setMySQLDelay(r.FormValue("delay"))
+	case "fill-spool":
+		err = fillSpool(r.FormValue("n"), r.FormValue("size"))
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func dropWebsocket(link string) error {
+	mux.Lock()
+	drop := map[string]func() error{}
+	for l, disconnect := range websockets {
+		if link == "" || l == link {
+			drop[l] = disconnect
+		}
+	}
+	mux.Unlock()
+	if len(drop) == 0 {
+		return fmt.Errorf("Unknown websocket: %s", link)
+	}
+	// The clients reconnect on their own.
+	for _, disconnect := range drop {
+		go disconnect()
+	}
+	return nil
+}
+
+func setMySQLDelay(delay string) error {
+	d, err := time.ParseDuration(delay)
+	if err != nil || d < 0 {
+		return fmt.Errorf("Invalid delay: %s", delay)
+	}
+	mux.Lock()
+	defer mux.Unlock()
+	mysqlDelay = d
+	return nil
+}
+
+func fillSpool(nArg, sizeArg string) error {
+	n, err := strconv.Atoi(nArg)
+	if err != nil || n <= 0 {
+		return fmt.Errorf("Invalid n: %s", nArg)
+	}
+	size := 1024
+	if sizeArg != "" {
+		if size, err = strconv.Atoi(sizeArg); err != nil || size < 0 {
+			return fmt.Errorf("Invalid size: %s", sizeArg)
+		}
+	}
+	mux.Lock()
+	s := spool
+	mux.Unlock()
+	if s == nil {
+		return fmt.Errorf("No spool")
+	}
+	junk := strings.Repeat("x", size)
+	for i := 0; i < n; i++ {
+		// Service "chaos" so the API rejects it, which tests Reject, too.
+		if err := s.Write("chaos", map[string]string{"Junk": junk}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,103 @@
+// +build chaos
+
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package chaos_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/percona/percona-agent/chaos"
+	"github.com/percona/percona-agent/test/mock"
+	. "gopkg.in/check.v1"
+)
+
+// Run with: go test -tags chaos ./chaos
+func Test(t *testing.T) { TestingT(t) }
+
+type TestSuite struct {
+	server *httptest.Server
+}
+
+var _ = Suite(&TestSuite{})
+
+func (s *TestSuite) SetUpSuite(t *C) {
+	s.server = httptest.NewServer(chaos.Handler())
+}
+
+func (s *TestSuite) TearDownSuite(t *C) {
+	s.server.Close()
+}
+
+func (s *TestSuite) post(path string) int {
+	resp, err := http.Post(s.server.URL+path, "", nil)
+	if err != nil {
+		return 0
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func (s *TestSuite) TestDropWebsocket(t *C) {
+	dropped := make(chan string, 2)
+	chaos.AddWebsocket("cmd", func() error { dropped <- "cmd"; return nil })
+	chaos.AddWebsocket("log", func() error { dropped <- "log"; return nil })
+
+	t.Check(s.post("/chaos/drop-ws?link=cmd"), Equals, http.StatusNoContent)
+	select {
+	case link := <-dropped:
+		t.Check(link, Equals, "cmd")
+	case <-time.After(1 * time.Second):
+		t.Error("cmd websocket not dropped")
+	}
+
+	t.Check(s.post("/chaos/drop-ws?link=foo"), Equals, http.StatusBadRequest)
+}
+
+func (s *TestSuite) TestMySQLDelay(t *C) {
+	t.Check(s.post("/chaos/mysql-delay?delay=200ms"), Equals, http.StatusNoContent)
+	t0 := time.Now()
+	chaos.DelayMySQL()
+	t.Check(time.Now().Sub(t0) >= 200*time.Millisecond, Equals, true)
+
+	t.Check(s.post("/chaos/mysql-delay?delay=0"), Equals, http.StatusNoContent)
+	t0 = time.Now()
+	chaos.DelayMySQL()
+	t.Check(time.Now().Sub(t0) < 100*time.Millisecond, Equals, true)
+
+	t.Check(s.post("/chaos/mysql-delay?delay=foo"), Equals, http.StatusBadRequest)
+}
+
+func (s *TestSuite) TestFillSpool(t *C) {
+	spool := mock.NewSpooler(nil)
+	chaos.SetSpool(spool)
+	t.Check(s.post("/chaos/fill-spool?n=3&size=10"), Equals, http.StatusNoContent)
+	t.Check(spool.DataIn, HasLen, 3)
+
+	t.Check(s.post("/chaos/fill-spool?n=0"), Equals, http.StatusBadRequest)
+
+	// Only POST changes faults.
+	resp, err := http.Get(s.server.URL + "/chaos/fill-spool?n=3")
+	t.Assert(err, IsNil)
+	resp.Body.Close()
+	t.Check(resp.StatusCode, Equals, http.StatusMethodNotAllowed)
+	t.Check(spool.DataIn, HasLen, 3)
+}
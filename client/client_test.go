@@ -18,14 +18,18 @@
 package client_test
 
 import (
+	"encoding/json"
 	"github.com/percona/cloud-protocol/proto/v1"
 	"github.com/percona/percona-agent/client"
 	"github.com/percona/percona-agent/pct"
 	"github.com/percona/percona-agent/test"
 	"github.com/percona/percona-agent/test/mock"
 	. "gopkg.in/check.v1"
+	"io/ioutil"
 	"log"
 	"net"
+	"os"
+	"strings"
 	"testing"
 	"time"
 )
@@ -137,12 +141,16 @@ func (s *TestSuite) TestSend(t *C) {
 	conn := ws.Conn()
 	t.Check(conn, NotNil)
 
-	// Status should report connected to the proper link.
+	// Status should report connected to the proper link, and the connection
+	// stats.
 	status := ws.Status()
-	t.Check(status, DeepEquals, map[string]string{
-		"ws":      "Connected " + URL,
-		"ws-link": URL,
-	})
+	t.Check(status["ws"], Equals, "Connected "+URL)
+	t.Check(status["ws-link"], Equals, URL)
+	t.Check(status["ws-queued"], Equals, "0 replies, 0 cmds")
+	t.Check(status["ws-reconnects"], Equals, "0")
+	t.Check(status["ws-uptime"], Not(Equals), "Disconnected")
+	t.Check(status["ws-bytes"], Not(Equals), "sent 0, recv 0")
+	t.Check(status["ws-error"], Equals, "")
 
 	ws.Disconnect()
 
@@ -154,10 +162,9 @@ func (s *TestSuite) TestSend(t *C) {
 
 	// Status should report disconnected and still the proper link.
 	status = ws.Status()
-	t.Check(status, DeepEquals, map[string]string{
-		"ws":      "Disconnected",
-		"ws-link": URL,
-	})
+	t.Check(status["ws"], Equals, "Disconnected")
+	t.Check(status["ws-link"], Equals, URL)
+	t.Check(status["ws-uptime"], Equals, "Disconnected")
 }
 
 func (s *TestSuite) TestChannels(t *C) {
@@ -332,9 +339,9 @@ func (s *TestSuite) TestConnectBackoff(t *C) {
 	<-ws.ConnectChan()
 	defer ws.Disconnect()
 
-	// 0s wait, connect, err="Lost connection",
-	// 1s wait, connect, err="Lost connection",
-	// 3s wait, connect, ok
+	// [0, 2s) wait, connect, err="Lost connection",
+	// [1s, 2s] wait, connect, err="Lost connection",
+	// [2s, 4s] wait, connect, ok
 	t0 := time.Now()
 	for i := 0; i < 2; i++ {
 		mock.DisconnectClient(c)
@@ -531,3 +538,173 @@ func (s *TestSuite) TestCloseTimeout(t *C) {
 	err = ws.Disconnect()
 	t.Check(err, IsNil)
 }
+
+func (s *TestSuite) TestCompressReply(t *C) {
+	// Small replies aren't compressed.
+	reply := &proto.Reply{Cmd: "GetAllConfigs", Data: []byte(`{"foo":"bar"}`)}
+	got, err := client.CompressReply(reply, 100)
+	t.Assert(err, IsNil)
+	t.Check(got, Equals, reply)
+
+	// Large replies are, but the original reply isn't changed.
+	data := []byte(`["` + strings.Repeat("SELECT 1; ", 1000) + `"]`)
+	reply = &proto.Reply{Cmd: "GetAllConfigs", Data: data}
+	got, err = client.CompressReply(reply, 100)
+	t.Assert(err, IsNil)
+	t.Check(reply.Data, DeepEquals, data)
+	t.Check(got.Cmd, Equals, "GetAllConfigs")
+	t.Check(len(got.Data) < len(data), Equals, true)
+
+	c := &client.CompressedData{}
+	t.Assert(json.Unmarshal(got.Data, c), IsNil)
+	t.Check(c.Encoding, Equals, "gzip")
+
+	orig, err := client.DecompressData(got.Data)
+	t.Assert(err, IsNil)
+	t.Check(orig, DeepEquals, data)
+}
+
+func (s *TestSuite) TestPollClient(t *C) {
+	links := map[string]string{"cmd": "wss://cloud-api.percona.com/agents/123/cmd"}
+	api := mock.NewAPI("http://localhost", "cloud-api.percona.com", "apikey", "123", links)
+	api.GetData = [][]byte{
+		[]byte(`[]`), // ConnectOnce
+		[]byte(`[{"Service":"agent","Cmd":"Status"},{"Service":"qan","Cmd":"GetConfig"}]`),
+	}
+
+	poll := client.NewPollClient(s.logger, api, "cmd")
+	t.Check(poll.URL(), Equals, "https://cloud-api.percona.com/agents/123/cmd/poll")
+	t.Check(poll.Conn(), IsNil)
+
+	poll.Start()
+	defer poll.Stop()
+	go poll.Connect()
+	select {
+	case connected := <-poll.ConnectChan():
+		t.Assert(connected, Equals, true)
+	case <-time.After(5 * time.Second):
+		t.Fatal("PollClient did not connect")
+	}
+
+	// Queued cmds are received in order.
+	for _, expect := range []string{"Status", "GetConfig"} {
+		select {
+		case cmd := <-poll.RecvChan():
+			t.Check(cmd.Cmd, Equals, expect)
+		case <-time.After(5 * time.Second):
+			t.Fatal("No cmd")
+		}
+	}
+
+	poll.DisconnectOnce()
+	t.Check(poll.Send(&proto.Reply{Cmd: "Status"}, 5), NotNil)
+}
+
+func (s *TestSuite) TestRecorder(t *C) {
+	tmpFile, err := ioutil.TempFile("", "percona-agent-test-record")
+	t.Assert(err, IsNil)
+	tmpFile.Close()
+	defer os.Remove(tmpFile.Name())
+
+	r, err := client.NewRecorder(tmpFile.Name())
+	t.Assert(err, IsNil)
+	ws, err := client.NewWebsocketClient(s.logger, s.api, "agent", nil)
+	t.Assert(err, IsNil)
+	ws.SetRecorder(r)
+
+	ws.ConnectOnce(5)
+	c := <-mock.ClientConnectChan
+
+	// Agent sends a reply and raw data, then receives a cmd.
+	t.Assert(ws.Send(&proto.Reply{Cmd: "Status"}, 5), IsNil)
+	test.WaitData(c.RecvChan)
+	t.Assert(ws.SendBytes([]byte{1, 2, 3}, 5), IsNil)
+	c.SendChan <- &proto.Cmd{Service: "agent", Cmd: "Status"}
+	cmd := &proto.Cmd{}
+	t.Assert(ws.Recv(cmd, 5), IsNil)
+	ws.DisconnectOnce()
+	t.Assert(r.Close(), IsNil)
+
+	frames, err := client.ReadRecording(tmpFile.Name())
+	t.Assert(err, IsNil)
+	t.Assert(frames, HasLen, 3)
+	t.Check(frames[0].Link, Equals, "agent")
+	t.Check(frames[0].Dir, Equals, client.RECORD_SEND)
+	reply := &proto.Reply{}
+	t.Assert(json.Unmarshal(frames[0].Json, reply), IsNil)
+	t.Check(reply.Cmd, Equals, "Status")
+	t.Check(frames[1].Dir, Equals, client.RECORD_SEND)
+	t.Check(frames[1].Bytes, DeepEquals, []byte{1, 2, 3})
+	t.Check(frames[2].Dir, Equals, client.RECORD_RECV)
+	gotCmd := &proto.Cmd{}
+	t.Assert(json.Unmarshal(frames[2].Json, gotCmd), IsNil)
+	t.Check(gotCmd.Cmd, Equals, "Status")
+}
+
+func (s *TestSuite) TestMux(t *C) {
+	links := map[string]string{client.MUX_LINK: URL}
+	api := mock.NewAPI("http://localhost", ADDR, "apikey", "uuid", links)
+	m, err := client.NewMux(s.logger, api, nil)
+	t.Assert(err, IsNil)
+
+	// The cmd stream connects the websocket.
+	cmd := m.Stream("cmd", s.logger)
+	cmd.Start()
+	defer cmd.Stop()
+	go cmd.Connect()
+	c := <-mock.ClientConnectChan
+	select {
+	case connected := <-cmd.ConnectChan():
+		t.Assert(connected, Equals, true)
+	case <-time.After(5 * time.Second):
+		t.Fatal("cmd stream did not connect")
+	}
+
+	// The data stream uses the same websocket.
+	data := m.Stream("data", s.logger)
+	t.Assert(data.ConnectOnce(5), IsNil)
+	select {
+	case <-mock.ClientConnectChan:
+		t.Fatal("data stream opened another websocket")
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	// Cmds are dispatched to the cmd stream, and replies are sent as cmd frames.
+	c.SendChan <- &client.MuxFrame{Stream: "cmd", Json: []byte(`{"Service":"agent","Cmd":"Status"}`)}
+	select {
+	case got := <-cmd.RecvChan():
+		t.Check(got.Cmd, Equals, "Status")
+	case <-time.After(5 * time.Second):
+		t.Fatal("No cmd")
+	}
+	cmd.SendChan() <- &proto.Reply{Cmd: "Status"}
+	got := test.WaitData(c.RecvChan)
+	t.Assert(got, HasLen, 1)
+	frame := got[0].(map[string]interface{})
+	t.Check(frame["Stream"], Equals, "cmd")
+	t.Check(frame["Json"].(map[string]interface{})["Cmd"], Equals, "Status")
+
+	// Raw data is sent as data frames, and the response is received on the
+	// data stream.
+	t.Assert(data.SendBytes([]byte{1, 2, 3}, 5), IsNil)
+	got = test.WaitData(c.RecvChan)
+	t.Assert(got, HasLen, 1)
+	frame = got[0].(map[string]interface{})
+	t.Check(frame["Stream"], Equals, "data")
+	t.Check(frame["Bytes"], Equals, "AQID")
+	c.SendChan <- &client.MuxFrame{Stream: "data", Json: []byte(`{"Code":200}`)}
+	resp := &proto.Response{}
+	t.Assert(data.Recv(resp, 5), IsNil)
+	t.Check(int(resp.Code), Equals, 200)
+
+	// Detaching the data stream does not close the websocket, but
+	// disconnecting the cmd stream does.
+	t.Check(data.DisconnectOnce(), IsNil)
+	cmd.Disconnect()
+	select {
+	case connected := <-cmd.ConnectChan():
+		t.Check(connected, Equals, false)
+	case <-time.After(5 * time.Second):
+		t.Fatal("cmd stream did not disconnect")
+	}
+}
@@ -0,0 +1,85 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package client
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/percona/cloud-protocol/proto/v1"
+)
+
+// The websocket library does not do permessage-deflate, so large replies
+// (e.g. GetAllConfigs, GetAuditLog) are compressed by the agent: Reply.Data
+// is replaced by CompressedData.  The API must agree to this in the handshake,
+// see WebsocketClient.SetCompression.
+
+const COMPRESS_ENCODING = "gzip"
+
+// CompressedData is the Data of a compressed Reply: Data is the original
+// Reply.Data compressed with Encoding.
+type CompressedData struct {
+	Encoding string
+	Data     []byte
+}
+
+// CompressReply returns a copy of the reply with its Data compressed if Data
+// is larger than minSize bytes, else it returns the reply.
+func CompressReply(reply *proto.Reply, minSize int) (*proto.Reply, error) {
+	if reply == nil || minSize <= 0 || len(reply.Data) <= minSize {
+		return reply, nil
+	}
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(reply.Data); err != nil {
+		return reply, err
+	}
+	if err := w.Close(); err != nil {
+		return reply, err
+	}
+	data, err := json.Marshal(CompressedData{Encoding: COMPRESS_ENCODING, Data: buf.Bytes()})
+	if err != nil {
+		return reply, err
+	}
+	if len(data) >= len(reply.Data) {
+		return reply, nil // not worth it, e.g. already compressed data
+	}
+	compressed := *reply
+	compressed.Data = data
+	return &compressed, nil
+}
+
+// DecompressData returns the original Reply.Data of CompressedData.
+func DecompressData(data []byte) ([]byte, error) {
+	c := &CompressedData{}
+	if err := json.Unmarshal(data, c); err != nil {
+		return nil, err
+	}
+	if c.Encoding != COMPRESS_ENCODING {
+		return nil, fmt.Errorf("Unknown encoding: %s", c.Encoding)
+	}
+	r, err := gzip.NewReader(bytes.NewReader(c.Data))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
@@ -0,0 +1,200 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package client
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"code.google.com/p/go.net/websocket"
+	"github.com/percona/cloud-protocol/proto/v1"
+	"github.com/percona/percona-agent/pct"
+)
+
+// FALLBACK_AFTER is how many times in a row the websocket must fail to connect
+// before FallbackClient tries long-polling.
+const FALLBACK_AFTER = 3
+
+// FallbackClient connects with a WebsocketClient, or a PollClient if the
+// websocket cannot be established.  Once it falls back, it tries the websocket
+// once on every Connect, so it switches back when wss is allowed again.  Both
+// clients share the same chans, so callers see one client.
+type FallbackClient struct {
+	logger *pct.Logger
+	ws     *WebsocketClient
+	poll   *PollClient
+	// --
+	backoff  *pct.Backoff
+	failures int
+	active   pct.WebsocketClient
+	mux      *sync.Mutex // guard active
+}
+
+func NewFallbackClient(logger *pct.Logger, ws *WebsocketClient, poll *PollClient) *FallbackClient {
+	// Share the chans.  The agent gets them once, e.g. RecvChan, so they
+	// must not change when the transport does.
+	poll.recvChan = ws.recvChan
+	poll.sendChan = ws.sendChan
+	poll.connectChan = ws.connectChan
+	poll.errChan = ws.errChan
+	c := &FallbackClient{
+		logger:  logger,
+		ws:      ws,
+		poll:    poll,
+		backoff: pct.NewJitterBackoff(CONNECT_MIN_WAIT, CONNECT_MAX_WAIT, 5*time.Minute),
+		active:  ws,
+		mux:     new(sync.Mutex),
+	}
+	return c
+}
+
+func (c *FallbackClient) client() pct.WebsocketClient {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	return c.active
+}
+
+func (c *FallbackClient) Start() {
+	c.ws.Start()
+	c.poll.Start()
+}
+
+func (c *FallbackClient) Stop() {
+	c.ws.Stop()
+	c.poll.Stop()
+}
+
+func (c *FallbackClient) Connect() {
+	c.logger.Debug("Connect:call")
+	defer c.logger.Debug("Connect:return")
+
+	wsTried := false
+	for {
+		time.Sleep(c.backoff.Wait())
+
+		// Try the websocket until it fails FALLBACK_AFTER times, then once
+		// per Connect before long-polling.
+		if c.failures < FALLBACK_AFTER || !wsTried {
+			wsTried = true
+			err := c.ws.ConnectOnce(0)
+			if err == nil {
+				c.connected(c.ws, "websocket")
+				c.ws.startChans()
+				c.ws.notifyConnect(true)
+				return
+			}
+			c.logger.Warn(err)
+			c.failures++
+			if c.failures < FALLBACK_AFTER {
+				if err := c.ws.api.Failover(); err != nil {
+					c.logger.Warn(err)
+				}
+				continue
+			}
+		}
+
+		if err := c.poll.ConnectOnce(10); err != nil {
+			c.logger.Warn(err)
+			if err := c.poll.api.Failover(); err != nil {
+				c.logger.Warn(err)
+			}
+			continue
+		}
+		c.connected(c.poll, "long-poll")
+		c.poll.startChans()
+		c.poll.notifyConnect(true)
+		return
+	}
+}
+
+func (c *FallbackClient) connected(client pct.WebsocketClient, transport string) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	if c.active != client {
+		c.logger.Warn(fmt.Sprintf("Connected to API with %s after %d websocket connect failures", transport, c.failures))
+	}
+	c.active = client
+	c.backoff.Success()
+	if client == c.ws {
+		c.failures = 0
+	}
+}
+
+func (c *FallbackClient) ConnectOnce(timeout uint) error {
+	if err := c.ws.ConnectOnce(timeout); err != nil {
+		c.logger.Warn(err)
+		if err := c.poll.ConnectOnce(timeout); err != nil {
+			return err
+		}
+		c.connected(c.poll, "long-poll")
+		return nil
+	}
+	c.connected(c.ws, "websocket")
+	return nil
+}
+
+func (c *FallbackClient) Disconnect() error {
+	return c.client().Disconnect()
+}
+
+func (c *FallbackClient) DisconnectOnce() error {
+	return c.client().DisconnectOnce()
+}
+
+func (c *FallbackClient) SendChan() chan *proto.Reply {
+	return c.ws.SendChan()
+}
+
+func (c *FallbackClient) RecvChan() chan *proto.Cmd {
+	return c.ws.RecvChan()
+}
+
+func (c *FallbackClient) ConnectChan() chan bool {
+	return c.ws.ConnectChan()
+}
+
+func (c *FallbackClient) ErrorChan() chan error {
+	return c.ws.ErrorChan()
+}
+
+func (c *FallbackClient) Send(data interface{}, timeout uint) error {
+	return c.client().Send(data, timeout)
+}
+
+func (c *FallbackClient) SendBytes(data []byte, timeout uint) error {
+	return c.client().SendBytes(data, timeout)
+}
+
+func (c *FallbackClient) Recv(data interface{}, timeout uint) error {
+	return c.client().Recv(data, timeout)
+}
+
+func (c *FallbackClient) SetCompression(minSize int) {
+	c.ws.SetCompression(minSize)
+	c.poll.SetCompression(minSize)
+}
+
+// Conn returns the websocket, or nil if long-polling.
+func (c *FallbackClient) Conn() *websocket.Conn {
+	return c.client().Conn()
+}
+
+func (c *FallbackClient) Status() map[string]string {
+	return c.client().Status()
+}
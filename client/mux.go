@@ -0,0 +1,523 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"code.google.com/p/go.net/websocket"
+	"github.com/percona/cloud-protocol/proto/v1"
+	"github.com/percona/percona-agent/pct"
+)
+
+const (
+	MUX_LINK           = "mux" // agent link of the multiplexed websocket
+	MUX_PRIMARY_STREAM = "cmd"
+	MUX_FRAME_BUFFER   = 10
+)
+
+var ErrMuxNotConnected = errors.New("Not connected")
+
+// A MuxFrame is one frame on the multiplexed websocket.  JSON data (cmds,
+// replies, log entries, data responses) is in Json, raw data (SendBytes) is
+// in Bytes.
+type MuxFrame struct {
+	Stream string          // cmd, log, or data
+	Json   json.RawMessage `json:",omitempty"`
+	Bytes  []byte          `json:",omitempty"`
+}
+
+// A Mux carries the cmd, log, and data streams over one websocket if the API
+// has a MUX_LINK, so the agent authenticates and reconnects once instead of
+// three times.  Each MuxStream is a pct.WebsocketClient, so the agent, log
+// relay, and data sender work as with their own websockets, except:
+// disconnecting the cmd stream (MUX_PRIMARY_STREAM) disconnects the websocket
+// because the agent does that to reconnect to the API, whereas disconnecting
+// another stream only detaches it.  The websocket is closed when no stream is
+// attached, and all attached streams are disconnected if it's lost.
+type Mux struct {
+	logger *pct.Logger
+	api    pct.APIConnector
+	ws     *WebsocketClient // only for its conn, not started
+	// --
+	streams    map[string]*MuxStream
+	connected  bool
+	done       chan struct{} // closed on disconnect
+	mux        *sync.Mutex   // guard streams, connected, and done
+	connectMux *sync.Mutex   // one connect at a time
+	sendMux    *sync.Mutex   // one writer at a time
+	backoff    *pct.Backoff
+}
+
+func NewMux(logger *pct.Logger, api pct.APIConnector, headers map[string]string) (*Mux, error) {
+	ws, err := NewWebsocketClient(logger, api, MUX_LINK, headers)
+	if err != nil {
+		return nil, err
+	}
+	m := &Mux{
+		logger: logger,
+		api:    api,
+		ws:     ws,
+		// --
+		streams:    make(map[string]*MuxStream),
+		mux:        &sync.Mutex{},
+		connectMux: &sync.Mutex{},
+		sendMux:    &sync.Mutex{},
+		backoff:    pct.NewJitterBackoff(CONNECT_MIN_WAIT, CONNECT_MAX_WAIT, 5*time.Minute),
+	}
+	return m, nil
+}
+
+// Stream returns the stream, e.g. cmd, creating it on first use.
+func (m *Mux) Stream(name string, logger *pct.Logger) *MuxStream {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	if s, ok := m.streams[name]; ok {
+		return s
+	}
+	s := newMuxStream(name, logger, m)
+	m.streams[name] = s
+	return s
+}
+
+// SetRecorder records all frames sent and received.
+func (m *Mux) SetRecorder(r *Recorder) {
+	m.ws.SetRecorder(r)
+}
+
+func (m *Mux) isConnected() bool {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	return m.connected
+}
+
+// connect tries forever to connect the websocket, if not connected.
+func (m *Mux) connect() {
+	for !m.isConnected() {
+		wait := m.backoff.Wait()
+		time.Sleep(wait)
+		if err := m.connectOnce(10); err != nil {
+			m.logger.Warn(err)
+			// Try the next API host, if any, for the next attempt.
+			if err := m.api.Failover(); err != nil {
+				m.logger.Warn(err)
+			}
+			continue
+		}
+		m.backoff.Success()
+	}
+}
+
+// connectOnce connects the websocket, if not connected.
+func (m *Mux) connectOnce(timeout uint) error {
+	m.connectMux.Lock()
+	defer m.connectMux.Unlock()
+	if m.isConnected() {
+		return nil
+	}
+	if err := m.ws.ConnectOnce(timeout); err != nil {
+		return err
+	}
+	m.mux.Lock()
+	m.connected = true
+	m.done = make(chan struct{})
+	done := m.done
+	m.mux.Unlock()
+	go m.recv(done)
+	return nil
+}
+
+// disconnect closes the websocket and disconnects all attached streams.
+func (m *Mux) disconnect() {
+	m.mux.Lock()
+	if !m.connected {
+		m.mux.Unlock()
+		return
+	}
+	m.connected = false
+	close(m.done)
+	attached := []*MuxStream{}
+	for _, s := range m.streams {
+		if s.detach() {
+			attached = append(attached, s)
+		}
+	}
+	m.mux.Unlock()
+
+	m.ws.DisconnectOnce()
+	for _, s := range attached {
+		s.notifyConnect(false)
+	}
+}
+
+// detach disconnects the websocket if the stream is MUX_PRIMARY_STREAM or no
+// other stream is attached.
+func (m *Mux) detach(s *MuxStream) {
+	s.detach()
+	if s.name == MUX_PRIMARY_STREAM {
+		m.disconnect()
+		return
+	}
+	m.mux.Lock()
+	attached := 0
+	for _, other := range m.streams {
+		if other.isConnected() {
+			attached++
+		}
+	}
+	m.mux.Unlock()
+	if attached == 0 {
+		m.disconnect()
+	}
+}
+
+// recv receives frames and dispatches them to their streams until the
+// websocket is lost or closed (done).
+func (m *Mux) recv(done chan struct{}) {
+	defer func() {
+		if err := recover(); err != nil {
+			log.Printf("ERROR: Mux.recv crashed: %s\n", err)
+		}
+	}()
+	for {
+		frame := &MuxFrame{}
+		if err := m.ws.Recv(frame, 0); err != nil {
+			select {
+			case <-done:
+				// Closed by disconnect.
+			default:
+				m.logger.DebugOffline("recv:err:", err)
+				m.disconnect()
+			}
+			return
+		}
+		m.mux.Lock()
+		s, ok := m.streams[frame.Stream]
+		m.mux.Unlock()
+		if !ok {
+			m.logger.Warn("Frame for unknown stream:", frame.Stream)
+			continue
+		}
+		s.dispatch(frame, done)
+	}
+}
+
+func (m *Mux) send(frame *MuxFrame, timeout uint) error {
+	m.sendMux.Lock()
+	defer m.sendMux.Unlock()
+	if !m.isConnected() {
+		return ErrMuxNotConnected
+	}
+	if err := m.ws.Send(frame, timeout); err != nil {
+		go m.disconnect()
+		return err
+	}
+	return nil
+}
+
+// --------------------------------------------------------------------------
+
+// A MuxStream is one stream of a Mux.  It implements pct.WebsocketClient.
+type MuxStream struct {
+	name   string
+	logger *pct.Logger
+	m      *Mux
+	// --
+	connected bool
+	started   bool
+	mux       *sync.Mutex // guard connected and started
+	// --
+	recvChan    chan *proto.Cmd
+	sendChan    chan *proto.Reply
+	connectChan chan bool
+	errChan     chan error
+	frames      chan *MuxFrame // for Recv
+	sendSync    *pct.SyncChan
+	status      *pct.Status
+	statusName  string
+	// --
+	compressMinSize int
+	compressMux     *sync.Mutex // guard compressMinSize
+}
+
+func newMuxStream(name string, logger *pct.Logger, m *Mux) *MuxStream {
+	statusName := logger.Service()
+	s := &MuxStream{
+		name:   name,
+		logger: logger,
+		m:      m,
+		// --
+		mux: &sync.Mutex{},
+		// --
+		recvChan:    make(chan *proto.Cmd, RECV_BUFFER_SIZE),
+		sendChan:    make(chan *proto.Reply, SEND_BUFFER_SIZE),
+		connectChan: make(chan bool, 1),
+		errChan:     make(chan error, 2),
+		frames:      make(chan *MuxFrame, MUX_FRAME_BUFFER),
+		sendSync:    pct.NewSyncChan(),
+		status:      pct.NewStatus([]string{statusName, statusName + "-queued"}),
+		statusName:  statusName,
+		// --
+		compressMux: &sync.Mutex{},
+	}
+	return s
+}
+
+func (s *MuxStream) isConnected() bool {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	return s.connected
+}
+
+func (s *MuxStream) attach() {
+	s.mux.Lock()
+	s.connected = true
+	started := s.started
+	s.mux.Unlock()
+	if started {
+		s.sendSync.Start()
+	}
+	s.status.Update(s.statusName, "Connected via "+MUX_LINK)
+}
+
+// detach returns true if the stream was attached.
+func (s *MuxStream) detach() bool {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if !s.connected {
+		return false
+	}
+	s.connected = false
+	s.status.Update(s.statusName, "Disconnected")
+	return true
+}
+
+// dispatch forwards a frame received for the stream: a cmd to RecvChan if
+// started (cmd stream), else to Recv (data stream).
+func (s *MuxStream) dispatch(frame *MuxFrame, done chan struct{}) {
+	s.mux.Lock()
+	started := s.started
+	s.mux.Unlock()
+	if !started {
+		select {
+		case s.frames <- frame:
+		default:
+			s.logger.Warn("Dropped frame, Recv not called")
+		}
+		return
+	}
+	cmd := &proto.Cmd{}
+	if err := json.Unmarshal(frame.Json, cmd); err != nil {
+		s.logger.Warn("Invalid cmd:", err)
+		return
+	}
+	select {
+	case s.recvChan <- cmd:
+	case <-done:
+	}
+}
+
+func (s *MuxStream) Start() {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if !s.started {
+		s.started = true
+		go s.send()
+	}
+}
+
+func (s *MuxStream) Stop() {
+	s.mux.Lock()
+	started := s.started
+	s.started = false
+	s.mux.Unlock()
+	if started {
+		s.sendSync.Stop()
+		s.sendSync.Wait()
+	}
+}
+
+func (s *MuxStream) Connect() {
+	s.m.connect()
+	s.attach()
+	s.notifyConnect(true)
+}
+
+func (s *MuxStream) ConnectOnce(timeout uint) error {
+	if err := s.m.connectOnce(timeout); err != nil {
+		return err
+	}
+	s.attach()
+	return nil
+}
+
+func (s *MuxStream) Disconnect() error {
+	if !s.isConnected() {
+		return nil
+	}
+	s.m.detach(s)
+	s.notifyConnect(false)
+	return nil
+}
+
+func (s *MuxStream) DisconnectOnce() error {
+	if !s.isConnected() {
+		return nil
+	}
+	s.m.detach(s)
+	return nil
+}
+
+func (s *MuxStream) send() {
+	s.logger.DebugOffline("send:call")
+	defer s.logger.DebugOffline("send:return")
+	defer s.sendSync.Done()
+	defer func() {
+		if err := recover(); err != nil {
+			log.Printf("ERROR: MuxStream.send crashed: %s\n", err)
+		}
+	}()
+
+	for {
+		// Wait to start (connect) or be told to stop.
+		select {
+		case <-s.sendSync.StartChan:
+			s.sendSync.StartChan <- true
+		case <-s.sendSync.StopChan:
+			return
+		}
+
+	SEND_LOOP:
+		for {
+			select {
+			case reply := <-s.sendChan:
+				if minSize := s.compression(); minSize > 0 {
+					compressed, err := CompressReply(reply, minSize)
+					if err != nil {
+						s.logger.Warn("Cannot compress reply:", err)
+					} else {
+						reply = compressed
+					}
+				}
+				if err := s.Send(reply, 10); err != nil {
+					s.logger.DebugOffline("send:err:", err)
+					select {
+					case s.errChan <- err:
+					default:
+					}
+					break SEND_LOOP
+				}
+			case <-s.sendSync.StopChan:
+				return
+			}
+		}
+
+		s.Disconnect()
+	}
+}
+
+func (s *MuxStream) SendChan() chan *proto.Reply {
+	return s.sendChan
+}
+
+func (s *MuxStream) RecvChan() chan *proto.Cmd {
+	return s.recvChan
+}
+
+func (s *MuxStream) Send(data interface{}, timeout uint) error {
+	if !s.isConnected() {
+		return ErrMuxNotConnected
+	}
+	bytes, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	return s.m.send(&MuxFrame{Stream: s.name, Json: bytes}, timeout)
+}
+
+func (s *MuxStream) SendBytes(data []byte, timeout uint) error {
+	if !s.isConnected() {
+		return ErrMuxNotConnected
+	}
+	return s.m.send(&MuxFrame{Stream: s.name, Bytes: data}, timeout)
+}
+
+func (s *MuxStream) Recv(data interface{}, timeout uint) error {
+	s.m.mux.Lock()
+	done := s.m.done
+	s.m.mux.Unlock()
+	if !s.isConnected() || done == nil {
+		return ErrMuxNotConnected
+	}
+	var timeoutChan <-chan time.Time
+	if timeout > 0 {
+		timeoutChan = time.After(time.Duration(timeout) * time.Second)
+	}
+	select {
+	case frame := <-s.frames:
+		return json.Unmarshal(frame.Json, data)
+	case <-done:
+		return ErrMuxNotConnected
+	case <-timeoutChan:
+		return fmt.Errorf("Recv timeout after %ds", timeout)
+	}
+}
+
+func (s *MuxStream) SetCompression(minSize int) {
+	s.compressMux.Lock()
+	defer s.compressMux.Unlock()
+	s.compressMinSize = minSize
+}
+
+func (s *MuxStream) compression() int {
+	s.compressMux.Lock()
+	defer s.compressMux.Unlock()
+	return s.compressMinSize
+}
+
+func (s *MuxStream) ConnectChan() chan bool {
+	return s.connectChan
+}
+
+func (s *MuxStream) ErrorChan() chan error {
+	return s.errChan
+}
+
+func (s *MuxStream) Conn() *websocket.Conn {
+	return s.m.ws.Conn()
+}
+
+// Status returns the stream status and queues, and the status of the shared
+// websocket, see WebsocketClient.Status.
+func (s *MuxStream) Status() map[string]string {
+	s.status.Update(s.statusName+"-queued", fmt.Sprintf("%d replies, %d cmds", len(s.sendChan), len(s.recvChan)))
+	return s.status.Merge(s.m.ws.Status())
+}
+
+func (s *MuxStream) notifyConnect(state bool) {
+	select {
+	case s.connectChan <- state:
+	case <-time.After(20 * time.Second):
+		s.logger.Error("notifyConnect timeout")
+	}
+}
@@ -0,0 +1,425 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"code.google.com/p/go.net/websocket"
+	"github.com/percona/cloud-protocol/proto/v1"
+	"github.com/percona/percona-agent/pct"
+)
+
+// POLL_WAIT is how long, in seconds, the API holds a poll request open if it
+// has no cmds.  It must be less than the API client read/write timeout.
+const POLL_WAIT = 5
+
+// POLL_IDLE is how long to wait before polling again if the API returned no
+// cmds without holding the request, i.e. it does not long-poll.
+const POLL_IDLE = 1 * time.Second
+
+// PollClient is an HTTPS long-poll transport for the cmd link.  It implements
+// pct.WebsocketClient for networks where the websocket cannot be established,
+// e.g. proxies that reject Upgrade.  The API queues cmds:
+//
+//	GET  <link>/poll?wait=N  returns []proto.Cmd, empty if none in N seconds
+//	POST <link>/poll         sends a proto.Reply
+//
+// where link is the agent link like wss://host/agents/<uuid>/cmd with the
+// https (or http) scheme.
+type PollClient struct {
+	logger *pct.Logger
+	api    pct.APIConnector
+	link   string
+	// --
+	connected bool
+	mux       *sync.Mutex // guard connected
+	// --
+	started         bool
+	recvChan        chan *proto.Cmd
+	sendChan        chan *proto.Reply
+	connectChan     chan bool
+	errChan         chan error
+	backoff         *pct.Backoff
+	sendSync        *pct.SyncChan
+	recvSync        *pct.SyncChan
+	status          *pct.Status
+	name            string
+	compressMinSize int
+	compressMux     *sync.Mutex // guard compressMinSize
+}
+
+// NewPollClient returns a client for the agent link, e.g. cmd.  API requests
+// have the API headers, see pct.API.
+func NewPollClient(logger *pct.Logger, api pct.APIConnector, link string) *PollClient {
+	name := logger.Service()
+	c := &PollClient{
+		logger: logger,
+		api:    api,
+		link:   link,
+		// --
+		mux: new(sync.Mutex),
+		// --
+		recvChan:    make(chan *proto.Cmd, RECV_BUFFER_SIZE),
+		sendChan:    make(chan *proto.Reply, SEND_BUFFER_SIZE),
+		connectChan: make(chan bool, 1),
+		errChan:     make(chan error, 2),
+		backoff:     pct.NewJitterBackoff(CONNECT_MIN_WAIT, CONNECT_MAX_WAIT, 5*time.Minute),
+		sendSync:    pct.NewSyncChan(),
+		recvSync:    pct.NewSyncChan(),
+		status:      pct.NewStatus([]string{name, name + "-link"}),
+		name:        name,
+		compressMux: new(sync.Mutex),
+	}
+	return c
+}
+
+// URL returns the poll URL of the agent link.
+func (c *PollClient) URL() string {
+	link := c.api.AgentLink(c.link)
+	if strings.HasPrefix(link, "wss://") {
+		link = "https://" + strings.TrimPrefix(link, "wss://")
+	} else if strings.HasPrefix(link, "ws://") {
+		link = "http://" + strings.TrimPrefix(link, "ws://")
+	}
+	return strings.TrimSuffix(link, "/") + "/poll"
+}
+
+func (c *PollClient) Start() {
+	// Start send() and recv() goroutines, but they wait for successful Connect().
+	if !c.started {
+		c.started = true
+		go c.send()
+		go c.recv()
+	}
+}
+
+func (c *PollClient) Stop() {
+	if c.started {
+		c.sendSync.Stop()
+		c.recvSync.Stop()
+		c.sendSync.Wait()
+		c.recvSync.Wait()
+		c.started = false
+	}
+}
+
+func (c *PollClient) Connect() {
+	c.logger.Debug("Connect:call")
+	defer c.logger.Debug("Connect:return")
+
+	for {
+		wait := c.backoff.Wait()
+		c.status.Update(c.name, fmt.Sprintf("Connect wait %s, next try at %s",
+			wait-wait%time.Millisecond, pct.TimeString(c.backoff.Next())))
+		time.Sleep(wait)
+
+		if err := c.ConnectOnce(10); err != nil {
+			c.logger.Warn(err)
+			if err := c.api.Failover(); err != nil {
+				c.logger.Warn(err)
+			}
+			continue
+		}
+		c.backoff.Success()
+		c.startChans()
+		c.notifyConnect(true)
+		return // success
+	}
+}
+
+// ConnectOnce polls once without waiting to check that the API has the poll
+// link.  timeout is not used: API requests have their own timeouts.
+func (c *PollClient) ConnectOnce(timeout uint) error {
+	c.logger.Debug("ConnectOnce:call")
+	defer c.logger.Debug("ConnectOnce:return")
+
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	url := c.URL()
+	c.status.Update(c.name, "Connecting "+url)
+	if _, err := c.poll(0); err != nil {
+		return err
+	}
+	c.connected = true
+	c.status.Update(c.name, "Connected "+url)
+	return nil
+}
+
+// startChans starts or resumes send() and recv() if Start() was called.
+func (c *PollClient) startChans() {
+	if c.started {
+		c.recvSync.Start()
+		c.sendSync.Start()
+	}
+}
+
+func (c *PollClient) Disconnect() error {
+	c.logger.DebugOffline("Disconnect:call")
+	defer c.logger.DebugOffline("Disconnect:return")
+
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	if !c.connected {
+		return nil
+	}
+	c.disconnect()
+	c.notifyConnect(false)
+	return nil
+}
+
+func (c *PollClient) DisconnectOnce() error {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	if c.connected {
+		c.disconnect()
+	}
+	return nil
+}
+
+func (c *PollClient) disconnect() {
+	// There's no connection to close: the next poll or send fails because
+	// recv() and send() check connected.
+	c.connected = false
+	c.status.Update(c.name, "Disconnected")
+}
+
+func (c *PollClient) isConnected() bool {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	return c.connected
+}
+
+func (c *PollClient) send() {
+	c.logger.DebugOffline("send:call")
+	defer c.logger.DebugOffline("send:return")
+	defer c.sendSync.Done()
+	defer func() {
+		if err := recover(); err != nil {
+			log.Printf("ERROR: PollClient.send crashed: %s\n", err)
+		}
+	}()
+
+	for {
+		// Wait to start (connect) or be told to stop.
+		select {
+		case <-c.sendSync.StartChan:
+			c.sendSync.StartChan <- true
+		case <-c.sendSync.StopChan:
+			return
+		}
+
+	SEND_LOOP:
+		for {
+			select {
+			case reply := <-c.sendChan:
+				if minSize := c.compression(); minSize > 0 {
+					compressed, err := CompressReply(reply, minSize)
+					if err != nil {
+						c.logger.Warn("Cannot compress reply:", err)
+					} else {
+						reply = compressed
+					}
+				}
+				if err := c.Send(reply, 10); err != nil {
+					c.logger.DebugOffline("send:err:", err)
+					select {
+					case c.errChan <- err:
+					default:
+					}
+					break SEND_LOOP
+				}
+			case <-c.sendSync.StopChan:
+				return
+			}
+		}
+
+		c.Disconnect()
+	}
+}
+
+func (c *PollClient) recv() {
+	c.logger.DebugOffline("recv:call")
+	defer c.logger.DebugOffline("recv:return")
+	defer c.recvSync.Done()
+	defer func() {
+		if err := recover(); err != nil {
+			log.Printf("ERROR: PollClient.recv crashed: %s\n", err)
+		}
+	}()
+
+	for {
+		// Wait to start (connect) or be told to stop.
+		select {
+		case <-c.recvSync.StartChan:
+			c.recvSync.StartChan <- true
+		case <-c.recvSync.StopChan:
+			return
+		}
+
+	RECV_LOOP:
+		for {
+			select {
+			case <-c.recvSync.StopChan:
+				return
+			default:
+			}
+			if !c.isConnected() {
+				break RECV_LOOP // disconnected by send() or the user
+			}
+
+			t0 := time.Now()
+			cmds, err := c.poll(POLL_WAIT)
+			if err != nil {
+				c.logger.DebugOffline("recv:err:", err)
+				select {
+				case c.errChan <- err:
+				default:
+				}
+				c.Disconnect()
+				break RECV_LOOP
+			}
+			for _, cmd := range cmds {
+				c.recvChan <- cmd
+			}
+			if len(cmds) == 0 && time.Now().Sub(t0) < POLL_IDLE {
+				time.Sleep(POLL_IDLE)
+			}
+		}
+	}
+}
+
+// poll gets the queued cmds, waiting up to wait seconds for one.
+func (c *PollClient) poll(wait int) ([]*proto.Cmd, error) {
+	url := fmt.Sprintf("%s?wait=%d", c.URL(), wait)
+	code, data, err := c.api.Get(c.api.ApiKey(), url)
+	if err != nil {
+		return nil, err
+	}
+	if code != http.StatusOK {
+		return nil, fmt.Errorf("GET %s: HTTP status code %d", url, code)
+	}
+	cmds := []*proto.Cmd{}
+	if len(data) == 0 {
+		return cmds, nil
+	}
+	if err := json.Unmarshal(data, &cmds); err != nil {
+		return nil, fmt.Errorf("GET %s: %s", url, err)
+	}
+	return cmds, nil
+}
+
+func (c *PollClient) SendChan() chan *proto.Reply {
+	return c.sendChan
+}
+
+func (c *PollClient) RecvChan() chan *proto.Cmd {
+	return c.recvChan
+}
+
+func (c *PollClient) Send(data interface{}, timeout uint) error {
+	bytes, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	return c.SendBytes(bytes, timeout)
+}
+
+func (c *PollClient) SendBytes(data []byte, timeout uint) error {
+	if !c.isConnected() {
+		return errors.New("Not connected")
+	}
+	url := c.URL()
+	resp, _, err := c.api.Post(c.api.ApiKey(), url, data)
+	if err != nil {
+		return err
+	}
+	if resp != nil && resp.StatusCode >= 300 {
+		return fmt.Errorf("POST %s: HTTP status code %d", url, resp.StatusCode)
+	}
+	return nil
+}
+
+// Recv gets the next queued cmd, waiting up to timeout seconds.  If more cmds
+// are queued, the others are sent on RecvChan.
+func (c *PollClient) Recv(data interface{}, timeout uint) error {
+	if !c.isConnected() {
+		return errors.New("Not connected")
+	}
+	cmds, err := c.poll(int(timeout))
+	if err != nil {
+		return err
+	}
+	if len(cmds) == 0 {
+		return errors.New("No cmd")
+	}
+	for _, cmd := range cmds[1:] {
+		c.recvChan <- cmd
+	}
+	bytes, err := json.Marshal(cmds[0])
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(bytes, data)
+}
+
+func (c *PollClient) SetCompression(minSize int) {
+	c.compressMux.Lock()
+	defer c.compressMux.Unlock()
+	c.compressMinSize = minSize
+}
+
+func (c *PollClient) compression() int {
+	c.compressMux.Lock()
+	defer c.compressMux.Unlock()
+	return c.compressMinSize
+}
+
+func (c *PollClient) ConnectChan() chan bool {
+	return c.connectChan
+}
+
+func (c *PollClient) ErrorChan() chan error {
+	return c.errChan
+}
+
+// Conn returns nil: there is no websocket.
+func (c *PollClient) Conn() *websocket.Conn {
+	return nil
+}
+
+func (c *PollClient) Status() map[string]string {
+	c.status.Update(c.name+"-link", c.URL())
+	return c.status.All()
+}
+
+func (c *PollClient) notifyConnect(state bool) {
+	select {
+	case c.connectChan <- state:
+	case <-time.After(20 * time.Second):
+		c.logger.Error("notifyConnect timeout")
+	}
+}
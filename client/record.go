@@ -0,0 +1,130 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package client
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	RECORD_SEND = "send" // agent to API
+	RECORD_RECV = "recv" // API to agent
+)
+
+// A Frame is one websocket frame in a recording.  JSON frames are in Json,
+// raw frames (SendBytes, e.g. data) are in Bytes.
+type Frame struct {
+	Ts    time.Time
+	Link  string          // cmd, log, or data
+	Dir   string          // RECORD_SEND or RECORD_RECV
+	Json  json.RawMessage `json:",omitempty"`
+	Bytes []byte          `json:",omitempty"`
+}
+
+// A Recorder writes the frames of websocket clients to a file, one JSON Frame
+// per line, to reproduce bugs with bin/percona-agent-replay.  Recordings
+// contain everything the agent sends, including query examples, so treat them
+// like the data spool.
+type Recorder struct {
+	file *os.File
+	w    *bufio.Writer
+	mux  *sync.Mutex // guard file and w
+}
+
+func NewRecorder(fileName string) (*Recorder, error) {
+	file, err := os.OpenFile(fileName, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	r := &Recorder{
+		file: file,
+		w:    bufio.NewWriter(file),
+		mux:  &sync.Mutex{},
+	}
+	return r, nil
+}
+
+// Record writes a JSON frame.  v is marshaled like websocket.JSON.Send does.
+func (r *Recorder) Record(link, dir string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return r.write(Frame{Ts: time.Now().UTC(), Link: link, Dir: dir, Json: data})
+}
+
+// RecordBytes writes a raw frame.
+func (r *Recorder) RecordBytes(link, dir string, data []byte) error {
+	return r.write(Frame{Ts: time.Now().UTC(), Link: link, Dir: dir, Bytes: data})
+}
+
+func (r *Recorder) write(f Frame) error {
+	line, err := json.Marshal(&f) // pointer for RawMessage.MarshalJSON
+	if err != nil {
+		return err
+	}
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	if r.file == nil {
+		return nil // closed
+	}
+	if _, err := r.w.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	// Flush every frame so the recording is complete if the agent crashes,
+	// which is usually the bug being recorded.
+	return r.w.Flush()
+}
+
+func (r *Recorder) Close() error {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	if r.file == nil {
+		return nil
+	}
+	r.w.Flush()
+	err := r.file.Close()
+	r.file = nil
+	return err
+}
+
+// ReadRecording returns the frames in a recording, oldest first.
+func ReadRecording(fileName string) ([]Frame, error) {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	frames := []Frame{}
+	d := json.NewDecoder(file)
+	for {
+		f := Frame{}
+		if err := d.Decode(&f); err == io.EOF {
+			break
+		} else if err != nil {
+			return frames, err
+		}
+		frames = append(frames, f)
+	}
+	return frames, nil
+}
@@ -0,0 +1,112 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package client
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/percona/percona-agent/pct"
+)
+
+// connStats are the connection statistics reported by WebsocketClient.Status
+// to show why data is lagging: bytes sent and received, reconnects, uptime,
+// and the last error.
+type connStats struct {
+	sent      uint64
+	recv      uint64
+	connects  uint
+	connectTs time.Time // zero if disconnected
+	lastErr   string
+	lastErrTs time.Time
+	mux       *sync.Mutex
+}
+
+func newConnStats() *connStats {
+	s := &connStats{
+		mux: &sync.Mutex{},
+	}
+	return s
+}
+
+func (s *connStats) connected(now time.Time) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.connects++
+	s.connectTs = now
+}
+
+func (s *connStats) disconnected() {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.connectTs = time.Time{}
+}
+
+func (s *connStats) error(err error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.lastErr = err.Error()
+	s.lastErrTs = time.Now()
+}
+
+func (s *connStats) add(sent, recv int) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.sent += uint64(sent)
+	s.recv += uint64(recv)
+}
+
+// update updates the <name>-bytes, -reconnects, -uptime, and -error status.
+func (s *connStats) update(status *pct.Status, name string, now time.Time) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	status.Update(name+"-bytes", fmt.Sprintf("sent %s, recv %s", pct.Bytes(s.sent), pct.Bytes(s.recv)))
+	reconnects := uint(0)
+	if s.connects > 1 {
+		reconnects = s.connects - 1
+	}
+	status.Update(name+"-reconnects", fmt.Sprintf("%d", reconnects))
+	if s.connectTs.IsZero() {
+		status.Update(name+"-uptime", "Disconnected")
+	} else {
+		status.Update(name+"-uptime", pct.Duration(now.Sub(s.connectTs).Seconds()))
+	}
+	if s.lastErr != "" {
+		status.Update(name+"-error", fmt.Sprintf("at %s: %s", pct.TimeString(s.lastErrTs), s.lastErr))
+	}
+}
+
+// statsConn counts the bytes read and written on a connection.
+type statsConn struct {
+	net.Conn
+	stats *connStats
+}
+
+func (c statsConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.stats.add(0, n)
+	return n, err
+}
+
+func (c statsConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.stats.add(n, 0)
+	return n, err
+}
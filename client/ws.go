@@ -32,6 +32,8 @@ import (
 const (
 	SEND_BUFFER_SIZE = 10
 	RECV_BUFFER_SIZE = 10
+	CONNECT_MIN_WAIT = 2 * time.Second
+	CONNECT_MAX_WAIT = 5 * time.Minute
 )
 
 type WebsocketClient struct {
@@ -54,6 +56,11 @@ type WebsocketClient struct {
 	recvSync    *pct.SyncChan
 	status      *pct.Status
 	name        string
+	stats       *connStats
+	// --
+	compressMinSize int
+	compressMux     *sync.Mutex // guard compressMinSize
+	recorder        *Recorder
 }
 
 func NewWebsocketClient(logger *pct.Logger, api pct.APIConnector, link string, headers map[string]string) (*WebsocketClient, error) {
@@ -71,11 +78,14 @@ func NewWebsocketClient(logger *pct.Logger, api pct.APIConnector, link string, h
 		sendChan:    make(chan *proto.Reply, SEND_BUFFER_SIZE),
 		connectChan: make(chan bool, 1),
 		errChan:     make(chan error, 2),
-		backoff:     pct.NewBackoff(5 * time.Minute),
+		backoff:     pct.NewJitterBackoff(CONNECT_MIN_WAIT, CONNECT_MAX_WAIT, 5*time.Minute),
 		sendSync:    pct.NewSyncChan(),
 		recvSync:    pct.NewSyncChan(),
-		status:      pct.NewStatus([]string{name, name + "-link"}),
+		status:      pct.NewStatus([]string{name, name + "-link", name + "-bytes", name + "-queued", name + "-reconnects", name + "-uptime", name + "-error"}),
 		name:        name,
+		stats:       newConnStats(),
+		// --
+		compressMux: new(sync.Mutex),
 	}
 	return c, nil
 }
@@ -107,26 +117,36 @@ func (c *WebsocketClient) Connect() {
 		// Wait before attempt to avoid DDoS'ing the API
 		// (there are many other agents in the world).
 		c.logger.Debug("Connect:backoff.Wait")
-		c.status.Update(c.name, "Connect wait")
-		time.Sleep(c.backoff.Wait())
+		wait := c.backoff.Wait()
+		c.status.Update(c.name, fmt.Sprintf("Connect wait %s, next try at %s",
+			wait-wait%time.Millisecond, pct.TimeString(c.backoff.Next())))
+		time.Sleep(wait)
 
-		if err := c.ConnectOnce(10); err != nil {
+		if err := c.ConnectOnce(0); err != nil {
 			c.logger.Warn(err)
+			// Try the next API host, if any, for the next attempt.
+			if err := c.api.Failover(); err != nil {
+				c.logger.Warn(err)
+			}
 			continue
 		}
 		c.backoff.Success()
-
-		// Start/resume send() and recv() goroutines if Start() was called.
-		if c.started {
-			c.recvSync.Start()
-			c.sendSync.Start()
-		}
-
+		c.startChans()
 		c.notifyConnect(true)
 		return // success
 	}
 }
 
+// startChans starts or resumes send() and recv() if Start() was called.
+func (c *WebsocketClient) startChans() {
+	if c.started {
+		c.recvSync.Start()
+		c.sendSync.Start()
+	}
+}
+
+// ConnectOnce connects once, waiting timeout seconds to connect, or the API
+// connect timeout (ApiDialTimeout) if 0.
 func (c *WebsocketClient) ConnectOnce(timeout uint) error {
 	c.logger.Debug("ConnectOnce:call")
 	defer c.logger.Debug("ConnectOnce:return")
@@ -152,11 +172,13 @@ func (c *WebsocketClient) ConnectOnce(timeout uint) error {
 	c.status.Update(c.name, "Connecting "+link)
 	conn, err := c.dialTimeout(config, timeout)
 	if err != nil {
+		c.stats.error(err)
 		return err
 	}
 
 	c.conn = conn
 	c.connected = true
+	c.stats.connected(time.Now())
 	c.status.Update(c.name, "Connected "+link)
 
 	return nil
@@ -176,14 +198,17 @@ func (c *WebsocketClient) dialTimeout(config *websocket.Config, timeout uint) (w
 		return nil, websocket.ErrBadWebSocketOrigin
 	}
 
+	// Connect directly or through a proxy (HTTP CONNECT), then do TLS for wss.
 	var conn net.Conn
+	dialTimeout := time.Duration(timeout) * time.Second
+	if timeout == 0 {
+		dialTimeout = pct.GetAPIOptions().ConnectTimeout
+	}
+	addr := pct.HostPort(config.Location.Host, config.Location.Scheme)
 	switch config.Location.Scheme {
 	case "ws":
-		conn, err = net.DialTimeout("tcp", config.Location.Host, time.Duration(timeout)*time.Second)
+		conn, err = pct.ProxyDial(config.Location, addr, dialTimeout)
 	case "wss":
-		dialer := &net.Dialer{
-			Timeout: time.Duration(timeout) * time.Second,
-		}
 		if config.Location.Host == "localhost:8443" {
 			// Test uses mock ws server which uses self-signed cert which causes Go to throw
 			// an error like "x509: certificate signed by unknown authority".  This disables
@@ -192,7 +217,13 @@ func (c *WebsocketClient) dialTimeout(config *websocket.Config, timeout uint) (w
 				InsecureSkipVerify: true,
 			}
 		}
-		conn, err = tls.DialWithDialer(dialer, "tcp", config.Location.Host, config.TlsConfig)
+		if config.TlsConfig == nil {
+			config.TlsConfig = pct.TLSConfig() // CA, client cert
+		}
+		var tlsConn *tls.Conn
+		if tlsConn, err = pct.TLSDial(config.Location, addr, dialTimeout, config.TlsConfig); err == nil {
+			conn = tlsConn
+		}
 	default:
 		err = websocket.ErrBadScheme
 	}
@@ -200,6 +231,9 @@ func (c *WebsocketClient) dialTimeout(config *websocket.Config, timeout uint) (w
 		return nil, &websocket.DialError{config, err}
 	}
 
+	// Count bytes sent and received, after TLS, see Status.
+	conn = statsConn{Conn: conn, stats: c.stats}
+
 	ws, err = websocket.NewClient(config, conn)
 	if err != nil {
 		return nil, err
@@ -272,6 +306,7 @@ func (c *WebsocketClient) disconnect() error {
 	 * just return an error, which is a lot better than a panic.
 	 */
 	c.connected = false
+	c.stats.disconnected()
 
 	c.logger.DebugOffline("disconnected")
 	c.status.Update(c.name, "Disconnected")
@@ -310,6 +345,14 @@ func (c *WebsocketClient) send() {
 			case reply := <-c.sendChan:
 				// Got Reply from agent, send to API.
 				c.logger.DebugOffline("send:reply:", reply)
+				if minSize := c.compression(); minSize > 0 {
+					compressed, err := CompressReply(reply, minSize)
+					if err != nil {
+						c.logger.Warn("Cannot compress reply:", err)
+					} else {
+						reply = compressed
+					}
+				}
 				if err := c.Send(reply, 10); err != nil {
 					c.logger.DebugOffline("send:err:", err)
 					select {
@@ -403,7 +446,14 @@ func (c *WebsocketClient) Send(data interface{}, timeout uint) error {
 	} else {
 		c.conn.SetWriteDeadline(time.Time{})
 	}
-	return websocket.JSON.Send(c.conn, data)
+	if err := websocket.JSON.Send(c.conn, data); err != nil {
+		c.stats.error(err)
+		return err
+	}
+	if c.recorder != nil {
+		c.recorder.Record(c.link, RECORD_SEND, data)
+	}
+	return nil
 }
 
 func (c *WebsocketClient) SendBytes(data []byte, timeout uint) error {
@@ -415,7 +465,14 @@ func (c *WebsocketClient) SendBytes(data []byte, timeout uint) error {
 		c.conn.SetWriteDeadline(time.Time{})
 	}
 	defer c.conn.SetWriteDeadline(time.Time{})
-	return websocket.Message.Send(c.conn, data)
+	if err := websocket.Message.Send(c.conn, data); err != nil {
+		c.stats.error(err)
+		return err
+	}
+	if c.recorder != nil {
+		c.recorder.RecordBytes(c.link, RECORD_SEND, data)
+	}
+	return nil
 }
 
 func (c *WebsocketClient) Recv(data interface{}, timeout uint) error {
@@ -427,7 +484,34 @@ func (c *WebsocketClient) Recv(data interface{}, timeout uint) error {
 	} else {
 		c.conn.SetReadDeadline(time.Time{})
 	}
-	return websocket.JSON.Receive(c.conn, data)
+	if err := websocket.JSON.Receive(c.conn, data); err != nil {
+		c.stats.error(err)
+		return err
+	}
+	if c.recorder != nil {
+		c.recorder.Record(c.link, RECORD_RECV, data)
+	}
+	return nil
+}
+
+// SetRecorder records all frames sent and received.  Call it before Start.
+func (c *WebsocketClient) SetRecorder(r *Recorder) {
+	c.recorder = r
+}
+
+// SetCompression compresses Reply.Data larger than minSize bytes sent on the
+// send chan, or disables compression if minSize is zero.  Only set it if the
+// API can decompress replies, see CompressReply.
+func (c *WebsocketClient) SetCompression(minSize int) {
+	c.compressMux.Lock()
+	defer c.compressMux.Unlock()
+	c.compressMinSize = minSize
+}
+
+func (c *WebsocketClient) compression() int {
+	c.compressMux.Lock()
+	defer c.compressMux.Unlock()
+	return c.compressMinSize
 }
 
 func (c *WebsocketClient) ConnectChan() chan bool {
@@ -442,8 +526,12 @@ func (c *WebsocketClient) Conn() *websocket.Conn {
 	return c.conn
 }
 
+// Status returns the connection status, link, bytes sent and received,
+// replies and cmds queued, reconnects, uptime, and the last error.
 func (c *WebsocketClient) Status() map[string]string {
 	c.status.Update(c.name+"-link", c.api.AgentLink(c.link))
+	c.status.Update(c.name+"-queued", fmt.Sprintf("%d replies, %d cmds", len(c.sendChan), len(c.recvChan)))
+	c.stats.update(c.status, c.name, time.Now())
 	return c.status.All()
 }
 
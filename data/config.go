@@ -27,11 +27,23 @@ const (
 	DEFAULT_DATA_MAX_AGE       = 3600             // 1h
 	DEFAULT_DATA_MAX_SIZE      = 1024 * 1024 * 10 // 10 MiB
 	DEFAULT_DATA_MAX_FILES     = 100
+
+	// Offline, data is retained until sent by Drain or going online.
+	DEFAULT_OFFLINE_MAX_AGE   = 86400 * 7                   // 7d
+	DEFAULT_OFFLINE_MAX_SIZE  = 1024 * 1024 * 1024          // 1 GiB
+	DEFAULT_OFFLINE_MAX_FILES = DEFAULT_OFFLINE_MAX_AGE / 6 // 10 files/min for MaxAge
+
+	// Secondary API data is spooled in the data dir plus this suffix.
+	SECONDARY_DIR_SUFFIX = "-secondary"
 )
 
 type Config struct {
-	Encoding     string
-	SendInterval uint
-	Blackhole    bool // don't send if true
-	Limits       proto.DataSpoolLimits
+	Encoding      string
+	SendInterval  uint
+	BatchWindow   uint // seconds, send when oldest data is this old, 0 = every SendInterval
+	Blackhole     bool // don't send if true
+	Limits        proto.DataSpoolLimits
+	Offline       bool                  // don't send, only spool, see Manager.Drain
+	OfflineLimits proto.DataSpoolLimits // used instead of Limits while Offline
+	Stream        bool                  // also write data as JSON lines to the local data socket, see Stream
 }
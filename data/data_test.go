@@ -18,14 +18,18 @@
 package data_test
 
 import (
+	"bufio"
 	"bytes"
 	"compress/gzip"
 	"encoding/json"
+	"fmt"
 	"io"
 	"io/ioutil"
+	"net"
 	"os"
 	"path"
 	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
@@ -34,6 +38,7 @@ import (
 	"github.com/percona/percona-agent/pct"
 	"github.com/percona/percona-agent/test"
 	"github.com/percona/percona-agent/test/mock"
+	"github.com/ugorji/go/codec"
 	. "gopkg.in/check.v1"
 )
 
@@ -172,6 +177,105 @@ func (s *DiskvSpoolerTestSuite) TestSpoolData(t *C) {
 	spool.Stop()
 }
 
+func (s *DiskvSpoolerTestSuite) TestTee(t *C) {
+	sz := data.NewJsonSerializer()
+	teeDir := s.dataDir + data.SECONDARY_DIR_SUFFIX
+	defer os.RemoveAll(teeDir)
+
+	// The tee spool, e.g. for a secondary API, has its own files.
+	tee := data.NewDiskvSpooler(s.logger, teeDir, s.trashDir, "localhost", s.limits)
+	err := tee.Start(sz)
+	t.Assert(err, IsNil)
+	defer tee.Stop()
+
+	spool := data.NewDiskvSpooler(s.logger, s.dataDir, s.trashDir, "localhost", s.limits)
+	spool.Tee(tee)
+	err = spool.Start(sz)
+	t.Assert(err, IsNil)
+	defer spool.Stop()
+
+	spool.Write("mm", map[string]string{"foo": "bar"})
+	files := test.WaitFiles(s.dataDir, 1)
+	t.Assert(files, HasLen, 1)
+	teeFiles := test.WaitFiles(teeDir, 1)
+	t.Assert(teeFiles, HasLen, 1)
+
+	// Removing a file from one spool doesn't remove it from the other.
+	spool.Remove(files[0].Name())
+	files = test.WaitFiles(s.dataDir, -1)
+	t.Check(files, HasLen, 0)
+	gotFiles := []string{}
+	for file := range tee.Files() {
+		gotFiles = append(gotFiles, file)
+	}
+	t.Check(gotFiles, DeepEquals, []string{teeFiles[0].Name()})
+}
+
+func (s *DiskvSpoolerTestSuite) TestStream(t *C) {
+	socket := filepath.Join(s.basedir, "data.sock")
+	stream := data.NewStream(s.logger, socket)
+	err := stream.Start()
+	t.Assert(err, IsNil)
+	defer stream.Stop()
+
+	spool := data.NewDiskvSpooler(s.logger, s.dataDir, s.trashDir, "localhost", s.limits)
+	spool.SetStream(stream)
+	err = spool.Start(data.NewJsonSerializer())
+	t.Assert(err, IsNil)
+	defer spool.Stop()
+
+	conn, err := net.Dial("unix", socket)
+	t.Assert(err, IsNil)
+	defer conn.Close()
+	for i := 0; i < 20 && stream.Clients() == 0; i++ {
+		time.Sleep(50 * time.Millisecond)
+	}
+	t.Assert(stream.Clients(), Equals, 1)
+
+	// Spooled data is also streamed as a JSON line.
+	err = spool.Write("mm", map[string]string{"foo": "bar"})
+	t.Assert(err, IsNil)
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	line, err := bufio.NewReader(conn).ReadBytes('\n')
+	t.Assert(err, IsNil)
+	got := data.StreamLine{}
+	err = json.Unmarshal(line, &got)
+	t.Assert(err, IsNil)
+	t.Check(got.Service, Equals, "mm")
+	t.Check(got.Data, DeepEquals, map[string]interface{}{"foo": "bar"})
+
+	// Stopping disconnects clients.
+	stream.Stop()
+	t.Check(stream.Clients(), Equals, 0)
+	t.Check(pct.FileExists(socket), Equals, false)
+}
+
+func (s *DiskvSpoolerTestSuite) TestSpoolPriority(t *C) {
+	sz := data.NewJsonSerializer()
+	spool := data.NewDiskvSpooler(s.logger, s.dataDir, s.trashDir, "localhost", s.limits)
+	t.Assert(spool, NotNil)
+	if err := spool.Start(sz); err != nil {
+		t.Fatal(err)
+	}
+	defer spool.Stop()
+
+	// Spool bulk data first, then normal data, then high priority data.
+	for _, service := range []string{"qan", "mm", "log"} {
+		spool.Write(service, &proto.LogEntry{Ts: time.Now(), Msg: service})
+		time.Sleep(10 * time.Millisecond)
+	}
+	files := test.WaitFiles(s.dataDir, 3)
+	t.Assert(files, HasLen, 3)
+
+	// Files are returned highest priority first.
+	gotServices := []string{}
+	for file := range spool.Files() {
+		gotServices = append(gotServices, strings.Split(file, "_")[0])
+		spool.Remove(file)
+	}
+	t.Check(gotServices, DeepEquals, []string{"log", "mm", "qan"})
+}
+
 func (s *DiskvSpoolerTestSuite) TestSpoolGzipData(t *C) {
 	// Same as TestSpoolData, but use the gzip serializer.
 
@@ -297,6 +401,34 @@ func (s *DiskvSpoolerTestSuite) TestSpoolGzipData(t *C) {
 	spool.Stop()
 }
 
+func (s *DiskvSpoolerTestSuite) TestMsgpackSerializer(t *C) {
+	logEntry := &proto.LogEntry{
+		Level:   1,
+		Service: "mm",
+		Msg:     "hello world",
+	}
+	for _, gz := range []bool{false, true} {
+		sz := data.NewMsgpackSerializer(gz)
+		t.Check(sz.ContentType(), Equals, "application/x-msgpack")
+		encoded, err := sz.ToBytes(logEntry)
+		t.Assert(err, IsNil)
+		var r io.Reader = strings.NewReader(string(encoded))
+		if gz {
+			t.Check(sz.Encoding(), Equals, "msgpack+gzip")
+			r, err = gzip.NewReader(r)
+			t.Assert(err, IsNil)
+		} else {
+			t.Check(sz.Encoding(), Equals, "msgpack")
+		}
+		got := map[string]interface{}{}
+		h := &codec.MsgpackHandle{}
+		h.RawToString = true
+		t.Assert(codec.NewDecoder(r, h).Decode(&got), IsNil)
+		t.Check(got["Service"], Equals, "mm")
+		t.Check(got["Msg"], Equals, "hello world")
+	}
+}
+
 func (s *DiskvSpoolerTestSuite) TestRejectData(t *C) {
 	sz := data.NewJsonSerializer()
 
@@ -532,7 +664,7 @@ func (s *SenderTestSuite) TestSendData(t *C) {
 
 	sender := data.NewSender(s.logger, s.client)
 
-	err = sender.Start(spool, s.tickerChan, 5, false)
+	err = sender.Start(spool, s.tickerChan, 5, false, 0)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -569,6 +701,49 @@ func (s *SenderTestSuite) TestSendData(t *C) {
 	t.Check(len(spool.RejectedFiles), Equals, 0)
 }
 
+func (s *SenderTestSuite) TestBatchWindow(t *C) {
+	spool := mock.NewSpooler(nil)
+
+	slow001, err := ioutil.ReadFile(sample + "slow001.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Spool file names are <service>_<nano unix ts>.
+	newFile := fmt.Sprintf("qan_%d", time.Now().UnixNano())
+	spool.FilesOut = []string{newFile}
+	spool.DataOut = map[string][]byte{newFile: slow001}
+
+	sender := data.NewSender(s.logger, s.client)
+	err = sender.Start(spool, s.tickerChan, 5, false, 300) // 5m batch window
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sender.Stop()
+
+	// Data is newer than the batch window, so it's not sent.
+	s.tickerChan <- time.Now()
+	data := test.WaitBytes(s.dataChan)
+	if len(data) != 0 {
+		t.Errorf("Data sent before batch window; got %+v", data)
+	}
+
+	// Once the oldest data is older than the batch window, all data is sent.
+	oldFile := fmt.Sprintf("qan_%d", time.Now().Add(-301*time.Second).UnixNano())
+	spool.FilesOut = []string{oldFile, newFile}
+	spool.DataOut = map[string][]byte{oldFile: slow001, newFile: slow001}
+	s.tickerChan <- time.Now()
+	data = test.WaitBytes(s.dataChan)
+	t.Assert(data, Not(HasLen), 0)
+	for i := 0; i < 2; i++ {
+		select {
+		case s.respChan <- &proto.Response{Code: 200}:
+		case <-time.After(500 * time.Millisecond):
+			t.Error("Sender receives prot.Response after sending data")
+		}
+	}
+}
+
 func (s *SenderTestSuite) TestBlackhole(t *C) {
 	spool := mock.NewSpooler(nil)
 
@@ -582,7 +757,7 @@ func (s *SenderTestSuite) TestBlackhole(t *C) {
 
 	sender := data.NewSender(s.logger, s.client)
 
-	err = sender.Start(spool, s.tickerChan, 5, true) // <- true = enable blackhole
+	err = sender.Start(spool, s.tickerChan, 5, true, 0) // <- true = enable blackhole
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -605,6 +780,49 @@ func (s *SenderTestSuite) TestBlackhole(t *C) {
 	t.Assert(err, IsNil)
 }
 
+func (s *SenderTestSuite) TestOfflineDrain(t *C) {
+	spool := mock.NewSpooler(nil)
+
+	slow001, err := ioutil.ReadFile(sample + "slow001.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	spool.FilesOut = []string{"slow001.json"}
+	spool.DataOut = map[string][]byte{"slow001.json": slow001}
+
+	sender := data.NewSender(s.logger, s.client)
+	sender.SetOffline(true)
+	err = sender.Start(spool, s.tickerChan, 5, false, 0)
+	t.Assert(err, IsNil)
+
+	// Offline, data is not sent on tick...
+	s.tickerChan <- time.Now()
+	data := test.WaitBytes(s.dataChan)
+	if len(data) != 0 {
+		t.Errorf("Data sent while offline; got %+v", data)
+	}
+	t.Check(spool.DataOut, HasLen, 1)
+
+	// ...only on Drain.
+	err = sender.Drain()
+	t.Assert(err, IsNil)
+	data = test.WaitBytes(s.dataChan)
+	t.Assert(data, Not(HasLen), 0)
+	if same, diff := test.IsDeeply(data[0], slow001); !same {
+		t.Error(diff)
+	}
+	select {
+	case s.respChan <- &proto.Response{Code: 200}:
+	case <-time.After(500 * time.Millisecond):
+		t.Error("Sender receives prot.Response after sending data")
+	}
+
+	err = sender.Stop()
+	t.Assert(err, IsNil)
+	t.Check(spool.DataOut, HasLen, 0)
+}
+
 func (s *SenderTestSuite) TestSendEmptyFile(t *C) {
 	// Make mock spooler which returns a single file name and zero bytes
 	// for that file.
@@ -614,7 +832,7 @@ func (s *SenderTestSuite) TestSendEmptyFile(t *C) {
 
 	// Start the sender.
 	sender := data.NewSender(s.logger, s.client)
-	err := sender.Start(spool, s.tickerChan, 5, false)
+	err := sender.Start(spool, s.tickerChan, 5, false, 0)
 	t.Assert(err, IsNil)
 
 	// Tick to make sender send.
@@ -639,7 +857,7 @@ func (s *SenderTestSuite) TestConnectErrors(t *C) {
 
 	sender := data.NewSender(s.logger, s.client)
 
-	err := sender.Start(spool, s.tickerChan, 60, false)
+	err := sender.Start(spool, s.tickerChan, 60, false, 0)
 	t.Assert(err, IsNil)
 
 	// Any connect error will do.
@@ -693,7 +911,7 @@ func (s *SenderTestSuite) TestRecvErrors(t *C) {
 
 	sender := data.NewSender(s.logger, s.client)
 
-	err := sender.Start(spool, s.tickerChan, 60, false)
+	err := sender.Start(spool, s.tickerChan, 60, false, 0)
 	t.Assert(err, IsNil)
 
 	// Any recv error will do.
@@ -763,7 +981,7 @@ func (s *SenderTestSuite) Test500Error(t *C) {
 	}
 
 	sender := data.NewSender(s.logger, s.client)
-	err := sender.Start(spool, s.tickerChan, 5, false)
+	err := sender.Start(spool, s.tickerChan, 5, false, 0)
 	t.Assert(err, IsNil)
 
 	s.tickerChan <- time.Now()
@@ -816,7 +1034,7 @@ func (s *SenderTestSuite) TestBadFiles(t *C) {
 	}
 
 	sender := data.NewSender(s.logger, s.client)
-	err := sender.Start(spool, s.tickerChan, 5, false)
+	err := sender.Start(spool, s.tickerChan, 5, false, 0)
 	t.Assert(err, IsNil)
 
 	doneChan := make(chan bool, 1)
@@ -880,7 +1098,7 @@ func (s *ManagerTestSuite) SetUpSuite(t *C) {
 	if err := pct.Basedir.Init(s.basedir); err != nil {
 		t.Fatal(err)
 	}
-	s.dataDir = pct.Basedir.Dir("data")
+	s.dataDir = pct.Basedir.Dir("spool")
 	s.trashDir = path.Join(s.basedir, "trash")
 
 	s.logChan = make(chan *proto.LogEntry, 10)
@@ -1036,8 +1254,8 @@ func (s *ManagerTestSuite) TestSetConfig(t *C) {
 		t.Error(diff)
 	}
 
-	// Verify new config on disk.
-	content, err := ioutil.ReadFile(pct.Basedir.ConfigFile("data"))
+	// Verify new config is saved.
+	content, err := pct.Basedir.ConfigData("data")
 	t.Assert(err, IsNil)
 	gotConfig := &data.Config{}
 	if err := json.Unmarshal(content, gotConfig); err != nil {
@@ -1087,8 +1305,8 @@ func (s *ManagerTestSuite) TestSetConfig(t *C) {
 		t.Error(diff)
 	}
 
-	// Verify new config on disk.
-	content, err = ioutil.ReadFile(pct.Basedir.ConfigFile("data"))
+	// Verify new config is saved.
+	content, err = pct.Basedir.ConfigData("data")
 	t.Assert(err, IsNil)
 	gotConfig = &data.Config{}
 	if err := json.Unmarshal(content, gotConfig); err != nil {
@@ -21,6 +21,7 @@ import (
 	"encoding/json"
 	"errors"
 	"os"
+	"strings"
 	"sync"
 	"time"
 
@@ -35,13 +36,19 @@ type Manager struct {
 	hostname string
 	client   pct.WebsocketClient
 	// --
-	config  *Config
-	running bool
-	mux     *sync.Mutex // guards config and running
-	sz      Serializer
-	spooler Spooler
-	sender  *Sender
-	status  *pct.Status
+	config   *Config
+	running  bool
+	mux      *sync.Mutex // guards config and running
+	sz       Serializer
+	spooler  *DiskvSpooler
+	sender   *Sender
+	stream   *Stream
+	recorder Recorder
+	status   *pct.Status
+	// --
+	secondaryClient  pct.WebsocketClient
+	secondarySpooler *DiskvSpooler
+	secondarySender  *Sender
 }
 
 func NewManager(logger *pct.Logger, dataDir, trashDir, hostname string, client pct.WebsocketClient) *Manager {
@@ -52,12 +59,30 @@ func NewManager(logger *pct.Logger, dataDir, trashDir, hostname string, client p
 		hostname: hostname,
 		client:   client,
 		// --
-		status: pct.NewStatus([]string{"data"}),
+		status: pct.NewStatus([]string{"data", "data-volume"}),
 		mux:    &sync.Mutex{},
 	}
 	return m
 }
 
+// SetSecondary makes the manager also send all data to a secondary API with
+// the client.  The secondary API has its own spool, in dataDir plus
+// SECONDARY_DIR_SUFFIX, and sender, so each API receives all data even if
+// the other is down.  Call it before Start.
+func (m *Manager) SetSecondary(client pct.WebsocketClient) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	m.secondaryClient = client
+}
+
+// SetRecorder makes the spooler pass all data to the recorder, e.g. the local
+// history.  Call it before Start.
+func (m *Manager) SetRecorder(recorder Recorder) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	m.recorder = recorder
+}
+
 /////////////////////////////////////////////////////////////////////////////
 // Interface
 /////////////////////////////////////////////////////////////////////////////
@@ -104,12 +129,27 @@ func (m *Manager) Start() error {
 		m.dataDir,
 		m.trashDir,
 		m.hostname,
-		config.Limits,
+		spoolLimits(config),
+	)
+	stream := NewStream(
+		pct.NewLogger(m.logger.LogChan(), "data-stream"),
+		pct.Basedir.File("data-socket"),
 	)
+	if config.Stream {
+		if err := stream.Start(); err != nil {
+			// Not fatal: data is still sent to the API.
+			m.logger.Error("Cannot start data stream:", err)
+		}
+	}
+	spooler.SetStream(stream)
+	if m.recorder != nil {
+		spooler.SetRecorder(m.recorder)
+	}
 	if err := spooler.Start(sz); err != nil {
 		return err
 	}
 	m.spooler = spooler
+	m.stream = stream
 
 	// Start data sender.
 	m.status.Update("data", "Starting sender")
@@ -117,11 +157,43 @@ func (m *Manager) Start() error {
 		pct.NewLogger(m.logger.LogChan(), "data-sender"),
 		m.client,
 	)
-	if err := sender.Start(m.spooler, time.Tick(time.Duration(config.SendInterval)*time.Second), config.SendInterval, config.Blackhole); err != nil {
+	sender.SetOffline(config.Offline)
+	if err := sender.Start(m.spooler, time.Tick(time.Duration(config.SendInterval)*time.Second), config.SendInterval, config.Blackhole, config.BatchWindow); err != nil {
 		return err
 	}
 	m.sender = sender
 
+	// Start secondary API spooler and sender, if any.  The primary spooler
+	// writes all data to the secondary spooler, too.
+	if m.secondaryClient != nil {
+		m.status.Update("data", "Starting secondary spooler and sender")
+		secondarySpooler := NewDiskvSpooler(
+			pct.NewLogger(m.logger.LogChan(), "data-spooler-secondary"),
+			m.dataDir+SECONDARY_DIR_SUFFIX,
+			m.trashDir,
+			m.hostname,
+			spoolLimits(config),
+		)
+		if err := secondarySpooler.Start(sz); err != nil {
+			return err
+		}
+		secondarySender := NewSender(
+			pct.NewLogger(m.logger.LogChan(), "data-sender-secondary"),
+			m.secondaryClient,
+		)
+		secondarySender.SetOffline(config.Offline)
+		if err := secondarySender.Start(secondarySpooler, time.Tick(time.Duration(config.SendInterval)*time.Second), config.SendInterval, config.Blackhole, config.BatchWindow); err != nil {
+			return err
+		}
+		m.spooler.Tee(secondarySpooler)
+		m.secondarySpooler = secondarySpooler
+		m.secondarySender = secondarySender
+	}
+
+	if config.Offline {
+		m.logger.Warn("Offline: spooling but not sending data until Drain or Online")
+	}
+
 	m.config = config
 	m.running = true
 
@@ -133,9 +205,19 @@ func (m *Manager) Start() error {
 func (m *Manager) Stop() error {
 	m.status.Update("data", "Stopping sender")
 	m.sender.Stop()
+	if m.secondarySender != nil {
+		m.secondarySender.Stop()
+	}
 
 	m.status.Update("data", "Stopping spooler")
 	m.spooler.Stop()
+	m.stream.Stop()
+	if m.secondarySpooler != nil {
+		m.spooler.Tee(nil)
+		m.secondarySpooler.Stop()
+		m.secondarySpooler = nil
+		m.secondarySender = nil
+	}
 
 	m.logger.Info("data", "Stopped")
 	m.status.Update("data", "Stopped")
@@ -160,16 +242,57 @@ func (m *Manager) Handle(cmd *proto.Cmd) *proto.Reply {
 	case "SetConfig":
 		newConfig, errs := m.handleSetConfig(cmd)
 		return cmd.Reply(newConfig, errs...)
+	case "ValidateConfig":
+		// Like SetConfig but only report what would change.
+		newConfig := &Config{}
+		if err := pct.UnmarshalConfig(cmd.Data, newConfig); err != nil {
+			return cmd.Reply(nil, err)
+		}
+		if err := m.validateConfig(newConfig); err != nil {
+			return cmd.Reply(nil, err)
+		}
+		m.mux.Lock()
+		currentConfig := *m.config
+		m.mux.Unlock()
+		changes, err := pct.ConfigChanges(currentConfig, newConfig)
+		return cmd.Reply(changes, err)
 	case "Purge":
 		removed, errs := m.handlePurge(cmd)
 		return cmd.Reply(removed, errs...)
+	case "Offline", "Online":
+		config, err := m.setOffline(cmd.Cmd == "Offline")
+		return cmd.Reply(config, err)
+	case "Drain":
+		if m.secondarySender != nil {
+			if err := m.secondarySender.Drain(); err != nil {
+				m.logger.Warn("Secondary API:", err)
+			}
+		}
+		return cmd.Reply(nil, m.sender.Drain())
+	case "GetVolume":
+		// Bytes spooled and sent per data type per day, see pct.DataVolume.
+		return cmd.Reply(pct.DataVolume.All())
 	default:
 		return cmd.Reply(nil, pct.UnknownCmdError{Cmd: cmd.Cmd})
 	}
 }
 
 func (m *Manager) Status() map[string]string {
-	return m.status.Merge(m.client.Status(), m.spooler.Status(), m.sender.Status())
+	// Today's bytes spooled/sent per data type.
+	m.status.Update("data-volume", pct.FormatVolume(pct.DataVolume.Day(time.Now())))
+	status := m.status.Merge(m.client.Status(), m.spooler.Status(), m.sender.Status(), m.stream.Status())
+	if m.secondarySender != nil {
+		// The secondary spooler and sender have the same status names.
+		for _, s := range []map[string]string{m.secondarySpooler.Status(), m.secondarySender.Status()} {
+			for name, value := range s {
+				if !strings.HasPrefix(name, "secondary-") {
+					name = "secondary-" + name
+				}
+				status[name] = value
+			}
+		}
+	}
+	return status
 }
 
 func (m *Manager) GetConfig() ([]proto.AgentConfig, []error) {
@@ -199,8 +322,12 @@ func (m *Manager) Sender() *Sender {
 	return m.sender
 }
 
+func (m *Manager) Stream() *Stream {
+	return m.stream
+}
+
 func (m *Manager) validateConfig(config *Config) error {
-	if config.Encoding != "" && config.Encoding != "gzip" {
+	if _, err := makeSerializer(config.Encoding); err != nil {
 		return errors.New("Invalid data encoding: " + config.Encoding)
 	}
 
@@ -215,6 +342,11 @@ func (m *Manager) validateConfig(config *Config) error {
 		config.SendInterval = DEFAULT_DATA_SEND_INTERVAL
 	}
 
+	// Don't hold data too long: it's purged after Limits.MaxAge (default 1 hour).
+	if config.BatchWindow > 3600 {
+		return errors.New("BatchWindow must be <= 3600 (1 hour)")
+	}
+
 	// as of 1.0.13
 	if config.Limits.MaxAge == 0 {
 		config.Limits.MaxAge = DEFAULT_DATA_MAX_AGE
@@ -231,7 +363,7 @@ func (m *Manager) validateConfig(config *Config) error {
 
 func (m *Manager) handleSetConfig(cmd *proto.Cmd) (interface{}, []error) {
 	newConfig := &Config{}
-	if err := json.Unmarshal(cmd.Data, newConfig); err != nil {
+	if err := pct.UnmarshalConfig(cmd.Data, newConfig); err != nil {
 		return nil, []error{err}
 	}
 
@@ -249,12 +381,19 @@ func (m *Manager) handleSetConfig(cmd *proto.Cmd) (interface{}, []error) {
 	 * Data sender
 	 */
 
-	if newConfig.SendInterval != finalConfig.SendInterval {
+	if newConfig.SendInterval != finalConfig.SendInterval || newConfig.BatchWindow != finalConfig.BatchWindow {
 		m.sender.Stop()
-		if err := m.sender.Start(m.spooler, time.Tick(time.Duration(newConfig.SendInterval)*time.Second), newConfig.SendInterval, newConfig.Blackhole); err != nil {
+		if err := m.sender.Start(m.spooler, time.Tick(time.Duration(newConfig.SendInterval)*time.Second), newConfig.SendInterval, newConfig.Blackhole, newConfig.BatchWindow); err != nil {
 			errs = append(errs, err)
 		} else {
 			finalConfig.SendInterval = newConfig.SendInterval
+			finalConfig.BatchWindow = newConfig.BatchWindow
+		}
+		if m.secondarySender != nil {
+			m.secondarySender.Stop()
+			if err := m.secondarySender.Start(m.secondarySpooler, time.Tick(time.Duration(finalConfig.SendInterval)*time.Second), finalConfig.SendInterval, newConfig.Blackhole, finalConfig.BatchWindow); err != nil {
+				errs = append(errs, err)
+			}
 		}
 	}
 
@@ -273,9 +412,55 @@ func (m *Manager) handleSetConfig(cmd *proto.Cmd) (interface{}, []error) {
 			} else {
 				finalConfig.Encoding = newConfig.Encoding
 			}
+			if m.secondarySpooler != nil {
+				m.secondarySpooler.Stop()
+				if err := m.secondarySpooler.Start(sz); err != nil {
+					errs = append(errs, err)
+				}
+			}
 		}
 	}
 
+	/**
+	 * Offline and spool limits
+	 */
+
+	if newConfig.Offline != finalConfig.Offline {
+		m.sender.SetOffline(newConfig.Offline)
+		if !newConfig.Offline {
+			m.sender.Drain()
+		}
+		if m.secondarySender != nil {
+			m.secondarySender.SetOffline(newConfig.Offline)
+			if !newConfig.Offline {
+				m.secondarySender.Drain()
+			}
+		}
+		finalConfig.Offline = newConfig.Offline
+	}
+	finalConfig.OfflineLimits = newConfig.OfflineLimits
+	m.spooler.SetLimits(spoolLimits(&finalConfig))
+
+	/**
+	 * Local data stream
+	 */
+
+	if newConfig.Stream != finalConfig.Stream {
+		if newConfig.Stream {
+			if err := m.stream.Start(); err != nil {
+				errs = append(errs, err)
+			} else {
+				finalConfig.Stream = true
+			}
+		} else {
+			m.stream.Stop()
+			finalConfig.Stream = false
+		}
+	}
+	if m.secondarySpooler != nil {
+		m.secondarySpooler.SetLimits(spoolLimits(&finalConfig))
+	}
+
 	// Write the new, updated config.  If this fails, agent will use old config if restarted.
 	if err := pct.Basedir.WriteConfig("data", finalConfig); err != nil {
 		errs = append(errs, errors.New("data.WriteConfig:"+err.Error()))
@@ -285,12 +470,88 @@ func (m *Manager) handleSetConfig(cmd *proto.Cmd) (interface{}, []error) {
 	return m.config, errs
 }
 
+// ConfigSchema describes Config.  The constraints must match validateConfig.
+func (m *Manager) ConfigSchema() pct.ConfigSchema {
+	s := pct.NewConfigSchema("data", Config{
+		SendInterval: DEFAULT_DATA_SEND_INTERVAL,
+		Limits: proto.DataSpoolLimits{
+			MaxAge:   DEFAULT_DATA_MAX_AGE,
+			MaxSize:  DEFAULT_DATA_MAX_SIZE,
+			MaxFiles: DEFAULT_DATA_MAX_FILES,
+		},
+		OfflineLimits: proto.DataSpoolLimits{
+			MaxAge:   DEFAULT_OFFLINE_MAX_AGE,
+			MaxSize:  DEFAULT_OFFLINE_MAX_SIZE,
+			MaxFiles: DEFAULT_OFFLINE_MAX_FILES,
+		},
+	})
+	s.Field("Encoding").Values = ENCODINGS
+	s.Field("SendInterval").Max = 3600
+	s.Field("BatchWindow").Max = 3600
+	return s
+}
+
+// setOffline stops or resumes sending data.  Going online drains the spool.
+func (m *Manager) setOffline(offline bool) (*Config, error) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	if m.config.Offline == offline {
+		return m.config, nil
+	}
+	config := *m.config
+	config.Offline = offline
+	m.sender.SetOffline(offline)
+	m.spooler.SetLimits(spoolLimits(&config))
+	if m.secondarySender != nil {
+		m.secondarySender.SetOffline(offline)
+		m.secondarySpooler.SetLimits(spoolLimits(&config))
+	}
+	if offline {
+		m.logger.Warn("Offline: spooling but not sending data until Drain or Online")
+	} else {
+		m.logger.Info("Online: sending spooled data")
+		m.sender.Drain()
+		if m.secondarySender != nil {
+			m.secondarySender.Drain()
+		}
+	}
+	m.config = &config
+	if err := pct.Basedir.WriteConfig("data", m.config); err != nil {
+		return m.config, errors.New("data.WriteConfig:" + err.Error())
+	}
+	return m.config, nil
+}
+
+// spoolLimits returns the spool limits for the config: OfflineLimits if
+// offline, else Limits.  Zero OfflineLimits are the defaults, not unlimited,
+// so the spool cannot fill the disk.
+func spoolLimits(config *Config) proto.DataSpoolLimits {
+	if !config.Offline {
+		return config.Limits
+	}
+	limits := config.OfflineLimits
+	if limits.MaxAge == 0 {
+		limits.MaxAge = DEFAULT_OFFLINE_MAX_AGE
+	}
+	if limits.MaxSize == 0 {
+		limits.MaxSize = DEFAULT_OFFLINE_MAX_SIZE
+	}
+	if limits.MaxFiles == 0 {
+		limits.MaxFiles = DEFAULT_OFFLINE_MAX_FILES
+	}
+	return limits
+}
+
 func makeSerializer(encoding string) (Serializer, error) {
 	switch encoding {
 	case "":
 		return NewJsonSerializer(), nil
 	case "gzip":
 		return NewJsonGzipSerializer(), nil
+	case "msgpack":
+		return NewMsgpackSerializer(false), nil
+	case "msgpack+gzip":
+		return NewMsgpackSerializer(true), nil
 	default:
 		return nil, errors.New("Unknown encoding: " + encoding)
 	}
@@ -304,5 +565,8 @@ func (m *Manager) handlePurge(cmd *proto.Cmd) (interface{}, []error) {
 		}
 	}
 	_, removed := m.spooler.Purge(time.Now().UTC(), limits)
+	if m.secondarySpooler != nil {
+		m.secondarySpooler.Purge(time.Now().UTC(), limits)
+	}
 	return removed, nil
 }
@@ -18,9 +18,11 @@
 package data
 
 import (
+	"errors"
 	"fmt"
 	"github.com/percona/cloud-protocol/proto/v1"
 	"github.com/percona/percona-agent/pct"
+	"sync"
 	"time"
 )
 
@@ -33,12 +35,16 @@ type Sender struct {
 	logger *pct.Logger
 	client pct.WebsocketClient
 	// --
-	spool      Spooler
-	tickerChan <-chan time.Time
-	timeout    uint
-	blackhole  bool
-	sync       *pct.SyncChan
-	status     *pct.Status
+	spool       Spooler
+	tickerChan  <-chan time.Time
+	timeout     uint
+	blackhole   bool
+	batchWindow uint
+	offline     bool
+	offlineMux  *sync.Mutex
+	drainChan   chan bool
+	sync        *pct.SyncChan
+	status      *pct.Status
 	// --
 	lastStats  *SenderStats
 	dailyStats *SenderStats
@@ -48,6 +54,8 @@ func NewSender(logger *pct.Logger, client pct.WebsocketClient) *Sender {
 	s := &Sender{
 		logger:     logger,
 		client:     client,
+		offlineMux: &sync.Mutex{},
+		drainChan:  make(chan bool, 1),
 		sync:       pct.NewSyncChan(),
 		status:     pct.NewStatus([]string{"data-sender", "data-sender-last", "data-sender-1d"}),
 		lastStats:  NewSenderStats(0),
@@ -56,11 +64,12 @@ func NewSender(logger *pct.Logger, client pct.WebsocketClient) *Sender {
 	return s
 }
 
-func (s *Sender) Start(spool Spooler, tickerChan <-chan time.Time, timeout uint, blackhole bool) error {
+func (s *Sender) Start(spool Spooler, tickerChan <-chan time.Time, timeout uint, blackhole bool, batchWindow uint) error {
 	s.spool = spool
 	s.tickerChan = tickerChan
 	s.timeout = timeout
 	s.blackhole = blackhole
+	s.batchWindow = batchWindow
 	go s.run()
 	s.logger.Info("Started")
 	return nil
@@ -79,6 +88,31 @@ func (s *Sender) Status() map[string]string {
 	return s.status.Merge(s.client.Status())
 }
 
+// SetOffline stops or resumes sending data every tick.  Data is still
+// spooled while offline, and Drain still sends it.
+func (s *Sender) SetOffline(offline bool) {
+	s.offlineMux.Lock()
+	defer s.offlineMux.Unlock()
+	s.offline = offline
+}
+
+func (s *Sender) isOffline() bool {
+	s.offlineMux.Lock()
+	defer s.offlineMux.Unlock()
+	return s.offline
+}
+
+// Drain sends all spooled files now, even if offline.  It does not wait for
+// the files to be sent; check the data-sender status for progress.
+func (s *Sender) Drain() error {
+	select {
+	case s.drainChan <- true:
+		return nil
+	default:
+		return errors.New("Already draining")
+	}
+}
+
 /////////////////////////////////////////////////////////////////////////////
 // Implementation
 /////////////////////////////////////////////////////////////////////////////
@@ -103,7 +137,17 @@ func (s *Sender) run() {
 	for {
 		select {
 		case <-s.tickerChan:
+			if s.isOffline() {
+				s.logger.Debug("run:offline")
+				continue
+			}
+			if s.batchWindow > 0 && !s.batchReady(time.Now()) {
+				s.logger.Debug("run:batch not ready")
+				continue
+			}
 			s.send()
+		case <-s.drainChan:
+			s.drain()
 		case <-s.sync.StopChan:
 			s.sync.Graceful()
 			return
@@ -111,11 +155,25 @@ func (s *Sender) run() {
 	}
 }
 
-func (s *Sender) send() {
+// drain sends until all files are sent or a send fails.  Each send is
+// limited to the timeout, so a large spool takes several sends.
+func (s *Sender) drain() {
+	s.logger.Info("Draining spooled data")
+	files := uint(0)
+	for {
+		sent := s.send()
+		files += sent.Files
+		if sent.Files == 0 || sent.Errs > 0 || sent.ApiErrs > 0 {
+			break
+		}
+	}
+	s.logger.Info(fmt.Sprintf("Drained %d files", files))
+}
+
+func (s *Sender) send() (sent SentInfo) {
 	s.logger.Debug("send:call")
 	defer s.logger.Debug("send:return")
 
-	sent := SentInfo{}
 	defer func() {
 		sent.End = time.Now()
 
@@ -157,7 +215,7 @@ func (s *Sender) send() {
 		if sent.Errs > 0 {
 			time.Sleep(CONNECT_ERROR_WAIT * time.Second)
 		}
-		if err := s.client.ConnectOnce(10); err != nil {
+		if err := s.client.ConnectOnce(0); err != nil { // API connect timeout
 			sent.Errs++
 			s.logger.Warn("Cannot connect to API: ", err)
 			continue // retry
@@ -173,6 +231,28 @@ func (s *Sender) send() {
 		}
 		return // success or API error, either way, stop sending
 	}
+	return
+}
+
+// batchReady returns true if the oldest spooled file is at least batchWindow
+// seconds old, so data is sent in batches instead of every tick.  If there
+// are no files, it returns false so the sender does not connect for nothing.
+func (s *Sender) batchReady(now time.Time) bool {
+	defer s.spool.CancelFiles()
+	oldest := int64(0)
+	for file := range s.spool.Files() {
+		ts, err := fileTs(file)
+		if err != nil {
+			return true // let send() handle the file
+		}
+		if oldest == 0 || ts < oldest {
+			oldest = ts
+		}
+	}
+	if oldest == 0 {
+		return false // no files
+	}
+	return now.UnixNano()-oldest >= int64(s.batchWindow)*int64(time.Second)
 }
 
 func (s *Sender) sendAllFiles(startTime time.Time, sent *SentInfo) error {
@@ -216,6 +296,7 @@ func (s *Sender) sendAllFiles(startTime time.Time, sent *SentInfo) error {
 		}
 		sent.SendTime += time.Now().Sub(t0).Seconds()
 		sent.Bytes += uint64(len(data))
+		pct.DataVolume.Add(t0, fileService(file), 0, len(data))
 
 		s.status.Update("data-sender", "Waiting for API to ack "+file)
 		resp := &proto.Response{}
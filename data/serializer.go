@@ -21,11 +21,20 @@ import (
 	"bytes"
 	"compress/gzip"
 	"encoding/json"
+
+	"github.com/ugorji/go/codec"
 )
 
+// ENCODINGS are the data encodings (Config.Encoding) the agent can send, see
+// makeSerializer.  The msgpack encodings are smaller and faster than JSON for
+// large reports, e.g. qan.Report with tens of thousands of classes, but the
+// API must decode them, so the agent uses them only if the API asks for them.
+var ENCODINGS = []string{"", "gzip", "msgpack", "msgpack+gzip"}
+
 type Serializer interface {
 	ToBytes(data interface{}) ([]byte, error)
 	Encoding() string
+	ContentType() string
 	Concurrent() bool
 }
 
@@ -63,6 +72,10 @@ func (s *JsonGzipSerializer) Encoding() string {
 	return "gzip"
 }
 
+func (s *JsonGzipSerializer) ContentType() string {
+	return "application/json"
+}
+
 func (s *JsonGzipSerializer) Concurrent() bool {
 	return false
 }
@@ -85,6 +98,62 @@ func (s *JsonSerializer) Encoding() string {
 	return ""
 }
 
+func (s *JsonSerializer) ContentType() string {
+	return "application/json"
+}
+
 func (s *JsonSerializer) Concurrent() bool {
 	return true
 }
+
+// --------------------------------------------------------------------------
+
+// msgpackHandle encodes structs like encoding/json: struct fields are keyed
+// on their json tag names, so the API decodes the same data structures.
+var msgpackHandle = &codec.MsgpackHandle{}
+
+type MsgpackSerializer struct {
+	gzip bool
+}
+
+// NewMsgpackSerializer returns a serializer for "msgpack", or "msgpack+gzip"
+// if gzip is true.
+func NewMsgpackSerializer(gzip bool) *MsgpackSerializer {
+	s := &MsgpackSerializer{
+		gzip: gzip,
+	}
+	return s
+}
+
+func (s *MsgpackSerializer) ToBytes(data interface{}) ([]byte, error) {
+	b := &bytes.Buffer{}
+	if !s.gzip {
+		if err := codec.NewEncoder(b, msgpackHandle).Encode(data); err != nil {
+			return nil, err
+		}
+		return b.Bytes(), nil
+	}
+	g := gzip.NewWriter(b)
+	if err := codec.NewEncoder(g, msgpackHandle).Encode(data); err != nil {
+		return nil, err
+	}
+	if err := g.Close(); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+func (s *MsgpackSerializer) Encoding() string {
+	if s.gzip {
+		return "msgpack+gzip"
+	}
+	return "msgpack"
+}
+
+func (s *MsgpackSerializer) ContentType() string {
+	return "application/x-msgpack"
+}
+
+func (s *MsgpackSerializer) Concurrent() bool {
+	return true // no shared buffers
+}
@@ -23,6 +23,7 @@ import (
 	"fmt"
 	"os"
 	"path"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -35,6 +36,32 @@ import (
 
 var ErrSpoolTimeout = errors.New("Timeout spooling data")
 
+// Priority classes of spooled data, highest first.  When draining a backlog,
+// e.g. after an outage, data is sent in priority order so small, time-sensitive
+// data like status and events arrives before bulk data like QAN reports.
+const (
+	PRIORITY_HIGH = iota
+	PRIORITY_NORMAL
+	PRIORITY_BULK
+)
+
+// ServicePriority maps a service to its priority class.  Services not listed
+// are PRIORITY_HIGH.
+var ServicePriority = map[string]int{
+	"mm":          PRIORITY_NORMAL,
+	"sysconfig":   PRIORITY_NORMAL,
+	"qan":         PRIORITY_BULK,
+	"qan-slowlog": PRIORITY_BULK,
+}
+
+// Priority returns the priority class of the service's data.
+func Priority(service string) int {
+	if p, ok := ServicePriority[service]; ok {
+		return p
+	}
+	return PRIORITY_HIGH
+}
+
 type Spooler interface {
 	Start(Serializer) error
 	Stop() error
@@ -48,6 +75,12 @@ type Spooler interface {
 	Purge(time.Time, proto.DataSpoolLimits) (int, map[string][]string)
 }
 
+// A Recorder receives data as it's spooled, e.g. to keep local history.
+// Record must not block: it's called by every service writing data.
+type Recorder interface {
+	Record(service string, data interface{})
+}
+
 // http://godoc.org/github.com/peterbourgon/diskv
 type DiskvSpooler struct {
 	logger   *pct.Logger
@@ -69,6 +102,9 @@ type DiskvSpooler struct {
 	fileSize     map[string]int
 	cancelChan   chan struct{}
 	purgeChan    chan time.Time
+	tee          Spooler
+	stream       *Stream
+	recorder     Recorder
 }
 
 func NewDiskvSpooler(logger *pct.Logger, dataDir, trashDir, hostname string, limits proto.DataSpoolLimits) *DiskvSpooler {
@@ -172,7 +208,7 @@ func (s *DiskvSpooler) Write(service string, data interface{}) error {
 		Created:         time.Now().UTC(),
 		Hostname:        s.hostname,
 		Service:         service,
-		ContentType:     "application/json",
+		ContentType:     s.sz.ContentType(),
 		ContentEncoding: s.sz.Encoding(),
 		Data:            encodedData,
 	}
@@ -186,12 +222,69 @@ func (s *DiskvSpooler) Write(service string, data interface{}) error {
 		return ErrSpoolTimeout
 	}
 
+	// Write data to the tee spool, too.  It has its own limits and sender,
+	// so its errors don't concern the caller.
+	if s.tee != nil {
+		if err := s.tee.Write(service, data); err != nil {
+			s.logger.Warn("Cannot write to tee spool:", err)
+		}
+	}
+
+	// And to local stream clients, if any.
+	if s.stream != nil {
+		s.stream.Write(service, data)
+	}
+
+	// And to the recorder, if any.
+	if s.recorder != nil {
+		s.recorder.Record(service, data)
+	}
+
 	return nil
 }
 
+// Tee makes Write also write data to the spooler, e.g. the spool of a
+// secondary API.  Call it before Start.
+func (s *DiskvSpooler) Tee(spool Spooler) {
+	s.tee = spool
+}
+
+// SetStream makes Write also write data to the local data stream.  Call it
+// before Start.
+func (s *DiskvSpooler) SetStream(stream *Stream) {
+	s.stream = stream
+}
+
+// SetRecorder makes Write also pass data to the recorder.  Call it before
+// Start.
+func (s *DiskvSpooler) SetRecorder(recorder Recorder) {
+	s.recorder = recorder
+}
+
+// Files returns spooled files in send order: by priority class, then by
+// service and time.
 func (s *DiskvSpooler) Files() <-chan string {
 	s.cancelChan = make(chan struct{})
-	return s.cache.Keys(s.cancelChan)
+	cancelChan := s.cancelChan
+
+	keys := []string{}
+	for key := range s.cache.Keys(cancelChan) {
+		keys = append(keys, key)
+	}
+	sort.Sort(byPriority(keys))
+
+	filesChan := make(chan string)
+	go func() {
+		defer close(filesChan)
+		for _, key := range keys {
+			select {
+			case filesChan <- key:
+			case <-cancelChan:
+				return
+			}
+		}
+	}()
+	return filesChan
 }
 
 func (s *DiskvSpooler) CancelFiles() {
@@ -229,6 +322,14 @@ func (s *DiskvSpooler) Purge(now time.Time, limits proto.DataSpoolLimits) (int,
 	return s.purge(now, limits)
 }
 
+// SetLimits sets the limits for the periodic purge, e.g. larger limits to
+// retain data while the agent is offline.
+func (s *DiskvSpooler) SetLimits(limits proto.DataSpoolLimits) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.limits = limits
+}
+
 func (s *DiskvSpooler) PurgeChan(c chan time.Time) {
 	s.purgeChan = c // testing only
 }
@@ -278,6 +379,8 @@ func (s *DiskvSpooler) run() {
 
 			if err := s.cache.Write(key, bytes); err != nil {
 				s.logger.Error(err)
+			} else {
+				pct.DataVolume.Add(protoData.Created, protoData.Service, len(bytes), 0)
 			}
 
 			s.mux.Lock()
@@ -288,7 +391,10 @@ func (s *DiskvSpooler) run() {
 			}
 			s.mux.Unlock()
 		case <-purgeChan:
-			n, removed := s.purge(time.Now().UTC(), s.limits)
+			s.mux.Lock()
+			limits := s.limits
+			s.mux.Unlock()
+			n, removed := s.purge(time.Now().UTC(), limits)
 			if n == 0 {
 				s.logger.Info("Spool size is ok, no files purged")
 				continue
@@ -317,7 +423,8 @@ func (s *DiskvSpooler) run() {
 	}
 }
 
-func (*DiskvSpooler) ts(key string) (int64, error) {
+// fileTs returns the spool time, in Unix nanoseconds, from a spool key.
+func fileTs(key string) (int64, error) {
 	parts := strings.Split(key, "_") // service_nanoUnixTs
 	if len(parts) != 2 {
 		return 0, fmt.Errorf("Invalid data file name: '%s'", key)
@@ -329,6 +436,14 @@ func (*DiskvSpooler) ts(key string) (int64, error) {
 	return ts, nil
 }
 
+// fileService returns the service, i.e. the data type, from a spool key.
+func fileService(key string) string {
+	if i := strings.LastIndex(key, "_"); i > 0 {
+		return key[0:i]
+	}
+	return key
+}
+
 func (s *DiskvSpooler) purge(now time.Time, limits proto.DataSpoolLimits) (int, map[string][]string) {
 	s.logger.Debug("purge:call")
 	defer s.logger.Debug("purge:return")
@@ -358,11 +473,14 @@ func (s *DiskvSpooler) purge(now time.Time, limits proto.DataSpoolLimits) (int,
 	n := 0
 	nowNano := now.UnixNano()
 
-	defer s.CancelFiles()
-	for file := range s.Files() {
+	// Purge in spool order, not send order (Files), so which files are
+	// removed to reduce the spool does not depend on priority.
+	cancelChan := make(chan struct{})
+	defer close(cancelChan)
+	for file := range s.cache.Keys(cancelChan) {
 		// File names have the format <service>_<nano unix ts>. Get the ts and
 		// convert it to seconds from the given now.
-		ts, err := s.ts(file)
+		ts, err := fileTs(file)
 		if err != nil {
 			s.logger.Error(err)
 			s.remove(file, false) // false=we've already locked mux
@@ -406,7 +524,7 @@ func (s *DiskvSpooler) updateStats() {
 			s.cache.Erase(key)
 			continue
 		}
-		ts, err := s.ts(key)
+		ts, err := fileTs(key)
 		if err != nil {
 			s.logger.Error(err)
 			s.cache.Erase(key)
@@ -441,3 +559,17 @@ func (s *DiskvSpooler) remove(file string, lock bool) error {
 	}
 	return nil
 }
+
+// byPriority sorts spool keys (service_ts) by priority class, then by key.
+type byPriority []string
+
+func (a byPriority) Len() int      { return len(a) }
+func (a byPriority) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
+func (a byPriority) Less(i, j int) bool {
+	pi := Priority(strings.Split(a[i], "_")[0])
+	pj := Priority(strings.Split(a[j], "_")[0])
+	if pi != pj {
+		return pi < pj
+	}
+	return a[i] < a[j]
+}
@@ -0,0 +1,185 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package data
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/percona/percona-agent/pct"
+)
+
+// Lines buffered per stream client.  If a client reads slower than data is
+// written, lines are dropped for it, not blocking the spooler.
+const STREAM_CLIENT_BUFFER = 100
+
+// A StreamLine is one JSON line of the data stream: data like a QAN report or
+// mm collection as it's spooled, before it's serialized for the API.
+type StreamLine struct {
+	Ts      time.Time // UTC
+	Service string    // qan, mm, sysconfig, etc.
+	Data    interface{}
+}
+
+// A Stream writes spooled data as JSON lines to every client connected to a
+// unix socket, so tools on the host (alerting, autoscalers, etc.) can use
+// agent data without the API.  The socket is 0600: only the agent user can
+// read the stream.  Clients send nothing; they receive data spooled
+// after they connect.
+type Stream struct {
+	logger *pct.Logger
+	socket string
+	// --
+	listener net.Listener
+	clients  map[chan []byte]bool
+	dropped  uint
+	mux      *sync.Mutex
+	status   *pct.Status
+}
+
+func NewStream(logger *pct.Logger, socket string) *Stream {
+	s := &Stream{
+		logger: logger,
+		socket: socket,
+		// --
+		clients: make(map[chan []byte]bool),
+		mux:     &sync.Mutex{},
+		status:  pct.NewStatus([]string{"data-stream"}),
+	}
+	s.status.Update("data-stream", "Disabled")
+	return s
+}
+
+// Start listens on the socket.  It does nothing if the stream is started.
+func (s *Stream) Start() error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if s.listener != nil {
+		return nil
+	}
+	os.Remove(s.socket) // stale socket if agent crashed
+	listener, err := net.Listen("unix", s.socket)
+	if err != nil {
+		return err
+	}
+	if err := os.Chmod(s.socket, 0600); err != nil {
+		listener.Close()
+		return err
+	}
+	s.listener = listener
+	go s.accept(listener)
+	s.logger.Info("Streaming data on " + s.socket)
+	s.status.Update("data-stream", "Listening on "+s.socket)
+	return nil
+}
+
+// Stop closes the socket and disconnects all clients.
+func (s *Stream) Stop() {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if s.listener == nil {
+		return
+	}
+	s.listener.Close() // removes the socket file
+	s.listener = nil
+	for c := range s.clients {
+		close(c)
+		delete(s.clients, c)
+	}
+	s.logger.Info("Stopped")
+	s.status.Update("data-stream", "Disabled")
+}
+
+func (s *Stream) Status() map[string]string {
+	return s.status.All()
+}
+
+// Clients returns the number of connected clients.
+func (s *Stream) Clients() int {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	return len(s.clients)
+}
+
+// Write sends data from service to all clients.  It never blocks.
+func (s *Stream) Write(service string, data interface{}) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if len(s.clients) == 0 {
+		return // don't encode data nobody reads
+	}
+	line := StreamLine{
+		Ts:      time.Now().UTC(),
+		Service: service,
+		Data:    data,
+	}
+	bytes, err := json.Marshal(line)
+	if err != nil {
+		s.logger.Warn("Cannot encode "+service+" data:", err)
+		return
+	}
+	bytes = append(bytes, '\n')
+	for c := range s.clients {
+		select {
+		case c <- bytes:
+		default:
+			s.dropped++
+		}
+	}
+	s.status.Update("data-stream", fmt.Sprintf("Listening on %s, %d clients, %d lines dropped", s.socket, len(s.clients), s.dropped))
+}
+
+func (s *Stream) accept(listener net.Listener) {
+	defer func() {
+		if err := recover(); err != nil {
+			s.logger.Error("Data stream crashed: ", err)
+		}
+	}()
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return // listener closed
+		}
+		c := make(chan []byte, STREAM_CLIENT_BUFFER)
+		s.mux.Lock()
+		if s.listener != listener {
+			s.mux.Unlock()
+			conn.Close()
+			return // stopped
+		}
+		s.clients[c] = true
+		s.mux.Unlock()
+		go s.send(conn, c)
+	}
+}
+
+func (s *Stream) send(conn net.Conn, c chan []byte) {
+	defer conn.Close()
+	for line := range c {
+		if _, err := conn.Write(line); err != nil {
+			break // client disconnected
+		}
+	}
+	s.mux.Lock()
+	delete(s.clients, c) // no-op if Stop closed c
+	s.mux.Unlock()
+}
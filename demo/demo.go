@@ -0,0 +1,67 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+// Package demo makes qan and mm services that generate synthetic data without
+// MySQL, see the percona-agent -demo flag.  The data is spooled and sent like
+// real data, so staging APIs and dashboards can be tested end to end.
+package demo
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"time"
+
+	"github.com/percona/percona-agent/instance"
+)
+
+const (
+	QAN_INTERVAL = 60 // seconds
+	MM_COLLECT   = 1  // seconds
+	MM_REPORT    = 60 // seconds
+	QPS          = 50 // average queries per second per instance
+)
+
+// Instances returns the ids of the MySQL instances in the repo, or [1] if
+// there are none so there's always data.
+func Instances(repo *instance.Repo) []uint {
+	ids := []uint{}
+	if repo != nil {
+		for _, name := range repo.List() {
+			var id uint
+			if n, _ := fmt.Sscanf(name, "mysql-%d", &id); n == 1 {
+				ids = append(ids, id)
+			}
+		}
+	}
+	if len(ids) == 0 {
+		ids = append(ids, 1)
+	}
+	return ids
+}
+
+// Load is the daily load pattern, between 0.5 at 06:00 and 1.5 at 18:00 UTC,
+// so charts don't look flat.
+func Load(ts time.Time) float64 {
+	ts = ts.UTC()
+	s := float64(ts.Hour()*3600 + ts.Minute()*60 + ts.Second())
+	return 1 - 0.5*math.Sin(2*math.Pi*s/86400)
+}
+
+func newRand() *rand.Rand {
+	return rand.New(rand.NewSource(time.Now().UnixNano()))
+}
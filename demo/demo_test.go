@@ -0,0 +1,83 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package demo_test
+
+import (
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/percona/percona-agent/demo"
+	"github.com/percona/percona-agent/qan"
+	. "gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) { TestingT(t) }
+
+type DemoTestSuite struct{}
+
+var _ = Suite(&DemoTestSuite{})
+
+func (s *DemoTestSuite) TestInstances(t *C) {
+	t.Check(demo.Instances(nil), DeepEquals, []uint{1})
+}
+
+func (s *DemoTestSuite) TestLoad(t *C) {
+	day := time.Date(2015, 6, 1, 0, 0, 0, 0, time.UTC)
+	t.Check(demo.Load(day.Add(6*time.Hour)) < 0.51, Equals, true)
+	t.Check(demo.Load(day.Add(18*time.Hour)) > 1.49, Equals, true)
+}
+
+func (s *DemoTestSuite) TestQanResult(t *C) {
+	start := time.Date(2015, 6, 1, 12, 0, 0, 0, time.UTC)
+	interval := &qan.Interval{
+		Number:    1,
+		StartTime: start,
+		StopTime:  start.Add(demo.QAN_INTERVAL * time.Second),
+	}
+	result := demo.MakeQanResult(interval, rand.New(rand.NewSource(1)))
+	t.Assert(result.Global, NotNil)
+
+	// About QPS for the interval, at Load 1 at noon.
+	n := float64(result.Global.TotalQueries)
+	expect := float64(demo.QPS * demo.QAN_INTERVAL)
+	t.Check(n > 0.85*expect && n < 1.15*expect, Equals, true, Commentf("%d queries", result.Global.TotalQueries))
+
+	// Every query template is a class, with an example.
+	t.Check(result.Class, HasLen, 7)
+	for _, class := range result.Class {
+		t.Check(class.Example, NotNil)
+	}
+}
+
+func (s *DemoTestSuite) TestMetrics(t *C) {
+	g := demo.NewMetricGenerator(rand.New(rand.NewSource(1)))
+	ts := time.Date(2015, 6, 1, 12, 0, 0, 0, time.UTC)
+	first := map[string]float64{}
+	for _, m := range g.Metrics(ts, 1) {
+		first[m.Name] = m.Number
+	}
+	t.Check(first["mysql/threads_connected"] > 0, Equals, true)
+
+	// Counters only increase.
+	for _, m := range g.Metrics(ts.Add(10*time.Second), 10) {
+		if m.Type == "counter" {
+			t.Check(m.Number >= first[m.Name], Equals, true, Commentf(m.Name))
+		}
+	}
+}
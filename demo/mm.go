@@ -0,0 +1,200 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package demo
+
+import (
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/percona/cloud-protocol/proto/v1"
+	"github.com/percona/percona-agent/data"
+	"github.com/percona/percona-agent/mm"
+	"github.com/percona/percona-agent/pct"
+	"github.com/percona/percona-agent/ticker"
+)
+
+// MetricGenerator makes synthetic MySQL metrics like the mm MySQL monitor.
+// Counters only increase, at a rate that follows Load.
+type MetricGenerator struct {
+	r        *rand.Rand
+	counters map[string]float64
+}
+
+func NewMetricGenerator(r *rand.Rand) *MetricGenerator {
+	g := &MetricGenerator{
+		r:        r,
+		counters: make(map[string]float64),
+	}
+	return g
+}
+
+// counterRates are per second at Load 1.
+var counterRates = map[string]float64{
+	"mysql/questions":            QPS,
+	"mysql/com_select":           QPS * 0.63,
+	"mysql/com_insert":           QPS * 0.15,
+	"mysql/com_update":           QPS * 0.20,
+	"mysql/com_delete":           QPS * 0.02,
+	"mysql/slow_queries":         0.05,
+	"mysql/bytes_received":       QPS * 200,
+	"mysql/bytes_sent":           QPS * 2000,
+	"mysql/innodb_rows_read":     QPS * 150,
+	"mysql/innodb_rows_inserted": QPS * 0.15,
+	"mysql/created_tmp_tables":   QPS * 0.05,
+}
+
+// Metrics returns the metrics collected at ts, seconds after the previous
+// collection.
+func (g *MetricGenerator) Metrics(ts time.Time, seconds float64) []mm.Metric {
+	load := Load(ts)
+	metrics := []mm.Metric{}
+	for name, rate := range counterRates {
+		g.counters[name] += rate * load * seconds * (0.8 + 0.4*g.r.Float64())
+		metrics = append(metrics, mm.Metric{Name: name, Type: "counter", Number: float64(int64(g.counters[name]))})
+	}
+	gauges := map[string]float64{
+		"mysql/threads_connected":              float64(int(20*load) + g.r.Intn(5)),
+		"mysql/threads_running":                float64(1 + g.r.Intn(int(3*load)+1)),
+		"mysql/innodb_buffer_pool_pages_dirty": float64(int(500*load) + g.r.Intn(100)),
+		"mysql/innodb_buffer_pool_pages_free":  float64(1000 + g.r.Intn(50)),
+	}
+	for name, value := range gauges {
+		metrics = append(metrics, mm.Metric{Name: name, Type: "gauge", Number: value})
+	}
+	return metrics
+}
+
+// MmManager is the mm service in demo mode: it collects synthetic metrics for
+// every instance every MM_COLLECT seconds and reports them every MM_REPORT
+// seconds with the real mm aggregator.
+type MmManager struct {
+	logger    *pct.Logger
+	clock     ticker.Manager
+	spool     data.Spooler
+	instances []uint
+	// --
+	tickChan       chan time.Time
+	collectionChan chan *mm.Collection
+	aggregator     *mm.Aggregator
+	sync           *pct.SyncChan
+	running        bool
+	mux            *sync.Mutex // guards running
+	status         *pct.Status
+}
+
+func NewMmManager(logger *pct.Logger, clock ticker.Manager, spool data.Spooler, instances []uint) *MmManager {
+	m := &MmManager{
+		logger:    logger,
+		clock:     clock,
+		spool:     spool,
+		instances: instances,
+		// --
+		mux:    &sync.Mutex{},
+		status: pct.NewStatus([]string{"mm"}),
+	}
+	return m
+}
+
+func (m *MmManager) Start() error {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	if m.running {
+		return pct.ServiceIsRunningError{Service: "mm"}
+	}
+	m.collectionChan = make(chan *mm.Collection, 5)
+	m.aggregator = mm.NewAggregator(pct.NewLogger(m.logger.LogChan(), "mm-ag-demo"), MM_REPORT, m.collectionChan, m.spool)
+	m.aggregator.Start()
+	m.tickChan = make(chan time.Time)
+	m.sync = pct.NewSyncChan()
+	m.clock.Add(m.tickChan, MM_COLLECT, true)
+	go m.run()
+	m.running = true
+	m.logger.Warn(fmt.Sprintf("Demo mode: reporting synthetic metrics for MySQL instances %v", m.instances))
+	m.status.Update("mm", "Running (demo)")
+	return nil
+}
+
+func (m *MmManager) Stop() error {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	if !m.running {
+		return nil
+	}
+	m.clock.Remove(m.tickChan)
+	m.sync.Stop()
+	m.sync.Wait()
+	m.aggregator.Stop()
+	m.running = false
+	m.status.Update("mm", "Stopped")
+	return nil
+}
+
+func (m *MmManager) Handle(cmd *proto.Cmd) *proto.Reply {
+	switch cmd.Cmd {
+	case "GetConfig":
+		config, errs := m.GetConfig()
+		return cmd.Reply(config, errs...)
+	default:
+		return cmd.Reply(nil, fmt.Errorf("%s not supported in demo mode", cmd.Cmd))
+	}
+}
+
+func (m *MmManager) Status() map[string]string {
+	return m.status.All()
+}
+
+func (m *MmManager) GetConfig() ([]proto.AgentConfig, []error) {
+	return nil, nil // no monitor configs in demo mode
+}
+
+func (m *MmManager) run() {
+	defer func() {
+		if err := recover(); err != nil {
+			m.logger.Error("Demo MM crashed: ", err)
+		}
+		m.sync.Done()
+	}()
+
+	r := newRand()
+	generators := make(map[uint]*MetricGenerator)
+	for _, id := range m.instances {
+		generators[id] = NewMetricGenerator(r)
+	}
+	for {
+		select {
+		case now := <-m.tickChan:
+			for _, id := range m.instances {
+				c := &mm.Collection{
+					ServiceInstance: proto.ServiceInstance{Service: "mysql", InstanceId: id},
+					Ts:              now.UTC().Unix(),
+					Metrics:         generators[id].Metrics(now, MM_COLLECT),
+				}
+				select {
+				case m.collectionChan <- c:
+				default:
+					m.logger.Warn("Lost collection: aggregator is blocked")
+				}
+			}
+		case <-m.sync.StopChan:
+			m.sync.Graceful()
+			return
+		}
+	}
+}
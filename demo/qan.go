@@ -0,0 +1,242 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package demo
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/percona/cloud-protocol/proto/v1"
+	"github.com/percona/go-mysql/event"
+	"github.com/percona/go-mysql/log"
+	"github.com/percona/go-mysql/query"
+	"github.com/percona/percona-agent/data"
+	"github.com/percona/percona-agent/pct"
+	"github.com/percona/percona-agent/qan"
+	"github.com/percona/percona-agent/ticker"
+)
+
+type queryTemplate struct {
+	query    string  // with one %d
+	weight   int     // relative frequency
+	time     float64 // median query time, seconds
+	rowsSent uint64
+}
+
+// A shop-like workload: many fast point queries, a few slow reports.
+var queries = []queryTemplate{
+	{"SELECT * FROM orders WHERE customer_id = %d", 30, 0.002, 10},
+	{"SELECT id, name, price FROM products WHERE category_id = %d ORDER BY price LIMIT 20", 20, 0.004, 20},
+	{"UPDATE sessions SET last_seen = NOW() WHERE id = %d", 20, 0.001, 0},
+	{"INSERT INTO events (user_id, type, ts) VALUES (%d, 'click', NOW())", 15, 0.0008, 0},
+	{"SELECT u.id, u.email FROM users u JOIN orders o ON o.user_id = u.id WHERE o.total > %d", 8, 0.08, 200},
+	{"SELECT COUNT(*) FROM orders WHERE created_at > NOW() - INTERVAL %d DAY", 5, 0.25, 1},
+	{"DELETE FROM carts WHERE updated_at < NOW() - INTERVAL %d DAY", 2, 0.5, 0},
+}
+
+// MakeQanResult returns synthetic query classes for the interval.
+func MakeQanResult(interval *qan.Interval, r *rand.Rand) *qan.Result {
+	totalWeight := 0
+	for _, q := range queries {
+		totalWeight += q.weight
+	}
+	seconds := interval.StopTime.Sub(interval.StartTime).Seconds()
+	n := int(seconds * QPS * Load(interval.StartTime) * (0.9 + 0.2*r.Float64()))
+
+	a := event.NewEventAggregator(true, 0)
+	for i := 0; i < n; i++ {
+		w := r.Intn(totalWeight)
+		q := queries[0]
+		for _, q = range queries {
+			if w < q.weight {
+				break
+			}
+			w -= q.weight
+		}
+		ts := interval.StartTime.Add(time.Duration(r.Float64() * seconds * float64(time.Second)))
+		queryTime := q.time * math.Exp(0.75*r.NormFloat64()) // log-normal
+		e := &log.Event{
+			Ts:    ts.UTC().Format("060102 15:04:05"),
+			Query: fmt.Sprintf(q.query, r.Intn(10000)),
+			User:  "app",
+			Host:  "web1",
+			Db:    "shop",
+			TimeMetrics: map[string]float32{
+				"Query_time": float32(queryTime),
+				"Lock_time":  float32(queryTime / 20),
+			},
+			NumberMetrics: map[string]uint64{
+				"Rows_sent":     q.rowsSent,
+				"Rows_examined": q.rowsSent*uint64(1+r.Intn(10)) + uint64(r.Intn(100)),
+			},
+		}
+		fingerprint := query.Fingerprint(e.Query)
+		a.AddEvent(e, query.Id(fingerprint), fingerprint)
+	}
+
+	res := a.Finalize()
+	result := &qan.Result{
+		Global: res.Global,
+		Class:  make([]*event.QueryClass, 0, len(res.Class)),
+	}
+	for _, class := range res.Class {
+		result.Class = append(result.Class, class)
+	}
+	return result
+}
+
+// QanManager is the qan service in demo mode: it spools a synthetic report for
+// every instance every QAN_INTERVAL seconds.
+type QanManager struct {
+	logger    *pct.Logger
+	clock     ticker.Manager
+	spool     data.Spooler
+	instances []uint
+	// --
+	tickChan chan time.Time
+	sync     *pct.SyncChan
+	running  bool
+	mux      *sync.Mutex // guards running
+	status   *pct.Status
+}
+
+func NewQanManager(logger *pct.Logger, clock ticker.Manager, spool data.Spooler, instances []uint) *QanManager {
+	m := &QanManager{
+		logger:    logger,
+		clock:     clock,
+		spool:     spool,
+		instances: instances,
+		// --
+		mux:    &sync.Mutex{},
+		status: pct.NewStatus([]string{"qan", "qan-demo-last-report"}),
+	}
+	return m
+}
+
+func (m *QanManager) Start() error {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	if m.running {
+		return pct.ServiceIsRunningError{Service: "qan"}
+	}
+	m.tickChan = make(chan time.Time)
+	m.sync = pct.NewSyncChan()
+	m.clock.Add(m.tickChan, QAN_INTERVAL, true)
+	go m.run()
+	m.running = true
+	m.logger.Warn(fmt.Sprintf("Demo mode: reporting synthetic queries for MySQL instances %v", m.instances))
+	m.status.Update("qan", "Running (demo)")
+	return nil
+}
+
+func (m *QanManager) Stop() error {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	if !m.running {
+		return nil
+	}
+	m.clock.Remove(m.tickChan)
+	m.sync.Stop()
+	m.sync.Wait()
+	m.running = false
+	m.status.Update("qan", "Stopped")
+	return nil
+}
+
+func (m *QanManager) Handle(cmd *proto.Cmd) *proto.Reply {
+	switch cmd.Cmd {
+	case "GetConfig":
+		config, errs := m.GetConfig()
+		return cmd.Reply(config, errs...)
+	default:
+		return cmd.Reply(nil, fmt.Errorf("%s not supported in demo mode", cmd.Cmd))
+	}
+}
+
+func (m *QanManager) Status() map[string]string {
+	return m.status.All()
+}
+
+func (m *QanManager) GetConfig() ([]proto.AgentConfig, []error) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	configs := []proto.AgentConfig{}
+	for _, id := range m.instances {
+		bytes, err := json.Marshal(m.config(id))
+		if err != nil {
+			return nil, []error{err}
+		}
+		configs = append(configs, proto.AgentConfig{
+			InternalService: "qan",
+			ExternalService: proto.ServiceInstance{Service: "mysql", InstanceId: id},
+			Config:          string(bytes),
+			Running:         m.running,
+		})
+	}
+	return configs, nil
+}
+
+func (m *QanManager) config(id uint) qan.Config {
+	return qan.Config{
+		ServiceInstance: proto.ServiceInstance{Service: "mysql", InstanceId: id},
+		CollectFrom:     "slowlog",
+		Interval:        QAN_INTERVAL,
+		ExampleQueries:  true,
+		ReportLimit:     200,
+	}
+}
+
+func (m *QanManager) run() {
+	defer func() {
+		if err := recover(); err != nil {
+			m.logger.Error("Demo QAN crashed: ", err)
+		}
+		m.sync.Done()
+	}()
+
+	r := newRand()
+	number := 0
+	for {
+		select {
+		case now := <-m.tickChan:
+			number++
+			interval := &qan.Interval{
+				Number:    number,
+				StartTime: now.UTC().Add(-QAN_INTERVAL * time.Second),
+				StopTime:  now.UTC(),
+			}
+			for _, id := range m.instances {
+				result := MakeQanResult(interval, r)
+				report := qan.MakeReport(m.config(id), interval, result)
+				if err := m.spool.Write("qan", report); err != nil {
+					m.logger.Warn("Lost report:", err)
+					continue
+				}
+				m.status.Update("qan-demo-last-report", fmt.Sprintf("%s: %d queries, %d classes",
+					interval.StartTime.Format("2006-01-02 15:04:05"), result.Global.TotalQueries, len(result.Class)))
+			}
+		case <-m.sync.StopChan:
+			m.sync.Graceful()
+			return
+		}
+	}
+}
@@ -0,0 +1,53 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package file
+
+const (
+	DEFAULT_MAX_SIZE = 1024 * 1024      // 1 MiB
+	MAX_MAX_SIZE     = 10 * 1024 * 1024 // 10 MiB, hard limit for Config.MaxSize
+)
+
+// Config is read only from the local config file (config/file.conf), never
+// from the API, because Allow is the security boundary: only files matching
+// an Allow path or glob can be fetched.  There is no default allowlist, so
+// GetFile fails until files are allowed, e.g.:
+//
+//	{"Allow":["/etc/my.cnf","/var/log/mysql/error.log","/proc/*/numa_maps"]}
+type Config struct {
+	Allow   []string // absolute paths or globs (filepath.Match syntax)
+	MaxSize int64    // bytes, max file data per GetFile
+}
+
+// A Request is the Data of a GetFile cmd.  A negative Offset is relative to
+// the end of the file, e.g. -65536 for the last 64 KiB of an error log.
+type Request struct {
+	Path    string
+	Offset  int64
+	MaxSize int64 // bytes, at most Config.MaxSize (default)
+}
+
+// A File is the Data of a GetFile reply.  Size is the file size, which is 0
+// for /proc files.  Truncated is true if there is more data after Data.
+type File struct {
+	Path      string
+	Size      int64
+	ModTime   int64 // Unix timestamp
+	Offset    int64 // where Data begins, always >= 0
+	Data      []byte
+	Truncated bool
+}
@@ -0,0 +1,177 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package file_test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/percona/cloud-protocol/proto/v1"
+	"github.com/percona/percona-agent/file"
+	"github.com/percona/percona-agent/pct"
+	. "gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) { TestingT(t) }
+
+type ManagerTestSuite struct {
+	logChan chan *proto.LogEntry
+	logger  *pct.Logger
+	tmpDir  string
+	logsDir string
+}
+
+var _ = Suite(&ManagerTestSuite{})
+
+func (s *ManagerTestSuite) SetUpSuite(t *C) {
+	s.logChan = make(chan *proto.LogEntry, 100)
+	s.logger = pct.NewLogger(s.logChan, file.SERVICE_NAME+"-manager-test")
+
+	var err error
+	s.tmpDir, err = ioutil.TempDir("/tmp", "agent-test")
+	t.Assert(err, IsNil)
+
+	if err := pct.Basedir.Init(s.tmpDir); err != nil {
+		t.Fatal(err)
+	}
+
+	// logs/error.log is allowed, logs/secret.txt is not, and logs/link.log
+	// is an allowed name that links to the secret.
+	s.logsDir = filepath.Join(s.tmpDir, "logs")
+	t.Assert(os.Mkdir(s.logsDir, 0755), IsNil)
+	err = ioutil.WriteFile(filepath.Join(s.logsDir, "error.log"), []byte("0123456789"), 0644)
+	t.Assert(err, IsNil)
+	err = ioutil.WriteFile(filepath.Join(s.logsDir, "secret.txt"), []byte("password"), 0644)
+	t.Assert(err, IsNil)
+	err = os.Symlink(filepath.Join(s.logsDir, "secret.txt"), filepath.Join(s.logsDir, "link.log"))
+	t.Assert(err, IsNil)
+}
+
+func (s *ManagerTestSuite) SetUpTest(t *C) {
+	pct.Basedir.RemoveConfig(file.SERVICE_NAME)
+}
+
+func (s *ManagerTestSuite) TearDownSuite(t *C) {
+	if err := os.RemoveAll(s.tmpDir); err != nil {
+		t.Error(err)
+	}
+}
+
+func (s *ManagerTestSuite) getFile(t *C, m *file.Manager, req *file.Request) (*file.File, string) {
+	data, err := json.Marshal(req)
+	t.Assert(err, IsNil)
+	cmd := &proto.Cmd{
+		Service: file.SERVICE_NAME,
+		Cmd:     "GetFile",
+		Data:    data,
+	}
+	reply := m.Handle(cmd)
+	if reply.Error != "" {
+		return nil, reply.Error
+	}
+	got := &file.File{}
+	t.Assert(json.Unmarshal(reply.Data, got), IsNil)
+	return got, ""
+}
+
+// --------------------------------------------------------------------------
+
+func (s *ManagerTestSuite) TestNoConfig(t *C) {
+	m := file.NewManager(s.logger)
+	t.Assert(m.Start(), IsNil)
+	defer m.Stop()
+
+	// No config, so no files are allowed.
+	_, err := s.getFile(t, m, &file.Request{Path: filepath.Join(s.logsDir, "error.log")})
+	t.Check(err, Not(Equals), "")
+}
+
+func (s *ManagerTestSuite) TestGetFile(t *C) {
+	config := &file.Config{
+		Allow:   []string{filepath.Join(s.logsDir, "*.log")},
+		MaxSize: 4,
+	}
+	t.Assert(pct.Basedir.WriteConfig(file.SERVICE_NAME, config), IsNil)
+
+	m := file.NewManager(s.logger)
+	t.Assert(m.Start(), IsNil)
+	defer m.Stop()
+
+	errorLog := filepath.Join(s.logsDir, "error.log")
+
+	// Data is capped at MaxSize.
+	got, err := s.getFile(t, m, &file.Request{Path: errorLog})
+	t.Assert(err, Equals, "")
+	t.Check(got.Path, Equals, errorLog)
+	t.Check(got.Size, Equals, int64(10))
+	t.Check(got.Offset, Equals, int64(0))
+	t.Check(string(got.Data), Equals, "0123")
+	t.Check(got.Truncated, Equals, true)
+
+	// Negative offset reads the end of the file.
+	got, err = s.getFile(t, m, &file.Request{Path: errorLog, Offset: -3})
+	t.Assert(err, Equals, "")
+	t.Check(got.Offset, Equals, int64(7))
+	t.Check(string(got.Data), Equals, "789")
+	t.Check(got.Truncated, Equals, false)
+
+	// Request cannot raise MaxSize, only lower it.
+	got, err = s.getFile(t, m, &file.Request{Path: errorLog, Offset: 2, MaxSize: 100})
+	t.Assert(err, Equals, "")
+	t.Check(string(got.Data), Equals, "2345")
+	got, err = s.getFile(t, m, &file.Request{Path: errorLog, Offset: 2, MaxSize: 2})
+	t.Assert(err, Equals, "")
+	t.Check(string(got.Data), Equals, "23")
+}
+
+func (s *ManagerTestSuite) TestNotAllowed(t *C) {
+	config := &file.Config{
+		Allow: []string{filepath.Join(s.logsDir, "*.log")},
+	}
+	t.Assert(pct.Basedir.WriteConfig(file.SERVICE_NAME, config), IsNil)
+
+	m := file.NewManager(s.logger)
+	t.Assert(m.Start(), IsNil)
+	defer m.Stop()
+
+	paths := []string{
+		filepath.Join(s.logsDir, "secret.txt"), // not allowed
+		filepath.Join(s.logsDir, "link.log"),   // symlink to not allowed
+		s.logsDir + "/../logs/secret.txt",      // cleaned
+		s.logsDir + "/error.log/../secret.txt", // cleaned
+		"logs/error.log",                       // not absolute
+	}
+	for _, path := range paths {
+		got, err := s.getFile(t, m, &file.Request{Path: path})
+		t.Check(err, Not(Equals), "", Commentf(path))
+		t.Check(got, IsNil, Commentf(path))
+	}
+}
+
+func (s *ManagerTestSuite) TestInvalidConfig(t *C) {
+	config := &file.Config{
+		Allow: []string{"logs/*.log"},
+	}
+	t.Assert(pct.Basedir.WriteConfig(file.SERVICE_NAME, config), IsNil)
+
+	m := file.NewManager(s.logger)
+	t.Check(m.Start(), NotNil)
+}
@@ -0,0 +1,255 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package file
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/percona/cloud-protocol/proto/v1"
+	"github.com/percona/percona-agent/pct"
+)
+
+const (
+	SERVICE_NAME = "file"
+)
+
+// Manager returns the contents of local files for remote diagnostics, like
+// my.cnf and the MySQL error log, but only files explicitly allowed in the
+// local config.
+type Manager struct {
+	logger *pct.Logger
+	// --
+	config  *Config
+	running bool
+	sync.Mutex
+	status *pct.Status
+}
+
+func NewManager(logger *pct.Logger) *Manager {
+	m := &Manager{
+		logger: logger,
+		// --
+		config: &Config{},
+		status: pct.NewStatus([]string{SERVICE_NAME}),
+	}
+	return m
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Interface
+/////////////////////////////////////////////////////////////////////////////
+
+func (m *Manager) Start() error {
+	m.Lock()
+	defer m.Unlock()
+	if m.running {
+		return pct.ServiceIsRunningError{Service: SERVICE_NAME}
+	}
+
+	// Load config from disk.  It's ok if there's no config: the service
+	// runs but GetFile cmds fail because no files are allowed.
+	config := &Config{}
+	if err := pct.Basedir.ReadConfig(SERVICE_NAME, config); err != nil {
+		if !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if err := validateConfig(config); err != nil {
+		return err
+	}
+	m.config = config
+
+	m.running = true
+	m.logger.Info("Started")
+	m.status.Update(SERVICE_NAME, "Idle")
+	return nil
+}
+
+func (m *Manager) Stop() error {
+	m.Lock()
+	defer m.Unlock()
+	if !m.running {
+		return nil
+	}
+	m.running = false
+	m.logger.Info("Stopped")
+	m.status.Update(SERVICE_NAME, "Stopped")
+	return nil
+}
+
+func (m *Manager) Handle(cmd *proto.Cmd) *proto.Reply {
+	m.Lock()
+	defer m.Unlock()
+
+	if !m.running {
+		return cmd.Reply(nil, pct.ServiceIsNotRunningError{Service: SERVICE_NAME})
+	}
+
+	m.status.UpdateRe(SERVICE_NAME, "Handling", cmd)
+	defer m.status.Update(SERVICE_NAME, "Idle")
+
+	switch cmd.Cmd {
+	case "GetFile":
+		req := &Request{}
+		if err := json.Unmarshal(cmd.Data, req); err != nil {
+			return cmd.Reply(nil, err)
+		}
+		file, err := m.getFile(req)
+		if err != nil {
+			m.logger.Warn("GetFile", req.Path, "failed:", err)
+			return cmd.Reply(nil, err)
+		}
+		m.logger.Info("GetFile", file.Path, len(file.Data), "bytes")
+		return cmd.Reply(file)
+	default:
+		return cmd.Reply(nil, pct.UnknownCmdError{Cmd: cmd.Cmd})
+	}
+}
+
+func (m *Manager) Status() map[string]string {
+	return m.status.All()
+}
+
+func (m *Manager) GetConfig() ([]proto.AgentConfig, []error) {
+	m.Lock()
+	defer m.Unlock()
+	bytes, err := json.Marshal(m.config)
+	if err != nil {
+		return nil, []error{err}
+	}
+	config := proto.AgentConfig{
+		InternalService: SERVICE_NAME,
+		Config:          string(bytes),
+		Running:         m.running,
+	}
+	return []proto.AgentConfig{config}, nil
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Implementation
+/////////////////////////////////////////////////////////////////////////////
+
+func validateConfig(config *Config) error {
+	for _, pattern := range config.Allow {
+		if !filepath.IsAbs(pattern) {
+			return fmt.Errorf("Invalid Allow path %s: must be absolute", pattern)
+		}
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return fmt.Errorf("Invalid Allow path %s: %s", pattern, err)
+		}
+	}
+	if config.MaxSize <= 0 {
+		config.MaxSize = DEFAULT_MAX_SIZE
+	} else if config.MaxSize > MAX_MAX_SIZE {
+		config.MaxSize = MAX_MAX_SIZE
+	}
+	return nil
+}
+
+// Allowed returns true if path matches an Allow path or glob.
+func (m *Manager) Allowed(path string) bool {
+	for _, pattern := range m.config.Allow {
+		if ok, _ := filepath.Match(pattern, path); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *Manager) getFile(req *Request) (*File, error) {
+	m.logger.Debug("getFile:call")
+	defer m.logger.Debug("getFile:return")
+
+	// Check the path as given, cleaned of "..", and the real path if it's
+	// a symlink, so an allowed path can't be used to reach another file.
+	if !filepath.IsAbs(req.Path) {
+		return nil, fmt.Errorf("Invalid path %s: must be absolute", req.Path)
+	}
+	path := filepath.Clean(req.Path)
+	if !m.Allowed(path) {
+		return nil, fmt.Errorf("%s is not allowed, see %s", path, pct.Basedir.ConfigFile(SERVICE_NAME))
+	}
+	realPath, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return nil, err
+	}
+	if realPath != path && !m.Allowed(realPath) {
+		return nil, fmt.Errorf("%s is a symlink to %s which is not allowed, see %s",
+			path, realPath, pct.Basedir.ConfigFile(SERVICE_NAME))
+	}
+
+	fh, err := os.Open(realPath)
+	if err != nil {
+		return nil, err
+	}
+	defer fh.Close()
+
+	fi, err := fh.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if !fi.Mode().IsRegular() {
+		return nil, fmt.Errorf("%s is not a regular file", path)
+	}
+
+	maxSize := m.config.MaxSize
+	if req.MaxSize > 0 && req.MaxSize < maxSize {
+		maxSize = req.MaxSize
+	}
+
+	// /proc files have size 0, so a negative offset reads them from the start.
+	offset := req.Offset
+	if offset < 0 {
+		offset += fi.Size()
+		if offset < 0 {
+			offset = 0
+		}
+	}
+	if offset > 0 {
+		if _, err := fh.Seek(offset, os.SEEK_SET); err != nil {
+			return nil, err
+		}
+	}
+
+	// Read one more byte than the max to know if the data is truncated.
+	data, err := ioutil.ReadAll(io.LimitReader(fh, maxSize+1))
+	if err != nil {
+		return nil, err
+	}
+	truncated := false
+	if int64(len(data)) > maxSize {
+		data = data[:maxSize]
+		truncated = true
+	}
+
+	file := &File{
+		Path:      path,
+		Size:      fi.Size(),
+		ModTime:   fi.ModTime().Unix(),
+		Offset:    offset,
+		Data:      data,
+		Truncated: truncated,
+	}
+	return file, nil
+}
@@ -0,0 +1,68 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package history
+
+const (
+	SERVICE_NAME       = "history"
+	DEFAULT_DAYS       = 30
+	DEFAULT_RAW_DAYS   = 1
+	DEFAULT_RESOLUTION = 300 // 5m
+	COMPACT_INTERVAL   = 3600
+)
+
+// Config is saved to config/history.conf by StartService.  Without it, no
+// history is kept.
+type Config struct {
+	Days       uint     // keep this many days of history, older days are removed
+	RawDays    uint     // keep every mm report this many days, then downsample
+	Resolution uint     // seconds, one downsampled point per instance per Resolution
+	Metrics    []string // metric patterns, e.g. mysql/threads_*, empty = all metrics
+}
+
+// A Point is the metrics of one instance at Ts: the avg and max of an mm
+// report or, when downsampled, of all reports in Config.Resolution seconds.
+type Point struct {
+	Ts         int64 // UTC Unix timestamp
+	Service    string
+	InstanceId uint
+	Avg        map[string]float64 // keyed on metric name
+	Max        map[string]float64
+}
+
+// A Query selects history.  Zero values select everything.
+type Query struct {
+	Metrics    []string // metric patterns, e.g. mysql/threads_*
+	Service    string   // e.g. mysql
+	InstanceId uint
+	Begin      int64 // UTC Unix timestamp, inclusive
+	End        int64 // UTC Unix timestamp, exclusive, 0 = now
+}
+
+type Sample struct {
+	Ts  int64
+	Avg float64
+	Max float64
+}
+
+// A Series is the history of one metric of one instance, oldest first.
+type Series struct {
+	Service    string
+	InstanceId uint
+	Metric     string
+	Samples    []Sample
+}
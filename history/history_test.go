@@ -0,0 +1,154 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package history_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/percona/cloud-protocol/proto/v1"
+	"github.com/percona/percona-agent/history"
+	"github.com/percona/percona-agent/mm"
+	. "gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) { TestingT(t) }
+
+type StoreTestSuite struct {
+	tmpDir string
+}
+
+var _ = Suite(&StoreTestSuite{})
+
+func (s *StoreTestSuite) SetUpTest(t *C) {
+	var err error
+	s.tmpDir, err = ioutil.TempDir("/tmp", "history-test")
+	t.Assert(err, IsNil)
+}
+
+func (s *StoreTestSuite) TearDownTest(t *C) {
+	os.RemoveAll(s.tmpDir)
+}
+
+func point(ts int64, avg, max float64) *history.Point {
+	return &history.Point{
+		Ts:         ts,
+		Service:    "mysql",
+		InstanceId: 1,
+		Avg:        map[string]float64{"mysql/threads_running": avg},
+		Max:        map[string]float64{"mysql/threads_running": max},
+	}
+}
+
+func (s *StoreTestSuite) TestDownsample(t *C) {
+	points := []*history.Point{
+		point(1000, 1, 2),
+		point(1060, 3, 8),
+		point(1200, 5, 5),
+	}
+	got := history.Downsample(points, 300)
+	t.Check(got, DeepEquals, []*history.Point{
+		point(900, 2, 8),
+		point(1200, 5, 5),
+	})
+}
+
+func (s *StoreTestSuite) TestStore(t *C) {
+	store := history.NewStore(s.tmpDir)
+	day := time.Date(2015, 6, 1, 0, 0, 0, 0, time.UTC).Unix()
+
+	// Two days: 2015-06-01 and 2015-06-02.
+	for _, ts := range []int64{day, day + 60, day + history.DAY} {
+		err := store.Append([]*history.Point{point(ts, float64(ts-day+1), float64(ts-day+2))})
+		t.Assert(err, IsNil)
+	}
+	files, _ := filepath.Glob(filepath.Join(s.tmpDir, "*"))
+	t.Check(files, DeepEquals, []string{
+		filepath.Join(s.tmpDir, "2015-06-01.raw"),
+		filepath.Join(s.tmpDir, "2015-06-02.raw"),
+	})
+
+	now := time.Unix(day+history.DAY+3600, 0)
+	q := &history.Query{Metrics: []string{"mysql/threads_*"}}
+	series, err := store.Query(q, now)
+	t.Assert(err, IsNil)
+	t.Assert(series, HasLen, 1)
+	t.Check(series[0].Metric, Equals, "mysql/threads_running")
+	t.Check(series[0].Samples, DeepEquals, []history.Sample{
+		{Ts: day, Avg: 1, Max: 2},
+		{Ts: day + 60, Avg: 61, Max: 62},
+		{Ts: day + history.DAY, Avg: 86401, Max: 86402},
+	})
+
+	q = &history.Query{Metrics: []string{"mysql/uptime"}}
+	series, err = store.Query(q, now)
+	t.Assert(err, IsNil)
+	t.Check(series, HasLen, 0)
+
+	// On 2015-06-03, the first day is downsampled, the second isn't.
+	config := &history.Config{Days: 2, RawDays: 1, Resolution: 300}
+	downsampled, removed, err := store.Compact(now.Add(24*time.Hour), config)
+	t.Assert(err, IsNil)
+	t.Check(downsampled, Equals, 1)
+	t.Check(removed, Equals, 0)
+	series, err = store.Query(&history.Query{}, now)
+	t.Assert(err, IsNil)
+	t.Assert(series, HasLen, 1)
+	t.Check(series[0].Samples, DeepEquals, []history.Sample{
+		{Ts: day, Avg: 31, Max: 62},
+		{Ts: day + history.DAY, Avg: 86401, Max: 86402},
+	})
+
+	// On 2015-06-04, the first day is removed.
+	downsampled, removed, err = store.Compact(now.Add(48*time.Hour), config)
+	t.Assert(err, IsNil)
+	t.Check(downsampled, Equals, 1)
+	t.Check(removed, Equals, 1)
+	files, _ = filepath.Glob(filepath.Join(s.tmpDir, "*"))
+	t.Check(files, DeepEquals, []string{
+		filepath.Join(s.tmpDir, "2015-06-02.ds"),
+	})
+}
+
+func (s *StoreTestSuite) TestPoints(t *C) {
+	report := &mm.Report{
+		Ts: time.Unix(1000, 0),
+		Stats: []*mm.InstanceStats{
+			{
+				ServiceInstance: proto.ServiceInstance{Service: "mysql", InstanceId: 1},
+				Stats: map[string]*mm.Stats{
+					"mysql/threads_running": &mm.Stats{Avg: 3, Max: 9},
+					"mysql/uptime":          &mm.Stats{Avg: 100, Max: 100},
+				},
+			},
+			{
+				ServiceInstance: proto.ServiceInstance{Service: "server", InstanceId: 1},
+				Stats: map[string]*mm.Stats{
+					"loadavg/1min": &mm.Stats{Avg: 1, Max: 2},
+				},
+			},
+		},
+	}
+	got := history.Points(report, []string{"mysql/threads_*"})
+	t.Check(got, DeepEquals, []*history.Point{point(1000, 3, 9)})
+	got = history.Points(report, nil)
+	t.Check(got, HasLen, 2)
+}
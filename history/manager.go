@@ -0,0 +1,203 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package history
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path"
+	"time"
+
+	"github.com/percona/cloud-protocol/proto/v1"
+	"github.com/percona/percona-agent/mm"
+	"github.com/percona/percona-agent/mysql"
+	"github.com/percona/percona-agent/pct"
+	"github.com/percona/percona-agent/periodic"
+)
+
+// Manager keeps days of mm metrics on this host, so it has history even if
+// it never connects to the API.  It records reports as they're spooled (it's
+// a data.Recorder), downsamples old days, and answers Query cmds, e.g. from
+// "percona-agent ctl history".  StopService keeps the history: it's removed
+// by Compact after Days if the service is started again.
+type Manager struct {
+	*periodic.Manager
+	logger *pct.Logger
+	store  *Store
+}
+
+func NewManager(logger *pct.Logger, dir string) *Manager {
+	c := &compactor{
+		logger: logger,
+		store:  NewStore(dir),
+		status: pct.NewStatus([]string{SERVICE_NAME}),
+	}
+	// History is not per MySQL instance and compacts on its own ticker, so
+	// no clock, instance repo, or connection factory.
+	spec := periodic.Spec{
+		Name: SERVICE_NAME,
+	}
+	m := &Manager{
+		Manager: periodic.NewManager(spec, c, logger, c.status, nil, nil, nil),
+		logger:  logger,
+		store:   c.store,
+	}
+	return m
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Interface
+/////////////////////////////////////////////////////////////////////////////
+
+func (m *Manager) Handle(cmd *proto.Cmd) *proto.Reply {
+	if cmd.Cmd == "Query" {
+		// Not under the Manager mux: reading days of history takes a while,
+		// and Record must not wait.
+		return m.query(cmd)
+	}
+	return m.Manager.Handle(cmd)
+}
+
+// Record records an mm report.  Other data is ignored.
+func (m *Manager) Record(service string, data interface{}) {
+	if service != "mm" {
+		return
+	}
+	report, ok := data.(*mm.Report)
+	if !ok {
+		return
+	}
+	config, ok := m.Manager.Config().(*Config)
+	if !ok {
+		return // no config
+	}
+	if err := m.store.Append(Points(report, config.Metrics)); err != nil {
+		m.logger.Warn("Cannot record history:", err)
+	}
+}
+
+// Points returns the avg and max of the metrics matching a pattern, or all
+// metrics if there are no patterns, per instance in the report.
+func Points(report *mm.Report, patterns []string) []*Point {
+	points := []*Point{}
+	for _, is := range report.Stats {
+		p := &Point{
+			Ts:         report.Ts.Unix(),
+			Service:    is.Service,
+			InstanceId: is.InstanceId,
+			Avg:        map[string]float64{},
+			Max:        map[string]float64{},
+		}
+		for metric, stats := range is.Stats {
+			if len(patterns) > 0 && !Match(patterns, metric) {
+				continue
+			}
+			p.Avg[metric] = stats.Avg
+			p.Max[metric] = stats.Max
+		}
+		if len(p.Avg) > 0 {
+			points = append(points, p)
+		}
+	}
+	return points
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Implementation
+/////////////////////////////////////////////////////////////////////////////
+
+// proto.Cmd[Service:history, Cmd:Query, Data:history.Query]
+func (m *Manager) query(cmd *proto.Cmd) *proto.Reply {
+	if !m.Manager.Running() {
+		return cmd.Reply(nil, pct.ServiceIsNotRunningError{Service: SERVICE_NAME})
+	}
+	q := &Query{}
+	if err := json.Unmarshal(cmd.Data, q); err != nil {
+		return cmd.Reply(nil, errors.New("history.Handle:json.Unmarshal:"+err.Error()))
+	}
+	series, err := m.store.Query(q, time.Now())
+	return cmd.Reply(series, err)
+}
+
+// compactor is the periodic.Service of the Manager.
+type compactor struct {
+	logger *pct.Logger
+	store  *Store
+	status *pct.Status
+}
+
+func (c *compactor) NewConfig() interface{} {
+	return &Config{}
+}
+
+func (c *compactor) Validate(config interface{}) error {
+	cfg := config.(*Config)
+	if cfg.Days == 0 {
+		cfg.Days = DEFAULT_DAYS
+	}
+	if cfg.RawDays == 0 {
+		cfg.RawDays = DEFAULT_RAW_DAYS
+	}
+	if cfg.RawDays > cfg.Days {
+		return fmt.Errorf("RawDays (%d) must be less than or equal to Days (%d)", cfg.RawDays, cfg.Days)
+	}
+	if cfg.Resolution == 0 {
+		cfg.Resolution = DEFAULT_RESOLUTION
+	}
+	for _, pattern := range cfg.Metrics {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("Invalid metric pattern: %s: %s", pattern, err)
+		}
+	}
+	return nil
+}
+
+// ConfigSchema describes Config.  The constraints must match Validate.
+func (c *compactor) ConfigSchema() pct.ConfigSchema {
+	return pct.NewConfigSchema(SERVICE_NAME, Config{
+		Days:       DEFAULT_DAYS,
+		RawDays:    DEFAULT_RAW_DAYS,
+		Resolution: DEFAULT_RESOLUTION,
+	})
+}
+
+// Run compacts the store now and every COMPACT_INTERVAL.
+// @goroutine[1]
+func (c *compactor) Run(config interface{}, conn mysql.Connector, tickChan chan time.Time, runSync *pct.SyncChan) {
+	cfg := config.(*Config)
+	ticker := time.NewTicker(COMPACT_INTERVAL * time.Second)
+	defer ticker.Stop()
+	now := time.Now()
+	for {
+		c.status.Update(SERVICE_NAME, "Compacting")
+		downsampled, removed, err := c.store.Compact(now, cfg)
+		if err != nil {
+			c.logger.Warn("Cannot compact history:", err)
+		} else if downsampled > 0 || removed > 0 {
+			c.logger.Info(fmt.Sprintf("Downsampled %d and removed %d days of history", downsampled, removed))
+		}
+		c.status.Update(SERVICE_NAME, fmt.Sprintf("Keeping %d days, compacted at %s", cfg.Days, pct.TimeString(now)))
+		select {
+		case now = <-ticker.C:
+		case <-runSync.StopChan:
+			runSync.Graceful()
+			return
+		}
+	}
+}
@@ -0,0 +1,348 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package history
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/percona/percona-agent/pct"
+)
+
+const (
+	RAW_SUFFIX         = ".raw"
+	DOWNSAMPLED_SUFFIX = ".ds"
+	DAY_FORMAT         = "2006-01-02"
+	DAY                = 86400 // seconds
+)
+
+// A Store keeps points in append-only files of JSON lines, one file per UTC
+// day: 2015-06-01.raw while it has every point, 2015-06-01.ds after Compact
+// downsamples it.  Writers (Append and Compact) are serialized; Query reads
+// without locking, so it can see a partial last line, which it ignores.
+type Store struct {
+	dir string
+	// --
+	mux *sync.Mutex
+}
+
+func NewStore(dir string) *Store {
+	s := &Store{
+		dir: dir,
+		// --
+		mux: &sync.Mutex{},
+	}
+	return s
+}
+
+// Append appends the points to the raw files of their days.
+func (s *Store) Append(points []*Point) error {
+	if len(points) == 0 {
+		return nil
+	}
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if err := os.MkdirAll(s.dir, 0700); err != nil {
+		return err
+	}
+	lines := map[string]*bytes.Buffer{}
+	for _, p := range points {
+		file := s.file(p.Ts, RAW_SUFFIX)
+		buf, ok := lines[file]
+		if !ok {
+			buf = &bytes.Buffer{}
+			lines[file] = buf
+		}
+		if err := json.NewEncoder(buf).Encode(p); err != nil {
+			return err
+		}
+	}
+	for file, buf := range lines {
+		f, err := os.OpenFile(file, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+		if err != nil {
+			return err
+		}
+		_, err = f.Write(buf.Bytes())
+		f.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Compact downsamples raw days older than config.RawDays and removes days
+// older than config.Days.  It returns the number of days downsampled and
+// removed.
+func (s *Store) Compact(now time.Time, config *Config) (int, int, error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	files, err := s.dayFiles()
+	if err != nil {
+		return 0, 0, err
+	}
+	today := now.UTC().Truncate(DAY * time.Second)
+	removeBefore := today.AddDate(0, 0, -int(config.Days))
+	downsampleBefore := today.AddDate(0, 0, -int(config.RawDays))
+	downsampled := 0
+	removed := 0
+	for i, f := range files {
+		file := filepath.Join(s.dir, f.name)
+		if f.day.Before(removeBefore) {
+			if err := os.Remove(file); err != nil {
+				return downsampled, removed, err
+			}
+			removed++
+			continue
+		}
+		if !f.raw || !f.day.Before(downsampleBefore) {
+			continue
+		}
+		if i > 0 && !files[i-1].raw && files[i-1].day.Equal(f.day) {
+			// Downsampled but not removed, e.g. agent crashed.
+			if err := os.Remove(file); err != nil {
+				return downsampled, removed, err
+			}
+			continue
+		}
+		points, err := readPoints(file)
+		if err != nil {
+			return downsampled, removed, err
+		}
+		if err := writePoints(s.file(f.day.Unix(), DOWNSAMPLED_SUFFIX), Downsample(points, config.Resolution)); err != nil {
+			return downsampled, removed, err
+		}
+		if err := os.Remove(file); err != nil {
+			return downsampled, removed, err
+		}
+		downsampled++
+	}
+	return downsampled, removed, nil
+}
+
+// Query returns the series selected by q, sorted by service, instance, and
+// metric.  Raw points are used if a day has not been downsampled yet.
+func (s *Store) Query(q *Query, now time.Time) ([]*Series, error) {
+	end := q.End
+	if end == 0 {
+		end = now.Unix()
+	}
+	files, err := s.dayFiles()
+	if err != nil {
+		return nil, err
+	}
+	type seriesKey struct {
+		service string
+		id      uint
+		metric  string
+	}
+	series := map[seriesKey]*Series{}
+	for i, f := range files {
+		if f.day.Unix()+DAY <= q.Begin || f.day.Unix() >= end {
+			continue
+		}
+		if !f.raw && i+1 < len(files) && files[i+1].raw && files[i+1].day.Equal(f.day) {
+			continue // use the raw day
+		}
+		points, err := readPoints(filepath.Join(s.dir, f.name))
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue // removed or downsampled by Compact
+			}
+			return nil, err
+		}
+		for _, p := range points {
+			if p.Ts < q.Begin || p.Ts >= end {
+				continue
+			}
+			if (q.Service != "" && p.Service != q.Service) || (q.InstanceId != 0 && p.InstanceId != q.InstanceId) {
+				continue
+			}
+			for metric, avg := range p.Avg {
+				if len(q.Metrics) > 0 && !Match(q.Metrics, metric) {
+					continue
+				}
+				k := seriesKey{p.Service, p.InstanceId, metric}
+				ser, ok := series[k]
+				if !ok {
+					ser = &Series{Service: p.Service, InstanceId: p.InstanceId, Metric: metric}
+					series[k] = ser
+				}
+				ser.Samples = append(ser.Samples, Sample{Ts: p.Ts, Avg: avg, Max: p.Max[metric]})
+			}
+		}
+	}
+	result := make([]*Series, 0, len(series))
+	for _, ser := range series {
+		result = append(result, ser)
+	}
+	sort.Sort(bySeries(result))
+	return result, nil
+}
+
+// Downsample returns one point per instance per resolution seconds: the avg
+// of the avgs and the max of the maxes of the points in the interval.
+func Downsample(points []*Point, resolution uint) []*Point {
+	type bucketKey struct {
+		ts      int64
+		service string
+		id      uint
+	}
+	buckets := map[bucketKey]*Point{}
+	counts := map[bucketKey]map[string]int{}
+	result := []*Point{}
+	for _, p := range points {
+		k := bucketKey{p.Ts - p.Ts%int64(resolution), p.Service, p.InstanceId}
+		b, ok := buckets[k]
+		if !ok {
+			b = &Point{
+				Ts:         k.ts,
+				Service:    p.Service,
+				InstanceId: p.InstanceId,
+				Avg:        map[string]float64{},
+				Max:        map[string]float64{},
+			}
+			buckets[k] = b
+			counts[k] = map[string]int{}
+			result = append(result, b)
+		}
+		for metric, avg := range p.Avg {
+			b.Avg[metric] += avg
+			counts[k][metric]++
+		}
+		for metric, max := range p.Max {
+			if cur, ok := b.Max[metric]; !ok || max > cur {
+				b.Max[metric] = max
+			}
+		}
+	}
+	for k, b := range buckets {
+		for metric, n := range counts[k] {
+			b.Avg[metric] /= float64(n)
+		}
+	}
+	return result
+}
+
+// Match returns true if the metric matches a pattern.  Patterns are matched
+// like path.Match, e.g. mysql/threads_* or disk/*/reads.
+func Match(patterns []string, metric string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, metric); ok {
+			return true
+		}
+	}
+	return false
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Implementation
+/////////////////////////////////////////////////////////////////////////////
+
+type dayFile struct {
+	day  time.Time // UTC midnight
+	name string
+	raw  bool
+}
+
+// dayFiles returns the store files by day, a day's downsampled file before
+// its raw file.
+func (s *Store) dayFiles() ([]dayFile, error) {
+	fis, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	files := []dayFile{}
+	for _, fi := range fis { // sorted by name
+		ext := filepath.Ext(fi.Name())
+		if ext != RAW_SUFFIX && ext != DOWNSAMPLED_SUFFIX {
+			continue
+		}
+		day, err := time.Parse(DAY_FORMAT, strings.TrimSuffix(fi.Name(), ext))
+		if err != nil {
+			continue
+		}
+		files = append(files, dayFile{day: day, name: fi.Name(), raw: ext == RAW_SUFFIX})
+	}
+	return files, nil
+}
+
+func (s *Store) file(ts int64, suffix string) string {
+	return filepath.Join(s.dir, time.Unix(ts, 0).UTC().Format(DAY_FORMAT)+suffix)
+}
+
+// readPoints reads the points in the file.  A partial last line, being
+// appended or left by a crash, is ignored.
+func readPoints(file string) ([]*Point, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	points := []*Point{}
+	dec := json.NewDecoder(f)
+	for {
+		p := &Point{}
+		if err := dec.Decode(p); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				return points, nil
+			}
+			return points, err
+		}
+		points = append(points, p)
+	}
+}
+
+// writePoints writes the points atomically, so readers never see a partial
+// file.
+func writePoints(file string, points []*Point) error {
+	buf := &bytes.Buffer{}
+	enc := json.NewEncoder(buf)
+	for _, p := range points {
+		if err := enc.Encode(p); err != nil {
+			return err
+		}
+	}
+	return pct.WriteFile(file, buf.Bytes(), 0600)
+}
+
+type bySeries []*Series
+
+func (a bySeries) Len() int      { return len(a) }
+func (a bySeries) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
+func (a bySeries) Less(i, j int) bool {
+	if a[i].Service != a[j].Service {
+		return a[i].Service < a[j].Service
+	}
+	if a[i].InstanceId != a[j].InstanceId {
+		return a[i].InstanceId < a[j].InstanceId
+	}
+	return a[i].Metric < a[j].Metric
+}
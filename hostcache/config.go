@@ -0,0 +1,71 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package hostcache
+
+import (
+	"github.com/percona/cloud-protocol/proto/v1"
+	"github.com/percona/percona-agent/periodic"
+)
+
+const (
+	DEFAULT_INTERVAL  = 60  // seconds
+	DEFAULT_THRESHOLD = 0.8 // fraction of max_connect_errors
+)
+
+// Config is saved to config/hostcache.conf by StartService.  Reports are
+// synchronized like mm reports.
+type Config struct {
+	periodic.Config
+	Threshold float64 // alert when a host has this fraction of max_connect_errors
+}
+
+// A Host is a client host in performance_schema.host_cache with connection
+// errors.  MySQL blocks a host when ConnectErrors reaches max_connect_errors
+// until FLUSH HOSTS.
+type Host struct {
+	IP                   string
+	Host                 string `json:",omitempty"` // empty if not resolved
+	ConnectErrors        uint64 // SUM_CONNECT_ERRORS, compared to max_connect_errors
+	BlockedErrors        uint64 // COUNT_HOST_BLOCKED_ERRORS: connections refused because the host is blocked
+	HandshakeErrors      uint64
+	AuthenticationErrors uint64
+	MaxUserConnErrors    uint64 // COUNT_MAX_USER_CONNECTIONS_ERRORS
+	OtherErrors          uint64 // all other COUNT_*_ERRORS
+	LastErrorSeen        string `json:",omitempty"`
+}
+
+// An Alert is a host at or above Config.Threshold of max_connect_errors.
+// It's sent once until the host drops below the threshold, e.g. after FLUSH
+// HOSTS.
+type Alert struct {
+	Host
+	MaxConnectErrors uint64
+	Blocked          bool // ConnectErrors >= MaxConnectErrors
+}
+
+// A Report is sent every interval.  Status has the deltas of the Aborted_*
+// and Connection_errors_* status counters during the interval that began at
+// Ts.  Hosts are all hosts with connection errors, not deltas.
+type Report struct {
+	proto.ServiceInstance
+	Ts       int64 // UTC Unix timestamp, interval start
+	Duration uint  // seconds, interval length
+	Status   map[string]uint64
+	Hosts    []Host
+	Alerts   []Alert
+}
@@ -0,0 +1,282 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package hostcache_test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	mysqlDriver "github.com/go-sql-driver/mysql"
+	"github.com/percona/cloud-protocol/proto/v1"
+	"github.com/percona/percona-agent/bus"
+	"github.com/percona/percona-agent/hostcache"
+	"github.com/percona/percona-agent/instance"
+	"github.com/percona/percona-agent/pct"
+	"github.com/percona/percona-agent/periodic"
+	"github.com/percona/percona-agent/test"
+	"github.com/percona/percona-agent/test/mock"
+	. "gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) { TestingT(t) }
+
+type ManagerTestSuite struct {
+	logChan       chan *proto.LogEntry
+	logger        *pct.Logger
+	tmpDir        string
+	repo          *instance.Repo
+	mysqlInstance proto.ServiceInstance
+}
+
+var _ = Suite(&ManagerTestSuite{})
+
+func (s *ManagerTestSuite) SetUpSuite(t *C) {
+	s.logChan = make(chan *proto.LogEntry, 100)
+	s.logger = pct.NewLogger(s.logChan, hostcache.SERVICE_NAME+"-manager-test")
+
+	var err error
+	s.tmpDir, err = ioutil.TempDir("/tmp", "agent-test")
+	t.Assert(err, IsNil)
+	if err := pct.Basedir.Init(s.tmpDir); err != nil {
+		t.Fatal(err)
+	}
+
+	s.repo = instance.NewRepo(pct.NewLogger(s.logChan, "im-test"), pct.Basedir.Dir("config"), nil)
+	data, err := json.Marshal(&proto.MySQLInstance{
+		Hostname: "db1",
+		DSN:      "user:pass@tcp(127.0.0.1:3306)/",
+	})
+	t.Assert(err, IsNil)
+	s.repo.Add("mysql", 1, data, false)
+	s.mysqlInstance = proto.ServiceInstance{Service: "mysql", InstanceId: 1}
+}
+
+func (s *ManagerTestSuite) SetUpTest(t *C) {
+	pct.Basedir.RemoveConfig(hostcache.SERVICE_NAME)
+}
+
+func (s *ManagerTestSuite) TearDownSuite(t *C) {
+	if err := os.RemoveAll(s.tmpDir); err != nil {
+		t.Error(err)
+	}
+}
+
+// --------------------------------------------------------------------------
+
+func (s *ManagerTestSuite) TestCheckHosts(t *C) {
+	hosts := []hostcache.Host{
+		{IP: "10.0.0.1", ConnectErrors: 100},
+		{IP: "10.0.0.2", ConnectErrors: 85},
+		{IP: "10.0.0.3", ConnectErrors: 10},
+	}
+	alerted := map[string]bool{}
+
+	// 80% of 100 max_connect_errors: 10.0.0.1 is blocked, 10.0.0.2 is close.
+	alerts := hostcache.CheckHosts(hosts, 100, 0.8, alerted)
+	t.Check(alerts, DeepEquals, []hostcache.Alert{
+		{Host: hosts[0], MaxConnectErrors: 100, Blocked: true},
+		{Host: hosts[1], MaxConnectErrors: 100, Blocked: false},
+	})
+	t.Check(alerted, DeepEquals, map[string]bool{"10.0.0.1": true, "10.0.0.2": true})
+
+	// Hosts are alerted only once.
+	alerts = hostcache.CheckHosts(hosts, 100, 0.8, alerted)
+	t.Check(alerts, HasLen, 0)
+
+	// FLUSH HOSTS: hosts are alerted again when they reach the threshold again.
+	alerts = hostcache.CheckHosts([]hostcache.Host{}, 100, 0.8, alerted)
+	t.Check(alerts, HasLen, 0)
+	t.Check(alerted, HasLen, 0)
+	alerts = hostcache.CheckHosts(hosts[1:2], 100, 0.8, alerted)
+	t.Check(alerts, HasLen, 1)
+}
+
+func (s *ManagerTestSuite) TestStatusDeltas(t *C) {
+	prev := map[string]uint64{"Aborted_clients": 10, "Aborted_connects": 5}
+	cur := map[string]uint64{"Aborted_clients": 12, "Aborted_connects": 5, "Connection_errors_max_connections": 3}
+	t.Check(hostcache.StatusDeltas(prev, cur), DeepEquals, map[string]uint64{
+		"Aborted_clients":                   2,
+		"Aborted_connects":                  0,
+		"Connection_errors_max_connections": 3,
+	})
+
+	// Counters reset, e.g. MySQL restarted: cur is the delta.
+	t.Check(hostcache.StatusDeltas(cur, prev), DeepEquals, map[string]uint64{
+		"Aborted_clients":  10,
+		"Aborted_connects": 0,
+	})
+}
+
+func (s *ManagerTestSuite) TestStartService(t *C) {
+	clock := mock.NewClock()
+	fake := mock.NewFakeMySQL()
+	m := hostcache.NewManager(s.logger, clock, mock.NewSpooler(nil), s.repo, &mock.ConnectionFactory{Conn: fake}, nil)
+	err := m.Start()
+	t.Assert(err, IsNil)
+	defer m.Stop()
+
+	// Threshold is a fraction.
+	config := &hostcache.Config{
+		Config:    periodic.Config{ServiceInstance: s.mysqlInstance},
+		Threshold: 80,
+	}
+	data, _ := json.Marshal(config)
+	reply := m.Handle(&proto.Cmd{Service: hostcache.SERVICE_NAME, Cmd: "StartService", Data: data})
+	t.Check(reply.Error, Not(Equals), "")
+
+	config.Threshold = 0
+	data, _ = json.Marshal(config)
+	reply = m.Handle(&proto.Cmd{Service: hostcache.SERVICE_NAME, Cmd: "StartService", Data: data})
+	t.Assert(reply.Error, Equals, "")
+	t.Check(clock.Added, DeepEquals, []uint{hostcache.DEFAULT_INTERVAL})
+
+	// Config is saved with defaults.
+	saved := &hostcache.Config{}
+	err = pct.Basedir.ReadConfig(hostcache.SERVICE_NAME, saved)
+	t.Assert(err, IsNil)
+	t.Check(saved.Interval, Equals, uint(hostcache.DEFAULT_INTERVAL))
+	t.Check(saved.Threshold, Equals, hostcache.DEFAULT_THRESHOLD)
+
+	reply = m.Handle(&proto.Cmd{Service: hostcache.SERVICE_NAME, Cmd: "StopService"})
+	t.Check(reply.Error, Equals, "")
+	t.Check(pct.Basedir.ConfigExists(hostcache.SERVICE_NAME), Equals, false)
+}
+
+func (s *ManagerTestSuite) TestGetStatus(t *C) {
+	fake := mock.NewFakeMySQL()
+	fake.OnQuery("SHOW GLOBAL STATUS").Rows(
+		[]string{"Variable_name", "Value"},
+		[][]interface{}{
+			{"Aborted_clients", "3"},
+			{"Aborted_connects", 5},
+			{"Connection_errors_internal", 0},
+		},
+	)
+	got, err := hostcache.GetStatus(fake.DB())
+	t.Assert(err, IsNil)
+	t.Check(got, DeepEquals, map[string]uint64{
+		"Aborted_clients":            3,
+		"Aborted_connects":           5,
+		"Connection_errors_internal": 0,
+	})
+	t.Check(fake.Queries(), HasLen, 1)
+}
+
+func (s *ManagerTestSuite) TestGetHosts(t *C) {
+	fake := mock.NewFakeMySQL()
+	q := fake.OnQuery("FROM performance_schema.host_cache").Rows(
+		[]string{"IP", "HOST", "SUM_CONNECT_ERRORS", "BLOCKED", "HANDSHAKE", "AUTH", "MAX_USER", "OTHER", "LAST_ERROR_SEEN"},
+		[][]interface{}{
+			{"10.0.0.1", "app1", 99, 1, 90, 8, 0, 0, "2015-06-01 12:00:00"},
+			{"10.0.0.2", "", 1, 0, 1, 0, 0, 0, ""},
+		},
+	)
+	hosts, err := hostcache.GetHosts(fake.DB())
+	t.Assert(err, IsNil)
+	t.Assert(hosts, HasLen, 2)
+	t.Check(hosts[0], DeepEquals, hostcache.Host{
+		IP:                   "10.0.0.1",
+		Host:                 "app1",
+		ConnectErrors:        99,
+		BlockedErrors:        1,
+		HandshakeErrors:      90,
+		AuthenticationErrors: 8,
+		LastErrorSeen:        "2015-06-01 12:00:00",
+	})
+	t.Check(hosts[1].IP, Equals, "10.0.0.2")
+
+	// MySQL errors and latency, e.g. performance_schema disabled on a slow server.
+	q.Error(&mysqlDriver.MySQLError{Number: 1146, Message: "Table 'performance_schema.host_cache' doesn't exist"})
+	q.Delay(100 * time.Millisecond)
+	t0 := time.Now()
+	_, err = hostcache.GetHosts(fake.DB())
+	t.Check(err, NotNil)
+	t.Check(time.Now().Sub(t0) >= 100*time.Millisecond, Equals, true)
+	t.Check(q.Count(), Equals, 2)
+}
+
+func (s *ManagerTestSuite) TestReport(t *C) {
+	fake := mock.NewFakeMySQL()
+	status := fake.OnQuery("SHOW GLOBAL STATUS").Rows(
+		[]string{"Variable_name", "Value"},
+		[][]interface{}{{"Aborted_connects", 5}},
+	)
+	fake.OnQuery("FROM performance_schema.host_cache").Rows(
+		[]string{"IP", "HOST", "SUM_CONNECT_ERRORS", "BLOCKED", "HANDSHAKE", "AUTH", "MAX_USER", "OTHER", "LAST_ERROR_SEEN"},
+		[][]interface{}{
+			{"10.0.0.1", "app1", 90, 0, 90, 0, 0, 0, "2015-06-01 12:00:00"},
+		},
+	)
+	fake.SetGlobalVar("max_connect_errors", 100)
+	b := bus.New()
+	alerts := b.Subscribe(bus.ALERT, 0)
+	defer alerts.Cancel()
+	clock := mock.NewClock()
+	dataChan := make(chan interface{}, 1)
+	m := hostcache.NewManager(s.logger, clock, mock.NewSpooler(dataChan), s.repo, &mock.ConnectionFactory{Conn: fake}, b)
+	err := m.Start()
+	t.Assert(err, IsNil)
+	defer m.Stop()
+
+	config := &hostcache.Config{
+		Config: periodic.Config{ServiceInstance: s.mysqlInstance},
+	}
+	data, _ := json.Marshal(config)
+	reply := m.Handle(&proto.Cmd{Service: hostcache.SERVICE_NAME, Cmd: "StartService", Data: data})
+	t.Assert(reply.Error, Equals, "")
+	t.Assert(clock.Chans, HasLen, 1)
+
+	// The first tick starts the interval, so there's no report, but hosts
+	// close to max_connect_errors are alerted right away.
+	t0 := time.Date(2015, 6, 1, 12, 0, 0, 0, time.UTC)
+	clock.Chans[0] <- t0
+	select {
+	case e := <-alerts.C:
+		t.Check(e.Source, Equals, hostcache.SERVICE_NAME)
+		alert, ok := e.Data.(hostcache.Alert)
+		t.Assert(ok, Equals, true)
+		t.Check(alert.IP, Equals, "10.0.0.1")
+		t.Check(alert.MaxConnectErrors, Equals, uint64(100))
+		t.Check(alert.Blocked, Equals, false)
+	case <-time.After(time.Second):
+		t.Fatal("No alert")
+	}
+	ok := test.WaitStatusPrefix(1, m, hostcache.SERVICE_NAME, "Collected 1 hosts")
+	t.Assert(ok, Equals, true)
+	t.Check(dataChan, HasLen, 0)
+
+	status.Rows(
+		[]string{"Variable_name", "Value"},
+		[][]interface{}{{"Aborted_connects", 8}},
+	)
+	clock.Chans[0] <- t0.Add(time.Minute)
+	got := test.WaitData(dataChan)
+	t.Assert(got, HasLen, 1)
+	report, ok := got[0].(*hostcache.Report)
+	t.Assert(ok, Equals, true)
+	t.Check(report.ServiceInstance, DeepEquals, s.mysqlInstance)
+	t.Check(report.Ts, Equals, t0.Unix())
+	t.Check(report.Duration, Equals, uint(60))
+	t.Check(report.Status, DeepEquals, map[string]uint64{"Aborted_connects": 3})
+	t.Check(report.Hosts, HasLen, 1)
+	t.Check(report.Alerts, HasLen, 0) // alerted once
+	t.Check(fake.Connected(), Equals, uint(0))
+}
@@ -0,0 +1,289 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package hostcache
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/percona/percona-agent/bus"
+	"github.com/percona/percona-agent/data"
+	"github.com/percona/percona-agent/instance"
+	"github.com/percona/percona-agent/mysql"
+	"github.com/percona/percona-agent/pct"
+	"github.com/percona/percona-agent/periodic"
+	"github.com/percona/percona-agent/ticker"
+)
+
+const (
+	SERVICE_NAME = "hostcache"
+)
+
+// Manager reports connection errors every interval: aborted connections and
+// clients, connection errors by cause, and the hosts in performance_schema.host_cache
+// with connection errors.  It warns when a host approaches max_connect_errors,
+// before MySQL blocks it.
+type Manager struct {
+	*periodic.Manager
+}
+
+// NewManager returns a Manager which also publishes alerts on the bus, if not
+// nil, as bus.ALERT events.
+func NewManager(logger *pct.Logger, clock ticker.Manager, spool data.Spooler, instanceRepo *instance.Repo, connFactory mysql.ConnectionFactory, b *bus.Bus) *Manager {
+	c := &collector{
+		logger: logger,
+		spool:  spool,
+		bus:    b,
+		status: pct.NewStatus([]string{SERVICE_NAME, SERVICE_NAME + "-mysql"}),
+	}
+	spec := periodic.Spec{
+		Name:            SERVICE_NAME,
+		DefaultInterval: DEFAULT_INTERVAL,
+		SyncTicks:       true,
+	}
+	m := &Manager{
+		Manager: periodic.NewManager(spec, c, logger, c.status, clock, instanceRepo, connFactory),
+	}
+	return m
+}
+
+// collector is the periodic.Service of the Manager.
+type collector struct {
+	logger *pct.Logger
+	spool  data.Spooler
+	bus    *bus.Bus
+	status *pct.Status
+}
+
+func (c *collector) NewConfig() interface{} {
+	return &Config{}
+}
+
+func (c *collector) Validate(config interface{}) error {
+	cfg := config.(*Config)
+	if cfg.Threshold == 0 {
+		cfg.Threshold = DEFAULT_THRESHOLD
+	} else if cfg.Threshold < 0 || cfg.Threshold > 1 {
+		return fmt.Errorf("Invalid Threshold: %f: must be between 0 and 1", cfg.Threshold)
+	}
+	return nil
+}
+
+// ConfigSchema describes Config.  The constraints must match Validate.
+func (c *collector) ConfigSchema() pct.ConfigSchema {
+	s := pct.NewConfigSchema(SERVICE_NAME, Config{Threshold: DEFAULT_THRESHOLD})
+	f := s.Field("Threshold")
+	f.Min, f.Max = 0, 1
+	return s
+}
+
+// @goroutine[1]
+func (c *collector) Run(config interface{}, conn mysql.Connector, tickChan chan time.Time, runSync *pct.SyncChan) {
+	cfg := config.(*Config)
+
+	// Status counters at the start of the current interval, nil until the
+	// first tick.
+	var prev map[string]uint64
+	var prevTs time.Time
+
+	// Hosts already alerted, keyed on IP.
+	alerted := make(map[string]bool)
+
+	last := "Idle" // the last result, shown between ticks
+	for {
+		c.status.Update(SERVICE_NAME, last)
+		select {
+		case now := <-tickChan:
+			c.status.Update(SERVICE_NAME, "Collecting host cache")
+			c.status.Update(SERVICE_NAME+"-mysql", "Connecting")
+			if err := conn.Connect(2); err != nil {
+				c.logger.Warn(err)
+				c.status.Update(SERVICE_NAME+"-mysql", "Error: "+err.Error())
+				prev = nil // interval is incomplete
+				continue
+			}
+			c.status.Update(SERVICE_NAME+"-mysql", "Connected")
+			cur, err := GetStatus(conn.DB())
+			var hosts []Host
+			if err == nil {
+				hosts, err = GetHosts(conn.DB())
+			}
+			maxConnectErrors := uint64(conn.GetGlobalVarNumber("max_connect_errors"))
+			conn.Close()
+			c.status.Update(SERVICE_NAME+"-mysql", "Disconnected (OK)")
+			if err != nil {
+				c.logger.Warn(err)
+				prev = nil
+				continue
+			}
+
+			alerts := CheckHosts(hosts, maxConnectErrors, cfg.Threshold, alerted)
+			for i := range hosts {
+				ExcludeHost(&hosts[i])
+			}
+			for i, a := range alerts {
+				ExcludeHost(&alerts[i].Host)
+				host := alerts[i].IP
+				if host == "" {
+					host = "(excluded)"
+				}
+				if a.Blocked {
+					c.logger.Warn(fmt.Sprintf("Host %s is blocked: %d connect errors, max_connect_errors=%d",
+						host, a.ConnectErrors, a.MaxConnectErrors))
+				} else {
+					c.logger.Warn(fmt.Sprintf("Host %s has %d connect errors, max_connect_errors=%d",
+						host, a.ConnectErrors, a.MaxConnectErrors))
+				}
+				c.bus.Publish(bus.Event{Topic: bus.ALERT, Source: SERVICE_NAME, Data: alerts[i]})
+			}
+
+			if prev != nil {
+				report := &Report{
+					ServiceInstance: cfg.ServiceInstance,
+					Ts:              prevTs.UTC().Unix(),
+					Duration:        uint(now.Sub(prevTs).Seconds()),
+					Status:          StatusDeltas(prev, cur),
+					Hosts:           hosts,
+					Alerts:          alerts,
+				}
+				if err := c.spool.Write(SERVICE_NAME, report); err != nil {
+					c.logger.Warn("Lost report:", err)
+				}
+			}
+			prev = cur
+			prevTs = now
+			last = fmt.Sprintf("Collected %d hosts with connect errors at %s", len(hosts), pct.TimeString(now))
+		case <-runSync.StopChan:
+			runSync.Graceful()
+			return
+		}
+	}
+}
+
+// GetStatus returns the Aborted_connects, Aborted_clients, and
+// Connection_errors_* status counters.  MySQL 5.5 does not have
+// Connection_errors_*.
+func GetStatus(conn *sql.DB) (map[string]uint64, error) {
+	rows, err := conn.Query("SHOW GLOBAL STATUS WHERE Variable_name LIKE 'Aborted\\_%'" +
+		" OR Variable_name LIKE 'Connection\\_errors\\_%'")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	status := make(map[string]uint64)
+	for rows.Next() {
+		var name string
+		var value uint64
+		if err := rows.Scan(&name, &value); err != nil {
+			return nil, err
+		}
+		status[name] = value
+	}
+	return status, rows.Err()
+}
+
+// GetHosts returns the hosts in performance_schema.host_cache with
+// connection errors, most ConnectErrors first.
+func GetHosts(conn *sql.DB) ([]Host, error) {
+	rows, err := conn.Query("SELECT IP, COALESCE(HOST, ''), SUM_CONNECT_ERRORS," +
+		" COUNT_HOST_BLOCKED_ERRORS, COUNT_HANDSHAKE_ERRORS, COUNT_AUTHENTICATION_ERRORS," +
+		" COUNT_MAX_USER_CONNECTIONS_ERRORS," +
+		" COUNT_NAMEINFO_TRANSIENT_ERRORS + COUNT_NAMEINFO_PERMANENT_ERRORS + COUNT_FORMAT_ERRORS" +
+		" + COUNT_ADDRINFO_TRANSIENT_ERRORS + COUNT_ADDRINFO_PERMANENT_ERRORS + COUNT_FCRDNS_ERRORS" +
+		" + COUNT_HOST_ACL_ERRORS + COUNT_NO_AUTH_PLUGIN_ERRORS + COUNT_AUTH_PLUGIN_ERRORS" +
+		" + COUNT_PROXY_USER_ERRORS + COUNT_PROXY_USER_ACL_ERRORS + COUNT_SSL_ERRORS" +
+		" + COUNT_MAX_USER_CONNECTIONS_PER_HOUR_ERRORS + COUNT_DEFAULT_DATABASE_ERRORS" +
+		" + COUNT_INIT_CONNECT_ERRORS + COUNT_LOCAL_ERRORS + COUNT_UNKNOWN_ERRORS," +
+		" COALESCE(LAST_ERROR_SEEN, '')" +
+		" FROM performance_schema.host_cache" +
+		" WHERE SUM_CONNECT_ERRORS > 0 OR COUNT_HOST_BLOCKED_ERRORS > 0" +
+		" OR COUNT_HANDSHAKE_ERRORS > 0 OR COUNT_AUTHENTICATION_ERRORS > 0" +
+		" ORDER BY SUM_CONNECT_ERRORS DESC, IP")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	hosts := []Host{}
+	for rows.Next() {
+		var h Host
+		err := rows.Scan(&h.IP, &h.Host, &h.ConnectErrors, &h.BlockedErrors, &h.HandshakeErrors,
+			&h.AuthenticationErrors, &h.MaxUserConnErrors, &h.OtherErrors, &h.LastErrorSeen)
+		if err != nil {
+			return nil, err
+		}
+		hosts = append(hosts, h)
+	}
+	return hosts, rows.Err()
+}
+
+// ExcludeHost removes the IP and host name if excluded, see pct.Collect.  The
+// connection error counts are still reported.
+func ExcludeHost(h *Host) {
+	if !pct.Collect(pct.DATA_IPS) {
+		h.IP = ""
+	}
+	if !pct.Collect(pct.DATA_HOSTNAMES) {
+		h.Host = ""
+	}
+}
+
+// StatusDeltas returns the deltas of the status counters from GetStatus.  If
+// a counter decreased, e.g. MySQL restarted, cur is the delta.
+func StatusDeltas(prev, cur map[string]uint64) map[string]uint64 {
+	deltas := make(map[string]uint64, len(cur))
+	for name, c := range cur {
+		if p, ok := prev[name]; ok && c >= p {
+			deltas[name] = c - p
+		} else {
+			deltas[name] = c
+		}
+	}
+	return deltas
+}
+
+// CheckHosts returns an alert for each host with at least threshold of
+// maxConnectErrors connect errors which is not already alerted, and updates
+// alerted.  Hosts below the threshold are removed from alerted so they're
+// alerted again if their errors increase, e.g. after FLUSH HOSTS.  Hosts no
+// longer in the host cache are removed, too.
+func CheckHosts(hosts []Host, maxConnectErrors uint64, threshold float64, alerted map[string]bool) []Alert {
+	alerts := []Alert{}
+	seen := make(map[string]bool, len(hosts))
+	for _, h := range hosts {
+		if maxConnectErrors == 0 || float64(h.ConnectErrors) < threshold*float64(maxConnectErrors) {
+			continue
+		}
+		seen[h.IP] = true
+		if alerted[h.IP] {
+			continue
+		}
+		alerted[h.IP] = true
+		alerts = append(alerts, Alert{
+			Host:             h,
+			MaxConnectErrors: maxConnectErrors,
+			Blocked:          h.ConnectErrors >= maxConnectErrors,
+		})
+	}
+	for ip := range alerted {
+		if !seen[ip] {
+			delete(alerted, ip)
+		}
+	}
+	return alerts
+}
@@ -0,0 +1,67 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package index
+
+import (
+	"github.com/percona/cloud-protocol/proto/v1"
+	"github.com/percona/percona-agent/periodic"
+)
+
+const (
+	DEFAULT_INTERVAL = 86400 // seconds, index usage changes slowly
+)
+
+// Config is saved to config/index.conf by StartService.
+type Config struct {
+	periodic.Config
+}
+
+// Sources of index usage, see UnusedIndexes.
+const (
+	SOURCE_SYS      = "sys"      // sys.schema_unused_indexes (MySQL 5.6+ with sys schema)
+	SOURCE_USERSTAT = "userstat" // information_schema.INDEX_STATISTICS (Percona Server userstat=ON)
+)
+
+// An Index is a secondary or primary index.  Columns are in index order.
+type Index struct {
+	Db      string
+	Table   string
+	Name    string
+	Unique  bool
+	Columns []string
+}
+
+// A Duplicate is an index made redundant by another index on the same table
+// with the same leading columns, e.g. (a) is a duplicate of (a, b).
+type Duplicate struct {
+	Index
+	DuplicateOf Index
+}
+
+// A Report is sent every Interval.  Unused is empty if index usage is not
+// available, i.e. Source is empty.  Usage is counted since MySQL started, so
+// Uptime tells how meaningful Unused is: an index used only by a monthly job
+// seems unused after a restart.
+type Report struct {
+	proto.ServiceInstance
+	Ts         int64  // UTC Unix timestamp
+	Uptime     int64  // seconds, MySQL Uptime
+	Source     string // SOURCE_SYS, SOURCE_USERSTAT, or empty
+	Unused     []Index
+	Duplicates []Duplicate
+}
@@ -0,0 +1,242 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package index_test
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/percona/cloud-protocol/proto/v1"
+	"github.com/percona/percona-agent/index"
+	"github.com/percona/percona-agent/instance"
+	"github.com/percona/percona-agent/pct"
+	"github.com/percona/percona-agent/periodic"
+	"github.com/percona/percona-agent/test"
+	"github.com/percona/percona-agent/test/mock"
+	. "gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) { TestingT(t) }
+
+type ManagerTestSuite struct {
+	logChan       chan *proto.LogEntry
+	logger        *pct.Logger
+	tmpDir        string
+	repo          *instance.Repo
+	mysqlInstance proto.ServiceInstance
+}
+
+var _ = Suite(&ManagerTestSuite{})
+
+func (s *ManagerTestSuite) SetUpSuite(t *C) {
+	s.logChan = make(chan *proto.LogEntry, 100)
+	s.logger = pct.NewLogger(s.logChan, index.SERVICE_NAME+"-manager-test")
+
+	var err error
+	s.tmpDir, err = ioutil.TempDir("/tmp", "agent-test")
+	t.Assert(err, IsNil)
+	if err := pct.Basedir.Init(s.tmpDir); err != nil {
+		t.Fatal(err)
+	}
+
+	s.repo = instance.NewRepo(pct.NewLogger(s.logChan, "im-test"), pct.Basedir.Dir("config"), nil)
+	data, err := json.Marshal(&proto.MySQLInstance{
+		Hostname: "db1",
+		DSN:      "user:pass@tcp(127.0.0.1:3306)/",
+	})
+	t.Assert(err, IsNil)
+	s.repo.Add("mysql", 1, data, false)
+	s.mysqlInstance = proto.ServiceInstance{Service: "mysql", InstanceId: 1}
+}
+
+func (s *ManagerTestSuite) SetUpTest(t *C) {
+	pct.Basedir.RemoveConfig(index.SERVICE_NAME)
+}
+
+func (s *ManagerTestSuite) TearDownSuite(t *C) {
+	if err := os.RemoveAll(s.tmpDir); err != nil {
+		t.Error(err)
+	}
+}
+
+// --------------------------------------------------------------------------
+
+func (s *ManagerTestSuite) TestDuplicateIndexes(t *C) {
+	pk := index.Index{Db: "app", Table: "t", Name: "PRIMARY", Unique: true, Columns: []string{"id"}}
+	a := index.Index{Db: "app", Table: "t", Name: "a", Columns: []string{"a"}}
+	ab := index.Index{Db: "app", Table: "t", Name: "ab", Columns: []string{"a", "b"}}
+	a2 := index.Index{Db: "app", Table: "t", Name: "a2", Columns: []string{"a"}}
+	uniqB := index.Index{Db: "app", Table: "t", Name: "uniq_b", Unique: true, Columns: []string{"b"}}
+	bc := index.Index{Db: "app", Table: "t", Name: "bc", Columns: []string{"b", "c"}}
+	idx := index.Index{Db: "app", Table: "t", Name: "idx", Columns: []string{"id"}}
+	other := index.Index{Db: "app", Table: "t2", Name: "ab", Columns: []string{"a", "b"}}
+
+	// A unique index is not a duplicate of a longer index: uniqB and bc are ok.
+	got := index.DuplicateIndexes([]index.Index{pk, a, a2, ab, bc, idx, uniqB, other})
+	t.Check(got, DeepEquals, []index.Duplicate{
+		{Index: a, DuplicateOf: ab},
+		{Index: a2, DuplicateOf: a},
+		{Index: idx, DuplicateOf: pk},
+	})
+}
+
+// fakeIndexes makes fake return the indexes of app.t: PRIMARY (id), a (a),
+// and ab (a, b).
+func fakeIndexes(fake *mock.FakeMySQL) {
+	fake.OnQuery("FROM information_schema.STATISTICS").Rows(
+		[]string{"TABLE_SCHEMA", "TABLE_NAME", "INDEX_NAME", "NON_UNIQUE", "COLUMN_NAME"},
+		[][]interface{}{
+			{"app", "t", "PRIMARY", 0, "id"},
+			{"app", "t", "a", 1, "a"},
+			{"app", "t", "ab", 1, "a"},
+			{"app", "t", "ab", 1, "b"},
+		},
+	)
+}
+
+func (s *ManagerTestSuite) TestGetIndexes(t *C) {
+	fake := mock.NewFakeMySQL()
+	fakeIndexes(fake)
+	got, err := index.GetIndexes(fake.DB())
+	t.Assert(err, IsNil)
+	t.Check(got, DeepEquals, []index.Index{
+		{Db: "app", Table: "t", Name: "PRIMARY", Unique: true, Columns: []string{"id"}},
+		{Db: "app", Table: "t", Name: "a", Columns: []string{"a"}},
+		{Db: "app", Table: "t", Name: "ab", Columns: []string{"a", "b"}},
+	})
+
+	dupes := index.DuplicateIndexes(got)
+	t.Assert(dupes, HasLen, 1)
+	t.Check(dupes[0].Name, Equals, "a")
+	t.Check(dupes[0].DuplicateOf.Name, Equals, "ab")
+}
+
+func (s *ManagerTestSuite) TestUnusedIndexes(t *C) {
+	indexes := []index.Index{
+		{Db: "app", Table: "t", Name: "PRIMARY", Unique: true, Columns: []string{"id"}},
+		{Db: "app", Table: "t", Name: "a", Columns: []string{"a"}},
+		{Db: "app", Table: "t", Name: "ab", Columns: []string{"a", "b"}},
+	}
+
+	// sys schema, if it exists.  PRIMARY is never unused.
+	fake := mock.NewFakeMySQL()
+	fake.OnQuery("FROM sys.schema_unused_indexes").Rows(
+		[]string{"object_schema", "object_name", "index_name"},
+		[][]interface{}{{"app", "t", "PRIMARY"}, {"app", "t", "ab"}},
+	)
+	source, unused, err := index.UnusedIndexes(fake.DB(), "", indexes)
+	t.Assert(err, IsNil)
+	t.Check(source, Equals, index.SOURCE_SYS)
+	t.Check(unused, DeepEquals, []index.Index{indexes[2]})
+
+	// Else userstat, which has only used indexes.
+	fake = mock.NewFakeMySQL()
+	fake.OnQuery("FROM sys.schema_unused_indexes").Error(errors.New("Table 'sys.schema_unused_indexes' doesn't exist"))
+	fake.OnQuery("FROM information_schema.INDEX_STATISTICS").Rows(
+		[]string{"TABLE_SCHEMA", "TABLE_NAME", "INDEX_NAME"},
+		[][]interface{}{{"app", "t", "a"}},
+	)
+	source, unused, err = index.UnusedIndexes(fake.DB(), "ON", indexes)
+	t.Assert(err, IsNil)
+	t.Check(source, Equals, index.SOURCE_USERSTAT)
+	t.Check(unused, DeepEquals, []index.Index{indexes[2]})
+
+	// Else there's no index usage.
+	source, unused, err = index.UnusedIndexes(fake.DB(), "OFF", indexes)
+	t.Check(err, NotNil)
+	t.Check(source, Equals, "")
+	t.Check(unused, IsNil)
+}
+
+func (s *ManagerTestSuite) TestStartService(t *C) {
+	fake := mock.NewFakeMySQL()
+	m := index.NewManager(s.logger, mock.NewClock(), mock.NewSpooler(nil), s.repo, &mock.ConnectionFactory{Conn: fake})
+	err := m.Start()
+	t.Assert(err, IsNil)
+	defer m.Stop()
+
+	// Only MySQL instances.
+	config := &index.Config{
+		Config: periodic.Config{ServiceInstance: proto.ServiceInstance{Service: "server", InstanceId: 1}},
+	}
+	data, _ := json.Marshal(config)
+	reply := m.Handle(&proto.Cmd{Service: index.SERVICE_NAME, Cmd: "StartService", Data: data})
+	t.Check(reply.Error, Not(Equals), "")
+
+	config.ServiceInstance = s.mysqlInstance
+	data, _ = json.Marshal(config)
+	reply = m.Handle(&proto.Cmd{Service: index.SERVICE_NAME, Cmd: "StartService", Data: data})
+	t.Assert(reply.Error, Equals, "")
+
+	// Config is saved with the default interval.
+	saved := &index.Config{}
+	err = pct.Basedir.ReadConfig(index.SERVICE_NAME, saved)
+	t.Assert(err, IsNil)
+	t.Check(saved.Interval, Equals, uint(index.DEFAULT_INTERVAL))
+
+	configs, errs := m.GetConfig()
+	t.Check(errs, HasLen, 0)
+	t.Assert(configs, HasLen, 1)
+	t.Check(configs[0].Running, Equals, true)
+
+	reply = m.Handle(&proto.Cmd{Service: index.SERVICE_NAME, Cmd: "StopService"})
+	t.Check(reply.Error, Equals, "")
+	t.Check(pct.Basedir.ConfigExists(index.SERVICE_NAME), Equals, false)
+}
+
+func (s *ManagerTestSuite) TestReport(t *C) {
+	fake := mock.NewFakeMySQL()
+	fakeIndexes(fake)
+	fake.OnQuery("FROM sys.schema_unused_indexes").Error(errors.New("Table 'sys.schema_unused_indexes' doesn't exist"))
+	fake.SetUptime(3600)
+	clock := mock.NewClock()
+	dataChan := make(chan interface{}, 1)
+	m := index.NewManager(s.logger, clock, mock.NewSpooler(dataChan), s.repo, &mock.ConnectionFactory{Conn: fake})
+	err := m.Start()
+	t.Assert(err, IsNil)
+	defer m.Stop()
+
+	config := &index.Config{
+		Config: periodic.Config{ServiceInstance: s.mysqlInstance},
+	}
+	data, _ := json.Marshal(config)
+	reply := m.Handle(&proto.Cmd{Service: index.SERVICE_NAME, Cmd: "StartService", Data: data})
+	t.Assert(reply.Error, Equals, "")
+	t.Check(clock.Added, DeepEquals, []uint{index.DEFAULT_INTERVAL})
+	t.Assert(clock.Chans, HasLen, 1)
+
+	// Without index usage, duplicates are still reported.
+	now := time.Date(2015, 6, 1, 12, 0, 0, 0, time.UTC)
+	clock.Chans[0] <- now
+	got := test.WaitData(dataChan)
+	t.Assert(got, HasLen, 1)
+	report, ok := got[0].(*index.Report)
+	t.Assert(ok, Equals, true)
+	t.Check(report.ServiceInstance, DeepEquals, s.mysqlInstance)
+	t.Check(report.Ts, Equals, now.Unix())
+	t.Check(report.Uptime, Equals, int64(3600))
+	t.Check(report.Source, Equals, "")
+	t.Check(report.Unused, HasLen, 0)
+	t.Assert(report.Duplicates, HasLen, 1)
+	t.Check(report.Duplicates[0].Name, Equals, "a")
+	t.Check(fake.Connected(), Equals, uint(0))
+}
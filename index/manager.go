@@ -0,0 +1,296 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package index
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/percona/percona-agent/data"
+	"github.com/percona/percona-agent/instance"
+	"github.com/percona/percona-agent/mysql"
+	"github.com/percona/percona-agent/pct"
+	"github.com/percona/percona-agent/periodic"
+	"github.com/percona/percona-agent/ticker"
+)
+
+const (
+	SERVICE_NAME = "index"
+)
+
+// Manager periodically reports unused and duplicate indexes for index
+// advisor features.  Unlike schema, it reports every Interval, not only on
+// changes, because usage accumulates.
+type Manager struct {
+	*periodic.Manager
+}
+
+func NewManager(logger *pct.Logger, clock ticker.Manager, spool data.Spooler, instanceRepo *instance.Repo, connFactory mysql.ConnectionFactory) *Manager {
+	r := &reporter{
+		logger: logger,
+		spool:  spool,
+		status: pct.NewStatus([]string{SERVICE_NAME, SERVICE_NAME + "-mysql"}),
+	}
+	spec := periodic.Spec{
+		Name:            SERVICE_NAME,
+		DefaultInterval: DEFAULT_INTERVAL,
+		SyncTicks:       false,
+	}
+	m := &Manager{
+		Manager: periodic.NewManager(spec, r, logger, r.status, clock, instanceRepo, connFactory),
+	}
+	return m
+}
+
+// reporter is the periodic.Service of the Manager.
+type reporter struct {
+	logger *pct.Logger
+	spool  data.Spooler
+	status *pct.Status
+}
+
+func (r *reporter) NewConfig() interface{} {
+	return &Config{}
+}
+
+func (r *reporter) Validate(config interface{}) error {
+	return nil
+}
+
+// ConfigSchema describes Config.  The constraints must match Validate.
+func (r *reporter) ConfigSchema() pct.ConfigSchema {
+	return pct.NewConfigSchema(SERVICE_NAME, Config{})
+}
+
+// @goroutine[1]
+func (r *reporter) Run(config interface{}, conn mysql.Connector, tickChan chan time.Time, runSync *pct.SyncChan) {
+	cfg := config.(*Config)
+	last := "Idle" // the last result, shown between ticks
+	for {
+		r.status.Update(SERVICE_NAME, last)
+		select {
+		case now := <-tickChan:
+			r.status.Update(SERVICE_NAME, "Checking indexes")
+			report, err := r.report(cfg, conn, now)
+			if err != nil {
+				r.logger.Warn(err)
+				continue
+			}
+			if err := r.spool.Write(SERVICE_NAME, report); err != nil {
+				r.logger.Warn("Lost report:", err)
+			}
+			last = fmt.Sprintf("Found %d unused and %d duplicate indexes at %s",
+				len(report.Unused), len(report.Duplicates), pct.TimeString(now))
+		case <-runSync.StopChan:
+			runSync.Graceful()
+			return
+		}
+	}
+}
+
+func (r *reporter) report(config *Config, conn mysql.Connector, now time.Time) (*Report, error) {
+	r.status.Update(SERVICE_NAME+"-mysql", "Connecting")
+	if err := conn.Connect(2); err != nil {
+		r.status.Update(SERVICE_NAME+"-mysql", "Error: "+err.Error())
+		return nil, err
+	}
+	defer func() {
+		conn.Close()
+		r.status.Update(SERVICE_NAME+"-mysql", "Disconnected (OK)")
+	}()
+	r.status.Update(SERVICE_NAME+"-mysql", "Connected")
+
+	indexes, err := GetIndexes(conn.DB())
+	if err != nil {
+		return nil, err
+	}
+	uptime, err := conn.Uptime()
+	if err != nil {
+		return nil, err
+	}
+	source, unused, err := UnusedIndexes(conn.DB(), conn.GetGlobalVarString("userstat"), indexes)
+	if err != nil {
+		// Duplicates are still useful.
+		r.logger.Warn("Cannot get index usage:", err)
+	}
+	report := &Report{
+		ServiceInstance: config.ServiceInstance,
+		Ts:              now.UTC().Unix(),
+		Uptime:          uptime,
+		Source:          source,
+		Unused:          unused,
+		Duplicates:      DuplicateIndexes(indexes),
+	}
+	return report, nil
+}
+
+// GetIndexes returns all indexes of base tables except in system dbs,
+// ordered by db, table, and index.
+func GetIndexes(conn *sql.DB) ([]Index, error) {
+	rows, err := conn.Query("SELECT TABLE_SCHEMA, TABLE_NAME, INDEX_NAME, NON_UNIQUE, COLUMN_NAME" +
+		" FROM information_schema.STATISTICS" +
+		" WHERE TABLE_SCHEMA NOT IN ('mysql', 'information_schema', 'performance_schema', 'sys')" +
+		" ORDER BY TABLE_SCHEMA, TABLE_NAME, INDEX_NAME, SEQ_IN_INDEX")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	indexes := []Index{}
+	for rows.Next() {
+		var db, table, name, column string
+		var nonUnique int
+		if err := rows.Scan(&db, &table, &name, &nonUnique, &column); err != nil {
+			return nil, err
+		}
+		n := len(indexes) - 1
+		if n >= 0 && indexes[n].Db == db && indexes[n].Table == table && indexes[n].Name == name {
+			indexes[n].Columns = append(indexes[n].Columns, column)
+			continue
+		}
+		indexes = append(indexes, Index{
+			Db:      db,
+			Table:   table,
+			Name:    name,
+			Unique:  nonUnique == 0,
+			Columns: []string{column},
+		})
+	}
+	return indexes, rows.Err()
+}
+
+// UnusedIndexes returns the source of index usage and the indexes not used
+// since MySQL started.  userstat is @@userstat.  sys.schema_unused_indexes
+// is used if it exists, else information_schema.INDEX_STATISTICS if userstat
+// is enabled: it has only used indexes, so unused indexes are those not in it.
+// PRIMARY keys are never unused: InnoDB needs them.
+func UnusedIndexes(conn *sql.DB, userstat string, indexes []Index) (string, []Index, error) {
+	sysUnused, sysErr := sysUnusedIndexes(conn)
+	if sysErr == nil {
+		unused := []Index{}
+		for _, index := range indexes {
+			if index.Name != "PRIMARY" && sysUnused[indexKey(index.Db, index.Table, index.Name)] {
+				unused = append(unused, index)
+			}
+		}
+		return SOURCE_SYS, unused, nil
+	}
+
+	if userstat == "1" || strings.ToUpper(userstat) == "ON" {
+		used, err := userstatUsedIndexes(conn)
+		if err != nil {
+			return "", nil, err
+		}
+		unused := []Index{}
+		for _, index := range indexes {
+			if index.Name != "PRIMARY" && !used[indexKey(index.Db, index.Table, index.Name)] {
+				unused = append(unused, index)
+			}
+		}
+		return SOURCE_USERSTAT, unused, nil
+	}
+
+	return "", nil, fmt.Errorf("No sys schema (%s) and userstat is not enabled", sysErr)
+}
+
+func sysUnusedIndexes(conn *sql.DB) (map[string]bool, error) {
+	rows, err := conn.Query("SELECT object_schema, object_name, index_name FROM sys.schema_unused_indexes")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	unused := make(map[string]bool)
+	for rows.Next() {
+		var db, table, name string
+		if err := rows.Scan(&db, &table, &name); err != nil {
+			return nil, err
+		}
+		unused[indexKey(db, table, name)] = true
+	}
+	return unused, rows.Err()
+}
+
+func userstatUsedIndexes(conn *sql.DB) (map[string]bool, error) {
+	rows, err := conn.Query("SELECT TABLE_SCHEMA, TABLE_NAME, INDEX_NAME FROM information_schema.INDEX_STATISTICS")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	used := make(map[string]bool)
+	for rows.Next() {
+		var db, table, name string
+		if err := rows.Scan(&db, &table, &name); err != nil {
+			return nil, err
+		}
+		used[indexKey(db, table, name)] = true
+	}
+	return used, rows.Err()
+}
+
+func indexKey(db, table, name string) string {
+	return db + "." + table + "." + name
+}
+
+// DuplicateIndexes returns indexes whose columns are a leftmost prefix of
+// another index on the same table.  A unique index is a duplicate only of an
+// index with the same columns that's also unique, because the uniqueness
+// constraint is lost otherwise.  Of two identical indexes, the second by
+// name is the duplicate, but PRIMARY is never a duplicate.
+func DuplicateIndexes(indexes []Index) []Duplicate {
+	dupes := []Duplicate{}
+	for i, index := range indexes {
+		if index.Name == "PRIMARY" {
+			continue
+		}
+		for j, other := range indexes {
+			if i == j || other.Db != index.Db || other.Table != index.Table {
+				continue
+			}
+			if !isPrefix(index.Columns, other.Columns) {
+				continue
+			}
+			if len(index.Columns) == len(other.Columns) {
+				if index.Unique && !other.Unique {
+					continue
+				}
+				if index.Unique == other.Unique && other.Name != "PRIMARY" && other.Name > index.Name {
+					continue // other is the duplicate of index
+				}
+			} else if index.Unique {
+				continue
+			}
+			dupes = append(dupes, Duplicate{Index: index, DuplicateOf: other})
+			break
+		}
+	}
+	return dupes
+}
+
+// isPrefix returns true if a is a leftmost prefix of b, or equal to b.
+func isPrefix(a, b []string) bool {
+	if len(a) > len(b) {
+		return false
+	}
+	for i := range a {
+		if !strings.EqualFold(a[i], b[i]) {
+			return false
+		}
+	}
+	return true
+}
@@ -153,7 +153,23 @@ install() {
        error "Installed $BIN but ping test failed"
     fi
 
-    if [ "$KERNEL" != "Darwin" ]; then
+    if [[ $* == *-install-service* ]]; then
+       # The installer installed the service for the init system, but could
+       # not start the agent before its binary was installed.
+       if [ -f "/etc/systemd/system/$BIN.service" ]; then
+          systemctl start $BIN
+       elif [ -f "/etc/init/$BIN.conf" ]; then
+          initctl start $BIN
+       elif [ -x "$INIT_SCRIPT" ]; then
+          ${INIT_SCRIPT} start
+       else
+          echo "$BIN service is not installed (-init-system=none).  To start $BIN:"
+          echo "$BASEDIR/bin/$BIN -basedir $BASEDIR"
+       fi
+       if [ $? -ne 0 ]; then
+          error "Failed to start $BIN"
+       fi
+    elif [ "$KERNEL" != "Darwin" ]; then
        cp -f "$INSTALL_DIR/$BIN/init.d/$BIN" "/etc/init.d/"
        chmod a+x "/etc/init.d/$BIN"
 
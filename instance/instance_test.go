@@ -19,12 +19,18 @@ package instance_test
 
 import (
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/percona/cloud-protocol/proto/v1"
+	"github.com/percona/percona-agent/bus"
 	"github.com/percona/percona-agent/instance"
 	"github.com/percona/percona-agent/mysql"
 	"github.com/percona/percona-agent/pct"
@@ -73,6 +79,9 @@ func (s *RepoTestSuite) SetUpTest(t *C) {
 			t.Error(err)
 		}
 	}
+	if err := test.ClearConfigs(); err != nil {
+		t.Error(err)
+	}
 }
 
 func (s *RepoTestSuite) TearDownSuite(t *C) {
@@ -118,7 +127,7 @@ func (s *RepoTestSuite) TestAddRemove(t *C) {
 	im := instance.NewRepo(s.logger, s.configDir, s.api)
 	t.Assert(im, NotNil)
 
-	t.Check(test.FileExists(s.configDir+"/mysql-1.conf"), Equals, false)
+	t.Check(pct.Basedir.ConfigExists("mysql-1"), Equals, false)
 
 	mysqlIt := &proto.MySQLInstance{
 		Id:       1,
@@ -132,7 +141,7 @@ func (s *RepoTestSuite) TestAddRemove(t *C) {
 	err = im.Add("mysql", 1, data, true)
 	t.Assert(err, IsNil)
 
-	t.Check(test.FileExists(s.configDir+"/mysql-1.conf"), Equals, true)
+	t.Check(pct.Basedir.ConfigExists("mysql-1"), Equals, true)
 
 	got := &proto.MySQLInstance{}
 	err = im.Get("mysql", 1, got)
@@ -141,7 +150,7 @@ func (s *RepoTestSuite) TestAddRemove(t *C) {
 		t.Error(diff)
 	}
 
-	data, err = ioutil.ReadFile(s.configDir + "/mysql-1.conf")
+	data, err = pct.Basedir.ConfigData("mysql-1")
 	t.Assert(err, IsNil)
 
 	got = &proto.MySQLInstance{}
@@ -152,7 +161,84 @@ func (s *RepoTestSuite) TestAddRemove(t *C) {
 	}
 
 	im.Remove("mysql", 1)
-	t.Check(test.FileExists(s.configDir+"/mysql-1.conf"), Equals, false)
+	t.Check(pct.Basedir.ConfigExists("mysql-1"), Equals, false)
+}
+
+func (s *RepoTestSuite) TestVaultDSN(t *C) {
+	// Vault returns new credentials for each read.
+	reads := 0
+	renewable := true
+	vaultServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v1/sys/leases/renew" {
+			if !renewable {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			fmt.Fprint(w, `{"lease_id":"lease-1","lease_duration":3600,"renewable":true}`)
+			return
+		}
+		t.Check(r.URL.Path, Equals, "/v1/database/creds/agent")
+		reads++
+		fmt.Fprintf(w, `{"lease_id":"lease-%d","lease_duration":3600,"renewable":true,"data":{"username":"v-agent-%d","password":"secret"}}`, reads, reads)
+	}))
+	defer vaultServer.Close()
+	os.Setenv("VAULT_TOKEN", "s.token")
+	defer os.Unsetenv("VAULT_TOKEN")
+
+	b := bus.New()
+	sub := b.Subscribe(bus.CREDS_CHANGED, 0)
+	defer sub.Cancel()
+	creds := instance.NewVaultCreds(s.logger, pct.NewVault(pct.VaultConfig{Addr: vaultServer.URL}), b)
+
+	im := instance.NewRepo(s.logger, s.configDir, s.api)
+	mysqlIt := &proto.MySQLInstance{
+		Id:       1,
+		Hostname: "db1",
+		DSN:      "vault:database/creds/agent@tcp(127.0.0.1:3306)/",
+	}
+	data, err := json.Marshal(mysqlIt)
+	t.Assert(err, IsNil)
+	err = im.Add("mysql", 1, data, true)
+	t.Assert(err, IsNil)
+	defer im.Remove("mysql", 1)
+
+	// Vault not configured.
+	got := &proto.MySQLInstance{}
+	err = im.Get("mysql", 1, got)
+	t.Check(err, NotNil)
+
+	im.SetVaultCreds(creds)
+	got = &proto.MySQLInstance{}
+	err = im.Get("mysql", 1, got)
+	t.Assert(err, IsNil)
+	t.Check(got.DSN, Equals, "v-agent-1:secret@tcp(127.0.0.1:3306)/")
+
+	// Credentials are cached, and the password is not saved.
+	err = im.Get("mysql", 1, got)
+	t.Assert(err, IsNil)
+	t.Check(reads, Equals, 1)
+	data, err = pct.Basedir.ConfigData("mysql-1")
+	t.Assert(err, IsNil)
+	t.Check(strings.Contains(string(data), "secret"), Equals, false)
+
+	// Before 2/3 of the lease, nothing is renewed.  After, the lease is
+	// renewed and the credentials do not change.
+	t.Check(creds.Renew(time.Now()), DeepEquals, []string{})
+	t.Check(creds.Renew(time.Now().Add(41*time.Minute)), DeepEquals, []string{})
+	t.Check(reads, Equals, 1)
+
+	// If the lease cannot be renewed, new credentials are read.
+	renewable = false
+	t.Check(creds.Renew(time.Now().Add(2*time.Hour)), DeepEquals, []string{"database/creds/agent"})
+	select {
+	case e := <-sub.C:
+		t.Check(e.Data, Equals, "database/creds/agent")
+	default:
+		t.Error("No CREDS_CHANGED event")
+	}
+	err = im.Get("mysql", 1, got)
+	t.Assert(err, IsNil)
+	t.Check(got.DSN, Equals, "v-agent-2:secret@tcp(127.0.0.1:3306)/")
 }
 
 func (s *RepoTestSuite) TestErrors(t *C) {
@@ -219,6 +305,9 @@ func (s *ManagerTestSuite) SetUpTest(t *C) {
 			t.Error(err)
 		}
 	}
+	if err := test.ClearConfigs(); err != nil {
+		t.Error(err)
+	}
 }
 
 func (s *ManagerTestSuite) TearDownSuite(t *C) {
@@ -259,7 +348,7 @@ func (s *ManagerTestSuite) TestHandleGetInfoMySQL(t *C) {
 
 	// Create an instance manager.
 	mrm := mock.NewMrmsMonitor()
-	m := instance.NewManager(s.logger, s.configDir, s.api, mrm)
+	m := instance.NewManager(s.logger, s.configDir, s.api, mrm, mrm.Bus)
 	t.Assert(m, NotNil)
 
 	err := m.Start()
@@ -305,7 +394,7 @@ func (s *ManagerTestSuite) TestHandleGetInfoMySQL(t *C) {
 func (s *ManagerTestSuite) TestHandleAdd(t *C) {
 	// Create an instance manager.
 	mrm := mock.NewMrmsMonitor()
-	m := instance.NewManager(s.logger, s.configDir, s.api, mrm)
+	m := instance.NewManager(s.logger, s.configDir, s.api, mrm, mrm.Bus)
 	t.Assert(m, NotNil)
 
 	mysqlIt := &proto.MySQLInstance{
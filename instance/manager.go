@@ -28,6 +28,7 @@ import (
 	"strconv"
 
 	"github.com/percona/cloud-protocol/proto/v1"
+	"github.com/percona/percona-agent/bus"
 	"github.com/percona/percona-agent/mrms"
 	"github.com/percona/percona-agent/mysql"
 	"github.com/percona/percona-agent/pct"
@@ -40,27 +41,27 @@ type Manager struct {
 	configDir string
 	api       pct.APIConnector
 	// --
-	status         *pct.Status
-	repo           *Repo
-	stopChan       chan empty
-	mrm            mrms.Monitor
-	mrmChans       map[string]<-chan bool
-	mrmsGlobalChan chan string
-	agentConfig    *agent.Config
+	status      *pct.Status
+	repo        *Repo
+	stopChan    chan empty
+	mrm         mrms.Monitor
+	bus         *bus.Bus
+	agentConfig *agent.Config
 }
 
-func NewManager(logger *pct.Logger, configDir string, api pct.APIConnector, mrm mrms.Monitor) *Manager {
+// NewManager returns an instance manager which adds MySQL instances to mrm and
+// updates their info when mrm publishes a restart on b.
+func NewManager(logger *pct.Logger, configDir string, api pct.APIConnector, mrm mrms.Monitor, b *bus.Bus) *Manager {
 	repo := NewRepo(pct.NewLogger(logger.LogChan(), "instance-repo"), configDir, api)
 	m := &Manager{
 		logger:    logger,
 		configDir: configDir,
 		api:       api,
 		// --
-		status:         pct.NewStatus([]string{"instance", "instance-repo", "instance-mrms"}),
-		repo:           repo,
-		mrm:            mrm,
-		mrmChans:       make(map[string]<-chan bool),
-		mrmsGlobalChan: make(chan string, 100), // monitor up to 100 instances
+		status: pct.NewStatus([]string{"instance", "instance-repo", "instance-mrms"}),
+		repo:   repo,
+		mrm:    mrm,
+		bus:    b,
 	}
 	return m
 }
@@ -78,14 +79,10 @@ func (m *Manager) Start() error {
 	m.logger.Info("Started")
 	m.status.Update("instance", "Running")
 
-	mrmsGlobalChan, err := m.mrm.GlobalSubscribe()
-	if err != nil {
-		return err
-	}
+	restarts := m.bus.Subscribe(bus.MYSQL_RESTART, 0)
 
 	for _, instance := range m.GetMySQLInstances() {
-		ch, err := m.mrm.Add(instance.DSN)
-		if err != nil {
+		if err := m.mrm.Add(instance.DSN); err != nil {
 			m.logger.Error("Cannot add instance to the monitor:", err)
 			continue
 		}
@@ -97,10 +94,8 @@ func (m *Manager) Start() error {
 		}
 		m.status.Update("instance", "Updating info "+safeDSN)
 		m.pushInstanceInfo(instance)
-		// Store the channel to be able to remove it from mrms
-		m.mrmChans[instance.DSN] = ch
 	}
-	go m.monitorInstancesRestart(mrmsGlobalChan)
+	go m.monitorInstancesRestart(restarts)
 	return nil
 }
 
@@ -137,12 +132,10 @@ func (m *Manager) Handle(cmd *proto.Cmd) *proto.Reply {
 				m.logger.Error(err)
 				return cmd.Reply(nil, nil)
 			}
-			ch, err := m.mrm.Add(iit.DSN)
-			if err != nil {
+			if err := m.mrm.Add(iit.DSN); err != nil {
 				m.logger.Error(err)
 				return cmd.Reply(nil, nil)
 			}
-			m.mrmChans[iit.DSN] = ch
 
 			safeDSN := mysql.HideDSNPassword(iit.DSN)
 			m.status.Update("instance", "Getting info "+safeDSN)
@@ -169,7 +162,7 @@ func (m *Manager) Handle(cmd *proto.Cmd) *proto.Reply {
 			if err != nil {
 				m.logger.Error(err)
 			} else {
-				m.mrm.Remove(iit.DSN, m.mrmChans[iit.DSN])
+				m.mrm.Remove(iit.DSN)
 			}
 		}
 		err := m.repo.Remove(it.Service, it.InstanceId)
@@ -224,8 +217,9 @@ func GetMySQLInfo(it *proto.MySQLInstance) error {
 		return err
 	}
 	defer conn.Close()
+	// With skip_networking the port is meaningless, so don't append it.
 	sql := "SELECT /* percona-agent */" +
-		" CONCAT_WS('.', @@hostname, IF(@@port='3306',NULL,@@port)) AS Hostname," +
+		" CONCAT_WS('.', @@hostname, IF(@@port='3306' OR @@skip_networking,NULL,@@port)) AS Hostname," +
 		" @@version_comment AS Distro," +
 		" @@version AS Version"
 	err := conn.DB().QueryRow(sql).Scan(
@@ -267,7 +261,7 @@ func (m *Manager) GetMySQLInstances() []*proto.MySQLInstance {
 	return instances
 }
 
-func (m *Manager) monitorInstancesRestart(ch chan string) {
+func (m *Manager) monitorInstancesRestart(restarts *bus.Subscription) {
 	m.logger.Debug("monitorInstancesRestart:call")
 	defer func() {
 		if err := recover(); err != nil {
@@ -279,24 +273,18 @@ func (m *Manager) monitorInstancesRestart(ch chan string) {
 		m.logger.Debug("monitorInstancesRestart:return")
 	}()
 
-	ch, err := m.mrm.GlobalSubscribe()
-	if err != nil {
-		m.logger.Error(fmt.Sprintf("Failed to get MySQL restart monitor global channel: %s", err))
-		return
-	}
-
 	for {
 		m.status.Update("instance-mrms", "Idle")
 		select {
-		case dsn := <-ch:
-			safeDSN := mysql.HideDSNPassword(dsn)
+		case e := <-restarts.C:
+			safeDSN, _ := e.Data.(string)
 			m.logger.Debug("mrms:restart:" + safeDSN)
 			m.status.Update("instance-mrms", "Updating "+safeDSN)
 
 			// Get the updated instances list. It should be updated every time since
 			// the Add method can add new instances to the list.
 			for _, instance := range m.GetMySQLInstances() {
-				if instance.DSN != dsn {
+				if mysql.HideDSNPassword(instance.DSN) != safeDSN {
 					continue
 				}
 				m.status.Update("instance-mrms", "Getting info "+safeDSN)
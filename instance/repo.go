@@ -23,10 +23,7 @@ import (
 	"fmt"
 	"github.com/percona/cloud-protocol/proto/v1"
 	"github.com/percona/percona-agent/pct"
-	"io/ioutil"
 	"log"
-	"os"
-	"path/filepath"
 	"reflect"
 	"strconv"
 	"strings"
@@ -38,8 +35,9 @@ type Repo struct {
 	configDir string
 	api       pct.APIConnector
 	// --
-	it  map[string]interface{}
-	mux *sync.RWMutex
+	it    map[string]interface{}
+	mux   *sync.RWMutex
+	vault *VaultCreds // resolves Vault DSNs, see SetVaultCreds
 }
 
 func NewRepo(logger *pct.Logger, configDir string, api pct.APIConnector) *Repo {
@@ -54,6 +52,13 @@ func NewRepo(logger *pct.Logger, configDir string, api pct.APIConnector) *Repo {
 	return m
 }
 
+// SetVaultCreds sets how Get resolves MySQL instances with a Vault DSN.
+func (r *Repo) SetVaultCreds(vault *VaultCreds) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	r.vault = vault
+}
+
 func (r *Repo) Init() error {
 	for service, _ := range proto.ExternalService {
 		if err := r.loadInstances(service); err != nil {
@@ -64,19 +69,19 @@ func (r *Repo) Init() error {
 }
 
 func (r *Repo) loadInstances(service string) error {
-	files, err := filepath.Glob(r.configDir + "/" + service + "-*.conf")
+	names, err := pct.Basedir.ConfigNames(service + "-*")
 	if err != nil {
 		return err
 	}
 
-	for _, file := range files {
-		r.logger.Debug("Reading " + file)
+	for _, name := range names {
+		r.logger.Debug("Reading " + name)
 
 		// 0       1
 		// service-id
-		part := strings.Split(strings.TrimSuffix(filepath.Base(file), ".conf"), "-")
+		part := strings.Split(name, "-")
 		if len(part) != 2 {
-			return errors.New("Invalid instance file name: " + file)
+			return errors.New("Invalid instance config name: " + name)
 		}
 		service := part[0]
 		id, err := strconv.ParseUint(part[1], 10, 32)
@@ -87,16 +92,16 @@ func (r *Repo) loadInstances(service string) error {
 			return pct.InvalidServiceInstanceError{Service: service, Id: uint(id)}
 		}
 
-		data, err := ioutil.ReadFile(file)
+		data, err := pct.Basedir.ConfigData(name)
 		if err != nil {
-			return errors.New(file + ":" + err.Error())
+			return errors.New(name + ":" + err.Error())
 		}
 
 		if err := r.Add(service, uint(id), data, false); err != nil {
-			return errors.New(file + ":" + err.Error())
+			return errors.New(name + ":" + err.Error())
 		}
 
-		r.logger.Info("Loaded " + file)
+		r.logger.Info("Loaded " + name)
 	}
 	return nil
 }
@@ -188,7 +193,9 @@ func (r *Repo) get(service string, id uint, info interface{}) error {
 		url := fmt.Sprintf("%s/%s/%d", link, service, id)
 		r.logger.Info("GET", url)
 		code, data, err := r.api.Get(r.api.ApiKey(), url)
-		if err != nil {
+		if apiErr, ok := err.(pct.APIError); ok && apiErr.Code == 404 {
+			return pct.UnknownServiceInstanceError{Service: service, Id: id}
+		} else if err != nil {
 			return fmt.Errorf("Failed to get %s instance from %s: %s", name, link, err)
 		} else if code != 200 {
 			return fmt.Errorf("Getting %s instance from %s returned code %d, expected 200", name, link, code)
@@ -217,6 +224,19 @@ func (r *Repo) get(service string, id uint, info interface{}) error {
 	infoVal := reflect.ValueOf(info).Elem()
 	infoVal.Set(reflect.ValueOf(it).Elem())
 
+	// The caller gets a copy, so the Vault DSN is kept for the next Get,
+	// which returns the current credentials.
+	if mysqlIt, ok := info.(*proto.MySQLInstance); ok && IsVaultDSN(mysqlIt.DSN) {
+		if r.vault == nil {
+			return fmt.Errorf("%s DSN is in Vault but Vault is not configured", name)
+		}
+		dsn, err := r.vault.DSN(mysqlIt.DSN)
+		if err != nil {
+			return fmt.Errorf("Cannot get %s credentials from Vault: %s", name, err)
+		}
+		mysqlIt.DSN = dsn
+	}
+
 	return nil
 }
 
@@ -238,9 +258,8 @@ func (r *Repo) Remove(service string, id uint) error {
 		return pct.UnknownServiceInstanceError{Service: service, Id: id}
 	}
 
-	file := r.configDir + "/" + name + ".conf"
-	r.logger.Info("Removing", file)
-	if err := os.Remove(file); err != nil {
+	r.logger.Info("Removing", name)
+	if err := pct.Basedir.RemoveConfig(name); err != nil {
 		return err
 	}
 
@@ -0,0 +1,192 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package instance
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/percona/percona-agent/bus"
+	"github.com/percona/percona-agent/pct"
+)
+
+// VAULT_DSN_PREFIX marks a DSN whose user and password are dynamic MySQL
+// credentials from Vault, e.g. vault:database/creds/percona-agent@tcp(db:3306)/
+// reads database/creds/percona-agent and uses its username and password.  No
+// password is stored on disk.
+const VAULT_DSN_PREFIX = "vault:"
+
+// VAULT_CHECK_INTERVAL is how often VaultCreds.Run checks for leases to renew.
+const VAULT_CHECK_INTERVAL = 30 * time.Second
+
+// IsVaultDSN returns true if the DSN credentials are in Vault.
+func IsVaultDSN(dsn string) bool {
+	return strings.HasPrefix(dsn, VAULT_DSN_PREFIX)
+}
+
+// VaultCreds reads MySQL credentials from Vault for Vault DSNs and keeps their
+// leases alive.  A lease is renewed after 2/3 of its duration.  When it cannot
+// be renewed, e.g. at its max TTL, new credentials are read and the
+// CREDS_CHANGED event tells services to reconnect with them.
+type VaultCreds struct {
+	logger *pct.Logger
+	vault  *pct.Vault
+	bus    *bus.Bus
+	// --
+	leases map[string]*vaultLease // keyed on Vault path
+	mux    *sync.Mutex
+}
+
+type vaultLease struct {
+	user      string
+	password  string
+	leaseId   string
+	renewable bool
+	duration  time.Duration
+	renewAt   time.Time // zero if no lease
+}
+
+func NewVaultCreds(logger *pct.Logger, vault *pct.Vault, b *bus.Bus) *VaultCreds {
+	c := &VaultCreds{
+		logger: logger,
+		vault:  vault,
+		bus:    b,
+		// --
+		leases: make(map[string]*vaultLease),
+		mux:    &sync.Mutex{},
+	}
+	return c
+}
+
+// DSN returns the Vault DSN with the credentials from Vault, reading them the
+// first time.
+func (c *VaultCreds) DSN(dsn string) (string, error) {
+	path, host, err := splitVaultDSN(dsn)
+	if err != nil {
+		return "", err
+	}
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	lease, ok := c.leases[path]
+	if !ok {
+		lease, err = c.read(path, time.Now())
+		if err != nil {
+			return "", err
+		}
+		c.leases[path] = lease
+	}
+	return lease.user + ":" + lease.password + "@" + host, nil
+}
+
+// Run renews leases every VAULT_CHECK_INTERVAL until stopChan is closed.
+func (c *VaultCreds) Run(stopChan chan bool) {
+	defer func() {
+		if err := recover(); err != nil {
+			c.logger.Error("Vault credentials crashed: ", err)
+		}
+	}()
+	ticker := time.NewTicker(VAULT_CHECK_INTERVAL)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			c.Renew(now)
+		case <-stopChan:
+			return
+		}
+	}
+}
+
+// Renew renews the leases due at now and returns the Vault paths of new
+// credentials, for which it publishes CREDS_CHANGED.
+func (c *VaultCreds) Renew(now time.Time) []string {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	changed := []string{}
+	for path, lease := range c.leases {
+		if lease.renewAt.IsZero() || now.Before(lease.renewAt) {
+			continue
+		}
+		if lease.renewable {
+			secret, err := c.vault.Renew(lease.leaseId, lease.duration)
+			if err == nil && time.Duration(secret.LeaseDuration)*time.Second > 2*VAULT_CHECK_INTERVAL {
+				lease.duration = time.Duration(secret.LeaseDuration) * time.Second
+				lease.renewAt = now.Add(lease.duration * 2 / 3)
+				continue
+			}
+			if err != nil {
+				c.logger.Warn("Cannot renew Vault lease for", path+":", err)
+			}
+			// Else the lease is at its max TTL: rotate the credentials.
+		}
+		newLease, err := c.read(path, now)
+		if err != nil {
+			c.logger.Warn("Cannot read new MySQL credentials from Vault:", err)
+			continue // try again next check, the current ones might still work
+		}
+		c.leases[path] = newLease
+		if newLease.user == lease.user && newLease.password == lease.password {
+			continue
+		}
+		c.logger.Info("New MySQL credentials from Vault", path, "for user", newLease.user)
+		changed = append(changed, path)
+		c.bus.Publish(bus.Event{Topic: bus.CREDS_CHANGED, Source: "instance", Data: path})
+	}
+	return changed
+}
+
+func (c *VaultCreds) read(path string, now time.Time) (*vaultLease, error) {
+	secret, err := c.vault.Read(path)
+	if err != nil {
+		return nil, err
+	}
+	lease := &vaultLease{
+		user:      secret.Field("username"),
+		password:  secret.Field("password"),
+		leaseId:   secret.LeaseId,
+		renewable: secret.Renewable,
+		duration:  time.Duration(secret.LeaseDuration) * time.Second,
+	}
+	if lease.user == "" {
+		return nil, fmt.Errorf("Vault secret %s has no username", path)
+	}
+	if lease.duration > 0 {
+		lease.renewAt = now.Add(lease.duration * 2 / 3)
+	}
+	return lease, nil
+}
+
+// splitVaultDSN returns the Vault path and the part of the DSN after the
+// credentials, e.g. tcp(db:3306)/.
+func splitVaultDSN(dsn string) (string, string, error) {
+	if !IsVaultDSN(dsn) {
+		return "", "", errors.New("Not a Vault DSN")
+	}
+	at := strings.Index(dsn, "@")
+	if at < 0 {
+		return "", "", errors.New("Invalid Vault DSN: no @ after the Vault path")
+	}
+	path := dsn[len(VAULT_DSN_PREFIX):at]
+	if path == "" {
+		return "", "", errors.New("Invalid Vault DSN: no Vault path")
+	}
+	return path, dsn[at+1:], nil
+}
@@ -131,6 +131,15 @@ func (s *RelayTestSuite) TestLogLevel(t *C) {
 		{Ts: test.Ts, Level: proto.LOG_CRITICAL, Service: "test", Msg: "fatal"},
 	}
 	t.Check(got, DeepEquals, expect)
+
+	// Recent entries, oldest first, are only those at or below the log level.
+	recent := r.Recent()
+	t.Assert(len(recent) >= 3, Equals, true)
+	msgs := []string{}
+	for _, e := range recent[len(recent)-3:] {
+		msgs = append(msgs, e.Msg)
+	}
+	t.Check(msgs, DeepEquals, []string{"warning", "error", "fatal"})
 }
 
 func (s *RelayTestSuite) TestLogFile(t *C) {
@@ -611,8 +620,8 @@ func (s *ManagerTestSuite) TestLogService(t *C) {
 		t.Error("Log file changed dynamically, got\n", string(content))
 	}
 
-	// Verify new log config on disk.
-	data, err := ioutil.ReadFile(pct.Basedir.ConfigFile("log"))
+	// Verify new log config is saved.
+	data, err := pct.Basedir.ConfigData("log")
 	t.Assert(err, IsNil)
 	gotConfig := &log.Config{}
 	if err := json.Unmarshal(data, gotConfig); err != nil {
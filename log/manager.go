@@ -23,6 +23,7 @@ import (
 	"github.com/percona/cloud-protocol/proto/v1"
 	"github.com/percona/percona-agent/pct"
 	"os"
+	"sort"
 	"sync"
 	"time"
 )
@@ -101,7 +102,7 @@ func (m *Manager) Handle(cmd *proto.Cmd) *proto.Reply {
 
 		// proto.Cmd[Service:log, Cmd:SetConfig, Data:log.Config]
 		newConfig := &Config{}
-		if err := json.Unmarshal(cmd.Data, newConfig); err != nil {
+		if err := pct.UnmarshalConfig(cmd.Data, newConfig); err != nil {
 			return cmd.Reply(nil, err)
 		}
 
@@ -118,6 +119,11 @@ func (m *Manager) Handle(cmd *proto.Cmd) *proto.Reply {
 				errs = append(errs, errors.New("Timeout setting new log file"))
 			}
 		}
+		if m.config.Offline != newConfig.Offline {
+			if err := m.setOffline(newConfig.Offline); err != nil {
+				errs = append(errs, err)
+			}
+		}
 		if m.config.Level != newConfig.Level {
 			level := proto.LogLevelNumber[newConfig.Level] // already validated
 			select {
@@ -134,12 +140,35 @@ func (m *Manager) Handle(cmd *proto.Cmd) *proto.Reply {
 		}
 
 		return cmd.Reply(m.config, errs...)
+	case "ValidateConfig":
+		// Like SetConfig but only report what would change.
+		newConfig := &Config{}
+		if err := pct.UnmarshalConfig(cmd.Data, newConfig); err != nil {
+			return cmd.Reply(nil, err)
+		}
+		if err := m.validateConfig(newConfig); err != nil {
+			return cmd.Reply(nil, err)
+		}
+		m.mux.Lock()
+		changes, err := pct.ConfigChanges(m.config, newConfig)
+		m.mux.Unlock()
+		return cmd.Reply(changes, err)
 	case "GetConfig":
 		config, errs := m.GetConfig()
 		return cmd.Reply(config, errs...)
 	case "Reconnect":
 		m.client.Disconnect()
 		return cmd.Reply(nil)
+	case "Offline", "Online":
+		m.mux.Lock()
+		defer m.mux.Unlock()
+		if err := m.setOffline(cmd.Cmd == "Offline"); err != nil {
+			return cmd.Reply(nil, err)
+		}
+		if err := pct.Basedir.WriteConfig("log", m.config); err != nil {
+			return cmd.Reply(m.config, errors.New("log.WriteConfig:"+err.Error()))
+		}
+		return cmd.Reply(m.config)
 	default:
 		return cmd.Reply(nil, pct.UnknownCmdError{Cmd: cmd.Cmd})
 	}
@@ -167,11 +196,49 @@ func (m *Manager) GetConfig() ([]proto.AgentConfig, []error) {
 	return []proto.AgentConfig{config}, nil
 }
 
+// setOffline stops or resumes sending log entries to the API.  The caller
+// must hold mux.
+func (m *Manager) setOffline(offline bool) error {
+	if m.config.Offline == offline {
+		return nil
+	}
+	select {
+	case m.relay.OfflineChan() <- offline:
+		m.config.Offline = offline
+	case <-time.After(3 * time.Second):
+		return errors.New("Timeout setting offline")
+	}
+	return nil
+}
+
 // @goroutine[0]
 func (m *Manager) Relay() *Relay {
 	return m.relay
 }
 
+// RecentEntries returns the last log entries, oldest first, see Relay.Recent.
+func (m *Manager) RecentEntries() []proto.LogEntry {
+	m.mux.RLock()
+	relay := m.relay
+	m.mux.RUnlock()
+	if relay == nil {
+		return nil
+	}
+	return relay.Recent()
+}
+
+// ConfigSchema describes Config.  The constraints must match validateConfig.
+func (m *Manager) ConfigSchema() pct.ConfigSchema {
+	s := pct.NewConfigSchema("log", Config{Level: DEFAULT_LOG_LEVEL})
+	levels := make([]string, 0, len(proto.LogLevelNumber))
+	for level := range proto.LogLevelNumber {
+		levels = append(levels, level)
+	}
+	sort.Strings(levels)
+	s.Field("Level").Values = levels
+	return s
+}
+
 func (m *Manager) validateConfig(config *Config) error {
 	if config.Level == "" {
 		config.Level = DEFAULT_LOG_LEVEL
@@ -18,17 +18,20 @@
 package log
 
 import (
+	"encoding/json"
 	"fmt"
 	"github.com/percona/cloud-protocol/proto/v1"
 	"github.com/percona/percona-agent/pct"
 	golog "log"
 	"os"
 	"path/filepath"
+	"sync"
 	"time"
 )
 
 const (
 	BUFFER_SIZE int = 50
+	RECENT_SIZE int = 100 // recent log entries kept for the local status UI
 )
 
 type Relay struct {
@@ -41,6 +44,7 @@ type Relay struct {
 	connected     bool
 	logLevelChan  chan byte
 	logFileChan   chan string
+	offlineChan   chan bool
 	logger        *golog.Logger
 	firstBuf      []*proto.LogEntry
 	firstBufSize  int
@@ -48,6 +52,8 @@ type Relay struct {
 	secondBufSize int
 	lost          int
 	status        *pct.Status
+	recent        []proto.LogEntry
+	recentMux     *sync.Mutex // guards recent
 }
 
 func NewRelay(client pct.WebsocketClient, logChan chan *proto.LogEntry, logFile string, logLevel byte, offline bool) *Relay {
@@ -60,6 +66,7 @@ func NewRelay(client pct.WebsocketClient, logChan chan *proto.LogEntry, logFile
 		// --
 		logLevelChan: make(chan byte),
 		logFileChan:  make(chan string),
+		offlineChan:  make(chan bool),
 		firstBuf:     make([]*proto.LogEntry, BUFFER_SIZE),
 		secondBuf:    make([]*proto.LogEntry, BUFFER_SIZE),
 		status: pct.NewStatus([]string{
@@ -70,6 +77,8 @@ func NewRelay(client pct.WebsocketClient, logChan chan *proto.LogEntry, logFile
 			"log-buf1",
 			"log-buf2",
 		}),
+		recent:    []proto.LogEntry{},
+		recentMux: &sync.Mutex{},
 	}
 	return r
 }
@@ -86,6 +95,10 @@ func (r *Relay) LogFileChan() chan string {
 	return r.logFileChan
 }
 
+func (r *Relay) OfflineChan() chan bool {
+	return r.offlineChan
+}
+
 func (r *Relay) Status() map[string]string {
 	return r.status.Merge(r.client.Status())
 }
@@ -114,6 +127,8 @@ func (r *Relay) Run() {
 				continue
 			}
 
+			r.remember(entry)
+
 			// Write to file if there's a file (usually there isn't).
 			if r.logger != nil {
 				r.logger.Printf("%s: %s: %s\n", entry.Service, proto.LogLevelName[entry.Level], entry.Msg)
@@ -142,10 +157,47 @@ func (r *Relay) Run() {
 			r.setLogFile(file)
 		case level := <-r.logLevelChan:
 			r.setLogLevel(level)
+		case offline := <-r.offlineChan:
+			r.setOffline(offline)
 		}
 	}
 }
 
+// Recent returns the last RECENT_SIZE log entries at or below the log level,
+// oldest first.
+func (r *Relay) Recent() []proto.LogEntry {
+	r.recentMux.Lock()
+	defer r.recentMux.Unlock()
+	recent := make([]proto.LogEntry, len(r.recent))
+	copy(recent, r.recent)
+	return recent
+}
+
+func (r *Relay) remember(entry *proto.LogEntry) {
+	r.recentMux.Lock()
+	defer r.recentMux.Unlock()
+	r.recent = append(r.recent, *entry)
+	if len(r.recent) > RECENT_SIZE {
+		r.recent = r.recent[len(r.recent)-RECENT_SIZE:]
+	}
+}
+
+// setOffline stops or resumes sending log entries to the API.  Offline,
+// entries are only written to the log file, if any.
+func (r *Relay) setOffline(offline bool) {
+	if offline == r.offline {
+		return
+	}
+	r.offline = offline
+	if offline {
+		if r.client != nil && r.connected {
+			r.client.Disconnect()
+		}
+	} else {
+		go r.connect()
+	}
+}
+
 // Even the relayer needs to log stuff.
 func (r *Relay) internal(msg string, level byte) {
 	logEntry := &proto.LogEntry{
@@ -212,6 +264,9 @@ func (r *Relay) send(entry *proto.LogEntry, bufferOnErr bool) error {
 				r.buffer(entry)
 			}
 			r.client.Disconnect() // causes ConnectChan() to recv false in main loop
+		} else if bytes, err := json.Marshal(entry); err == nil {
+			// Log entries are not spooled, only sent.
+			pct.DataVolume.Add(time.Now(), "log", 0, len(bytes))
 		}
 	} else {
 		r.buffer(entry)
@@ -291,7 +346,7 @@ func (r *Relay) setLogFile(logFile string) {
 		file = os.Stderr
 	} else {
 		if !filepath.IsAbs(logFile) {
-			logFile = filepath.Join(pct.Basedir.Path(), logFile)
+			logFile = filepath.Join(pct.Basedir.Dir("log"), logFile)
 		}
 		var err error
 		file, err = os.OpenFile(logFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
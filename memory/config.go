@@ -0,0 +1,57 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package memory
+
+import (
+	"github.com/percona/cloud-protocol/proto/v1"
+	"github.com/percona/percona-agent/periodic"
+)
+
+const (
+	DEFAULT_INTERVAL = 60 // seconds
+	DEFAULT_LIMIT    = 20 // top instruments per report
+)
+
+// Config is saved to config/memory.conf by StartService.  Reports are
+// synchronized like mm reports.
+type Config struct {
+	periodic.Config
+	Limit uint // top instruments by bytes per report
+}
+
+// Usage is memory used by an instrument, e.g. memory/innodb/buf_buf_pool,
+// or by all instruments of a code area, e.g. innodb.  Growth is the change
+// in Bytes since the previous report, zero in the first report.
+type Usage struct {
+	Name      string
+	Bytes     int64 // CURRENT_NUMBER_OF_BYTES_USED
+	HighBytes int64 // HIGH_NUMBER_OF_BYTES_USED since MySQL started
+	Growth    int64
+}
+
+// A Report is current memory usage by code area, e.g. innodb, sql, or
+// temptable, and the top instruments.  Only instruments enabled in
+// performance_schema.setup_instruments are counted, so Total is less than
+// the memory used by mysqld.
+type Report struct {
+	proto.ServiceInstance
+	Ts          int64 // UTC Unix timestamp
+	Total       int64 // bytes, all instruments
+	Areas       []Usage
+	Instruments []Usage
+}
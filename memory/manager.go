@@ -0,0 +1,222 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package memory
+
+import (
+	"database/sql"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/percona/percona-agent/data"
+	"github.com/percona/percona-agent/instance"
+	"github.com/percona/percona-agent/mysql"
+	"github.com/percona/percona-agent/pct"
+	"github.com/percona/percona-agent/periodic"
+	"github.com/percona/percona-agent/ticker"
+)
+
+const (
+	SERVICE_NAME = "memory"
+)
+
+// Manager reports memory used by MySQL per code area and instrument from
+// performance_schema every interval, so memory growth can be attributed to,
+// e.g., the buffer pool vs. connections vs. temp tables.  It requires MySQL
+// 5.7 or newer with memory instruments enabled.
+type Manager struct {
+	*periodic.Manager
+}
+
+func NewManager(logger *pct.Logger, clock ticker.Manager, spool data.Spooler, instanceRepo *instance.Repo, connFactory mysql.ConnectionFactory) *Manager {
+	c := &collector{
+		logger: logger,
+		spool:  spool,
+		status: pct.NewStatus([]string{SERVICE_NAME, SERVICE_NAME + "-mysql"}),
+	}
+	spec := periodic.Spec{
+		Name:            SERVICE_NAME,
+		DefaultInterval: DEFAULT_INTERVAL,
+		SyncTicks:       true,
+	}
+	m := &Manager{
+		Manager: periodic.NewManager(spec, c, logger, c.status, clock, instanceRepo, connFactory),
+	}
+	return m
+}
+
+// collector is the periodic.Service of the Manager.
+type collector struct {
+	logger *pct.Logger
+	spool  data.Spooler
+	status *pct.Status
+}
+
+func (c *collector) NewConfig() interface{} {
+	return &Config{}
+}
+
+func (c *collector) Validate(config interface{}) error {
+	if cfg := config.(*Config); cfg.Limit == 0 {
+		cfg.Limit = DEFAULT_LIMIT
+	}
+	return nil
+}
+
+// ConfigSchema describes Config.  The constraints must match Validate.
+func (c *collector) ConfigSchema() pct.ConfigSchema {
+	return pct.NewConfigSchema(SERVICE_NAME, Config{Limit: DEFAULT_LIMIT})
+}
+
+// @goroutine[1]
+func (c *collector) Run(config interface{}, conn mysql.Connector, tickChan chan time.Time, runSync *pct.SyncChan) {
+	cfg := config.(*Config)
+
+	// Usage in the previous report, for Growth.
+	var prev map[string]Usage
+
+	last := "Idle" // the last result, shown between ticks
+	for {
+		c.status.Update(SERVICE_NAME, last)
+		select {
+		case now := <-tickChan:
+			c.status.Update(SERVICE_NAME, "Collecting memory usage")
+			c.status.Update(SERVICE_NAME+"-mysql", "Connecting")
+			if err := conn.Connect(2); err != nil {
+				c.logger.Warn(err)
+				c.status.Update(SERVICE_NAME+"-mysql", "Error: "+err.Error())
+				continue
+			}
+			c.status.Update(SERVICE_NAME+"-mysql", "Connected")
+			cur, err := GetUsage(conn.DB())
+			conn.Close()
+			c.status.Update(SERVICE_NAME+"-mysql", "Disconnected (OK)")
+			if err != nil {
+				c.logger.Warn(err)
+				continue
+			}
+			if len(cur) == 0 {
+				c.logger.Warn("No memory usage: performance_schema memory instruments are not enabled")
+			}
+
+			report := &Report{
+				ServiceInstance: cfg.ServiceInstance,
+				Ts:              now.UTC().Unix(),
+			}
+			report.Total, report.Areas, report.Instruments = Summarize(prev, cur, cfg.Limit)
+			if err := c.spool.Write(SERVICE_NAME, report); err != nil {
+				c.logger.Warn("Lost report:", err)
+			}
+			prev = cur
+			last = fmt.Sprintf("%d bytes in %d instruments at %s",
+				report.Total, len(cur), pct.TimeString(now))
+		case <-runSync.StopChan:
+			runSync.Graceful()
+			return
+		}
+	}
+}
+
+// GetUsage returns current memory usage of instruments using memory, keyed
+// on instrument name.
+func GetUsage(conn *sql.DB) (map[string]Usage, error) {
+	rows, err := conn.Query("SELECT EVENT_NAME, CURRENT_NUMBER_OF_BYTES_USED, HIGH_NUMBER_OF_BYTES_USED" +
+		" FROM performance_schema.memory_summary_global_by_event_name" +
+		" WHERE CURRENT_NUMBER_OF_BYTES_USED != 0 OR HIGH_NUMBER_OF_BYTES_USED != 0")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	usage := make(map[string]Usage)
+	for rows.Next() {
+		var u Usage
+		if err := rows.Scan(&u.Name, &u.Bytes, &u.HighBytes); err != nil {
+			return nil, err
+		}
+		usage[u.Name] = u
+	}
+	return usage, rows.Err()
+}
+
+// Area returns the code area of an instrument, e.g. innodb for
+// memory/innodb/buf_buf_pool.
+func Area(instrument string) string {
+	parts := strings.SplitN(instrument, "/", 3)
+	if len(parts) < 3 {
+		return instrument
+	}
+	return parts[1]
+}
+
+// Summarize returns the total bytes used, usage per area, and the top limit
+// instruments, both by bytes, most first, with Growth since prev, which can
+// be nil.  HighBytes of an area is the sum of its instruments' HighBytes, so
+// it's an upper bound.
+func Summarize(prev, cur map[string]Usage, limit uint) (int64, []Usage, []Usage) {
+	var total int64
+	areas := make(map[string]*Usage)
+	prevAreas := make(map[string]int64)
+	for _, p := range prev {
+		prevAreas[Area(p.Name)] += p.Bytes
+	}
+	instruments := []Usage{}
+	for name, u := range cur {
+		total += u.Bytes
+		if p, ok := prev[name]; ok {
+			u.Growth = u.Bytes - p.Bytes
+		} else if prev != nil {
+			u.Growth = u.Bytes
+		}
+		instruments = append(instruments, u)
+
+		area := Area(name)
+		a, ok := areas[area]
+		if !ok {
+			a = &Usage{Name: area}
+			areas[area] = a
+		}
+		a.Bytes += u.Bytes
+		a.HighBytes += u.HighBytes
+	}
+	areaUsage := []Usage{}
+	for name, a := range areas {
+		if prev != nil {
+			a.Growth = a.Bytes - prevAreas[name]
+		}
+		areaUsage = append(areaUsage, *a)
+	}
+	sort.Sort(ByBytes(areaUsage))
+	sort.Sort(ByBytes(instruments))
+	if uint(len(instruments)) > limit {
+		instruments = instruments[0:limit]
+	}
+	return total, areaUsage, instruments
+}
+
+// ByBytes sorts usage by Bytes, most first, then by Name.
+type ByBytes []Usage
+
+func (u ByBytes) Len() int      { return len(u) }
+func (u ByBytes) Swap(i, j int) { u[i], u[j] = u[j], u[i] }
+func (u ByBytes) Less(i, j int) bool {
+	if u[i].Bytes == u[j].Bytes {
+		return u[i].Name < u[j].Name
+	}
+	return u[i].Bytes > u[j].Bytes
+}
@@ -0,0 +1,244 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package memory_test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/percona/cloud-protocol/proto/v1"
+	"github.com/percona/percona-agent/instance"
+	"github.com/percona/percona-agent/memory"
+	"github.com/percona/percona-agent/pct"
+	"github.com/percona/percona-agent/periodic"
+	"github.com/percona/percona-agent/test"
+	"github.com/percona/percona-agent/test/mock"
+	. "gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) { TestingT(t) }
+
+type ManagerTestSuite struct {
+	logChan       chan *proto.LogEntry
+	logger        *pct.Logger
+	tmpDir        string
+	repo          *instance.Repo
+	mysqlInstance proto.ServiceInstance
+}
+
+var _ = Suite(&ManagerTestSuite{})
+
+func (s *ManagerTestSuite) SetUpSuite(t *C) {
+	s.logChan = make(chan *proto.LogEntry, 100)
+	s.logger = pct.NewLogger(s.logChan, memory.SERVICE_NAME+"-manager-test")
+
+	var err error
+	s.tmpDir, err = ioutil.TempDir("/tmp", "agent-test")
+	t.Assert(err, IsNil)
+	if err := pct.Basedir.Init(s.tmpDir); err != nil {
+		t.Fatal(err)
+	}
+
+	s.repo = instance.NewRepo(pct.NewLogger(s.logChan, "im-test"), pct.Basedir.Dir("config"), nil)
+	data, err := json.Marshal(&proto.MySQLInstance{
+		Hostname: "db1",
+		DSN:      "user:pass@tcp(127.0.0.1:3306)/",
+	})
+	t.Assert(err, IsNil)
+	s.repo.Add("mysql", 1, data, false)
+	s.mysqlInstance = proto.ServiceInstance{Service: "mysql", InstanceId: 1}
+}
+
+func (s *ManagerTestSuite) SetUpTest(t *C) {
+	pct.Basedir.RemoveConfig(memory.SERVICE_NAME)
+}
+
+func (s *ManagerTestSuite) TearDownSuite(t *C) {
+	if err := os.RemoveAll(s.tmpDir); err != nil {
+		t.Error(err)
+	}
+}
+
+// --------------------------------------------------------------------------
+
+func (s *ManagerTestSuite) TestArea(t *C) {
+	t.Check(memory.Area("memory/innodb/buf_buf_pool"), Equals, "innodb")
+	t.Check(memory.Area("memory/sql/THD::main_mem_root"), Equals, "sql")
+	t.Check(memory.Area("memory/temptable/physical_ram"), Equals, "temptable")
+	t.Check(memory.Area("foo"), Equals, "foo")
+}
+
+func (s *ManagerTestSuite) TestSummarize(t *C) {
+	cur := map[string]memory.Usage{
+		"memory/innodb/buf_buf_pool":    {Name: "memory/innodb/buf_buf_pool", Bytes: 1000, HighBytes: 1000},
+		"memory/innodb/hash0hash":       {Name: "memory/innodb/hash0hash", Bytes: 100, HighBytes: 100},
+		"memory/sql/THD::main_mem_root": {Name: "memory/sql/THD::main_mem_root", Bytes: 500, HighBytes: 800},
+	}
+
+	// First report: no growth.
+	total, areas, top := memory.Summarize(nil, cur, 2)
+	t.Check(total, Equals, int64(1600))
+	t.Check(areas, DeepEquals, []memory.Usage{
+		{Name: "innodb", Bytes: 1100, HighBytes: 1100},
+		{Name: "sql", Bytes: 500, HighBytes: 800},
+	})
+	t.Check(top, DeepEquals, []memory.Usage{
+		{Name: "memory/innodb/buf_buf_pool", Bytes: 1000, HighBytes: 1000},
+		{Name: "memory/sql/THD::main_mem_root", Bytes: 500, HighBytes: 800},
+	})
+
+	// Connections use more memory.
+	next := map[string]memory.Usage{
+		"memory/innodb/buf_buf_pool":    {Name: "memory/innodb/buf_buf_pool", Bytes: 1000, HighBytes: 1000},
+		"memory/innodb/hash0hash":       {Name: "memory/innodb/hash0hash", Bytes: 100, HighBytes: 100},
+		"memory/sql/THD::main_mem_root": {Name: "memory/sql/THD::main_mem_root", Bytes: 1500, HighBytes: 1500},
+	}
+	total, areas, top = memory.Summarize(cur, next, 1)
+	t.Check(total, Equals, int64(2600))
+	t.Check(areas, DeepEquals, []memory.Usage{
+		{Name: "sql", Bytes: 1500, HighBytes: 1500, Growth: 1000},
+		{Name: "innodb", Bytes: 1100, HighBytes: 1100},
+	})
+	t.Check(top, DeepEquals, []memory.Usage{
+		{Name: "memory/sql/THD::main_mem_root", Bytes: 1500, HighBytes: 1500, Growth: 1000},
+	})
+}
+
+// memory_summary_global_by_event_name columns selected by GetUsage.
+var usageColumns = []string{"EVENT_NAME", "CURRENT_NUMBER_OF_BYTES_USED", "HIGH_NUMBER_OF_BYTES_USED"}
+
+func (s *ManagerTestSuite) TestGetUsage(t *C) {
+	fake := mock.NewFakeMySQL()
+	fake.OnQuery("FROM performance_schema.memory_summary_global_by_event_name").Rows(
+		usageColumns,
+		[][]interface{}{
+			{"memory/innodb/buf_buf_pool", 1000, 1000},
+			{"memory/sql/THD::main_mem_root", 0, 800},
+		},
+	)
+	usage, err := memory.GetUsage(fake.DB())
+	t.Assert(err, IsNil)
+	t.Check(usage, DeepEquals, map[string]memory.Usage{
+		"memory/innodb/buf_buf_pool":    {Name: "memory/innodb/buf_buf_pool", Bytes: 1000, HighBytes: 1000},
+		"memory/sql/THD::main_mem_root": {Name: "memory/sql/THD::main_mem_root", Bytes: 0, HighBytes: 800},
+	})
+}
+
+func (s *ManagerTestSuite) TestStartService(t *C) {
+	clock := mock.NewClock()
+	fake := mock.NewFakeMySQL()
+	m := memory.NewManager(s.logger, clock, mock.NewSpooler(nil), s.repo, &mock.ConnectionFactory{Conn: fake})
+	err := m.Start()
+	t.Assert(err, IsNil)
+	defer m.Stop()
+
+	// Only MySQL instances.
+	config := &memory.Config{
+		Config: periodic.Config{ServiceInstance: proto.ServiceInstance{Service: "server", InstanceId: 1}},
+	}
+	data, _ := json.Marshal(config)
+	reply := m.Handle(&proto.Cmd{Service: memory.SERVICE_NAME, Cmd: "StartService", Data: data})
+	t.Check(reply.Error, Not(Equals), "")
+
+	config.ServiceInstance = s.mysqlInstance
+	data, _ = json.Marshal(config)
+	reply = m.Handle(&proto.Cmd{Service: memory.SERVICE_NAME, Cmd: "StartService", Data: data})
+	t.Assert(reply.Error, Equals, "")
+	t.Check(clock.Added, DeepEquals, []uint{memory.DEFAULT_INTERVAL})
+
+	// Config is saved with defaults.
+	saved := &memory.Config{}
+	err = pct.Basedir.ReadConfig(memory.SERVICE_NAME, saved)
+	t.Assert(err, IsNil)
+	t.Check(saved.Interval, Equals, uint(memory.DEFAULT_INTERVAL))
+	t.Check(saved.Limit, Equals, uint(memory.DEFAULT_LIMIT))
+
+	configs, errs := m.GetConfig()
+	t.Check(errs, HasLen, 0)
+	t.Assert(configs, HasLen, 1)
+	t.Check(configs[0].Running, Equals, true)
+
+	reply = m.Handle(&proto.Cmd{Service: memory.SERVICE_NAME, Cmd: "StopService"})
+	t.Check(reply.Error, Equals, "")
+	t.Check(pct.Basedir.ConfigExists(memory.SERVICE_NAME), Equals, false)
+}
+
+func (s *ManagerTestSuite) TestReport(t *C) {
+	fake := mock.NewFakeMySQL()
+	usage := fake.OnQuery("FROM performance_schema.memory_summary_global_by_event_name").Rows(
+		usageColumns,
+		[][]interface{}{
+			{"memory/innodb/buf_buf_pool", 1000, 1000},
+			{"memory/sql/THD::main_mem_root", 500, 800},
+		},
+	)
+	clock := mock.NewClock()
+	dataChan := make(chan interface{}, 1)
+	m := memory.NewManager(s.logger, clock, mock.NewSpooler(dataChan), s.repo, &mock.ConnectionFactory{Conn: fake})
+	err := m.Start()
+	t.Assert(err, IsNil)
+	defer m.Stop()
+
+	config := &memory.Config{
+		Config: periodic.Config{ServiceInstance: s.mysqlInstance},
+		Limit:  1,
+	}
+	data, _ := json.Marshal(config)
+	reply := m.Handle(&proto.Cmd{Service: memory.SERVICE_NAME, Cmd: "StartService", Data: data})
+	t.Assert(reply.Error, Equals, "")
+	t.Assert(clock.Chans, HasLen, 1)
+
+	// Unlike waits, the first interval is reported.
+	t0 := time.Date(2015, 6, 1, 12, 0, 0, 0, time.UTC)
+	clock.Chans[0] <- t0
+	got := test.WaitData(dataChan)
+	t.Assert(got, HasLen, 1)
+	t.Check(got[0], DeepEquals, &memory.Report{
+		ServiceInstance: s.mysqlInstance,
+		Ts:              t0.Unix(),
+		Total:           1500,
+		Areas: []memory.Usage{
+			{Name: "innodb", Bytes: 1000, HighBytes: 1000},
+			{Name: "sql", Bytes: 500, HighBytes: 800},
+		},
+		Instruments: []memory.Usage{
+			{Name: "memory/innodb/buf_buf_pool", Bytes: 1000, HighBytes: 1000},
+		},
+	})
+
+	// Growth is since the previous report.
+	usage.Rows(
+		usageColumns,
+		[][]interface{}{
+			{"memory/innodb/buf_buf_pool", 1000, 1000},
+			{"memory/sql/THD::main_mem_root", 1500, 1500},
+		},
+	)
+	clock.Chans[0] <- t0.Add(time.Minute)
+	got = test.WaitData(dataChan)
+	t.Assert(got, HasLen, 1)
+	report := got[0].(*memory.Report)
+	t.Check(report.Total, Equals, int64(2500))
+	t.Check(report.Instruments, DeepEquals, []memory.Usage{
+		{Name: "memory/sql/THD::main_mem_root", Bytes: 1500, HighBytes: 1500, Growth: 1000},
+	})
+	t.Check(fake.Connected(), Equals, uint(0))
+}
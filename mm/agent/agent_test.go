@@ -0,0 +1,114 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package agent_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/percona/cloud-protocol/proto/v1"
+	"github.com/percona/percona-agent/mm"
+	"github.com/percona/percona-agent/mm/agent"
+	"github.com/percona/percona-agent/pct"
+	. "gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) { TestingT(t) }
+
+type AgentTestSuite struct {
+	logChan chan *proto.LogEntry
+	logger  *pct.Logger
+}
+
+var _ = Suite(&AgentTestSuite{})
+
+func (s *AgentTestSuite) SetUpSuite(t *C) {
+	s.logChan = make(chan *proto.LogEntry, 10)
+	s.logger = pct.NewLogger(s.logChan, "agent-monitor-test")
+}
+
+// --------------------------------------------------------------------------
+
+func metricMap(metrics []mm.Metric) map[string]mm.Metric {
+	m := make(map[string]mm.Metric)
+	for _, metric := range metrics {
+		m[metric.Name] = metric
+	}
+	return m
+}
+
+func (s *AgentTestSuite) TestCollect(t *C) {
+	metrics := pct.NewMetrics()
+	queue := 3
+	metrics.SetFunc("cmd/queue", func() float64 { return float64(queue) })
+	metrics.Add("ws/reconnects", 1)
+
+	m := agent.NewMonitor("mm-agent", &agent.Config{}, s.logger, metrics)
+
+	got := metricMap(m.Collect())
+	t.Check(got["agent/goroutines"].Number > 0, Equals, true)
+	t.Check(got["agent/heap/alloc"].Number > 0, Equals, true)
+	t.Check(got["agent/cmd/queue"], Equals, mm.Metric{Name: "agent/cmd/queue", Type: "gauge", Number: 3})
+	t.Check(got["agent/ws/reconnects"], Equals, mm.Metric{Name: "agent/ws/reconnects", Type: "counter", Number: 1})
+	t.Check(got["agent/cmd/exec_time"], Equals, mm.Metric{Name: "agent/cmd/exec_time", Type: "gauge", Number: 0})
+
+	// Two cmds: 10ms and 30ms, so avg 20ms.
+	metrics.Add("cmd/count", 2)
+	metrics.Add("cmd/exec_time", 40)
+	queue = 0
+	got = metricMap(m.Collect())
+	t.Check(got["agent/cmd/queue"].Number, Equals, float64(0))
+	t.Check(got["agent/cmd/exec_time"].Number, Equals, float64(20))
+	_, ok := got["agent/cmd/count"]
+	t.Check(ok, Equals, false)
+
+	// No cmds since last collect.
+	got = metricMap(m.Collect())
+	t.Check(got["agent/cmd/exec_time"].Number, Equals, float64(0))
+}
+
+func (s *AgentTestSuite) TestStartCollectStop(t *C) {
+	config := &agent.Config{
+		Config: mm.Config{
+			ServiceInstance: proto.ServiceInstance{Service: "agent", InstanceId: 0},
+			Collect:         1,
+			Report:          60,
+		},
+	}
+	m := agent.NewMonitor("mm-agent", config, s.logger, pct.NewMetrics())
+
+	tickChan := make(chan time.Time)
+	collectionChan := make(chan *mm.Collection, 1)
+	err := m.Start(tickChan, collectionChan)
+	t.Assert(err, IsNil)
+
+	now := time.Now()
+	tickChan <- now
+	select {
+	case c := <-collectionChan:
+		t.Check(c.Service, Equals, "agent")
+		t.Check(c.Ts, Equals, now.UTC().Unix())
+		t.Check(len(c.Metrics) > 0, Equals, true)
+	case <-time.After(1 * time.Second):
+		t.Error("No collection after 1s")
+	}
+
+	err = m.Stop()
+	t.Assert(err, IsNil)
+	t.Check(m.Status()["mm-agent"], Equals, "Stopped")
+}
@@ -0,0 +1,211 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package agent
+
+import (
+	"fmt"
+	"runtime"
+	"sort"
+	"time"
+
+	"github.com/percona/cloud-protocol/proto/v1"
+	"github.com/percona/percona-agent/mm"
+	"github.com/percona/percona-agent/pct"
+)
+
+// Monitor collects the agent's own metrics: runtime stats and pct.AgentMetrics,
+// all prefixed "agent/".  These show when the agent itself is struggling.
+type Monitor struct {
+	name    string
+	logger  *pct.Logger
+	config  *Config
+	metrics *pct.Metrics
+	// --
+	tickChan       chan time.Time
+	collectionChan chan *mm.Collection
+	// --
+	lastCmdCount    float64
+	lastCmdExecTime float64
+	sync            *pct.SyncChan
+	status          *pct.Status
+	running         bool
+}
+
+func NewMonitor(name string, config *Config, logger *pct.Logger, metrics *pct.Metrics) *Monitor {
+	m := &Monitor{
+		name:    name,
+		config:  config,
+		logger:  logger,
+		metrics: metrics,
+		// --
+		status: pct.NewStatus([]string{name}),
+		sync:   pct.NewSyncChan(),
+	}
+	return m
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Interface
+/////////////////////////////////////////////////////////////////////////////
+
+// @goroutine[0]
+func (m *Monitor) Start(tickChan chan time.Time, collectionChan chan *mm.Collection) error {
+	m.logger.Debug("Start:call")
+	defer m.logger.Debug("Start:return")
+
+	if m.running {
+		return pct.ServiceIsRunningError{Service: m.name}
+	}
+
+	m.tickChan = tickChan
+	m.collectionChan = collectionChan
+
+	go m.run()
+	m.running = true
+	m.logger.Info("Started")
+
+	return nil
+}
+
+// @goroutine[0]
+func (m *Monitor) Stop() error {
+	m.logger.Debug("Stop:call")
+	defer m.logger.Debug("Stop:return")
+
+	if m.config == nil {
+		return nil // already stopped
+	}
+
+	// Stop run().  When it returns, it updates status to "Stopped".
+	m.status.Update(m.name, "Stopping")
+	m.sync.Stop()
+	m.sync.Wait()
+
+	m.config = nil // no config if not running
+	m.running = false
+	m.logger.Info("Stopped")
+
+	// Do not update status to "Stopped" here; run() does that on return.
+	return nil
+}
+
+// @goroutine[0]
+func (m *Monitor) Status() map[string]string {
+	return m.status.All()
+}
+
+// @goroutine[0]
+func (m *Monitor) TickChan() chan time.Time {
+	return m.tickChan
+}
+
+// @goroutine[0]
+func (m *Monitor) Config() interface{} {
+	return m.config
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Implementation
+/////////////////////////////////////////////////////////////////////////////
+
+// Collect returns the current agent metrics.  cmd/count and cmd/exec_time are
+// reported as agent/cmd/exec_time: the average ms per cmd since the last call.
+func (m *Monitor) Collect() []mm.Metric {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	metrics := []mm.Metric{
+		{Name: "agent/goroutines", Type: "gauge", Number: float64(runtime.NumGoroutine())},
+		{Name: "agent/heap/alloc", Type: "gauge", Number: float64(mem.HeapAlloc)},
+		{Name: "agent/heap/sys", Type: "gauge", Number: float64(mem.HeapSys)},
+		{Name: "agent/heap/objects", Type: "gauge", Number: float64(mem.HeapObjects)},
+		{Name: "agent/gc", Type: "counter", Number: float64(mem.NumGC)},
+	}
+
+	all := m.metrics.All()
+	names := make([]string, 0, len(all))
+	for name, _ := range all {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		switch name {
+		case "cmd/count", "cmd/exec_time":
+			continue // below
+		}
+		metric := all[name]
+		metrics = append(metrics, mm.Metric{Name: "agent/" + name, Type: metric.Type, Number: metric.Number})
+	}
+
+	cmdCount := all["cmd/count"].Number
+	cmdExecTime := all["cmd/exec_time"].Number
+	execTime := 0.0
+	if n := cmdCount - m.lastCmdCount; n > 0 {
+		execTime = (cmdExecTime - m.lastCmdExecTime) / n
+	}
+	metrics = append(metrics, mm.Metric{Name: "agent/cmd/exec_time", Type: "gauge", Number: execTime})
+	m.lastCmdCount = cmdCount
+	m.lastCmdExecTime = cmdExecTime
+
+	return metrics
+}
+
+func (m *Monitor) run() {
+	m.logger.Debug("run:call")
+	defer func() {
+		if err := recover(); err != nil {
+			m.logger.Error("Agent monitor crashed: ", err)
+		}
+		m.status.Update(m.name, "Stopped")
+		m.sync.Done()
+		m.logger.Debug("run:return")
+	}()
+
+	var lastTs int64
+	for {
+		m.logger.Debug("run:idle")
+		m.status.Update(m.name, fmt.Sprintf("Idle (last collected at %s)", time.Unix(lastTs, 0)))
+		select {
+		case now := <-m.tickChan:
+			m.logger.Debug("run:collect:start")
+			m.status.Update(m.name, "Running")
+
+			c := &mm.Collection{
+				ServiceInstance: proto.ServiceInstance{
+					Service:    m.config.Service,
+					InstanceId: m.config.InstanceId,
+				},
+				Ts:      now.UTC().Unix(),
+				Metrics: m.Collect(),
+			}
+
+			// Send the metrics to the aggregator.
+			select {
+			case m.collectionChan <- c:
+				lastTs = c.Ts
+			case <-time.After(500 * time.Millisecond):
+				// lost collection
+				m.logger.Debug("Lost agent metrics; timeout spooling after 500ms")
+			}
+
+			m.logger.Debug("run:collect:stop")
+		case <-m.sync.StopChan:
+			m.logger.Debug("run:stop")
+			return
+		}
+	}
+}
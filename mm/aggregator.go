@@ -217,6 +217,9 @@ func (a *Aggregator) report(startTs time.Time, is []*InstanceStats) {
 		Duration: uint(a.interval),
 		Stats:    finalInstanceStats,
 	}
+	report.Timezone, report.UtcOffset = pct.Timezone()
+	report.ClockOffset = int(pct.ClockOffset() / time.Second)
+	report.Cloud = pct.CloudInstance()
 	if err := a.spool.Write("mm", report); err != nil {
 		a.logger.Warn("Lost report:", err)
 	}
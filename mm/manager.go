@@ -32,8 +32,6 @@ import (
 	"github.com/percona/percona-agent/mrms"
 	"github.com/percona/percona-agent/pct"
 	"github.com/percona/percona-agent/ticker"
-	"io/ioutil"
-	"path/filepath"
 	"sync"
 	"time"
 )
@@ -94,21 +92,20 @@ func (m *Manager) Start() error {
 	}
 
 	// Start all metric monitors.
-	glob := filepath.Join(pct.Basedir.Dir("config"), "mm-*.conf")
-	configFiles, err := filepath.Glob(glob)
+	names, err := pct.Basedir.ConfigNames("mm-*")
 	if err != nil {
 		return err
 	}
 
-	for _, configFile := range configFiles {
-		data, err := ioutil.ReadFile(configFile)
+	for _, name := range names {
+		data, err := pct.Basedir.ConfigData(name)
 		if err != nil {
-			m.logger.Error("Read " + configFile + ": " + err.Error())
+			m.logger.Error("Read " + name + ": " + err.Error())
 			continue
 		}
 		config := &Config{}
 		if err := json.Unmarshal(data, config); err != nil {
-			m.logger.Error("Decode " + configFile + ": " + err.Error())
+			m.logger.Error("Decode " + name + ": " + err.Error())
 			continue
 		}
 		cmd := &proto.Cmd{
@@ -118,10 +115,10 @@ func (m *Manager) Start() error {
 		}
 		reply := m.Handle(cmd)
 		if reply.Error != "" {
-			m.logger.Error("Start " + configFile + ": " + reply.Error)
+			m.logger.Error("Start " + name + ": " + reply.Error)
 			continue
 		}
-		m.logger.Info("Started " + configFile)
+		m.logger.Info("Started " + name)
 	}
 
 	m.running = true
@@ -309,6 +306,16 @@ func (m *Manager) GetConfig() ([]proto.AgentConfig, []error) {
 	return configs, errs
 }
 
+// ConfigSchema describes Config which is embedded in every monitor-specific
+// config.
+func (m *Manager) ConfigSchema() pct.ConfigSchema {
+	s := pct.NewConfigSchema("mm", Config{})
+	s.Field("Service").Required = true
+	s.Field("Collect").Min = 1
+	s.Field("Report").Min = 1
+	return s
+}
+
 func (m *Manager) getMonitorConfig(cmd *proto.Cmd) (*Config, string, error) {
 	/**
 	 * cmd.Data is a monitor-specific config, e.g. mysql.Config.  But monitor-specific
@@ -572,6 +572,9 @@ func (s *ManagerTestSuite) SetUpTest(t *C) {
 			t.Fatal(err)
 		}
 	}
+	if err := test.ClearConfigs(); err != nil {
+		t.Fatal(err)
+	}
 }
 
 func (s *ManagerTestSuite) TearDownSuite(t *C) {
@@ -700,10 +703,9 @@ func (s *ManagerTestSuite) TestRestartMonitor(t *C) {
 		t.Errorf("Make 1s ticker for collect interval\n%s", diff)
 	}
 
-	// After starting a monitor, mm should write its config to the dir
-	// it learned when mm.LoadConfig() was called.  Next time agent starts,
-	// it will have mm start the monitor with this config.
-	data, err := ioutil.ReadFile(s.configDir + "/mm-mysql-1.conf")
+	// After starting a monitor, mm should save its config.  Next time agent
+	// starts, it will have mm start the monitor with this config.
+	data, err := pct.Basedir.ConfigData("mm-mysql-1")
 	t.Check(err, IsNil)
 	gotConfig := &mysql.Config{}
 	err = json.Unmarshal(data, gotConfig)
@@ -739,11 +741,10 @@ func (s *ManagerTestSuite) TestRestartMonitor(t *C) {
 		t.Error("Remove's monitor's tickChan from clock")
 	}
 
-	// After stopping a monitor, mm should remove its config file so agent
+	// After stopping a monitor, mm should remove its config so agent
 	// doesn't start it on restart.
-	file := s.configDir + "/mm-mysql-1.conf"
-	if pct.FileExists(file) {
-		t.Error("Stopping monitor removes its config; ", file, " exists")
+	if pct.Basedir.ConfigExists("mm-mysql-1") {
+		t.Error("Stopping monitor removes its config; mm-mysql-1 exists")
 	}
 
 	/**
@@ -776,10 +777,9 @@ func (s *ManagerTestSuite) TestRestartMonitor(t *C) {
 		t.Errorf("Make 1s ticker for collect interval\n%s", diff)
 	}
 
-	// After starting a monitor, mm should write its config to the dir
-	// it learned when mm.LoadConfig() was called.  Next time agent starts,
-	// it will have mm start the monitor with this config.
-	data, err = ioutil.ReadFile(s.configDir + "/mm-mysql-1.conf")
+	// After starting a monitor, mm should save its config.  Next time agent
+	// starts, it will have mm start the monitor with this config.
+	data, err = pct.Basedir.ConfigData("mm-mysql-1")
 	t.Check(err, IsNil)
 	gotConfig = &mysql.Config{}
 	err = json.Unmarshal(data, gotConfig)
@@ -19,6 +19,7 @@ package mm
 
 import (
 	"github.com/percona/cloud-protocol/proto/v1"
+	"github.com/percona/percona-agent/pct"
 	"time"
 )
 
@@ -75,7 +76,11 @@ type InstanceStats struct {
 }
 
 type Report struct {
-	Ts       time.Time // start, UTC
-	Duration uint      // seconds
-	Stats    []*InstanceStats
+	Ts          time.Time // start, UTC
+	Duration    uint      // seconds
+	Stats       []*InstanceStats
+	Timezone    string             // agent local timezone, e.g. America/New_York
+	UtcOffset   int                // seconds, agent local timezone offset from UTC
+	Cloud       *pct.CloudMetadata `json:",omitempty"` // nil if not in a cloud
+	ClockOffset int                `json:",omitempty"` // seconds, API clock minus agent clock, see pct.ClockOffset
 }
@@ -18,11 +18,12 @@
 package monitor
 
 import (
-	"encoding/json"
 	"errors"
 	"github.com/percona/cloud-protocol/proto/v1"
+	"github.com/percona/percona-agent/bus"
 	"github.com/percona/percona-agent/instance"
 	"github.com/percona/percona-agent/mm"
+	"github.com/percona/percona-agent/mm/agent"
 	"github.com/percona/percona-agent/mm/mysql"
 	"github.com/percona/percona-agent/mm/system"
 	"github.com/percona/percona-agent/mrms"
@@ -34,13 +35,15 @@ type Factory struct {
 	logChan chan *proto.LogEntry
 	ir      *instance.Repo
 	mrm     mrms.Monitor
+	bus     *bus.Bus
 }
 
-func NewFactory(logChan chan *proto.LogEntry, ir *instance.Repo, mrm mrms.Monitor) *Factory {
+func NewFactory(logChan chan *proto.LogEntry, ir *instance.Repo, mrm mrms.Monitor, b *bus.Bus) *Factory {
 	f := &Factory{
 		logChan: logChan,
 		ir:      ir,
 		mrm:     mrm,
+		bus:     b,
 	}
 	return f
 }
@@ -57,7 +60,7 @@ func (f *Factory) Make(service string, instanceId uint, data []byte) (mm.Monitor
 
 		// Parse the MySQL sysconfig config.
 		config := &mysql.Config{}
-		if err := json.Unmarshal(data, config); err != nil {
+		if err := pct.UnmarshalConfig(data, config); err != nil {
 			return nil, err
 		}
 
@@ -71,11 +74,12 @@ func (f *Factory) Make(service string, instanceId uint, data []byte) (mm.Monitor
 			pct.NewLogger(f.logChan, alias),
 			mysqlConn.NewConnection(mysqlIt.DSN),
 			f.mrm,
+			f.bus,
 		)
 	case "server":
 		// Parse the system mm config.
 		config := &system.Config{}
-		if err := json.Unmarshal(data, config); err != nil {
+		if err := pct.UnmarshalConfig(data, config); err != nil {
 			return nil, err
 		}
 
@@ -88,6 +92,23 @@ func (f *Factory) Make(service string, instanceId uint, data []byte) (mm.Monitor
 			config,
 			pct.NewLogger(f.logChan, alias),
 		)
+	case "agent":
+		// Parse the agent mm config.
+		config := &agent.Config{}
+		if err := pct.UnmarshalConfig(data, config); err != nil {
+			return nil, err
+		}
+
+		// There is only one agent, like there is only one system.
+		alias := "mm-agent"
+
+		// Make an agent metrics monitor.
+		monitor = agent.NewMonitor(
+			alias,
+			config,
+			pct.NewLogger(f.logChan, alias),
+			pct.AgentMetrics,
+		)
 	default:
 		return nil, errors.New("Unknown metrics monitor type: " + service)
 	}
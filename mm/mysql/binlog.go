@@ -0,0 +1,257 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package mysql
+
+import (
+	"database/sql"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/percona/percona-agent/mm"
+)
+
+// --------------------------------------------------------------------------
+// Binary log format and events
+// http://dev.mysql.com/doc/refman/5.6/en/binary-log-formats.html
+// --------------------------------------------------------------------------
+
+// Max events read by SHOW BINLOG EVENTS per collection.  If more events were
+// written since the last collection, the rest are skipped, so event counts
+// are a sample on busy servers.
+var BINLOG_EVENTS_LIMIT = 1000
+
+// Binlog formats reported as mysql/binlog/format_<format>.
+var BinlogFormats = []string{"STATEMENT", "ROW", "MIXED"}
+
+// A BinlogFormat is how MySQL writes the binary log.  Changing it, even
+// only for new sessions, often breaks downstream consumers like CDC tools
+// that require row-based events with full row images.
+type BinlogFormat struct {
+	LogBin   string // ON or OFF
+	Format   string // binlog_format: STATEMENT, ROW, MIXED
+	RowImage string // binlog_row_image (MySQL 5.6+): FULL, MINIMAL, NOBLOB
+}
+
+// A BinlogPosition is where the last SHOW BINLOG EVENTS stopped.
+type BinlogPosition struct {
+	File string
+	Pos  uint64
+}
+
+// GetBinlogFormat returns the current binlog format.  Variables that do not
+// exist, like binlog_row_image before MySQL 5.6, are empty.
+func GetBinlogFormat(conn *sql.DB) (BinlogFormat, error) {
+	f := BinlogFormat{}
+	rows, err := conn.Query("SHOW GLOBAL VARIABLES WHERE Variable_name IN" +
+		" ('log_bin', 'binlog_format', 'binlog_row_image')")
+	if err != nil {
+		return f, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var varName, varValue string
+		if err := rows.Scan(&varName, &varValue); err != nil {
+			return f, err
+		}
+		varValue = strings.ToUpper(varValue)
+		switch strings.ToLower(varName) {
+		case "log_bin":
+			if varValue == "1" {
+				varValue = "ON"
+			}
+			f.LogBin = varValue
+		case "binlog_format":
+			f.Format = varValue
+		case "binlog_row_image":
+			f.RowImage = varValue
+		}
+	}
+	return f, rows.Err()
+}
+
+// BinlogFormatMetrics returns mysql/binlog/format_<format> gauges, 1 for the
+// current format and 0 for the others, so format flips can be charted.
+// There are no metrics if binary logging is off.
+func BinlogFormatMetrics(f BinlogFormat) []mm.Metric {
+	metrics := []mm.Metric{}
+	if f.LogBin != "ON" {
+		return metrics
+	}
+	for _, format := range BinlogFormats {
+		val := 0.0
+		if f.Format == format {
+			val = 1
+		}
+		metrics = append(metrics, mm.Metric{
+			Name:   "mysql/binlog/format_" + strings.ToLower(format),
+			Type:   "gauge",
+			Number: val,
+		})
+	}
+	return metrics
+}
+
+// BinlogFormatChanges returns a message for each binlog format variable that
+// changed between prev and curr.
+func BinlogFormatChanges(prev, curr BinlogFormat) []string {
+	changes := []string{}
+	if prev.LogBin != curr.LogBin {
+		changes = append(changes, fmt.Sprintf("Binary logging changed from %s to %s", prev.LogBin, curr.LogBin))
+	}
+	if prev.Format != curr.Format {
+		changes = append(changes, fmt.Sprintf("binlog_format changed from %s to %s", prev.Format, curr.Format))
+	}
+	if prev.RowImage != curr.RowImage {
+		changes = append(changes, fmt.Sprintf("binlog_row_image changed from %s to %s", prev.RowImage, curr.RowImage))
+	}
+	return changes
+}
+
+// BinlogEventName returns the metric name of a SHOW BINLOG EVENTS Event_type,
+// e.g. Write_rows_v1 -> mysql/binlog/events_write_rows.
+func BinlogEventName(eventType string) string {
+	eventType = strings.ToLower(eventType)
+	if i := strings.LastIndex(eventType, "_v"); i > 0 {
+		if _, err := strconv.Atoi(eventType[i+2:]); err == nil {
+			eventType = eventType[:i]
+		}
+	}
+	return "mysql/binlog/events_" + eventType
+}
+
+// GetBinlogMetrics collects the binlog format and, if config.BinlogEvents,
+// counts of binlog events by type.  Format changes are logged as warnings so
+// they're seen like events.
+func (m *Monitor) GetBinlogMetrics(conn *sql.DB, c *mm.Collection) error {
+	m.logger.Debug("GetBinlogMetrics:call")
+	defer m.logger.Debug("GetBinlogMetrics:return")
+
+	m.status.Update(m.name, "Getting binlog metrics")
+
+	f, err := GetBinlogFormat(conn)
+	if err != nil {
+		return err
+	}
+	if m.binlogFormat != nil {
+		for _, change := range BinlogFormatChanges(*m.binlogFormat, f) {
+			m.logger.Warn(change)
+		}
+	}
+	m.binlogFormat = &f
+	c.Metrics = append(c.Metrics, BinlogFormatMetrics(f)...)
+
+	if !m.config.BinlogEvents || f.LogBin != "ON" {
+		return nil
+	}
+	if err := m.getBinlogEvents(conn, c); err != nil {
+		if _, ok := err.(*net.OpError); ok {
+			return err
+		}
+		// Probably no REPLICATION CLIENT or REPLICATION SLAVE priv.
+		m.logger.Error("Cannot collect binlog events: ", err)
+		m.config.BinlogEvents = false
+	}
+	return nil
+}
+
+func (m *Monitor) getBinlogEvents(conn *sql.DB, c *mm.Collection) error {
+	// The current binlog and position.  SHOW MASTER STATUS has 4 or 5 columns
+	// depending on the version, but we only need the first two.
+	rows, err := conn.Query("SHOW MASTER STATUS")
+	if err != nil {
+		return err
+	}
+	cols, err := rows.Columns()
+	if err != nil {
+		rows.Close()
+		return err
+	}
+	curr := BinlogPosition{}
+	if rows.Next() {
+		vals := make([]interface{}, len(cols))
+		for i := range vals {
+			vals[i] = new(sql.RawBytes)
+		}
+		if err := rows.Scan(vals...); err != nil {
+			rows.Close()
+			return err
+		}
+		curr.File = string(*vals[0].(*sql.RawBytes))
+		curr.Pos, _ = strconv.ParseUint(string(*vals[1].(*sql.RawBytes)), 10, 64)
+	}
+	rows.Close()
+	if curr.File == "" {
+		return nil // binary logging off or no privs
+	}
+
+	// Start from the current position the first time, and from the start
+	// of a new binlog after it rotates.  Events at the end of the previous
+	// binlog are not counted.
+	start := m.binlogPos
+	if start.File == "" {
+		m.binlogPos = curr
+		m.binlogEvents = map[string]float64{}
+		return nil
+	}
+	if start.File != curr.File {
+		start = BinlogPosition{File: curr.File, Pos: 4}
+	}
+	if start.Pos >= curr.Pos {
+		m.addBinlogEvents(c)
+		return nil // no new events
+	}
+
+	rows, err = conn.Query(fmt.Sprintf("SHOW BINLOG EVENTS IN '%s' FROM %d LIMIT %d",
+		strings.Replace(start.File, "'", "''", -1), start.Pos, BINLOG_EVENTS_LIMIT))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	n := 0
+	for rows.Next() {
+		var logName, eventType string
+		var pos, serverId, endPos uint64
+		var info sql.NullString
+		if err := rows.Scan(&logName, &pos, &eventType, &serverId, &endPos, &info); err != nil {
+			return err
+		}
+		m.binlogEvents[BinlogEventName(eventType)]++
+		n++
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	// Skip events not read so the next collection starts at the current
+	// position instead of falling further behind.
+	m.binlogPos = curr
+	if n >= BINLOG_EVENTS_LIMIT {
+		m.logger.Debug(fmt.Sprintf("Read only %d binlog events from %s:%d to %d", n, start.File, start.Pos, curr.Pos))
+	}
+	m.addBinlogEvents(c)
+	return nil
+}
+
+// addBinlogEvents adds the binlog event counters.  They're totals since the
+// agent started, like SHOW STATUS counters, so mm reports rates.
+func (m *Monitor) addBinlogEvents(c *mm.Collection) {
+	for name, val := range m.binlogEvents {
+		c.Metrics = append(c.Metrics, mm.Metric{Name: name, Type: "counter", Number: val})
+	}
+}
@@ -27,4 +27,7 @@ type Config struct {
 	InnoDB            []string          // SET GLOBAL innodb_monitor_enable="<value>"
 	UserStats         bool              // SET GLOBAL userstat=ON|OFF
 	UserStatsIgnoreDb string
+	RollupTables      uint // if > 0, report per-schema userstat totals if more tables
+	DiskStats         bool // I/O latency of devices backing datadir, binlog, etc. (local MySQL only)
+	BinlogEvents      bool // count binlog events by type with SHOW BINLOG EVENTS (sampled)
 }
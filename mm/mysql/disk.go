@@ -0,0 +1,205 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package mysql
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/percona/percona-agent/mm"
+)
+
+// --------------------------------------------------------------------------
+// I/O latency of the block devices backing MySQL dirs
+// --------------------------------------------------------------------------
+
+var ProcDiskstats = "/proc/diskstats"
+
+// A DiskDevice is the block device backing a MySQL dir.  Role is the kind of
+// files in the dir: datadir, binlog, or redolog.  Dev is "major:minor".
+type DiskDevice struct {
+	Role string
+	Dir  string
+	Dev  string
+}
+
+// A DiskSample is the /proc/diskstats counters needed to compute await and
+// util for one device.
+type DiskSample struct {
+	IOs    float64 // reads + writes completed
+	IOMs   float64 // ms spent reading + writing
+	BusyMs float64 // ms spent doing I/O
+}
+
+// MySQLDirs returns the dirs with MySQL files, keyed on role.  Relative dirs
+// are relative to the datadir, like MySQL does.
+func MySQLDirs(dataDir, logBin, logBinBasename, logGroupHomeDir string) map[string]string {
+	dirs := map[string]string{}
+	if dataDir == "" {
+		return dirs
+	}
+	dirs["datadir"] = dataDir
+	if logBin == "1" || strings.ToUpper(logBin) == "ON" {
+		if logBinBasename != "" {
+			dirs["binlog"] = path.Dir(absDir(dataDir, logBinBasename))
+		} else {
+			dirs["binlog"] = dataDir // MySQL < 5.6 without --log-bin=<path>
+		}
+	}
+	if logGroupHomeDir != "" {
+		dirs["redolog"] = absDir(dataDir, logGroupHomeDir)
+	}
+	return dirs
+}
+
+// DiskDevices resolves each dir to its block device.  Dirs that do not exist
+// locally (e.g. MySQL is on another host) are skipped.
+func DiskDevices(dirs map[string]string) []DiskDevice {
+	devices := []DiskDevice{}
+	for _, role := range []string{"datadir", "binlog", "redolog"} {
+		dir, ok := dirs[role]
+		if !ok {
+			continue
+		}
+		var st syscall.Stat_t
+		if err := syscall.Stat(dir, &st); err != nil {
+			continue
+		}
+		devices = append(devices, DiskDevice{Role: role, Dir: dir, Dev: devNumber(uint64(st.Dev))})
+	}
+	return devices
+}
+
+// DiskLatency returns mysql/disk/<role>/await (ms per I/O) and util (percent
+// of elapsedMs the device was busy) for each device.  Metrics are computed from
+// the difference to the last samples, so the first call only returns the
+// samples.  Dirs on the same device report the same values.
+func DiskLatency(content []byte, devices []DiskDevice, last map[string]DiskSample, elapsedMs float64) ([]mm.Metric, map[string]DiskSample) {
+	/**
+	 *   8       3 sda3 55223 932 1262468 270204 184397 256917 10804032 1436428 0 512824 1707280
+	 *
+	 * Field 0: major device number
+	 *       1: minor device number
+	 *       2: device name
+	 *    3-13: 11 stats: https://www.kernel.org/doc/Documentation/iostats.txt
+	 */
+	want := map[string]bool{}
+	for _, d := range devices {
+		want[d.Dev] = true
+	}
+	curr := map[string]DiskSample{}
+	for _, line := range strings.Split(string(content), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 14 {
+			continue // partitions on early 2.6 kernels do not have timings
+		}
+		dev := fields[0] + ":" + fields[1]
+		if !want[dev] {
+			continue
+		}
+		val := [14]float64{}
+		for k := 3; k <= 13; k++ {
+			val[k], _ = strconv.ParseFloat(fields[k], 64)
+		}
+		curr[dev] = DiskSample{
+			IOs:    val[3] + val[7],
+			IOMs:   val[6] + val[10],
+			BusyMs: val[12],
+		}
+	}
+
+	metrics := []mm.Metric{}
+	if elapsedMs <= 0 {
+		return metrics, curr
+	}
+	for _, d := range devices {
+		c, ok := curr[d.Dev]
+		if !ok {
+			continue
+		}
+		l, ok := last[d.Dev]
+		if !ok || c.IOs < l.IOs || c.BusyMs < l.BusyMs {
+			continue // no last sample or counters reset
+		}
+		await := 0.0
+		if ios := c.IOs - l.IOs; ios > 0 {
+			await = (c.IOMs - l.IOMs) / ios
+		}
+		util := (c.BusyMs - l.BusyMs) / elapsedMs * 100
+		if util > 100 {
+			util = 100
+		}
+		metrics = append(metrics,
+			mm.Metric{Name: "mysql/disk/" + d.Role + "/await", Type: "gauge", Number: await},
+			mm.Metric{Name: "mysql/disk/" + d.Role + "/util", Type: "gauge", Number: util},
+		)
+	}
+	return metrics, curr
+}
+
+func (m *Monitor) resolveDiskDevices() {
+	dirs := MySQLDirs(
+		m.conn.GetGlobalVarString("datadir"),
+		m.conn.GetGlobalVarString("log_bin"),
+		m.conn.GetGlobalVarString("log_bin_basename"),
+		m.conn.GetGlobalVarString("innodb_log_group_home_dir"),
+	)
+	m.diskDevices = DiskDevices(dirs)
+	if len(m.diskDevices) == 0 {
+		m.logger.Warn("Cannot collect disk stats: MySQL dirs do not exist on this host")
+		return
+	}
+	for _, d := range m.diskDevices {
+		m.logger.Info(fmt.Sprintf("%s %s is on device %s", d.Role, d.Dir, d.Dev))
+	}
+}
+
+func (m *Monitor) getDiskStats(c *mm.Collection) error {
+	m.status.Update(m.name, "Getting disk stats")
+	content, err := ioutil.ReadFile(ProcDiskstats)
+	if err != nil {
+		return err
+	}
+	elapsedMs := 0.0
+	if m.lastDiskTs > 0 {
+		elapsedMs = float64(c.Ts-m.lastDiskTs) * 1000
+	}
+	var metrics []mm.Metric
+	metrics, m.lastDiskSamples = DiskLatency(content, m.diskDevices, m.lastDiskSamples, elapsedMs)
+	m.lastDiskTs = c.Ts
+	c.Metrics = append(c.Metrics, metrics...)
+	return nil
+}
+
+func absDir(dataDir, dir string) string {
+	if !path.IsAbs(dir) {
+		dir = path.Join(dataDir, dir)
+	}
+	return path.Clean(dir)
+}
+
+// devNumber returns "major:minor" of a Linux dev_t, like /proc/diskstats.
+func devNumber(dev uint64) string {
+	major := (dev>>8)&0xfff | (dev>>32)&^uint64(0xfff)
+	minor := dev&0xff | (dev>>12)&^uint64(0xff)
+	return fmt.Sprintf("%d:%d", major, minor)
+}
@@ -0,0 +1,179 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package mysql
+
+import (
+	"database/sql"
+	"strconv"
+	"strings"
+
+	"github.com/percona/percona-agent/mm"
+)
+
+// --------------------------------------------------------------------------
+// Engine-specific metrics: TokuDB and MyRocks
+// https://www.percona.com/doc/percona-server/5.6/tokudb/tokudb_status_variables.html
+// --------------------------------------------------------------------------
+
+// SHOW STATUS variables collected in addition to those in the mm config if
+// TokuDB is enabled.
+var TokuDBStatus = map[string]string{
+	"tokudb_cachetable_size_current":  "gauge",
+	"tokudb_cachetable_size_limit":    "gauge",
+	"tokudb_cachetable_size_writing":  "gauge",
+	"tokudb_cachetable_miss":          "counter",
+	"tokudb_cachetable_miss_time":     "counter",
+	"tokudb_cachetable_evictions":     "counter",
+	"tokudb_checkpoint_taken":         "counter",
+	"tokudb_checkpoint_failed":        "counter",
+	"tokudb_checkpoint_duration":      "counter",
+	"tokudb_txn_begin":                "counter",
+	"tokudb_txn_commits":              "counter",
+	"tokudb_txn_aborts":               "counter",
+	"tokudb_locktree_memory_size":     "gauge",
+	"tokudb_locktree_wait_count":      "counter",
+	"tokudb_locktree_timeout_count":   "counter",
+	"tokudb_locktree_long_wait_count": "counter",
+	"tokudb_logger_writes":            "counter",
+	"tokudb_logger_writes_bytes":      "counter",
+	"tokudb_filesystem_fsync_num":     "counter",
+	"tokudb_filesystem_fsync_time":    "counter",
+	"tokudb_leaf_node_full_evictions": "counter",
+}
+
+// SHOW STATUS variables collected in addition to those in the mm config if
+// RocksDB (MyRocks) is enabled.
+var RocksDBStatus = map[string]string{
+	"rocksdb_rows_read":           "counter",
+	"rocksdb_rows_inserted":       "counter",
+	"rocksdb_rows_updated":        "counter",
+	"rocksdb_rows_deleted":        "counter",
+	"rocksdb_block_cache_hit":     "counter",
+	"rocksdb_block_cache_miss":    "counter",
+	"rocksdb_bytes_read":          "counter",
+	"rocksdb_bytes_written":       "counter",
+	"rocksdb_memtable_hit":        "counter",
+	"rocksdb_memtable_miss":       "counter",
+	"rocksdb_number_keys_read":    "counter",
+	"rocksdb_number_keys_written": "counter",
+	"rocksdb_compact_read_bytes":  "counter",
+	"rocksdb_compact_write_bytes": "counter",
+	"rocksdb_flush_write_bytes":   "counter",
+	"rocksdb_stall_micros":        "counter",
+	"rocksdb_wal_bytes":           "counter",
+	"rocksdb_wal_synced":          "counter",
+}
+
+// EngineStatus returns the engine-specific SHOW STATUS variables to collect
+// given the enabled engines, e.g. from GetEngines.
+func EngineStatus(engines map[string]bool) map[string]string {
+	status := map[string]string{}
+	if engines["tokudb"] {
+		for name, metricType := range TokuDBStatus {
+			status[name] = metricType
+		}
+	}
+	if engines["rocksdb"] {
+		for name, metricType := range RocksDBStatus {
+			status[name] = metricType
+		}
+	}
+	return status
+}
+
+// GetEngines returns the enabled storage engines, lowercase.  Engines that
+// are compiled or loaded but disabled (SUPPORT=NO) are not returned.
+func GetEngines(conn *sql.DB) (map[string]bool, error) {
+	rows, err := conn.Query("SELECT ENGINE, SUPPORT FROM INFORMATION_SCHEMA.ENGINES")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	engines := map[string]bool{}
+	for rows.Next() {
+		var engine, support string
+		if err := rows.Scan(&engine, &support); err != nil {
+			return nil, err
+		}
+		if support == "YES" || support == "DEFAULT" {
+			engines[strings.ToLower(engine)] = true
+		}
+	}
+	return engines, rows.Err()
+}
+
+func (m *Monitor) resolveEngines() {
+	m.engines = map[string]bool{}
+	m.extraStatus = map[string]string{}
+	for name, metricType := range m.features.Status {
+		m.extraStatus[name] = metricType
+	}
+	engines, err := GetEngines(m.conn.DB())
+	if err != nil {
+		m.logger.Warn("Cannot get engines, not collecting TokuDB or RocksDB metrics: ", err)
+		return
+	}
+	m.engines = engines
+	for name, metricType := range EngineStatus(engines) {
+		m.extraStatus[name] = metricType
+	}
+	if engines["tokudb"] {
+		m.logger.Info("TokuDB is enabled, collecting its metrics")
+	}
+	if engines["rocksdb"] {
+		m.logger.Info("RocksDB is enabled, collecting its metrics")
+	}
+}
+
+// GetRocksDBMetrics collects INFORMATION_SCHEMA.ROCKSDB_DBSTATS as gauges
+// like mysql/rocksdb/db_block_cache_usage.
+func (m *Monitor) GetRocksDBMetrics(conn *sql.DB, c *mm.Collection) error {
+	m.logger.Debug("GetRocksDBMetrics:call")
+	defer m.logger.Debug("GetRocksDBMetrics:return")
+
+	m.status.Update(m.name, "Getting RocksDB metrics")
+
+	/**
+	 *  SELECT * FROM INFORMATION_SCHEMA.ROCKSDB_DBSTATS;
+	 *  +-------------------------+----------+
+	 *  | STAT_TYPE               | VALUE    |
+	 *  +-------------------------+----------+
+	 *  | DB_BACKGROUND_ERRORS    |        0 |
+	 *  | DB_NUM_SNAPSHOTS        |        0 |
+	 *  | DB_OLDEST_SNAPSHOT_TIME |        0 |
+	 *  | DB_BLOCK_CACHE_USAGE    | 25165824 |
+	 *  +-------------------------+----------+
+	 */
+	rows, err := conn.Query("SELECT STAT_TYPE, VALUE FROM INFORMATION_SCHEMA.ROCKSDB_DBSTATS")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var statType, statValue string
+		if err := rows.Scan(&statType, &statValue); err != nil {
+			return err
+		}
+		metricValue, err := strconv.ParseFloat(statValue, 64)
+		if err != nil {
+			continue
+		}
+		c.Metrics = append(c.Metrics, mm.Metric{Name: "mysql/rocksdb/" + strings.ToLower(statType), Type: "gauge", Number: metricValue})
+	}
+	return rows.Err()
+}
@@ -0,0 +1,189 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package mysql
+
+import (
+	"database/sql"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/percona/percona-agent/mm"
+)
+
+// --------------------------------------------------------------------------
+// Group Replication (MySQL 5.7.17+, InnoDB Cluster)
+// https://dev.mysql.com/doc/refman/5.7/en/group-replication-monitoring.html
+// --------------------------------------------------------------------------
+
+// Member states reported as mysql/group_replication/members_<state>.
+var GroupMemberStates = []string{"ONLINE", "RECOVERING", "UNREACHABLE", "OFFLINE", "ERROR"}
+
+// A GroupMember is a row from performance_schema.replication_group_members.
+type GroupMember struct {
+	Id    string // server_uuid
+	Host  string
+	Port  int
+	State string // ONLINE, RECOVERING, etc.
+}
+
+// HaveGroupReplication returns true if the group_replication plugin is active.
+func HaveGroupReplication(conn *sql.DB) (bool, error) {
+	var status string
+	err := conn.QueryRow("SELECT PLUGIN_STATUS FROM INFORMATION_SCHEMA.PLUGINS" +
+		" WHERE PLUGIN_NAME = 'group_replication'").Scan(&status)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return status == "ACTIVE", nil
+}
+
+// GroupMembersMetrics returns the number of group members, the number in each
+// state, and whether the local member (localId) is online (1) or not (0).
+func GroupMembersMetrics(members []GroupMember, localId string) []mm.Metric {
+	count := map[string]float64{}
+	localOnline := 0.0
+	for _, member := range members {
+		count[member.State]++
+		if member.Id == localId && member.State == "ONLINE" {
+			localOnline = 1
+		}
+	}
+	metrics := []mm.Metric{
+		{Name: "mysql/group_replication/members", Type: "gauge", Number: float64(len(members))},
+	}
+	for _, state := range GroupMemberStates {
+		metrics = append(metrics, mm.Metric{
+			Name:   "mysql/group_replication/members_" + strings.ToLower(state),
+			Type:   "gauge",
+			Number: count[state],
+		})
+	}
+	metrics = append(metrics, mm.Metric{Name: "mysql/group_replication/online", Type: "gauge", Number: localOnline})
+	return metrics
+}
+
+// GroupMembershipChanges returns a message for each member that joined, left,
+// or changed state between prev and curr, keyed on member ID.
+func GroupMembershipChanges(prev, curr map[string]GroupMember) []string {
+	changes := []string{}
+	for id, member := range curr {
+		if p, ok := prev[id]; !ok {
+			changes = append(changes, fmt.Sprintf("Group replication member %s:%d (%s) joined as %s",
+				member.Host, member.Port, id, member.State))
+		} else if p.State != member.State {
+			changes = append(changes, fmt.Sprintf("Group replication member %s:%d (%s) changed from %s to %s",
+				member.Host, member.Port, id, p.State, member.State))
+		}
+	}
+	for id, member := range prev {
+		if _, ok := curr[id]; !ok {
+			changes = append(changes, fmt.Sprintf("Group replication member %s:%d (%s) left",
+				member.Host, member.Port, id))
+		}
+	}
+	sort.Strings(changes)
+	return changes
+}
+
+func (m *Monitor) resolveGroupReplication() {
+	ok, err := HaveGroupReplication(m.conn.DB())
+	if err != nil {
+		m.logger.Warn("Cannot check for group replication: ", err)
+	}
+	m.groupReplication = ok
+	if ok {
+		m.logger.Info("Group replication is active, collecting its metrics")
+	}
+}
+
+// GetGroupReplicationMetrics collects group membership and, for the local
+// member, performance_schema.replication_group_member_stats.  Membership
+// changes are logged as warnings so they're seen like events.
+func (m *Monitor) GetGroupReplicationMetrics(conn *sql.DB, c *mm.Collection) error {
+	m.logger.Debug("GetGroupReplicationMetrics:call")
+	defer m.logger.Debug("GetGroupReplicationMetrics:return")
+
+	m.status.Update(m.name, "Getting group replication metrics")
+
+	var localId string
+	if err := conn.QueryRow("SELECT @@server_uuid").Scan(&localId); err != nil {
+		return err
+	}
+
+	rows, err := conn.Query("SELECT MEMBER_ID, MEMBER_HOST, MEMBER_PORT, MEMBER_STATE" +
+		" FROM performance_schema.replication_group_members")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	members := []GroupMember{}
+	curr := map[string]GroupMember{}
+	for rows.Next() {
+		var id, host, state sql.NullString
+		var port sql.NullInt64
+		if err := rows.Scan(&id, &host, &port, &state); err != nil {
+			return err
+		}
+		member := GroupMember{
+			Id:    id.String,
+			Host:  host.String,
+			Port:  int(port.Int64),
+			State: state.String,
+		}
+		if member.Id == "" {
+			continue // group replication stopped: one row, all empty but OFFLINE
+		}
+		members = append(members, member)
+		curr[member.Id] = member
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	c.Metrics = append(c.Metrics, GroupMembersMetrics(members, localId)...)
+
+	if m.groupMembers != nil {
+		for _, change := range GroupMembershipChanges(m.groupMembers, curr) {
+			m.logger.Warn(change)
+		}
+	}
+	m.groupMembers = curr
+
+	// Stats of the local member.  There are no stats if it's not in a group.
+	var inQueue, checked, conflicts, validating float64
+	err = conn.QueryRow("SELECT COUNT_TRANSACTIONS_IN_QUEUE, COUNT_TRANSACTIONS_CHECKED,"+
+		" COUNT_CONFLICTS_DETECTED, COUNT_TRANSACTIONS_ROWS_VALIDATING"+
+		" FROM performance_schema.replication_group_member_stats"+
+		" WHERE MEMBER_ID = @@server_uuid").Scan(&inQueue, &checked, &conflicts, &validating)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	c.Metrics = append(c.Metrics,
+		mm.Metric{Name: "mysql/group_replication/transactions_in_queue", Type: "gauge", Number: inQueue},
+		mm.Metric{Name: "mysql/group_replication/transactions_checked", Type: "counter", Number: checked},
+		mm.Metric{Name: "mysql/group_replication/conflicts_detected", Type: "counter", Number: conflicts},
+		mm.Metric{Name: "mysql/group_replication/transactions_rows_validating", Type: "gauge", Number: validating},
+	)
+	return nil
+}
@@ -29,6 +29,7 @@ import (
 
 	"errors"
 	"github.com/percona/cloud-protocol/proto/v1"
+	"github.com/percona/percona-agent/bus"
 	"github.com/percona/percona-agent/mm"
 	"github.com/percona/percona-agent/mrms"
 	"github.com/percona/percona-agent/mysql"
@@ -49,15 +50,37 @@ type Monitor struct {
 	tickChan       chan time.Time
 	collectionChan chan *mm.Collection
 	connectedChan  chan bool
-	restartChan    <-chan bool
+	restarts       *bus.Subscription
+	mrmAdded       bool
 	status         *pct.Status
 	sync           *pct.SyncChan
 	running        bool
 	collectLimit   float64
 	mrm            mrms.Monitor
+	bus            *bus.Bus
+	// --
+	features         mysql.Features
+	engines          map[string]bool        // enabled storage engines, see GetEngines
+	extraStatus      map[string]string      // flavor-, engine-, and replication-specific SHOW STATUS variables
+	groupReplication bool                   // group_replication plugin is active
+	groupMembers     map[string]GroupMember // last seen, to log membership changes
+	semiSync         map[string]float64     // last seen, to log semi-sync changes
+	binlog           bool                   // collect binlog metrics, see GetBinlogMetrics
+	binlogFormat     *BinlogFormat          // last seen, to log format changes
+	binlogPos        BinlogPosition         // where last SHOW BINLOG EVENTS stopped
+	binlogEvents     map[string]float64     // binlog event counts since start
+	replicaRunning   *bool                  // last seen, nil if not a replica, see checkReplication
+	noReplicaStatus  bool                   // SHOW SLAVE STATUS failed, e.g. no privilege
+	// --
+	diskDevices     []DiskDevice
+	lastDiskSamples map[string]DiskSample
+	lastDiskTs      int64
 }
 
-func NewMonitor(name string, config *Config, logger *pct.Logger, conn mysql.Connector, mrm mrms.Monitor) *Monitor {
+// NewMonitor returns a MySQL metrics monitor.  It reconnects when mrm publishes
+// a restart of its MySQL instance on b, and it publishes replication stopping
+// to b as bus.REPLICATION_STOPPED events.
+func NewMonitor(name string, config *Config, logger *pct.Logger, conn mysql.Connector, mrm mrms.Monitor, b *bus.Bus) *Monitor {
 	m := &Monitor{
 		name:   name,
 		config: config,
@@ -65,11 +88,11 @@ func NewMonitor(name string, config *Config, logger *pct.Logger, conn mysql.Conn
 		conn:   conn,
 		// --
 		connectedChan: make(chan bool, 1),
-		restartChan:   nil,
 		status:        pct.NewStatus([]string{name, name + "-mysql"}),
 		sync:          pct.NewSyncChan(),
 		collectLimit:  float64(config.Collect) * 0.1, // 10% of Collect time
 		mrm:           mrm,
+		bus:           b,
 	}
 	return m
 }
@@ -88,6 +111,7 @@ func (m *Monitor) Start(tickChan chan time.Time, collectionChan chan *mm.Collect
 
 	m.tickChan = tickChan
 	m.collectionChan = collectionChan
+	m.restarts = m.bus.Subscribe(bus.MYSQL_RESTART, 0)
 
 	go m.run()
 	m.running = true
@@ -109,7 +133,11 @@ func (m *Monitor) Stop() error {
 	m.sync.Stop()
 	m.sync.Wait()
 
-	m.mrm.Remove(m.conn.DSN(), m.restartChan)
+	m.restarts.Cancel()
+	if m.mrmAdded {
+		m.mrm.Remove(m.conn.DSN())
+		m.mrmAdded = false
+	}
 
 	m.running = false
 	m.logger.Info("Stopped")
@@ -160,16 +188,31 @@ func (m *Monitor) connect(err error) {
 		m.logger.Info("Connected")
 		m.status.Update(m.name+"-mysql", "Connected")
 
+		// MySQL can be upgraded or replaced by MariaDB on restart, so get
+		// its features every connect.
+		m.features = mysql.GetConnFeatures(m.conn)
+		m.logger.Info(fmt.Sprintf("MySQL flavor %s version %s", m.features.Flavor, m.features.Version))
+		m.resolveEngines()
+		m.resolveGroupReplication()
+		m.resolveSemiSync()
+		m.binlog = true
+
 		m.setGlobalVars()
 
+		// MySQL dirs can change on restart, so resolve them every connect.
+		if m.config.DiskStats {
+			m.resolveDiskDevices()
+		}
+
 		// Tell run() goroutine that it can try to collect metrics.
 		// If connection is lost, it will call us again.
 		m.connectedChan <- true
 		// Add the instance only when we have a connection. Otherwise, mrm.Add will fail
-		if m.restartChan == nil {
-			m.restartChan, err = m.mrm.Add(m.conn.DSN())
-			if err != nil {
+		if !m.mrmAdded {
+			if err := m.mrm.Add(m.conn.DSN()); err != nil {
 				m.logger.Warn(fmt.Sprintf("Cannot add instance to the restart monitor: %v", err))
+			} else {
+				m.mrmAdded = true
 			}
 		}
 		return
@@ -184,6 +227,11 @@ func (m *Monitor) setGlobalVars() {
 
 	// Set global vars we need.  If these fail, that's ok: they won't work,
 	// but don't let that stop us from collecting other metrics.
+	if len(m.config.InnoDB) > 0 && m.features.Version != "" && !m.features.InnoDBMetrics {
+		m.logger.Warn("Cannot collect InnoDB stats because INFORMATION_SCHEMA.INNODB_METRICS" +
+			" requires MySQL 5.6 or MariaDB 10.0, this is " + m.features.Flavor + " " + m.features.Version)
+		m.config.InnoDB = []string{}
+	}
 	if len(m.config.InnoDB) > 0 {
 		for _, module := range m.config.InnoDB {
 			sql := "SET GLOBAL innodb_monitor_enable = '" + module + "'"
@@ -197,9 +245,12 @@ func (m *Monitor) setGlobalVars() {
 	}
 
 	if m.config.UserStats {
-		// 5.1.49 <= v <= 5.5.10: SET GLOBAL userstat_running=ON
-		// 5.5.10 <  v:           SET GLOBAL userstat=ON
-		sql := "SET GLOBAL userstat=ON"
+		// userstat_running in Percona Server <= 5.5.10, else userstat.
+		userstatVar := m.features.UserstatVar
+		if userstatVar == "" {
+			userstatVar = "userstat"
+		}
+		sql := "SET GLOBAL " + userstatVar + "=ON"
 		if _, err := m.conn.DB().Exec(sql); err != nil {
 			errMsg := fmt.Sprintf("Cannot collect user stats because '%s' failed: %s", sql, err)
 			m.logger.Error(errMsg)
@@ -267,6 +318,9 @@ func (m *Monitor) run() {
 				}
 			}
 
+			// SHOW SLAVE STATUS, only to detect replication stopping
+			m.checkReplication(conn)
+
 			// SELECT NAME, ... FROM INFORMATION_SCHEMA.INNODB_METRICS
 			if len(m.config.InnoDB) > 0 {
 				if err := m.GetInnoDBMetrics(conn, c); err != nil {
@@ -280,6 +334,46 @@ func (m *Monitor) run() {
 				}
 			}
 
+			// SELECT STAT_TYPE, VALUE FROM INFORMATION_SCHEMA.ROCKSDB_DBSTATS
+			if m.engines["rocksdb"] {
+				if err := m.GetRocksDBMetrics(conn, c); err != nil {
+					switch m.collectError(err) {
+					case networkError:
+						connected = false
+						continue
+					default:
+						// Older MyRocks don't have ROCKSDB_DBSTATS.
+						m.engines["rocksdb"] = false
+					}
+				}
+			}
+
+			// SELECT ... FROM performance_schema.replication_group_members
+			if m.groupReplication {
+				if err := m.GetGroupReplicationMetrics(conn, c); err != nil {
+					switch m.collectError(err) {
+					case networkError:
+						connected = false
+						continue
+					default:
+						m.groupReplication = false
+					}
+				}
+			}
+
+			// SHOW GLOBAL VARIABLES ... binlog_format, SHOW BINLOG EVENTS
+			if m.binlog {
+				if err := m.GetBinlogMetrics(conn, c); err != nil {
+					switch m.collectError(err) {
+					case networkError:
+						connected = false
+						continue
+					default:
+						m.binlog = false
+					}
+				}
+			}
+
 			if m.config.UserStats {
 				// SELECT ... FROM INFORMATION_SCHEMA.TABLE_STATISTICS
 				if err := m.getTableUserStats(conn, c, m.config.UserStatsIgnoreDb); err != nil {
@@ -301,6 +395,17 @@ func (m *Monitor) run() {
 						continue
 					}
 				}
+				// Bound metric cardinality on hosts with many tables.
+				if m.config.RollupTables > 0 {
+					c.Metrics = RollupTables(c.Metrics, m.config.RollupTables)
+				}
+			}
+
+			// /proc/diskstats for devices backing datadir, binlog, etc.
+			if len(m.diskDevices) > 0 {
+				if err := m.getDiskStats(c); err != nil {
+					m.logger.Warn("Cannot get disk stats: ", err)
+				}
 			}
 
 			// It is possible that collecting metrics will stall for many
@@ -337,7 +442,10 @@ func (m *Monitor) run() {
 		case connected = <-m.connectedChan:
 			m.logger.Debug("run:connected:true")
 			m.status.Update(m.name, "Ready")
-		case <-m.restartChan:
+		case e := <-m.restarts.C:
+			if e.Data != mysql.HideDSNPassword(m.conn.DSN()) {
+				continue // another instance
+			}
 			m.logger.Debug("run:mysql:restart")
 			connected = false
 			go m.connect(fmt.Errorf("Lost connection to MySQL, restarting"))
@@ -363,6 +471,7 @@ func (m *Monitor) GetShowStatusMetrics(conn *sql.DB, c *mm.Collection) error {
 		return err
 	}
 	defer rows.Close()
+	semiSync := map[string]float64{}
 	for rows.Next() {
 		var statName string
 		var statValue string
@@ -373,7 +482,10 @@ func (m *Monitor) GetShowStatusMetrics(conn *sql.DB, c *mm.Collection) error {
 		statName = strings.ToLower(statName)
 		metricType, ok := m.config.Status[statName]
 		if !ok {
-			continue // not collecting this stat
+			// Flavor- and engine-specific stats, e.g. Aria on MariaDB.
+			if metricType, ok = m.extraStatus[statName]; !ok {
+				continue // not collecting this stat
+			}
 		}
 
 		if statValue == "" {
@@ -382,19 +494,31 @@ func (m *Monitor) GetShowStatusMetrics(conn *sql.DB, c *mm.Collection) error {
 			continue
 		}
 
+		_, isSemiSync := SemiSyncStatus[statName]
 		metricValue, err := strconv.ParseFloat(statValue, 64)
+		if err != nil && isSemiSync {
+			metricValue, ok = SemiSyncValue(statValue)
+			if ok {
+				err = nil
+			}
+		}
 		if err != nil {
 			m.logger.Warn(fmt.Sprintf("Cannot convert '%s' value '%s' to float: %s", statName, statValue, err))
 			delete(m.config.Status, statName) // stop collecting it
+			delete(m.extraStatus, statName)
 			continue
 		}
 
 		c.Metrics = append(c.Metrics, mm.Metric{"mysql/" + statName, metricType, metricValue, ""})
+		if isSemiSync {
+			semiSync[statName] = metricValue
+		}
 	}
 	err = rows.Err()
 	if err != nil {
 		return err
 	}
+	m.semiSyncChanges(semiSync)
 	return nil
 }
 
@@ -549,6 +673,59 @@ func (m *Monitor) getIndexUserStats(conn *sql.DB, c *mm.Collection, ignoreDb str
 	return nil
 }
 
+// RollupTables aggregates per-table and per-index userstat metrics into
+// per-schema totals if they are for more than maxTables tables, e.g.
+// mysql/db.foo/t.bar/rows_read becomes mysql/db.foo/rows_read and
+// mysql/db.foo/t.bar/idx.PRIMARY/rows_read becomes mysql/db.foo/idx/rows_read.
+// Other metrics are not changed.  A schema total jumps if tables are created
+// or dropped, like any counter that is reset.
+func RollupTables(metrics []mm.Metric, maxTables uint) []mm.Metric {
+	tables := make(map[string]bool)
+	for _, metric := range metrics {
+		if db, table, _, ok := splitTableMetric(metric.Name); ok {
+			tables[db+"/"+table] = true
+		}
+	}
+	if uint(len(tables)) <= maxTables {
+		return metrics
+	}
+
+	rollup := make([]mm.Metric, 0, len(metrics))
+	index := make(map[string]int) // rolled-up metric name => index in rollup
+	for _, metric := range metrics {
+		db, _, rest, ok := splitTableMetric(metric.Name)
+		if !ok {
+			rollup = append(rollup, metric)
+			continue
+		}
+		if strings.HasPrefix(rest, "idx.") {
+			rest = "idx/" + rest[strings.Index(rest, "/")+1:]
+		}
+		name := "mysql/" + db + "/" + rest
+		if i, ok := index[name]; ok {
+			rollup[i].Number += metric.Number
+			continue
+		}
+		index[name] = len(rollup)
+		rollup = append(rollup, mm.Metric{
+			Name:   name,
+			Type:   metric.Type,
+			Number: metric.Number,
+		})
+	}
+	return rollup
+}
+
+// splitTableMetric splits mysql/db.foo/t.bar/rows_read into "db.foo", "t.bar",
+// and "rows_read".  ok is false if the metric is not a table metric.
+func splitTableMetric(name string) (db, table, rest string, ok bool) {
+	parts := strings.SplitN(name, "/", 4)
+	if len(parts) != 4 || parts[0] != "mysql" || !strings.HasPrefix(parts[1], "db.") || !strings.HasPrefix(parts[2], "t.") {
+		return "", "", "", false
+	}
+	return parts[1], parts[2], parts[3], true
+}
+
 func (m *Monitor) collectError(err error) error {
 	switch {
 	case mysql.MySQLErrorCode(err) == mysql.ER_SPECIFIC_ACCESS_DENIED_ERROR:
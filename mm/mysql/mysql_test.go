@@ -19,6 +19,7 @@ package mysql_test
 
 import (
 	"database/sql"
+	"io/ioutil"
 	"os"
 	"testing"
 	"time"
@@ -114,7 +115,7 @@ func (s *TestSuite) TestStartCollectStop(t *C) {
 	// for the DSN for that service (since it's a MySQL monitor in this case).
 	// It creates the monitor with these args:
 
-	m := mysql.NewMonitor(s.name, config, s.logger, mysqlConn.NewConnection(dsn), s.mrm)
+	m := mysql.NewMonitor(s.name, config, s.logger, mysqlConn.NewConnection(dsn), s.mrm, s.mrm.Bus)
 	if m == nil {
 		t.Fatal("Make new mysql.Monitor")
 	}
@@ -210,7 +211,7 @@ func (s *TestSuite) TestCollectInnoDBStats(t *C) {
 		InnoDB: []string{"dml_%"}, // same as above ^
 	}
 
-	m := mysql.NewMonitor(s.name, config, s.logger, mysqlConn.NewConnection(dsn), s.mrm)
+	m := mysql.NewMonitor(s.name, config, s.logger, mysqlConn.NewConnection(dsn), s.mrm, s.mrm.Bus)
 	if m == nil {
 		t.Fatal("Make new mysql.Monitor")
 	}
@@ -291,7 +292,7 @@ func (s *TestSuite) TestCollectUserstats(t *C) {
 		UserStats: true,
 	}
 
-	m := mysql.NewMonitor(s.name, config, s.logger, mysqlConn.NewConnection(dsn), s.mrm)
+	m := mysql.NewMonitor(s.name, config, s.logger, mysqlConn.NewConnection(dsn), s.mrm, s.mrm.Bus)
 	if m == nil {
 		t.Fatal("Make new mysql.Monitor")
 	}
@@ -393,7 +394,7 @@ func (s *TestSuite) TestHandleMySQLRestarts(t *C) {
 		InnoDB: []string{"dml_%"}, // same as above ^
 	}
 
-	m := mysql.NewMonitor(s.name, config, s.logger, mysqlConn.NewConnection(dsn), s.mrm)
+	m := mysql.NewMonitor(s.name, config, s.logger, mysqlConn.NewConnection(dsn), s.mrm, s.mrm.Bus)
 	if m == nil {
 		t.Fatal("Make new mysql.Monitor")
 	}
@@ -408,8 +409,8 @@ func (s *TestSuite) TestHandleMySQLRestarts(t *C) {
 	}
 
 	/**
-	 * Simulate a MySQL disconnection by disabling InnoDB metrics and putting a
-	 * true into the restart channel. The monitor must enable them again
+	 * Simulate a MySQL disconnection by disabling InnoDB metrics and publishing a
+	 * restart on the bus. The monitor must enable them again
 	 */
 	if _, err := s.db.Exec("set global innodb_monitor_disable = '%'"); err != nil {
 		t.Fatal(err)
@@ -480,7 +481,7 @@ func (s *TestSuite) TestSlowResponse(t *C) {
 
 	slowCon := mock.NewSlowMySQL(dsn)
 	slowCon.SetGlobalDelay(time.Duration(config.Collect+1) * time.Second)
-	m := mysql.NewMonitor(s.name, config, s.logger, slowCon, s.mrm)
+	m := mysql.NewMonitor(s.name, config, s.logger, slowCon, s.mrm, s.mrm.Bus)
 	if m == nil {
 		t.Fatal("Make new mysql.Monitor")
 	}
@@ -523,7 +524,7 @@ func (s *TestSuite) TestStartWithInvalidDSN(t *C) {
 	}
 
 	failDsn := "user:pass@tcp(127.0.0.2:3309)/"
-	m := mysql.NewMonitor(s.name, config, s.logger, mysqlConn.NewConnection(failDsn), s.mrm)
+	m := mysql.NewMonitor(s.name, config, s.logger, mysqlConn.NewConnection(failDsn), s.mrm, s.mrm.Bus)
 	if m == nil {
 		t.Fatal("Make new mysql.Monitor")
 	}
@@ -531,3 +532,273 @@ func (s *TestSuite) TestStartWithInvalidDSN(t *C) {
 	err := m.Start(s.tickChan, s.collectionChan)
 	t.Assert(err, IsNil)
 }
+
+/////////////////////////////////////////////////////////////////////////////
+// RollupTables test suite (no MySQL)
+/////////////////////////////////////////////////////////////////////////////
+
+type RollupTestSuite struct{}
+
+var _ = Suite(&RollupTestSuite{})
+
+func (s *RollupTestSuite) TestRollupTables(t *C) {
+	metrics := []mm.Metric{
+		{Name: "mysql/threads_running", Type: "gauge", Number: 3},
+		{Name: "mysql/db.foo/t.a/rows_read", Type: "counter", Number: 10},
+		{Name: "mysql/db.foo/t.b/rows_read", Type: "counter", Number: 5},
+		{Name: "mysql/db.bar/t.a/rows_read", Type: "counter", Number: 1},
+		{Name: "mysql/db.foo/t.a/idx.PRIMARY/rows_read", Type: "counter", Number: 7},
+		{Name: "mysql/db.foo/t.b/idx.PRIMARY/rows_read", Type: "counter", Number: 2},
+	}
+
+	// 3 tables <= 3, so no rollup.
+	got := mysql.RollupTables(metrics, 3)
+	t.Check(got, DeepEquals, metrics)
+
+	// 3 tables > 2, so per-schema totals.
+	got = mysql.RollupTables(metrics, 2)
+	expect := []mm.Metric{
+		{Name: "mysql/threads_running", Type: "gauge", Number: 3},
+		{Name: "mysql/db.foo/rows_read", Type: "counter", Number: 15},
+		{Name: "mysql/db.bar/rows_read", Type: "counter", Number: 1},
+		{Name: "mysql/db.foo/idx/rows_read", Type: "counter", Number: 9},
+	}
+	if same, diff := test.IsDeeply(got, expect); !same {
+		test.Dump(got)
+		t.Error(diff)
+	}
+}
+
+type DiskTestSuite struct{}
+
+var _ = Suite(&DiskTestSuite{})
+
+func (s *DiskTestSuite) TestMySQLDirs(t *C) {
+	got := mysql.MySQLDirs("/var/lib/mysql/", "ON", "/binlogs/mysql-bin", "./")
+	expect := map[string]string{
+		"datadir": "/var/lib/mysql/",
+		"binlog":  "/binlogs",
+		"redolog": "/var/lib/mysql",
+	}
+	t.Check(got, DeepEquals, expect)
+
+	// Binary log disabled.
+	got = mysql.MySQLDirs("/var/lib/mysql/", "OFF", "", "/redo")
+	expect = map[string]string{
+		"datadir": "/var/lib/mysql/",
+		"redolog": "/redo",
+	}
+	t.Check(got, DeepEquals, expect)
+}
+
+func (s *DiskTestSuite) TestDiskLatency(t *C) {
+	devices := []mysql.DiskDevice{
+		{Role: "datadir", Dir: "/var/lib/mysql", Dev: "8:3"},
+		{Role: "binlog", Dir: "/binlogs", Dev: "252:0"},
+		{Role: "redolog", Dir: "/var/lib/mysql", Dev: "8:3"},
+	}
+
+	content, err := ioutil.ReadFile(test.RootDir + "/mm/proc/diskstats002-1.txt")
+	t.Assert(err, IsNil)
+	metrics, last := mysql.DiskLatency(content, devices, nil, 0)
+	t.Check(metrics, HasLen, 0) // first sample
+	t.Check(last, HasLen, 2)
+
+	// sda3: +200 IOs taking +1000ms, busy +500ms in 1s.  dm-0: idle.
+	content, err = ioutil.ReadFile(test.RootDir + "/mm/proc/diskstats002-2.txt")
+	t.Assert(err, IsNil)
+	metrics, _ = mysql.DiskLatency(content, devices, last, 1000)
+	expect := []mm.Metric{
+		{Name: "mysql/disk/datadir/await", Type: "gauge", Number: 5},
+		{Name: "mysql/disk/datadir/util", Type: "gauge", Number: 50},
+		{Name: "mysql/disk/binlog/await", Type: "gauge", Number: 0},
+		{Name: "mysql/disk/binlog/util", Type: "gauge", Number: 0},
+		{Name: "mysql/disk/redolog/await", Type: "gauge", Number: 5},
+		{Name: "mysql/disk/redolog/util", Type: "gauge", Number: 50},
+	}
+	if same, diff := test.IsDeeply(metrics, expect); !same {
+		test.Dump(metrics)
+		t.Error(diff)
+	}
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Engine-specific metrics
+/////////////////////////////////////////////////////////////////////////////
+
+type EngineTestSuite struct{}
+
+var _ = Suite(&EngineTestSuite{})
+
+func (s *EngineTestSuite) TestEngineStatus(t *C) {
+	got := mysql.EngineStatus(map[string]bool{"innodb": true, "myisam": true})
+	t.Check(got, HasLen, 0)
+
+	got = mysql.EngineStatus(map[string]bool{"innodb": true, "tokudb": true})
+	t.Check(got, HasLen, len(mysql.TokuDBStatus))
+	t.Check(got["tokudb_cachetable_miss"], Equals, "counter")
+	t.Check(got["tokudb_cachetable_size_current"], Equals, "gauge")
+
+	got = mysql.EngineStatus(map[string]bool{"tokudb": true, "rocksdb": true})
+	t.Check(got, HasLen, len(mysql.TokuDBStatus)+len(mysql.RocksDBStatus))
+	t.Check(got["rocksdb_rows_read"], Equals, "counter")
+
+	// Changing the returned map does not change the package vars.
+	delete(got, "rocksdb_rows_read")
+	t.Check(mysql.RocksDBStatus["rocksdb_rows_read"], Equals, "counter")
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Group Replication
+/////////////////////////////////////////////////////////////////////////////
+
+type GroupReplicationTestSuite struct{}
+
+var _ = Suite(&GroupReplicationTestSuite{})
+
+func (s *GroupReplicationTestSuite) TestGroupMembersMetrics(t *C) {
+	members := []mysql.GroupMember{
+		{Id: "a", Host: "db1", Port: 3306, State: "ONLINE"},
+		{Id: "b", Host: "db2", Port: 3306, State: "ONLINE"},
+		{Id: "c", Host: "db3", Port: 3306, State: "UNREACHABLE"},
+	}
+	got := mysql.GroupMembersMetrics(members, "a")
+	expect := []mm.Metric{
+		{Name: "mysql/group_replication/members", Type: "gauge", Number: 3},
+		{Name: "mysql/group_replication/members_online", Type: "gauge", Number: 2},
+		{Name: "mysql/group_replication/members_recovering", Type: "gauge", Number: 0},
+		{Name: "mysql/group_replication/members_unreachable", Type: "gauge", Number: 1},
+		{Name: "mysql/group_replication/members_offline", Type: "gauge", Number: 0},
+		{Name: "mysql/group_replication/members_error", Type: "gauge", Number: 0},
+		{Name: "mysql/group_replication/online", Type: "gauge", Number: 1},
+	}
+	if same, diff := test.IsDeeply(got, expect); !same {
+		test.Dump(got)
+		t.Error(diff)
+	}
+
+	got = mysql.GroupMembersMetrics(members, "c")
+	t.Check(got[len(got)-1].Number, Equals, float64(0))
+}
+
+func (s *GroupReplicationTestSuite) TestGroupMembershipChanges(t *C) {
+	prev := map[string]mysql.GroupMember{
+		"a": {Id: "a", Host: "db1", Port: 3306, State: "ONLINE"},
+		"b": {Id: "b", Host: "db2", Port: 3306, State: "ONLINE"},
+		"c": {Id: "c", Host: "db3", Port: 3306, State: "ONLINE"},
+	}
+	t.Check(mysql.GroupMembershipChanges(prev, prev), HasLen, 0)
+
+	curr := map[string]mysql.GroupMember{
+		"a": {Id: "a", Host: "db1", Port: 3306, State: "ONLINE"},
+		"b": {Id: "b", Host: "db2", Port: 3306, State: "UNREACHABLE"},
+		"d": {Id: "d", Host: "db4", Port: 3306, State: "RECOVERING"},
+	}
+	got := mysql.GroupMembershipChanges(prev, curr)
+	expect := []string{
+		"Group replication member db2:3306 (b) changed from ONLINE to UNREACHABLE",
+		"Group replication member db3:3306 (c) left",
+		"Group replication member db4:3306 (d) joined as RECOVERING",
+	}
+	t.Check(got, DeepEquals, expect)
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Semi-sync replication
+/////////////////////////////////////////////////////////////////////////////
+
+type SemiSyncTestSuite struct{}
+
+var _ = Suite(&SemiSyncTestSuite{})
+
+func (s *SemiSyncTestSuite) TestSemiSyncValue(t *C) {
+	v, ok := mysql.SemiSyncValue("ON")
+	t.Check(ok, Equals, true)
+	t.Check(v, Equals, float64(1))
+	v, ok = mysql.SemiSyncValue("OFF")
+	t.Check(ok, Equals, true)
+	t.Check(v, Equals, float64(0))
+	_, ok = mysql.SemiSyncValue("")
+	t.Check(ok, Equals, false)
+}
+
+func (s *SemiSyncTestSuite) TestSemiSyncChanges(t *C) {
+	prev := map[string]float64{
+		"rpl_semi_sync_master_status":   1,
+		"rpl_semi_sync_master_no_times": 3,
+		"rpl_semi_sync_slave_status":    0,
+	}
+	t.Check(mysql.SemiSyncChanges(prev, prev), HasLen, 0)
+
+	// Source degraded to async, replica semi-sync came back on.
+	curr := map[string]float64{
+		"rpl_semi_sync_master_status":   0,
+		"rpl_semi_sync_master_no_times": 4,
+		"rpl_semi_sync_slave_status":    1,
+	}
+	got := mysql.SemiSyncChanges(prev, curr)
+	expect := []string{
+		"Semi-sync replication on replica is ON again (rpl_semi_sync_slave_status)",
+		"Semi-sync replication on source is OFF, replication is async (rpl_semi_sync_master_status)",
+	}
+	t.Check(got, DeepEquals, expect)
+
+	// Source fell back to async and recovered between collections.
+	curr = map[string]float64{
+		"rpl_semi_sync_source_status":   1,
+		"rpl_semi_sync_source_no_times": 2,
+	}
+	prev = map[string]float64{
+		"rpl_semi_sync_source_status":   1,
+		"rpl_semi_sync_source_no_times": 0,
+	}
+	got = mysql.SemiSyncChanges(prev, curr)
+	expect = []string{
+		"Semi-sync replication on source fell back to async 2 times (rpl_semi_sync_source_no_times)",
+	}
+	t.Check(got, DeepEquals, expect)
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Binlog
+/////////////////////////////////////////////////////////////////////////////
+
+type BinlogTestSuite struct{}
+
+var _ = Suite(&BinlogTestSuite{})
+
+func (s *BinlogTestSuite) TestBinlogFormatMetrics(t *C) {
+	got := mysql.BinlogFormatMetrics(mysql.BinlogFormat{LogBin: "ON", Format: "ROW", RowImage: "FULL"})
+	expect := []mm.Metric{
+		{Name: "mysql/binlog/format_statement", Type: "gauge", Number: 0},
+		{Name: "mysql/binlog/format_row", Type: "gauge", Number: 1},
+		{Name: "mysql/binlog/format_mixed", Type: "gauge", Number: 0},
+	}
+	if same, diff := test.IsDeeply(got, expect); !same {
+		test.Dump(got)
+		t.Error(diff)
+	}
+
+	got = mysql.BinlogFormatMetrics(mysql.BinlogFormat{LogBin: "OFF", Format: "ROW"})
+	t.Check(got, HasLen, 0)
+}
+
+func (s *BinlogTestSuite) TestBinlogFormatChanges(t *C) {
+	prev := mysql.BinlogFormat{LogBin: "ON", Format: "ROW", RowImage: "FULL"}
+	t.Check(mysql.BinlogFormatChanges(prev, prev), HasLen, 0)
+
+	curr := mysql.BinlogFormat{LogBin: "ON", Format: "MIXED", RowImage: "MINIMAL"}
+	got := mysql.BinlogFormatChanges(prev, curr)
+	expect := []string{
+		"binlog_format changed from ROW to MIXED",
+		"binlog_row_image changed from FULL to MINIMAL",
+	}
+	t.Check(got, DeepEquals, expect)
+}
+
+func (s *BinlogTestSuite) TestBinlogEventName(t *C) {
+	t.Check(mysql.BinlogEventName("Write_rows_v1"), Equals, "mysql/binlog/events_write_rows")
+	t.Check(mysql.BinlogEventName("Update_rows"), Equals, "mysql/binlog/events_update_rows")
+	t.Check(mysql.BinlogEventName("Xid"), Equals, "mysql/binlog/events_xid")
+	t.Check(mysql.BinlogEventName("Gtid_log_event_vx"), Equals, "mysql/binlog/events_gtid_log_event_vx")
+}
@@ -0,0 +1,115 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package mysql
+
+import (
+	"database/sql"
+	"fmt"
+
+	"github.com/percona/percona-agent/bus"
+	"github.com/percona/percona-agent/mysql"
+)
+
+// --------------------------------------------------------------------------
+// Replication
+// https://dev.mysql.com/doc/refman/5.6/en/show-slave-status.html
+// --------------------------------------------------------------------------
+
+// ReplicationStatus is the SHOW SLAVE STATUS of a replica whose replication
+// stopped, published as a bus.REPLICATION_STOPPED event.
+type ReplicationStatus struct {
+	DSN        string // without password
+	IORunning  string // Slave_IO_Running: Yes, No, or Connecting
+	SQLRunning string // Slave_SQL_Running: Yes or No
+	LastError  string `json:",omitempty"` // Last_IO_Error or Last_SQL_Error
+}
+
+func (s ReplicationStatus) String() string {
+	msg := fmt.Sprintf("Replication stopped on %s: Slave_IO_Running=%s Slave_SQL_Running=%s", s.DSN, s.IORunning, s.SQLRunning)
+	if s.LastError != "" {
+		msg += ": " + s.LastError
+	}
+	return msg
+}
+
+// checkReplication publishes replication stopping, i.e. the IO or SQL thread
+// was running at the last collection but not now.  It does nothing if MySQL
+// is not a replica.  Replication lag is a metric, see Config.Status.
+func (m *Monitor) checkReplication(conn *sql.DB) {
+	if m.noReplicaStatus {
+		return
+	}
+	status, err := GetReplicationStatus(conn)
+	if err != nil {
+		m.logger.Warn("Cannot detect replication stopping because SHOW SLAVE STATUS failed:", err)
+		m.noReplicaStatus = true
+		return
+	}
+	if status == nil {
+		m.replicaRunning = nil // not a replica, or RESET SLAVE ALL
+		return
+	}
+	running := status.IORunning == "Yes" && status.SQLRunning == "Yes"
+	if m.replicaRunning != nil && *m.replicaRunning && !running {
+		status.DSN = mysql.HideDSNPassword(m.conn.DSN())
+		m.logger.Warn(status.String())
+		m.bus.Publish(bus.Event{Topic: bus.REPLICATION_STOPPED, Source: m.name, Data: *status})
+	}
+	m.replicaRunning = &running
+}
+
+// GetReplicationStatus returns the SHOW SLAVE STATUS thread states and last
+// error, or nil if MySQL is not a replica.  DSN is not set.
+func GetReplicationStatus(conn *sql.DB) (*ReplicationStatus, error) {
+	rows, err := conn.Query("SHOW SLAVE STATUS")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	if !rows.Next() {
+		return nil, rows.Err()
+	}
+
+	// The columns vary by version, so scan them all by name.
+	cols, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+	vals := make([]sql.NullString, len(cols))
+	ptrs := make([]interface{}, len(cols))
+	for i := range vals {
+		ptrs[i] = &vals[i]
+	}
+	if err := rows.Scan(ptrs...); err != nil {
+		return nil, err
+	}
+	row := map[string]string{}
+	for i, col := range cols {
+		row[col] = vals[i].String
+	}
+
+	status := &ReplicationStatus{
+		IORunning:  row["Slave_IO_Running"],
+		SQLRunning: row["Slave_SQL_Running"],
+		LastError:  row["Last_SQL_Error"],
+	}
+	if status.LastError == "" {
+		status.LastError = row["Last_IO_Error"]
+	}
+	return status, nil
+}
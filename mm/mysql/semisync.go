@@ -0,0 +1,131 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package mysql
+
+import (
+	"fmt"
+	"sort"
+)
+
+// --------------------------------------------------------------------------
+// Semi-synchronous replication
+// https://dev.mysql.com/doc/refman/5.7/en/replication-semisync-monitoring.html
+// --------------------------------------------------------------------------
+
+// SHOW STATUS variables collected in addition to those in the mm config.
+// They exist only if the semi-sync plugins are loaded.  MySQL 8.0.26 renamed
+// master to source and slave to replica; both names are collected.
+var SemiSyncStatus = map[string]string{
+	// Source (master)
+	"rpl_semi_sync_master_status":            "gauge",
+	"rpl_semi_sync_master_clients":           "gauge",
+	"rpl_semi_sync_master_yes_tx":            "counter",
+	"rpl_semi_sync_master_no_tx":             "counter",
+	"rpl_semi_sync_master_no_times":          "counter",
+	"rpl_semi_sync_master_wait_sessions":     "gauge",
+	"rpl_semi_sync_master_tx_avg_wait_time":  "gauge",
+	"rpl_semi_sync_master_net_avg_wait_time": "gauge",
+	"rpl_semi_sync_source_status":            "gauge",
+	"rpl_semi_sync_source_clients":           "gauge",
+	"rpl_semi_sync_source_yes_tx":            "counter",
+	"rpl_semi_sync_source_no_tx":             "counter",
+	"rpl_semi_sync_source_no_times":          "counter",
+	"rpl_semi_sync_source_wait_sessions":     "gauge",
+	"rpl_semi_sync_source_tx_avg_wait_time":  "gauge",
+	"rpl_semi_sync_source_net_avg_wait_time": "gauge",
+	// Replica (slave)
+	"rpl_semi_sync_slave_status":   "gauge",
+	"rpl_semi_sync_replica_status": "gauge",
+}
+
+// SemiSyncValue returns the value of a semi-sync status variable.  The
+// *_status variables are ON or OFF which are returned as 1 or 0.
+func SemiSyncValue(statValue string) (float64, bool) {
+	switch statValue {
+	case "ON":
+		return 1, true
+	case "OFF":
+		return 0, true
+	}
+	return 0, false
+}
+
+// SemiSyncChanges returns a message for each semi-sync status that turned
+// off or on between prev and curr, keyed on status variable name.  Turning
+// off usually means the source timed out waiting for a replica ack and
+// silently fell back to async replication.  The source *_no_times counter
+// catches fall backs that recovered between collections.
+func SemiSyncChanges(prev, curr map[string]float64) []string {
+	changes := []string{}
+	roles := []struct {
+		role    string
+		status  string
+		noTimes string
+	}{
+		{"source", "rpl_semi_sync_master_status", "rpl_semi_sync_master_no_times"},
+		{"source", "rpl_semi_sync_source_status", "rpl_semi_sync_source_no_times"},
+		{"replica", "rpl_semi_sync_slave_status", ""},
+		{"replica", "rpl_semi_sync_replica_status", ""},
+	}
+	for _, r := range roles {
+		p, okPrev := prev[r.status]
+		c, okCurr := curr[r.status]
+		if !okPrev || !okCurr {
+			continue
+		}
+		switch {
+		case p == 1 && c == 0:
+			changes = append(changes, fmt.Sprintf("Semi-sync replication on %s is OFF, replication is async (%s)",
+				r.role, r.status))
+		case p == 0 && c == 1:
+			changes = append(changes, fmt.Sprintf("Semi-sync replication on %s is ON again (%s)",
+				r.role, r.status))
+		case c == 1 && r.noTimes != "":
+			// Still on, but did it fall back to async since last time?
+			if n := curr[r.noTimes] - prev[r.noTimes]; n > 0 {
+				changes = append(changes, fmt.Sprintf("Semi-sync replication on %s fell back to async %.0f times (%s)",
+					r.role, n, r.noTimes))
+			}
+		}
+	}
+	sort.Strings(changes)
+	return changes
+}
+
+func (m *Monitor) resolveSemiSync() {
+	for name, metricType := range SemiSyncStatus {
+		m.extraStatus[name] = metricType
+	}
+	// MySQL can restart with or without semi-sync, so don't compare to
+	// values from before the restart.
+	m.semiSync = nil
+}
+
+// semiSyncChanges logs changes in semi-sync status as warnings so they're
+// seen like events.  curr are the semi-sync values from SHOW STATUS.
+func (m *Monitor) semiSyncChanges(curr map[string]float64) {
+	if len(curr) == 0 {
+		return // semi-sync plugins not loaded
+	}
+	if m.semiSync != nil {
+		for _, change := range SemiSyncChanges(m.semiSync, curr) {
+			m.logger.Warn(change)
+		}
+	}
+	m.semiSync = curr
+}
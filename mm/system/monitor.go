@@ -43,9 +43,13 @@ type Monitor struct {
 	// --
 	prevCPUval map[string][]float64 // [cpu0] => [user, nice, ...]
 	prevCPUsum map[string]float64   // [cpu0] => user + nice + ...
-	sync       *pct.SyncChan
-	status     *pct.Status
-	running    bool
+	// OOM kills, see KernelLog
+	kmsgSeq        int64 // last kernel log record seen, -1 = none
+	oomKills       float64
+	mysqldOOMKills float64
+	sync           *pct.SyncChan
+	status         *pct.Status
+	running        bool
 }
 
 func NewMonitor(name string, config *Config, logger *pct.Logger) *Monitor {
@@ -56,6 +60,7 @@ func NewMonitor(name string, config *Config, logger *pct.Logger) *Monitor {
 		// --
 		prevCPUval: make(map[string][]float64),
 		prevCPUsum: make(map[string]float64),
+		kmsgSeq:    -1,
 		status:     pct.NewStatus([]string{name}),
 		sync:       pct.NewSyncChan(),
 	}
@@ -145,6 +150,15 @@ func (m *Monitor) run() {
 		m.logger.Debug("run:return")
 	}()
 
+	// Keep the kernel log open so each collect reads only new records.
+	// Opening it usually requires root.
+	kmsg, err := OpenKmsg()
+	if err != nil {
+		m.logger.Debug("run:OpenKmsg:", err)
+	} else {
+		defer kmsg.Close()
+	}
+
 	var lastTs int64
 	for {
 		m.logger.Debug("run:idle")
@@ -208,6 +222,17 @@ func (m *Monitor) run() {
 				}
 			}
 
+			if kmsg != nil {
+				content, err = kmsg.Read()
+				if err == nil {
+					if metrics, err := m.KernelLog(content); err != nil {
+						m.logger.Warn("system:run:KernelLog:", err)
+					} else {
+						c.Metrics = append(c.Metrics, metrics...)
+					}
+				}
+			}
+
 			// Send the metrics to the aggregator.
 			if len(c.Metrics) > 0 {
 				select {
@@ -402,7 +427,8 @@ func (m *Monitor) ProcVmstat(content []byte) ([]mm.Metric, error) {
 
 		if strings.HasPrefix(fields[0], "pswp") ||
 			strings.HasPrefix(fields[0], "pgpg") ||
-			strings.HasPrefix(fields[0], "numa") {
+			strings.HasPrefix(fields[0], "numa") ||
+			fields[0] == "oom_kill" { // Linux 4.13 and newer
 			m := mm.Metric{
 				Name:   "vmstat/" + fields[0],
 				Type:   "counter",
@@ -0,0 +1,129 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package system
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/percona/percona-agent/mm"
+)
+
+// An OOM kill in the kernel log, e.g. "Out of memory: Kill process 1234 (mysqld) ..."
+// or "Memory cgroup out of memory: Killed process 1234 (mysqld) ...".
+var oomKillRe = regexp.MustCompile(`(?i)out of memory: kill(?:ed)? process (\d+) \(([^)]+)\)`)
+
+// A Kmsg reads kernel log records from /dev/kmsg.  It keeps the file open, so
+// the first Read returns the whole kernel ring buffer and every Read after that
+// returns only the records logged since the last Read.
+type Kmsg struct {
+	fd int
+}
+
+// OpenKmsg opens /dev/kmsg.  It usually requires root.
+func OpenKmsg() (*Kmsg, error) {
+	fd, err := syscall.Open("/dev/kmsg", syscall.O_RDONLY|syscall.O_NONBLOCK, 0)
+	if err != nil {
+		return nil, err
+	}
+	return &Kmsg{fd: fd}, nil
+}
+
+// Read returns the new kernel log records, one per line, without blocking.
+func (k *Kmsg) Read() ([]byte, error) {
+	content := []byte{}
+	buf := make([]byte, 8192) // records are <= 8k
+	for {
+		n, err := syscall.Read(k.fd, buf)
+		if err == syscall.EPIPE {
+			continue // record overwritten while reading, skip it
+		}
+		if err != nil || n <= 0 {
+			break // EAGAIN: no more records
+		}
+		content = append(content, buf[:n]...)
+	}
+	return content, nil
+}
+
+func (k *Kmsg) Close() error {
+	return syscall.Close(k.fd)
+}
+
+// KernelLog counts OOM kills in kernel log records from Kmsg.Read and returns
+// oom/kills and oom/mysqld_kills counter metrics.  An OOM-killed mysqld is also
+// logged as a warning because otherwise it looks like a normal MySQL restart.
+// Records before the first call are not counted because they're from before
+// the agent started.
+func (m *Monitor) KernelLog(content []byte) ([]mm.Metric, error) {
+	m.logger.Debug("KernelLog:call")
+	defer m.logger.Debug("KernelLog:return")
+
+	m.status.Update(m.name, "Getting kernel log OOM kills")
+
+	/**
+	 * 6,1234,5678901,-;Out of memory: Kill process 1234 (mysqld) score 900 or sacrifice child
+	 *
+	 * Field 0: priority, 1: sequence number, 2: timestamp (microseconds
+	 * since boot), 3: flags, then the message after ;
+	 * https://www.kernel.org/doc/Documentation/ABI/testing/dev-kmsg
+	 */
+	baseline := m.kmsgSeq < 0
+	lines := strings.Split(string(content), "\n")
+	for _, line := range lines {
+		i := strings.Index(line, ";")
+		if i < 0 {
+			continue // continuation line or not a record
+		}
+		fields := strings.Split(line[:i], ",")
+		if len(fields) < 3 {
+			continue
+		}
+		seq, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil || seq <= m.kmsgSeq {
+			continue // already seen
+		}
+		m.kmsgSeq = seq
+		if baseline {
+			continue
+		}
+		match := oomKillRe.FindStringSubmatch(line[i+1:])
+		if match == nil {
+			continue
+		}
+		m.oomKills++
+		if match[2] == "mysqld" {
+			m.mysqldOOMKills++
+			m.logger.Warn(fmt.Sprintf("mysqld (PID %s) killed by OOM killer", match[1]))
+		} else {
+			m.logger.Info(fmt.Sprintf("%s (PID %s) killed by OOM killer", match[2], match[1]))
+		}
+	}
+	if baseline && m.kmsgSeq < 0 {
+		m.kmsgSeq = 0 // empty log
+	}
+
+	metrics := []mm.Metric{
+		{Name: "oom/kills", Type: "counter", Number: m.oomKills},
+		{Name: "oom/mysqld_kills", Type: "counter", Number: m.mysqldOOMKills},
+	}
+	return metrics, nil
+}
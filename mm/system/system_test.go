@@ -269,6 +269,77 @@ func (s *ProcVmstatTestSuite) TestProcVmstat001(t *C) {
 	}
 }
 
+/////////////////////////////////////////////////////////////////////////////
+// KernelLog
+/////////////////////////////////////////////////////////////////////////////
+
+type KernelLogTestSuite struct {
+	logChan chan *proto.LogEntry
+	logger  *pct.Logger
+}
+
+var _ = Suite(&KernelLogTestSuite{})
+
+func (s *KernelLogTestSuite) SetUpSuite(t *C) {
+	s.logChan = make(chan *proto.LogEntry, 100)
+	s.logger = pct.NewLogger(s.logChan, "system-monitor-test")
+}
+
+// --------------------------------------------------------------------------
+
+func (s *KernelLogTestSuite) TestKernelLog001(t *C) {
+	m := system.NewMonitor("", &system.Config{}, s.logger)
+
+	// Records before the first read are from before the agent started,
+	// so the OOM kill in the first read is not counted.
+	content, err := ioutil.ReadFile(sample + "/proc/kmsg001-1.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := m.KernelLog(content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := []mm.Metric{
+		{Name: "oom/kills", Type: "counter", Number: 0},
+		{Name: "oom/mysqld_kills", Type: "counter", Number: 0},
+	}
+	if same, diff := test.IsDeeply(got, expect); !same {
+		test.Dump(got)
+		t.Error(diff)
+	}
+
+	// Records already seen are skipped, e.g. if /dev/kmsg is reopened, so
+	// only the new ones count: one mysqld OOM kill (logged twice by older
+	// kernels) and one cgroup OOM kill.
+	content, err = ioutil.ReadFile(sample + "/proc/kmsg001-2.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err = m.KernelLog(content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect = []mm.Metric{
+		{Name: "oom/kills", Type: "counter", Number: 2},
+		{Name: "oom/mysqld_kills", Type: "counter", Number: 1},
+	}
+	if same, diff := test.IsDeeply(got, expect); !same {
+		test.Dump(got)
+		t.Error(diff)
+	}
+
+	// mysqld OOM kills are logged as warnings.
+	logs := test.WaitLogChan(s.logChan, 0)
+	found := false
+	for _, log := range logs {
+		if log.Level == proto.LOG_WARNING && log.Msg == "mysqld (PID 1234) killed by OOM killer" {
+			found = true
+		}
+	}
+	t.Check(found, Equals, true)
+}
+
 /////////////////////////////////////////////////////////////////////////////
 // ProcLoadavg
 /////////////////////////////////////////////////////////////////////////////
@@ -21,12 +21,15 @@ import (
 	"time"
 )
 
+// A Monitor checks the MySQL instances added to it for restarts.  Restarts are
+// published on the bus as bus.MYSQL_RESTART events, so services subscribe to
+// the bus, not the Monitor.  An instance is monitored until it's removed as
+// many times as it was added.
 type Monitor interface {
 	Start(interval time.Duration) error
 	Stop() error
 	Status() map[string]string
-	Add(dsn string) (c <-chan bool, err error)
-	Remove(dsn string, c <-chan bool)
+	Add(dsn string) error
+	Remove(dsn string)
 	Check()
-	GlobalSubscribe() (chan string, error)
 }
@@ -26,16 +26,16 @@ import (
 )
 
 type MysqlInstance struct {
-	logger      *pct.Logger
-	mysqlConn   mysql.Connector
-	Subscribers *Subscribers
+	logger    *pct.Logger
+	mysqlConn mysql.Connector
 	// --
+	refs            int // Monitor.Add count, guarded by the Monitor
 	lastUptime      int64
 	lastUptimeCheck time.Time
 	sync.Mutex
 }
 
-func NewMysqlInstance(logger *pct.Logger, mysqlConn mysql.Connector, subscribers *Subscribers) (mi *MysqlInstance, err error) {
+func NewMysqlInstance(logger *pct.Logger, mysqlConn mysql.Connector) (mi *MysqlInstance, err error) {
 	if err := mysqlConn.Connect(1); err != nil {
 		// 0. caller
 		// 1. monitor.Add()
@@ -56,7 +56,6 @@ func NewMysqlInstance(logger *pct.Logger, mysqlConn mysql.Connector, subscribers
 	mi = &MysqlInstance{
 		logger:          logger,
 		mysqlConn:       mysqlConn,
-		Subscribers:     subscribers,
 		lastUptime:      lastUptime,
 		lastUptimeCheck: lastUptimeCheck,
 	}
@@ -18,6 +18,7 @@
 package monitor
 
 import (
+	"github.com/percona/percona-agent/bus"
 	"github.com/percona/percona-agent/mrms"
 	"github.com/percona/percona-agent/mysql"
 	"github.com/percona/percona-agent/pct"
@@ -32,25 +33,27 @@ const (
 type Monitor struct {
 	logger           *pct.Logger
 	mysqlConnFactory mysql.ConnectionFactory
+	bus              *bus.Bus
 	// --
 	mysqlInstances map[string]*MysqlInstance
 	sync.RWMutex
 	// --
-	status     *pct.Status
-	sync       *pct.SyncChan
-	globalChan chan string
+	status *pct.Status
+	sync   *pct.SyncChan
 }
 
-func NewMonitor(logger *pct.Logger, mysqlConnFactory mysql.ConnectionFactory) mrms.Monitor {
+// NewMonitor returns a Monitor which publishes restarts to the bus as
+// bus.MYSQL_RESTART events.
+func NewMonitor(logger *pct.Logger, mysqlConnFactory mysql.ConnectionFactory, b *bus.Bus) mrms.Monitor {
 	m := &Monitor{
 		logger:           logger,
 		mysqlConnFactory: mysqlConnFactory,
+		bus:              b,
 		// --
 		mysqlInstances: make(map[string]*MysqlInstance),
 		// --
-		status:     pct.NewStatus([]string{MONITOR_NAME}),
-		sync:       pct.NewSyncChan(),
-		globalChan: make(chan string, 100),
+		status: pct.NewStatus([]string{MONITOR_NAME}),
+		sync:   pct.NewSyncChan(),
 	}
 	return m
 }
@@ -83,7 +86,7 @@ func (m *Monitor) Status() map[string]string {
 	return m.status.All()
 }
 
-func (m *Monitor) Add(dsn string) (c <-chan bool, err error) {
+func (m *Monitor) Add(dsn string) error {
 	m.logger.Debug("Add:call:" + mysql.HideDSNPassword(dsn))
 	defer m.logger.Debug("Add:return:" + mysql.HideDSNPassword(dsn))
 
@@ -92,35 +95,18 @@ func (m *Monitor) Add(dsn string) (c <-chan bool, err error) {
 
 	mysqlInstance, ok := m.mysqlInstances[dsn]
 	if !ok {
+		var err error
 		mysqlInstance, err = m.createMysqlInstance(dsn)
 		if err != nil {
-			return nil, err
+			return err
 		}
 		m.mysqlInstances[dsn] = mysqlInstance
 	}
-
-	c = mysqlInstance.Subscribers.Add()
-	return c, nil
-}
-
-func (m *Monitor) GlobalSubscribe() (chan string, error) {
-	m.logger.Debug("GlobalSusbcribe:call")
-	defer m.logger.Debug("GlobalSubscribe:return")
-
-	m.Lock()
-	defer m.Unlock()
-	var err error
-
-	for _, instance := range m.mysqlInstances {
-		err = instance.Subscribers.GlobalAdd(m.globalChan, instance.mysqlConn.DSN())
-		if err != nil {
-			return nil, err
-		}
-	}
-	return m.globalChan, nil
+	mysqlInstance.refs++
+	return nil
 }
 
-func (m *Monitor) Remove(dsn string, c <-chan bool) {
+func (m *Monitor) Remove(dsn string) {
 	m.logger.Debug("Remove:call:" + mysql.HideDSNPassword(dsn))
 	defer m.logger.Debug("Remove:return:" + mysql.HideDSNPassword(dsn))
 
@@ -128,11 +114,10 @@ func (m *Monitor) Remove(dsn string, c <-chan bool) {
 	defer m.Unlock()
 
 	if mysqlInstance, ok := m.mysqlInstances[dsn]; ok {
-		mysqlInstance.Subscribers.Remove(c)
-		if mysqlInstance.Subscribers.Empty() {
+		mysqlInstance.refs--
+		if mysqlInstance.refs <= 0 {
 			delete(m.mysqlInstances, dsn)
 		}
-		mysqlInstance.Subscribers.GlobalRemove(dsn)
 	}
 }
 
@@ -143,15 +128,19 @@ func (m *Monitor) Check() {
 	m.RLock()
 	defer m.RUnlock()
 
-	for _, mysqlInstance := range m.mysqlInstances {
+	for dsn, mysqlInstance := range m.mysqlInstances {
 		wasRestarted, err := mysqlInstance.CheckIfMysqlRestarted()
 		if err != nil {
 			m.logger.Error(err)
 			continue
 		}
 		if wasRestarted {
-			m.logger.Debug("Check:restarted:" + mysql.HideDSNPassword(mysqlInstance.DSN()))
-			mysqlInstance.Subscribers.Notify()
+			m.logger.Debug("Check:restarted:" + mysql.HideDSNPassword(dsn))
+			m.bus.Publish(bus.Event{
+				Topic:  bus.MYSQL_RESTART,
+				Source: MONITOR_NAME,
+				Data:   mysql.HideDSNPassword(dsn),
+			})
 		}
 	}
 }
@@ -195,6 +184,5 @@ func (m *Monitor) createMysqlInstance(dsn string) (mi *MysqlInstance, err error)
 	mysqlConn := m.mysqlConnFactory.Make(dsn)
 	// todo: fix
 	logger := pct.NewLogger(m.logger.LogChan(), "mrms-monitor-mysql")
-	subscribers := NewSubscribers(logger)
-	return NewMysqlInstance(logger, mysqlConn, subscribers)
+	return NewMysqlInstance(logger, mysqlConn)
 }
@@ -22,6 +22,7 @@ import (
 	"time"
 
 	"github.com/percona/cloud-protocol/proto/v1"
+	"github.com/percona/percona-agent/bus"
 	"github.com/percona/percona-agent/mrms/monitor"
 	"github.com/percona/percona-agent/mysql"
 	"github.com/percona/percona-agent/pct"
@@ -57,18 +58,20 @@ func (s *TestSuite) TestStartStop(t *C) {
 	mockConnFactory := &mock.ConnectionFactory{
 		Conn: mockConn,
 	}
-	m := monitor.NewMonitor(s.logger, mockConnFactory)
+	b := bus.New()
+	restarts := b.Subscribe(bus.MYSQL_RESTART, 0)
+	m := monitor.NewMonitor(s.logger, mockConnFactory, b)
 	dsn := "fake:dsn@tcp(127.0.0.1:3306)/?parseTime=true"
 
 	/**
-	 * Register new subscriber
+	 * Add instance
 	 */
 	// Set initial uptime
 	mockConn.SetUptime(10)
 	t.Assert(mockConn.GetUptimeCount(), Equals, uint(0))
-	subChan, err := m.Add(dsn)
+	err := m.Add(dsn)
 	t.Assert(err, IsNil)
-	t.Assert(mockConn.GetUptimeCount(), Equals, uint(1), Commentf("MRMS didn't checked uptime after adding first subscriber"))
+	t.Assert(mockConn.GetUptimeCount(), Equals, uint(1), Commentf("MRMS didn't checked uptime after adding first instance"))
 
 	/**
 	 * Start MRMS
@@ -80,13 +83,13 @@ func (s *TestSuite) TestStartStop(t *C) {
 	// Imitate MySQL restart by setting uptime to 5s (previously 10s)
 	mockConn.SetUptime(5)
 
-	// After max 1 second it should notify subscriber about MySQL restart
-	var notified bool
+	// After max 1 second it should publish the MySQL restart
 	select {
-	case notified = <-subChan:
-	case <-time.After(1 * time.Second):
+	case e := <-restarts.C:
+		t.Check(e.Data, Equals, mysql.HideDSNPassword(dsn))
+	case <-time.After(2 * time.Second):
+		t.Error("MySQL was restarted but MRMS didn't publish it")
 	}
-	t.Assert(notified, Equals, true, Commentf("MySQL was restarted but MRMS didn't notify subscribers"))
 
 	/**
 	 * Stop MRMS
@@ -103,81 +106,64 @@ func (s *TestSuite) TestStartStop(t *C) {
 	// Imitate MySQL restart by setting uptime to 1s (previously 5s)
 	mockConn.SetUptime(1)
 
-	// After stopping service it should not notify subscribers anymore
+	// After stopping service it should not publish restarts anymore
 	time.Sleep(2 * time.Second)
 	select {
-	case notified = <-subChan:
+	case <-restarts.C:
+		t.Error("MRMS published a restart after being stopped")
 	default:
 	}
-	t.Assert(notified, Equals, true, Commentf("MRMS notified subscribers after being stopped"))
 }
 
-func (s *TestSuite) TestGlobalSubscribe(t *C) {
+func (s *TestSuite) TestNotifications(t *C) {
 	mockConn := mock.NewNullMySQL()
 	mockConnFactory := &mock.ConnectionFactory{
 		Conn: mockConn,
 	}
-	m := monitor.NewMonitor(s.logger, mockConnFactory)
+	b := bus.New()
+	restarts := b.Subscribe(bus.MYSQL_RESTART, 0)
+	m := monitor.NewMonitor(s.logger, mockConnFactory, b)
 	dsn := "fake:dsn@tcp(127.0.0.1:3306)/?parseTime=true"
-	subChan, err := m.Add(dsn)
-	t.Assert(err, IsNil)
-	t.Assert(subChan, NotNil)
 
-	gc, err := m.GlobalSubscribe()
-	t.Assert(err, IsNil)
-	t.Assert(gc, NotNil)
-}
-func (s *TestSuite) TestNotifications(t *C) {
-	mockConn := mock.NewNullMySQL()
-	mockConnFactory := &mock.ConnectionFactory{
-		Conn: mockConn,
+	restarted := func() bool {
+		select {
+		case e := <-restarts.C:
+			t.Check(e.Source, Equals, monitor.MONITOR_NAME)
+			t.Check(e.Data, Equals, mysql.HideDSNPassword(dsn))
+			return true
+		default:
+			return false
+		}
 	}
-	m := monitor.NewMonitor(s.logger, mockConnFactory)
-	dsn := "fake:dsn@tcp(127.0.0.1:3306)/?parseTime=true"
 
 	/**
-	 * Register new subscriber
+	 * Add instance
 	 */
 	// Set initial uptime
 	mockConn.SetUptime(10)
-	subChan, err := m.Add(dsn)
+	err := m.Add(dsn)
 	t.Assert(err, IsNil)
 
 	/**
-	 * MRMS should not send notification after first check for given dsn
+	 * MRMS should not publish a restart after first check for given dsn
 	 */
-	var notified bool
-	select {
-	case notified = <-subChan:
-	default:
-	}
-	t.Assert(notified, Equals, false, Commentf("MySQL was not restarted (first check of MySQL server), but MRMS notified subscribers"))
+	t.Assert(restarted(), Equals, false, Commentf("MySQL was not restarted (first check of MySQL server), but MRMS published a restart"))
 
 	/**
-	 * If MySQL was restarted then MRMS should notify subscriber
+	 * If MySQL was restarted then MRMS should publish it
 	 */
 	// Imitate MySQL restart by returning 0s uptime (previously 10s)
 	mockConn.SetUptime(0)
 	m.Check()
-	notified = false
-	select {
-	case notified = <-subChan:
-	default:
-	}
-	t.Assert(notified, Equals, true, Commentf("MySQL was restarted, but MRMS didn't notify subscribers"))
+	t.Assert(restarted(), Equals, true, Commentf("MySQL was restarted, but MRMS didn't publish it"))
 
 	/**
-	 * If MySQL was not restarted then MRMS should not notify subscriber
+	 * If MySQL was not restarted then MRMS should not publish anything
 	 */
 	// 2s uptime is higher than previous 0s, this indicates MySQL was not restarted
 	mockConn.SetUptime(2)
 	m.Check()
-	notified = false
-	select {
-	case notified = <-subChan:
-	default:
-	}
-	t.Assert(notified, Equals, false, Commentf("MySQL was not restarted, but MRMS notified subscribers"))
+	t.Assert(restarted(), Equals, false, Commentf("MySQL was not restarted, but MRMS published a restart"))
 
 	/**
 	 * Now let's imitate MySQL server restart and let's wait 3 seconds before next check.
@@ -185,100 +171,75 @@ func (s *TestSuite) TestNotifications(t *C) {
 	 * which is higher than last registered uptime=2s
 	 *
 	 * However we expect in this test that this is properly detected as MySQL restart
-	 * and the MRMS notifies subscribers
+	 * and the MRMS publishes it
 	 */
 	waitTime := int64(3)
 	time.Sleep(time.Duration(waitTime) * time.Second)
 	mockConn.SetUptime(waitTime)
 	m.Check()
-	select {
-	case notified = <-subChan:
-	default:
-	}
-	t.Assert(notified, Equals, true, Commentf("MySQL was restarted (uptime overlaped last registered uptime), but MRMS didn't notify subscribers"))
+	t.Assert(restarted(), Equals, true, Commentf("MySQL was restarted (uptime overlaped last registered uptime), but MRMS didn't publish it"))
 
 	/**
-	 * After removing subscriber MRMS should not notify it anymore about MySQL restarts
+	 * After removing the instance MRMS should not check it anymore
 	 */
 	// Imitate MySQL restart by returning 0s uptime (previously 3s)
 	mockConn.SetUptime(0)
-	m.Remove(dsn, subChan)
+	m.Remove(dsn)
 	m.Check()
-	notified = false
-	select {
-	case notified = <-subChan:
-	default:
-	}
-	t.Assert(notified, Equals, false, Commentf("Subscriber was removed but MRMS still notified it about MySQL restart"))
+	t.Assert(restarted(), Equals, false, Commentf("Instance was removed but MRMS still published its restart"))
 }
 
-func (s *TestSuite) TestSubscribers(t *C) {
-	subs := monitor.NewSubscribers(s.logger)
-	rwChan := make(chan string, 100)
-	dsn := "fake:dsn@tcp(127.0.0.1:3306)/?parseTime=true"
-	err := subs.GlobalAdd(rwChan, dsn)
-	t.Assert(err, Equals, nil)
-
-	err = subs.GlobalAdd(rwChan, "")
-	t.Assert(err, NotNil)
-}
-
-func (s *TestSuite) Test2Subscribers(t *C) {
+func (s *TestSuite) TestAddRemove(t *C) {
 	mockConn := mock.NewNullMySQL()
 	mockConnFactory := &mock.ConnectionFactory{
 		Conn: mockConn,
 	}
-	m := monitor.NewMonitor(s.logger, mockConnFactory)
+	b := bus.New()
+	restarts := b.Subscribe(bus.MYSQL_RESTART, 0)
+	m := monitor.NewMonitor(s.logger, mockConnFactory, b)
 	dsn := "fake:dsn@tcp(127.0.0.1:3306)/?parseTime=true"
 
-	c1, err := m.Add(dsn)
+	// Two services monitor the same instance, e.g. qan and mm.
+	mockConn.SetUptime(10)
+	err := m.Add(dsn)
 	t.Assert(err, IsNil)
-
-	c2, err := m.Add(dsn)
+	err = m.Add(dsn)
 	t.Assert(err, IsNil)
 
-	var notified bool
-
+	// One restart is one event, not one per Add.
 	mockConn.SetUptime(1)
 	m.Check()
-	select {
-	case notified = <-c1:
-	default:
-	}
-	t.Check(notified, Equals, false)
-	select {
-	case notified = <-c2:
-	default:
-	}
-	t.Check(notified, Equals, false)
+	t.Check(len(restarts.C), Equals, 1)
+	<-restarts.C
 
-	mockConn.SetUptime(2)
+	// The instance is monitored until the last service removes it.
+	m.Remove(dsn)
+	mockConn.SetUptime(0)
 	m.Check()
-	select {
-	case notified = <-c1:
-	default:
-	}
-	t.Check(notified, Equals, false)
-	select {
-	case notified = <-c2:
-	default:
-	}
-	t.Check(notified, Equals, false)
+	t.Check(len(restarts.C), Equals, 1)
+	<-restarts.C
+
+	m.Remove(dsn)
+	mockConn.SetUptime(0)
+	m.Check()
+	t.Check(len(restarts.C), Equals, 0)
 }
 
 func (s *TestSuite) TestRealMySQL(t *C) {
 	if dsn == "" {
 		t.Skip("PCT_TEST_MYSQL_DSN is not set")
 	}
-	m := monitor.NewMonitor(s.logger, &mysql.RealConnectionFactory{})
-	c, err := m.Add(dsn)
+	b := bus.New()
+	restarts := b.Subscribe(bus.MYSQL_RESTART, 0)
+	m := monitor.NewMonitor(s.logger, &mysql.RealConnectionFactory{}, b)
+	err := m.Add(dsn)
 	t.Assert(err, IsNil)
-	defer m.Remove(dsn, c)
+	defer m.Remove(dsn)
 	for i := 0; i < 2; i++ {
 		time.Sleep(1 * time.Second)
 		m.Check()
 		select {
-		case <-c:
+		case <-restarts.C:
 			t.Logf("False-positive restart reported on check number %d", i)
 			t.FailNow()
 		default:
@@ -20,6 +20,7 @@ package mysql
 import (
 	"errors"
 	"fmt"
+	"os"
 	"os/exec"
 	"os/user"
 	"path"
@@ -44,6 +45,14 @@ const (
 
 var ErrNoSocket error = errors.New("Cannot find MySQL socket (localhost implies socket).  Specify socket or use 127.0.0.1 instead of localhost.")
 
+// Common MySQL socket files, checked if the socket is not found in netstat
+// output, e.g. because netstat is not installed.
+var DefaultSockets = []string{
+	"/var/run/mysqld/mysqld.sock",
+	"/var/lib/mysql/mysql.sock",
+	"/tmp/mysql.sock",
+}
+
 func (dsn DSN) DSN() (string, error) {
 	// Make Sprintf format easier; password doesn't really start with ":".
 	if dsn.Password != "" {
@@ -60,12 +69,7 @@ func (dsn DSN) DSN() (string, error) {
 	// "connections on Unix to localhost are made using a Unix socket file by default"
 	if dsn.Hostname == "localhost" && (dsn.Protocol == "" || dsn.Protocol == "socket") {
 		if dsn.Socket == "" {
-			// Try to auto-detect MySQL socket from netstat output.
-			out, err := exec.Command("netstat", "-anp").Output()
-			if err != nil {
-				return "", ErrNoSocket
-			}
-			socket := ParseSocketFromNetstat(string(out))
+			socket := FindSocket()
 			if socket == "" {
 				return "", ErrNoSocket
 			}
@@ -136,6 +140,23 @@ func (dsn DSN) StringWithSuffixes() string {
 	return dsnString
 }
 
+// FindSocket returns the MySQL socket file from netstat output or, failing
+// that, the first of DefaultSockets which exists.  It returns an empty string
+// if no socket is found.
+func FindSocket() string {
+	if out, err := exec.Command("netstat", "-anp").Output(); err == nil {
+		if socket := ParseSocketFromNetstat(string(out)); socket != "" {
+			return socket
+		}
+	}
+	for _, socket := range DefaultSockets {
+		if fi, err := os.Stat(socket); err == nil && fi.Mode()&os.ModeSocket != 0 {
+			return socket
+		}
+	}
+	return ""
+}
+
 func ParseSocketFromNetstat(out string) string {
 	lines := strings.Split(out, "\n")
 	for _, line := range lines {
@@ -81,3 +81,22 @@ func (s *DSNTestSuite) TestHideDSNPassword(t *C) {
 	dsn = ""
 	t.Check(mysql.HideDSNPassword(dsn), Equals, ":"+mysql.HiddenPassword+"@")
 }
+
+func (s *DSNTestSuite) TestSocketOnly(t *C) {
+	// Servers with skip-networking have only a socket, no hostname or port.
+	dsn := mysql.DSN{
+		Username: "user",
+		Password: "pass",
+		Socket:   "/var/run/mysqld/mysqld.sock",
+	}
+	str, err := dsn.DSN()
+	t.Check(err, IsNil)
+	t.Check(str, Equals, "user:pass@unix(/var/run/mysqld/mysqld.sock)/?parseTime=true")
+	t.Check(dsn.To(), Equals, "/var/run/mysqld/mysqld.sock")
+
+	// Socket takes precedence over hostname.
+	dsn.Hostname = "localhost"
+	str, err = dsn.DSN()
+	t.Check(err, IsNil)
+	t.Check(str, Equals, "user:pass@unix(/var/run/mysqld/mysqld.sock)/?parseTime=true")
+}
@@ -0,0 +1,118 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package mysql
+
+import (
+	"strings"
+
+	"github.com/percona/percona-agent/pct"
+)
+
+const (
+	FLAVOR_MYSQL   = "mysql"
+	FLAVOR_PERCONA = "percona"
+	FLAVOR_MARIADB = "mariadb"
+)
+
+// MariaDB SHOW STATUS variables collected in addition to those in the mm config:
+// thread pool and Aria (MyISAM replacement used for internal temp tables).
+var MariaDBStatus = map[string]string{
+	"threadpool_idle_threads":           "gauge",
+	"threadpool_threads":                "gauge",
+	"aria_pagecache_blocks_not_flushed": "gauge",
+	"aria_pagecache_blocks_unused":      "gauge",
+	"aria_pagecache_blocks_used":        "gauge",
+	"aria_pagecache_read_requests":      "counter",
+	"aria_pagecache_reads":              "counter",
+	"aria_pagecache_write_requests":     "counter",
+	"aria_pagecache_writes":             "counter",
+	"aria_transaction_log_syncs":        "counter",
+}
+
+// Features is what a MySQL server supports, which depends on its flavor and
+// version.  Features of newer unknown flavors default to those of MySQL.
+type Features struct {
+	Flavor            string
+	Version           string
+	UserstatVar       string            // SET GLOBAL <UserstatVar>=ON
+	InnoDBMetrics     bool              // INFORMATION_SCHEMA.INNODB_METRICS
+	PerfSchemaDigests bool              // performance_schema.events_statements_summary_by_digest
+	JSONExplain       bool              // EXPLAIN FORMAT=JSON
+	Status            map[string]string // flavor-specific SHOW STATUS variables
+}
+
+// Flavor returns FLAVOR_MARIADB, FLAVOR_PERCONA, or FLAVOR_MYSQL given
+// @@version (e.g. 10.0.17-MariaDB-log) and @@version_comment (e.g.
+// Percona Server (GPL), Release 72.2).
+func Flavor(version, versionComment string) string {
+	version = strings.ToLower(version)
+	versionComment = strings.ToLower(versionComment)
+	switch {
+	case strings.Contains(version, "mariadb") || strings.Contains(versionComment, "mariadb"):
+		return FLAVOR_MARIADB
+	case strings.Contains(versionComment, "percona"):
+		return FLAVOR_PERCONA
+	default:
+		return FLAVOR_MYSQL
+	}
+}
+
+// GetFeatures returns the Features of a MySQL server given its @@version and
+// @@version_comment.
+func GetFeatures(version, versionComment string) Features {
+	f := Features{
+		Flavor:  Flavor(version, versionComment),
+		Version: version,
+		Status:  map[string]string{},
+	}
+	atLeast := func(v string) bool {
+		ok, _ := pct.AtLeastVersion(version, v)
+		return ok
+	}
+	if f.Flavor == FLAVOR_MARIADB {
+		// MariaDB 10 is roughly MySQL 5.6, but not all 5.6 features were
+		// ported, and not in the same version.
+		f.UserstatVar = "userstat"
+		f.InnoDBMetrics = atLeast("10.0.0")
+		f.PerfSchemaDigests = atLeast("10.0.12")
+		f.JSONExplain = atLeast("10.1.2")
+		for name, metricType := range MariaDBStatus {
+			f.Status[name] = metricType
+		}
+	} else {
+		// 5.1.49 <= v <= 5.5.10: SET GLOBAL userstat_running=ON
+		// 5.5.10 <  v:           SET GLOBAL userstat=ON
+		// Only Percona Server has user stats, but some builds don't say
+		// "Percona" in version_comment, so try for all non-MariaDB.
+		if atLeast("5.1.49") && !atLeast("5.5.11") {
+			f.UserstatVar = "userstat_running"
+		} else {
+			f.UserstatVar = "userstat"
+		}
+		f.InnoDBMetrics = atLeast("5.6.2")
+		f.PerfSchemaDigests = atLeast("5.6.5")
+		f.JSONExplain = atLeast("5.6.5")
+	}
+	return f
+}
+
+// GetConnFeatures returns the Features of the MySQL server, which must be
+// connected.
+func GetConnFeatures(conn Connector) Features {
+	return GetFeatures(conn.GetGlobalVarString("version"), conn.GetGlobalVarString("version_comment"))
+}
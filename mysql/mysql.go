@@ -25,6 +25,7 @@ import (
 	"time"
 
 	_ "github.com/go-sql-driver/mysql"
+	"github.com/percona/percona-agent/chaos"
 	"github.com/percona/percona-agent/pct"
 )
 
@@ -64,6 +65,7 @@ func NewConnection(dsn string) *Connection {
 }
 
 func (c *Connection) DB() *sql.DB {
+	chaos.DelayMySQL() // no-op unless built with chaos tag
 	return c.conn
 }
 
@@ -95,6 +97,7 @@ func (c *Connection) Connect(tries uint) error {
 		}
 
 		// ...try to use the connection for real.
+		chaos.DelayMySQL()
 		if err = db.Ping(); err != nil {
 			// Connection failed.  Wrong username or password?
 			db.Close()
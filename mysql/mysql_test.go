@@ -109,3 +109,54 @@ func (s *MysqlTestSuite) TestErrorFormatting(t *C) {
 	}
 	t.Check(mysql.FormatError(e1), Equals, "connection refused: 127.0.0.1:3306")
 }
+
+/////////////////////////////////////////////////////////////////////////////
+// Flavor and features
+/////////////////////////////////////////////////////////////////////////////
+
+type FlavorTestSuite struct{}
+
+var _ = Suite(&FlavorTestSuite{})
+
+func (s *FlavorTestSuite) TestFlavor(t *C) {
+	t.Check(mysql.Flavor("10.0.17-MariaDB-log", "MariaDB Server"), Equals, mysql.FLAVOR_MARIADB)
+	t.Check(mysql.Flavor("5.5.41-MariaDB", "(Debian)"), Equals, mysql.FLAVOR_MARIADB)
+	t.Check(mysql.Flavor("5.6.22-71.0-log", "Percona Server (GPL), Release 71.0, Revision 726"), Equals, mysql.FLAVOR_PERCONA)
+	t.Check(mysql.Flavor("5.6.23", "MySQL Community Server (GPL)"), Equals, mysql.FLAVOR_MYSQL)
+	t.Check(mysql.Flavor("", ""), Equals, mysql.FLAVOR_MYSQL)
+}
+
+func (s *FlavorTestSuite) TestFeatures(t *C) {
+	f := mysql.GetFeatures("5.5.41-MariaDB", "MariaDB Server")
+	t.Check(f.UserstatVar, Equals, "userstat")
+	t.Check(f.InnoDBMetrics, Equals, false)
+	t.Check(f.PerfSchemaDigests, Equals, false)
+	t.Check(f.JSONExplain, Equals, false)
+	t.Check(f.Status["aria_pagecache_reads"], Equals, "counter")
+
+	f = mysql.GetFeatures("10.0.17-MariaDB-log", "MariaDB Server")
+	t.Check(f.InnoDBMetrics, Equals, true)
+	t.Check(f.PerfSchemaDigests, Equals, true)
+	t.Check(f.JSONExplain, Equals, false)
+
+	f = mysql.GetFeatures("10.1.3-MariaDB", "MariaDB Server")
+	t.Check(f.JSONExplain, Equals, true)
+
+	f = mysql.GetFeatures("5.5.10-rel20.1", "Percona Server (GPL), Release 20.1")
+	t.Check(f.UserstatVar, Equals, "userstat_running")
+	t.Check(f.InnoDBMetrics, Equals, false)
+	t.Check(f.PerfSchemaDigests, Equals, false)
+	t.Check(f.Status, HasLen, 0)
+
+	f = mysql.GetFeatures("5.6.22-71.0-log", "Percona Server (GPL), Release 71.0, Revision 726")
+	t.Check(f.UserstatVar, Equals, "userstat")
+	t.Check(f.InnoDBMetrics, Equals, true)
+	t.Check(f.PerfSchemaDigests, Equals, true)
+	t.Check(f.JSONExplain, Equals, true)
+
+	// Flavor-specific status vars can be changed per instance.
+	f = mysql.GetFeatures("10.0.17-MariaDB-log", "MariaDB Server")
+	delete(f.Status, "aria_pagecache_reads")
+	f = mysql.GetFeatures("10.0.17-MariaDB-log", "MariaDB Server")
+	t.Check(f.Status["aria_pagecache_reads"], Equals, "counter")
+}
@@ -0,0 +1,237 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package pct
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"sync"
+)
+
+const (
+	ANONYMIZE_KEY_SIZE = 32 // bytes
+	ANONYMIZE_PREFIX   = "anon_"
+)
+
+// An Anonymizer replaces schema, table, and user names with names hashed with
+// a key that only the agent has, so customers can share data with support
+// without exposing their naming.  The same name is always hashed the same,
+// so e.g. a table can be followed across QAN reports, but the hashes cannot
+// be reversed by hashing common names without the key.
+type Anonymizer struct {
+	key []byte
+}
+
+func NewAnonymizer(key []byte) *Anonymizer {
+	return &Anonymizer{key: key}
+}
+
+var (
+	anonymizer    *Anonymizer
+	anonymizerMux = &sync.RWMutex{}
+)
+
+// SetAnonymize enables or disables anonymization agent-wide, see Anonymize.
+// The key is read from the state store, or created there the first time.
+func SetAnonymize(enabled bool) error {
+	var a *Anonymizer
+	if enabled {
+		store, err := Basedir.Store()
+		if err != nil {
+			return err
+		}
+		key, err := anonymizeKey(store)
+		if err != nil {
+			return err
+		}
+		a = NewAnonymizer(key)
+	}
+	anonymizerMux.Lock()
+	anonymizer = a
+	anonymizerMux.Unlock()
+	return nil
+}
+
+// Anonymize returns the Anonymizer set by SetAnonymize, or nil if
+// anonymization is disabled.  Services anonymize data before spooling it.
+func Anonymize() *Anonymizer {
+	anonymizerMux.RLock()
+	defer anonymizerMux.RUnlock()
+	return anonymizer
+}
+
+func anonymizeKey(store *Store) ([]byte, error) {
+	var key []byte
+	err := store.Update(func(tx *StoreTx) error {
+		hexKey := ""
+		found, err := tx.Get(STORE_STATE, "anonymize-key", &hexKey)
+		if err != nil {
+			return err
+		}
+		if found {
+			key, err = hex.DecodeString(hexKey)
+			return err
+		}
+		key = make([]byte, ANONYMIZE_KEY_SIZE)
+		if _, err := rand.Read(key); err != nil {
+			return err
+		}
+		return tx.Put(STORE_STATE, "anonymize-key", hex.EncodeToString(key))
+	})
+	return key, err
+}
+
+// Name returns the hashed name, e.g. anon_3fa91c0d2e4b.  Names are hashed
+// case-insensitively because query fingerprints are lowercase.
+func (a *Anonymizer) Name(name string) string {
+	if name == "" || strings.HasPrefix(name, ANONYMIZE_PREFIX) {
+		return name
+	}
+	mac := hmac.New(sha256.New, a.key)
+	mac.Write([]byte(strings.ToLower(name)))
+	return ANONYMIZE_PREFIX + hex.EncodeToString(mac.Sum(nil))[0:12]
+}
+
+// List hashes each name in a comma-separated list, e.g. the value of
+// replicate_do_db.  Names like db.tbl are hashed by part.
+func (a *Anonymizer) List(names string) string {
+	if names == "" {
+		return names
+	}
+	list := strings.Split(names, ",")
+	for i, name := range list {
+		parts := strings.Split(strings.TrimSpace(name), ".")
+		for j, part := range parts {
+			if part != "%" {
+				parts[j] = a.Name(part)
+			}
+		}
+		list[i] = strings.Join(parts, ".")
+	}
+	return strings.Join(list, ",")
+}
+
+// Query hashes the identifiers in a query fingerprint, e.g. "select c from
+// db.t where id=?" becomes "select anon_... from anon_....anon_... where
+// anon_...=?".  SQL keywords, functions, variables, and values are kept.
+// Only fingerprints should be anonymized: literal values in queries are not
+// identifiers, so they are not hashed, but they are not kept safe either.
+func (a *Anonymizer) Query(query string) string {
+	var out []byte
+	for i := 0; i < len(query); {
+		c := query[i]
+		switch {
+		case c == '\'' || c == '"':
+			// Value: copy as is.
+			j := i + 1
+			for j < len(query) && query[j] != c {
+				if query[j] == '\\' {
+					j++
+				}
+				j++
+			}
+			if j < len(query) {
+				j++
+			}
+			out = append(out, query[i:j]...)
+			i = j
+		case c == '`':
+			// Quoted identifier.
+			j := strings.IndexByte(query[i+1:], '`')
+			if j < 0 {
+				out = append(out, query[i:]...)
+				return string(out)
+			}
+			out = append(out, '`')
+			out = append(out, a.Name(query[i+1:i+1+j])...)
+			out = append(out, '`')
+			i += j + 2
+		case isIdentByte(c):
+			j := i
+			for j < len(query) && isIdentByte(query[j]) {
+				j++
+			}
+			word := query[i:j]
+			if a.isIdent(query, i, j) {
+				word = a.Name(word)
+			}
+			out = append(out, word...)
+			i = j
+		default:
+			out = append(out, c)
+			i++
+		}
+	}
+	return string(out)
+}
+
+// isIdent returns true if the word query[i:j] is a schema, table, or column
+// name.
+func (a *Anonymizer) isIdent(query string, i, j int) bool {
+	word := query[i:j]
+	if strings.Trim(word, "0123456789") == "" {
+		return false // number
+	}
+	if i > 0 && query[i-1] == '.' {
+		return true // db.tbl or tbl.col
+	}
+	if i > 0 && query[i-1] == '@' {
+		return false // @var or @@var
+	}
+	if j < len(query) && query[j] == '(' {
+		return false // function
+	}
+	if sqlKeywords[strings.ToLower(word)] {
+		return false
+	}
+	return true
+}
+
+func isIdentByte(c byte) bool {
+	return c == '_' || c == '$' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9')
+}
+
+// sqlKeywords are not hashed by Anonymizer.Query.  A name that is also a
+// keyword, e.g. a column named status, is not hashed unless it's qualified,
+// e.g. t.status.
+var sqlKeywords = map[string]bool{}
+
+func init() {
+	for _, word := range strings.Fields(`
+		add all alter analyze and as asc auto_increment begin between binary
+		by call case change character charset check collate column commit
+		create cross current_date current_time current_timestamp database
+		databases default delayed delete desc describe distinct div do drop
+		duplicate else end engine escape exists explain false flush for force
+		foreign from full global grant group having high_priority if ignore
+		in index inner insert interval into is join key keys kill left like
+		limit load local lock low_priority match mod modify natural not null
+		offset on optimize or order outer partition primary procedure
+		process processlist purge read regexp rename repair replace revoke
+		right rlike rollback row rows savepoint schema schemas select session
+		set share show sql_big_result sql_buffer_result sql_cache
+		sql_calc_found_rows sql_no_cache sql_small_result start status
+		straight_join table tables then to transaction trigger true truncate
+		union unique unlock update use using values variables view when
+		where with write xor`) {
+		sqlKeywords[word] = true
+	}
+}
@@ -0,0 +1,59 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package pct_test
+
+import (
+	"github.com/percona/percona-agent/pct"
+	. "gopkg.in/check.v1"
+	"strings"
+)
+
+type AnonymizeTestSuite struct {
+}
+
+var _ = Suite(&AnonymizeTestSuite{})
+
+func (s *AnonymizeTestSuite) TestName(t *C) {
+	a := pct.NewAnonymizer([]byte("key1"))
+	name := a.Name("sales")
+	t.Check(strings.HasPrefix(name, pct.ANONYMIZE_PREFIX), Equals, true)
+	t.Check(strings.Contains(name, "sales"), Equals, false)
+
+	// Same name, same hash, regardless of case, but not hashed twice.
+	t.Check(a.Name("Sales"), Equals, name)
+	t.Check(a.Name(name), Equals, name)
+	t.Check(a.Name("orders"), Not(Equals), name)
+	t.Check(a.Name(""), Equals, "")
+
+	// Hashes are keyed per agent.
+	t.Check(pct.NewAnonymizer([]byte("key2")).Name("sales"), Not(Equals), name)
+
+	t.Check(a.List("sales,shop.orders,logs%.%"), Equals,
+		name+","+a.Name("shop")+"."+a.Name("orders")+","+a.Name("logs%")+".%")
+}
+
+func (s *AnonymizeTestSuite) TestQuery(t *C) {
+	a := pct.NewAnonymizer([]byte("key1"))
+	got := a.Query("select c, sleep(?) from sales.orders as o where o.status = ? and @@autocommit=?")
+	expect := "select " + a.Name("c") + ", sleep(?) from " + a.Name("sales") + "." + a.Name("orders") +
+		" as " + a.Name("o") + " where " + a.Name("o") + "." + a.Name("status") + " = ? and @@autocommit=?"
+	t.Check(got, Equals, expect)
+
+	got = a.Query("insert into `my table` values(?+)")
+	t.Check(got, Equals, "insert into `"+a.Name("my table")+"` values(?+)")
+}
@@ -20,6 +20,9 @@ package pct
 import (
 	"bytes"
 	"compress/gzip"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -28,7 +31,9 @@ import (
 	"io/ioutil"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -36,17 +41,45 @@ import (
 
 var requiredEntryLinks = []string{"agents", "instances", "download"}
 var requiredAgentLinks = []string{"cmd", "log", "data"}
-var timeoutClientConfig = &TimeoutClientConfig{
-	ConnectTimeout:   10 * time.Second,
-	ReadWriteTimeout: 10 * time.Second,
+
+// APIOptions are the timeouts and retries of all API requests, see
+// SetAPIOptions.
+type APIOptions struct {
+	ConnectTimeout time.Duration
+	ReadTimeout    time.Duration // per connection, see TimeoutDialer
+	Retries        uint          // after a NetworkError or a 5xx APIError
+	RetryWait      time.Duration // before the first retry, doubled for each retry after
+	FallbackDelay  time.Duration // before also trying the next address, see Dial
+	AddrTimeout    time.Duration // minimum connect timeout per address, see Dial
+	PreferIPv4     bool          // try IPv4 addresses first, e.g. if IPv6 is broken
+}
+
+var DefaultAPIOptions = APIOptions{
+	ConnectTimeout: 10 * time.Second,
+	ReadTimeout:    10 * time.Second,
+	Retries:        0,
+	RetryWait:      1 * time.Second,
+	FallbackDelay:  DIAL_FALLBACK_DELAY,
+	AddrTimeout:    DIAL_MIN_ADDR_TIMEOUT,
 }
 
+var (
+	apiOptions    = DefaultAPIOptions
+	apiOptionsMux = &sync.RWMutex{}
+)
+
+// Connect skips an API host for this long after it fails, unless all hosts
+// have failed.
+var HostRetryInterval = 1 * time.Minute
+
 type APIConnector interface {
 	Connect(hostname, apiKey, agentUuid string) error
 	Init(hostname, apiKey string, headers map[string]string) (code int, err error)
 	Get(apiKey, url string) (int, []byte, error)
 	Post(apiKey, url string, data []byte) (*http.Response, []byte, error)
 	Put(apiKey, url string, data []byte) (*http.Response, []byte, error)
+	Delete(apiKey, url string) (*http.Response, []byte, error)
+	Failover() error
 	EntryLink(resource string) string
 	AgentLink(resource string) string
 	Origin() string
@@ -58,13 +91,18 @@ type APIConnector interface {
 
 type API struct {
 	origin     string
-	hostname   string
+	hostname   string   // connected host
+	hostnames  []string // all hosts, primary first, see ApiHostnames
+	failed     map[string]time.Time
 	apiKey     string
 	agentUuid  string
 	entryLinks map[string]string
 	agentLinks map[string]string
 	mux        *sync.RWMutex
 	client     *http.Client
+	sign       bool
+	headers    map[string]string
+	auth       *Auth // replaces apiKey if set, see SetAuth
 }
 
 type TimeoutClientConfig struct {
@@ -75,19 +113,49 @@ type TimeoutClientConfig struct {
 func NewAPI() *API {
 	hostname, _ := os.Hostname()
 	client := &http.Client{
-		Transport: &http.Transport{
-			Dial: TimeoutDialer(timeoutClientConfig),
-		},
+		Transport: newTransport(),
 	}
 	a := &API{
 		origin:     "http://" + hostname,
 		agentLinks: make(map[string]string),
+		failed:     make(map[string]time.Time),
 		mux:        new(sync.RWMutex),
 		client:     client,
 	}
 	return a
 }
 
+// SetAPIOptions sets the timeouts and retries used by new API requests and
+// connections, including Ping and websockets.  Zero timeouts, RetryWait, and
+// FallbackDelay are the defaults.
+func SetAPIOptions(o APIOptions) {
+	if o.ConnectTimeout == 0 {
+		o.ConnectTimeout = DefaultAPIOptions.ConnectTimeout
+	}
+	if o.ReadTimeout == 0 {
+		o.ReadTimeout = DefaultAPIOptions.ReadTimeout
+	}
+	if o.RetryWait == 0 {
+		o.RetryWait = DefaultAPIOptions.RetryWait
+	}
+	if o.FallbackDelay == 0 {
+		o.FallbackDelay = DefaultAPIOptions.FallbackDelay
+	}
+	if o.AddrTimeout == 0 {
+		o.AddrTimeout = DefaultAPIOptions.AddrTimeout
+	}
+	apiOptionsMux.Lock()
+	apiOptions = o
+	apiOptionsMux.Unlock()
+}
+
+// GetAPIOptions returns the options set by SetAPIOptions.
+func GetAPIOptions() APIOptions {
+	apiOptionsMux.RLock()
+	defer apiOptionsMux.RUnlock()
+	return apiOptions
+}
+
 func Ping(hostname, apiKey string, headers map[string]string) (int, error) {
 	url := URL(hostname, "ping")
 	req, err := http.NewRequest("GET", url, nil)
@@ -102,9 +170,7 @@ func Ping(hostname, apiKey string, headers map[string]string) (int, error) {
 	}
 
 	client := &http.Client{
-		Transport: &http.Transport{
-			Dial: TimeoutDialer(timeoutClientConfig),
-		},
+		Transport: newTransport(),
 	}
 	resp, err := client.Do(req)
 	if err != nil {
@@ -135,7 +201,88 @@ func URL(hostname string, paths ...string) string {
 	return url
 }
 
+// ApiHostnames returns the hosts in a comma-separated list of API hostnames
+// like "cloud-api.percona.com,dr-api.example.com".  The first is the primary.
+func ApiHostnames(hostname string) []string {
+	hostnames := []string{}
+	for _, host := range strings.Split(hostname, ",") {
+		host = strings.TrimSpace(host)
+		if host != "" {
+			hostnames = append(hostnames, host)
+		}
+	}
+	return hostnames
+}
+
+// Connect connects to the first API host in hostname (see ApiHostnames) that
+// responds with the required links.  Hosts that failed in the last
+// HostRetryInterval are tried last.
 func (a *API) Connect(hostname, apiKey, agentUuid string) error {
+	hostnames := ApiHostnames(hostname)
+	if len(hostnames) == 0 {
+		return errors.New("No API hostname")
+	}
+
+	// Healthy hosts first, in order, then failed hosts in order.
+	a.mux.RLock()
+	healthy := []string{}
+	failed := []string{}
+	for _, host := range hostnames {
+		if t, ok := a.failed[host]; ok && time.Now().Sub(t) < HostRetryInterval {
+			failed = append(failed, host)
+		} else {
+			healthy = append(healthy, host)
+		}
+	}
+	a.mux.RUnlock()
+
+	var lastErr error
+	errs := []string{}
+	for _, host := range append(healthy, failed...) {
+		entryLinks, agentLinks, err := a.connect(host, apiKey, agentUuid)
+		if err != nil {
+			a.mux.Lock()
+			a.failed[host] = time.Now()
+			a.mux.Unlock()
+			lastErr = err
+			errs = append(errs, host+": "+err.Error())
+			continue
+		}
+
+		// Success: API responds with the links we need.
+		a.mux.Lock()
+		defer a.mux.Unlock()
+		delete(a.failed, host)
+		a.hostname = host
+		a.hostnames = hostnames
+		a.apiKey = apiKey
+		a.agentUuid = agentUuid
+		a.entryLinks = entryLinks
+		a.agentLinks = agentLinks
+		return nil
+	}
+	if len(hostnames) == 1 {
+		return lastErr
+	}
+	return errors.New(strings.Join(errs, "; "))
+}
+
+// Failover reconnects to the first API host that responds, starting with the
+// primary.  The websocket client calls it when it cannot connect, and the
+// agent calls it periodically to fail back to the primary.
+func (a *API) Failover() error {
+	a.mux.RLock()
+	hostname := strings.Join(a.hostnames, ",")
+	apiKey := a.apiKey
+	agentUuid := a.agentUuid
+	a.mux.RUnlock()
+	if hostname == "" {
+		return errors.New("Not connected to API")
+	}
+	return a.Connect(hostname, apiKey, agentUuid)
+}
+
+func (a *API) connect(hostname, apiKey, agentUuid string) (map[string]string, map[string]string, error) {
 	schema := "https://"
 	if strings.HasPrefix(hostname, "localhost") || strings.HasPrefix(hostname, "127.0.0.1") {
 		schema = "http://"
@@ -144,39 +291,41 @@ func (a *API) Connect(hostname, apiKey, agentUuid string) error {
 	// Get entry links: GET <API hostname>/
 	entryLinks, err := a.getLinks(apiKey, schema+hostname)
 	if err != nil {
-		return err
+		return nil, nil, err
 	}
 	if err := a.checkLinks(entryLinks, requiredEntryLinks...); err != nil {
-		return err
+		return nil, nil, err
 	}
 
 	// Get agent links: <API hostname>/agents/
 	agentLinks, err := a.getLinks(apiKey, entryLinks["agents"]+"/"+agentUuid)
 	if err != nil {
-		return err
+		return nil, nil, err
 	}
 	if err := a.checkLinks(agentLinks, requiredAgentLinks...); err != nil {
-		return err
+		return nil, nil, err
 	}
 
-	// Success: API responds with the links we need.
-	a.mux.Lock()
-	defer a.mux.Unlock()
-	a.hostname = hostname
-	a.apiKey = apiKey
-	a.agentUuid = agentUuid
-	a.entryLinks = entryLinks
-	a.agentLinks = agentLinks
-	return nil
+	return entryLinks, agentLinks, nil
 }
 
+// Init pings the API hosts in hostname in order and uses the first that
+// responds with 200.
 func (a *API) Init(hostname string, apiKey string, headers map[string]string) (int, error) {
-	code, err := Ping(hostname, apiKey, headers)
-	if code == 200 && err == nil {
-		a.mux.Lock()
-		defer a.mux.Unlock()
-		a.hostname = hostname
-		a.apiKey = apiKey
+	var code int
+	var err error
+	hostnames := ApiHostnames(hostname)
+	for _, host := range hostnames {
+		code, err = Ping(host, apiKey, headers)
+		if code == 200 && err == nil {
+			a.mux.Lock()
+			defer a.mux.Unlock()
+			a.hostname = host
+			a.hostnames = hostnames
+			a.apiKey = apiKey
+			a.headers = headers // for all requests, e.g. creating the agent
+			return code, nil
+		}
 	}
 
 	return code, err
@@ -193,13 +342,11 @@ func (a *API) checkLinks(links map[string]string, req ...string) error {
 }
 
 func (a *API) getLinks(apiKey, url string) (map[string]string, error) {
-	code, data, err := a.Get(apiKey, url)
+	_, data, err := a.Get(apiKey, url)
 	if err != nil {
 		return nil, err
 	}
-	if code >= 400 {
-		return nil, fmt.Errorf("Error %d from %s\n", code, url)
-	} else if len(data) == 0 {
+	if len(data) == 0 {
 		return nil, fmt.Errorf("OK response from %s but no content", url)
 	}
 
@@ -211,39 +358,15 @@ func (a *API) getLinks(apiKey, url string) (map[string]string, error) {
 	return links.Links, nil
 }
 
+// Get returns the response code and body.  The error is an APIError if the
+// code is >= 400, or a NetworkError if there's no response.  Like Post and
+// Put, it's retried as set by SetAPIOptions.
 func (a *API) Get(apiKey, url string) (int, []byte, error) {
-	req, err := http.NewRequest("GET", url, nil)
-	if err != nil {
+	resp, data, err := a.request("GET", apiKey, url, nil)
+	if resp == nil {
 		return 0, nil, err
 	}
-	req.Header.Add("X-Percona-API-Key", apiKey)
-
-	// todo: timeout
-	resp, err := a.client.Do(req)
-	if err != nil {
-		return 0, nil, fmt.Errorf("GET %s error: client.Do: %s", url, err)
-	}
-	defer resp.Body.Close()
-
-	var data []byte
-	if resp.Header.Get("Content-Type") == "application/x-gzip" {
-		buf := new(bytes.Buffer)
-		gz, err := gzip.NewReader(resp.Body)
-		if err != nil {
-			return 0, nil, err
-		}
-		if _, err := io.Copy(buf, gz); err != nil {
-			return resp.StatusCode, nil, err
-		}
-		data = buf.Bytes()
-	} else {
-		data, err = ioutil.ReadAll(resp.Body)
-		if err != nil {
-			return resp.StatusCode, nil, fmt.Errorf("GET %s error: ioutil.ReadAll: %s", url, err)
-		}
-	}
-
-	return resp.StatusCode, data, nil
+	return resp.StatusCode, data, err
 }
 
 func (a *API) EntryLink(resource string) string {
@@ -273,10 +396,33 @@ func (a *API) URL(paths ...string) string {
 	return URL(a.Hostname(), paths...)
 }
 
+// ApiKey returns the API key, or the token of the auth provider if set.  If
+// the provider fails, it returns the API key, which the API rejects.
 func (a *API) ApiKey() string {
+	a.mux.RLock()
+	auth := a.auth
+	apiKey := a.apiKey
+	a.mux.RUnlock()
+	if auth != nil {
+		if key, err := auth.Key(); err == nil {
+			return key
+		}
+	}
+	return apiKey
+}
+
+// SetAuth sets the auth provider whose token replaces the API key in all
+// requests and connections, or removes it if nil.
+func (a *API) SetAuth(auth *Auth) {
+	a.mux.Lock()
+	defer a.mux.Unlock()
+	a.auth = auth
+}
+
+func (a *API) authenticator() *Auth {
 	a.mux.RLock()
 	defer a.mux.RUnlock()
-	return a.apiKey
+	return a.auth
 }
 
 func (a *API) AgentUuid() string {
@@ -285,35 +431,172 @@ func (a *API) AgentUuid() string {
 	return a.agentUuid
 }
 
+// SignRequests enables or disables signing Get, Post, and Put requests.
+// See SignRequest.
+func (a *API) SignRequests(sign bool) {
+	a.mux.Lock()
+	defer a.mux.Unlock()
+	a.sign = sign
+}
+
+func (a *API) signing() bool {
+	a.mux.RLock()
+	defer a.mux.RUnlock()
+	return a.sign
+}
+
+func (a *API) addHeaders(req *http.Request) {
+	a.mux.RLock()
+	defer a.mux.RUnlock()
+	for k, v := range a.headers {
+		req.Header.Set(k, v)
+	}
+}
+
 func (a *API) Post(apiKey, url string, data []byte) (*http.Response, []byte, error) {
-	return a.send("POST", apiKey, url, data)
+	return a.request("POST", apiKey, url, data)
 }
 
 func (a *API) Put(apiKey, url string, data []byte) (*http.Response, []byte, error) {
-	return a.send("PUT", apiKey, url, data)
+	return a.request("PUT", apiKey, url, data)
 }
 
-func (a *API) send(method, apiKey, url string, data []byte) (*http.Response, []byte, error) {
-	req, err := http.NewRequest(method, url, bytes.NewReader(data))
-	header := http.Header{}
-	header.Set("X-Percona-API-Key", apiKey)
-	req.Header = header
+func (a *API) Delete(apiKey, url string) (*http.Response, []byte, error) {
+	return a.request("DELETE", apiKey, url, nil)
+}
 
-	resp, err := a.client.Do(req)
+// request sends the request until it succeeds, fails with a 4xx APIError, or
+// there are no retries left.
+func (a *API) request(method, apiKey, url string, data []byte) (*http.Response, []byte, error) {
+	o := GetAPIOptions()
+	wait := o.RetryWait
+	for try := uint(0); ; try++ {
+		resp, content, err := a.requestOnce(method, apiKey, url, data)
+		if err == nil || try >= o.Retries {
+			return resp, content, err
+		}
+		if apiErr, ok := err.(APIError); ok && apiErr.Code < 500 {
+			return resp, content, err
+		}
+		time.Sleep(wait)
+		wait *= 2
+	}
+}
+
+func (a *API) requestOnce(method, apiKey, url string, data []byte) (*http.Response, []byte, error) {
+	var body io.Reader
+	if data != nil {
+		body = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, url, body)
 	if err != nil {
-		return resp, nil, err
+		return nil, nil, err
 	}
-	content, err := ioutil.ReadAll(resp.Body)
-	resp.Body.Close()
+	if auth := a.authenticator(); auth != nil {
+		if apiKey, err = auth.Key(); err != nil {
+			return nil, nil, err
+		}
+	}
+	req.Header.Set("X-Percona-API-Key", apiKey)
+	a.addHeaders(req)
+	if a.signing() {
+		SignRequest(req, apiKey, data, time.Now())
+	}
+
+	t0 := time.Now()
+	resp, err := a.client.Do(req)
 	if err != nil {
-		return resp, nil, err
+		return nil, nil, NetworkError{Method: method, URL: url, Err: err}
+	}
+	defer resp.Body.Close()
+	if apiTime, err := http.ParseTime(resp.Header.Get("Date")); err == nil {
+		MeasureClock(apiTime, t0, time.Now())
+	}
+
+	var content []byte
+	if resp.Header.Get("Content-Type") == "application/x-gzip" {
+		buf := new(bytes.Buffer)
+		gz, err := gzip.NewReader(resp.Body)
+		if err != nil {
+			return resp, nil, NetworkError{Method: method, URL: url, Err: err}
+		}
+		if _, err := io.Copy(buf, gz); err != nil {
+			return resp, nil, NetworkError{Method: method, URL: url, Err: err}
+		}
+		content = buf.Bytes()
+	} else {
+		content, err = ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return resp, nil, NetworkError{Method: method, URL: url, Err: err}
+		}
+	}
+
+	if resp.StatusCode >= 400 {
+		return resp, content, APIError{Method: method, URL: url, Code: resp.StatusCode, Body: content}
 	}
 	return resp, content, nil
 }
 
+// SignRequest signs req so on-premise APIs can authenticate the agent more
+// strongly than the API key header.  It sets X-Percona-Timestamp (Unix seconds)
+// and X-Percona-Signature (see RequestSignature).  The API should reject
+// requests with an old timestamp to prevent replaying them.
+func SignRequest(req *http.Request, apiKey string, body []byte, ts time.Time) {
+	timestamp := strconv.FormatInt(ts.Unix(), 10)
+	req.Header.Set("X-Percona-Timestamp", timestamp)
+	req.Header.Set("X-Percona-Signature", RequestSignature(apiKey, req.Method, req.URL.Path, timestamp, body))
+}
+
+// RequestSignature returns the hex HMAC-SHA256, keyed by the API key, of the
+// method, path, and timestamp, each followed by a newline, then the body.
+func RequestSignature(apiKey, method, path, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(apiKey))
+	fmt.Fprintf(mac, "%s\n%s\n%s\n", method, path, timestamp)
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// newTransport returns the transport for API requests.  https connects with
+// TLSDial (proxy, TLSConfig, and pins), http with the proxy, if any.  Both use
+// the timeouts set by SetAPIOptions.
+func newTransport() *http.Transport {
+	return &http.Transport{
+		Dial: func(netw, addr string) (net.Conn, error) {
+			o := GetAPIOptions()
+			config := &TimeoutClientConfig{
+				ConnectTimeout:   o.ConnectTimeout,
+				ReadWriteTimeout: o.ReadTimeout,
+			}
+			return TimeoutDialer(config)(netw, addr)
+		},
+		DialTLS: func(netw, addr string) (net.Conn, error) {
+			o := GetAPIOptions()
+			location := &url.URL{Scheme: "https", Host: addr}
+			conn, err := TLSDial(location, addr, o.ConnectTimeout, nil)
+			if err != nil {
+				return nil, err
+			}
+			conn.SetDeadline(time.Now().Add(o.ReadTimeout))
+			return conn, nil
+		},
+		Proxy: func(req *http.Request) (*url.URL, error) {
+			if req.URL.Scheme == "https" {
+				return nil, nil // TLSDial connects through the proxy
+			}
+			return Proxy(req)
+		},
+	}
+}
+
 func TimeoutDialer(config *TimeoutClientConfig) func(net, addr string) (c net.Conn, err error) {
 	return func(netw, addr string) (net.Conn, error) {
-		conn, err := net.DialTimeout(netw, addr, config.ConnectTimeout)
+		var conn net.Conn
+		var err error
+		if netw == "tcp" {
+			conn, err = Dial(addr, config.ConnectTimeout) // all A and AAAA records
+		} else {
+			conn, err = net.DialTimeout(netw, addr, config.ConnectTimeout)
+		}
 		if err != nil {
 			return nil, err
 		}
@@ -0,0 +1,191 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package pct
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// AUTH_REFRESH_BEFORE is how long before a token expires that Auth fetches a
+// new one, so requests never send an expired token.
+const AUTH_REFRESH_BEFORE = 5 * time.Minute
+
+// AUTH_TIMEOUT is the timeout for requests to a metadata service or Vault.
+const AUTH_TIMEOUT = 10 * time.Second
+
+// An AuthProvider returns the key sent to the API as X-Percona-API-Key instead
+// of the static ApiKey, e.g. a short-lived token.
+type AuthProvider interface {
+	// Token returns the current token and when it expires, zero if never.
+	Token() (string, time.Time, error)
+	Name() string
+}
+
+// AuthConfig configures an AuthProvider, see NewAuthProvider.
+type AuthConfig struct {
+	Provider  string // "metadata" or "vault"
+	URL       string // metadata service URL, or Vault address like https://127.0.0.1:8200
+	Path      string // Vault secret path, e.g. secret/percona-agent
+	Field     string // Vault secret field with the API key, default "api_key"
+	TokenFile string // file with the Vault token, else the VAULT_TOKEN env var
+}
+
+// NewAuthProvider returns the provider configured by config.
+func NewAuthProvider(config AuthConfig) (AuthProvider, error) {
+	if config.URL == "" {
+		return nil, errors.New("Missing auth URL")
+	}
+	switch config.Provider {
+	case "metadata":
+		return &MetadataAuth{url: config.URL, client: &http.Client{Timeout: AUTH_TIMEOUT}}, nil
+	case "vault":
+		if config.Path == "" {
+			return nil, errors.New("Missing Vault secret path")
+		}
+		field := config.Field
+		if field == "" {
+			field = "api_key"
+		}
+		v := &VaultAuth{
+			vault: NewVault(VaultConfig{Addr: config.URL, TokenFile: config.TokenFile}),
+			path:  config.Path,
+			field: field,
+		}
+		return v, nil
+	default:
+		return nil, fmt.Errorf("Invalid auth provider: %s: expected metadata or vault", config.Provider)
+	}
+}
+
+// MetadataAuth gets a token from a local metadata service which responds to
+// GET with JSON like {"Token":"...","Expires":"2015-06-01T12:00:00Z"}.
+type MetadataAuth struct {
+	url    string
+	client *http.Client
+}
+
+func (m *MetadataAuth) Name() string {
+	return "metadata " + m.url
+}
+
+func (m *MetadataAuth) Token() (string, time.Time, error) {
+	resp, err := m.client.Get(m.url)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", time.Time{}, fmt.Errorf("GET %s: %s", m.url, resp.Status)
+	}
+	token := struct {
+		Token   string
+		Expires time.Time
+	}{}
+	if err := json.Unmarshal(data, &token); err != nil {
+		return "", time.Time{}, fmt.Errorf("Invalid token from %s: %s", m.url, err)
+	}
+	if token.Token == "" {
+		return "", time.Time{}, fmt.Errorf("No token from %s", m.url)
+	}
+	return token.Token, token.Expires, nil
+}
+
+// VaultAuth reads the API key from a Vault secret.  It expires after the lease
+// duration, if any, e.g. for a dynamic secret.
+type VaultAuth struct {
+	vault *Vault
+	path  string
+	field string
+}
+
+func (v *VaultAuth) Name() string {
+	return "vault " + v.path
+}
+
+func (v *VaultAuth) Token() (string, time.Time, error) {
+	now := time.Now()
+	secret, err := v.vault.Read(v.path)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	token := secret.Field(v.field)
+	if token == "" {
+		return "", time.Time{}, fmt.Errorf("Vault secret %s has no %s", v.path, v.field)
+	}
+	return token, secret.Expires(now), nil
+}
+
+// Auth caches the token of an AuthProvider.  It gets a new token when the
+// cached one is due to expire in AUTH_REFRESH_BEFORE.  If that fails, the
+// cached token is used until it expires.
+type Auth struct {
+	provider AuthProvider
+	// --
+	token   string
+	expires time.Time
+	mux     *sync.Mutex
+}
+
+func NewAuth(provider AuthProvider) *Auth {
+	a := &Auth{
+		provider: provider,
+		mux:      &sync.Mutex{},
+	}
+	return a
+}
+
+// Key returns the cached token, refreshing it if needed.
+func (a *Auth) Key() (string, error) {
+	a.mux.Lock()
+	defer a.mux.Unlock()
+	now := time.Now()
+	if a.token != "" && (a.expires.IsZero() || now.Before(a.expires.Add(-AUTH_REFRESH_BEFORE))) {
+		return a.token, nil
+	}
+	token, expires, err := a.provider.Token()
+	if err != nil {
+		if a.token != "" && now.Before(a.expires) {
+			return a.token, nil // still valid, try again next time
+		}
+		return "", fmt.Errorf("Cannot get API key from %s: %s", a.provider.Name(), err)
+	}
+	a.token = token
+	a.expires = expires
+	return a.token, nil
+}
+
+// Expires returns when the cached token expires, zero if never or not fetched.
+func (a *Auth) Expires() time.Time {
+	a.mux.Lock()
+	defer a.mux.Unlock()
+	return a.expires
+}
+
+func (a *Auth) Name() string {
+	return a.provider.Name()
+}
@@ -0,0 +1,106 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package pct_test
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"time"
+
+	"github.com/percona/percona-agent/pct"
+	. "gopkg.in/check.v1"
+)
+
+type AuthTestSuite struct {
+}
+
+var _ = Suite(&AuthTestSuite{})
+
+func (s *AuthTestSuite) TestMetadataAuth(t *C) {
+	expires := time.Now().Add(time.Hour).UTC().Truncate(time.Second)
+	gets := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gets++
+		fmt.Fprintf(w, `{"Token":"token-%d","Expires":"%s"}`, gets, expires.Format(time.RFC3339))
+	}))
+	defer server.Close()
+
+	provider, err := pct.NewAuthProvider(pct.AuthConfig{Provider: "metadata", URL: server.URL})
+	t.Assert(err, IsNil)
+	auth := pct.NewAuth(provider)
+
+	// The token is cached until it's due to expire.
+	key, err := auth.Key()
+	t.Assert(err, IsNil)
+	t.Check(key, Equals, "token-1")
+	key, err = auth.Key()
+	t.Assert(err, IsNil)
+	t.Check(key, Equals, "token-1")
+	t.Check(gets, Equals, 1)
+	t.Check(auth.Expires().Equal(expires), Equals, true)
+
+	// Within AUTH_REFRESH_BEFORE of expiring, it gets a new one.
+	expires = time.Now().Add(pct.AUTH_REFRESH_BEFORE / 2).UTC().Truncate(time.Second)
+	auth = pct.NewAuth(provider)
+	key, err = auth.Key()
+	t.Assert(err, IsNil)
+	t.Check(key, Equals, "token-2")
+	key, err = auth.Key()
+	t.Assert(err, IsNil)
+	t.Check(key, Equals, "token-3")
+
+	// If the provider fails, the token is used until it expires.
+	server.Close()
+	key, err = auth.Key()
+	t.Check(err, IsNil)
+	t.Check(key, Equals, "token-3")
+}
+
+func (s *AuthTestSuite) TestVaultAuth(t *C) {
+	var header http.Header
+	var path string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header = r.Header
+		path = r.URL.Path
+		fmt.Fprint(w, `{"lease_duration":3600,"data":{"data":{"api_key":"vault-key"}}}`)
+	}))
+	defer server.Close()
+
+	os.Setenv("VAULT_TOKEN", "s.root")
+	defer os.Unsetenv("VAULT_TOKEN")
+	provider, err := pct.NewAuthProvider(pct.AuthConfig{Provider: "vault", URL: server.URL, Path: "/secret/data/agent"})
+	t.Assert(err, IsNil)
+	t0 := time.Now()
+	token, expires, err := provider.Token()
+	t.Assert(err, IsNil)
+	t.Check(token, Equals, "vault-key")
+	t.Check(path, Equals, "/v1/secret/data/agent")
+	t.Check(header.Get("X-Vault-Token"), Equals, "s.root")
+	t.Check(expires.After(t0.Add(59*time.Minute)), Equals, true)
+}
+
+func (s *AuthTestSuite) TestInvalidAuth(t *C) {
+	_, err := pct.NewAuthProvider(pct.AuthConfig{Provider: "kerberos", URL: "http://localhost"})
+	t.Check(err, NotNil)
+	_, err = pct.NewAuthProvider(pct.AuthConfig{Provider: "vault", URL: "http://localhost"})
+	t.Check(err, NotNil) // no path
+	_, err = pct.NewAuthProvider(pct.AuthConfig{Provider: "metadata"})
+	t.Check(err, NotNil) // no URL
+}
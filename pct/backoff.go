@@ -28,6 +28,10 @@ type Backoff struct {
 	lastSuccess time.Time
 	resetAfter  time.Duration
 	NowFunc     func() time.Time
+	// Exponential backoff with jitter, see NewJitterBackoff:
+	min  time.Duration
+	max  time.Duration
+	next time.Time
 }
 
 func NewBackoff(resetAfter time.Duration) *Backoff {
@@ -38,7 +42,25 @@ func NewBackoff(resetAfter time.Duration) *Backoff {
 	return b
 }
 
+// NewJitterBackoff returns a Backoff that waits about min, 2*min, 4*min, etc.
+// up to max.  Each wait is random in [d/2, d] (the first in [0, min)) so many
+// clients don't retry at the same time, e.g. when the API comes back.
+func NewJitterBackoff(min, max, resetAfter time.Duration) *Backoff {
+	b := &Backoff{
+		resetAfter: resetAfter,
+		NowFunc:    time.Now,
+		min:        min,
+		max:        max,
+	}
+	return b
+}
+
 func (b *Backoff) Wait() time.Duration {
+	if b.max > 0 {
+		d := b.jitterWait()
+		b.next = b.NowFunc().Add(d)
+		return d
+	}
 	var t int
 	if b.try == 0 {
 		t = 0
@@ -72,3 +94,26 @@ func (b *Backoff) Success() {
 	}
 	b.lastSuccess = time.Now()
 }
+
+// Next returns when the last Wait ends, i.e. the next try, for jitter backoffs.
+func (b *Backoff) Next() time.Time {
+	return b.next
+}
+
+func (b *Backoff) jitterWait() time.Duration {
+	if b.try == 0 {
+		b.try++
+		if b.min <= 0 {
+			return 0
+		}
+		return time.Duration(rand.Int63n(int64(b.min)))
+	}
+	d := b.max
+	if b.try < 32 {
+		if exp := b.min << uint(b.try-1); exp > 0 && exp < b.max {
+			d = exp
+		}
+	}
+	b.try++
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
@@ -0,0 +1,51 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package pct_test
+
+import (
+	"github.com/percona/percona-agent/pct"
+	. "gopkg.in/check.v1"
+	"time"
+)
+
+/////////////////////////////////////////////////////////////////////////////
+// backoff.go test suite
+/////////////////////////////////////////////////////////////////////////////
+
+type BackoffTestSuite struct {
+}
+
+var _ = Suite(&BackoffTestSuite{})
+
+func (s *BackoffTestSuite) TestJitterBackoff(t *C) {
+	b := pct.NewJitterBackoff(2*time.Second, 10*time.Second, time.Minute)
+	now := time.Now()
+	b.NowFunc = func() time.Time { return now }
+
+	// First wait is random in [0, min).
+	d := b.Wait()
+	t.Check(d >= 0 && d < 2*time.Second, Equals, true, Commentf("%s", d))
+	t.Check(b.Next(), Equals, now.Add(d))
+
+	// Then [d/2, d] for d = 2s, 4s, 8s, 10s (max), 10s.
+	for _, max := range []time.Duration{2, 4, 8, 10, 10} {
+		max *= time.Second
+		d = b.Wait()
+		t.Check(d >= max/2 && d <= max, Equals, true, Commentf("%s not in [%s, %s]", d, max/2, max))
+	}
+}
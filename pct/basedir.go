@@ -18,68 +18,143 @@
 package pct
 
 import (
+	"bytes"
+	"crypto/md5"
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"log"
 	"os"
 	"path/filepath"
+	"sort"
+	"sync"
 )
 
 const (
 	DEFAULT_BASEDIR    = "/usr/local/percona/percona-agent"
 	CONFIG_FILE_SUFFIX = ".conf"
 	// Relative to Basedir.path:
-	CONFIG_DIR   = "config"
-	DATA_DIR     = "data"
-	BIN_DIR      = "bin"
-	TRASH_DIR    = "trash"
-	START_LOCK   = "start.lock"
-	START_SCRIPT = "start.sh"
+	CONFIG_DIR    = "config"
+	DATA_DIR      = "data"
+	BIN_DIR       = "bin"
+	TRASH_DIR     = "trash"
+	START_LOCK    = "start.lock"
+	START_SCRIPT  = "start.sh"
+	CTL_SOCKET    = "percona-agent.sock"
+	DATA_SOCKET   = "percona-agent-data.sock"
+	AUDIT_LOG     = "audit.log"
+	REPLY_CACHE   = "reply-cache.json"
+	ANONYMIZE_KEY = "anonymize.key"
+	UPDATE_KEYS   = "update-keys.json"
+	HISTORY_DIR   = "history"
 )
 
+// Env vars that override the basedir and the BasedirLayout dirs, see EnvLayout.
+const (
+	ENV_BASEDIR    = "PCT_BASEDIR"
+	ENV_CONFIG_DIR = "PCT_CONFIG_DIR"
+	ENV_DATA_DIR   = "PCT_DATA_DIR"
+	ENV_LOG_DIR    = "PCT_LOG_DIR"
+	ENV_BIN_DIR    = "PCT_BIN_DIR"
+	ENV_SPOOL_DIR  = "PCT_SPOOL_DIR"
+)
+
+// A BasedirLayout puts agent dirs outside the basedir, e.g. configs in /etc,
+// state in /var/lib, and logs in /var/log for OS packages.  An empty dir is
+// in the basedir like the default layout.
+type BasedirLayout struct {
+	ConfigDir string // *.conf files, default basedir/config
+	DataDir   string // state store, history, trash; default basedir
+	LogDir    string // log files with a relative path, default basedir
+	BinDir    string // default basedir/bin
+	SpoolDir  string // data spool, default basedir/data
+}
+
+// EnvLayout returns the layout set by the PCT_*_DIR env vars.
+func EnvLayout() BasedirLayout {
+	return BasedirLayout{
+		ConfigDir: os.Getenv(ENV_CONFIG_DIR),
+		DataDir:   os.Getenv(ENV_DATA_DIR),
+		LogDir:    os.Getenv(ENV_LOG_DIR),
+		BinDir:    os.Getenv(ENV_BIN_DIR),
+		SpoolDir:  os.Getenv(ENV_SPOOL_DIR),
+	}
+}
+
+// EnvBasedir returns the PCT_BASEDIR env var, else defaultDir.
+func EnvBasedir(defaultDir string) string {
+	if dir := os.Getenv(ENV_BASEDIR); dir != "" {
+		return dir
+	}
+	return defaultDir
+}
+
 type basedir struct {
 	path      string
 	configDir string
 	dataDir   string
+	logDir    string
 	binDir    string
+	spoolDir  string
 	trashDir  string
+	// MD5 of config files as last read or written by the agent, see ChangedConfigs
+	digests    map[string]string
+	digestsMux sync.Mutex
+	// Secrets split out of configs, see SeparateCredentials
+	creds         *Credentials
+	separateCreds bool
+	credsMux      sync.Mutex
+	// State store in the data dir, opened by Store
+	store    *Store
+	storeMux sync.Mutex
 }
 
 var Basedir basedir
 
+// Init initializes the basedir at path with the layout set by the env vars,
+// see EnvLayout.
 func (b *basedir) Init(path string) error {
+	return b.InitLayout(path, EnvLayout())
+}
+
+// InitLayout initializes the basedir at path with the given layout, creating
+// the dirs that do not exist.
+func (b *basedir) InitLayout(path string, layout BasedirLayout) error {
 	var err error
 	b.path, err = filepath.Abs(path)
 	if err != nil {
 		return err
 	}
-
-	if err := MakeDir(b.path); err != nil && !os.IsExist(err) {
+	if err := b.CloseStore(); err != nil {
 		return err
 	}
 
-	b.configDir = filepath.Join(b.path, CONFIG_DIR)
-	if err := MakeDir(b.configDir); err != nil && !os.IsExist(err) {
-		return err
-	}
-	if err := os.Chmod(b.configDir, 0700); err != nil {
+	if err := MakeDir(b.path); err != nil && !os.IsExist(err) {
 		return err
 	}
 
-	b.dataDir = filepath.Join(b.path, DATA_DIR)
-	if err := MakeDir(b.dataDir); err != nil && !os.IsExist(err) {
+	dirs, err := b.layoutDirs(layout)
+	if err != nil {
 		return err
 	}
-
-	b.binDir = filepath.Join(b.path, BIN_DIR)
-	if err := MakeDir(b.binDir); err != nil && !os.IsExist(err) {
+	b.configDir = dirs.ConfigDir
+	b.dataDir = dirs.DataDir
+	b.logDir = dirs.LogDir
+	b.binDir = dirs.BinDir
+	b.spoolDir = dirs.SpoolDir
+	b.trashDir = filepath.Join(b.dataDir, TRASH_DIR)
+	if err := b.makeDirs(); err != nil {
 		return err
 	}
+	b.setCredentials()
 
-	b.trashDir = filepath.Join(b.path, TRASH_DIR)
-	if err := MakeDir(b.trashDir); err != nil && !os.IsExist(err) {
+	digests, err := b.configDigests()
+	if err != nil {
 		return err
 	}
+	b.digestsMux.Lock()
+	b.digests = digests
+	b.digestsMux.Unlock()
 
 	return nil
 }
@@ -88,14 +163,29 @@ func (b *basedir) Path() string {
 	return b.path
 }
 
+// Layout returns the absolute dirs of the current layout.
+func (b *basedir) Layout() BasedirLayout {
+	return BasedirLayout{
+		ConfigDir: b.configDir,
+		DataDir:   b.dataDir,
+		LogDir:    b.logDir,
+		BinDir:    b.binDir,
+		SpoolDir:  b.spoolDir,
+	}
+}
+
 func (b *basedir) Dir(service string) string {
 	switch service {
 	case "config":
 		return b.configDir
 	case "data":
 		return b.dataDir
+	case "log":
+		return b.logDir
 	case "bin":
 		return b.binDir
+	case "spool":
+		return b.spoolDir
 	case "trash":
 		return b.trashDir
 	default:
@@ -104,15 +194,20 @@ func (b *basedir) Dir(service string) string {
 	return ""
 }
 
+// ConfigFile returns the config file of service in any format, see
+// FindConfigFile.  The file need not exist: configs are in the store unless
+// they have a file, see ReadConfig.
 func (b *basedir) ConfigFile(service string) string {
-	return filepath.Join(b.configDir, service+CONFIG_FILE_SUFFIX)
+	return FindConfigFile(b.configDir, service)
 }
 
+// ReadConfig decodes the config of service into v.  Configs are in the store,
+// but a config file, e.g. written by hand or by config management, overrides
+// the config in the store and is written in place by WriteConfig.  If service
+// has no config, the error is os.IsNotExist.
 func (b *basedir) ReadConfig(service string, v interface{}) error {
-	configFile := filepath.Join(b.configDir, service+CONFIG_FILE_SUFFIX)
-	data, err := ioutil.ReadFile(configFile)
-	if err != nil && !os.IsNotExist(err) {
-		// There's an error and it's not "file not found".
+	data, err := b.ConfigData(service)
+	if err != nil {
 		return err
 	}
 	if len(data) > 0 {
@@ -121,23 +216,259 @@ func (b *basedir) ReadConfig(service string, v interface{}) error {
 	return err
 }
 
+// ConfigData returns the config of service as JSON with its credential
+// references resolved, see ReadConfig.
+func (b *basedir) ConfigData(service string) ([]byte, error) {
+	data, source, err := b.configJSON(service, true)
+	if err != nil {
+		return nil, err
+	}
+	if data, err = b.credentials().Resolve(data); err != nil {
+		return nil, fmt.Errorf("%s: %s", source, err)
+	}
+	return data, nil
+}
+
+// ConfigExists returns true if service has a config, see ReadConfig.
+func (b *basedir) ConfigExists(service string) bool {
+	if FileExists(b.ConfigFile(service)) {
+		return true
+	}
+	store, err := b.Store()
+	if err != nil {
+		return false
+	}
+	var v json.RawMessage
+	found, _ := store.Get(STORE_CONFIGS, service, &v)
+	return found
+}
+
+// ConfigNames returns the names of the configs that match pattern, e.g.
+// "mm-*", in the store or with a config file, sorted.
+func (b *basedir) ConfigNames(pattern string) ([]string, error) {
+	store, err := b.Store()
+	if err != nil {
+		return nil, err
+	}
+	names := []string{}
+	seen := make(map[string]bool)
+	err = store.View(func(tx *StoreTx) error {
+		for _, name := range tx.Keys(STORE_CONFIGS) {
+			if ok, _ := filepath.Match(pattern, name); ok {
+				names = append(names, name)
+				seen[name] = true
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	files, err := GlobConfigFiles(b.configDir, pattern)
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		if name := ConfigName(file); !seen[name] {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// configJSON returns the config of service as JSON with its credential
+// references, and where it is for errors: the config file or the store.  If
+// digest is true, the digest of the config file is set, see ChangedConfigs.
+func (b *basedir) configJSON(service string, digest bool) ([]byte, string, error) {
+	// Open the store first: it imports old config files, see importConfigFiles.
+	store, err := b.Store()
+	if err != nil {
+		return nil, "", err
+	}
+	configFile := b.ConfigFile(service)
+	data, err := ioutil.ReadFile(configFile)
+	if err == nil {
+		if digest {
+			b.setDigest(service, data)
+		}
+		if data, err = ConfigToJSON(data, ConfigFormat(configFile)); err != nil {
+			return nil, configFile, fmt.Errorf("%s: %s", configFile, err)
+		}
+		return data, configFile, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, configFile, err
+	}
+	source := STORE_CONFIGS + "/" + service
+	var v json.RawMessage
+	found, err := store.Get(STORE_CONFIGS, service, &v)
+	if err != nil {
+		return nil, source, err
+	}
+	if !found {
+		return nil, source, &os.PathError{Op: "open", Path: configFile, Err: os.ErrNotExist}
+	}
+	return v, source, nil
+}
+
+// WriteConfig writes the config of service to the store, or to its config file
+// in the format of the file if it has one, see ReadConfig and EncodeConfig.
 func (b *basedir) WriteConfig(service string, config interface{}) error {
-	configFile := filepath.Join(b.configDir, service+CONFIG_FILE_SUFFIX)
-	data, err := json.MarshalIndent(config, "", "    ")
+	b.credsMux.Lock()
+	separate := b.separateCreds
+	b.credsMux.Unlock()
+	configFile := b.ConfigFile(service)
+	if separate || !FileExists(configFile) {
+		data, err := json.Marshal(config)
+		if err != nil {
+			return err
+		}
+		return b.writeConfigJSON(service, data, separate)
+	}
+	data, err := EncodeConfig(config, ConfigFormat(configFile))
 	if err != nil {
 		return err
 	}
-	return ioutil.WriteFile(configFile, data, 0600)
+	if err := WriteFile(configFile, data, 0600); err != nil {
+		return err
+	}
+	b.setDigest(service, data)
+	return nil
 }
 
+// WriteConfigString writes the JSON config of service like WriteConfig.
 func (b *basedir) WriteConfigString(service, config string) error {
-	configFile := filepath.Join(b.configDir, service+CONFIG_FILE_SUFFIX)
-	return ioutil.WriteFile(configFile, []byte(config), 0600)
+	b.credsMux.Lock()
+	separate := b.separateCreds
+	b.credsMux.Unlock()
+	return b.writeConfigJSON(service, []byte(config), separate)
 }
 
+// writeConfigJSON writes the JSON config of service like WriteConfig, first
+// moving its secrets to the credentials if separate is true.
+func (b *basedir) writeConfigJSON(service string, config []byte, separate bool) error {
+	var m map[string]interface{} // config without secrets
+	if separate && hasCredentials(service) {
+		m = map[string]interface{}{}
+		if err := json.Unmarshal(config, &m); err != nil {
+			return err
+		}
+		creds := b.credentials()
+		for name, secret := range SplitCredentials(service, m) {
+			if err := creds.Set(name, secret); err != nil {
+				return err
+			}
+		}
+	}
+	configFile := b.ConfigFile(service)
+	if !FileExists(configFile) {
+		var v json.RawMessage = config
+		if m != nil {
+			data, err := json.Marshal(m)
+			if err != nil {
+				return err
+			}
+			v = data
+		}
+		store, err := b.Store()
+		if err != nil {
+			return err
+		}
+		return store.Put(STORE_CONFIGS, service, &v)
+	}
+	var data []byte
+	var err error
+	if m != nil {
+		data, err = EncodeConfig(m, ConfigFormat(configFile))
+	} else {
+		data, err = jsonToConfig(config, ConfigFormat(configFile))
+	}
+	if err != nil {
+		return err
+	}
+	if err := WriteFile(configFile, data, 0600); err != nil {
+		return err
+	}
+	b.setDigest(service, data)
+	return nil
+}
+
+// SeparateCredentials enables or disables keeping secrets (API keys and MySQL
+// passwords) in the credentials file (or keyring) instead of configs, where
+// they are replaced by references like {credentials:agent.ApiKey}.  Configs
+// in the store and config files are rewritten as needed: enabling moves their
+// secrets out, disabling puts them back.
+func (b *basedir) SeparateCredentials(enabled bool) error {
+	b.credsMux.Lock()
+	b.separateCreds = enabled
+	b.credsMux.Unlock()
+
+	names, err := b.ConfigNames("*")
+	if err != nil {
+		return err
+	}
+	creds := b.credentials()
+	for _, service := range names {
+		data, source, err := b.configJSON(service, false)
+		if err != nil {
+			return err
+		}
+		hasRefs := bytes.Contains(data, []byte(CREDENTIAL_REF_PREFIX))
+		if (enabled && !hasCredentials(service)) || (!enabled && !hasRefs) {
+			continue
+		}
+		if enabled {
+			m := map[string]interface{}{}
+			if err := json.Unmarshal(data, &m); err != nil {
+				return fmt.Errorf("%s: %s", source, err)
+			}
+			if len(SplitCredentials(service, m)) == 0 {
+				continue // no plaintext secrets
+			}
+		} else if data, err = creds.Resolve(data); err != nil {
+			return fmt.Errorf("%s: %s", source, err)
+		}
+		if err := b.writeConfigJSON(service, data, enabled); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// credentials returns the credentials in the current config dir.
+func (b *basedir) credentials() *Credentials {
+	b.credsMux.Lock()
+	defer b.credsMux.Unlock()
+	return b.creds
+}
+
+func (b *basedir) setCredentials() {
+	b.credsMux.Lock()
+	defer b.credsMux.Unlock()
+	b.creds = NewCredentials(filepath.Join(b.configDir, CREDENTIALS_FILE), os.Getenv(ENV_KEYRING_CMD))
+}
+
+// RemoveConfig removes the config of service from the store and its config
+// file, if any.
 func (b *basedir) RemoveConfig(service string) error {
-	configFile := filepath.Join(b.configDir, service+CONFIG_FILE_SUFFIX)
-	return RemoveFile(configFile)
+	store, err := b.Store()
+	if err != nil {
+		return err
+	}
+	err = store.Update(func(tx *StoreTx) error {
+		return tx.Delete(STORE_CONFIGS, service)
+	})
+	if err != nil {
+		return err
+	}
+	if err := RemoveFile(b.ConfigFile(service)); err != nil {
+		return err
+	}
+	b.digestsMux.Lock()
+	delete(b.digests, service)
+	b.digestsMux.Unlock()
+	return nil
 }
 
 func (b *basedir) File(file string) string {
@@ -146,8 +477,262 @@ func (b *basedir) File(file string) string {
 		file = START_LOCK
 	case "start-script":
 		file = START_SCRIPT
+	case "ctl-socket":
+		file = CTL_SOCKET
+	case "data-socket":
+		file = DATA_SOCKET
+	case "audit-log":
+		return filepath.Join(b.dataDir, AUDIT_LOG)
+	case "reply-cache":
+		return filepath.Join(b.dataDir, REPLY_CACHE)
+	case "anonymize-key":
+		return filepath.Join(b.dataDir, ANONYMIZE_KEY)
+	case "update-keys":
+		return filepath.Join(b.dataDir, UPDATE_KEYS)
+	case "history":
+		return filepath.Join(b.dataDir, HISTORY_DIR)
+	case "store":
+		return filepath.Join(b.dataDir, STORE_FILE)
 	default:
 		log.Panicf("Unknown basedir file: %s", file)
 	}
 	return filepath.Join(b.Path(), file)
 }
+
+// Relocate moves the configs, state files, bin dir, and data spool from the
+// current layout to the new layout, then uses it.  Log files are not moved:
+// the agent opens new ones in the new log dir.  The agent must not be running,
+// and the new layout must be set (e.g. by the env vars) on the next start.
+func (b *basedir) Relocate(layout BasedirLayout) error {
+	dirs, err := b.layoutDirs(layout)
+	if err != nil {
+		return err
+	}
+	// The store is moved, so it must be closed.  Store reopens it.
+	if err := b.CloseStore(); err != nil {
+		return err
+	}
+	old := b.Layout()
+	oldTrashDir := b.trashDir
+	b.configDir = dirs.ConfigDir
+	b.dataDir = dirs.DataDir
+	b.logDir = dirs.LogDir
+	b.binDir = dirs.BinDir
+	b.spoolDir = dirs.SpoolDir
+	b.trashDir = filepath.Join(b.dataDir, TRASH_DIR)
+	if err := b.makeDirs(); err != nil {
+		return err
+	}
+
+	// Whole dirs.  The old ones are removed if empty.
+	moves := [][2]string{
+		{old.ConfigDir, b.configDir},
+		{old.BinDir, b.binDir},
+		{old.SpoolDir, b.spoolDir},
+		{oldTrashDir, b.trashDir},
+	}
+	for _, m := range moves {
+		if err := moveDir(m[0], m[1]); err != nil {
+			return err
+		}
+	}
+	b.setCredentials() // moved with the config dir
+
+	// State files.  The data dir is the basedir by default, so only these
+	// files are moved.  The files the store replaced are moved, too, in case
+	// they are not imported yet (audit.log.1, etc. with the rotated audit logs).
+	if old.DataDir != b.dataDir {
+		for _, file := range []string{STORE_FILE, HISTORY_DIR, AUDIT_LOG, REPLY_CACHE, ANONYMIZE_KEY, UPDATE_KEYS} {
+			files, err := filepath.Glob(filepath.Join(old.DataDir, file) + "*")
+			if err != nil {
+				return err
+			}
+			for _, oldFile := range files {
+				if err := moveFile(oldFile, filepath.Join(b.dataDir, filepath.Base(oldFile))); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// Store returns the state store in the data dir, opening it the first time,
+// see OpenStore.
+func (b *basedir) Store() (*Store, error) {
+	b.storeMux.Lock()
+	defer b.storeMux.Unlock()
+	if b.store == nil {
+		store, err := OpenStore(filepath.Join(b.dataDir, STORE_FILE), b.configDir)
+		if err != nil {
+			return nil, err
+		}
+		b.store = store
+		// Config files imported by the store were not removed by hand.
+		digests, err := b.configDigests()
+		if err != nil {
+			return nil, err
+		}
+		b.digestsMux.Lock()
+		b.digests = digests
+		b.digestsMux.Unlock()
+	}
+	return b.store, nil
+}
+
+// CloseStore closes the state store if it's open.  The next call to Store
+// opens it again.
+func (b *basedir) CloseStore() error {
+	b.storeMux.Lock()
+	defer b.storeMux.Unlock()
+	if b.store == nil {
+		return nil
+	}
+	err := b.store.Close()
+	b.store = nil
+	return err
+}
+
+// layoutDirs returns the absolute dirs of layout, defaulting to the basedir.
+func (b *basedir) layoutDirs(layout BasedirLayout) (BasedirLayout, error) {
+	dirs := BasedirLayout{
+		ConfigDir: filepath.Join(b.path, CONFIG_DIR),
+		DataDir:   b.path,
+		LogDir:    b.path,
+		BinDir:    filepath.Join(b.path, BIN_DIR),
+		SpoolDir:  filepath.Join(b.path, DATA_DIR),
+	}
+	for _, d := range []struct {
+		dir  string
+		into *string
+	}{
+		{layout.ConfigDir, &dirs.ConfigDir},
+		{layout.DataDir, &dirs.DataDir},
+		{layout.LogDir, &dirs.LogDir},
+		{layout.BinDir, &dirs.BinDir},
+		{layout.SpoolDir, &dirs.SpoolDir},
+	} {
+		if d.dir == "" {
+			continue
+		}
+		dir, err := filepath.Abs(d.dir)
+		if err != nil {
+			return dirs, err
+		}
+		*d.into = dir
+	}
+	return dirs, nil
+}
+
+func (b *basedir) makeDirs() error {
+	for _, dir := range []string{b.configDir, b.dataDir, b.logDir, b.binDir, b.spoolDir, b.trashDir} {
+		if err := MakeDir(dir); err != nil && !os.IsExist(err) {
+			return err
+		}
+	}
+	// Configs have API keys and MySQL passwords.
+	return os.Chmod(b.configDir, 0700)
+}
+
+// moveDir moves the files in oldDir to newDir, then removes oldDir if empty.
+func moveDir(oldDir, newDir string) error {
+	if oldDir == newDir {
+		return nil
+	}
+	files, err := ioutil.ReadDir(oldDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	for _, fi := range files {
+		if err := moveFile(filepath.Join(oldDir, fi.Name()), filepath.Join(newDir, fi.Name())); err != nil {
+			return err
+		}
+	}
+	os.Remove(oldDir) // fails if not empty, e.g. new dir is a subdir
+	return nil
+}
+
+// moveFile renames oldFile to newFile, or copies and removes it if they are on
+// different file systems, e.g. /usr/local and /var.  Dirs are moved recursively.
+func moveFile(oldFile, newFile string) error {
+	if err := os.Rename(oldFile, newFile); err == nil {
+		return nil
+	}
+	fi, err := os.Stat(oldFile)
+	if err != nil {
+		return err
+	}
+	if fi.IsDir() {
+		if err := os.MkdirAll(newFile, fi.Mode().Perm()); err != nil {
+			return err
+		}
+		return moveDir(oldFile, newFile)
+	}
+	data, err := ioutil.ReadFile(oldFile)
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(newFile, data, fi.Mode().Perm()); err != nil {
+		return err
+	}
+	return os.Remove(oldFile)
+}
+
+// ChangedConfigs returns the names of config files (e.g. "agent", "mm-mysql-1")
+// changed, added, or removed since they were last read or written by the agent,
+// or since the previous call, i.e. changed by hand.  The agent reloads these on
+// SIGHUP.  Configs in the store are changed only by the agent.
+func (b *basedir) ChangedConfigs() ([]string, error) {
+	digests, err := b.configDigests()
+	if err != nil {
+		return nil, err
+	}
+	b.digestsMux.Lock()
+	defer b.digestsMux.Unlock()
+	changed := []string{}
+	for name, digest := range digests {
+		if b.digests[name] != digest {
+			changed = append(changed, name)
+		}
+	}
+	for name, _ := range b.digests {
+		if _, ok := digests[name]; !ok {
+			changed = append(changed, name)
+		}
+	}
+	sort.Strings(changed)
+	b.digests = digests
+	return changed, nil
+}
+
+func (b *basedir) configDigests() (map[string]string, error) {
+	files, err := GlobConfigFiles(b.configDir, "*")
+	if err != nil {
+		return nil, err
+	}
+	digests := make(map[string]string)
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue // removed while globbing
+			}
+			return nil, err
+		}
+		name := ConfigName(file)
+		digests[name] = fmt.Sprintf("%x", md5.Sum(data))
+	}
+	return digests, nil
+}
+
+func (b *basedir) setDigest(service string, data []byte) {
+	b.digestsMux.Lock()
+	defer b.digestsMux.Unlock()
+	if b.digests == nil {
+		b.digests = make(map[string]string)
+	}
+	b.digests[service] = fmt.Sprintf("%x", md5.Sum(data))
+}
@@ -0,0 +1,288 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package pct_test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/percona/percona-agent/pct"
+	. "gopkg.in/check.v1"
+)
+
+type BasedirTestSuite struct {
+	tmpDir string
+}
+
+var _ = Suite(&BasedirTestSuite{})
+
+func (s *BasedirTestSuite) SetUpTest(t *C) {
+	var err error
+	s.tmpDir, err = ioutil.TempDir("", "basedir-test-")
+	t.Assert(err, IsNil)
+}
+
+func (s *BasedirTestSuite) TearDownTest(t *C) {
+	if err := os.RemoveAll(s.tmpDir); err != nil {
+		t.Error(err)
+	}
+}
+
+func (s *BasedirTestSuite) TestDefaultLayout(t *C) {
+	basedir := filepath.Join(s.tmpDir, "agent")
+	err := pct.Basedir.InitLayout(basedir, pct.BasedirLayout{})
+	t.Assert(err, IsNil)
+	t.Check(pct.Basedir.Layout(), Equals, pct.BasedirLayout{
+		ConfigDir: filepath.Join(basedir, "config"),
+		DataDir:   basedir,
+		LogDir:    basedir,
+		BinDir:    filepath.Join(basedir, "bin"),
+		SpoolDir:  filepath.Join(basedir, "data"),
+	})
+	t.Check(pct.Basedir.Dir("trash"), Equals, filepath.Join(basedir, "trash"))
+	t.Check(pct.Basedir.File("audit-log"), Equals, filepath.Join(basedir, "audit.log"))
+}
+
+func (s *BasedirTestSuite) TestRelocate(t *C) {
+	basedir := filepath.Join(s.tmpDir, "agent")
+	err := pct.Basedir.InitLayout(basedir, pct.BasedirLayout{})
+	t.Assert(err, IsNil)
+
+	// Some state in the default layout.
+	err = pct.Basedir.WriteConfigString("agent", "{}")
+	t.Assert(err, IsNil)
+	qanDir := filepath.Join(pct.Basedir.Dir("spool"), "qan")
+	t.Assert(os.Mkdir(qanDir, 0755), IsNil)
+	t.Assert(ioutil.WriteFile(filepath.Join(qanDir, "1"), []byte("data"), 0644), IsNil)
+	t.Assert(ioutil.WriteFile(pct.Basedir.File("audit-log"), []byte("cmd"), 0644), IsNil)
+	t.Assert(ioutil.WriteFile(pct.Basedir.File("audit-log")+".1", []byte("cmd"), 0644), IsNil)
+
+	layout := pct.BasedirLayout{
+		ConfigDir: filepath.Join(s.tmpDir, "etc"),
+		DataDir:   filepath.Join(s.tmpDir, "lib"),
+		SpoolDir:  filepath.Join(s.tmpDir, "lib", "spool"),
+	}
+	err = pct.Basedir.Relocate(layout)
+	t.Assert(err, IsNil)
+
+	t.Check(pct.Basedir.Dir("config"), Equals, layout.ConfigDir)
+	t.Check(pct.Basedir.Dir("log"), Equals, basedir) // not set, so not moved
+	for _, file := range []string{
+		filepath.Join(layout.DataDir, pct.STORE_FILE),
+		filepath.Join(layout.SpoolDir, "qan", "1"),
+		filepath.Join(layout.DataDir, "audit.log"),
+		filepath.Join(layout.DataDir, "audit.log.1"),
+		filepath.Join(layout.DataDir, "trash"),
+	} {
+		t.Check(pct.FileExists(file), Equals, true, Commentf(file))
+	}
+	for _, file := range []string{
+		filepath.Join(basedir, "config"),
+		filepath.Join(basedir, "data"),
+		filepath.Join(basedir, "trash"),
+		filepath.Join(basedir, "audit.log"),
+	} {
+		t.Check(pct.FileExists(file), Equals, false, Commentf(file))
+	}
+
+	// Configs are still read, and not changed by hand.
+	t.Check(pct.Basedir.ConfigExists("agent"), Equals, true)
+	changed, err := pct.Basedir.ChangedConfigs()
+	t.Assert(err, IsNil)
+	t.Check(changed, DeepEquals, []string{})
+}
+
+func (s *BasedirTestSuite) TestConfigFormats(t *C) {
+	basedir := filepath.Join(s.tmpDir, "agent")
+	err := pct.Basedir.InitLayout(basedir, pct.BasedirLayout{})
+	t.Assert(err, IsNil)
+	configDir := pct.Basedir.Dir("config")
+
+	type config struct {
+		Level    string
+		Interval uint
+		Hosts    []string `json:",omitempty"`
+	}
+
+	files := []struct {
+		format  string
+		suffix  string
+		content string
+	}{
+		{"yaml", ".yml", "level: info\ninterval: 60\nhosts:\n  - db1\n  - db2\n"},
+		{"toml", ".toml", "Level = \"info\"\nInterval = 60\nHosts = [\"db1\", \"db2\"]\n"},
+	}
+	for _, f := range files {
+		format := f.format
+		name := "log-" + format
+		file := filepath.Join(configDir, name+f.suffix)
+		t.Assert(ioutil.WriteFile(file, []byte(f.content), 0600), IsNil)
+		t.Check(pct.Basedir.ConfigFile(name), Equals, file)
+
+		// Read like JSON: keys are case-insensitive.
+		got := config{}
+		err := pct.Basedir.ReadConfig(name, &got)
+		t.Assert(err, IsNil, Commentf(format))
+		t.Check(got, DeepEquals, config{Level: "info", Interval: 60, Hosts: []string{"db1", "db2"}}, Commentf(format))
+
+		// Written in the same format.
+		got.Level = "warning"
+		got.Hosts = nil
+		err = pct.Basedir.WriteConfig(name, got)
+		t.Assert(err, IsNil)
+		t.Check(pct.ConfigFormat(pct.Basedir.ConfigFile(name)), Equals, format)
+		t.Check(pct.FileExists(filepath.Join(configDir, name+".conf")), Equals, false)
+		reread := config{}
+		err = pct.Basedir.ReadConfig(name, &reread)
+		t.Assert(err, IsNil, Commentf(format))
+		t.Check(reread, DeepEquals, config{Level: "warning", Interval: 60}, Commentf(format))
+	}
+
+	globbed, err := pct.GlobConfigFiles(configDir, "log-*")
+	t.Assert(err, IsNil)
+	t.Check(globbed, DeepEquals, []string{filepath.Join(configDir, "log-toml.toml"), filepath.Join(configDir, "log-yaml.yml")})
+}
+
+func (s *BasedirTestSuite) TestConfigStore(t *C) {
+	basedir := filepath.Join(s.tmpDir, "agent")
+	err := pct.Basedir.InitLayout(basedir, pct.BasedirLayout{})
+	t.Assert(err, IsNil)
+	configDir := pct.Basedir.Dir("config")
+
+	type config struct {
+		Level string
+	}
+
+	// No config is a not-exist error like a missing file.
+	got := config{}
+	err = pct.Basedir.ReadConfig("log", &got)
+	t.Check(os.IsNotExist(err), Equals, true)
+	t.Check(pct.Basedir.ConfigExists("log"), Equals, false)
+
+	// Configs are written to the store, not files.
+	err = pct.Basedir.WriteConfig("log", config{Level: "info"})
+	t.Assert(err, IsNil)
+	err = pct.Basedir.WriteConfigString("log-mysql-1", `{"Level":"debug"}`)
+	t.Assert(err, IsNil)
+	t.Check(pct.Basedir.ConfigExists("log"), Equals, false)
+	t.Check(pct.Basedir.ConfigExists("log"), Equals, true)
+	err = pct.Basedir.ReadConfig("log-mysql-1", &got)
+	t.Assert(err, IsNil)
+	t.Check(got.Level, Equals, "debug")
+
+	// A config file overrides the store, and is written in place.
+	file := filepath.Join(configDir, "log.yml")
+	t.Assert(ioutil.WriteFile(file, []byte("level: warning\n"), 0600), IsNil)
+	err = pct.Basedir.ReadConfig("log", &got)
+	t.Assert(err, IsNil)
+	t.Check(got.Level, Equals, "warning")
+	err = pct.Basedir.WriteConfig("log", config{Level: "error"})
+	t.Assert(err, IsNil)
+	data, err := ioutil.ReadFile(file)
+	t.Assert(err, IsNil)
+	t.Check(string(data), Matches, `(?s).*error.*`)
+
+	names, err := pct.Basedir.ConfigNames("log*")
+	t.Assert(err, IsNil)
+	t.Check(names, DeepEquals, []string{"log", "log-mysql-1"})
+
+	// Removed from both.
+	err = pct.Basedir.RemoveConfig("log")
+	t.Assert(err, IsNil)
+	t.Check(pct.FileExists(file), Equals, false)
+	t.Check(pct.Basedir.ConfigExists("log"), Equals, false)
+	names, err = pct.Basedir.ConfigNames("*")
+	t.Assert(err, IsNil)
+	t.Check(names, DeepEquals, []string{"log-mysql-1"})
+}
+
+func (s *BasedirTestSuite) TestSeparateCredentials(t *C) {
+	basedir := filepath.Join(s.tmpDir, "agent")
+	err := pct.Basedir.InitLayout(basedir, pct.BasedirLayout{})
+	t.Assert(err, IsNil)
+	defer pct.Basedir.SeparateCredentials(false)
+
+	type agentConfig struct {
+		ApiHostname string
+		ApiKey      string
+	}
+	type mysqlConfig struct {
+		Id  uint
+		DSN string
+	}
+	agent := agentConfig{ApiHostname: "cloud-api.percona.com", ApiKey: "s3cr3t\"key"}
+	mysql := mysqlConfig{Id: 1, DSN: "percona:p@ss:w0rd@tcp(127.0.0.1:3306)/"}
+	t.Assert(pct.Basedir.WriteConfig("agent", agent), IsNil)
+	t.Assert(pct.Basedir.WriteConfig("mysql-1", mysql), IsNil)
+
+	// Enabling moves the secrets from existing configs to the credentials file.
+	err = pct.Basedir.SeparateCredentials(true)
+	t.Assert(err, IsNil)
+
+	credsFile := filepath.Join(pct.Basedir.Dir("config"), pct.CREDENTIALS_FILE)
+	fi, err := os.Stat(credsFile)
+	t.Assert(err, IsNil)
+	t.Check(fi.Mode().Perm(), Equals, os.FileMode(0600))
+
+	data, err := storedConfig("agent")
+	t.Assert(err, IsNil)
+	t.Check(string(data), Not(Matches), `(?s).*s3cr3t.*`)
+	t.Check(string(data), Matches, `(?s).*\{credentials:agent.ApiKey\}.*`)
+	data, err = storedConfig("mysql-1")
+	t.Assert(err, IsNil)
+	t.Check(string(data), Not(Matches), `(?s).*w0rd.*`)
+
+	// Configs are read with the secrets.
+	gotAgent := agentConfig{}
+	t.Assert(pct.Basedir.ReadConfig("agent", &gotAgent), IsNil)
+	t.Check(gotAgent, Equals, agent)
+	gotMySQL := mysqlConfig{}
+	t.Assert(pct.Basedir.ReadConfig("mysql-1", &gotMySQL), IsNil)
+	t.Check(gotMySQL, Equals, mysql)
+
+	// New secrets are written to the credentials file too.
+	agent.ApiKey = "n3w"
+	t.Assert(pct.Basedir.WriteConfig("agent", agent), IsNil)
+	data, err = storedConfig("agent")
+	t.Assert(err, IsNil)
+	t.Check(string(data), Not(Matches), `(?s).*n3w.*`)
+	t.Assert(pct.Basedir.ReadConfig("agent", &gotAgent), IsNil)
+	t.Check(gotAgent.ApiKey, Equals, "n3w")
+
+	// Disabling puts them back.
+	err = pct.Basedir.SeparateCredentials(false)
+	t.Assert(err, IsNil)
+	data, err = storedConfig("mysql-1")
+	t.Assert(err, IsNil)
+	t.Check(string(data), Matches, `(?s).*p@ss:w0rd.*`)
+}
+
+// storedConfig returns the config in the store, as written.
+func storedConfig(name string) ([]byte, error) {
+	store, err := pct.Basedir.Store()
+	if err != nil {
+		return nil, err
+	}
+	var v json.RawMessage
+	if _, err := store.Get(pct.STORE_CONFIGS, name, &v); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
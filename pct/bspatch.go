@@ -0,0 +1,109 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package pct
+
+import (
+	"bytes"
+	"compress/bzip2"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// BSDIFF_MAGIC starts a bsdiff 4 patch, see Bspatch.
+const BSDIFF_MAGIC = "BSDIFF40"
+
+// Bspatch rejects a patch whose new size is more than BSPATCH_MAX_GROWTH
+// times the old size plus BSPATCH_MAX_EXTRA bytes.  The new size comes from
+// the patch header, which isn't checked until the patched binary's signature
+// is, so it cannot be trusted to allocate the new data.
+const (
+	BSPATCH_MAX_GROWTH = 4
+	BSPATCH_MAX_EXTRA  = 16 * 1024 * 1024
+)
+
+// Bspatch applies a bsdiff 4 patch to old and returns the new data.  The patch
+// is a 32 byte header (magic, control block length, diff block length, new
+// size) followed by three bzip2 blocks: control, diff, and extra.  Each
+// control entry is three ints: add x diff bytes to old bytes, copy y extra
+// bytes, then seek z bytes in old.
+func Bspatch(old, patch []byte) ([]byte, error) {
+	if len(patch) < 32 || string(patch[0:8]) != BSDIFF_MAGIC {
+		return nil, errors.New("Invalid patch: bad header")
+	}
+	ctrlLen := offtin(patch[8:16])
+	diffLen := offtin(patch[16:24])
+	newSize := offtin(patch[24:32])
+	// Lengths are checked against what's left so they can't overflow.
+	if ctrlLen < 0 || diffLen < 0 || newSize < 0 ||
+		ctrlLen > int64(len(patch))-32 || diffLen > int64(len(patch))-32-ctrlLen {
+		return nil, errors.New("Invalid patch: bad block lengths")
+	}
+	if maxSize := BSPATCH_MAX_GROWTH*int64(len(old)) + BSPATCH_MAX_EXTRA; newSize > maxSize {
+		return nil, fmt.Errorf("Invalid patch: new size %d exceeds maximum %d", newSize, maxSize)
+	}
+	ctrl := bzip2.NewReader(bytes.NewReader(patch[32 : 32+ctrlLen]))
+	diff := bzip2.NewReader(bytes.NewReader(patch[32+ctrlLen : 32+ctrlLen+diffLen]))
+	extra := bzip2.NewReader(bytes.NewReader(patch[32+ctrlLen+diffLen:]))
+
+	newData := make([]byte, newSize)
+	var oldPos, newPos int64
+	buf := make([]byte, 24)
+	for newPos < newSize {
+		if _, err := io.ReadFull(ctrl, buf); err != nil {
+			return nil, fmt.Errorf("Invalid patch: control block: %s", err)
+		}
+		x, y, z := offtin(buf[0:8]), offtin(buf[8:16]), offtin(buf[16:24])
+		if x < 0 || y < 0 || x > newSize-newPos || y > newSize-newPos-x {
+			return nil, errors.New("Invalid patch: bad control entry")
+		}
+
+		// Diff bytes are added to old bytes.
+		if _, err := io.ReadFull(diff, newData[newPos:newPos+x]); err != nil {
+			return nil, fmt.Errorf("Invalid patch: diff block: %s", err)
+		}
+		for i := int64(0); i < x; i++ {
+			if oldPos+i >= 0 && oldPos+i < int64(len(old)) {
+				newData[newPos+i] += old[oldPos+i]
+			}
+		}
+		newPos += x
+		oldPos += x
+
+		// Extra bytes are new.
+		if _, err := io.ReadFull(extra, newData[newPos:newPos+y]); err != nil {
+			return nil, fmt.Errorf("Invalid patch: extra block: %s", err)
+		}
+		newPos += y
+		oldPos += z
+	}
+	return newData, nil
+}
+
+// offtin decodes a bsdiff int: 8 bytes, little endian, the high bit of the
+// last byte is the sign.
+func offtin(buf []byte) int64 {
+	y := int64(buf[7] & 0x7f)
+	for i := 6; i >= 0; i-- {
+		y = y<<8 | int64(buf[i])
+	}
+	if buf[7]&0x80 != 0 {
+		y = -y
+	}
+	return y
+}
@@ -46,4 +46,7 @@ type WebsocketClient interface {
 	SendBytes(data []byte, timeout uint) error // send data (data/sender)
 	Recv(data interface{}, timeout uint) error // recv proto.Response (data/sender)
 	Send(data interface{}, timeout uint) error // send proto.LogEntry (log/relay)
+
+	// Compress Reply.Data larger than minSize bytes, 0 to disable:
+	SetCompression(minSize int)
 }
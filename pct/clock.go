@@ -0,0 +1,94 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package pct
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// CLOCK_SKEW_WARN is how far the local clock can be from the API clock before
+// the agent warns: QAN intervals and mm timestamps are misplaced by the skew.
+const CLOCK_SKEW_WARN = 5 * time.Second
+
+var (
+	clockOffset   time.Duration
+	clockMeasured time.Time
+	clockMux      = &sync.RWMutex{}
+)
+
+// MeasureClock sets the API clock offset, see ClockOffset, from apiTime, e.g.
+// the Date header, of a response to a request sent at t0 and received at t1.
+// The API time is taken midway between t0 and t1.  Date has one second
+// resolution, so the offset is rounded to seconds.  It returns the offset.
+func MeasureClock(apiTime, t0, t1 time.Time) time.Duration {
+	local := t0.Add(t1.Sub(t0) / 2)
+	offset := apiTime.Add(500 * time.Millisecond).Sub(local) // midway through apiTime's second
+	if offset < 0 {
+		offset = -((-offset + 500*time.Millisecond) / time.Second * time.Second)
+	} else {
+		offset = (offset + 500*time.Millisecond) / time.Second * time.Second
+	}
+	clockMux.Lock()
+	defer clockMux.Unlock()
+	clockOffset = offset
+	clockMeasured = t1
+	return offset
+}
+
+// ClockOffset returns the API clock minus the local clock: positive if the
+// local clock is behind.  It's zero until measured.  Reports include it so
+// the API can place data correctly on hosts with skewed clocks.
+func ClockOffset() time.Duration {
+	clockMux.RLock()
+	defer clockMux.RUnlock()
+	return clockOffset
+}
+
+// ClockMeasured returns when the clock offset was last measured, zero if never.
+func ClockMeasured() time.Time {
+	clockMux.RLock()
+	defer clockMux.RUnlock()
+	return clockMeasured
+}
+
+// ClockStatus returns the clock offset and when it was measured, e.g. "+7s
+// (skewed: local clock is behind the API) at 2015-03-01 12:00:00 UTC", or ""
+// if not measured.
+func ClockStatus() string {
+	clockMux.RLock()
+	defer clockMux.RUnlock()
+	if clockMeasured.IsZero() {
+		return ""
+	}
+	status := fmt.Sprintf("%+ds", int64(clockOffset/time.Second))
+	if ClockSkewed(clockOffset) {
+		if clockOffset > 0 {
+			status += " (skewed: local clock is behind the API)"
+		} else {
+			status += " (skewed: local clock is ahead of the API)"
+		}
+	}
+	return status + " at " + TimeString(clockMeasured)
+}
+
+// ClockSkewed returns true if the offset is more than CLOCK_SKEW_WARN.
+func ClockSkewed(offset time.Duration) bool {
+	return offset > CLOCK_SKEW_WARN || offset < -CLOCK_SKEW_WARN
+}
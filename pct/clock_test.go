@@ -0,0 +1,54 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package pct_test
+
+import (
+	"github.com/percona/percona-agent/pct"
+	. "gopkg.in/check.v1"
+	"strings"
+	"time"
+)
+
+type ClockTestSuite struct {
+}
+
+var _ = Suite(&ClockTestSuite{})
+
+func (s *ClockTestSuite) TestMeasureClock(t *C) {
+	t0 := time.Date(2015, 3, 1, 12, 0, 0, 0, time.UTC)
+	t1 := t0.Add(200 * time.Millisecond)
+
+	// API Date is t0 truncated to the second, so no skew.
+	offset := pct.MeasureClock(t0, t0, t1)
+	t.Check(offset, Equals, time.Duration(0))
+	t.Check(pct.ClockSkewed(offset), Equals, false)
+
+	// Local clock 7s behind the API.
+	offset = pct.MeasureClock(t0.Add(7*time.Second), t0, t1)
+	t.Check(offset, Equals, 7*time.Second)
+	t.Check(pct.ClockOffset(), Equals, 7*time.Second)
+	t.Check(pct.ClockSkewed(offset), Equals, true)
+	t.Check(strings.HasPrefix(pct.ClockStatus(), "+7s (skewed: local clock is behind the API) at "), Equals, true)
+
+	// Local clock 10s ahead of the API.
+	offset = pct.MeasureClock(t0.Add(-10*time.Second), t0, t1)
+	t.Check(offset, Equals, -10*time.Second)
+	t.Check(strings.HasPrefix(pct.ClockStatus(), "-10s (skewed: local clock is ahead of the API) at "), Equals, true)
+
+	pct.MeasureClock(t0, t0, t1)
+}
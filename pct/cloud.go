@@ -0,0 +1,191 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package pct
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Cloud metadata service URLs, variables for testing.
+var (
+	AwsMetadataURL   = "http://169.254.169.254/latest/meta-data"
+	GcpMetadataURL   = "http://metadata.google.internal/computeMetadata/v1/instance"
+	AzureMetadataURL = "http://169.254.169.254/metadata/instance?api-version=2017-08-01"
+)
+
+// CloudMetadata describes the cloud instance the agent runs on.  It's attached
+// to reports so cloud inventory dimensions are available without manual tags.
+type CloudMetadata struct {
+	Provider     string // aws, gcp, or azure
+	InstanceId   string
+	InstanceType string `json:",omitempty"`
+	Region       string `json:",omitempty"`
+	Zone         string `json:",omitempty"`
+}
+
+var (
+	cloudMux      = &sync.RWMutex{}
+	cloudMetadata *CloudMetadata
+)
+
+// DetectCloud queries the AWS, GCP, and Azure metadata services and saves
+// the first CloudMetadata found for CloudInstance.  It returns nil if the agent
+// is not running in a cloud or no service responds within timeout.  The agent
+// calls it once at startup.
+func DetectCloud(timeout time.Duration) *CloudMetadata {
+	// Metadata services are link-local, so never use a proxy.
+	client := &http.Client{Timeout: timeout, Transport: &http.Transport{}}
+	detectors := []func(*http.Client) (*CloudMetadata, error){
+		awsMetadata,
+		gcpMetadata,
+		azureMetadata,
+	}
+	c := make(chan *CloudMetadata, len(detectors))
+	for _, detect := range detectors {
+		go func(detect func(*http.Client) (*CloudMetadata, error)) {
+			m, err := detect(client)
+			if err != nil {
+				m = nil
+			}
+			c <- m
+		}(detect)
+	}
+	var m *CloudMetadata
+	for i := 0; i < len(detectors); i++ {
+		if found := <-c; found != nil && m == nil {
+			m = found
+		}
+	}
+	cloudMux.Lock()
+	cloudMetadata = m
+	cloudMux.Unlock()
+	return m
+}
+
+// CloudInstance returns the CloudMetadata saved by DetectCloud, or nil.
+func CloudInstance() *CloudMetadata {
+	cloudMux.RLock()
+	defer cloudMux.RUnlock()
+	return cloudMetadata
+}
+
+func awsMetadata(client *http.Client) (*CloudMetadata, error) {
+	get := func(path string) (string, error) {
+		return getMetadata(client, AwsMetadataURL+"/"+path, nil)
+	}
+	m := &CloudMetadata{Provider: "aws"}
+	var err error
+	if m.InstanceId, err = get("instance-id"); err != nil {
+		return nil, err
+	}
+	if m.InstanceType, err = get("instance-type"); err != nil {
+		return nil, err
+	}
+	if m.Zone, err = get("placement/availability-zone"); err != nil {
+		return nil, err
+	}
+	// us-east-1a -> us-east-1
+	m.Region = strings.TrimRight(m.Zone, "abcdefghijklmnopqrstuvwxyz")
+	return m, nil
+}
+
+func gcpMetadata(client *http.Client) (*CloudMetadata, error) {
+	header := map[string]string{"Metadata-Flavor": "Google"}
+	get := func(path string) (string, error) {
+		return getMetadata(client, GcpMetadataURL+"/"+path, header)
+	}
+	m := &CloudMetadata{Provider: "gcp"}
+	var err error
+	if m.InstanceId, err = get("id"); err != nil {
+		return nil, err
+	}
+	// projects/123/machineTypes/n1-standard-1 -> n1-standard-1
+	machineType, err := get("machine-type")
+	if err != nil {
+		return nil, err
+	}
+	m.InstanceType = machineType[strings.LastIndex(machineType, "/")+1:]
+	// projects/123/zones/us-central1-a -> us-central1-a
+	zone, err := get("zone")
+	if err != nil {
+		return nil, err
+	}
+	m.Zone = zone[strings.LastIndex(zone, "/")+1:]
+	if i := strings.LastIndex(m.Zone, "-"); i > 0 {
+		m.Region = m.Zone[:i]
+	}
+	return m, nil
+}
+
+func azureMetadata(client *http.Client) (*CloudMetadata, error) {
+	data, err := getMetadata(client, AzureMetadataURL, map[string]string{"Metadata": "true"})
+	if err != nil {
+		return nil, err
+	}
+	instance := struct {
+		Compute struct {
+			VmId     string
+			VmSize   string
+			Location string
+			Zone     string
+		}
+	}{}
+	if err := json.Unmarshal([]byte(data), &instance); err != nil {
+		return nil, err
+	}
+	if instance.Compute.VmId == "" {
+		return nil, fmt.Errorf("No vmId in Azure metadata")
+	}
+	m := &CloudMetadata{
+		Provider:     "azure",
+		InstanceId:   instance.Compute.VmId,
+		InstanceType: instance.Compute.VmSize,
+		Region:       instance.Compute.Location,
+		Zone:         instance.Compute.Zone,
+	}
+	return m, nil
+}
+
+func getMetadata(client *http.Client, url string, header map[string]string) (string, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return "", err
+	}
+	for k, v := range header {
+		req.Header.Set(k, v)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("GET %s: %d", url, resp.StatusCode)
+	}
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
@@ -0,0 +1,116 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package pct_test
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	"github.com/percona/percona-agent/pct"
+	. "gopkg.in/check.v1"
+)
+
+type CloudTestSuite struct {
+	server *httptest.Server
+	urls   []string
+}
+
+var _ = Suite(&CloudTestSuite{})
+
+func (s *CloudTestSuite) SetUpSuite(t *C) {
+	metadata := map[string]string{
+		"/aws/instance-id":                 "i-123abc",
+		"/aws/instance-type":               "m3.large",
+		"/aws/placement/availability-zone": "us-east-1a",
+		"/gcp/id":                          "4567",
+		"/gcp/machine-type":                "projects/123/machineTypes/n1-standard-1",
+		"/gcp/zone":                        "projects/123/zones/us-central1-b",
+		"/azure":                           `{"compute":{"vmId":"abc-def","vmSize":"Standard_D2","location":"westus","zone":"1"}}`,
+	}
+	s.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/gcp/id" && r.Header.Get("Metadata-Flavor") != "Google" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		if r.URL.Path == "/azure" && r.Header.Get("Metadata") != "true" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		v, ok := metadata[r.URL.Path]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		fmt.Fprint(w, v)
+	}))
+	s.urls = []string{pct.AwsMetadataURL, pct.GcpMetadataURL, pct.AzureMetadataURL}
+}
+
+func (s *CloudTestSuite) TearDownSuite(t *C) {
+	s.setURLs("/none", "/none", "/none")
+	pct.DetectCloud(time.Second) // reset CloudInstance
+	s.server.Close()
+	pct.AwsMetadataURL, pct.GcpMetadataURL, pct.AzureMetadataURL = s.urls[0], s.urls[1], s.urls[2]
+}
+
+func (s *CloudTestSuite) setURLs(aws, gcp, azure string) {
+	pct.AwsMetadataURL = s.server.URL + aws
+	pct.GcpMetadataURL = s.server.URL + gcp
+	pct.AzureMetadataURL = s.server.URL + azure
+}
+
+func (s *CloudTestSuite) TestDetectCloud(t *C) {
+	s.setURLs("/aws", "/none", "/none")
+	got := pct.DetectCloud(time.Second)
+	expect := &pct.CloudMetadata{
+		Provider:     "aws",
+		InstanceId:   "i-123abc",
+		InstanceType: "m3.large",
+		Region:       "us-east-1",
+		Zone:         "us-east-1a",
+	}
+	t.Check(got, DeepEquals, expect)
+	t.Check(pct.CloudInstance(), DeepEquals, expect)
+
+	s.setURLs("/none", "/gcp", "/none")
+	got = pct.DetectCloud(time.Second)
+	t.Check(got, DeepEquals, &pct.CloudMetadata{
+		Provider:     "gcp",
+		InstanceId:   "4567",
+		InstanceType: "n1-standard-1",
+		Region:       "us-central1",
+		Zone:         "us-central1-b",
+	})
+
+	s.setURLs("/none", "/none", "/azure")
+	got = pct.DetectCloud(time.Second)
+	t.Check(got, DeepEquals, &pct.CloudMetadata{
+		Provider:     "azure",
+		InstanceId:   "abc-def",
+		InstanceType: "Standard_D2",
+		Region:       "westus",
+		Zone:         "1",
+	})
+
+	// Not in a cloud.
+	s.setURLs("/none", "/none", "/none")
+	t.Check(pct.DetectCloud(time.Second), IsNil)
+	t.Check(pct.CloudInstance(), IsNil)
+}
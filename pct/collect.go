@@ -0,0 +1,91 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package pct
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+)
+
+// Data categories that can be excluded, see SetExcludeData.
+const (
+	DATA_QUERY_EXAMPLES = "query-examples" // queries with real values, not only fingerprints
+	DATA_HOSTNAMES      = "hostnames"      // client host names
+	DATA_USERNAMES      = "usernames"      // MySQL user names
+	DATA_IPS            = "ips"            // client IP addresses
+)
+
+var DataCategories = []string{DATA_QUERY_EXAMPLES, DATA_HOSTNAMES, DATA_USERNAMES, DATA_IPS}
+
+var (
+	excludeData    = map[string]bool{}
+	excludeDataMux = &sync.RWMutex{}
+)
+
+// ValidateExcludeData returns an error if a category is not one of
+// DataCategories.
+func ValidateExcludeData(categories []string) error {
+	for _, c := range categories {
+		valid := false
+		for _, dc := range DataCategories {
+			if c == dc {
+				valid = true
+				break
+			}
+		}
+		if !valid {
+			return fmt.Errorf("Invalid data category: %s (valid categories: %s)", c, strings.Join(DataCategories, ", "))
+		}
+	}
+	return nil
+}
+
+// SetExcludeData sets the data categories that are never spooled or sent.
+// Every collector checks Collect for the categories it collects, so the data
+// never leaves the server, instead of relying on the API to remove it.
+func SetExcludeData(categories []string) error {
+	if err := ValidateExcludeData(categories); err != nil {
+		return err
+	}
+	exclude := make(map[string]bool, len(categories))
+	for _, c := range categories {
+		exclude[c] = true
+	}
+	excludeDataMux.Lock()
+	excludeData = exclude
+	excludeDataMux.Unlock()
+	return nil
+}
+
+// Collect returns false if the data category is excluded by SetExcludeData.
+func Collect(category string) bool {
+	excludeDataMux.RLock()
+	defer excludeDataMux.RUnlock()
+	return !excludeData[category]
+}
+
+// CollectHost returns false if host is excluded: an IP address if DATA_IPS is
+// excluded, else a host name if DATA_HOSTNAMES is excluded.
+func CollectHost(host string) bool {
+	if net.ParseIP(host) != nil {
+		return Collect(DATA_IPS)
+	}
+	return Collect(DATA_HOSTNAMES)
+}
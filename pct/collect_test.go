@@ -0,0 +1,50 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package pct_test
+
+import (
+	"github.com/percona/percona-agent/pct"
+	. "gopkg.in/check.v1"
+)
+
+type CollectTestSuite struct {
+}
+
+var _ = Suite(&CollectTestSuite{})
+
+func (s *CollectTestSuite) TestExcludeData(t *C) {
+	defer pct.SetExcludeData(nil)
+
+	// All data is collected by default.
+	for _, c := range pct.DataCategories {
+		t.Check(pct.Collect(c), Equals, true)
+	}
+
+	err := pct.SetExcludeData([]string{pct.DATA_IPS})
+	t.Assert(err, IsNil)
+	t.Check(pct.Collect(pct.DATA_IPS), Equals, false)
+	t.Check(pct.Collect(pct.DATA_HOSTNAMES), Equals, true)
+	t.Check(pct.CollectHost("10.0.0.1"), Equals, false)
+	t.Check(pct.CollectHost("fe80::1"), Equals, false)
+	t.Check(pct.CollectHost("web1"), Equals, true)
+
+	// Invalid categories don't change the excluded data.
+	err = pct.SetExcludeData([]string{"passwords"})
+	t.Check(err, NotNil)
+	t.Check(pct.Collect(pct.DATA_IPS), Equals, false)
+}
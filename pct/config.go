@@ -0,0 +1,255 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package pct
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// UnmarshalConfig decodes a service config like json.Unmarshal but rejects
+// unknown fields.  A typo like "colectFrom" would otherwise be silently
+// ignored and the service would run with the default value.
+func UnmarshalConfig(data []byte, v interface{}) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	err := dec.Decode(v)
+	if err == nil {
+		return nil
+	}
+	// encoding/json does not export an error type for unknown fields,
+	// so the key has to be parsed from the error message.
+	const prefix = `json: unknown field "`
+	msg := err.Error()
+	if !strings.HasPrefix(msg, prefix) {
+		return err
+	}
+	key := strings.TrimSuffix(strings.TrimPrefix(msg, prefix), `"`)
+	return UnknownConfigKeyError{
+		Key:   key,
+		Valid: ConfigKeys(v),
+	}
+}
+
+// ConfigKeys returns the sorted JSON keys of the config struct v, including
+// keys of embedded structs like proto.ServiceInstance.
+func ConfigKeys(v interface{}) []string {
+	t := reflect.TypeOf(v)
+	for t != nil && t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t == nil || t.Kind() != reflect.Struct {
+		return nil
+	}
+	keys := configKeys(t)
+	sort.Strings(keys)
+	return keys
+}
+
+func configKeys(t reflect.Type) []string {
+	keys := []string{}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name := strings.Split(f.Tag.Get("json"), ",")[0]
+		if name == "-" {
+			continue
+		}
+		if f.Anonymous && name == "" {
+			ft := f.Type
+			if ft.Kind() == reflect.Ptr {
+				ft = ft.Elem()
+			}
+			if ft.Kind() == reflect.Struct {
+				keys = append(keys, configKeys(ft)...)
+				continue
+			}
+		}
+		if f.PkgPath != "" {
+			continue // unexported
+		}
+		if name == "" {
+			name = f.Name
+		}
+		keys = append(keys, name)
+	}
+	return keys
+}
+
+// ConfigChanges returns what changes from oldConfig to newConfig by JSON key,
+// like "Interval: 60 -> 300", sorted by key.  It's used to report what a config
+// would change without applying it (ValidateConfig).  oldConfig can be nil if
+// there is no current config.
+func ConfigChanges(oldConfig, newConfig interface{}) ([]string, error) {
+	oldKeys, err := configMap(oldConfig)
+	if err != nil {
+		return nil, err
+	}
+	newKeys, err := configMap(newConfig)
+	if err != nil {
+		return nil, err
+	}
+	changes := []string{}
+	for key, newVal := range newKeys {
+		oldVal, ok := oldKeys[key]
+		if ok && reflect.DeepEqual(oldVal, newVal) {
+			continue
+		}
+		changes = append(changes, key+": "+configValue(oldVal)+" -> "+configValue(newVal))
+	}
+	for key, oldVal := range oldKeys {
+		if _, ok := newKeys[key]; !ok {
+			changes = append(changes, key+": "+configValue(oldVal)+" -> null")
+		}
+	}
+	sort.Strings(changes)
+	return changes, nil
+}
+
+func configMap(config interface{}) (map[string]interface{}, error) {
+	data, err := json.Marshal(config)
+	if err != nil {
+		return nil, err
+	}
+	m := map[string]interface{}{}
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func configValue(v interface{}) string {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return "?"
+	}
+	return string(data)
+}
+
+// ConfigSchemaReporter is implemented by service managers which can describe
+// their config.  It is optional: not every ServiceManager has a config.
+type ConfigSchemaReporter interface {
+	ConfigSchema() ConfigSchema
+}
+
+// A ConfigSchema describes a service config so tools like the web UI can
+// generate forms and validate configs without hard-coding them.  Constraints
+// must match the service's ValidateConfig.
+type ConfigSchema struct {
+	Service string
+	Fields  []ConfigField
+}
+
+type ConfigField struct {
+	Name     string
+	Type     string      // string, bool, int, uint, float, array, or object
+	Default  interface{} `json:",omitempty"`
+	Required bool        `json:",omitempty"`
+	Min      interface{} `json:",omitempty"`
+	Max      interface{} `json:",omitempty"`
+	Values   []string    `json:",omitempty"` // valid values, if enumerated
+}
+
+// NewConfigSchema returns a ConfigSchema with a field for every JSON key of
+// config.  Non-zero values in config are reported as field defaults, so
+// callers should pass a config with defaults set.
+func NewConfigSchema(service string, config interface{}) ConfigSchema {
+	s := ConfigSchema{
+		Service: service,
+		Fields:  []ConfigField{},
+	}
+	v := reflect.ValueOf(config)
+	for v.Kind() == reflect.Ptr {
+		v = v.Elem()
+	}
+	if v.Kind() != reflect.Struct {
+		return s
+	}
+	s.Fields = configFields(v)
+	return s
+}
+
+// Field returns the named field so its constraints can be set, or nil if
+// there is no such field.
+func (s ConfigSchema) Field(name string) *ConfigField {
+	for i := range s.Fields {
+		if s.Fields[i].Name == name {
+			return &s.Fields[i]
+		}
+	}
+	return nil
+}
+
+func configFields(v reflect.Value) []ConfigField {
+	fields := []ConfigField{}
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name := strings.Split(f.Tag.Get("json"), ",")[0]
+		if name == "-" {
+			continue
+		}
+		fv := v.Field(i)
+		if f.Anonymous && name == "" && fv.Kind() == reflect.Struct {
+			fields = append(fields, configFields(fv)...)
+			continue
+		}
+		if f.PkgPath != "" {
+			continue // unexported
+		}
+		if name == "" {
+			name = f.Name
+		}
+		field := ConfigField{
+			Name: name,
+			Type: configFieldType(f.Type),
+		}
+		if !isZero(fv) {
+			field.Default = fv.Interface()
+		}
+		fields = append(fields, field)
+	}
+	return fields
+}
+
+func configFieldType(t reflect.Type) string {
+	switch t.Kind() {
+	case reflect.String:
+		return "string"
+	case reflect.Bool:
+		return "bool"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return "int"
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return "uint"
+	case reflect.Float32, reflect.Float64:
+		return "float"
+	case reflect.Slice, reflect.Array:
+		return "array"
+	case reflect.Ptr:
+		return configFieldType(t.Elem())
+	default:
+		return "object"
+	}
+}
+
+func isZero(v reflect.Value) bool {
+	return reflect.DeepEqual(v.Interface(), reflect.Zero(v.Type()).Interface())
+}
@@ -0,0 +1,106 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package pct_test
+
+import (
+	"github.com/percona/cloud-protocol/proto/v1"
+	"github.com/percona/percona-agent/pct"
+	. "gopkg.in/check.v1"
+)
+
+/////////////////////////////////////////////////////////////////////////////
+// config.go test suite
+/////////////////////////////////////////////////////////////////////////////
+
+type ConfigTestSuite struct {
+}
+
+var _ = Suite(&ConfigTestSuite{})
+
+type testConfig struct {
+	proto.ServiceInstance
+	CollectFrom string
+	Interval    uint `json:",omitempty"`
+	Ignored     bool `json:"-"`
+}
+
+func (s *ConfigTestSuite) TestUnmarshalConfig(t *C) {
+	config := &testConfig{}
+	err := pct.UnmarshalConfig([]byte(`{"Service":"mysql","InstanceId":1,"CollectFrom":"perfschema"}`), config)
+	t.Assert(err, IsNil)
+	t.Check(config.Service, Equals, "mysql")
+	t.Check(config.InstanceId, Equals, uint(1))
+	t.Check(config.CollectFrom, Equals, "perfschema")
+}
+
+func (s *ConfigTestSuite) TestUnmarshalConfigUnknownKey(t *C) {
+	config := &testConfig{}
+	err := pct.UnmarshalConfig([]byte(`{"Service":"mysql","colectFrom":"perfschema"}`), config)
+	t.Assert(err, NotNil)
+	t.Check(err, DeepEquals, pct.UnknownConfigKeyError{
+		Key:   "colectFrom",
+		Valid: []string{"CollectFrom", "InstanceId", "Interval", "Service"},
+	})
+	t.Check(err.Error(), Equals, "Unknown config key: colectFrom (valid keys: CollectFrom, InstanceId, Interval, Service)")
+}
+
+func (s *ConfigTestSuite) TestNewConfigSchema(t *C) {
+	schema := pct.NewConfigSchema("test", testConfig{CollectFrom: "slowlog"})
+	schema.Field("Interval").Max = 3600
+	t.Check(schema.Field("Foo"), IsNil)
+	t.Check(schema, DeepEquals, pct.ConfigSchema{
+		Service: "test",
+		Fields: []pct.ConfigField{
+			{Name: "Service", Type: "string"},
+			{Name: "InstanceId", Type: "uint"},
+			{Name: "CollectFrom", Type: "string", Default: "slowlog"},
+			{Name: "Interval", Type: "uint", Max: 3600},
+		},
+	})
+}
+
+func (s *ConfigTestSuite) TestConfigChanges(t *C) {
+	oldConfig := testConfig{CollectFrom: "slowlog", Interval: 60}
+	newConfig := testConfig{CollectFrom: "perfschema", Interval: 60}
+	got, err := pct.ConfigChanges(oldConfig, newConfig)
+	t.Assert(err, IsNil)
+	t.Check(got, DeepEquals, []string{`CollectFrom: "slowlog" -> "perfschema"`})
+
+	got, err = pct.ConfigChanges(oldConfig, oldConfig)
+	t.Assert(err, IsNil)
+	t.Check(got, HasLen, 0)
+
+	// Interval is omitted if zero.
+	newConfig.Interval = 0
+	got, err = pct.ConfigChanges(oldConfig, newConfig)
+	t.Assert(err, IsNil)
+	t.Check(got, DeepEquals, []string{
+		`CollectFrom: "slowlog" -> "perfschema"`,
+		`Interval: 60 -> null`,
+	})
+
+	// No current config.
+	got, err = pct.ConfigChanges(nil, oldConfig)
+	t.Assert(err, IsNil)
+	t.Check(got, DeepEquals, []string{
+		`CollectFrom: null -> "slowlog"`,
+		`InstanceId: null -> 0`,
+		`Interval: null -> 60`,
+		`Service: null -> ""`,
+	})
+}
@@ -0,0 +1,221 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package pct
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v2"
+)
+
+// Config file formats, by file extension.  Services only handle JSON, so
+// YAML and TOML configs are converted to and from JSON, see ReadConfigFile and
+// EncodeConfig.  This lets config management templates write configs in
+// the format they already use.
+const (
+	CONFIG_FORMAT_JSON = "json" // .conf
+	CONFIG_FORMAT_YAML = "yaml" // .yml or .yaml
+	CONFIG_FORMAT_TOML = "toml" // .toml
+)
+
+// configSuffixes in order of precedence if a config has several files.
+var configSuffixes = []string{CONFIG_FILE_SUFFIX, ".yml", ".yaml", ".toml"}
+
+// ConfigFormat returns the format of file by its extension.  Unknown
+// extensions are JSON, like .conf.
+func ConfigFormat(file string) string {
+	switch filepath.Ext(file) {
+	case ".yml", ".yaml":
+		return CONFIG_FORMAT_YAML
+	case ".toml":
+		return CONFIG_FORMAT_TOML
+	}
+	return CONFIG_FORMAT_JSON
+}
+
+// ConfigName returns the name of a config file, e.g. mm-mysql-1 for
+// mm-mysql-1.yml.
+func ConfigName(file string) string {
+	name := filepath.Base(file)
+	for _, suffix := range configSuffixes {
+		if strings.HasSuffix(name, suffix) {
+			return strings.TrimSuffix(name, suffix)
+		}
+	}
+	return name
+}
+
+// FindConfigFile returns the file of config name in dir in any format, or the
+// JSON file (name.conf) if there is none.
+func FindConfigFile(dir, name string) string {
+	for _, suffix := range configSuffixes {
+		file := filepath.Join(dir, name+suffix)
+		if FileExists(file) {
+			return file
+		}
+	}
+	return filepath.Join(dir, name+CONFIG_FILE_SUFFIX)
+}
+
+// GlobConfigFiles returns the config files in dir whose name matches pattern,
+// e.g. "mm-*", in any format, sorted.  If a config has several files, only the
+// one FindConfigFile returns is included.
+func GlobConfigFiles(dir, pattern string) ([]string, error) {
+	seen := make(map[string]bool)
+	files := []string{}
+	for _, suffix := range configSuffixes {
+		matches, err := filepath.Glob(filepath.Join(dir, pattern+suffix))
+		if err != nil {
+			return nil, err
+		}
+		for _, file := range matches {
+			name := ConfigName(file)
+			if seen[name] {
+				continue
+			}
+			seen[name] = true
+			files = append(files, file)
+		}
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// ReadConfigFile returns the config in file as JSON.
+func ReadConfigFile(file string) ([]byte, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	return ConfigToJSON(data, ConfigFormat(file))
+}
+
+// ConfigToJSON converts a config in format to JSON.
+func ConfigToJSON(data []byte, format string) ([]byte, error) {
+	switch format {
+	case CONFIG_FORMAT_YAML:
+		var v interface{}
+		if err := yaml.Unmarshal(data, &v); err != nil {
+			return nil, err
+		}
+		if v == nil {
+			return nil, nil // empty file
+		}
+		return json.Marshal(yamlToJSON(v))
+	case CONFIG_FORMAT_TOML:
+		v := make(map[string]interface{})
+		if _, err := toml.Decode(string(data), &v); err != nil {
+			return nil, err
+		}
+		return json.Marshal(v)
+	}
+	return data, nil
+}
+
+// EncodeConfig encodes config in format.  JSON is indented like configs have
+// always been written.  YAML and TOML have the keys of the JSON encoding, so
+// json tags like omitempty apply to them, too.
+func EncodeConfig(config interface{}, format string) ([]byte, error) {
+	if format == CONFIG_FORMAT_JSON {
+		return json.MarshalIndent(config, "", "    ")
+	}
+	data, err := json.Marshal(config)
+	if err != nil {
+		return nil, err
+	}
+	return jsonToConfig(data, format)
+}
+
+// jsonToConfig converts a JSON config to format.
+func jsonToConfig(data []byte, format string) ([]byte, error) {
+	if format == CONFIG_FORMAT_JSON {
+		return data, nil
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber() // else all numbers are floats, e.g. Interval: 60.0
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+	v = jsonToNative(v)
+	switch format {
+	case CONFIG_FORMAT_YAML:
+		return yaml.Marshal(v)
+	case CONFIG_FORMAT_TOML:
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("TOML config must be an object, got %T", v)
+		}
+		var buf bytes.Buffer
+		if err := toml.NewEncoder(&buf).Encode(m); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	}
+	return nil, fmt.Errorf("Invalid config format: %s", format)
+}
+
+// yamlToJSON converts YAML maps, which have interface{} keys, to JSON objects.
+func yamlToJSON(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for k, val := range v {
+			m[fmt.Sprintf("%v", k)] = yamlToJSON(val)
+		}
+		return m
+	case []interface{}:
+		for i, val := range v {
+			v[i] = yamlToJSON(val)
+		}
+	}
+	return v
+}
+
+// jsonToNative converts JSON numbers to int64 or float64 and drops null
+// values, which TOML does not have.
+func jsonToNative(v interface{}) interface{} {
+	switch v := v.(type) {
+	case json.Number:
+		if n, err := v.Int64(); err == nil {
+			return n
+		}
+		f, _ := v.Float64()
+		return f
+	case map[string]interface{}:
+		for k, val := range v {
+			if val == nil {
+				delete(v, k)
+				continue
+			}
+			v[k] = jsonToNative(val)
+		}
+	case []interface{}:
+		for i, val := range v {
+			v[i] = jsonToNative(val)
+		}
+	}
+	return v
+}
@@ -0,0 +1,225 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package pct
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+)
+
+// CREDENTIALS_FILE is the file in the config dir with the secrets split out of
+// configs, see basedir.SeparateCredentials.  It is written 0600.
+const CREDENTIALS_FILE = "credentials"
+
+// ENV_KEYRING_CMD is the env var with a keyring command which stores the
+// secrets instead of CREDENTIALS_FILE, see Credentials.
+const ENV_KEYRING_CMD = "PCT_KEYRING_CMD"
+
+// A credential reference replaces a secret in a config, e.g.
+// "ApiKey": "{credentials:agent.ApiKey}" or a DSN like
+// "percona:{credentials:mysql-1.DSN}@tcp(127.0.0.1:3306)/".
+const (
+	CREDENTIAL_REF_PREFIX = "{credentials:"
+	CREDENTIAL_REF_SUFFIX = "}"
+)
+
+// Credentials stores secrets by name, e.g. agent.ApiKey, in a JSON file or, if
+// cmd is set, an external keyring command run like a git credential helper:
+// "cmd get NAME" prints the secret, "cmd set NAME" reads it from stdin.
+type Credentials struct {
+	file string
+	cmd  string
+	mux  *sync.Mutex
+}
+
+func NewCredentials(file, cmd string) *Credentials {
+	c := &Credentials{
+		file: file,
+		cmd:  cmd,
+		mux:  &sync.Mutex{},
+	}
+	return c
+}
+
+func (c *Credentials) Get(name string) (string, error) {
+	if c.cmd != "" {
+		out, err := exec.Command(c.cmd, "get", name).Output()
+		if err != nil {
+			return "", fmt.Errorf("%s get %s: %s", c.cmd, name, err)
+		}
+		return strings.TrimRight(string(out), "\r\n"), nil
+	}
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	secrets, err := c.read()
+	if err != nil {
+		return "", err
+	}
+	secret, ok := secrets[name]
+	if !ok {
+		return "", fmt.Errorf("No %s in %s", name, c.file)
+	}
+	return secret, nil
+}
+
+func (c *Credentials) Set(name, secret string) error {
+	if c.cmd != "" {
+		cmd := exec.Command(c.cmd, "set", name)
+		cmd.Stdin = strings.NewReader(secret)
+		if out, err := cmd.CombinedOutput(); err != nil {
+			return fmt.Errorf("%s set %s: %s: %s", c.cmd, name, err, strings.TrimSpace(string(out)))
+		}
+		return nil
+	}
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	secrets, err := c.read()
+	if err != nil {
+		return err
+	}
+	if old, ok := secrets[name]; ok && old == secret {
+		return nil
+	}
+	secrets[name] = secret
+	data, err := json.MarshalIndent(secrets, "", "    ")
+	if err != nil {
+		return err
+	}
+	return WriteFile(c.file, data, 0600)
+}
+
+func (c *Credentials) read() (map[string]string, error) {
+	secrets := make(map[string]string)
+	data, err := ioutil.ReadFile(c.file)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return secrets, nil
+		}
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &secrets); err != nil {
+		return nil, fmt.Errorf("%s: %s", c.file, err)
+	}
+	return secrets, nil
+}
+
+// Resolve replaces the credential references in a JSON config with the
+// secrets.
+func (c *Credentials) Resolve(data []byte) ([]byte, error) {
+	prefix := []byte(CREDENTIAL_REF_PREFIX)
+	if !bytes.Contains(data, prefix) {
+		return data, nil
+	}
+	var buf bytes.Buffer
+	for {
+		i := bytes.Index(data, prefix)
+		if i < 0 {
+			break
+		}
+		j := bytes.Index(data[i:], []byte(CREDENTIAL_REF_SUFFIX))
+		if j < 0 {
+			break
+		}
+		name := string(data[i+len(prefix) : i+j])
+		secret, err := c.Get(name)
+		if err != nil {
+			return nil, err
+		}
+		// The reference is in a JSON string, so the secret must be escaped.
+		quoted, err := json.Marshal(secret)
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(data[:i])
+		buf.Write(quoted[1 : len(quoted)-1])
+		data = data[i+j+len(CREDENTIAL_REF_SUFFIX):]
+	}
+	buf.Write(data)
+	return buf.Bytes(), nil
+}
+
+// CredentialRef returns the reference to the credential name.
+func CredentialRef(name string) string {
+	return CREDENTIAL_REF_PREFIX + name + CREDENTIAL_REF_SUFFIX
+}
+
+// hasCredentials returns true if config file name can have secrets, see
+// SplitCredentials.
+func hasCredentials(name string) bool {
+	return name == "agent" || strings.HasPrefix(name, "mysql-")
+}
+
+// SplitCredentials replaces the secrets in config, the JSON object of config
+// file name, with references and returns the secrets by credential name.
+// Secrets are the agent ApiKey (and Secondary.ApiKey) and the password in the
+// DSN of MySQL instances.
+func SplitCredentials(name string, config map[string]interface{}) map[string]string {
+	secrets := make(map[string]string)
+	split := func(obj map[string]interface{}, key, credName string) {
+		value, _ := obj[key].(string)
+		if value == "" || strings.Contains(value, CREDENTIAL_REF_PREFIX) {
+			return
+		}
+		obj[key] = CredentialRef(credName)
+		secrets[credName] = value
+	}
+	switch {
+	case name == "agent":
+		split(config, "ApiKey", "agent.ApiKey")
+		if secondary, ok := config["Secondary"].(map[string]interface{}); ok {
+			split(secondary, "ApiKey", "agent.Secondary.ApiKey")
+		}
+	case strings.HasPrefix(name, "mysql-"):
+		dsn, _ := config["DSN"].(string)
+		if user, password, host, ok := splitDSNPassword(dsn); ok && !strings.Contains(password, CREDENTIAL_REF_PREFIX) {
+			credName := name + ".DSN"
+			config["DSN"] = user + ":" + CredentialRef(credName) + "@" + host
+			secrets[credName] = password
+		}
+	}
+	return secrets
+}
+
+// splitDSNPassword splits a DSN like user:pass@tcp(host:port)/db like the
+// MySQL driver: the password ends at the last @ before the last /.  ok is
+// false if the DSN has no password or is a Vault DSN (vault:path@...), which
+// has none.
+func splitDSNPassword(dsn string) (user, password, host string, ok bool) {
+	if strings.HasPrefix(dsn, "vault:") {
+		return "", "", "", false
+	}
+	slash := strings.LastIndex(dsn, "/")
+	if slash < 0 {
+		slash = len(dsn)
+	}
+	at := strings.LastIndex(dsn[:slash], "@")
+	if at < 0 {
+		return "", "", "", false
+	}
+	colon := strings.Index(dsn[:at], ":")
+	if colon < 0 || colon == at-1 {
+		return "", "", "", false
+	}
+	return dsn[:colon], dsn[colon+1 : at], dsn[at+1:], true
+}
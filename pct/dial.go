@@ -0,0 +1,171 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package pct
+
+import (
+	"net"
+	"sort"
+	"time"
+)
+
+// DIAL_FALLBACK_DELAY is how long Dial waits for one address to connect before
+// also trying the next, like Happy Eyeballs (RFC 6555), by default.  See
+// APIOptions.FallbackDelay.
+const DIAL_FALLBACK_DELAY = 300 * time.Millisecond
+
+// DIAL_MIN_ADDR_TIMEOUT is the default minimum connect timeout per address,
+// see APIOptions.AddrTimeout.
+const DIAL_MIN_ADDR_TIMEOUT = 2 * time.Second
+
+// Dial connects to addr (host:port) over TCP.  It resolves all A and AAAA
+// records of host and tries them in InterleaveIPs order: if an address does not
+// connect within APIOptions.FallbackDelay or fails, it also tries the next.  The
+// first connection wins.  Each address has its share of timeout, but at least
+// APIOptions.AddrTimeout, so a dead address, e.g. on a network with broken
+// IPv6, does not stall connecting.
+func Dial(addr string, timeout time.Duration) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	ips, err := net.LookupIP(host)
+	if err != nil {
+		return nil, err
+	}
+	o := GetAPIOptions()
+	ips = InterleaveIPs(ips, o.PreferIPv4)
+	if len(ips) == 1 {
+		return net.DialTimeout("tcp", net.JoinHostPort(ips[0].String(), port), timeout)
+	}
+
+	addrTimeout := timeout / time.Duration(len(ips))
+	if addrTimeout < o.AddrTimeout {
+		addrTimeout = o.AddrTimeout
+	}
+	if addrTimeout > timeout {
+		addrTimeout = timeout
+	}
+
+	// Buffered so attempts that finish after Dial returns do not block.
+	results := make(chan dialResult, len(ips))
+	started := 0
+	pending := 0
+	start := func() {
+		ipAddr := net.JoinHostPort(ips[started].String(), port)
+		started++
+		pending++
+		go func() {
+			conn, err := net.DialTimeout("tcp", ipAddr, addrTimeout)
+			results <- dialResult{conn, err}
+		}()
+	}
+
+	start()
+	fallback := time.NewTimer(o.FallbackDelay)
+	defer fallback.Stop()
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	for {
+		select {
+		case r := <-results:
+			pending--
+			if r.err == nil {
+				go closeDialResults(results, pending)
+				return r.conn, nil
+			}
+			err = r.err
+			if started < len(ips) {
+				start()
+				fallback.Reset(o.FallbackDelay)
+			} else if pending == 0 {
+				return nil, err // last error
+			}
+		case <-fallback.C:
+			if started < len(ips) {
+				start()
+				fallback.Reset(o.FallbackDelay)
+			}
+		case <-deadline.C:
+			go closeDialResults(results, pending)
+			return nil, &net.OpError{Op: "dial", Net: "tcp", Err: dialTimeoutError{}}
+		}
+	}
+}
+
+// LookupAddrs returns the IP addresses of host, sorted, e.g. to detect when
+// its DNS records change.
+func LookupAddrs(host string) ([]string, error) {
+	ips, err := net.LookupIP(host)
+	if err != nil {
+		return nil, err
+	}
+	addrs := make([]string, len(ips))
+	for i, ip := range ips {
+		addrs[i] = ip.String()
+	}
+	sort.Strings(addrs)
+	return addrs, nil
+}
+
+// InterleaveIPs returns ips alternating IPv6 and IPv4 addresses, IPv6 first
+// unless ipv4First, else in DNS order.
+func InterleaveIPs(ips []net.IP, ipv4First bool) []net.IP {
+	v6 := []net.IP{}
+	v4 := []net.IP{}
+	for _, ip := range ips {
+		if ip.To4() != nil {
+			v4 = append(v4, ip)
+		} else {
+			v6 = append(v6, ip)
+		}
+	}
+	if ipv4First {
+		v6, v4 = v4, v6
+	}
+	interleaved := make([]net.IP, 0, len(ips))
+	for i := 0; i < len(v6) || i < len(v4); i++ {
+		if i < len(v6) {
+			interleaved = append(interleaved, v6[i])
+		}
+		if i < len(v4) {
+			interleaved = append(interleaved, v4[i])
+		}
+	}
+	return interleaved
+}
+
+type dialResult struct {
+	conn net.Conn
+	err  error
+}
+
+// closeDialResults closes the connections of n pending attempts which Dial
+// did not use.
+func closeDialResults(results chan dialResult, n int) {
+	for i := 0; i < n; i++ {
+		if r := <-results; r.err == nil {
+			r.conn.Close()
+		}
+	}
+}
+
+type dialTimeoutError struct{}
+
+func (e dialTimeoutError) Error() string   { return "i/o timeout" }
+func (e dialTimeoutError) Timeout() bool   { return true }
+func (e dialTimeoutError) Temporary() bool { return true }
@@ -0,0 +1,81 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package pct_test
+
+import (
+	"github.com/percona/percona-agent/pct"
+	. "gopkg.in/check.v1"
+	"net"
+	"time"
+)
+
+type DialTestSuite struct {
+}
+
+var _ = Suite(&DialTestSuite{})
+
+func (s *DialTestSuite) TestInterleaveIPs(t *C) {
+	ips := []net.IP{
+		net.ParseIP("10.0.0.1"),
+		net.ParseIP("10.0.0.2"),
+		net.ParseIP("10.0.0.3"),
+		net.ParseIP("2001:db8::1"),
+		net.ParseIP("2001:db8::2"),
+	}
+	got := []string{}
+	for _, ip := range pct.InterleaveIPs(ips, false) {
+		got = append(got, ip.String())
+	}
+	t.Check(got, DeepEquals, []string{"2001:db8::1", "10.0.0.1", "2001:db8::2", "10.0.0.2", "10.0.0.3"})
+
+	got = []string{}
+	for _, ip := range pct.InterleaveIPs(ips, true) {
+		got = append(got, ip.String())
+	}
+	t.Check(got, DeepEquals, []string{"10.0.0.1", "2001:db8::1", "10.0.0.2", "2001:db8::2", "10.0.0.3"})
+}
+
+func (s *DialTestSuite) TestDial(t *C) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	t.Assert(err, IsNil)
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+
+	// localhost can resolve to ::1 and 127.0.0.1 but only the latter listens.
+	conn, err := pct.Dial(net.JoinHostPort("localhost", port), 5*time.Second)
+	t.Assert(err, IsNil)
+	t.Check(conn.RemoteAddr().String(), Equals, l.Addr().String())
+	conn.Close()
+}
+
+func (s *DialTestSuite) TestHostPort(t *C) {
+	t.Check(pct.HostPort("api.example.com", "wss"), Equals, "api.example.com:443")
+	t.Check(pct.HostPort("api.example.com:8080", "https"), Equals, "api.example.com:8080")
+	t.Check(pct.HostPort("[2001:db8::1]", "ws"), Equals, "[2001:db8::1]:80")
+	t.Check(pct.HostPort("2001:db8::1", "https"), Equals, "[2001:db8::1]:443")
+	t.Check(pct.HostPort("[2001:db8::1]:8443", "wss"), Equals, "[2001:db8::1]:8443")
+}
@@ -19,6 +19,7 @@ package pct
 
 import (
 	"fmt"
+	"strings"
 )
 
 type ServiceIsRunningError struct {
@@ -51,6 +52,17 @@ func (e UnknownServiceError) Error() string {
 
 /////////////////////////////////////////////////////////////////////////////
 
+type CmdNotAllowedError struct {
+	Service string
+	Cmd     string
+}
+
+func (e CmdNotAllowedError) Error() string {
+	return e.Service + "." + e.Cmd + " is not allowed by the agent config (AllowCmds, DenyCmds)"
+}
+
+/////////////////////////////////////////////////////////////////////////////
+
 type CmdTimeoutError struct {
 	Cmd string
 }
@@ -126,3 +138,56 @@ type DuplicateServiceInstanceError struct {
 func (e DuplicateServiceInstanceError) Error() string {
 	return fmt.Sprintf("Duplicate %s instance: %d", e.Service, e.Id)
 }
+
+/////////////////////////////////////////////////////////////////////////////
+
+type UnknownConfigKeyError struct {
+	Key   string
+	Valid []string
+}
+
+func (e UnknownConfigKeyError) Error() string {
+	return fmt.Sprintf("Unknown config key: %s (valid keys: %s)", e.Key, strings.Join(e.Valid, ", "))
+}
+
+/////////////////////////////////////////////////////////////////////////////
+
+// APIError is an API response with an HTTP status code >= 400.
+type APIError struct {
+	Method string
+	URL    string
+	Code   int
+	Body   []byte
+}
+
+func (e APIError) Error() string {
+	msg := fmt.Sprintf("%s %s: HTTP status code %d", e.Method, e.URL, e.Code)
+	if len(e.Body) > 0 {
+		body := string(e.Body)
+		if len(body) > 200 {
+			body = body[0:200] + "..."
+		}
+		msg += ": " + body
+	}
+	return msg
+}
+
+// ClientError returns true for 4xx codes: the API rejected the request, so
+// resending it won't help.
+func (e APIError) ClientError() bool {
+	return e.Code >= 400 && e.Code < 500
+}
+
+/////////////////////////////////////////////////////////////////////////////
+
+// NetworkError is an API request that failed without a response, e.g. cannot
+// connect or timeout.
+type NetworkError struct {
+	Method string
+	URL    string
+	Err    error
+}
+
+func (e NetworkError) Error() string {
+	return fmt.Sprintf("%s %s error: %s", e.Method, e.URL, e.Err)
+}
@@ -0,0 +1,106 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package pct
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+)
+
+var (
+	fingerprintOnce sync.Once
+	fingerprint     string
+)
+
+var machineIdFiles = []string{
+	"/etc/machine-id",
+	"/var/lib/dbus/machine-id",
+}
+
+var instanceIdFiles = []string{
+	"/var/lib/cloud/data/instance-id", // cloud-init: EC2, OpenStack, etc.
+	"/sys/class/dmi/id/product_uuid",  // SMBIOS, requires root
+}
+
+// HostFingerprint returns a stable, hex SHA256 fingerprint of the host, or ""
+// if there's nothing to fingerprint.  It's reported with the AgentUuid so a
+// reinstalled agent can be re-associated with its existing server instance
+// instead of creating a duplicate.  The fingerprint is the machine ID and cloud
+// instance ID.  MAC addresses are used only if neither exists because they
+// change more often, e.g. when containers start.
+func HostFingerprint() string {
+	fingerprintOnce.Do(func() {
+		machineId := firstFileValue(machineIdFiles)
+		instanceId := firstFileValue(instanceIdFiles)
+		var macs []string
+		if machineId == "" && instanceId == "" {
+			macs = hardwareAddrs()
+		}
+		fingerprint = Fingerprint(machineId, instanceId, macs)
+	})
+	return fingerprint
+}
+
+// Fingerprint returns the hex SHA256 of the host identifiers, or "" if all
+// are empty.
+func Fingerprint(machineId, instanceId string, macs []string) string {
+	if machineId == "" && instanceId == "" && len(macs) == 0 {
+		return ""
+	}
+	h := sha256.New()
+	fmt.Fprintf(h, "machine-id:%s\n", machineId)
+	fmt.Fprintf(h, "instance-id:%s\n", instanceId)
+	sorted := append([]string{}, macs...)
+	sort.Strings(sorted)
+	fmt.Fprintf(h, "mac:%s\n", strings.Join(sorted, ","))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func firstFileValue(files []string) string {
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			continue
+		}
+		if v := strings.TrimSpace(string(data)); v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+func hardwareAddrs() []string {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil
+	}
+	macs := []string{}
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagLoopback != 0 || len(iface.HardwareAddr) == 0 {
+			continue
+		}
+		macs = append(macs, iface.HardwareAddr.String())
+	}
+	return macs
+}
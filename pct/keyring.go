@@ -0,0 +1,245 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package pct
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// ROOT_KEY_ID is the id of the compiled-in PublicKey.  A key manifest can
+// revoke it like any other key.
+const ROOT_KEY_ID = "root"
+
+// Signature algorithms, see Signature.  Both hash the signed data with
+// SHA-256.
+const (
+	SIG_RSA_SHA256     = "rsa-sha256"     // RSA PKCS #1 v1.5
+	SIG_RSA_PSS_SHA256 = "rsa-pss-sha256" // RSA PSS
+)
+
+// A TrustedKey verifies updates until it expires or is revoked.
+type TrustedKey struct {
+	Id      string
+	PEM     string    // PKIX RSA public key
+	Expires time.Time // zero if it does not expire
+	key     *rsa.PublicKey
+}
+
+// A KeyManifest adds and revokes update keys without a new agent release.  It
+// is signed by a key in the current keyring, so a new key is added by the
+// manifest before it signs anything, and a compromised key is revoked by a
+// manifest signed with another key.
+type KeyManifest struct {
+	Serial  uint64 // must be greater than the current manifest's
+	Keys    []TrustedKey
+	Revoked []string // key ids, including ROOT_KEY_ID
+}
+
+// A Signature of an update file.  The .sig file is either a Signature (JSON)
+// or, like before keyrings, a raw RSA PKCS #1 v1.5 SHA-256 signature, which
+// is checked with every valid key.
+type Signature struct {
+	KeyId string
+	Alg   string // SIG_RSA_SHA256 (default) or SIG_RSA_PSS_SHA256
+	Sig   []byte // base64 in JSON
+}
+
+// A Keyring is the compiled-in root key plus the keys of the current key
+// manifest.  The manifest is saved in the store, if set, where it's trusted
+// when loaded: it's only saved after its signature is verified.
+type Keyring struct {
+	root     TrustedKey
+	store    *Store
+	manifest *KeyManifest
+	mux      *sync.RWMutex
+}
+
+func NewKeyring(rootKey []byte) (*Keyring, error) {
+	root := TrustedKey{Id: ROOT_KEY_ID, PEM: string(rootKey)}
+	if err := root.parse(); err != nil {
+		return nil, err
+	}
+	k := &Keyring{
+		root:     root,
+		manifest: &KeyManifest{},
+		mux:      &sync.RWMutex{},
+	}
+	return k, nil
+}
+
+// Load loads the key manifest saved in the store, if any, and saves new
+// manifests there.
+func (k *Keyring) Load(store *Store) error {
+	k.mux.Lock()
+	defer k.mux.Unlock()
+	k.store = store
+	var data json.RawMessage
+	found, err := store.Get(STORE_STATE, "update-keys", &data)
+	if err != nil || !found {
+		return err
+	}
+	manifest, err := parseKeyManifest(data)
+	if err != nil {
+		return fmt.Errorf("Saved key manifest: %s", err)
+	}
+	k.manifest = manifest
+	return nil
+}
+
+// Serial returns the serial of the current key manifest, 0 if there's none.
+func (k *Keyring) Serial() uint64 {
+	k.mux.RLock()
+	defer k.mux.RUnlock()
+	return k.manifest.Serial
+}
+
+// Keys returns the keys valid at now: not expired or revoked.
+func (k *Keyring) Keys(now time.Time) []TrustedKey {
+	k.mux.RLock()
+	defer k.mux.RUnlock()
+	return k.keys(now)
+}
+
+func (k *Keyring) keys(now time.Time) []TrustedKey {
+	revoked := make(map[string]bool)
+	for _, id := range k.manifest.Revoked {
+		revoked[id] = true
+	}
+	keys := []TrustedKey{}
+	for _, key := range append([]TrustedKey{k.root}, k.manifest.Keys...) {
+		if revoked[key.Id] || (!key.Expires.IsZero() && !now.Before(key.Expires)) {
+			continue
+		}
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// Verify returns the id of the valid key which signed data, or an error if
+// none did.
+func (k *Keyring) Verify(data, sig []byte, now time.Time) (string, error) {
+	k.mux.RLock()
+	defer k.mux.RUnlock()
+	return k.verify(data, sig, now)
+}
+
+func (k *Keyring) verify(data, sig []byte, now time.Time) (string, error) {
+	s := Signature{Alg: SIG_RSA_SHA256, Sig: sig}
+	if len(sig) > 0 && sig[0] == '{' {
+		if err := json.Unmarshal(sig, &s); err != nil {
+			return "", fmt.Errorf("Invalid signature: %s", err)
+		}
+		if s.Alg == "" {
+			s.Alg = SIG_RSA_SHA256
+		}
+	}
+	hash := sha256.Sum256(data)
+	keys := k.keys(now)
+	if len(keys) == 0 {
+		return "", errors.New("No valid keys: all are expired or revoked")
+	}
+	for _, key := range keys {
+		if s.KeyId != "" && key.Id != s.KeyId {
+			continue
+		}
+		var err error
+		switch s.Alg {
+		case SIG_RSA_SHA256:
+			err = rsa.VerifyPKCS1v15(key.key, crypto.SHA256, hash[:], s.Sig)
+		case SIG_RSA_PSS_SHA256:
+			err = rsa.VerifyPSS(key.key, crypto.SHA256, hash[:], s.Sig, nil)
+		default:
+			return "", fmt.Errorf("Invalid signature algorithm: %s", s.Alg)
+		}
+		if err == nil {
+			return key.Id, nil
+		}
+	}
+	if s.KeyId != "" {
+		return "", fmt.Errorf("Invalid signature: key %s is unknown, expired, revoked, or did not sign the data", s.KeyId)
+	}
+	return "", errors.New("Invalid signature: no valid key signed the data")
+}
+
+// Rotate replaces the key manifest with the manifest in data, if it's signed
+// by a valid key and its serial is greater than the current manifest's.
+func (k *Keyring) Rotate(data, sig []byte, now time.Time) error {
+	k.mux.Lock()
+	defer k.mux.Unlock()
+	if _, err := k.verify(data, sig, now); err != nil {
+		return fmt.Errorf("Key manifest: %s", err)
+	}
+	manifest, err := parseKeyManifest(data)
+	if err != nil {
+		return fmt.Errorf("Key manifest: %s", err)
+	}
+	if manifest.Serial <= k.manifest.Serial {
+		// Replaying an old manifest must not restore revoked keys.
+		return fmt.Errorf("Key manifest serial %d is not greater than current serial %d", manifest.Serial, k.manifest.Serial)
+	}
+	if k.store != nil {
+		raw := json.RawMessage(data)
+		if err := k.store.Put(STORE_STATE, "update-keys", &raw); err != nil {
+			return err
+		}
+	}
+	k.manifest = manifest
+	return nil
+}
+
+func parseKeyManifest(data []byte) (*KeyManifest, error) {
+	manifest := &KeyManifest{}
+	if err := json.Unmarshal(data, manifest); err != nil {
+		return nil, err
+	}
+	for i := range manifest.Keys {
+		if manifest.Keys[i].Id == "" || manifest.Keys[i].Id == ROOT_KEY_ID {
+			return nil, fmt.Errorf("Invalid key id: '%s'", manifest.Keys[i].Id)
+		}
+		if err := manifest.Keys[i].parse(); err != nil {
+			return nil, fmt.Errorf("Key %s: %s", manifest.Keys[i].Id, err)
+		}
+	}
+	return manifest, nil
+}
+
+func (k *TrustedKey) parse() error {
+	block, _ := pem.Decode([]byte(k.PEM))
+	if block == nil {
+		return errors.New("Invalid PEM public key")
+	}
+	pubKey, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return err
+	}
+	rsaPubKey, ok := pubKey.(*rsa.PublicKey)
+	if !ok {
+		return errors.New("Not an RSA public key")
+	}
+	k.key = rsaPubKey
+	return nil
+}
@@ -0,0 +1,84 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package pct
+
+import (
+	"sync"
+)
+
+// AgentMetrics are the agent's own internals, e.g. cmd exec time.  The agent
+// records them and the mm agent monitor collects them.
+var AgentMetrics = NewMetrics()
+
+// A Metric is a counter or gauge value in Metrics.  Type is "counter" or
+// "gauge" like mm.Metric.
+type Metric struct {
+	Type   string
+	Number float64
+}
+
+type Metrics struct {
+	metrics map[string]Metric
+	gauges  map[string]func() float64
+	mux     *sync.RWMutex
+}
+
+func NewMetrics() *Metrics {
+	m := &Metrics{
+		metrics: make(map[string]Metric),
+		gauges:  make(map[string]func() float64),
+		mux:     &sync.RWMutex{},
+	}
+	return m
+}
+
+// Add increments counter name by n.
+func (m *Metrics) Add(name string, n float64) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	m.metrics[name] = Metric{Type: "counter", Number: m.metrics[name].Number + n}
+}
+
+// Set sets gauge name to n.
+func (m *Metrics) Set(name string, n float64) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	m.metrics[name] = Metric{Type: "gauge", Number: n}
+}
+
+// SetFunc sets gauge name to the value of f each time All is called, e.g. to
+// report the length of a chan.
+func (m *Metrics) SetFunc(name string, f func() float64) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	m.gauges[name] = f
+}
+
+// All returns a copy of all metrics.
+func (m *Metrics) All() map[string]Metric {
+	m.mux.RLock()
+	defer m.mux.RUnlock()
+	all := make(map[string]Metric, len(m.metrics)+len(m.gauges))
+	for name, metric := range m.metrics {
+		all[name] = metric
+	}
+	for name, f := range m.gauges {
+		all[name] = Metric{Type: "gauge", Number: f()}
+	}
+	return all
+}
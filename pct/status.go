@@ -21,12 +21,94 @@ import (
 	"fmt"
 	"github.com/percona/cloud-protocol/proto/v1"
 	"sync"
+	"time"
 )
 
 type StatusReporter interface {
 	Status() map[string]string
 }
 
+// A StatusEntry is a structured status: State since the last transition,
+// and Detail, e.g. the cmd from UpdateRe.  The flat status is State + " " + Detail.
+type StatusEntry struct {
+	State  string
+	Since  time.Time // UTC
+	Detail string    `json:",omitempty"`
+}
+
+func (e StatusEntry) String() string {
+	if e.Detail == "" {
+		return e.State
+	}
+	return e.State + " " + e.Detail
+}
+
+// Entries of all Status, keyed on proc, so StructuredStatus can structure the
+// flat status maps returned by StatusReporter, and the last transitions of
+// each proc, see StatusHistory.  statusEntriesMux guards both.
+var statusEntries = make(map[string]StatusEntry)
+var statusHistory = make(map[string]*statusRing)
+var statusEntriesMux = &sync.RWMutex{}
+
+// STATUS_HISTORY_SIZE is how many transitions StatusHistory keeps per proc.
+const STATUS_HISTORY_SIZE = 20
+
+type statusRing struct {
+	entries [STATUS_HISTORY_SIZE]StatusEntry
+	n       int // entries used
+	next    int // index of next entry
+}
+
+func (r *statusRing) add(e StatusEntry) {
+	r.entries[r.next] = e
+	r.next = (r.next + 1) % STATUS_HISTORY_SIZE
+	if r.n < STATUS_HISTORY_SIZE {
+		r.n++
+	}
+}
+
+func (r *statusRing) all() []StatusEntry {
+	all := make([]StatusEntry, r.n)
+	first := (r.next - r.n + STATUS_HISTORY_SIZE) % STATUS_HISTORY_SIZE
+	for i := 0; i < r.n; i++ {
+		all[i] = r.entries[(first+i)%STATUS_HISTORY_SIZE]
+	}
+	return all
+}
+
+// StatusHistory returns the last STATUS_HISTORY_SIZE transitions of the procs,
+// oldest first, so intermittent problems (e.g. a ws client bouncing between
+// Connected and Disconnected) are visible after recovery.
+func StatusHistory(procs []string) map[string][]StatusEntry {
+	statusEntriesMux.RLock()
+	defer statusEntriesMux.RUnlock()
+	history := make(map[string][]StatusEntry, len(procs))
+	for _, proc := range procs {
+		if r, ok := statusHistory[proc]; ok {
+			history[proc] = r.all()
+		} else {
+			history[proc] = []StatusEntry{}
+		}
+	}
+	return history
+}
+
+// StructuredStatus returns the entries of the flat status.  A proc without a
+// matching entry, i.e. its status was not set by a Status, has only State.
+func StructuredStatus(status map[string]string) map[string]StatusEntry {
+	statusEntriesMux.RLock()
+	defer statusEntriesMux.RUnlock()
+	structured := make(map[string]StatusEntry, len(status))
+	for proc, val := range status {
+		if e, ok := statusEntries[proc]; ok && e.String() == val {
+			structured[proc] = e
+		} else {
+			structured[proc] = StatusEntry{State: val}
+		}
+	}
+	return structured
+}
+
 type Status struct {
 	status map[string]string
 	mux    *sync.RWMutex
@@ -50,7 +132,7 @@ func (s *Status) Update(proc string, status string) {
 	if _, ok := s.status[proc]; !ok {
 		return
 	}
-	s.status[proc] = status
+	s.update(proc, StatusEntry{State: status})
 }
 
 func (s *Status) UpdateRe(proc string, status string, cmd *proto.Cmd) {
@@ -59,7 +141,27 @@ func (s *Status) UpdateRe(proc string, status string, cmd *proto.Cmd) {
 	if _, ok := s.status[proc]; !ok {
 		return
 	}
-	s.status[proc] = fmt.Sprintf("%s %s", status, cmd)
+	s.update(proc, StatusEntry{State: status, Detail: fmt.Sprintf("%s", cmd)})
+}
+
+// update sets the status of proc and, if it changed, when.  The caller must
+// hold s.mux.
+func (s *Status) update(proc string, e StatusEntry) {
+	val := e.String()
+	statusEntriesMux.Lock()
+	defer statusEntriesMux.Unlock()
+	if prev, ok := statusEntries[proc]; ok && s.status[proc] == val && prev.String() == val {
+		return // no transition
+	}
+	s.status[proc] = val
+	e.Since = time.Now().UTC()
+	statusEntries[proc] = e
+	r, ok := statusHistory[proc]
+	if !ok {
+		r = &statusRing{}
+		statusHistory[proc] = r
+	}
+	r.add(e)
 }
 
 func (s *Status) Get(proc string) string {
@@ -72,6 +174,11 @@ func (s *Status) Get(proc string) string {
 	return status
 }
 
+// Entries returns the structured status, see StatusEntry.
+func (s *Status) Entries() map[string]StatusEntry {
+	return StructuredStatus(s.All())
+}
+
 func (s *Status) All() map[string]string {
 	all := make(map[string]string)
 	s.mux.RLock()
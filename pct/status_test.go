@@ -0,0 +1,76 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package pct_test
+
+import (
+	"fmt"
+	"github.com/percona/cloud-protocol/proto/v1"
+	"github.com/percona/percona-agent/pct"
+	. "gopkg.in/check.v1"
+	"time"
+)
+
+/////////////////////////////////////////////////////////////////////////////
+// status.go test suite
+/////////////////////////////////////////////////////////////////////////////
+
+type StatusTestSuite struct {
+}
+
+var _ = Suite(&StatusTestSuite{})
+
+func (s *StatusTestSuite) TestEntries(t *C) {
+	status := pct.NewStatus([]string{"status-test"})
+	status.Update("status-test", "Idle")
+	e := status.Entries()["status-test"]
+	t.Check(e.State, Equals, "Idle")
+	t.Check(e.Detail, Equals, "")
+	since := e.Since
+	t.Check(since.IsZero(), Equals, false)
+
+	// Same status isn't a transition.
+	time.Sleep(10 * time.Millisecond)
+	status.Update("status-test", "Idle")
+	t.Check(status.Entries()["status-test"].Since, Equals, since)
+
+	// UpdateRe: the cmd is the detail.
+	cmd := &proto.Cmd{Service: "qan", Cmd: "StartService"}
+	status.UpdateRe("status-test", "Handling", cmd)
+	e = status.Entries()["status-test"]
+	t.Check(e.State, Equals, "Handling")
+	t.Check(e.Detail, Equals, cmd.String())
+	t.Check(e.Since.After(since), Equals, true)
+	t.Check(status.Get("status-test"), Equals, "Handling "+cmd.String())
+
+	// Flat status not set by a Status has only State.
+	structured := pct.StructuredStatus(map[string]string{"other": "Running"})
+	t.Check(structured["other"], DeepEquals, pct.StatusEntry{State: "Running"})
+}
+
+func (s *StatusTestSuite) TestHistory(t *C) {
+	status := pct.NewStatus([]string{"status-history-test"})
+	for i := 0; i < pct.STATUS_HISTORY_SIZE+5; i++ {
+		status.Update("status-history-test", fmt.Sprintf("State %d", i))
+	}
+	history := pct.StatusHistory([]string{"status-history-test", "status-history-unknown"})
+	got := history["status-history-test"]
+	t.Assert(got, HasLen, pct.STATUS_HISTORY_SIZE)
+	t.Check(got[0].State, Equals, "State 5") // oldest
+	t.Check(got[pct.STATUS_HISTORY_SIZE-1].State, Equals, fmt.Sprintf("State %d", pct.STATUS_HISTORY_SIZE+4))
+	t.Check(history["status-history-unknown"], HasLen, 0)
+}
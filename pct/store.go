@@ -0,0 +1,508 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package pct
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+const (
+	STORE_FILE    = "agent.db"
+	STORE_TIMEOUT = 5 * time.Second // wait for another process, e.g. the agent, to finish a transaction
+)
+
+// Store buckets.
+const (
+	STORE_META    = "meta"    // schema version, see StoreMigrations
+	STORE_STATE   = "state"   // single values: reply-cache, update-keys, anonymize-key
+	STORE_AUDIT   = "audit"   // audit log entries, see StoreTx.Append
+	STORE_CONFIGS = "configs" // configs by name, e.g. agent, mysql-1; see Basedir.ReadConfig
+	STORE_OFFSETS = "offsets" // QAN slow log offsets by instance, e.g. mysql-1
+)
+
+// A Store is the embedded database of agent state which used to be separate
+// files: the configs (including instance configs), QAN slow log offsets, audit
+// log, reply cache, update key manifest, and anonymize key.  Changes are made
+// in transactions, so a crash or full disk never leaves partial state, and all
+// state is backed up by Backup.  Values are JSON.
+//
+// The store file is locked only during a transaction, and shared by readers,
+// so other processes like the installer and percona-agent -self-check can read
+// configs while the agent runs.
+type Store struct {
+	file      string
+	dir       string // of the old state files, see importStateFiles
+	configDir string // of the old config files, see importConfigFiles
+	mux       sync.Mutex
+	closed    bool
+}
+
+// A StoreTx is a read-only (Store.View) or read-write (Store.Update)
+// transaction.
+type StoreTx struct {
+	tx        *bolt.Tx
+	dir       string
+	configDir string
+	imported  []string // old files to remove after commit
+}
+
+// A StoreMigration changes the store from one schema version to the next.
+type StoreMigration func(tx *StoreTx) error
+
+// StoreMigrations are applied in order by OpenStore, each in its own
+// transaction.  The schema version is the number of migrations applied, so
+// new migrations are appended; old ones are never changed or removed.
+var StoreMigrations = []StoreMigration{
+	importStateFiles,  // 1
+	importConfigFiles, // 2
+}
+
+// OpenStore opens the store in file, creating it if it does not exist, and
+// applies new StoreMigrations.  configDir has the config files to import, see
+// importConfigFiles.
+func OpenStore(file, configDir string) (*Store, error) {
+	s := &Store{
+		file:      file,
+		dir:       filepath.Dir(file),
+		configDir: configDir,
+	}
+	if err := s.migrate(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Close waits for the current transaction, if any.  The store cannot be used
+// after.
+func (s *Store) Close() error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.closed = true
+	return nil
+}
+
+// Version returns the schema version, see StoreMigrations.
+func (s *Store) Version() (int, error) {
+	version := 0
+	err := s.view(func(tx *bolt.Tx) error {
+		var err error
+		version, err = storeVersion(tx)
+		return err
+	})
+	return version, err
+}
+
+// View runs fn in a read-only transaction.
+func (s *Store) View(fn func(tx *StoreTx) error) error {
+	return s.view(func(tx *bolt.Tx) error {
+		return fn(s.tx(tx))
+	})
+}
+
+// Update runs fn in a read-write transaction which is committed if fn returns
+// nil, else rolled back.
+func (s *Store) Update(fn func(tx *StoreTx) error) error {
+	return s.update(func(tx *bolt.Tx) error {
+		return fn(s.tx(tx))
+	})
+}
+
+// Get decodes the value of key in bucket into v.  It returns false if there
+// is no value.
+func (s *Store) Get(bucket, key string, v interface{}) (bool, error) {
+	found := false
+	err := s.View(func(tx *StoreTx) error {
+		var err error
+		found, err = tx.Get(bucket, key, v)
+		return err
+	})
+	return found, err
+}
+
+// Put sets the value of key in bucket to v.
+func (s *Store) Put(bucket, key string, v interface{}) error {
+	return s.Update(func(tx *StoreTx) error {
+		return tx.Put(bucket, key, v)
+	})
+}
+
+// Backup writes a consistent copy of the store to w.  The copy is a store
+// file, so it is restored by replacing STORE_FILE while the agent is stopped.
+func (s *Store) Backup(w io.Writer) (int64, error) {
+	var n int64
+	err := s.view(func(tx *bolt.Tx) error {
+		var err error
+		n, err = tx.WriteTo(w)
+		return err
+	})
+	return n, err
+}
+
+func (s *Store) tx(tx *bolt.Tx) *StoreTx {
+	return &StoreTx{
+		tx:        tx,
+		dir:       s.dir,
+		configDir: s.configDir,
+	}
+}
+
+// view runs fn in a read-only transaction, opening the store file for it with
+// a shared lock.  Transactions of the process are serialized because a process
+// cannot hold a shared and an exclusive lock of a file.
+func (s *Store) view(fn func(tx *bolt.Tx) error) error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	db, err := s.open(true)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	return db.View(fn)
+}
+
+// update runs fn in a read-write transaction, opening the store file for it
+// with an exclusive lock, see view.
+func (s *Store) update(fn func(tx *bolt.Tx) error) error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	db, err := s.open(false)
+	if err != nil {
+		return err
+	}
+	err = db.Update(fn)
+	if closeErr := db.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func (s *Store) open(readOnly bool) (*bolt.DB, error) {
+	if s.closed {
+		return nil, bolt.ErrDatabaseNotOpen
+	}
+	db, err := bolt.Open(s.file, 0600, &bolt.Options{Timeout: STORE_TIMEOUT, ReadOnly: readOnly})
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", s.file, err)
+	}
+	return db, nil
+}
+
+func (s *Store) migrate() error {
+	// Usually there's nothing to do, so check with a shared lock first: a
+	// process reading configs needn't wait for the agent or write the file.
+	if FileExists(s.file) {
+		version, err := s.Version()
+		if err == nil && version == len(StoreMigrations) {
+			return nil
+		}
+	}
+	for {
+		done := false
+		var tx *StoreTx
+		err := s.update(func(btx *bolt.Tx) error {
+			tx = s.tx(btx)
+			version, err := storeVersion(btx)
+			if err != nil {
+				return fmt.Errorf("%s: %s", s.file, err)
+			}
+			if version > len(StoreMigrations) {
+				return fmt.Errorf("%s: schema version %d is newer than this agent supports (%d)", s.file, version, len(StoreMigrations))
+			}
+			if version == len(StoreMigrations) {
+				done = true
+				return nil
+			}
+			if err := StoreMigrations[version](tx); err != nil {
+				return fmt.Errorf("%s: migration %d: %s", s.file, version+1, err)
+			}
+			meta, err := btx.CreateBucketIfNotExists([]byte(STORE_META))
+			if err != nil {
+				return err
+			}
+			return meta.Put([]byte("version"), []byte(strconv.Itoa(version+1)))
+		})
+		if err != nil {
+			return err
+		}
+		if done {
+			return nil
+		}
+		// The state is in the store now, so the old files can go.
+		for _, file := range tx.imported {
+			if err := RemoveFile(file); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func storeVersion(tx *bolt.Tx) (int, error) {
+	meta := tx.Bucket([]byte(STORE_META))
+	if meta == nil {
+		return 0, nil
+	}
+	v := meta.Get([]byte("version"))
+	if v == nil {
+		return 0, nil
+	}
+	return strconv.Atoi(string(v))
+}
+
+// Get decodes the value of key in bucket into v.  It returns false if there
+// is no value.
+func (tx *StoreTx) Get(bucket, key string, v interface{}) (bool, error) {
+	b := tx.tx.Bucket([]byte(bucket))
+	if b == nil {
+		return false, nil
+	}
+	data := b.Get([]byte(key))
+	if data == nil {
+		return false, nil
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return true, fmt.Errorf("%s/%s: %s", bucket, key, err)
+	}
+	return true, nil
+}
+
+// Put sets the value of key in bucket to v, creating the bucket if needed.
+func (tx *StoreTx) Put(bucket, key string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	b, err := tx.tx.CreateBucketIfNotExists([]byte(bucket))
+	if err != nil {
+		return err
+	}
+	return b.Put([]byte(key), data)
+}
+
+// Delete removes key from bucket.  It is not an error if there is no key.
+func (tx *StoreTx) Delete(bucket, key string) error {
+	b := tx.tx.Bucket([]byte(bucket))
+	if b == nil {
+		return nil
+	}
+	return b.Delete([]byte(key))
+}
+
+// Keys returns the keys in bucket, sorted.
+func (tx *StoreTx) Keys(bucket string) []string {
+	keys := []string{}
+	b := tx.tx.Bucket([]byte(bucket))
+	if b == nil {
+		return keys
+	}
+	b.ForEach(func(k, v []byte) error {
+		keys = append(keys, string(k))
+		return nil
+	})
+	return keys
+}
+
+// Append puts v in bucket with the next sequence number of the bucket as its
+// key, see SequenceKey, and returns the sequence number.  The values of a
+// bucket used only by Append are in the order appended.
+func (tx *StoreTx) Append(bucket string, v interface{}) (uint64, error) {
+	b, err := tx.tx.CreateBucketIfNotExists([]byte(bucket))
+	if err != nil {
+		return 0, err
+	}
+	seq, err := b.NextSequence()
+	if err != nil {
+		return 0, err
+	}
+	return seq, tx.Put(bucket, SequenceKey(seq), v)
+}
+
+// Last returns the last n values in bucket, oldest first.
+func (tx *StoreTx) Last(bucket string, n int) ([]json.RawMessage, error) {
+	values := []json.RawMessage{}
+	b := tx.tx.Bucket([]byte(bucket))
+	if b == nil {
+		return values, nil
+	}
+	c := b.Cursor()
+	for k, v := c.Last(); k != nil && len(values) < n; k, v = c.Prev() {
+		values = append(values, append(json.RawMessage{}, v...))
+	}
+	for i, j := 0, len(values)-1; i < j; i, j = i+1, j-1 {
+		values[i], values[j] = values[j], values[i]
+	}
+	return values, nil
+}
+
+// SequenceKey returns the key of sequence number seq, see StoreTx.Append.
+// Keys are zero-padded so that they sort in sequence order.
+func SequenceKey(seq uint64) string {
+	return fmt.Sprintf("%020d", seq)
+}
+
+// importStateFiles imports the state files of agents before the store, then
+// they are removed.  Invalid files are not imported because the agent ignored
+// them, too, except the update key manifest which must be valid.
+func importStateFiles(tx *StoreTx) error {
+	for _, f := range []struct {
+		file     string
+		key      string
+		required bool
+	}{
+		{REPLY_CACHE, "reply-cache", false},
+		{UPDATE_KEYS, "update-keys", true},
+	} {
+		file := filepath.Join(tx.dir, f.file)
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return err
+		}
+		var v json.RawMessage
+		if err := json.Unmarshal(data, &v); err != nil {
+			if f.required {
+				return fmt.Errorf("%s: %s", file, err)
+			}
+		} else if err := tx.Put(STORE_STATE, f.key, &v); err != nil {
+			return err
+		}
+		tx.imported = append(tx.imported, file)
+	}
+
+	file := filepath.Join(tx.dir, ANONYMIZE_KEY)
+	if data, err := ioutil.ReadFile(file); err == nil {
+		key := strings.TrimSpace(string(data))
+		if _, err := hex.DecodeString(key); err != nil {
+			return fmt.Errorf("%s: %s", file, err)
+		}
+		if err := tx.Put(STORE_STATE, "anonymize-key", key); err != nil {
+			return err
+		}
+		tx.imported = append(tx.imported, file)
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	// Audit logs, oldest first: audit.log.N (oldest) to audit.log.1, then
+	// audit.log.
+	files, err := filepath.Glob(filepath.Join(tx.dir, AUDIT_LOG) + ".*")
+	if err != nil {
+		return err
+	}
+	sort.Sort(sort.Reverse(byRotation(files)))
+	if file := filepath.Join(tx.dir, AUDIT_LOG); FileExists(file) {
+		files = append(files, file)
+	}
+	for _, file := range files {
+		if err := importAuditLog(tx, file); err != nil {
+			return fmt.Errorf("%s: %s", file, err)
+		}
+		tx.imported = append(tx.imported, file)
+	}
+	return nil
+}
+
+// importConfigFiles imports the config files, e.g. agent.conf and mysql-1.yml,
+// as JSON with their credential references, then they are removed with the
+// files of other formats they overrode.  Invalid files are not imported: they
+// stay files, so the agent reports them like before.
+func importConfigFiles(tx *StoreTx) error {
+	if tx.configDir == "" {
+		return nil
+	}
+	files, err := GlobConfigFiles(tx.configDir, "*")
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		if data, err = ConfigToJSON(data, ConfigFormat(file)); err != nil {
+			continue
+		}
+		if len(bytes.TrimSpace(data)) == 0 {
+			data = []byte("{}") // empty file, no settings
+		}
+		var v json.RawMessage
+		if err := json.Unmarshal(data, &v); err != nil {
+			continue
+		}
+		name := ConfigName(file)
+		if err := tx.Put(STORE_CONFIGS, name, &v); err != nil {
+			return err
+		}
+		for _, suffix := range configSuffixes {
+			if file := filepath.Join(tx.configDir, name+suffix); FileExists(file) {
+				tx.imported = append(tx.imported, file)
+			}
+		}
+	}
+	return nil
+}
+
+func importAuditLog(tx *StoreTx, file string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var entry json.RawMessage
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			continue // partial line, e.g. disk full
+		}
+		if _, err := tx.Append(STORE_AUDIT, &entry); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+// byRotation sorts rotated files like audit.log.1 by their number, so .10
+// is after .9.
+type byRotation []string
+
+func (a byRotation) Len() int      { return len(a) }
+func (a byRotation) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
+func (a byRotation) Less(i, j int) bool {
+	return rotation(a[i]) < rotation(a[j])
+}
+
+func rotation(file string) int {
+	n, _ := strconv.Atoi(filepath.Ext(file)[1:])
+	return n
+}
@@ -0,0 +1,247 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package pct_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/percona/percona-agent/pct"
+	. "gopkg.in/check.v1"
+)
+
+/////////////////////////////////////////////////////////////////////////////
+// store.go test suite
+/////////////////////////////////////////////////////////////////////////////
+
+type StoreTestSuite struct {
+	tmpDir string
+}
+
+var _ = Suite(&StoreTestSuite{})
+
+func (s *StoreTestSuite) SetUpTest(t *C) {
+	var err error
+	s.tmpDir, err = ioutil.TempDir("/tmp", "agent-test")
+	t.Assert(err, IsNil)
+}
+
+func (s *StoreTestSuite) TearDownTest(t *C) {
+	if err := os.RemoveAll(s.tmpDir); err != nil {
+		t.Error(err)
+	}
+}
+
+func (s *StoreTestSuite) TestImportStateFiles(t *C) {
+	// State files of an agent before the store.
+	files := map[string]string{
+		pct.REPLY_CACHE:      `[{"Key":"k1"}]`,
+		pct.UPDATE_KEYS:      `{"Serial":2}`,
+		pct.ANONYMIZE_KEY:    "0a0b\n",
+		pct.AUDIT_LOG + ".2": `{"Cmd":"Cmd1"}` + "\n",
+		pct.AUDIT_LOG + ".1": `{"Cmd":"Cmd2"}` + "\n" + `{"Cmd":"Cm`,
+		pct.AUDIT_LOG:        `{"Cmd":"Cmd3"}` + "\n",
+	}
+	for file, data := range files {
+		err := ioutil.WriteFile(filepath.Join(s.tmpDir, file), []byte(data), 0600)
+		t.Assert(err, IsNil)
+	}
+
+	store, err := pct.OpenStore(filepath.Join(s.tmpDir, pct.STORE_FILE), "")
+	t.Assert(err, IsNil)
+	defer store.Close()
+
+	version, err := store.Version()
+	t.Assert(err, IsNil)
+	t.Check(version, Equals, len(pct.StoreMigrations))
+
+	replies := []map[string]string{}
+	found, err := store.Get(pct.STORE_STATE, "reply-cache", &replies)
+	t.Assert(err, IsNil)
+	t.Check(found, Equals, true)
+	t.Check(replies, DeepEquals, []map[string]string{{"Key": "k1"}})
+
+	keys := map[string]uint64{}
+	found, err = store.Get(pct.STORE_STATE, "update-keys", &keys)
+	t.Assert(err, IsNil)
+	t.Check(found, Equals, true)
+	t.Check(keys["Serial"], Equals, uint64(2))
+
+	anonKey := ""
+	found, err = store.Get(pct.STORE_STATE, "anonymize-key", &anonKey)
+	t.Assert(err, IsNil)
+	t.Check(anonKey, Equals, "0a0b")
+
+	// Audit logs are imported oldest first; the partial line is skipped.
+	var values []json.RawMessage
+	err = store.View(func(tx *pct.StoreTx) error {
+		values, err = tx.Last(pct.STORE_AUDIT, 10)
+		return err
+	})
+	t.Assert(err, IsNil)
+	t.Assert(values, HasLen, 3)
+	t.Check(string(values[0]), Equals, `{"Cmd":"Cmd1"}`)
+	t.Check(string(values[2]), Equals, `{"Cmd":"Cmd3"}`)
+
+	// The imported files are removed.
+	for file := range files {
+		t.Check(pct.FileExists(filepath.Join(s.tmpDir, file)), Equals, false, Commentf(file))
+	}
+}
+
+func (s *StoreTestSuite) TestImportConfigFiles(t *C) {
+	configDir := filepath.Join(s.tmpDir, "config")
+	err := os.Mkdir(configDir, 0700)
+	t.Assert(err, IsNil)
+	files := map[string]string{
+		"agent.conf":   `{"ApiKey":"{credentials:agent.ApiKey}"}`,
+		"mysql-1.conf": `{"Id":1}`,
+		"mysql-1.yml":  "Id: 2\n", // overridden by mysql-1.conf
+		"qan.toml":     "Interval = 60\n",
+		"log.conf":     "",
+		"bad.conf":     `{"Id":`,
+	}
+	for file, data := range files {
+		err := ioutil.WriteFile(filepath.Join(configDir, file), []byte(data), 0600)
+		t.Assert(err, IsNil)
+	}
+
+	store, err := pct.OpenStore(filepath.Join(s.tmpDir, pct.STORE_FILE), configDir)
+	t.Assert(err, IsNil)
+	defer store.Close()
+
+	expect := map[string]string{
+		"agent":   `{"ApiKey":"{credentials:agent.ApiKey}"}`,
+		"mysql-1": `{"Id":1}`,
+		"qan":     `{"Interval":60}`,
+		"log":     `{}`,
+	}
+	err = store.View(func(tx *pct.StoreTx) error {
+		t.Check(tx.Keys(pct.STORE_CONFIGS), DeepEquals, []string{"agent", "log", "mysql-1", "qan"})
+		for name, config := range expect {
+			var v json.RawMessage
+			found, err := tx.Get(pct.STORE_CONFIGS, name, &v)
+			t.Check(err, IsNil)
+			t.Check(found, Equals, true)
+			t.Check(string(v), Equals, config, Commentf(name))
+		}
+		return nil
+	})
+	t.Assert(err, IsNil)
+
+	// The imported files are removed, the invalid one is kept.
+	for file := range files {
+		t.Check(pct.FileExists(filepath.Join(configDir, file)), Equals, file == "bad.conf", Commentf(file))
+	}
+}
+
+func (s *StoreTestSuite) TestNotLocked(t *C) {
+	// The file is locked only during a transaction, so another process,
+	// e.g. the installer, can use the store while the agent runs.
+	file := filepath.Join(s.tmpDir, pct.STORE_FILE)
+	store, err := pct.OpenStore(file, "")
+	t.Assert(err, IsNil)
+	defer store.Close()
+	err = store.Put(pct.STORE_STATE, "foo", "bar")
+	t.Assert(err, IsNil)
+
+	other, err := pct.OpenStore(file, "")
+	t.Assert(err, IsNil)
+	defer other.Close()
+	v := ""
+	found, err := other.Get(pct.STORE_STATE, "foo", &v)
+	t.Assert(err, IsNil)
+	t.Check(found, Equals, true)
+	t.Check(v, Equals, "bar")
+}
+
+func (s *StoreTestSuite) TestInvalidUpdateKeys(t *C) {
+	// An invalid key manifest is an error, like it was for Keyring.Load, and
+	// the file is kept.
+	file := filepath.Join(s.tmpDir, pct.UPDATE_KEYS)
+	err := ioutil.WriteFile(file, []byte(`{"Serial":`), 0600)
+	t.Assert(err, IsNil)
+	_, err = pct.OpenStore(filepath.Join(s.tmpDir, pct.STORE_FILE), "")
+	t.Check(err, NotNil)
+	t.Check(pct.FileExists(file), Equals, true)
+}
+
+func (s *StoreTestSuite) TestUpdate(t *C) {
+	store, err := pct.OpenStore(filepath.Join(s.tmpDir, pct.STORE_FILE), "")
+	t.Assert(err, IsNil)
+	defer store.Close()
+
+	v := ""
+	found, err := store.Get(pct.STORE_STATE, "foo", &v)
+	t.Assert(err, IsNil)
+	t.Check(found, Equals, false)
+
+	err = store.Put(pct.STORE_STATE, "foo", "bar")
+	t.Assert(err, IsNil)
+
+	// A failed transaction changes nothing.
+	err = store.Update(func(tx *pct.StoreTx) error {
+		if err := tx.Put(pct.STORE_STATE, "foo", "baz"); err != nil {
+			return err
+		}
+		if _, err := tx.Append(pct.STORE_AUDIT, "entry"); err != nil {
+			return err
+		}
+		return errors.New("failed")
+	})
+	t.Check(err, ErrorMatches, "failed")
+	found, err = store.Get(pct.STORE_STATE, "foo", &v)
+	t.Assert(err, IsNil)
+	t.Check(found, Equals, true)
+	t.Check(v, Equals, "bar")
+	err = store.View(func(tx *pct.StoreTx) error {
+		values, err := tx.Last(pct.STORE_AUDIT, 10)
+		t.Check(values, HasLen, 0)
+		return err
+	})
+	t.Assert(err, IsNil)
+}
+
+func (s *StoreTestSuite) TestBackup(t *C) {
+	store, err := pct.OpenStore(filepath.Join(s.tmpDir, pct.STORE_FILE), "")
+	t.Assert(err, IsNil)
+	err = store.Put(pct.STORE_STATE, "foo", "bar")
+	t.Assert(err, IsNil)
+
+	buf := &bytes.Buffer{}
+	_, err = store.Backup(buf)
+	t.Assert(err, IsNil)
+	store.Close()
+
+	// The backup is a store.
+	backupFile := filepath.Join(s.tmpDir, "backup.db")
+	err = ioutil.WriteFile(backupFile, buf.Bytes(), 0600)
+	t.Assert(err, IsNil)
+	backup, err := pct.OpenStore(backupFile, "")
+	t.Assert(err, IsNil)
+	defer backup.Close()
+	v := ""
+	found, err := backup.Get(pct.STORE_STATE, "foo", &v)
+	t.Assert(err, IsNil)
+	t.Check(found, Equals, true)
+	t.Check(v, Equals, "bar")
+}
@@ -20,8 +20,10 @@ package pct
 import (
 	"fmt"
 	"os"
+	"path/filepath"
 	"regexp"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/hashicorp/go-version"
@@ -70,6 +72,36 @@ func RemoveFile(file string) error {
 	return nil
 }
 
+// WriteFile writes data to file like ioutil.WriteFile, but atomically: data is
+// written and synced to a temp file which is renamed to file, so a crash or
+// full disk never leaves a partial file.  If file is a symlink, its target is
+// replaced.  The file has mode perm even if it existed.
+func WriteFile(file string, data []byte, perm os.FileMode) error {
+	if target, err := filepath.EvalSymlinks(file); err == nil {
+		file = target
+	}
+	tmpFile := file + ".tmp"
+	f, err := os.OpenFile(tmpFile, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(tmpFile, perm) // OpenFile does not change the mode of an existing file
+	}
+	if err != nil {
+		os.Remove(tmpFile)
+		return err
+	}
+	return os.Rename(tmpFile, file)
+}
+
 func FileExists(file string) bool {
 	_, err := os.Stat(file)
 	if err == nil {
@@ -173,7 +205,11 @@ func Duration(s float64) string {
 }
 
 func TimeString(t time.Time) string {
-	return t.UTC().Format("2006-01-02 15:04:05 MST")
+	s := t.UTC().Format("2006-01-02 15:04:05 MST")
+	if atomic.LoadInt32(&localTime) == 1 {
+		s += " (" + t.Local().Format("2006-01-02 15:04:05 MST") + ")"
+	}
+	return s
 }
 
 func AtLeastVersion(v1, v2 string) (bool, error) {
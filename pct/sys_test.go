@@ -20,7 +20,10 @@ package pct_test
 import (
 	"github.com/percona/percona-agent/pct"
 	. "gopkg.in/check.v1"
+	"io/ioutil"
 	"os"
+	"path/filepath"
+	"time"
 )
 
 /////////////////////////////////////////////////////////////////////////////
@@ -89,6 +92,35 @@ func (s *SysTestSuite) TestSameFile(t *C) {
 	}
 }
 
+func (s *SysTestSuite) TestWriteFile(t *C) {
+	tmpDir, err := ioutil.TempDir("/tmp", "pct-test")
+	t.Assert(err, IsNil)
+	defer os.RemoveAll(tmpDir)
+
+	// An existing file is replaced and gets the new mode.
+	file := filepath.Join(tmpDir, "state.json")
+	t.Assert(ioutil.WriteFile(file, []byte("old data, longer than new data"), 0644), IsNil)
+	t.Assert(pct.WriteFile(file, []byte("new"), 0600), IsNil)
+	data, err := ioutil.ReadFile(file)
+	t.Assert(err, IsNil)
+	t.Check(string(data), Equals, "new")
+	fi, err := os.Stat(file)
+	t.Assert(err, IsNil)
+	t.Check(fi.Mode().Perm(), Equals, os.FileMode(0600))
+	t.Check(pct.FileExists(file+".tmp"), Equals, false)
+
+	// The target of a symlink is replaced, not the symlink.
+	link := filepath.Join(tmpDir, "link.json")
+	t.Assert(os.Symlink(file, link), IsNil)
+	t.Assert(pct.WriteFile(link, []byte("via link"), 0600), IsNil)
+	data, err = ioutil.ReadFile(file)
+	t.Assert(err, IsNil)
+	t.Check(string(data), Equals, "via link")
+	fi, err = os.Lstat(link)
+	t.Assert(err, IsNil)
+	t.Check(fi.Mode()&os.ModeSymlink, Equals, os.ModeSymlink)
+}
+
 func (s *SysTestSuite) TestMbps(t *C) {
 	t.Check(pct.Mbps(0, 1.0), Equals, "0.00")
 	t.Check(pct.Mbps(12749201, 0), Equals, "0.00")
@@ -133,6 +165,16 @@ func (s *SysTestSuite) TestDuration(t *C) {
 	t.Check(pct.Duration(100000), Equals, "1d3h46m40s")
 }
 
+func (s *SysTestSuite) TestTimeString(t *C) {
+	ts := time.Date(2015, 5, 20, 10, 30, 0, 0, time.UTC)
+	t.Check(pct.TimeString(ts), Equals, "2015-05-20 10:30:00 UTC")
+
+	pct.SetLocalTime(true)
+	defer pct.SetLocalTime(false)
+	local := ts.Local().Format("2006-01-02 15:04:05 MST")
+	t.Check(pct.TimeString(ts), Equals, "2015-05-20 10:30:00 UTC ("+local+")")
+}
+
 func (s *SysTestSuite) TestAtLeastVersion(t *C) {
 	var got bool
 	var err error
@@ -163,3 +205,21 @@ func (s *SysTestSuite) TestAtLeastVersion(t *C) {
 	t.Check(err, IsNil)
 	t.Check(got, Equals, true)
 }
+
+func (s *SysTestSuite) TestFingerprint(t *C) {
+	t.Check(pct.Fingerprint("", "", nil), Equals, "")
+
+	// MAC address order doesn't matter.
+	fp := pct.Fingerprint("", "", []string{"00:11:22:33:44:55", "66:77:88:99:aa:bb"})
+	t.Check(fp, HasLen, 64)
+	t.Check(pct.Fingerprint("", "", []string{"66:77:88:99:aa:bb", "00:11:22:33:44:55"}), Equals, fp)
+
+	// Every identifier changes the fingerprint.
+	fp = pct.Fingerprint("abc", "i-123", nil)
+	t.Check(pct.Fingerprint("abd", "i-123", nil), Not(Equals), fp)
+	t.Check(pct.Fingerprint("abc", "i-124", nil), Not(Equals), fp)
+	t.Check(pct.Fingerprint("", "abci-123", nil), Not(Equals), fp)
+
+	// The host fingerprint is stable.
+	t.Check(pct.HostFingerprint(), Equals, pct.HostFingerprint())
+}
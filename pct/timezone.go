@@ -0,0 +1,80 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package pct
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	tzOnce sync.Once
+	tzName string
+)
+
+// Timezone returns the name of the local timezone, e.g. "America/New_York",
+// and its current offset from UTC in seconds.  All agent timestamps are UTC,
+// but reports include this so users can correlate data with local events
+// like cron jobs.  If the timezone has no name, its abbreviation is used.
+func Timezone() (string, int) {
+	tzOnce.Do(func() {
+		tzName = timezoneName()
+	})
+	abbr, offset := time.Now().Zone()
+	if tzName == "" {
+		return abbr, offset
+	}
+	return tzName, offset
+}
+
+func timezoneName() string {
+	if tz := strings.TrimPrefix(os.Getenv("TZ"), ":"); tz != "" {
+		return tz
+	}
+	// Debian and Ubuntu
+	if data, err := ioutil.ReadFile("/etc/timezone"); err == nil {
+		if tz := strings.TrimSpace(string(data)); tz != "" {
+			return tz
+		}
+	}
+	// Red Hat, CentOS, etc.: /etc/localtime -> /usr/share/zoneinfo/America/New_York
+	if link, err := filepath.EvalSymlinks("/etc/localtime"); err == nil {
+		if i := strings.Index(link, "zoneinfo/"); i > -1 {
+			return link[i+len("zoneinfo/"):]
+		}
+	}
+	return ""
+}
+
+// localTime is 1 if TimeString includes local time, else 0.
+var localTime int32
+
+// SetLocalTime makes TimeString include the local time, too.  Times are
+// still UTC first, the local time is only for display.
+func SetLocalTime(on bool) {
+	var v int32
+	if on {
+		v = 1
+	}
+	atomic.StoreInt32(&localTime, v)
+}
@@ -0,0 +1,186 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package pct
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TLS for API and websocket connections, e.g. from agent.Config, for an API
+// behind a private PKI.  If not set, the system CAs are used and no client
+// cert is sent.
+var tlsConfig *tls.Config
+var tlsPins []string
+var tlsMux = &sync.RWMutex{}
+
+// SPKI pins are like "sha256/<base64 SHA-256 of the cert public key>", the
+// HPKP format, e.g. from:
+//
+//	openssl x509 -in cert.pem -pubkey -noout | openssl pkey -pubin -outform der |
+//	openssl dgst -sha256 -binary | base64
+const PIN_PREFIX = "sha256/"
+
+// LoadTLSConfig returns a TLS config with the CA bundle and client cert and
+// key (PEM files), or nil if none are given.  Every pin must be valid.
+func LoadTLSConfig(caFile, certFile, keyFile string, pins []string) (*tls.Config, error) {
+	for _, pin := range pins {
+		if err := validatePin(pin); err != nil {
+			return nil, err
+		}
+	}
+	if caFile == "" && certFile == "" && keyFile == "" {
+		return nil, nil
+	}
+	config := &tls.Config{}
+	if caFile != "" {
+		pem, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("Cannot read CA bundle: %s", err)
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("No certs in CA bundle %s", caFile)
+		}
+	}
+	if certFile != "" || keyFile != "" {
+		if certFile == "" || keyFile == "" {
+			return nil, errors.New("Client cert and key must both be set")
+		}
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("Cannot load client cert: %s", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+// SetTLS sets the CA bundle, client cert and key, and SPKI pins used by new
+// connections.  Empty values mean use the system CAs, no client cert, and no
+// pins.
+func SetTLS(caFile, certFile, keyFile string, pins []string) error {
+	config, err := LoadTLSConfig(caFile, certFile, keyFile, pins)
+	if err != nil {
+		return err
+	}
+	tlsMux.Lock()
+	tlsConfig = config
+	tlsPins = pins
+	tlsMux.Unlock()
+	return nil
+}
+
+// TLSConfig returns a new TLS config with the CAs and client cert set by SetTLS,
+// or an empty config.  It's new, not a copy, because a tls.Config must not be
+// copied after use, and callers set other fields like ServerName.
+func TLSConfig() *tls.Config {
+	tlsMux.RLock()
+	defer tlsMux.RUnlock()
+	if tlsConfig == nil {
+		return &tls.Config{}
+	}
+	return &tls.Config{
+		RootCAs:      tlsConfig.RootCAs,
+		Certificates: tlsConfig.Certificates,
+	}
+}
+
+// VerifyPins returns an error if pins are set by SetTLS and none matches a
+// public key in the verified cert chain of the connection.
+func VerifyPins(state tls.ConnectionState) error {
+	tlsMux.RLock()
+	pins := tlsPins
+	tlsMux.RUnlock()
+	if len(pins) == 0 {
+		return nil
+	}
+	for _, chain := range state.VerifiedChains {
+		for _, cert := range chain {
+			if hasPin(pins, SPKIPin(cert)) {
+				return nil
+			}
+		}
+	}
+	return errors.New("No pinned public key in the server cert chain")
+}
+
+// SPKIPin returns the pin of the cert public key.
+func SPKIPin(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return PIN_PREFIX + base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// TLSDial connects to addr (host:port) like ProxyDial, then does TLS with
+// config and verifies the pins.  If config is nil, TLSConfig is used.
+func TLSDial(location *url.URL, addr string, timeout time.Duration, config *tls.Config) (*tls.Conn, error) {
+	if config == nil {
+		config = TLSConfig()
+	}
+	if config.ServerName == "" {
+		config.ServerName, _, _ = net.SplitHostPort(addr)
+	}
+	conn, err := ProxyDial(location, addr, timeout)
+	if err != nil {
+		return nil, err
+	}
+	tlsConn := tls.Client(conn, config)
+	tlsConn.SetDeadline(time.Now().Add(timeout))
+	if err := tlsConn.Handshake(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if !config.InsecureSkipVerify {
+		if err := VerifyPins(tlsConn.ConnectionState()); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("%s: %s", addr, err)
+		}
+	}
+	tlsConn.SetDeadline(time.Time{})
+	return tlsConn, nil
+}
+
+func validatePin(pin string) error {
+	if !strings.HasPrefix(pin, PIN_PREFIX) {
+		return fmt.Errorf("Invalid pin %s: must begin with %s", pin, PIN_PREFIX)
+	}
+	sum, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(pin, PIN_PREFIX))
+	if err != nil || len(sum) != sha256.Size {
+		return fmt.Errorf("Invalid pin %s: must be a base64 SHA-256 hash", pin)
+	}
+	return nil
+}
+
+func hasPin(pins []string, pin string) bool {
+	for _, p := range pins {
+		if p == pin {
+			return true
+		}
+	}
+	return false
+}
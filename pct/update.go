@@ -18,20 +18,64 @@
 package pct
 
 import (
-	"crypto"
-	"crypto/rsa"
-	"crypto/sha256"
-	"crypto/x509"
-	"encoding/pem"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"os/exec"
-	"path/filepath"
 	"strconv"
 	"strings"
+	"time"
 )
 
+// Files next to the current binary, e.g. /usr/local/percona/percona-agent.new.
+// Update writes the new binary to the staged file so it's on the same file
+// system and can be renamed, keeps the current binary as the prev file, and
+// writes a PendingUpdate to the pending file until Commit or Rollback.
+const (
+	UPDATE_STAGED_SUFFIX  = ".new"
+	UPDATE_PREV_SUFFIX    = ".prev"
+	UPDATE_PENDING_SUFFIX = ".update"
+)
+
+// Update channels.  Canary hosts use testing or nightly to run new versions
+// before the fleet.  The latest version and binaries of a channel other than
+// stable are in a subdir of the download link named like the channel.
+const (
+	UPDATE_CHANNEL_STABLE  = "stable"
+	UPDATE_CHANNEL_TESTING = "testing"
+	UPDATE_CHANNEL_NIGHTLY = "nightly"
+)
+
+var UPDATE_CHANNELS = []string{UPDATE_CHANNEL_STABLE, UPDATE_CHANNEL_TESTING, UPDATE_CHANNEL_NIGHTLY}
+
+// ValidateUpdateChannel returns an error if channel is not empty (stable) or
+// one of UPDATE_CHANNELS.
+func ValidateUpdateChannel(channel string) error {
+	if channel == "" {
+		return nil
+	}
+	for _, c := range UPDATE_CHANNELS {
+		if channel == c {
+			return nil
+		}
+	}
+	return fmt.Errorf("Invalid update channel: %s: expected %s", channel, strings.Join(UPDATE_CHANNELS, ", "))
+}
+
+// UPDATE_KEYS_FILE is the signed key manifest at the download link, see
+// Updater.UpdateKeys.
+const UPDATE_KEYS_FILE = "keys.json"
+
+// A PendingUpdate is an update not yet committed: the new version has not
+// connected to the API yet.
+type PendingUpdate struct {
+	Ts          time.Time // when updated, UTC
+	Version     string    // new version
+	PrevVersion string    // version of the prev binary
+}
+
 var PublicKey = []byte(`-----BEGIN PUBLIC KEY-----
 MIICIjANBgkqhkiG9w0BAQEFAAOCAg8AMIICCgKCAgEA3Ks0r5mrqcxOj95VLyCC
 JGkilUyyqIwK9YANtf1qOghQHM4qR1g22c+4iLalzcKuf7fRFWyEOmthUMJEdaPN
@@ -53,19 +97,18 @@ type Updater struct {
 	currentBin     string
 	currentVersion string
 	// --
-	rsaPubKey *rsa.PublicKey
-	major     int64
-	minor     int64
-	patch     int64
+	keyring *Keyring
+	channel string
+	major   int64
+	minor   int64
+	patch   int64
 }
 
 func NewUpdater(logger *Logger, api APIConnector, pubKey []byte, currentBin, currentVersion string) *Updater {
-	pubkeyMarshaled, _ := pem.Decode(pubKey)
-	pubKeyParsed, err := x509.ParsePKIXPublicKey(pubkeyMarshaled.Bytes)
+	keyring, err := NewKeyring(pubKey)
 	if err != nil {
 		panic(err)
 	}
-	rsaPubKey := pubKeyParsed.(*rsa.PublicKey)
 
 	major, minor, patch := VersionStringToInts(currentVersion)
 	u := &Updater{
@@ -74,74 +117,207 @@ func NewUpdater(logger *Logger, api APIConnector, pubKey []byte, currentBin, cur
 		currentBin:     currentBin, // filepath.Abs(os.Args[0])
 		currentVersion: currentVersion,
 		// --
-		rsaPubKey: rsaPubKey,
-		major:     major,
-		minor:     minor,
-		patch:     patch,
+		keyring: keyring,
+		major:   major,
+		minor:   minor,
+		patch:   patch,
 	}
 	return u
 }
 
+// Keyring returns the keys which verify updates: pubKey and the keys added by
+// key manifests.
+func (u *Updater) Keyring() *Keyring {
+	return u.keyring
+}
+
+// LoadKeys loads the key manifest saved in the store and saves new ones
+// there, see Keyring.Load.
+func (u *Updater) LoadKeys(store *Store) error {
+	return u.keyring.Load(store)
+}
+
+// UpdateKeys downloads the key manifest and, if it's newer than the current
+// one, rotates the keyring.  It is not an error if there's no manifest.
+func (u *Updater) UpdateKeys() error {
+	url := u.api.EntryLink("download") + "/" + UPDATE_KEYS_FILE
+	code, data, err := u.api.Get(u.api.ApiKey(), url)
+	if err != nil {
+		return fmt.Errorf("GET %s error: %s", url, err)
+	}
+	if code == 404 {
+		return nil
+	}
+	if code != 200 {
+		return fmt.Errorf("GET %s returned %d, expected 200", url, code)
+	}
+
+	// Don't download the signature of the current manifest.
+	serial := struct{ Serial uint64 }{}
+	if err := json.Unmarshal(data, &serial); err != nil {
+		return fmt.Errorf("Invalid key manifest: %s", err)
+	}
+	if serial.Serial <= u.keyring.Serial() {
+		return nil
+	}
+
+	sig, err := u.download(url + ".sig")
+	if err != nil {
+		return err
+	}
+	if err := u.keyring.Rotate(data, sig, time.Now()); err != nil {
+		return err
+	}
+	u.logger.Info(fmt.Sprintf("Rotated update keys to key manifest serial %d", serial.Serial))
+	return nil
+}
+
+// SetChannel sets the update channel for Check and Download, stable if
+// empty.
+func (u *Updater) SetChannel(channel string) error {
+	if err := ValidateUpdateChannel(channel); err != nil {
+		return err
+	}
+	if channel == "" {
+		channel = UPDATE_CHANNEL_STABLE
+	}
+	u.channel = channel
+	return nil
+}
+
+// Channel returns the update channel.
+func (u *Updater) Channel() string {
+	if u.channel == "" {
+		return UPDATE_CHANNEL_STABLE
+	}
+	return u.channel
+}
+
+// Check returns the latest version in the channel and whether it's a "major",
+// "minor", or "patch" update, or "" if it's not newer than the current
+// version.
 func (u *Updater) Check() (string, string, error) {
-	url := fmt.Sprintf("%s/latest", u.api.EntryLink("download"), u.major, u.minor)
+	url := fmt.Sprintf("%s/latest", u.downloadLink())
 	v, err := u.download(url)
 	if err != nil {
 		return "", "", err
 	}
-	version := string(v)
+	version := strings.TrimSpace(string(v))
 	major, minor, patch := VersionStringToInts(version)
 	switch {
 	case major > u.major:
 		return "major", version, nil
-	case minor > u.minor:
+	case major == u.major && minor > u.minor:
 		return "minor", version, nil
-	case patch > u.patch:
+	case major == u.major && minor == u.minor && patch > u.patch:
 		return "patch", version, nil
 	default:
 		return "", "", nil
 	}
 }
 
+// Update downloads and applies the version.  Restart percona-agent to run it.
 func (u *Updater) Update(version string) error {
-	u.logger.Info("Updating to", version)
+	if err := u.Download(version); err != nil {
+		return err
+	}
+	return u.Apply(version)
+}
 
-	// Download and decompress the gzipped bin and its signature.
-	url := fmt.Sprintf("%s/percona-agent-%s", u.api.EntryLink("download"), version)
-	data, err := u.download(url + ".gz")
+// Download downloads and checks the version and writes it to the staged file
+// next to the current binary.  The current binary is not changed until Apply.
+func (u *Updater) Download(version string) error {
+	u.logger.Info("Downloading version", version)
+
+	// Patch the current binary if there's a patch from the current version,
+	// else download and decompress the gzipped bin.  Then get its signature.
+	url := fmt.Sprintf("%s/percona-agent-%s", u.downloadLink(), version)
+	data, err := u.downloadPatch(version)
 	if err != nil {
-		return err
+		u.logger.Warn(fmt.Sprintf("Cannot patch version %s to %s, downloading full binary: %s", u.currentVersion, version, err))
+	}
+	patched := data != nil
+	if !patched {
+		if data, err = u.download(url + ".gz"); err != nil {
+			return err
+		}
 	}
 	sig, err := u.download(url + ".sig")
 	if err != nil {
 		return err
 	}
 
-	// Check the binary's signature.  It's signed by Percona.
+	// Check the binary's signature.  It's signed by Percona with a key in
+	// the keyring.  The full binary is signed, not the patch, so a patch
+	// applied to a modified current binary fails here.
 	if err = u.checkSignature(data, sig); err != nil {
-		return err
+		if !patched {
+			return err
+		}
+		u.logger.Warn("Patched binary has an invalid signature; downloading full binary:", err)
+		if data, err = u.download(url + ".gz"); err != nil {
+			return err
+		}
+		if err = u.checkSignature(data, sig); err != nil {
+			return err
+		}
 	}
 
-	// Write binary to disk as /tmp/percona-agent-<version>.
-	newBin := filepath.Join(os.TempDir(), fmt.Sprintf("percona-agent-%s", version))
+	// Write binary to disk next to the current binary.
+	newBin := u.currentBin + UPDATE_STAGED_SUFFIX
 	u.logger.Debug("Update:write:" + newBin)
 	if err := ioutil.WriteFile(newBin, data, os.FileMode(0755)); err != nil {
 		return err
 	}
 
-	// Run new binary -version to make sure it runs and returns the version.
-	u.logger.Debug("Update:exec")
-	out, err := exec.Command(newBin, "-version").Output()
-	if err != nil {
+	// Run new binary -self-check to make sure it runs, can read its config,
+	// and returns the version.
+	if err := u.selfCheck(newBin, version); err != nil {
+		os.Remove(newBin)
 		return err
 	}
-	u.logger.Debug("Update:exec:" + string(out))
-	if !strings.HasPrefix(strings.TrimSpace(string(out)), "percona-agent "+version) {
-		return fmt.Errorf("%s -version returns %s, expected %s", newBin, out, version)
+	u.logger.Info("Downloaded version", version, "to", newBin)
+	return nil
+}
+
+// Apply replaces the current binary with the staged binary from Download.
+// The current binary is kept for Rollback, and the update is pending until
+// Commit.
+func (u *Updater) Apply(version string) error {
+	u.logger.Info("Updating to", version)
+
+	newBin := u.currentBin + UPDATE_STAGED_SUFFIX
+	if !FileExists(newBin) {
+		return fmt.Errorf("Cannot update to %s: %s does not exist", version, newBin)
+	}
+	if err := u.selfCheck(newBin, version); err != nil {
+		return err
 	}
 
-	// Overwrite the current, running binary with new bin.
+	// Keep the current binary so the update can be rolled back, then replace
+	// it with the new binary.
+	prevBin := u.currentBin + UPDATE_PREV_SUFFIX
+	u.logger.Info("Moving", u.currentBin, "to", prevBin)
+	if err := os.Rename(u.currentBin, prevBin); err != nil {
+		os.Remove(newBin)
+		return err
+	}
 	u.logger.Info("Moving", newBin, "to", u.currentBin)
 	if err := os.Rename(newBin, u.currentBin); err != nil {
+		os.Rename(prevBin, u.currentBin)
+		return err
+	}
+
+	pending := &PendingUpdate{
+		Ts:          time.Now().UTC(),
+		Version:     version,
+		PrevVersion: u.currentVersion,
+	}
+	data, err := json.Marshal(pending)
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(u.currentBin+UPDATE_PENDING_SUFFIX, data, os.FileMode(0644)); err != nil {
 		return err
 	}
 
@@ -149,6 +325,107 @@ func (u *Updater) Update(version string) error {
 	return nil
 }
 
+// Pending returns the update not yet committed, or nil if there's none.
+func (u *Updater) Pending() (*PendingUpdate, error) {
+	data, err := ioutil.ReadFile(u.currentBin + UPDATE_PENDING_SUFFIX)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	pending := &PendingUpdate{}
+	if err := json.Unmarshal(data, pending); err != nil {
+		return nil, err
+	}
+	return pending, nil
+}
+
+// Commit is called when the new version works, i.e. connects to the API.
+// The prev binary is kept for Rollback.
+func (u *Updater) Commit() error {
+	u.logger.Info("Update committed")
+	return RemoveFile(u.currentBin + UPDATE_PENDING_SUFFIX)
+}
+
+// Rollback replaces the current binary with the prev binary kept by Update
+// and returns the version of the prev binary, if known.  Restart percona-agent
+// to run it.
+func (u *Updater) Rollback() (string, error) {
+	prevBin := u.currentBin + UPDATE_PREV_SUFFIX
+	if !FileExists(prevBin) {
+		return "", errors.New("Cannot roll back: " + prevBin + " does not exist")
+	}
+	version := ""
+	if pending, err := u.Pending(); err != nil {
+		u.logger.Warn(err)
+	} else if pending != nil {
+		version = pending.PrevVersion
+	}
+	u.logger.Info("Moving", prevBin, "to", u.currentBin)
+	if err := os.Rename(prevBin, u.currentBin); err != nil {
+		return "", err
+	}
+	if err := RemoveFile(u.currentBin + UPDATE_PENDING_SUFFIX); err != nil {
+		u.logger.Warn(err)
+	}
+	u.logger.Info("Rollback complete; restart percona-agent")
+	return version, nil
+}
+
+func (u *Updater) selfCheck(bin, version string) error {
+	u.logger.Debug("Update:exec")
+	args := []string{"-self-check"}
+	if Basedir.Path() != "" {
+		args = append(args, "-basedir", Basedir.Path())
+	}
+	out, err := exec.Command(bin, args...).Output()
+	if err != nil {
+		return fmt.Errorf("%s -self-check failed: %s: %s", bin, err, out)
+	}
+	u.logger.Debug("Update:exec:" + string(out))
+	if !strings.HasPrefix(strings.TrimSpace(string(out)), "percona-agent "+version) {
+		return fmt.Errorf("%s -self-check returns %s, expected %s", bin, out, version)
+	}
+	return nil
+}
+
+// downloadPatch downloads the bsdiff patch from the current version to version, if
+// any, and applies it to the current binary.  It returns nil if there's no
+// patch.
+func (u *Updater) downloadPatch(version string) ([]byte, error) {
+	url := fmt.Sprintf("%s/percona-agent-%s-%s.patch", u.downloadLink(), u.currentVersion, version)
+	code, patch, err := u.api.Get(u.api.ApiKey(), url)
+	if err != nil {
+		return nil, fmt.Errorf("GET %s error: %s", url, err)
+	}
+	if code == 404 {
+		return nil, nil
+	}
+	if code != 200 {
+		return nil, fmt.Errorf("GET %s returned %d, expected 200", url, code)
+	}
+	old, err := ioutil.ReadFile(u.currentBin)
+	if err != nil {
+		return nil, err
+	}
+	data, err := Bspatch(old, patch)
+	if err != nil {
+		return nil, err
+	}
+	u.logger.Info(fmt.Sprintf("Patched version %s to %s: downloaded %s instead of %s", u.currentVersion, version, Bytes(uint64(len(patch))), Bytes(uint64(len(data)))))
+	return data, nil
+}
+
+// downloadLink returns the download link of the channel.
+func (u *Updater) downloadLink() string {
+	link := u.api.EntryLink("download")
+	if u.Channel() != UPDATE_CHANNEL_STABLE {
+		link += "/" + u.Channel()
+	}
+	return link
+}
+
 func (u *Updater) download(url string) ([]byte, error) {
 	u.logger.Debug("download:call:" + url)
 	defer u.logger.Debug("download:call")
@@ -158,7 +435,7 @@ func (u *Updater) download(url string) ([]byte, error) {
 	code, data, err := u.api.Get(u.api.ApiKey(), url)
 	u.logger.Debug(fmt.Sprintf("download:code:%d", code))
 	if err != nil {
-		return nil, fmt.Errorf("GET %s error: %s", err)
+		return nil, fmt.Errorf("GET %s error: %s", url, err)
 	}
 	if code != 200 {
 		return nil, fmt.Errorf("GET %s returned %d, expected 200", url, code)
@@ -172,9 +449,12 @@ func (u *Updater) download(url string) ([]byte, error) {
 func (u *Updater) checkSignature(data, sig []byte) error {
 	u.logger.Debug("checkSignature:call")
 	defer u.logger.Debug("checkSignature:return")
-	hash := sha256.New()
-	hash.Write(data)
-	return rsa.VerifyPKCS1v15(u.rsaPubKey, crypto.SHA256, hash.Sum(nil), sig)
+	keyId, err := u.keyring.Verify(data, sig, time.Now())
+	if err != nil {
+		return err
+	}
+	u.logger.Debug("checkSignature:key:" + keyId)
+	return nil
 }
 
 func VersionStringToInts(version string) (int64, int64, int64) {
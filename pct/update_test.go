@@ -19,6 +19,13 @@ package pct_test
 
 import (
 	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
 	"github.com/percona/cloud-protocol/proto/v1"
 	"github.com/percona/percona-agent/pct"
 	"github.com/percona/percona-agent/test"
@@ -29,6 +36,7 @@ import (
 	"os/exec"
 	"path/filepath"
 	"strings"
+	"time"
 )
 
 type UpdateTestSuite struct {
@@ -99,13 +107,14 @@ func (s *UpdateTestSuite) TestCheck(t *C) {
 	u := pct.NewUpdater(s.logger, s.api, s.pubKey, curBin, "1.0.0")
 	t.Assert(u, NotNil)
 
-	// Updater.Update() makes 2 API calls: first to get percona-agent-VERSION-ARCH.gz,
-	// second to get the corresponding .sig file.  The bin and sig here are "real" in
+	// Updater.Update() makes 3 API calls: first to get a patch from the current
+	// version (there's none), then percona-agent-VERSION-ARCH.gz, then the
+	// corresponding .sig file.  The bin and sig here are "real" in
 	// the sense that in SetUpSuite() we compiled a fake percona-agent bin and signed
 	// it with the test private key (test/pct/key.pem).
-	s.api.GetCode = []int{200, 200}
-	s.api.GetData = [][]byte{s.bin, s.sig}
-	s.api.GetError = []error{nil, nil}
+	s.api.GetCode = []int{404, 200, 200} // no patch from 1.0.0
+	s.api.GetData = [][]byte{nil, s.bin, s.sig}
+	s.api.GetError = []error{nil, nil, nil}
 
 	// Run the update process.  It thinks it's getting percona-agent 1.0.1 from the real API.
 	err := u.Update("1.0.1")
@@ -133,4 +142,196 @@ func (s *UpdateTestSuite) TestCheck(t *C) {
 	out, err := exec.Command(curBin, "-version").Output()
 	t.Assert(err, IsNil)
 	t.Check(strings.TrimSpace(string(out)), Equals, "percona-agent 1.0.1 rev 19b6b2ede12bfd2a012d40ac572a660be7aff1e7")
+
+	// The previous binary is kept, and the update is pending until Commit
+	// or Rollback.
+	prevBin, err := ioutil.ReadFile(curBin + pct.UPDATE_PREV_SUFFIX)
+	t.Assert(err, IsNil)
+	t.Check(prevBin, DeepEquals, []byte{0x41})
+	t.Check(pct.FileExists(curBin+pct.UPDATE_STAGED_SUFFIX), Equals, false)
+	pending, err := u.Pending()
+	t.Assert(err, IsNil)
+	t.Assert(pending, NotNil)
+	t.Check(pending.Version, Equals, "1.0.1")
+	t.Check(pending.PrevVersion, Equals, "1.0.0")
+
+	err = u.Commit()
+	t.Assert(err, IsNil)
+	pending, err = u.Pending()
+	t.Assert(err, IsNil)
+	t.Check(pending, IsNil)
+}
+
+func (s *UpdateTestSuite) TestRollback(t *C) {
+	curBin := filepath.Join(s.tmpDir + "/percona-agent-rollback")
+	if err := ioutil.WriteFile(curBin, []byte{0x41}, os.FileMode(0655)); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(curBin)
+
+	u := pct.NewUpdater(s.logger, s.api, s.pubKey, curBin, "1.0.0")
+	t.Assert(u, NotNil)
+
+	// Nothing to roll back to, and nothing downloaded to apply.
+	_, err := u.Rollback()
+	t.Check(err, NotNil)
+	err = u.Apply("1.0.1")
+	t.Check(err, NotNil)
+
+	s.api.GetCode = []int{404, 200, 200} // no patch from 1.0.0
+	s.api.GetData = [][]byte{nil, s.bin, s.sig}
+	s.api.GetError = []error{nil, nil, nil}
+	err = u.Update("1.0.1")
+	t.Assert(err, IsNil)
+
+	version, err := u.Rollback()
+	t.Assert(err, IsNil)
+	t.Check(version, Equals, "1.0.0")
+
+	// The previous binary is the current binary again.
+	data, err := ioutil.ReadFile(curBin)
+	t.Assert(err, IsNil)
+	t.Check(data, DeepEquals, []byte{0x41})
+	t.Check(pct.FileExists(curBin+pct.UPDATE_PREV_SUFFIX), Equals, false)
+	pending, err := u.Pending()
+	t.Assert(err, IsNil)
+	t.Check(pending, IsNil)
+}
+
+func (s *UpdateTestSuite) TestKeyring(t *C) {
+	k, err := pct.NewKeyring(s.pubKey)
+	t.Assert(err, IsNil)
+	storeFile := filepath.Join(s.tmpDir, pct.STORE_FILE)
+	defer os.Remove(storeFile)
+	store, err := pct.OpenStore(storeFile, "")
+	t.Assert(err, IsNil)
+	defer store.Close()
+	err = k.Load(store)
+	t.Assert(err, IsNil)
+
+	// Raw signatures are checked with the root key.
+	keyId, err := k.Verify(s.bin, s.sig, time.Now())
+	t.Assert(err, IsNil)
+	t.Check(keyId, Equals, pct.ROOT_KEY_ID)
+
+	// Rotate to a new key and revoke the root key.  The manifest is signed
+	// by the root key.
+	newKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	t.Assert(err, IsNil)
+	pubKey, err := x509.MarshalPKIXPublicKey(&newKey.PublicKey)
+	t.Assert(err, IsNil)
+	manifest := pct.KeyManifest{
+		Serial: 1,
+		Keys: []pct.TrustedKey{
+			{
+				Id:      "2015",
+				PEM:     string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pubKey})),
+				Expires: time.Now().Add(24 * time.Hour),
+			},
+		},
+		Revoked: []string{pct.ROOT_KEY_ID},
+	}
+	manifestData, err := json.Marshal(manifest)
+	t.Assert(err, IsNil)
+	manifestFile := filepath.Join(s.tmpDir, "keys.json")
+	err = ioutil.WriteFile(manifestFile, manifestData, 0644)
+	t.Assert(err, IsNil)
+	data, sig, err := test.Sign(manifestFile)
+	t.Assert(err, IsNil)
+	err = k.Rotate(data, sig, time.Now())
+	t.Assert(err, IsNil)
+	t.Check(k.Serial(), Equals, uint64(1))
+
+	// The same manifest is not applied again.
+	err = k.Rotate(data, sig, time.Now())
+	t.Check(err, NotNil)
+
+	// The root key is revoked, and the new key signs with RSA PSS.
+	_, err = k.Verify(s.bin, s.sig, time.Now())
+	t.Check(err, NotNil)
+	hash := sha256.Sum256(s.bin)
+	pss, err := rsa.SignPSS(rand.Reader, newKey, crypto.SHA256, hash[:], nil)
+	t.Assert(err, IsNil)
+	sig, err = json.Marshal(pct.Signature{KeyId: "2015", Alg: pct.SIG_RSA_PSS_SHA256, Sig: pss})
+	t.Assert(err, IsNil)
+	keyId, err = k.Verify(s.bin, sig, time.Now())
+	t.Assert(err, IsNil)
+	t.Check(keyId, Equals, "2015")
+
+	// Until it expires.
+	_, err = k.Verify(s.bin, sig, time.Now().Add(48*time.Hour))
+	t.Check(err, NotNil)
+
+	// The manifest is saved and loaded on restart.
+	k, err = pct.NewKeyring(s.pubKey)
+	t.Assert(err, IsNil)
+	err = k.Load(store)
+	t.Assert(err, IsNil)
+	t.Check(k.Serial(), Equals, uint64(1))
+	t.Check(k.Keys(time.Now()), HasLen, 1)
+}
+
+func (s *UpdateTestSuite) TestBspatch(t *C) {
+	old, err := ioutil.ReadFile(filepath.Join(test.RootDir, "pct", "bspatch-old"))
+	t.Assert(err, IsNil)
+	patch, err := ioutil.ReadFile(filepath.Join(test.RootDir, "pct", "bspatch.patch"))
+	t.Assert(err, IsNil)
+	expect, err := ioutil.ReadFile(filepath.Join(test.RootDir, "pct", "bspatch-new"))
+	t.Assert(err, IsNil)
+
+	got, err := pct.Bspatch(old, patch)
+	t.Assert(err, IsNil)
+	t.Check(got, DeepEquals, expect)
+
+	_, err = pct.Bspatch(old, patch[0:40])
+	t.Check(err, NotNil)
+	_, err = pct.Bspatch(old, []byte("not a patch"))
+	t.Check(err, NotNil)
+
+	// A huge new size in the header is rejected before it's allocated.
+	huge := make([]byte, len(patch))
+	copy(huge, patch)
+	copy(huge[24:32], []byte{0, 0, 0, 0, 0, 0, 0, 0x7f})
+	_, err = pct.Bspatch(old, huge)
+	t.Check(err, ErrorMatches, "Invalid patch: new size .+ exceeds maximum .+")
+
+	// Huge block lengths that overflow when added are rejected.
+	copy(huge, patch)
+	copy(huge[8:16], []byte{0, 0, 0, 0, 0, 0, 0, 0x40})  // 2^62
+	copy(huge[16:24], []byte{0, 0, 0, 0, 0, 0, 0, 0x40}) // 2^62
+	_, err = pct.Bspatch(old, huge)
+	t.Check(err, ErrorMatches, "Invalid patch: bad block lengths")
+}
+
+func (s *UpdateTestSuite) TestChannel(t *C) {
+	u := pct.NewUpdater(s.logger, s.api, s.pubKey, filepath.Join(s.tmpDir, "percona-agent"), "1.2.3")
+	t.Check(u.Channel(), Equals, pct.UPDATE_CHANNEL_STABLE)
+
+	err := u.SetChannel("beta")
+	t.Check(err, NotNil)
+	t.Check(u.Channel(), Equals, pct.UPDATE_CHANNEL_STABLE)
+
+	err = u.SetChannel(pct.UPDATE_CHANNEL_TESTING)
+	t.Assert(err, IsNil)
+	t.Check(u.Channel(), Equals, pct.UPDATE_CHANNEL_TESTING)
+
+	// Check compares the whole version, so a greater minor or patch in an
+	// older major or minor isn't newer.
+	versions := map[string][2]string{
+		"1.2.3\n": {"", ""},
+		"1.2.4\n": {"patch", "1.2.4"},
+		"1.3.0":   {"minor", "1.3.0"},
+		"2.0.0":   {"major", "2.0.0"},
+		"1.1.9":   {"", ""},
+		"0.9.9":   {"", ""},
+	}
+	for latest, expect := range versions {
+		s.api.GetCode = []int{200}
+		s.api.GetData = [][]byte{[]byte(latest)}
+		s.api.GetError = []error{nil}
+		level, version, err := u.Check()
+		t.Assert(err, IsNil)
+		t.Check(level, Equals, expect[0], Commentf("latest %s", latest))
+		t.Check(version, Equals, expect[1], Commentf("latest %s", latest))
+	}
 }
@@ -0,0 +1,151 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package pct
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// VaultConfig is how to reach HashiCorp Vault.  Empty fields are the Vault
+// env vars: VAULT_ADDR and VAULT_TOKEN.
+type VaultConfig struct {
+	Addr      string // e.g. https://127.0.0.1:8200
+	TokenFile string // file with the Vault token
+}
+
+// A VaultSecret is a secret read from Vault.  Dynamic secrets, e.g. database
+// credentials, have a lease which expires unless renewed.
+type VaultSecret struct {
+	LeaseId       string                 `json:"lease_id"`
+	LeaseDuration int                    `json:"lease_duration"` // seconds
+	Renewable     bool                   `json:"renewable"`
+	Data          map[string]interface{} `json:"data"`
+}
+
+// Field returns the string field of the secret, or "" if it has none.  KV
+// version 2 secrets, which nest the fields in data, work too.
+func (s *VaultSecret) Field(name string) string {
+	fields := s.Data
+	if kv2, ok := fields["data"].(map[string]interface{}); ok {
+		fields = kv2
+	}
+	value, _ := fields[name].(string)
+	return value
+}
+
+// Expires returns when the lease of the secret read at t expires, zero if it
+// has no lease.
+func (s *VaultSecret) Expires(t time.Time) time.Time {
+	if s.LeaseDuration <= 0 {
+		return time.Time{}
+	}
+	return t.Add(time.Duration(s.LeaseDuration) * time.Second)
+}
+
+// Vault is a minimal client of the Vault HTTP API: read secrets and renew
+// their leases.
+type Vault struct {
+	addr      string
+	tokenFile string
+	client    *http.Client
+}
+
+func NewVault(config VaultConfig) *Vault {
+	addr := config.Addr
+	if addr == "" {
+		addr = os.Getenv("VAULT_ADDR")
+	}
+	v := &Vault{
+		addr:      strings.TrimSuffix(addr, "/"),
+		tokenFile: config.TokenFile,
+		client:    &http.Client{Timeout: AUTH_TIMEOUT},
+	}
+	return v
+}
+
+// Read reads the secret at path, e.g. database/creds/percona-agent.
+func (v *Vault) Read(path string) (*VaultSecret, error) {
+	return v.request("GET", "/v1/"+strings.Trim(path, "/"), nil)
+}
+
+// Renew renews the lease of a secret by increment.
+func (v *Vault) Renew(leaseId string, increment time.Duration) (*VaultSecret, error) {
+	body, err := json.Marshal(map[string]interface{}{
+		"lease_id":  leaseId,
+		"increment": int(increment.Seconds()),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v.request("PUT", "/v1/sys/leases/renew", body)
+}
+
+func (v *Vault) request(method, path string, body []byte) (*VaultSecret, error) {
+	if v.addr == "" {
+		return nil, errors.New("No Vault address: set Addr or the VAULT_ADDR env var")
+	}
+	token, err := v.token()
+	if err != nil {
+		return nil, err
+	}
+	url := v.addr + path
+	req, err := http.NewRequest(method, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-Vault-Token", token)
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s %s: %s", method, url, resp.Status)
+	}
+	secret := &VaultSecret{}
+	if err := json.Unmarshal(data, secret); err != nil {
+		return nil, fmt.Errorf("Invalid Vault response from %s: %s", url, err)
+	}
+	return secret, nil
+}
+
+func (v *Vault) token() (string, error) {
+	if v.tokenFile == "" {
+		if token := os.Getenv("VAULT_TOKEN"); token != "" {
+			return token, nil
+		}
+		return "", errors.New("No Vault token: set TokenFile or the VAULT_TOKEN env var")
+	}
+	data, err := ioutil.ReadFile(v.tokenFile)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
@@ -0,0 +1,130 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package pct
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// VOLUME_DAYS is how many days of data volume DataVolume keeps, today included.
+const VOLUME_DAYS = 31
+
+// DataVolume is the bytes spooled and sent per data type (qan, mm, sysconfig,
+// log, etc.) per day since the agent started.  The data spooler and sender and
+// the log relay record it.
+var DataVolume = NewVolume(VOLUME_DAYS)
+
+// VolumeCount is the bytes spooled and sent for one data type on one day.
+type VolumeCount struct {
+	Spooled uint64
+	Sent    uint64
+}
+
+type Volume struct {
+	days int
+	// --
+	volume map[string]map[string]VolumeCount // day (YYYY-MM-DD, UTC) => data type
+	mux    *sync.Mutex
+}
+
+func NewVolume(days int) *Volume {
+	v := &Volume{
+		days: days,
+		// --
+		volume: make(map[string]map[string]VolumeCount),
+		mux:    &sync.Mutex{},
+	}
+	return v
+}
+
+// Add adds bytes spooled and sent for the data type on the day of ts, and
+// removes days older than the number of days kept.
+func (v *Volume) Add(ts time.Time, dataType string, spooled, sent int) {
+	day := ts.UTC().Format("2006-01-02")
+	v.mux.Lock()
+	defer v.mux.Unlock()
+	types, ok := v.volume[day]
+	if !ok {
+		types = make(map[string]VolumeCount)
+		v.volume[day] = types
+		v.prune(ts)
+	}
+	count := types[dataType]
+	count.Spooled += uint64(spooled)
+	count.Sent += uint64(sent)
+	types[dataType] = count
+}
+
+// Day returns a copy of the volume per data type on the day of ts.
+func (v *Volume) Day(ts time.Time) map[string]VolumeCount {
+	v.mux.Lock()
+	defer v.mux.Unlock()
+	types := make(map[string]VolumeCount)
+	for dataType, count := range v.volume[ts.UTC().Format("2006-01-02")] {
+		types[dataType] = count
+	}
+	return types
+}
+
+// All returns a copy of the volume per data type per day (YYYY-MM-DD, UTC).
+func (v *Volume) All() map[string]map[string]VolumeCount {
+	v.mux.Lock()
+	defer v.mux.Unlock()
+	all := make(map[string]map[string]VolumeCount, len(v.volume))
+	for day, types := range v.volume {
+		all[day] = make(map[string]VolumeCount, len(types))
+		for dataType, count := range types {
+			all[day][dataType] = count
+		}
+	}
+	return all
+}
+
+// FormatVolume returns a one-line summary of the volume per data type, sorted
+// by data type, e.g. "log 1.20 kB/1.20 kB, mm 5.31 MB/5.10 MB" (spooled/sent).
+func FormatVolume(types map[string]VolumeCount) string {
+	if len(types) == 0 {
+		return "none"
+	}
+	names := make([]string, 0, len(types))
+	for dataType := range types {
+		names = append(names, dataType)
+	}
+	sort.Strings(names)
+	volume := make([]string, len(names))
+	for i, dataType := range names {
+		count := types[dataType]
+		volume[i] = fmt.Sprintf("%s %s/%s", dataType, Bytes(count.Spooled), Bytes(count.Sent))
+	}
+	return strings.Join(volume, ", ")
+}
+
+// prune removes days older than the number of days kept before ts.  The
+// caller must hold mux.
+func (v *Volume) prune(ts time.Time) {
+	oldest := ts.UTC().AddDate(0, 0, -(v.days - 1)).Format("2006-01-02")
+	for day := range v.volume {
+		if day < oldest {
+			delete(v.volume, day)
+		}
+	}
+}
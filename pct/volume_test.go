@@ -0,0 +1,60 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package pct_test
+
+import (
+	"github.com/percona/percona-agent/pct"
+	. "gopkg.in/check.v1"
+	"time"
+)
+
+type VolumeTestSuite struct {
+}
+
+var _ = Suite(&VolumeTestSuite{})
+
+func (s *VolumeTestSuite) TestVolume(t *C) {
+	v := pct.NewVolume(2)
+
+	day1 := time.Date(2015, 3, 1, 23, 59, 0, 0, time.UTC)
+	v.Add(day1, "qan", 1000, 0)
+	v.Add(day1, "qan", 500, 1500)
+	v.Add(day1, "log", 0, 200)
+	t.Check(v.Day(day1), DeepEquals, map[string]pct.VolumeCount{
+		"qan": pct.VolumeCount{Spooled: 1500, Sent: 1500},
+		"log": pct.VolumeCount{Spooled: 0, Sent: 200},
+	})
+	t.Check(pct.FormatVolume(v.Day(day1)), Equals, "log 0/200.00 B, qan 1.50 kB/1.50 kB")
+
+	// Each day is counted separately.
+	day2 := day1.Add(2 * time.Minute)
+	v.Add(day2, "mm", 100, 100)
+	t.Check(v.Day(day2), DeepEquals, map[string]pct.VolumeCount{
+		"mm": pct.VolumeCount{Spooled: 100, Sent: 100},
+	})
+	t.Check(v.All(), HasLen, 2)
+
+	// Only 2 days are kept, so the first day is removed on the third.
+	day3 := day2.Add(24 * time.Hour)
+	v.Add(day3, "mm", 100, 0)
+	all := v.All()
+	t.Check(all, HasLen, 2)
+	t.Check(all["2015-03-01"], IsNil)
+	t.Check(all["2015-03-03"]["mm"], Equals, pct.VolumeCount{Spooled: 100})
+	t.Check(pct.FormatVolume(v.Day(day1)), Equals, "none")
+}
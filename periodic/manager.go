@@ -0,0 +1,330 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+// Package periodic runs services which collect and report something every
+// interval, e.g. waits and schema.  A Manager does what they have in common:
+// the service lifecycle, the config, the MySQL connection, and the ticker.
+// The Service does the rest.
+package periodic
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/percona/cloud-protocol/proto/v1"
+	"github.com/percona/percona-agent/instance"
+	"github.com/percona/percona-agent/mysql"
+	"github.com/percona/percona-agent/pct"
+	"github.com/percona/percona-agent/ticker"
+)
+
+// A Service is the part of a periodic service that differs between services:
+// its config and what it does every interval.
+type Service interface {
+	// NewConfig returns a new config to decode a config file or StartService
+	// data into, e.g. &waits.Config{}.
+	NewConfig() interface{}
+
+	// Validate checks the config and sets its defaults.  The MySQL instance
+	// and Interval of a Config are checked and set by the Manager first.
+	Validate(config interface{}) error
+
+	// ConfigSchema describes the config with its defaults.  The constraints
+	// must match Validate.  The Manager sets those of Config.
+	ConfigSchema() pct.ConfigSchema
+
+	// Run runs with the validated config until runSync.StopChan is closed,
+	// then calls runSync.Graceful and returns.  conn and tickChan are nil if
+	// the config does not embed Config.
+	Run(config interface{}, conn mysql.Connector, tickChan chan time.Time, runSync *pct.SyncChan)
+}
+
+// Config is embedded in the configs of services which report on a MySQL
+// instance every Interval.
+type Config struct {
+	proto.ServiceInstance
+	Interval uint // seconds
+}
+
+// Periodic returns the Config of a config that embeds it, see Configured.
+func (c *Config) Periodic() *Config {
+	return c
+}
+
+// Configured is a config that embeds Config.
+type Configured interface {
+	Periodic() *Config
+}
+
+// A Spec is what the Manager needs to know about a Service.
+type Spec struct {
+	Name            string // service name, e.g. waits, also its config and spool name
+	DefaultInterval uint   // seconds, if Config.Interval is zero
+	SyncTicks       bool   // ticks are synchronized like mm reports, else like sysconfig
+}
+
+// Manager is the pct.ServiceManager of a Service.  It runs the service with
+// the config saved by StartService, if any, until StopService.
+type Manager struct {
+	spec         Spec
+	service      Service
+	logger       *pct.Logger
+	status       *pct.Status
+	clock        ticker.Manager
+	instanceRepo *instance.Repo
+	connFactory  mysql.ConnectionFactory
+	// --
+	config   interface{}
+	running  bool
+	tickChan chan time.Time
+	sync     *pct.SyncChan
+	mux      *sync.RWMutex // guards all of the above
+}
+
+// NewManager returns the Manager of the service.  The service updates the
+// status, too.  clock, instanceRepo, and connFactory are only used, and may
+// be nil otherwise, if the config of the service embeds Config.
+func NewManager(spec Spec, service Service, logger *pct.Logger, status *pct.Status, clock ticker.Manager, instanceRepo *instance.Repo, connFactory mysql.ConnectionFactory) *Manager {
+	m := &Manager{
+		spec:         spec,
+		service:      service,
+		logger:       logger,
+		status:       status,
+		clock:        clock,
+		instanceRepo: instanceRepo,
+		connFactory:  connFactory,
+		// --
+		mux: &sync.RWMutex{},
+	}
+	return m
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Interface
+/////////////////////////////////////////////////////////////////////////////
+
+func (m *Manager) Start() error {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	if m.running {
+		return pct.ServiceIsRunningError{Service: m.spec.Name}
+	}
+
+	// Load config from disk.  It's ok if there's no config: the service
+	// runs but does nothing until StartService.
+	config := m.service.NewConfig()
+	if err := pct.Basedir.ReadConfig(m.spec.Name, config); err != nil {
+		if !os.IsNotExist(err) {
+			return err
+		}
+		config = nil
+	}
+	if config != nil {
+		if err := m.validateConfig(config); err != nil {
+			return err
+		}
+		m.start(config)
+	} else {
+		m.status.Update(m.spec.Name, "Idle (no config)")
+	}
+
+	m.running = true
+	m.logger.Info("Started")
+	return nil
+}
+
+func (m *Manager) Stop() error {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	if !m.running {
+		return nil
+	}
+	m.stop()
+	m.running = false
+	m.logger.Info("Stopped")
+	m.status.Update(m.spec.Name, "Stopped")
+	return nil
+}
+
+func (m *Manager) Handle(cmd *proto.Cmd) *proto.Reply {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	if !m.running {
+		return cmd.Reply(nil, pct.ServiceIsNotRunningError{Service: m.spec.Name})
+	}
+
+	switch cmd.Cmd {
+	case "StartService":
+		config := m.service.NewConfig()
+		if err := pct.UnmarshalConfig(cmd.Data, config); err != nil {
+			return cmd.Reply(nil, err)
+		}
+		if err := m.validateConfig(config); err != nil {
+			return cmd.Reply(nil, err)
+		}
+		m.logger.Info("Start", cmd)
+		if err := pct.Basedir.WriteConfig(m.spec.Name, config); err != nil {
+			return cmd.Reply(nil, errors.New("Write "+m.spec.Name+" config:"+err.Error()))
+		}
+		// Restart with the new config.
+		m.stop()
+		m.start(config)
+		return cmd.Reply(nil) // success
+	case "StopService":
+		m.logger.Info("Stop", cmd)
+		m.stop()
+		m.config = nil
+		if err := pct.Basedir.RemoveConfig(m.spec.Name); err != nil {
+			return cmd.Reply(nil, errors.New("Remove "+m.spec.Name+": "+err.Error()))
+		}
+		m.status.Update(m.spec.Name, "Idle (no config)")
+		return cmd.Reply(nil) // success
+	case "GetConfig":
+		config, errs := m.getConfig()
+		return cmd.Reply(config, errs...)
+	default:
+		return cmd.Reply(nil, pct.UnknownCmdError{Cmd: cmd.Cmd})
+	}
+}
+
+func (m *Manager) Status() map[string]string {
+	return m.status.All()
+}
+
+func (m *Manager) GetConfig() ([]proto.AgentConfig, []error) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	return m.getConfig()
+}
+
+// ConfigSchema describes the config of the service.  The constraints must
+// match validateConfig.
+func (m *Manager) ConfigSchema() pct.ConfigSchema {
+	s := m.service.ConfigSchema()
+	if _, ok := m.service.NewConfig().(Configured); ok {
+		s.Field("Service").Values = []string{"mysql"}
+		s.Field("InstanceId").Required = true
+		f := s.Field("Interval")
+		f.Default = m.spec.DefaultInterval
+		f.Min = 1
+	}
+	return s
+}
+
+// Running returns true between Start and Stop.
+func (m *Manager) Running() bool {
+	m.mux.RLock()
+	defer m.mux.RUnlock()
+	return m.running
+}
+
+// Config returns the current config, or nil if the service has none.
+func (m *Manager) Config() interface{} {
+	m.mux.RLock()
+	defer m.mux.RUnlock()
+	return m.config
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Implementation
+/////////////////////////////////////////////////////////////////////////////
+
+func (m *Manager) getConfig() ([]proto.AgentConfig, []error) {
+	if m.config == nil {
+		return nil, nil
+	}
+	bytes, err := json.Marshal(m.config)
+	if err != nil {
+		return nil, []error{err}
+	}
+	config := proto.AgentConfig{
+		InternalService: m.spec.Name,
+		Config:          string(bytes),
+		Running:         m.sync != nil,
+	}
+	if c, ok := m.config.(Configured); ok {
+		config.ExternalService = c.Periodic().ServiceInstance
+	}
+	return []proto.AgentConfig{config}, nil
+}
+
+func (m *Manager) validateConfig(config interface{}) error {
+	if c, ok := config.(Configured); ok {
+		pc := c.Periodic()
+		if pc.Service != "mysql" {
+			return pct.UnknownServiceInstanceError{Service: pc.Service, Id: pc.InstanceId}
+		}
+		mysqlIt := &proto.MySQLInstance{}
+		if err := m.instanceRepo.Get(pc.Service, pc.InstanceId, mysqlIt); err != nil {
+			return err
+		}
+		if pc.Interval == 0 {
+			pc.Interval = m.spec.DefaultInterval
+		}
+	}
+	return m.service.Validate(config)
+}
+
+// start starts run() with the config.  The caller must hold mux.
+func (m *Manager) start(config interface{}) {
+	var conn mysql.Connector
+	if c, ok := config.(Configured); ok {
+		pc := c.Periodic()
+		mysqlIt := &proto.MySQLInstance{}
+		m.instanceRepo.Get(pc.Service, pc.InstanceId, mysqlIt) // checked by validateConfig
+		conn = m.connFactory.Make(mysqlIt.DSN)
+		m.tickChan = make(chan time.Time)
+		m.clock.Add(m.tickChan, pc.Interval, m.spec.SyncTicks)
+	}
+	m.sync = pct.NewSyncChan()
+	m.config = config
+	go m.run(config, conn, m.tickChan, m.sync)
+}
+
+// stop stops run(), if running.  The caller must hold mux.
+func (m *Manager) stop() {
+	if m.sync == nil {
+		return
+	}
+	if m.tickChan != nil {
+		m.clock.Remove(m.tickChan)
+	}
+	// If run() crashed, nothing receives on StopChan.
+	select {
+	case m.sync.StopChan <- true:
+		m.sync.Wait()
+	case <-m.sync.CrashChan:
+	}
+	m.sync = nil
+	m.tickChan = nil
+}
+
+// @goroutine[1]
+func (m *Manager) run(config interface{}, conn mysql.Connector, tickChan chan time.Time, runSync *pct.SyncChan) {
+	defer func() {
+		if err := recover(); err != nil {
+			m.logger.Error("Crashed: ", err)
+		}
+		m.status.Update(m.spec.Name, "Stopped")
+		runSync.Done()
+	}()
+	m.service.Run(config, conn, tickChan, runSync)
+}
@@ -0,0 +1,387 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package periodic_test
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/percona/cloud-protocol/proto/v1"
+	"github.com/percona/percona-agent/instance"
+	"github.com/percona/percona-agent/mysql"
+	"github.com/percona/percona-agent/pct"
+	"github.com/percona/percona-agent/periodic"
+	"github.com/percona/percona-agent/test"
+	"github.com/percona/percona-agent/test/mock"
+	. "gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) { TestingT(t) }
+
+const SERVICE_NAME = "periodic-test"
+
+// fakeConfig is the config of a service which reports on MySQL.
+type fakeConfig struct {
+	periodic.Config
+	Limit uint
+}
+
+// localConfig is the config of a service which doesn't, like history.
+type localConfig struct {
+	Days uint
+}
+
+// A run is the args of one fakeService.Run.
+type run struct {
+	config   interface{}
+	conn     mysql.Connector
+	tickChan chan time.Time
+}
+
+// fakeService sends its runs and ticks to the test, and crashes if crash.
+type fakeService struct {
+	local    bool
+	crash    bool
+	runChan  chan run
+	tickChan chan time.Time
+}
+
+func newFakeService(local bool) *fakeService {
+	s := &fakeService{
+		local:    local,
+		runChan:  make(chan run, 10),
+		tickChan: make(chan time.Time, 10),
+	}
+	return s
+}
+
+func (s *fakeService) NewConfig() interface{} {
+	if s.local {
+		return &localConfig{}
+	}
+	return &fakeConfig{}
+}
+
+func (s *fakeService) Validate(config interface{}) error {
+	if s.local {
+		return nil
+	}
+	cfg := config.(*fakeConfig)
+	if cfg.Limit > 10 {
+		return errors.New("Limit > 10")
+	}
+	return nil
+}
+
+func (s *fakeService) ConfigSchema() pct.ConfigSchema {
+	if s.local {
+		return pct.NewConfigSchema(SERVICE_NAME, localConfig{})
+	}
+	schema := pct.NewConfigSchema(SERVICE_NAME, fakeConfig{})
+	schema.Field("Limit").Max = 10
+	return schema
+}
+
+func (s *fakeService) Run(config interface{}, conn mysql.Connector, tickChan chan time.Time, runSync *pct.SyncChan) {
+	s.runChan <- run{config, conn, tickChan}
+	if s.crash {
+		panic("crash")
+	}
+	for {
+		select {
+		case now := <-tickChan:
+			s.tickChan <- now
+		case <-runSync.StopChan:
+			runSync.Graceful()
+			return
+		}
+	}
+}
+
+// --------------------------------------------------------------------------
+
+type ManagerTestSuite struct {
+	logChan       chan *proto.LogEntry
+	logger        *pct.Logger
+	tmpDir        string
+	repo          *instance.Repo
+	mysqlInstance proto.ServiceInstance
+	spec          periodic.Spec
+}
+
+var _ = Suite(&ManagerTestSuite{})
+
+func (s *ManagerTestSuite) SetUpSuite(t *C) {
+	s.logChan = make(chan *proto.LogEntry, 100)
+	s.logger = pct.NewLogger(s.logChan, SERVICE_NAME)
+
+	var err error
+	s.tmpDir, err = ioutil.TempDir("/tmp", "agent-test")
+	t.Assert(err, IsNil)
+	if err := pct.Basedir.Init(s.tmpDir); err != nil {
+		t.Fatal(err)
+	}
+
+	// The API has no instances link, so instances not in the repo are unknown.
+	api := mock.NewAPI("http://localhost", "http://localhost", "123", "abc-123-def", nil)
+	s.repo = instance.NewRepo(pct.NewLogger(s.logChan, "im-test"), pct.Basedir.Dir("config"), api)
+	data, err := json.Marshal(&proto.MySQLInstance{
+		Hostname: "db1",
+		DSN:      "user:pass@tcp(127.0.0.1:3306)/",
+	})
+	t.Assert(err, IsNil)
+	s.repo.Add("mysql", 1, data, false)
+	s.mysqlInstance = proto.ServiceInstance{Service: "mysql", InstanceId: 1}
+
+	s.spec = periodic.Spec{
+		Name:            SERVICE_NAME,
+		DefaultInterval: 60,
+		SyncTicks:       true,
+	}
+}
+
+func (s *ManagerTestSuite) SetUpTest(t *C) {
+	pct.Basedir.RemoveConfig(SERVICE_NAME)
+}
+
+func (s *ManagerTestSuite) TearDownSuite(t *C) {
+	if err := os.RemoveAll(s.tmpDir); err != nil {
+		t.Error(err)
+	}
+}
+
+func (s *ManagerTestSuite) startCmd(t *C, config interface{}) *proto.Cmd {
+	data, err := json.Marshal(config)
+	t.Assert(err, IsNil)
+	return &proto.Cmd{
+		Service: SERVICE_NAME,
+		Cmd:     "StartService",
+		Data:    data,
+	}
+}
+
+func waitRun(t *C, runChan chan run) run {
+	select {
+	case r := <-runChan:
+		return r
+	case <-time.After(time.Second):
+		t.Fatal("Service did not run")
+	}
+	return run{}
+}
+
+// --------------------------------------------------------------------------
+
+func (s *ManagerTestSuite) TestStartStopService(t *C) {
+	fake := mock.NewFakeMySQL()
+	service := newFakeService(false)
+	clock := mock.NewClock()
+	status := pct.NewStatus([]string{SERVICE_NAME})
+	m := periodic.NewManager(s.spec, service, s.logger, status, clock, s.repo, &mock.ConnectionFactory{Conn: fake})
+
+	// Not running yet.
+	reply := m.Handle(s.startCmd(t, &fakeConfig{}))
+	t.Check(reply.Error, Not(Equals), "")
+
+	err := m.Start()
+	t.Assert(err, IsNil)
+	defer m.Stop()
+	t.Check(m.Running(), Equals, true)
+	t.Check(m.Status()[SERVICE_NAME], Equals, "Idle (no config)")
+	configs, errs := m.GetConfig()
+	t.Check(errs, HasLen, 0)
+	t.Check(configs, HasLen, 0)
+
+	// Only MySQL instances, and only those in the repo.
+	config := &fakeConfig{
+		Config: periodic.Config{ServiceInstance: proto.ServiceInstance{Service: "server", InstanceId: 1}},
+	}
+	reply = m.Handle(s.startCmd(t, config))
+	t.Check(reply.Error, Not(Equals), "")
+	config.ServiceInstance = proto.ServiceInstance{Service: "mysql", InstanceId: 9}
+	reply = m.Handle(s.startCmd(t, config))
+	t.Check(reply.Error, Not(Equals), "")
+
+	// Unknown keys are rejected, not ignored.
+	reply = m.Handle(&proto.Cmd{
+		Service: SERVICE_NAME,
+		Cmd:     "StartService",
+		Data:    []byte(`{"Service":"mysql","InstanceId":1,"Limt":5}`),
+	})
+	t.Check(reply.Error, Matches, "Unknown config key: Limt .+")
+
+	// The service validates the rest.
+	config.ServiceInstance = s.mysqlInstance
+	config.Limit = 11
+	reply = m.Handle(s.startCmd(t, config))
+	t.Check(reply.Error, Equals, "Limit > 10")
+	t.Check(clock.Added, HasLen, 0)
+	t.Check(service.runChan, HasLen, 0)
+
+	config.Limit = 5
+	reply = m.Handle(s.startCmd(t, config))
+	t.Assert(reply.Error, Equals, "")
+	t.Check(clock.Added, DeepEquals, []uint{60})
+
+	// Run gets the config with defaults, the instance, and the ticker.
+	r := waitRun(t, service.runChan)
+	t.Check(r.config, DeepEquals, &fakeConfig{
+		Config: periodic.Config{ServiceInstance: s.mysqlInstance, Interval: 60},
+		Limit:  5,
+	})
+	t.Check(r.conn, Equals, fake)
+	t.Assert(clock.Chans, HasLen, 1)
+	t.Check(r.tickChan, Equals, clock.Chans[0])
+	now := time.Now()
+	r.tickChan <- now
+	select {
+	case got := <-service.tickChan:
+		t.Check(got, Equals, now)
+	case <-time.After(time.Second):
+		t.Error("No tick")
+	}
+
+	// Config is saved with defaults.
+	saved := &fakeConfig{}
+	err = pct.Basedir.ReadConfig(SERVICE_NAME, saved)
+	t.Assert(err, IsNil)
+	t.Check(saved, DeepEquals, r.config)
+	t.Check(m.Config(), Equals, r.config)
+
+	configs, errs = m.GetConfig()
+	t.Check(errs, HasLen, 0)
+	t.Assert(configs, HasLen, 1)
+	t.Check(configs[0].InternalService, Equals, SERVICE_NAME)
+	t.Check(configs[0].ExternalService, DeepEquals, s.mysqlInstance)
+	t.Check(configs[0].Running, Equals, true)
+
+	// A new config restarts the service with a new ticker.
+	config.Interval = 10
+	reply = m.Handle(s.startCmd(t, config))
+	t.Assert(reply.Error, Equals, "")
+	t.Check(clock.Removed, DeepEquals, []chan time.Time{r.tickChan})
+	t.Check(clock.Added, DeepEquals, []uint{60, 10})
+	r = waitRun(t, service.runChan)
+	t.Check(r.tickChan, Equals, clock.Chans[1])
+
+	reply = m.Handle(&proto.Cmd{Service: SERVICE_NAME, Cmd: "StopService"})
+	t.Check(reply.Error, Equals, "")
+	t.Check(clock.Removed, DeepEquals, []chan time.Time{clock.Chans[0], clock.Chans[1]})
+	t.Check(pct.Basedir.ConfigExists(SERVICE_NAME), Equals, false)
+	t.Check(m.Config(), IsNil)
+	t.Check(m.Status()[SERVICE_NAME], Equals, "Idle (no config)")
+
+	reply = m.Handle(&proto.Cmd{Service: SERVICE_NAME, Cmd: "Foo"})
+	t.Check(reply.Error, Not(Equals), "")
+}
+
+func (s *ManagerTestSuite) TestStartWithConfig(t *C) {
+	config := &fakeConfig{
+		Config: periodic.Config{ServiceInstance: s.mysqlInstance, Interval: 30},
+	}
+	err := pct.Basedir.WriteConfig(SERVICE_NAME, config)
+	t.Assert(err, IsNil)
+
+	service := newFakeService(false)
+	clock := mock.NewClock()
+	status := pct.NewStatus([]string{SERVICE_NAME})
+	m := periodic.NewManager(s.spec, service, s.logger, status, clock, s.repo, &mock.ConnectionFactory{Conn: mock.NewFakeMySQL()})
+	err = m.Start()
+	t.Assert(err, IsNil)
+	r := waitRun(t, service.runChan)
+	t.Check(r.config, DeepEquals, config)
+	t.Check(clock.Added, DeepEquals, []uint{30})
+
+	// Stop stops the service but keeps its config.
+	err = m.Stop()
+	t.Assert(err, IsNil)
+	t.Check(m.Running(), Equals, false)
+	t.Check(clock.Removed, DeepEquals, []chan time.Time{r.tickChan})
+	t.Check(m.Status()[SERVICE_NAME], Equals, "Stopped")
+	t.Check(pct.Basedir.ConfigExists(SERVICE_NAME), Equals, true)
+}
+
+func (s *ManagerTestSuite) TestConfigSchema(t *C) {
+	m := periodic.NewManager(s.spec, newFakeService(false), s.logger, pct.NewStatus([]string{SERVICE_NAME}), nil, nil, nil)
+	t.Check(m.ConfigSchema(), DeepEquals, pct.ConfigSchema{
+		Service: SERVICE_NAME,
+		Fields: []pct.ConfigField{
+			{Name: "Service", Type: "string", Values: []string{"mysql"}},
+			{Name: "InstanceId", Type: "uint", Required: true},
+			{Name: "Interval", Type: "uint", Default: uint(60), Min: 1},
+			{Name: "Limit", Type: "uint", Max: 10},
+		},
+	})
+
+	// Configs without periodic.Config are the service's own.
+	m = periodic.NewManager(periodic.Spec{Name: SERVICE_NAME}, newFakeService(true), s.logger, pct.NewStatus([]string{SERVICE_NAME}), nil, nil, nil)
+	t.Check(m.ConfigSchema(), DeepEquals, pct.ConfigSchema{
+		Service: SERVICE_NAME,
+		Fields:  []pct.ConfigField{{Name: "Days", Type: "uint"}},
+	})
+}
+
+func (s *ManagerTestSuite) TestLocalConfig(t *C) {
+	// Configs without periodic.Config have no instance, connection, or
+	// ticker, so no clock, repo, or connection factory is needed.
+	service := newFakeService(true)
+	status := pct.NewStatus([]string{SERVICE_NAME})
+	m := periodic.NewManager(periodic.Spec{Name: SERVICE_NAME}, service, s.logger, status, nil, nil, nil)
+	err := m.Start()
+	t.Assert(err, IsNil)
+	defer m.Stop()
+
+	reply := m.Handle(s.startCmd(t, &localConfig{Days: 7}))
+	t.Assert(reply.Error, Equals, "")
+	r := waitRun(t, service.runChan)
+	t.Check(r.config, DeepEquals, &localConfig{Days: 7})
+	t.Check(r.conn, IsNil)
+	t.Check(r.tickChan, IsNil)
+
+	configs, errs := m.GetConfig()
+	t.Check(errs, HasLen, 0)
+	t.Assert(configs, HasLen, 1)
+	t.Check(configs[0].ExternalService, DeepEquals, proto.ServiceInstance{})
+}
+
+func (s *ManagerTestSuite) TestCrash(t *C) {
+	service := newFakeService(false)
+	service.crash = true
+	status := pct.NewStatus([]string{SERVICE_NAME})
+	m := periodic.NewManager(s.spec, service, s.logger, status, mock.NewClock(), s.repo, &mock.ConnectionFactory{Conn: mock.NewFakeMySQL()})
+	err := m.Start()
+	t.Assert(err, IsNil)
+	defer m.Stop()
+
+	config := &fakeConfig{
+		Config: periodic.Config{ServiceInstance: s.mysqlInstance},
+	}
+	reply := m.Handle(s.startCmd(t, config))
+	t.Assert(reply.Error, Equals, "")
+	waitRun(t, service.runChan)
+	ok := test.WaitStatus(1, m, SERVICE_NAME, "Stopped")
+	t.Assert(ok, Equals, true)
+
+	// The manager still works.
+	reply = m.Handle(&proto.Cmd{Service: SERVICE_NAME, Cmd: "StopService"})
+	t.Check(reply.Error, Equals, "")
+}
@@ -0,0 +1,58 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package plan
+
+import (
+	"github.com/percona/cloud-protocol/proto/v1"
+	"github.com/percona/percona-agent/periodic"
+)
+
+const (
+	DEFAULT_INTERVAL = 3600 // seconds
+	MAX_QUERIES      = 100  // queries explained per interval
+)
+
+// Config is saved to config/plan.conf by StartService.
+type Config struct {
+	periodic.Config
+	Queries []Query // at most MAX_QUERIES
+}
+
+// A Query is a tracked query digest.  Digests are abstracted, so Query is an
+// example with real values, e.g. from QAN, that can be EXPLAINed.
+type Query struct {
+	Id    string // query class id (digest checksum)
+	Db    string // default db, optional if tables are db-qualified
+	Query string
+}
+
+// A Change is a query whose plan changed since the previous check.  Plans
+// are normalized EXPLAIN output, see NormalizePlan.
+type Change struct {
+	Query
+	OldPlan string
+	NewPlan string
+}
+
+// A Report is sent only when plans change.  Ts is when the change was
+// detected, so the change happened during the previous Interval.
+type Report struct {
+	proto.ServiceInstance
+	Ts      int64 // UTC Unix timestamp
+	Changes []Change
+}
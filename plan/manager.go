@@ -0,0 +1,202 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package plan
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/percona/cloud-protocol/proto/v1"
+	"github.com/percona/percona-agent/data"
+	"github.com/percona/percona-agent/instance"
+	"github.com/percona/percona-agent/mysql"
+	"github.com/percona/percona-agent/pct"
+	"github.com/percona/percona-agent/periodic"
+	mysqlExec "github.com/percona/percona-agent/query/mysql"
+	"github.com/percona/percona-agent/ticker"
+)
+
+const (
+	SERVICE_NAME = "plan"
+)
+
+// Manager periodically EXPLAINs the tracked queries in its config and
+// reports queries whose plan changed since the previous check, e.g. after
+// ANALYZE TABLE, a stats change, or a MySQL upgrade.
+type Manager struct {
+	*periodic.Manager
+}
+
+func NewManager(logger *pct.Logger, clock ticker.Manager, spool data.Spooler, instanceRepo *instance.Repo, connFactory mysql.ConnectionFactory) *Manager {
+	d := &detector{
+		logger: logger,
+		spool:  spool,
+		status: pct.NewStatus([]string{SERVICE_NAME, SERVICE_NAME + "-mysql"}),
+	}
+	// Unsynchronized ticker, like schema.
+	spec := periodic.Spec{
+		Name:            SERVICE_NAME,
+		DefaultInterval: DEFAULT_INTERVAL,
+		SyncTicks:       false,
+	}
+	m := &Manager{
+		Manager: periodic.NewManager(spec, d, logger, d.status, clock, instanceRepo, connFactory),
+	}
+	return m
+}
+
+// detector is the periodic.Service of the Manager.
+type detector struct {
+	logger *pct.Logger
+	spool  data.Spooler
+	status *pct.Status
+}
+
+func (d *detector) NewConfig() interface{} {
+	return &Config{}
+}
+
+func (d *detector) Validate(config interface{}) error {
+	cfg := config.(*Config)
+	if len(cfg.Queries) == 0 {
+		return errors.New("No Queries")
+	}
+	if len(cfg.Queries) > MAX_QUERIES {
+		return fmt.Errorf("Too many Queries: %d > %d", len(cfg.Queries), MAX_QUERIES)
+	}
+	ids := map[string]bool{}
+	for _, q := range cfg.Queries {
+		if q.Id == "" || q.Query == "" {
+			return fmt.Errorf("Invalid query: Id and Query are required: %+v", q)
+		}
+		if ids[q.Id] {
+			return fmt.Errorf("Duplicate query: %s", q.Id)
+		}
+		ids[q.Id] = true
+	}
+	return nil
+}
+
+// ConfigSchema describes Config.  The constraints must match Validate.
+func (d *detector) ConfigSchema() pct.ConfigSchema {
+	s := pct.NewConfigSchema(SERVICE_NAME, Config{})
+	f := s.Field("Queries")
+	f.Required = true
+	f.Max = MAX_QUERIES
+	return s
+}
+
+// @goroutine[1]
+func (d *detector) Run(config interface{}, conn mysql.Connector, tickChan chan time.Time, runSync *pct.SyncChan) {
+	cfg := config.(*Config)
+
+	// Query.Id => normalized plan of the previous check.  A query's first
+	// plan is its baseline, so no changes are reported when the service starts.
+	plans := make(map[string]string)
+
+	last := "Idle" // the last result, shown between ticks
+	for {
+		d.status.Update(SERVICE_NAME, last)
+		select {
+		case now := <-tickChan:
+			d.status.Update(SERVICE_NAME, "Explaining queries")
+			d.status.Update(SERVICE_NAME+"-mysql", "Connecting")
+			if err := conn.Connect(2); err != nil {
+				d.logger.Warn(err)
+				d.status.Update(SERVICE_NAME+"-mysql", "Error: "+err.Error())
+				continue
+			}
+			d.status.Update(SERVICE_NAME+"-mysql", "Connected")
+			e := mysqlExec.NewQueryExecutor(conn)
+			changes := []Change{}
+			for _, q := range cfg.Queries {
+				res, err := e.Explain(q.Db, q.Query)
+				if err != nil {
+					// Keep the old plan: the query might work again, e.g.
+					// if a table was temporarily renamed.
+					d.logger.Warn(fmt.Sprintf("EXPLAIN %s failed: %s", q.Id, err))
+					continue
+				}
+				plan := NormalizePlan(res)
+				if oldPlan, ok := plans[q.Id]; ok && oldPlan != plan {
+					d.logger.Info(fmt.Sprintf("Plan change: %s", q.Id))
+					change := Change{Query: q, OldPlan: oldPlan, NewPlan: plan}
+					if !pct.Collect(pct.DATA_QUERY_EXAMPLES) {
+						change.Query.Query = "" // the API knows it by Id
+					}
+					changes = append(changes, change)
+				}
+				plans[q.Id] = plan
+			}
+			conn.Close()
+			d.status.Update(SERVICE_NAME+"-mysql", "Disconnected (OK)")
+
+			if len(changes) > 0 {
+				report := &Report{
+					ServiceInstance: cfg.ServiceInstance,
+					Ts:              now.UTC().Unix(),
+					Changes:         changes,
+				}
+				if err := d.spool.Write(SERVICE_NAME, report); err != nil {
+					d.logger.Warn("Lost report:", err)
+				}
+			}
+			last = fmt.Sprintf("Explained %d queries at %s", len(cfg.Queries), pct.TimeString(now))
+		case <-runSync.StopChan:
+			runSync.Graceful()
+			return
+		}
+	}
+}
+
+// NormalizePlan returns the classic EXPLAIN as one line per table:
+//
+//	id select_type table partitions type key key_len ref Extra
+//
+// Estimates like rows and candidates like possible_keys are not the plan,
+// and they change often, so they're excluded.  NULL values are "NULL".
+func NormalizePlan(res *proto.ExplainResult) string {
+	lines := make([]string, len(res.Classic))
+	for i, row := range res.Classic {
+		id := "NULL"
+		if row.Id.Valid {
+			id = fmt.Sprintf("%d", row.Id.Int64)
+		}
+		lines[i] = strings.Join([]string{
+			id,
+			nullString(row.SelectType),
+			nullString(row.Table),
+			nullString(row.Partitions),
+			nullString(row.Type),
+			nullString(row.Key),
+			nullString(row.KeyLen),
+			nullString(row.Ref),
+			nullString(row.Extra),
+		}, " ")
+	}
+	return strings.Join(lines, "\n")
+}
+
+func nullString(s proto.NullString) string {
+	if !s.Valid {
+		return "NULL"
+	}
+	return s.String
+}
@@ -0,0 +1,220 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package plan_test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/percona/cloud-protocol/proto/v1"
+	"github.com/percona/percona-agent/instance"
+	"github.com/percona/percona-agent/pct"
+	"github.com/percona/percona-agent/periodic"
+	"github.com/percona/percona-agent/plan"
+	mysqlExec "github.com/percona/percona-agent/query/mysql"
+	"github.com/percona/percona-agent/test"
+	"github.com/percona/percona-agent/test/mock"
+	. "gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) { TestingT(t) }
+
+type ManagerTestSuite struct {
+	logChan       chan *proto.LogEntry
+	logger        *pct.Logger
+	tmpDir        string
+	repo          *instance.Repo
+	mysqlInstance proto.ServiceInstance
+}
+
+var _ = Suite(&ManagerTestSuite{})
+
+func (s *ManagerTestSuite) SetUpSuite(t *C) {
+	s.logChan = make(chan *proto.LogEntry, 100)
+	s.logger = pct.NewLogger(s.logChan, plan.SERVICE_NAME+"-manager-test")
+
+	var err error
+	s.tmpDir, err = ioutil.TempDir("/tmp", "agent-test")
+	t.Assert(err, IsNil)
+	if err := pct.Basedir.Init(s.tmpDir); err != nil {
+		t.Fatal(err)
+	}
+
+	s.repo = instance.NewRepo(pct.NewLogger(s.logChan, "im-test"), pct.Basedir.Dir("config"), nil)
+	data, err := json.Marshal(&proto.MySQLInstance{
+		Hostname: "db1",
+		DSN:      "user:pass@tcp(127.0.0.1:3306)/",
+	})
+	t.Assert(err, IsNil)
+	s.repo.Add("mysql", 1, data, false)
+	s.mysqlInstance = proto.ServiceInstance{Service: "mysql", InstanceId: 1}
+}
+
+func (s *ManagerTestSuite) SetUpTest(t *C) {
+	pct.Basedir.RemoveConfig(plan.SERVICE_NAME)
+}
+
+func (s *ManagerTestSuite) TearDownSuite(t *C) {
+	if err := os.RemoveAll(s.tmpDir); err != nil {
+		t.Error(err)
+	}
+}
+
+func (s *ManagerTestSuite) startCmd(t *C, config *plan.Config) *proto.Cmd {
+	data, err := json.Marshal(config)
+	t.Assert(err, IsNil)
+	return &proto.Cmd{
+		Service: plan.SERVICE_NAME,
+		Cmd:     "StartService",
+		Data:    data,
+	}
+}
+
+// --------------------------------------------------------------------------
+
+// EXPLAIN PARTITIONS columns, see fakeExplain.
+var explainColumns = []string{"id", "select_type", "table", "partitions", "type", "possible_keys", "key", "key_len", "ref", "rows", "Extra"}
+
+// fakeExplain returns the EXPLAIN row of a single-table SELECT that scans
+// the table, or uses the key if not empty.
+func fakeExplain(key string, rows int) [][]interface{} {
+	if key == "" {
+		return [][]interface{}{{1, "SIMPLE", "t", nil, "ALL", nil, nil, nil, nil, rows, "Using where"}}
+	}
+	return [][]interface{}{{1, "SIMPLE", "t", nil, "ref", key, key, "5", "const", rows, nil}}
+}
+
+func (s *ManagerTestSuite) TestNormalizePlan(t *C) {
+	fake := mock.NewFakeMySQL()
+	explain := fake.OnQuery("EXPLAIN /*!50100 PARTITIONS*/ SELECT * FROM t WHERE c = 1").Rows(explainColumns, fakeExplain("", 3))
+	e := mysqlExec.NewQueryExecutor(fake)
+
+	query := "SELECT * FROM t WHERE c = 1"
+	res, err := e.Explain("app", query)
+	t.Assert(err, IsNil)
+	plan1 := plan.NormalizePlan(res)
+	t.Check(plan1, Equals, "1 SIMPLE t NULL ALL NULL NULL NULL Using where")
+	t.Check(fake.Queries()[0], Equals, "USE app")
+
+	// More rows change the estimate but not the plan.
+	explain.Rows(explainColumns, fakeExplain("", 3000))
+	res, err = e.Explain("app", query)
+	t.Assert(err, IsNil)
+	t.Check(plan.NormalizePlan(res), Equals, plan1)
+
+	// A new index changes the plan.
+	explain.Rows(explainColumns, fakeExplain("c", 1))
+	res, err = e.Explain("app", query)
+	t.Assert(err, IsNil)
+	t.Check(plan.NormalizePlan(res), Equals, "1 SIMPLE t NULL ref c 5 const NULL")
+}
+
+func (s *ManagerTestSuite) TestStartService(t *C) {
+	fake := mock.NewFakeMySQL()
+	m := plan.NewManager(s.logger, mock.NewClock(), mock.NewSpooler(nil), s.repo, &mock.ConnectionFactory{Conn: fake})
+	err := m.Start()
+	t.Assert(err, IsNil)
+	defer m.Stop()
+
+	// No config, so nothing to check.
+	configs, errs := m.GetConfig()
+	t.Check(errs, HasLen, 0)
+	t.Check(configs, HasLen, 0)
+
+	// Queries are required.
+	config := &plan.Config{
+		Config: periodic.Config{ServiceInstance: s.mysqlInstance},
+	}
+	reply := m.Handle(s.startCmd(t, config))
+	t.Check(reply.Error, Not(Equals), "")
+
+	// Query ids must be unique.
+	config.Queries = []plan.Query{
+		{Id: "A", Db: "app", Query: "SELECT 1"},
+		{Id: "A", Db: "app", Query: "SELECT 2"},
+	}
+	reply = m.Handle(s.startCmd(t, config))
+	t.Check(reply.Error, Not(Equals), "")
+
+	config.Queries[1].Id = "B"
+	reply = m.Handle(s.startCmd(t, config))
+	t.Assert(reply.Error, Equals, "")
+
+	// Config is saved with the default interval.
+	saved := &plan.Config{}
+	err = pct.Basedir.ReadConfig(plan.SERVICE_NAME, saved)
+	t.Assert(err, IsNil)
+	t.Check(saved.Interval, Equals, uint(plan.DEFAULT_INTERVAL))
+	t.Check(saved.Queries, DeepEquals, config.Queries)
+
+	configs, errs = m.GetConfig()
+	t.Check(errs, HasLen, 0)
+	t.Assert(configs, HasLen, 1)
+	t.Check(configs[0].Running, Equals, true)
+
+	reply = m.Handle(&proto.Cmd{Service: plan.SERVICE_NAME, Cmd: "StopService"})
+	t.Check(reply.Error, Equals, "")
+	t.Check(pct.Basedir.ConfigExists(plan.SERVICE_NAME), Equals, false)
+}
+
+func (s *ManagerTestSuite) TestReport(t *C) {
+	fake := mock.NewFakeMySQL()
+	explain := fake.OnQuery("EXPLAIN /*!50100 PARTITIONS*/ SELECT * FROM t WHERE c = 1").Rows(explainColumns, fakeExplain("", 3))
+	clock := mock.NewClock()
+	dataChan := make(chan interface{}, 1)
+	m := plan.NewManager(s.logger, clock, mock.NewSpooler(dataChan), s.repo, &mock.ConnectionFactory{Conn: fake})
+	err := m.Start()
+	t.Assert(err, IsNil)
+	defer m.Stop()
+
+	config := &plan.Config{
+		Config:  periodic.Config{ServiceInstance: s.mysqlInstance},
+		Queries: []plan.Query{{Id: "A", Db: "app", Query: "SELECT * FROM t WHERE c = 1"}},
+	}
+	reply := m.Handle(s.startCmd(t, config))
+	t.Assert(reply.Error, Equals, "")
+	t.Check(clock.Added, DeepEquals, []uint{plan.DEFAULT_INTERVAL})
+	t.Assert(clock.Chans, HasLen, 1)
+
+	// The first plan is the baseline, so there's no report.
+	t0 := time.Date(2015, 6, 1, 12, 0, 0, 0, time.UTC)
+	clock.Chans[0] <- t0
+	ok := test.WaitStatusPrefix(1, m, plan.SERVICE_NAME, "Explained 1 queries")
+	t.Assert(ok, Equals, true)
+	t.Check(dataChan, HasLen, 0)
+	t.Check(fake.Connected(), Equals, uint(0))
+
+	explain.Rows(explainColumns, fakeExplain("c", 1))
+	clock.Chans[0] <- t0.Add(time.Hour)
+	got := test.WaitData(dataChan)
+	t.Assert(got, HasLen, 1)
+	t.Check(got[0], DeepEquals, &plan.Report{
+		ServiceInstance: s.mysqlInstance,
+		Ts:              t0.Add(time.Hour).Unix(),
+		Changes: []plan.Change{
+			{
+				Query:   config.Queries[0],
+				OldPlan: "1 SIMPLE t NULL ALL NULL NULL NULL Using where",
+				NewPlan: "1 SIMPLE t NULL ref c 5 const NULL",
+			},
+		},
+	})
+}
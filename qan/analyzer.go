@@ -24,6 +24,7 @@ import (
 	"sync"
 	"time"
 
+	"github.com/percona/percona-agent/bus"
 	"github.com/percona/percona-agent/data"
 	"github.com/percona/percona-agent/mysql"
 	"github.com/percona/percona-agent/pct"
@@ -56,9 +57,15 @@ type Analyzer interface {
 	SetConfig(Config)
 }
 
-// An AnalyzerFactory makes an Analyzer, real or mock.
+// An AnalyzerFactory makes an Analyzer, real or mock.  The Analyzer receives
+// bus.MYSQL_RESTART events for all MySQL instances on restartChan and ignores
+// the ones for other instances.  MakeBackfill makes an
+// Analyzer which analyzes historical data between begin and end, UTC.
+// ShipSlowLog reads a slice of the raw slow log and spools it.
 type AnalyzerFactory interface {
-	Make(config Config, name string, mysqlConn mysql.Connector, restartChan <-chan bool, tickChan chan time.Time) Analyzer
+	Make(config Config, name string, mysqlConn mysql.Connector, restartChan <-chan bus.Event, tickChan chan time.Time) Analyzer
+	MakeBackfill(config Config, name string, mysqlConn mysql.Connector, begin, end time.Time) (Analyzer, error)
+	ShipSlowLog(mysqlConn mysql.Connector, req SlowLogSliceRequest) (*SlowLogSlice, error)
 }
 
 // --------------------------------------------------------------------------
@@ -68,7 +75,7 @@ type RealAnalyzer struct {
 	config      Config
 	iter        IntervalIter
 	mysqlConn   mysql.Connector
-	restartChan <-chan bool
+	restartChan <-chan bus.Event
 	worker      Worker
 	clock       ticker.Manager
 	spool       data.Spooler
@@ -83,7 +90,7 @@ type RealAnalyzer struct {
 	mux                 *sync.RWMutex
 }
 
-func NewRealAnalyzer(logger *pct.Logger, config Config, iter IntervalIter, mysqlConn mysql.Connector, restartChan <-chan bool, worker Worker, clock ticker.Manager, spool data.Spooler) *RealAnalyzer {
+func NewRealAnalyzer(logger *pct.Logger, config Config, iter IntervalIter, mysqlConn mysql.Connector, restartChan <-chan bus.Event, worker Worker, clock ticker.Manager, spool data.Spooler) *RealAnalyzer {
 	name := logger.Service()
 	a := &RealAnalyzer{
 		logger:      logger,
@@ -98,7 +105,7 @@ func NewRealAnalyzer(logger *pct.Logger, config Config, iter IntervalIter, mysql
 		name:                name,
 		mysqlConfiguredChan: make(chan bool, 1),
 		workerDoneChan:      make(chan *Interval, 1),
-		status:              pct.NewStatus([]string{name, name + "-last-interval", name + "-next-interval"}),
+		status:              pct.NewStatus([]string{name, name + "-last-interval", name + "-last-report", name + "-next-interval"}),
 		runSync:             pct.NewSyncChan(),
 		configureMySQLSync:  pct.NewSyncChan(),
 		mux:                 &sync.RWMutex{},
@@ -183,7 +190,9 @@ func (a *RealAnalyzer) TakeOverPerconaServerRotation() error {
 	return nil
 }
 
-func (a *RealAnalyzer) configureMySQL(config []mysql.Query, tryLimit int) {
+// configureMySQL sets the config queries.  If ramp is not nil, it may remove
+// the queries which set long_query_time, see ramp.begin.
+func (a *RealAnalyzer) configureMySQL(config []mysql.Query, tryLimit int, ramp *ramp) {
 	a.logger.Debug("configureMySQL:call")
 	defer func() {
 		if err := recover(); err != nil {
@@ -218,7 +227,11 @@ func (a *RealAnalyzer) configureMySQL(config []mysql.Query, tryLimit int) {
 			a.logger.Warn("Cannot takeover slowlog rotation from Percona Server:", err)
 			continue
 		}
-		if err := a.mysqlConn.Set(config); err != nil {
+		queries := config
+		if ramp != nil {
+			queries = ramp.begin(a.mysqlConn, config)
+		}
+		if err := a.mysqlConn.Set(queries); err != nil {
 			a.mysqlConn.Close()
 			a.logger.Warn("Cannot configure MySQL:", err)
 			continue
@@ -241,7 +254,8 @@ func (a *RealAnalyzer) run() {
 	defer a.logger.Debug("run:return")
 
 	mysqlConfigured := false
-	go a.configureMySQL(a.config.Start, 0) // try forever
+	ramp := newRamp(a.config)
+	go a.configureMySQL(a.config.Start, 0, ramp) // try forever
 
 	defer func() {
 		a.logger.Info("Stopping")
@@ -259,7 +273,7 @@ func (a *RealAnalyzer) run() {
 		}
 
 		a.status.Update(a.name, "Stopping QAN on MySQL")
-		a.configureMySQL(a.config.Stop, 1) // try once
+		a.configureMySQL(a.config.Stop, 1, nil) // try once
 
 		if err := recover(); err != nil {
 			a.logger.Error("QAN crashed: ", err)
@@ -323,6 +337,13 @@ func (a *RealAnalyzer) run() {
 				}
 				lastTs = interval.StartTime
 			}
+
+			if mysqlConfigured && a.config.CollectFrom == "slowlog" {
+				// Don't lower long_query_time if the slow log grew too fast.
+				if !a.slowLogValve(interval, ramp) && ramp != nil {
+					a.rampLongQueryTime(ramp, interval)
+				}
+			}
 		case mysqlConfigured = <-a.mysqlConfiguredChan:
 			a.logger.Debug("run:mysql:configured")
 			// Start the IntervalIter once MySQL has been configured.
@@ -345,7 +366,10 @@ func (a *RealAnalyzer) run() {
 			} else {
 				a.logger.Info(fmt.Sprintf("First interval begins in %.1f seconds", t))
 			}
-		case <-a.restartChan:
+		case e := <-a.restartChan:
+			if e.Data != mysql.HideDSNPassword(a.mysqlConn.DSN()) {
+				continue // another instance
+			}
 			a.logger.Debug("run:mysql:restart")
 			// If MySQL is not configured, then configureMySQL() should already
 			// be running, trying to configure it. Else, we need to run
@@ -353,7 +377,8 @@ func (a *RealAnalyzer) run() {
 			if mysqlConfigured {
 				mysqlConfigured = false
 				a.iter.Stop()
-				go a.configureMySQL(a.config.Start, 0) // try forever
+				ramp = newRamp(a.config)                     // MySQL reset long_query_time
+				go a.configureMySQL(a.config.Start, 0, ramp) // try forever
 			}
 		case <-a.runSync.StopChan:
 			a.logger.Debug("run:stop")
@@ -362,6 +387,34 @@ func (a *RealAnalyzer) run() {
 	}
 }
 
+// rampLongQueryTime lowers long_query_time one step after the interval,
+// unless the ramp is done or the slow log grew too much during the interval.
+func (a *RealAnalyzer) rampLongQueryTime(r *ramp, interval *Interval) {
+	if r.left == 0 {
+		return
+	}
+	logSize := intervalLogSize(interval)
+	if err := a.mysqlConn.Connect(1); err != nil {
+		a.logger.Warn("Cannot connect to MySQL to lower long_query_time:", err)
+		return
+	}
+	defer a.mysqlConn.Close()
+	prev := r.cur
+	value, ok := r.step(logSize)
+	if !ok {
+		a.logger.Warn(fmt.Sprintf("Not lowering long_query_time from %.6f: slow log grew %d bytes, more than RampMaxLogSize %d",
+			prev, logSize, r.maxLogSize))
+		return
+	}
+	if err := a.mysqlConn.Set([]mysql.Query{longQueryTimeQuery(value)}); err != nil {
+		r.cur = prev
+		r.left++
+		a.logger.Warn("Cannot lower long_query_time:", err)
+		return
+	}
+	a.logger.Info(fmt.Sprintf("Lowered long_query_time from %.6f to %.6f, target %.6f", prev, value, r.target))
+}
+
 func (a *RealAnalyzer) runWorker(interval *Interval) {
 	a.logger.Debug(fmt.Sprintf("runWorker:call:%d", interval.Number))
 	defer func() {
@@ -414,4 +467,8 @@ func (a *RealAnalyzer) runWorker(interval *Interval) {
 	if err := a.spool.Write("qan", report); err != nil {
 		a.logger.Warn("Lost report:", err)
 	}
+	if report.Global != nil {
+		a.status.Update(a.name+"-last-report", fmt.Sprintf("%d queries, %d classes, parsed in %.3fs",
+			report.Global.TotalQueries, len(report.Class), report.RunTime))
+	}
 }
@@ -25,6 +25,7 @@ import (
 
 	. "github.com/go-test/test"
 	"github.com/percona/cloud-protocol/proto/v1"
+	"github.com/percona/percona-agent/bus"
 	"github.com/percona/percona-agent/instance"
 	"github.com/percona/percona-agent/mysql"
 	"github.com/percona/percona-agent/pct"
@@ -42,7 +43,7 @@ type AnalyzerTestSuite struct {
 	clock         *mock.Clock
 	api           *mock.API
 	worker        *mock.QanWorker
-	restartChan   chan bool
+	restartChan   chan bus.Event
 	logChan       chan *proto.LogEntry
 	logger        *pct.Logger
 	intervalChan  chan *qan.Interval
@@ -97,7 +98,7 @@ func (s *AnalyzerTestSuite) SetUpSuite(t *C) {
 	}
 	s.api = mock.NewAPI("http://localhost", "http://localhost", "123", "abc-123-def", links)
 
-	s.restartChan = make(chan bool, 1)
+	s.restartChan = make(chan bus.Event, 1)
 }
 
 func (s *AnalyzerTestSuite) SetUpTest(t *C) {
@@ -258,7 +259,7 @@ func (s *AnalyzerTestSuite) TestMySQLRestart(t *C) {
 	// Simulate a MySQL restart. This causes the analyzer to re-configure MySQL
 	// using the same Start queries.
 	s.nullmysql.Reset()
-	s.restartChan <- true
+	s.restartChan <- bus.Event{Topic: bus.MYSQL_RESTART, Data: mysql.HideDSNPassword(s.nullmysql.DSN())}
 	if !test.WaitState(s.nullmysql.SetChan) {
 		t.Error("Timeout waiting for <-s.nullmysql.SetChan")
 	}
@@ -275,7 +276,7 @@ func (s *AnalyzerTestSuite) TestMySQLRestart(t *C) {
 	s.nullmysql.Reset()
 	// Enable slowlog DB rotation by setting max_slowlog_size to a value > 4096 and simulate MySQL restart
 	s.nullmysql.SetGlobalVarNumber("max_slowlog_size", 100000)
-	s.restartChan <- true
+	s.restartChan <- bus.Event{Topic: bus.MYSQL_RESTART, Data: mysql.HideDSNPassword(s.nullmysql.DSN())}
 	if !test.WaitState(s.nullmysql.SetChan) {
 		t.Error("Timeout waiting for <-s.nullmysql.SetChan")
 	}
@@ -504,3 +505,166 @@ func (s *AnalyzerTestSuite) TestSlowLogTakeOver(t *C) {
 	test.WaitStatus(1, a, "qan-analyzer", "Stopped")
 	t.Check(a.String(), Equals, "qan-analyzer")
 }
+
+func (s *AnalyzerTestSuite) TestNextLongQueryTime(t *C) {
+	// Equal steps, last step is the target.
+	t.Check(qan.NextLongQueryTime(10, 0, 4), Equals, 7.5)
+	t.Check(qan.NextLongQueryTime(7.5, 0, 3), Equals, 5.0)
+	t.Check(qan.NextLongQueryTime(1, 0.5, 1), Equals, 0.5)
+	// Microsecond precision.
+	t.Check(qan.NextLongQueryTime(1, 0, 3), Equals, 0.666667)
+	// Already at or below the target.
+	t.Check(qan.NextLongQueryTime(0, 0.5, 3), Equals, 0.5)
+}
+
+func (s *AnalyzerTestSuite) TestRampLongQueryTime(t *C) {
+	s.nullmysql.SetGlobalVarNumber("long_query_time", 10)
+	config := s.config
+	config.Start = []mysql.Query{
+		mysql.Query{Set: "SET GLOBAL slow_query_log=ON"},
+		mysql.Query{Set: "SET GLOBAL long_query_time=0"},
+	}
+	config.RampIntervals = 2
+	config.RampMaxLogSize = 1000
+	a := qan.NewRealAnalyzer(
+		pct.NewLogger(s.logChan, "qan-analyzer"),
+		config,
+		s.iter,
+		s.nullmysql,
+		s.restartChan,
+		s.worker,
+		s.clock,
+		s.spool,
+	)
+	err := a.Start()
+	t.Assert(err, IsNil)
+	test.WaitStatus(1, a, "qan-analyzer", "Idle")
+
+	// long_query_time is not set at once.
+	t.Check(s.nullmysql.GetSet(), DeepEquals, []mysql.Query{
+		mysql.Query{Set: "SET GLOBAL slow_query_log=ON"},
+	})
+
+	// Intervals are handled in order, so when the worker is set up for the
+	// next interval, long_query_time was lowered (or not) after the previous.
+	now := time.Now()
+	runInterval := func(n int, logSize int64) {
+		s.intervalChan <- &qan.Interval{
+			Number:      n,
+			StartTime:   now,
+			StopTime:    now.Add(1 * time.Minute),
+			Filename:    "slow.log",
+			StartOffset: 0,
+			EndOffset:   logSize,
+		}
+		if !test.WaitState(s.worker.SetupChan) {
+			t.Fatal("Timeout waiting for <-s.worker.SetupChan")
+		}
+		if !test.WaitState(s.worker.RunChan) {
+			t.Fatal("Timeout waiting for <-s.worker.RunChan")
+		}
+		if !test.WaitState(s.worker.CleanupChan) {
+			t.Fatal("Timeout waiting for <-s.worker.CleanupChan")
+		}
+	}
+
+	// Slow log grew more than RampMaxLogSize: long_query_time is not lowered.
+	runInterval(1, 5000)
+	runInterval(2, 500)
+	t.Check(s.nullmysql.GetSet(), HasLen, 1)
+
+	runInterval(3, 500)
+	t.Check(s.nullmysql.GetSet(), DeepEquals, []mysql.Query{
+		mysql.Query{Set: "SET GLOBAL slow_query_log=ON"},
+		mysql.Query{Set: "SET GLOBAL long_query_time = 5"},
+	})
+
+	// Target reached after RampIntervals steps, then the ramp is done.
+	runInterval(4, 500)
+	runInterval(5, 500)
+	t.Check(s.nullmysql.GetSet(), DeepEquals, []mysql.Query{
+		mysql.Query{Set: "SET GLOBAL slow_query_log=ON"},
+		mysql.Query{Set: "SET GLOBAL long_query_time = 5"},
+		mysql.Query{Set: "SET GLOBAL long_query_time = 0"},
+	})
+
+	err = a.Stop()
+	t.Assert(err, IsNil)
+	test.WaitStatus(1, a, "qan-analyzer", "Stopped")
+}
+
+func (s *AnalyzerTestSuite) TestRaiseLongQueryTime(t *C) {
+	t.Check(qan.RaiseLongQueryTime(0), Equals, 0.1)
+	t.Check(qan.RaiseLongQueryTime(0.5), Equals, 1.0)
+	t.Check(qan.RaiseLongQueryTime(8), Equals, qan.MAX_VALVE_LONG_QUERY_TIME)
+
+	now := time.Now()
+	i := &qan.Interval{
+		StartTime:   now,
+		StopTime:    now.Add(2 * time.Minute),
+		StartOffset: 1024 * 1024,
+		EndOffset:   4 * 1024 * 1024,
+		PrevFiles: []qan.LogFile{
+			{Filename: "slow.log.1", StartOffset: 0, EndOffset: 1024 * 1024},
+		},
+	}
+	t.Check(qan.SlowLogRate(i), Equals, 2.0)
+}
+
+func (s *AnalyzerTestSuite) TestSlowLogValve(t *C) {
+	s.nullmysql.SetGlobalVarNumber("long_query_time", 0)
+	s.nullmysql.SetGlobalVarString("log_slow_admin_statements", "ON")
+	config := s.config
+	config.MaxSlowLogRate = 1 // MB/minute
+	a := qan.NewRealAnalyzer(
+		pct.NewLogger(s.logChan, "qan-analyzer"),
+		config,
+		s.iter,
+		s.nullmysql,
+		s.restartChan,
+		s.worker,
+		s.clock,
+		s.spool,
+	)
+	err := a.Start()
+	t.Assert(err, IsNil)
+	test.WaitStatus(1, a, "qan-analyzer", "Idle")
+	t.Check(s.nullmysql.GetSet(), DeepEquals, config.Start)
+
+	// Intervals are handled in order, so when the worker is set up for the
+	// next interval, the valve was checked after the previous.
+	now := time.Now()
+	runInterval := func(n int, logSize int64) {
+		s.intervalChan <- &qan.Interval{
+			Number:      n,
+			StartTime:   now,
+			StopTime:    now.Add(1 * time.Minute),
+			Filename:    "slow.log",
+			StartOffset: 0,
+			EndOffset:   logSize,
+		}
+		if !test.WaitState(s.worker.SetupChan) {
+			t.Fatal("Timeout waiting for <-s.worker.SetupChan")
+		}
+		if !test.WaitState(s.worker.RunChan) {
+			t.Fatal("Timeout waiting for <-s.worker.RunChan")
+		}
+		if !test.WaitState(s.worker.CleanupChan) {
+			t.Fatal("Timeout waiting for <-s.worker.CleanupChan")
+		}
+	}
+
+	// 500 KB/minute is ok, 2 MB/minute is too much.
+	runInterval(1, 500*1024)
+	runInterval(2, 2*1024*1024)
+	runInterval(3, 0)
+	t.Check(s.nullmysql.GetSet(), DeepEquals, []mysql.Query{
+		mysql.Query{Set: "-- start"},
+		mysql.Query{Set: "SET GLOBAL long_query_time = 0.1"},
+		mysql.Query{Set: "SET GLOBAL log_slow_admin_statements = OFF"},
+	})
+
+	err = a.Stop()
+	t.Assert(err, IsNil)
+	test.WaitStatus(1, a, "qan-analyzer", "Stopped")
+}
@@ -0,0 +1,267 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package qan
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/percona/cloud-protocol/proto/v1"
+	"github.com/percona/percona-agent/data"
+	"github.com/percona/percona-agent/pct"
+)
+
+// Backfill is the data of a Backfill cmd: the MySQL instance and the time
+// range (UTC) to analyze.  If End is zero, it's now.  If Begin is zero, it's
+// BACKFILL_DEFAULT_RANGE before End.
+type Backfill struct {
+	proto.ServiceInstance
+	Begin time.Time
+	End   time.Time
+}
+
+const BACKFILL_DEFAULT_RANGE = 24 * time.Hour
+
+// A BinlogBackfill is the binary logs, oldest first, in which a backfill
+// counts events between Begin and End, see BinlogCounter.
+type BinlogBackfill struct {
+	Files []string
+	Begin time.Time
+	End   time.Time
+}
+
+// A BackfillAnalyzer analyzes historical data, e.g. the past 24 hours of the
+// slow log, so new installs are not blind to the past.  Unlike a RealAnalyzer,
+// it does not configure MySQL or wait for the clock: it counts binary log
+// events, if binlog is not nil, then runs its worker for every interval from
+// its iter until the iter is done.  iter and worker are nil if there's no
+// slow log to replay, e.g. when collecting from perf schema which has no
+// history.  Reports are tagged Backfill=true.
+type BackfillAnalyzer struct {
+	logger *pct.Logger
+	config Config
+	iter   IntervalIter
+	worker Worker
+	binlog *BinlogBackfill
+	spool  data.Spooler
+	// --
+	name     string
+	status   *pct.Status
+	sync     *pct.SyncChan
+	doneChan chan struct{}
+	running  bool
+	mux      *sync.Mutex
+}
+
+func NewBackfillAnalyzer(logger *pct.Logger, config Config, iter IntervalIter, worker Worker, binlog *BinlogBackfill, spool data.Spooler) *BackfillAnalyzer {
+	name := logger.Service()
+	a := &BackfillAnalyzer{
+		logger: logger,
+		config: config,
+		iter:   iter,
+		worker: worker,
+		binlog: binlog,
+		spool:  spool,
+		// --
+		name:     name,
+		status:   pct.NewStatus([]string{name}),
+		sync:     pct.NewSyncChan(),
+		doneChan: make(chan struct{}),
+		mux:      &sync.Mutex{},
+	}
+	return a
+}
+
+func (a *BackfillAnalyzer) String() string {
+	return a.name
+}
+
+// Start starts the backfill and returns immediately.  A BackfillAnalyzer
+// runs only once; make a new one to backfill again.
+func (a *BackfillAnalyzer) Start() error {
+	a.mux.Lock()
+	defer a.mux.Unlock()
+	if a.running {
+		return pct.ServiceIsRunningError{Service: a.name}
+	}
+	a.running = true
+	go a.run()
+	return nil
+}
+
+// Stop stops the backfill if it's still running.  It waits for the current
+// interval to be processed.
+func (a *BackfillAnalyzer) Stop() error {
+	a.mux.Lock()
+	defer a.mux.Unlock()
+	if !a.running {
+		return nil
+	}
+	select {
+	case a.sync.StopChan <- true:
+		a.sync.Wait()
+	case <-a.doneChan:
+	}
+	a.running = false
+	return nil
+}
+
+func (a *BackfillAnalyzer) Status() map[string]string {
+	if a.worker == nil {
+		return a.status.All()
+	}
+	return a.status.Merge(a.worker.Status())
+}
+
+func (a *BackfillAnalyzer) Config() Config {
+	return a.config
+}
+
+func (a *BackfillAnalyzer) SetConfig(config Config) {
+	a.config = config
+}
+
+// --------------------------------------------------------------------------
+
+func (a *BackfillAnalyzer) run() {
+	a.logger.Debug("run:call")
+	defer a.logger.Debug("run:return")
+
+	n := 0
+	defer func() {
+		if a.iter != nil {
+			a.iter.Stop()
+		}
+		if err := recover(); err != nil {
+			a.logger.Error("QAN backfill crashed: ", err)
+			a.status.Update(a.name, "Crashed")
+		} else {
+			a.sync.Graceful()
+			a.logger.Info(fmt.Sprintf("Done, %d intervals", n))
+			a.status.Update(a.name, fmt.Sprintf("Done, %d intervals", n))
+		}
+		close(a.doneChan)
+		a.sync.Done()
+	}()
+
+	a.logger.Info("Started")
+	a.status.Update(a.name, "Running")
+	if a.binlog != nil && !a.countBinlogs() {
+		return // stopped
+	}
+	if a.iter == nil {
+		return // no slow log
+	}
+	a.iter.Start()
+	for {
+		select {
+		case interval, ok := <-a.iter.IntervalChan():
+			if !ok {
+				return // iter done
+			}
+			a.status.Update(a.name, fmt.Sprintf("Running interval '%s'", interval))
+			a.runWorker(interval)
+			n++
+		case <-a.sync.StopChan:
+			a.logger.Debug("run:stop")
+			return
+		}
+	}
+}
+
+// countBinlogs counts binary log events and spools the reports.  It returns
+// false if the backfill is stopped.  A binlog that cannot be read, e.g. purged
+// since it was listed, is skipped.
+func (a *BackfillAnalyzer) countBinlogs() bool {
+	a.logger.Debug("countBinlogs:call")
+	defer a.logger.Debug("countBinlogs:return")
+
+	c := NewBinlogCounter(a.config, a.binlog.Begin, a.binlog.End)
+	for _, file := range a.binlog.Files {
+		select {
+		case <-a.sync.StopChan:
+			a.logger.Debug("countBinlogs:stop")
+			return false
+		default:
+		}
+		// A binlog last written before the range has no events in it.
+		fileInfo, err := os.Stat(file)
+		if err != nil {
+			a.logger.Warn(err)
+			continue
+		}
+		if fileInfo.ModTime().Before(a.binlog.Begin) {
+			continue
+		}
+		a.status.Update(a.name, "Counting binlog events in "+file)
+		f, err := os.Open(file)
+		if err != nil {
+			a.logger.Warn(err)
+			continue
+		}
+		err = c.Count(f)
+		f.Close()
+		if err != nil {
+			a.logger.Warn(fmt.Sprintf("Cannot count binlog events in %s: %s", file, err))
+		}
+	}
+	reports := c.Reports()
+	for _, report := range reports {
+		if err := a.spool.Write("qan-binlog", report); err != nil {
+			a.logger.Warn("Lost binlog report:", err)
+		}
+	}
+	a.logger.Info(fmt.Sprintf("Counted binlog events in %d intervals", len(reports)))
+	return true
+}
+
+func (a *BackfillAnalyzer) runWorker(interval *Interval) {
+	a.logger.Debug(fmt.Sprintf("runWorker:call:%d", interval.Number))
+	defer a.logger.Debug(fmt.Sprintf("runWorker:return:%d", interval.Number))
+
+	if err := a.worker.Setup(interval); err != nil {
+		a.logger.Warn(err)
+		return
+	}
+	defer func() {
+		if err := a.worker.Cleanup(); err != nil {
+			a.logger.Warn(err)
+		}
+	}()
+
+	t0 := time.Now()
+	result, err := a.worker.Run()
+	t1 := time.Now()
+	if err != nil {
+		a.logger.Error(err)
+		return
+	}
+	if result == nil {
+		return
+	}
+	result.RunTime = t1.Sub(t0).Seconds()
+
+	// NOTE: "qan" here is correct; do not use a.name.
+	report := MakeReport(a.config, interval, result)
+	report.Backfill = true
+	if err := a.spool.Write("qan", report); err != nil {
+		a.logger.Warn("Lost report:", err)
+	}
+}
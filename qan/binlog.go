@@ -0,0 +1,203 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package qan
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"time"
+
+	"github.com/percona/cloud-protocol/proto/v1"
+)
+
+// --------------------------------------------------------------------------
+// Binary log event counters
+// http://dev.mysql.com/doc/internals/en/binlog-event-header.html
+// --------------------------------------------------------------------------
+
+// BINLOG_MAGIC starts a binary log file.  BINLOG_HEADER_SIZE is the size of a
+// v4 (MySQL 5.0 and newer) event header: timestamp, type, server id, event
+// size, next position, flags.
+const (
+	BINLOG_MAGIC       = "\xfebin"
+	BINLOG_HEADER_SIZE = 19
+)
+
+// Binary log event types by type code, named like SHOW BINLOG EVENTS
+// Event_type lowercase without the version, e.g. Write_rows_v1 -> write_rows,
+// so they match the mm mysql/binlog/events_<type> metrics.  Unknown types are
+// counted as "unknown".
+var BinlogEventTypes = map[byte]string{
+	1:   "start_v3",
+	2:   "query",
+	3:   "stop",
+	4:   "rotate",
+	5:   "intvar",
+	6:   "load",
+	8:   "create_file",
+	9:   "append_block",
+	10:  "exec_load",
+	11:  "delete_file",
+	12:  "new_load",
+	13:  "rand",
+	14:  "user_var",
+	15:  "format_desc",
+	16:  "xid",
+	17:  "begin_load_query",
+	18:  "execute_load_query",
+	19:  "table_map",
+	20:  "write_rows",
+	21:  "update_rows",
+	22:  "delete_rows",
+	23:  "write_rows",
+	24:  "update_rows",
+	25:  "delete_rows",
+	26:  "incident",
+	27:  "heartbeat",
+	28:  "ignorable",
+	29:  "rows_query",
+	30:  "write_rows",
+	31:  "update_rows",
+	32:  "delete_rows",
+	33:  "gtid",
+	34:  "anonymous_gtid",
+	35:  "previous_gtids",
+	160: "annotate_rows",     // MariaDB
+	161: "binlog_checkpoint", // MariaDB
+	162: "gtid",              // MariaDB
+	163: "gtid_list",         // MariaDB
+}
+
+// A BinlogReport is the binary log event counts of an interval.  Backfills
+// spool them as "qan-binlog" data with their slow log reports, so history
+// is not blind to writes even when the slow log was off.
+type BinlogReport struct {
+	proto.ServiceInstance                   // MySQL instance
+	StartTs               time.Time         // of interval, UTC
+	EndTs                 time.Time         // of interval, UTC
+	Backfill              bool              `json:",omitempty"` // historical data, see BackfillAnalyzer
+	Events                map[string]uint64 // by type, see BinlogEventTypes
+	Bytes                 uint64            // size of all events
+}
+
+// A BinlogCounter counts binary log events by type per interval between begin
+// (inclusive) and end (exclusive).  Intervals are aligned to config.Interval
+// seconds like the clock ticks of a RealAnalyzer.
+type BinlogCounter struct {
+	config   Config
+	begin    time.Time
+	end      time.Time
+	interval int64
+	reports  map[int64]*BinlogReport
+}
+
+func NewBinlogCounter(config Config, begin, end time.Time) *BinlogCounter {
+	interval := int64(config.Interval)
+	if interval <= 0 {
+		interval = 60
+	}
+	c := &BinlogCounter{
+		config:   config,
+		begin:    begin,
+		end:      end,
+		interval: interval,
+		reports:  make(map[int64]*BinlogReport),
+	}
+	return c
+}
+
+// Count counts the events in a binary log.  An event cut short at the end, as
+// when MySQL is still writing it, is ignored.
+func (c *BinlogCounter) Count(r io.Reader) error {
+	br := bufio.NewReaderSize(r, 64*1024)
+	magic := make([]byte, len(BINLOG_MAGIC))
+	if _, err := io.ReadFull(br, magic); err != nil || string(magic) != BINLOG_MAGIC {
+		return errors.New("Not a binary log: bad magic number")
+	}
+	header := make([]byte, BINLOG_HEADER_SIZE)
+	for {
+		if _, err := io.ReadFull(br, header); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				return nil
+			}
+			return err
+		}
+		ts := int64(binary.LittleEndian.Uint32(header[0:4]))
+		eventType := header[4]
+		size := int64(binary.LittleEndian.Uint32(header[9:13]))
+		if size < BINLOG_HEADER_SIZE {
+			return fmt.Errorf("Invalid binary log event: size %d", size)
+		}
+		if _, err := io.CopyN(ioutil.Discard, br, size-BINLOG_HEADER_SIZE); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		c.add(ts, eventType, uint64(size))
+	}
+}
+
+// Reports returns the reports of intervals with events, oldest first.
+func (c *BinlogCounter) Reports() []*BinlogReport {
+	starts := make([]int64, 0, len(c.reports))
+	for start := range c.reports {
+		starts = append(starts, start)
+	}
+	sort.Sort(int64s(starts))
+	reports := make([]*BinlogReport, len(starts))
+	for i, start := range starts {
+		reports[i] = c.reports[start]
+	}
+	return reports
+}
+
+func (c *BinlogCounter) add(ts int64, eventType byte, size uint64) {
+	if ts < c.begin.Unix() || ts >= c.end.Unix() {
+		return
+	}
+	start := ts - ts%c.interval
+	report, ok := c.reports[start]
+	if !ok {
+		report = &BinlogReport{
+			ServiceInstance: c.config.ServiceInstance,
+			StartTs:         time.Unix(start, 0).UTC(),
+			EndTs:           time.Unix(start+c.interval, 0).UTC(),
+			Backfill:        true,
+			Events:          make(map[string]uint64),
+		}
+		c.reports[start] = report
+	}
+	name, ok := BinlogEventTypes[eventType]
+	if !ok {
+		name = "unknown"
+	}
+	report.Events[name]++
+	report.Bytes += size
+}
+
+type int64s []int64
+
+func (a int64s) Len() int           { return len(a) }
+func (a int64s) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a int64s) Less(i, j int) bool { return a[i] < a[j] }
@@ -0,0 +1,120 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package qan
+
+import (
+	"time"
+)
+
+// A Bucket is part of an interval, beginning at Ts and Config.BucketSize
+// seconds long.  Buckets show when in an interval queries ran, e.g. a spike
+// in the last minute of a 5 minute interval.
+type Bucket struct {
+	Ts    time.Time               // UTC
+	Class map[string]*BucketClass // keyed on query class id
+}
+
+type BucketClass struct {
+	TotalQueries uint
+	QueryTimeSum float64 // seconds
+	QueryTimeMax float64 // seconds
+}
+
+// Buckets aggregates query times into buckets of an interval.
+type Buckets struct {
+	start   time.Time
+	size    time.Duration
+	buckets []Bucket
+}
+
+func NewBuckets(start, stop time.Time, size time.Duration) *Buckets {
+	n := 1
+	if size > 0 && !start.IsZero() && stop.After(start) {
+		n = int((stop.Sub(start) + size - 1) / size)
+	}
+	buckets := make([]Bucket, n)
+	for i := range buckets {
+		buckets[i] = Bucket{
+			Ts:    start.Add(time.Duration(i) * size).UTC(),
+			Class: make(map[string]*BucketClass),
+		}
+	}
+	b := &Buckets{
+		start:   start,
+		size:    size,
+		buckets: buckets,
+	}
+	return b
+}
+
+// Add adds a query that ran at ts (UTC) to its bucket.  A ts outside the
+// interval is added to the first or last bucket: event times are only
+// seconds, and the last events of an interval can be logged after it stops.
+func (b *Buckets) Add(ts time.Time, id string, queryTime float64) {
+	i := 0
+	if b.size > 0 && ts.After(b.start) {
+		i = int(ts.Sub(b.start) / b.size)
+	}
+	if i >= len(b.buckets) {
+		i = len(b.buckets) - 1
+	}
+	c, ok := b.buckets[i].Class[id]
+	if !ok {
+		c = &BucketClass{}
+		b.buckets[i].Class[id] = c
+	}
+	c.TotalQueries++
+	c.QueryTimeSum += queryTime
+	if queryTime > c.QueryTimeMax {
+		c.QueryTimeMax = queryTime
+	}
+}
+
+// Buckets returns the buckets, oldest first.
+func (b *Buckets) Buckets() []Bucket {
+	return b.buckets
+}
+
+// mergeBuckets returns buckets with classes not in keep merged into the
+// low-ranking queries class "0", like MakeReport does for report classes.
+func mergeBuckets(buckets []Bucket, keep map[string]bool) []Bucket {
+	merged := make([]Bucket, len(buckets))
+	for i, bucket := range buckets {
+		merged[i] = Bucket{
+			Ts:    bucket.Ts,
+			Class: make(map[string]*BucketClass),
+		}
+		for id, c := range bucket.Class {
+			if keep[id] {
+				merged[i].Class[id] = c
+				continue
+			}
+			lrq, ok := merged[i].Class["0"]
+			if !ok {
+				lrq = &BucketClass{}
+				merged[i].Class["0"] = lrq
+			}
+			lrq.TotalQueries += c.TotalQueries
+			lrq.QueryTimeSum += c.QueryTimeSum
+			if c.QueryTimeMax > lrq.QueryTimeMax {
+				lrq.QueryTimeMax = c.QueryTimeMax
+			}
+		}
+	}
+	return merged
+}
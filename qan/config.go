@@ -25,16 +25,22 @@ import (
 type Config struct {
 	proto.ServiceInstance
 	// Manager
-	CollectFrom       string // "slowlog" or "perfschema"
+	CollectFrom       string // "slowlog", "perfschema", or "slowtable" (mysql.slow_log, log_output=TABLE)
 	Start             []mysql.Query
 	Stop              []mysql.Query
 	MaxWorkers        int
-	Interval          uint  // minutes, "How often to report"
-	MaxSlowLogSize    int64 // bytes, 0 = no max
-	RemoveOldSlowLogs bool  // after rotating for MaxSlowLogSize
+	Interval          uint    // minutes, "How often to report"
+	MaxSlowLogSize    int64   // bytes, 0 = no max; slowtable: max mysql.slow_log size
+	RemoveOldSlowLogs bool    // after rotating for MaxSlowLogSize
+	SlowLogFiles      string  // glob of slow logs rotated by other programs, e.g. slow.log.*
+	RampIntervals     uint    // lower long_query_time from its current value to the value in Start over this many intervals, 0 = at once
+	RampMaxLogSize    int64   // bytes, don't lower long_query_time after an interval in which the slow log grew more, 0 = no max
+	MaxSlowLogRate    float64 // MB/minute, raise long_query_time if the slow log grows faster during an interval, 0 = no max
 	// Worker
 	ExampleQueries bool // only fingerprints if false
 	WorkerRunTime  uint // seconds
+	BucketSize     uint // seconds, report class query time per bucket of the interval, 0 = no buckets (slowlog and slowtable only)
 	// Report
 	ReportLimit uint
+	Dimensions  map[string]string `json:",omitempty"` // added to every report, e.g. cluster: prod-1
 }
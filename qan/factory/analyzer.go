@@ -18,15 +18,19 @@
 package factory
 
 import (
+	"fmt"
+	"math"
 	"time"
 
 	"github.com/percona/cloud-protocol/proto/v1"
+	"github.com/percona/percona-agent/bus"
 	"github.com/percona/percona-agent/data"
 	"github.com/percona/percona-agent/mysql"
 	"github.com/percona/percona-agent/pct"
 	"github.com/percona/percona-agent/qan"
 	"github.com/percona/percona-agent/qan/perfschema"
 	"github.com/percona/percona-agent/qan/slowlog"
+	"github.com/percona/percona-agent/qan/slowtable"
 	"github.com/percona/percona-agent/ticker"
 )
 
@@ -35,6 +39,7 @@ type RealAnalyzerFactory struct {
 	iterFactory             qan.IntervalIterFactory
 	slowlogWorkerFactory    slowlog.WorkerFactory
 	perfschemaWorkerFactory perfschema.WorkerFactory
+	slowtableWorkerFactory  slowtable.WorkerFactory
 	spool                   data.Spooler
 	clock                   ticker.Manager
 }
@@ -44,6 +49,7 @@ func NewRealAnalyzerFactory(
 	iterFactory qan.IntervalIterFactory,
 	slowlogWorkerFactory slowlog.WorkerFactory,
 	perfschemaWorkerFactory perfschema.WorkerFactory,
+	slowtableWorkerFactory slowtable.WorkerFactory,
 	spool data.Spooler,
 	clock ticker.Manager,
 ) *RealAnalyzerFactory {
@@ -52,8 +58,9 @@ func NewRealAnalyzerFactory(
 		iterFactory:             iterFactory,
 		slowlogWorkerFactory:    slowlogWorkerFactory,
 		perfschemaWorkerFactory: perfschemaWorkerFactory,
-		spool: spool,
-		clock: clock,
+		slowtableWorkerFactory:  slowtableWorkerFactory,
+		spool:                   spool,
+		clock:                   clock,
 	}
 	return f
 }
@@ -62,7 +69,7 @@ func (f *RealAnalyzerFactory) Make(
 	config qan.Config,
 	name string,
 	mysqlConn mysql.Connector,
-	restartChan <-chan bool,
+	restartChan <-chan bus.Event,
 	tickChan chan time.Time,
 ) qan.Analyzer {
 	var worker qan.Worker
@@ -72,13 +79,15 @@ func (f *RealAnalyzerFactory) Make(
 		worker = f.slowlogWorkerFactory.Make(name+"-worker", config, mysqlConn)
 	case "perfschema":
 		worker = f.perfschemaWorkerFactory.Make(name+"-worker", mysqlConn)
+	case "slowtable":
+		worker = f.slowtableWorkerFactory.Make(name+"-worker", config, mysqlConn)
 	default:
 		panic("Invalid analyzerType: " + analyzerType)
 	}
 	return qan.NewRealAnalyzer(
 		pct.NewLogger(f.logChan, name),
 		config,
-		f.iterFactory.Make(analyzerType, mysqlConn, tickChan),
+		f.iterFactory.Make(config, mysqlConn, tickChan),
 		mysqlConn,
 		restartChan,
 		worker,
@@ -86,3 +95,68 @@ func (f *RealAnalyzerFactory) Make(
 		f.spool,
 	)
 }
+
+func (f *RealAnalyzerFactory) MakeBackfill(
+	config qan.Config,
+	name string,
+	mysqlConn mysql.Connector,
+	begin, end time.Time,
+) (qan.Analyzer, error) {
+	logger := pct.NewLogger(f.logChan, name)
+
+	// Count binlog events if the binlogs are available, i.e. the agent is on
+	// the MySQL server.  This doesn't depend on CollectFrom.
+	var binlog *qan.BinlogBackfill
+	if files, err := BinlogFiles(mysqlConn); err != nil {
+		logger.Info("Not counting binlog events:", err)
+	} else {
+		binlog = &qan.BinlogBackfill{Files: files, Begin: begin, End: end}
+	}
+
+	// Only the slow log can be replayed; perf schema has no history.
+	if config.CollectFrom != "slowlog" {
+		if binlog == nil {
+			return nil, fmt.Errorf("Cannot backfill from %s: only slowlog can be replayed, and binlogs are not available", config.CollectFrom)
+		}
+		return qan.NewBackfillAnalyzer(logger, config, nil, nil, binlog, f.spool), nil
+	}
+	_, filename, err := SlowLogFile(mysqlConn)
+	if err != nil {
+		return nil, err
+	}
+	utcOffset, err := slowlog.GetutcOffset(mysqlConn)
+	if err != nil {
+		return nil, err
+	}
+	// Never rotate the slow log while replaying it.
+	config.MaxSlowLogSize = math.MaxInt64
+	iter := slowlog.NewReplayIter(
+		pct.NewLogger(f.logChan, name+"-interval"),
+		filename,
+		begin,
+		end,
+		time.Duration(config.Interval)*time.Second,
+		utcOffset,
+	)
+	worker := f.slowlogWorkerFactory.Make(name+"-worker", config, mysqlConn)
+	return qan.NewBackfillAnalyzer(logger, config, iter, worker, binlog, f.spool), nil
+}
+
+func (f *RealAnalyzerFactory) ShipSlowLog(mysqlConn mysql.Connector, req qan.SlowLogSliceRequest) (*qan.SlowLogSlice, error) {
+	_, filename, err := SlowLogFile(mysqlConn)
+	if err != nil {
+		return nil, err
+	}
+	utcOffset, err := slowlog.GetutcOffset(mysqlConn)
+	if err != nil {
+		return nil, err
+	}
+	slice, err := slowlog.ReadSlice(filename, req, utcOffset)
+	if err != nil {
+		return nil, err
+	}
+	if err := f.spool.Write("qan-slowlog", slice); err != nil {
+		return nil, err
+	}
+	return slice, nil
+}
@@ -0,0 +1,84 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package factory
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/percona/percona-agent/mysql"
+)
+
+// BinlogFiles returns the binary logs listed by SHOW BINARY LOGS, oldest first,
+// that the agent can read.  It returns an error if binary logging is off or
+// none can be read, e.g. the agent isn't on the MySQL server or can't read the
+// datadir.  It requires the REPLICATION CLIENT privilege.
+func BinlogFiles(mysqlConn mysql.Connector) ([]string, error) {
+	if err := mysqlConn.Connect(1); err != nil {
+		return nil, err
+	}
+	defer mysqlConn.Close()
+
+	if logBin := mysqlConn.GetGlobalVarString("log_bin"); logBin != "1" && logBin != "ON" {
+		return nil, errors.New("binary logging is off")
+	}
+
+	// Binlogs are in the dir of log_bin_basename (MySQL 5.6 and newer), else
+	// in the datadir.
+	dir := mysqlConn.GetGlobalVarString("datadir")
+	if basename := mysqlConn.GetGlobalVarString("log_bin_basename"); basename != "" {
+		dir = filepath.Dir(basename)
+	}
+
+	// SHOW BINARY LOGS has 2 or 3 columns depending on the version, but we
+	// only need the first.
+	rows, err := mysqlConn.DB().Query("SHOW BINARY LOGS")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	cols, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+	files := []string{}
+	for rows.Next() {
+		vals := make([]interface{}, len(cols))
+		for i := range vals {
+			vals[i] = new(sql.RawBytes)
+		}
+		if err := rows.Scan(vals...); err != nil {
+			return nil, err
+		}
+		file := AbsDataFile(dir, string(*vals[0].(*sql.RawBytes)))
+		if f, err := os.Open(file); err == nil {
+			f.Close()
+			files = append(files, file)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("cannot read binary logs in %s", dir)
+	}
+	return files, nil
+}
@@ -18,7 +18,11 @@
 package factory
 
 import (
+	"fmt"
+	"os"
 	"path"
+	"path/filepath"
+	"sort"
 	"time"
 
 	"github.com/percona/cloud-protocol/proto/v1"
@@ -40,34 +44,93 @@ func NewRealIntervalIterFactory(logChan chan *proto.LogEntry) *RealIntervalIterF
 	return f
 }
 
-func (f *RealIntervalIterFactory) Make(analyzerType string, mysqlConn mysql.Connector, tickChan chan time.Time) qan.IntervalIter {
-	switch analyzerType {
+func (f *RealIntervalIterFactory) Make(config qan.Config, mysqlConn mysql.Connector, tickChan chan time.Time) qan.IntervalIter {
+	switch analyzerType := config.CollectFrom; analyzerType {
 	case "slowlog":
 		// The interval iter gets the slow log file (@@global.slow_query_log_file)
 		// every tick because it can change (not typical, but possible). If it changes,
-		// the start offset is reset to 0 for the new file.
-		getSlowLogFunc := func() (string, error) {
-			if err := mysqlConn.Connect(1); err != nil {
-				return "", err
+		// the start offset is reset to 0 for the new file.  If another program
+		// rotates the slow log, config.SlowLogFiles matches the rotated files
+		// so the iter can finish parsing them.
+		getSlowLogFunc := func() ([]string, error) {
+			dataDir, filename, err := SlowLogFile(mysqlConn)
+			if err != nil {
+				return nil, err
 			}
-			defer mysqlConn.Close()
-			// Slow log file can be absolute or relative. If it's relative,
-			// then prepend the datadir.
-			dataDir := mysqlConn.GetGlobalVarString("datadir")
-			filename := AbsDataFile(dataDir, mysqlConn.GetGlobalVarString("slow_query_log_file"))
-			return filename, nil
+			if config.SlowLogFiles == "" {
+				return []string{filename}, nil
+			}
+			files, err := RotatedFiles(AbsDataFile(dataDir, config.SlowLogFiles), filename)
+			if err != nil {
+				return nil, err
+			}
+			return append(files, filename), nil
 		}
-		return slowlog.NewIter(pct.NewLogger(f.logChan, "qan-interval"), getSlowLogFunc, tickChan)
-	case "perfschema":
+		logger := pct.NewLogger(f.logChan, "qan-interval")
+		iter := slowlog.NewIter(logger, getSlowLogFunc, tickChan)
+		if store, err := pct.Basedir.Store(); err == nil {
+			iter.SaveOffsets(store, fmt.Sprintf("%s-%d", config.Service, config.InstanceId))
+		} else {
+			logger.Warn("Not saving slow log offsets: ", err)
+		}
+		return iter
+	case "perfschema", "slowtable":
+		// Both read intervals by time, not by file offset.
 		return perfschema.NewIter(pct.NewLogger(f.logChan, "qan-interval"), tickChan)
 	default:
 		panic("Invalid analyzerType: " + analyzerType)
 	}
 }
 
+// SlowLogFile returns the MySQL datadir and the absolute slow log file.
+func SlowLogFile(mysqlConn mysql.Connector) (dataDir, filename string, err error) {
+	if err := mysqlConn.Connect(1); err != nil {
+		return "", "", err
+	}
+	defer mysqlConn.Close()
+	// Slow log file can be absolute or relative. If it's relative,
+	// then prepend the datadir.
+	dataDir = mysqlConn.GetGlobalVarString("datadir")
+	filename = AbsDataFile(dataDir, mysqlConn.GetGlobalVarString("slow_query_log_file"))
+	return dataDir, filename, nil
+}
+
 func AbsDataFile(dataDir, fileName string) string {
 	if !path.IsAbs(fileName) {
 		fileName = path.Join(dataDir, fileName)
 	}
 	return fileName
 }
+
+// RotatedFiles returns the files matching glob, oldest (by modify time) first,
+// excluding the current file.
+func RotatedFiles(glob, current string) ([]string, error) {
+	matches, err := filepath.Glob(glob)
+	if err != nil {
+		return nil, err
+	}
+	curInfo, _ := os.Stat(current)
+	files := []string{}
+	modTime := make(map[string]time.Time)
+	for _, file := range matches {
+		fileInfo, err := os.Stat(file)
+		if err != nil || fileInfo.IsDir() || os.SameFile(curInfo, fileInfo) {
+			continue
+		}
+		files = append(files, file)
+		modTime[file] = fileInfo.ModTime()
+	}
+	sort.Sort(byModTime{files, modTime})
+	return files, nil
+}
+
+type byModTime struct {
+	files   []string
+	modTime map[string]time.Time
+}
+
+func (a byModTime) Len() int      { return len(a.files) }
+func (a byModTime) Swap(i, j int) { a.files[i], a.files[j] = a.files[j], a.files[i] }
+func (a byModTime) Less(i, j int) bool {
+	return a.modTime[a.files[i]].Before(a.modTime[a.files[j]])
+}
@@ -35,6 +35,15 @@ type Interval struct {
 	Filename    string // slow_query_log_file
 	StartOffset int64  // bytes @ StartTime
 	EndOffset   int64  // bytes @ StopTime
+	PrevFiles   []LogFile
+}
+
+// A LogFile is part of a slow log file which was rotated (renamed) by another
+// program during an Interval.  PrevFiles are parsed in order before Filename.
+type LogFile struct {
+	Filename    string
+	StartOffset int64
+	EndOffset   int64
 }
 
 func (i *Interval) String() string {
@@ -53,5 +62,5 @@ type IntervalIter interface {
 
 // An IntervalIterFactory makes an IntervalIter, real or mock.
 type IntervalIterFactory interface {
-	Make(analyzerType string, mysqlConn mysql.Connector, tickChan chan time.Time) IntervalIter
+	Make(config Config, mysqlConn mysql.Connector, tickChan chan time.Time) IntervalIter
 }
@@ -22,10 +22,12 @@ import (
 	"errors"
 	"fmt"
 	"os"
+	"regexp"
 	"sync"
 	"time"
 
 	"github.com/percona/cloud-protocol/proto/v1"
+	"github.com/percona/percona-agent/bus"
 	"github.com/percona/percona-agent/instance"
 	"github.com/percona/percona-agent/mrms"
 	"github.com/percona/percona-agent/mysql"
@@ -36,10 +38,10 @@ import (
 // An AnalyzerInstnace is an Analyzer ran by a Manager, one per MySQL instance
 // as configured.
 type AnalyzerInstance struct {
-	mysqlConn   mysql.Connector
-	restartChan <-chan bool
-	tickChan    chan time.Time
-	analyzer    Analyzer
+	mysqlConn mysql.Connector
+	restarts  *bus.Subscription
+	tickChan  chan time.Time
+	analyzer  Analyzer
 }
 
 // A Manager runs AnalyzerInstances, one per MySQL instance as configured.
@@ -48,12 +50,14 @@ type Manager struct {
 	clock           ticker.Manager
 	im              *instance.Repo
 	mrm             mrms.Monitor
+	bus             *bus.Bus
 	mysqlFactory    mysql.ConnectionFactory
 	analyzerFactory AnalyzerFactory
 	// --
 	mux       *sync.RWMutex
 	running   bool
 	analyzers map[uint]AnalyzerInstance
+	backfills map[uint]Analyzer
 	status    *pct.Status
 }
 
@@ -62,6 +66,7 @@ func NewManager(
 	clock ticker.Manager,
 	im *instance.Repo,
 	mrm mrms.Monitor,
+	b *bus.Bus,
 	mysqlFactory mysql.ConnectionFactory,
 	analyzerFactory AnalyzerFactory,
 ) *Manager {
@@ -70,11 +75,13 @@ func NewManager(
 		clock:           clock,
 		im:              im,
 		mrm:             mrm,
+		bus:             b,
 		mysqlFactory:    mysqlFactory,
 		analyzerFactory: analyzerFactory,
 		// --
 		mux:       &sync.RWMutex{},
 		analyzers: make(map[uint]AnalyzerInstance),
+		backfills: make(map[uint]Analyzer),
 		status:    pct.NewStatus([]string{"qan"}),
 	}
 	return m
@@ -162,6 +169,11 @@ func (m *Manager) Status() map[string]string {
 			status[k] = v
 		}
 	}
+	for _, b := range m.backfills {
+		for k, v := range b.Status() {
+			status[k] = v
+		}
+	}
 	return status
 }
 
@@ -177,7 +189,7 @@ func (m *Manager) Handle(cmd *proto.Cmd) *proto.Reply {
 			return cmd.Reply(nil, pct.ServiceIsNotRunningError{Service: "qan"})
 		}
 		config := Config{}
-		if err := json.Unmarshal(cmd.Data, &config); err != nil {
+		if err := pct.UnmarshalConfig(cmd.Data, &config); err != nil {
 			return cmd.Reply(nil, err)
 		}
 		if err := m.startAnalyzer(config); err != nil {
@@ -209,6 +221,53 @@ func (m *Manager) Handle(cmd *proto.Cmd) *proto.Reply {
 	case "GetConfig":
 		config, errs := m.GetConfig()
 		return cmd.Reply(config, errs...)
+	case "ValidateConfig":
+		// Like StartService but only report what would change.
+		m.mux.RLock()
+		defer m.mux.RUnlock()
+		config := Config{}
+		if err := pct.UnmarshalConfig(cmd.Data, &config); err != nil {
+			return cmd.Reply(nil, err)
+		}
+		if err := ValidateConfig(&config); err != nil {
+			return cmd.Reply(nil, fmt.Errorf("Invalid qan.Config: %s", err))
+		}
+		mysqlInstance := proto.MySQLInstance{}
+		if err := m.im.Get(config.Service, config.InstanceId, &mysqlInstance); err != nil {
+			return cmd.Reply(nil, fmt.Errorf("Cannot get MySQL instance from repo: %s", err))
+		}
+		var currentConfig interface{}
+		if a, ok := m.analyzers[config.InstanceId]; ok {
+			currentConfig = a.analyzer.Config()
+		}
+		changes, err := pct.ConfigChanges(currentConfig, config)
+		return cmd.Reply(changes, err)
+	case "Backfill":
+		m.mux.Lock()
+		defer m.mux.Unlock()
+		if !m.running {
+			return cmd.Reply(nil, pct.ServiceIsNotRunningError{Service: "qan"})
+		}
+		backfill := Backfill{}
+		if err := json.Unmarshal(cmd.Data, &backfill); err != nil {
+			return cmd.Reply(nil, err)
+		}
+		if err := m.startBackfill(backfill); err != nil {
+			return cmd.Reply(nil, err)
+		}
+		return cmd.Reply(nil) // success
+	case "GetSlowLog":
+		m.mux.RLock()
+		defer m.mux.RUnlock()
+		if !m.running {
+			return cmd.Reply(nil, pct.ServiceIsNotRunningError{Service: "qan"})
+		}
+		req := SlowLogSliceRequest{}
+		if err := json.Unmarshal(cmd.Data, &req); err != nil {
+			return cmd.Reply(nil, err)
+		}
+		slice, err := m.shipSlowLog(req)
+		return cmd.Reply(slice, err)
 	default:
 		// SetConfig does not work by design.  To re-configure QAN,
 		// stop it then start it again with the new config.
@@ -241,14 +300,18 @@ func (m *Manager) GetConfig() ([]proto.AgentConfig, []error) {
 	return configs, nil
 }
 
+const MAX_DIMENSIONS = 20
+
+var dimensionRe = regexp.MustCompile(`^[a-zA-Z0-9_.-]{1,64}$`)
+
 func ValidateConfig(config *Config) error {
 	if config.CollectFrom == "" {
 		// Before perf schema, CollectFrom didn't exist, so existing default QAN configs
 		// don't have it.  To be backwards-compatible, no CollectFrom == slowlog.
 		config.CollectFrom = "slowlog"
 	}
-	if config.CollectFrom != "slowlog" && config.CollectFrom != "perfschema" {
-		return fmt.Errorf("Invalid CollectFrom: '%s'.  Expected 'perfschema' or 'slowlog'.", config.CollectFrom)
+	if config.CollectFrom != "slowlog" && config.CollectFrom != "perfschema" && config.CollectFrom != "slowtable" {
+		return fmt.Errorf("Invalid CollectFrom: '%s'.  Expected 'perfschema', 'slowlog', or 'slowtable'.", config.CollectFrom)
 	}
 	if config.Start == nil || len(config.Start) == 0 {
 		return errors.New("qan.Config.Start array is empty")
@@ -274,9 +337,47 @@ func ValidateConfig(config *Config) error {
 	if config.WorkerRunTime > 1200 {
 		return errors.New("WorkerRuntime must be <= 1200 (20 minutes)")
 	}
+	if config.RampMaxLogSize < 0 {
+		return errors.New("RampMaxLogSize must be >= 0")
+	}
+	if config.MaxSlowLogRate < 0 {
+		return errors.New("MaxSlowLogRate must be >= 0")
+	}
+	if len(config.Dimensions) > MAX_DIMENSIONS {
+		return fmt.Errorf("Too many Dimensions: %d > %d", len(config.Dimensions), MAX_DIMENSIONS)
+	}
+	for k := range config.Dimensions {
+		if !dimensionRe.MatchString(k) {
+			return fmt.Errorf("Invalid dimension: '%s'.  Expected letters, digits, '_', '-', or '.', up to 64 characters.", k)
+		}
+	}
+	if config.BucketSize > 0 {
+		if config.CollectFrom == "perfschema" {
+			return errors.New("BucketSize requires CollectFrom 'slowlog' or 'slowtable'")
+		}
+		if config.BucketSize > config.Interval {
+			return errors.New("BucketSize must be <= Interval")
+		}
+	}
 	return nil
 }
 
+// ConfigSchema describes Config.  The constraints must match ValidateConfig.
+func (m *Manager) ConfigSchema() pct.ConfigSchema {
+	s := pct.NewConfigSchema("qan", Config{CollectFrom: "slowlog"})
+	s.Field("CollectFrom").Values = []string{"slowlog", "perfschema", "slowtable"}
+	s.Field("Start").Required = true
+	s.Field("Stop").Required = true
+	f := s.Field("MaxWorkers")
+	f.Min, f.Max = 1, 4
+	f = s.Field("Interval")
+	f.Min, f.Max = 1, 3600
+	f = s.Field("WorkerRunTime")
+	f.Min, f.Max = 1, 1200
+	s.Field("BucketSize").Max = 3600
+	return s
+}
+
 /////////////////////////////////////////////////////////////////////////////
 // Implementation
 /////////////////////////////////////////////////////////////////////////////
@@ -305,14 +406,26 @@ func (m *Manager) startAnalyzer(config Config) error {
 	if err := m.im.Get(config.Service, config.InstanceId, &mysqlInstance); err != nil {
 		return fmt.Errorf("Cannot get MySQL instance from repo: %s", err)
 	}
+
+	// Digests require MySQL 5.6.5 or MariaDB 10.0.12.  The version is unknown
+	// if the instance was added without getting its info, so let MySQL decide.
+	if config.CollectFrom == "perfschema" && mysqlInstance.Version != "" {
+		if f := mysql.GetFeatures(mysqlInstance.Version, mysqlInstance.Distro); !f.PerfSchemaDigests {
+			return fmt.Errorf("Cannot collect from perfschema because %s %s does not have"+
+				" performance_schema.events_statements_summary_by_digest, collect from slowlog instead",
+				f.Flavor, f.Version)
+		}
+	}
+
 	mysqlConn := m.mysqlFactory.Make(mysqlInstance.DSN)
 
 	// Add the MySQL DSN to the MySQL restart monitor. If MySQL restarts,
-	// the analyzer will stop its worker and re-configure MySQL.
-	restartChan, err := m.mrm.Add(mysqlConn.DSN())
-	if err != nil {
+	// the monitor publishes it on the bus and the analyzer will stop its
+	// worker and re-configure MySQL.
+	if err := m.mrm.Add(mysqlConn.DSN()); err != nil {
 		return fmt.Errorf("Cannot add MySQL instance to restart monitor: %s", err)
 	}
+	restarts := m.bus.Subscribe(bus.MYSQL_RESTART, 0)
 
 	// Make a chan on which the clock will tick at even intervals:
 	// clock -> tickChan -> iter -> analyzer -> worker
@@ -326,19 +439,20 @@ func (m *Manager) startAnalyzer(config Config) error {
 		config,
 		"qan-analyzer", // todo-1.1: append instance name
 		mysqlConn,
-		restartChan,
+		restarts.C,
 		tickChan,
 	)
 	if err := analyzer.Start(); err != nil {
+		restarts.Cancel()
 		return fmt.Errorf("Cannot start analyzer: %s", err)
 	}
 
 	// Save the new analyzer and its associated parts.
 	m.analyzers[config.InstanceId] = AnalyzerInstance{
-		mysqlConn:   mysqlConn,
-		restartChan: restartChan,
-		tickChan:    tickChan,
-		analyzer:    analyzer,
+		mysqlConn: mysqlConn,
+		restarts:  restarts,
+		tickChan:  tickChan,
+		analyzer:  analyzer,
 	}
 
 	return nil // success
@@ -352,6 +466,8 @@ func (m *Manager) stopAnalyzer(instanceId uint) error {
 	m.logger.Debug("stopAnalyzer:call")
 	defer m.logger.Debug("stopAnalyzer:return")
 
+	m.stopBackfill(instanceId)
+
 	a, ok := m.analyzers[instanceId]
 	if !ok {
 		m.logger.Debug("stopAnalyzer:na", instanceId)
@@ -367,7 +483,8 @@ func (m *Manager) stopAnalyzer(instanceId uint) error {
 
 	// Stop watching this MySQL instance. Other tools watching this MySQL
 	// instance are not affected.
-	m.mrm.Remove(a.mysqlConn.DSN(), a.restartChan)
+	m.mrm.Remove(a.mysqlConn.DSN())
+	a.restarts.Cancel()
 
 	// Stop the analyzer. It stops its iter and worker and un-configures MySQL.
 	if err := a.analyzer.Stop(); err != nil {
@@ -381,3 +498,97 @@ func (m *Manager) stopAnalyzer(instanceId uint) error {
 
 	return nil // success
 }
+
+func (m *Manager) startBackfill(b Backfill) error {
+	/*
+		XXX Assume caller has locked m.mux.
+	*/
+
+	m.logger.Debug("startBackfill:call")
+	defer m.logger.Debug("startBackfill:return")
+
+	// The backfill uses the config and MySQL connection of the running
+	// analyzer, so QAN must be started for the MySQL instance first.
+	a, ok := m.analyzers[b.InstanceId]
+	if !ok {
+		return fmt.Errorf("QAN is not running for MySQL instance %d", b.InstanceId)
+	}
+
+	if b.End.IsZero() {
+		b.End = time.Now().UTC()
+	}
+	if b.Begin.IsZero() {
+		b.Begin = b.End.Add(-BACKFILL_DEFAULT_RANGE)
+	}
+	if !b.Begin.Before(b.End) {
+		return fmt.Errorf("Invalid backfill range: begin %s is not before end %s", b.Begin, b.End)
+	}
+
+	// A new backfill replaces one that's still running for the instance.
+	m.stopBackfill(b.InstanceId)
+
+	backfill, err := m.analyzerFactory.MakeBackfill(
+		a.analyzer.Config(),
+		"qan-backfill", // todo-1.1: append instance name
+		a.mysqlConn,
+		b.Begin,
+		b.End,
+	)
+	if err != nil {
+		return fmt.Errorf("Cannot make backfill: %s", err)
+	}
+	if err := backfill.Start(); err != nil {
+		return fmt.Errorf("Cannot start backfill: %s", err)
+	}
+	m.logger.Info(fmt.Sprintf("Backfilling %s to %s", b.Begin, b.End))
+	m.backfills[b.InstanceId] = backfill
+
+	return nil // success
+}
+
+func (m *Manager) shipSlowLog(req SlowLogSliceRequest) (*SlowLogSlice, error) {
+	/*
+		XXX Assume caller has locked m.mux.
+	*/
+
+	m.logger.Debug("shipSlowLog:call")
+	defer m.logger.Debug("shipSlowLog:return")
+
+	// Like backfill, use the MySQL connection of the running analyzer.
+	a, ok := m.analyzers[req.InstanceId]
+	if !ok {
+		return nil, fmt.Errorf("QAN is not running for MySQL instance %d", req.InstanceId)
+	}
+	if !req.Begin.IsZero() && !req.End.IsZero() && !req.Begin.Before(req.End) {
+		return nil, fmt.Errorf("Invalid slow log range: begin %s is not before end %s", req.Begin, req.End)
+	}
+	if req.Offset < 0 || req.Length < 0 {
+		return nil, fmt.Errorf("Invalid slow log range: offset %d, length %d", req.Offset, req.Length)
+	}
+
+	slice, err := m.analyzerFactory.ShipSlowLog(a.mysqlConn, req)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot ship slow log: %s", err)
+	}
+	m.logger.Info(fmt.Sprintf("Shipped %d slow log events (%d bytes) from %s offset %d",
+		slice.Events, len(slice.Data), slice.Filename, slice.Offset))
+
+	// The raw events are sent through the data channel, not the reply.
+	reply := *slice
+	reply.Data = ""
+	return &reply, nil
+}
+
+func (m *Manager) stopBackfill(instanceId uint) {
+	/*
+		XXX Assume caller has locked m.mux.
+	*/
+	b, ok := m.backfills[instanceId]
+	if !ok {
+		return
+	}
+	if err := b.Stop(); err != nil {
+		m.logger.Warn(err)
+	}
+	delete(m.backfills, instanceId)
+}
@@ -96,6 +96,9 @@ func (s *ManagerTestSuite) SetUpTest(t *C) {
 	if err := test.ClearDir(pct.Basedir.Dir("config"), "*"); err != nil {
 		t.Fatal(err)
 	}
+	if err := test.ClearConfigs(); err != nil {
+		t.Fatal(err)
+	}
 }
 
 func (s *ManagerTestSuite) TearDownTest(t *C) {
@@ -118,7 +121,7 @@ func (s *ManagerTestSuite) TestStarNoConfig(t *C) {
 	mockConnFactory := &mock.ConnectionFactory{Conn: s.nullmysql}
 	a := mock.NewQanAnalyzer()
 	f := mock.NewQanAnalyzerFactory(a)
-	m := qan.NewManager(s.logger, s.clock, s.im, s.mrmsMonitor, mockConnFactory, f)
+	m := qan.NewManager(s.logger, s.clock, s.im, s.mrmsMonitor, s.mrmsMonitor.Bus, mockConnFactory, f)
 	t.Assert(m, NotNil)
 
 	// qan.Manager should be able to start without a qan.conf, i.e. no analyzer.
@@ -157,7 +160,7 @@ func (s *ManagerTestSuite) TestStartWithConfig(t *C) {
 		mockConnFactory := &mock.ConnectionFactory{Conn: s.nullmysql}
 		a := mock.NewQanAnalyzer()
 		f := mock.NewQanAnalyzerFactory(a)
-		m := qan.NewManager(s.logger, s.clock, s.im, s.mrmsMonitor, mockConnFactory, f)
+		m := qan.NewManager(s.logger, s.clock, s.im, s.mrmsMonitor, s.mrmsMonitor.Bus, mockConnFactory, f)
 		t.Assert(m, NotNil)
 
 		// Write a realistic qan.conf config to disk.
@@ -214,7 +217,7 @@ func (s *ManagerTestSuite) TestStartWithConfig(t *C) {
 		}
 
 		// qan.conf still exists after qan.Stop().
-		t.Check(test.FileExists(pct.Basedir.ConfigFile("qan")), Equals, true)
+		t.Check(pct.Basedir.ConfigExists("qan"), Equals, true)
 
 		// The analyzer is no longer reported in the status because it was stopped
 		// and removed when the manager was stopped.
@@ -228,7 +231,7 @@ func (s *ManagerTestSuite) TestGetConfig(t *C) {
 	mockConnFactory := &mock.ConnectionFactory{Conn: s.nullmysql}
 	a := mock.NewQanAnalyzer()
 	f := mock.NewQanAnalyzerFactory(a)
-	m := qan.NewManager(s.logger, s.clock, s.im, s.mrmsMonitor, mockConnFactory, f)
+	m := qan.NewManager(s.logger, s.clock, s.im, s.mrmsMonitor, s.mrmsMonitor.Bus, mockConnFactory, f)
 	t.Assert(m, NotNil)
 
 	// Write a realistic qan.conf config to disk.
@@ -345,6 +348,15 @@ func (s *ManagerTestSuite) TestValidateConfig(t *C) {
 	err = qan.ValidateConfig(&config)
 	t.Check(err, NotNil)
 	t.Check(config.CollectFrom, Equals, "slowlog")
+
+	// Dimensions are names like cluster or app.
+	config.MaxWorkers = 2
+	config.Dimensions = map[string]string{"cluster": "prod-1", "app.tier": "web"}
+	err = qan.ValidateConfig(&config)
+	t.Check(err, IsNil)
+	config.Dimensions = map[string]string{"my cluster": "prod-1"}
+	err = qan.ValidateConfig(&config)
+	t.Check(err, NotNil)
 }
 
 /*
@@ -356,7 +368,7 @@ func (s *ManagerTestSuite) TestStartService(t *C) {
 	mockConnFactory := &mock.ConnectionFactory{Conn: s.nullmysql}
 	a := mock.NewQanAnalyzer()
 	f := mock.NewQanAnalyzerFactory(a)
-	m := qan.NewManager(s.logger, s.clock, s.im, s.mrmsMonitor, mockConnFactory, f)
+	m := qan.NewManager(s.logger, s.clock, s.im, s.mrmsMonitor, s.mrmsMonitor.Bus, mockConnFactory, f)
 	t.Assert(m, NotNil)
 	err := m.Start()
 	t.Check(err, IsNil)
@@ -397,8 +409,8 @@ func (s *ManagerTestSuite) TestStartService(t *C) {
 	reply := m.Handle(cmd)
 	t.Assert(reply.Error, Equals, "")
 
-	// The manager writes the qan config to disk.
-	data, err := ioutil.ReadFile(pct.Basedir.ConfigFile("qan"))
+	// The manager saves the qan config.
+	data, err := pct.Basedir.ConfigData("qan")
 	t.Check(err, IsNil)
 	gotConfig := &qan.Config{}
 	err = json.Unmarshal(data, gotConfig)
@@ -437,7 +449,7 @@ func (s *ManagerTestSuite) TestStartService(t *C) {
 
 	// And the manager has removed the qan config from disk so next time
 	// the agent starts the analyzer is not started.
-	t.Check(test.FileExists(pct.Basedir.ConfigFile("qan")), Equals, false)
+	t.Check(pct.Basedir.ConfigExists("qan"), Equals, false)
 
 	// StopService should be idempotent, so send it again and expect no error.
 	reply = m.Handle(cmd)
@@ -448,11 +460,168 @@ func (s *ManagerTestSuite) TestStartService(t *C) {
 	t.Assert(err, IsNil)
 }
 
+func (s *ManagerTestSuite) TestBackfill(t *C) {
+	mockConnFactory := &mock.ConnectionFactory{Conn: s.nullmysql}
+	a := mock.NewQanAnalyzer()
+	b := mock.NewQanAnalyzer()
+	f := mock.NewQanAnalyzerFactory(a, b)
+	m := qan.NewManager(s.logger, s.clock, s.im, s.mrmsMonitor, s.mrmsMonitor.Bus, mockConnFactory, f)
+	t.Assert(m, NotNil)
+	err := m.Start()
+	t.Check(err, IsNil)
+	defer m.Stop()
+	test.WaitStatus(1, m, "qan", "Running")
+
+	// Backfill requires QAN running for the MySQL instance.
+	end := time.Date(2015, 5, 20, 10, 0, 0, 0, time.UTC)
+	data, _ := json.Marshal(&qan.Backfill{
+		ServiceInstance: s.mysqlInstance,
+		End:             end,
+	})
+	backfillCmd := &proto.Cmd{
+		User:      "daniel",
+		Ts:        time.Now(),
+		AgentUuid: "123",
+		Service:   "qan",
+		Cmd:       "Backfill",
+		Data:      data,
+	}
+	reply := m.Handle(backfillCmd)
+	t.Check(reply.Error, Equals, "QAN is not running for MySQL instance 1")
+
+	config := &qan.Config{
+		ServiceInstance: s.mysqlInstance,
+		Start:           []mysql.Query{mysql.Query{Set: "SET GLOBAL slow_query_log=ON"}},
+		Stop:            []mysql.Query{mysql.Query{Set: "SET GLOBAL slow_query_log=OFF"}},
+		Interval:        300,
+		MaxWorkers:      1,
+		WorkerRunTime:   600,
+		CollectFrom:     "slowlog",
+	}
+	qanConfig, _ := json.Marshal(config)
+	cmd := &proto.Cmd{
+		User:      "daniel",
+		Ts:        time.Now(),
+		AgentUuid: "123",
+		Service:   "qan",
+		Cmd:       "StartService",
+		Data:      qanConfig,
+	}
+	reply = m.Handle(cmd)
+	t.Assert(reply.Error, Equals, "")
+
+	// Now the backfill analyzer is made with the running analyzer's config
+	// and started.  Begin defaults to 24 hours before end.
+	reply = m.Handle(backfillCmd)
+	t.Assert(reply.Error, Equals, "")
+	t.Assert(f.Args, HasLen, 2)
+	t.Check(f.Args[1].Name, Equals, "qan-backfill")
+	t.Check(f.Args[1].Config.CollectFrom, Equals, "slowlog")
+	t.Check(f.Args[1].Begin, Equals, end.Add(-24*time.Hour))
+	t.Check(f.Args[1].End, Equals, end)
+	select {
+	case <-b.StartChan:
+	case <-time.After(1 * time.Second):
+		t.Error("Backfill analyzer not started")
+	}
+
+	// Stopping QAN stops the backfill, too.
+	cmd.Cmd = "StopService"
+	cmd.Data = nil
+	reply = m.Handle(cmd)
+	t.Assert(reply.Error, Equals, "")
+	select {
+	case <-b.StopChan:
+	case <-time.After(1 * time.Second):
+		t.Error("Backfill analyzer not stopped")
+	}
+}
+
+func (s *ManagerTestSuite) TestGetSlowLog(t *C) {
+	mockConnFactory := &mock.ConnectionFactory{Conn: s.nullmysql}
+	a := mock.NewQanAnalyzer()
+	f := mock.NewQanAnalyzerFactory(a)
+	m := qan.NewManager(s.logger, s.clock, s.im, s.mrmsMonitor, s.mrmsMonitor.Bus, mockConnFactory, f)
+	t.Assert(m, NotNil)
+	err := m.Start()
+	t.Check(err, IsNil)
+	defer m.Stop()
+	test.WaitStatus(1, m, "qan", "Running")
+
+	config := &qan.Config{
+		ServiceInstance: s.mysqlInstance,
+		Start:           []mysql.Query{mysql.Query{Set: "SET GLOBAL slow_query_log=ON"}},
+		Stop:            []mysql.Query{mysql.Query{Set: "SET GLOBAL slow_query_log=OFF"}},
+		Interval:        300,
+		MaxWorkers:      1,
+		WorkerRunTime:   600,
+		CollectFrom:     "slowlog",
+	}
+	qanConfig, _ := json.Marshal(config)
+	reply := m.Handle(&proto.Cmd{
+		User:    "daniel",
+		Ts:      time.Now(),
+		Service: "qan",
+		Cmd:     "StartService",
+		Data:    qanConfig,
+	})
+	t.Assert(reply.Error, Equals, "")
+
+	// The factory reads and spools the slice.  The reply is the same slice
+	// without the raw events.
+	f.SlowLogSlice = &qan.SlowLogSlice{
+		ServiceInstance: s.mysqlInstance,
+		Filename:        "/var/lib/mysql/slow.log",
+		NextOffset:      100,
+		Events:          2,
+		Redacted:        true,
+		Data:            "# Time: 150520 10:00:00\nselect ?;\n",
+	}
+	data, _ := json.Marshal(&qan.SlowLogSliceRequest{
+		ServiceInstance: s.mysqlInstance,
+		Length:          100,
+		Redact:          true,
+	})
+	reply = m.Handle(&proto.Cmd{
+		User:    "daniel",
+		Ts:      time.Now(),
+		Service: "qan",
+		Cmd:     "GetSlowLog",
+		Data:    data,
+	})
+	t.Assert(reply.Error, Equals, "")
+	t.Assert(f.SlowLogReqs, HasLen, 1)
+	t.Check(f.SlowLogReqs[0].Length, Equals, int64(100))
+	t.Check(f.SlowLogReqs[0].Redact, Equals, true)
+
+	got := &qan.SlowLogSlice{}
+	err = json.Unmarshal(reply.Data, got)
+	t.Assert(err, IsNil)
+	t.Check(got.Events, Equals, uint(2))
+	t.Check(got.NextOffset, Equals, int64(100))
+	t.Check(got.Data, Equals, "")
+
+	// Bad byte range.
+	data, _ = json.Marshal(&qan.SlowLogSliceRequest{
+		ServiceInstance: s.mysqlInstance,
+		Offset:          -1,
+	})
+	reply = m.Handle(&proto.Cmd{
+		User:    "daniel",
+		Ts:      time.Now(),
+		Service: "qan",
+		Cmd:     "GetSlowLog",
+		Data:    data,
+	})
+	t.Check(reply.Error, Not(Equals), "")
+	t.Check(f.SlowLogReqs, HasLen, 1)
+}
+
 func (s *ManagerTestSuite) TestBadCmd(t *C) {
 	mockConnFactory := &mock.ConnectionFactory{Conn: s.nullmysql}
 	a := mock.NewQanAnalyzer()
 	f := mock.NewQanAnalyzerFactory(a)
-	m := qan.NewManager(s.logger, s.clock, s.im, s.mrmsMonitor, mockConnFactory, f)
+	m := qan.NewManager(s.logger, s.clock, s.im, s.mrmsMonitor, s.mrmsMonitor.Bus, mockConnFactory, f)
 	t.Assert(m, NotNil)
 	err := m.Start()
 	t.Check(err, IsNil)
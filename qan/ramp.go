@@ -0,0 +1,134 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package qan
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+
+	"github.com/percona/percona-agent/mysql"
+)
+
+var longQueryTimeRe = regexp.MustCompile(`(?i)long_query_time\s*=\s*([0-9.]+)`)
+
+// A ramp lowers long_query_time from its current value to the value in
+// Config.Start over Config.RampIntervals intervals instead of at once, which
+// can flood the slow log on busy servers.  It does not lower long_query_time
+// after an interval in which the slow log grew more than Config.RampMaxLogSize.
+type ramp struct {
+	target     float64 // long_query_time in Config.Start
+	cur        float64 // long_query_time set by the ramp
+	left       uint    // steps to target
+	maxLogSize int64
+}
+
+// newRamp returns a ramp for the config, or nil if the config does not ramp
+// long_query_time: RampIntervals is zero, QAN does not collect from the slow
+// log, or Start does not set long_query_time.
+func newRamp(config Config) *ramp {
+	if config.RampIntervals == 0 || config.CollectFrom != "slowlog" {
+		return nil
+	}
+	for _, q := range config.Start {
+		if target, ok := longQueryTime(q.Set); ok {
+			return &ramp{
+				target:     target,
+				left:       config.RampIntervals,
+				maxLogSize: config.RampMaxLogSize,
+			}
+		}
+	}
+	return nil
+}
+
+// longQueryTime returns the value of long_query_time in a SET query.
+func longQueryTime(query string) (float64, bool) {
+	m := longQueryTimeRe.FindStringSubmatch(query)
+	if m == nil {
+		return 0, false
+	}
+	value, err := strconv.ParseFloat(m[1], 64)
+	if err != nil {
+		return 0, false
+	}
+	return value, true
+}
+
+// begin returns the Start queries to configure MySQL.  If the current
+// long_query_time is greater than the target, the queries which set
+// long_query_time are removed so it's lowered by step.  Else, the ramp is
+// done and start is returned as is.  The conn must be connected.
+func (r *ramp) begin(conn mysql.Connector, start []mysql.Query) []mysql.Query {
+	r.cur = conn.GetGlobalVarNumber("long_query_time")
+	if r.cur <= r.target {
+		r.left = 0
+		return start
+	}
+	queries := []mysql.Query{}
+	for _, q := range start {
+		if _, ok := longQueryTime(q.Set); ok {
+			continue
+		}
+		queries = append(queries, q)
+	}
+	return queries
+}
+
+// step returns the next long_query_time after an interval in which the slow
+// log grew logSize bytes, and true if it should be set.  It returns false if
+// the ramp is done or the slow log grew too much.
+func (r *ramp) step(logSize int64) (float64, bool) {
+	if r.left == 0 {
+		return r.cur, false
+	}
+	if r.maxLogSize > 0 && logSize > r.maxLogSize {
+		return r.cur, false
+	}
+	r.cur = NextLongQueryTime(r.cur, r.target, r.left)
+	r.left--
+	return r.cur, true
+}
+
+// longQueryTimeQuery returns the query to set long_query_time to value.
+func longQueryTimeQuery(value float64) mysql.Query {
+	return mysql.Query{Set: fmt.Sprintf("SET GLOBAL long_query_time = %s", strconv.FormatFloat(value, 'f', -1, 64))}
+}
+
+// NextLongQueryTime returns the long_query_time one step from cur toward
+// target with stepsLeft steps left: steps are equal, and the last step is
+// the target.
+func NextLongQueryTime(cur, target float64, stepsLeft uint) float64 {
+	if stepsLeft <= 1 || cur <= target {
+		return target
+	}
+	// Round to microseconds, the precision of long_query_time.
+	next := cur - (cur-target)/float64(stepsLeft)
+	next, _ = strconv.ParseFloat(strconv.FormatFloat(next, 'f', 6, 64), 64)
+	return next
+}
+
+// intervalLogSize returns how many bytes the slow log grew during the interval,
+// including rotated files.
+func intervalLogSize(interval *Interval) int64 {
+	size := interval.EndOffset - interval.StartOffset
+	for _, f := range interval.PrevFiles {
+		size += f.EndOffset - f.StartOffset
+	}
+	return size
+}
@@ -35,6 +35,7 @@ type Result struct {
 	Class      []*event.QueryClass // per-class metrics
 	RunTime    float64             // seconds parsing data, hopefully < interval
 	StopOffset int64               // slow log offset where parsing stopped, should be <= end offset
+	Buckets    []Bucket            `json:",omitempty"` // if Config.BucketSize
 	Error      string              `json:",omitempty"`
 }
 
@@ -48,6 +49,13 @@ type Report struct {
 	RunTime               float64             // seconds parsing data
 	Global                *event.GlobalClass  // metrics for all data
 	Class                 []*event.QueryClass // per-class metrics
+	Timezone              string              // agent local timezone, e.g. America/New_York
+	UtcOffset             int                 // seconds, agent local timezone offset from UTC
+	ClockOffset           int                 `json:",omitempty"` // seconds, API clock minus agent clock, see pct.ClockOffset
+	Cloud                 *pct.CloudMetadata  `json:",omitempty"` // nil if not in a cloud
+	Backfill              bool                `json:",omitempty"` // historical data, see BackfillAnalyzer
+	Buckets               []Bucket            `json:",omitempty"` // if Config.BucketSize, classes match Class
+	Dimensions            map[string]string   `json:",omitempty"` // Config.Dimensions
 	// slow log:
 	SlowLogFile     string `json:",omitempty"` // not slow_query_log_file if rotated
 	SlowLogFileSize int64  `json:",omitempty"`
@@ -70,6 +78,10 @@ func MakeReport(config Config, interval *Interval, result *Result) *Report {
 	// Sort classes by Query_time_sum, descending.
 	sort.Sort(ByQueryTime(result.Class))
 
+	if a := pct.Anonymize(); a != nil {
+		anonymize(a, result.Class)
+	}
+
 	// Make Report from Result and other metadata (e.g. Interval).
 	report := &Report{
 		ServiceInstance: config.ServiceInstance,
@@ -78,7 +90,9 @@ func MakeReport(config Config, interval *Interval, result *Result) *Report {
 		RunTime:         result.RunTime,
 		Global:          result.Global,
 		Class:           result.Class,
+		Buckets:         result.Buckets,
 	}
+	addEnvelope(report, config)
 	if interval != nil {
 		size, err := pct.FileSize(interval.Filename)
 		if err != nil {
@@ -102,6 +116,13 @@ func MakeReport(config Config, interval *Interval, result *Result) *Report {
 
 	// Top queries
 	report.Class = result.Class[0:config.ReportLimit]
+	if len(result.Buckets) > 0 {
+		top := make(map[string]bool, len(report.Class))
+		for _, class := range report.Class {
+			top[class.Id] = true
+		}
+		report.Buckets = mergeBuckets(result.Buckets, top)
+	}
 
 	// Low-ranking Queries
 	lrq := event.NewQueryClass("0", "", false, 0*time.Second)
@@ -113,6 +134,35 @@ func MakeReport(config Config, interval *Interval, result *Result) *Report {
 	return report // top classes, the rest as LRQ
 }
 
+// addEnvelope adds metadata about the agent and the instance to the report so
+// the API doesn't have to look it up for every report: timezone, cloud, and
+// Config.Dimensions.
+func addEnvelope(report *Report, config Config) {
+	report.Timezone, report.UtcOffset = pct.Timezone()
+	report.ClockOffset = int(pct.ClockOffset() / time.Second)
+	report.Cloud = pct.CloudInstance()
+	if len(config.Dimensions) > 0 {
+		// Copy so a config change doesn't change reports already made.
+		report.Dimensions = make(map[string]string, len(config.Dimensions))
+		for k, v := range config.Dimensions {
+			report.Dimensions[k] = v
+		}
+	}
+}
+
+// anonymize hashes schema, table, and column names in the query classes, see
+// pct.Anonymizer.  Example queries are replaced by their anonymized
+// fingerprint because their values can be anything.
+func anonymize(a *pct.Anonymizer, classes []*event.QueryClass) {
+	for _, class := range classes {
+		class.Fingerprint = a.Query(class.Fingerprint)
+		if class.Example != nil {
+			class.Example.Db = a.Name(class.Example.Db)
+			class.Example.Query = class.Fingerprint
+		}
+	}
+}
+
 func addQuery(dst, src *event.QueryClass) {
 	dst.TotalQueries++
 	for srcMetric, srcStats := range src.Metrics.TimeMetrics {
@@ -18,6 +18,8 @@
 package qan_test
 
 import (
+	"bytes"
+	"encoding/binary"
 	"encoding/json"
 	"io/ioutil"
 	"time"
@@ -69,10 +71,14 @@ func (s *ReportTestSuite) TestResult001(t *C) {
 	t.Check(report.Class[4].Id, Equals, "5000000000000005")
 	t.Check(report.Class[4].Metrics.TimeMetrics["Query_time"].Sum, Equals, float64(0.101001))
 
+	t.Check(report.Dimensions, IsNil)
+
 	// Limit=2 results in top 2 queries and the rest in 1 LRQ "query".
 	config.ReportLimit = 2
+	config.Dimensions = map[string]string{"cluster": "prod-1"}
 	report = qan.MakeReport(config, interval, result)
 	t.Check(len(report.Class), Equals, 3)
+	t.Check(report.Dimensions, DeepEquals, map[string]string{"cluster": "prod-1"})
 
 	t.Check(report.Class[0].Id, Equals, "3000000000000003")
 	t.Check(report.Class[0].Metrics.TimeMetrics["Query_time"].Sum, Equals, float64(2.9))
@@ -88,6 +94,43 @@ func (s *ReportTestSuite) TestResult001(t *C) {
 	t.Check(report.Class[2].Metrics.TimeMetrics["Query_time"].Avg, Equals, float64(0.505))
 }
 
+func (s *ReportTestSuite) TestBuckets(t *C) {
+	data, err := ioutil.ReadFile(outputDir + "/result001.json")
+	t.Assert(err, IsNil)
+	result := &qan.Result{}
+	err = json.Unmarshal(data, result)
+	t.Assert(err, IsNil)
+
+	// 3 minute interval in 1 minute buckets.
+	start := time.Date(2015, 6, 1, 10, 0, 0, 0, time.UTC)
+	stop := start.Add(3 * time.Minute)
+	b := qan.NewBuckets(start, stop, time.Minute)
+	b.Add(start.Add(-1*time.Second), "3000000000000003", 1) // before start: 1st bucket
+	b.Add(start.Add(70*time.Second), "3000000000000003", 0.5)
+	b.Add(start.Add(75*time.Second), "3000000000000003", 1.4)
+	b.Add(start.Add(80*time.Second), "5000000000000005", 0.1)
+	b.Add(stop.Add(1*time.Second), "2000000000000002", 2) // after stop: last bucket
+	result.Buckets = b.Buckets()
+	t.Assert(result.Buckets, HasLen, 3)
+	t.Check(result.Buckets[1].Ts, Equals, start.Add(time.Minute))
+	t.Check(result.Buckets[1].Class["3000000000000003"], DeepEquals, &qan.BucketClass{TotalQueries: 2, QueryTimeSum: 1.9, QueryTimeMax: 1.4})
+	t.Check(result.Buckets[0].Class["3000000000000003"].TotalQueries, Equals, uint(1))
+	t.Check(result.Buckets[2].Class["2000000000000002"].TotalQueries, Equals, uint(1))
+
+	// Limit=2: classes not in the top 2 are LRQ "0" in buckets, too.
+	config := qan.Config{
+		ServiceInstance: proto.ServiceInstance{Service: "mysql", InstanceId: 1},
+		ReportLimit:     2,
+		BucketSize:      60,
+	}
+	interval := &qan.Interval{StartTime: start, StopTime: stop}
+	report := qan.MakeReport(config, interval, result)
+	t.Assert(report.Buckets, HasLen, 3)
+	t.Check(report.Buckets[1].Class["3000000000000003"].TotalQueries, Equals, uint(2))
+	t.Check(report.Buckets[1].Class["5000000000000005"], IsNil)
+	t.Check(report.Buckets[1].Class["0"], DeepEquals, &qan.BucketClass{TotalQueries: 1, QueryTimeSum: 0.1, QueryTimeMax: 0.1})
+}
+
 func (s *ReportTestSuite) TestResult014(t *C) {
 	si := proto.ServiceInstance{Service: "mysql", InstanceId: 1}
 	config := qan.Config{
@@ -127,3 +170,62 @@ func (s *ReportTestSuite) TestResult014(t *C) {
 	// This query required improving the log parser to get the correct checksum ID:
 	t.Check(report.Class[0].Id, Equals, "DB9EF18846547B8C")
 }
+
+// binlogEvent returns a binary log event with a v4 header and size-19 bytes
+// of zero data.
+func binlogEvent(ts time.Time, eventType byte, size uint32) []byte {
+	event := make([]byte, size)
+	binary.LittleEndian.PutUint32(event[0:4], uint32(ts.Unix()))
+	event[4] = eventType
+	binary.LittleEndian.PutUint32(event[9:13], size)
+	return event
+}
+
+func (s *ReportTestSuite) TestBinlogCounter(t *C) {
+	begin := time.Date(2015, 3, 1, 10, 0, 0, 0, time.UTC)
+	end := begin.Add(2 * time.Minute)
+	config := qan.Config{
+		ServiceInstance: proto.ServiceInstance{Service: "mysql", InstanceId: 1},
+		Interval:        60,
+	}
+
+	var binlog bytes.Buffer
+	binlog.WriteString(qan.BINLOG_MAGIC)
+	binlog.Write(binlogEvent(begin.Add(-time.Minute), 15, 120)) // format_desc, before begin
+	binlog.Write(binlogEvent(begin, 2, 80))                     // query
+	binlog.Write(binlogEvent(begin.Add(5*time.Second), 19, 40)) // table_map
+	binlog.Write(binlogEvent(begin.Add(5*time.Second), 30, 50)) // write_rows_v2
+	binlog.Write(binlogEvent(begin.Add(5*time.Second), 16, 31)) // xid
+	binlog.Write(binlogEvent(begin.Add(70*time.Second), 24, 60))
+	binlog.Write(binlogEvent(begin.Add(70*time.Second), 200, 20)) // unknown
+	binlog.Write(binlogEvent(end, 4, 40))                         // rotate, at end
+	binlog.Write(binlogEvent(end, 2, 100)[0:30])                  // being written
+
+	c := qan.NewBinlogCounter(config, begin, end)
+	err := c.Count(&binlog)
+	t.Assert(err, IsNil)
+	got := c.Reports()
+	expect := []*qan.BinlogReport{
+		{
+			ServiceInstance: config.ServiceInstance,
+			StartTs:         begin,
+			EndTs:           begin.Add(time.Minute),
+			Backfill:        true,
+			Events:          map[string]uint64{"query": 1, "table_map": 1, "write_rows": 1, "xid": 1},
+			Bytes:           80 + 40 + 50 + 31,
+		},
+		{
+			ServiceInstance: config.ServiceInstance,
+			StartTs:         begin.Add(time.Minute),
+			EndTs:           end,
+			Backfill:        true,
+			Events:          map[string]uint64{"update_rows": 1, "unknown": 1},
+			Bytes:           60 + 20,
+		},
+	}
+	t.Check(got, DeepEquals, expect)
+
+	// Not a binlog.
+	err = c.Count(bytes.NewBufferString("hello world"))
+	t.Check(err, NotNil)
+}
@@ -0,0 +1,61 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package qan
+
+import (
+	"time"
+
+	"github.com/percona/cloud-protocol/proto/v1"
+)
+
+const (
+	SLOWLOG_SLICE_DEFAULT_SIZE = 1 * 1024 * 1024  // bytes
+	SLOWLOG_SLICE_MAX_SIZE     = 10 * 1024 * 1024 // bytes
+)
+
+// A SlowLogSliceRequest is the GetSlowLog cmd data.  It selects raw events
+// from the slow log by time range (Begin, End, UTC), by byte range (Offset,
+// Length), or both.  Zero values mean no limit.  At most MaxSize bytes of whole
+// events are returned.  If Redact is true, queries are replaced by their
+// fingerprints so literal values (e.g. passwords) are not sent.
+type SlowLogSliceRequest struct {
+	proto.ServiceInstance
+	Begin   time.Time
+	End     time.Time
+	Offset  int64
+	Length  int64
+	MaxSize int64
+	Redact  bool
+}
+
+// A SlowLogSlice is raw slow log events sent through the data channel as
+// service "qan-slowlog".  The GetSlowLog cmd reply is the same without Data.
+// If Truncated, request the rest with Offset = NextOffset.
+type SlowLogSlice struct {
+	proto.ServiceInstance
+	Ts         time.Time // UTC
+	Filename   string
+	Begin      time.Time `json:",omitempty"`
+	End        time.Time `json:",omitempty"`
+	Offset     int64     // of the first event
+	NextOffset int64     // after the last event
+	Events     uint
+	Truncated  bool // MaxSize reached
+	Redacted   bool
+	Data       string `json:",omitempty"`
+}
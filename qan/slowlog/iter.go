@@ -26,7 +26,18 @@ import (
 	"github.com/percona/percona-agent/qan"
 )
 
-type FilenameFunc func() (string, error)
+// A FilenameFunc returns the slow log files to parse, oldest first.  The last
+// file is the current slow log (slow_query_log_file); the others are older
+// slow logs rotated by other programs, e.g. logrotate.
+type FilenameFunc func() ([]string, error)
+
+// An Offset is where the next interval of a slow log starts.  It's saved in
+// the store, so the iter resumes there after the agent restarts, see
+// Iter.SaveOffsets.
+type Offset struct {
+	Filename string
+	Offset   int64
+}
 
 type Iter struct {
 	logger   *pct.Logger
@@ -36,6 +47,8 @@ type Iter struct {
 	intervalNo   int
 	intervalChan chan *qan.Interval
 	sync         *pct.SyncChan
+	store        *pct.Store // offsets, see SaveOffsets
+	storeKey     string
 }
 
 func NewIter(logger *pct.Logger, filename FilenameFunc, tickChan chan time.Time) *Iter {
@@ -50,6 +63,15 @@ func NewIter(logger *pct.Logger, filename FilenameFunc, tickChan chan time.Time)
 	return iter
 }
 
+// SaveOffsets saves the offset of each interval in store as key, e.g. the
+// MySQL instance name.  When started, the iter resumes at the saved offset if
+// it's in the current slow log, so queries logged while the agent was stopped
+// are not lost.  Call before Start.
+func (i *Iter) SaveOffsets(store *pct.Store, key string) {
+	i.store = store
+	i.storeKey = key
+}
+
 func (i *Iter) Start() {
 	go i.run()
 }
@@ -79,6 +101,7 @@ func (i *Iter) run() {
 	}()
 
 	var prevFileInfo os.FileInfo
+	var prevStartInfo os.FileInfo // file at start of interval
 	cur := &qan.Interval{}
 
 	for {
@@ -89,12 +112,16 @@ func (i *Iter) run() {
 			i.logger.Debug("run:tick")
 
 			// Get the MySQL slow log file name at each interval because it can change.
-			curFile, err := i.filename()
+			files, err := i.filename()
+			if err == nil && len(files) == 0 {
+				err = fmt.Errorf("No slow log file")
+			}
 			if err != nil {
 				i.logger.Warn(err)
 				cur = new(qan.Interval)
 				continue
 			}
+			curFile := files[len(files)-1]
 
 			// Get the current size of the MySQL slow log.
 			i.logger.Debug("run:file size")
@@ -112,6 +139,7 @@ func (i *Iter) run() {
 			//        renames slow log) then StartOffset=0 may not be ideal.
 			curFileInfo, _ := os.Stat(curFile)
 			fileChanged := !os.SameFile(prevFileInfo, curFileInfo)
+			prevStartInfo = prevFileInfo
 			prevFileInfo = curFileInfo
 
 			if !cur.StartTime.IsZero() { // StartTime is set
@@ -121,8 +149,10 @@ func (i *Iter) run() {
 				// End of current interval:
 				cur.Filename = curFile
 				if fileChanged {
-					// Start from beginning of new file.
+					// Finish the previous file if it was rotated, then start
+					// from beginning of new file.
 					i.logger.Info("File changed")
+					cur.PrevFiles = prevFiles(files[0:len(files)-1], prevStartInfo, cur.StartOffset)
 					cur.StartOffset = 0
 				}
 				cur.EndOffset = curSize
@@ -146,12 +176,71 @@ func (i *Iter) run() {
 				// occurred earlier so a new interval was started.
 				i.logger.Debug("run:first")
 				cur.StartOffset = curSize
+				if i.intervalNo == 0 {
+					cur.StartOffset = i.savedOffset(curFile, curSize)
+				}
 				cur.StartTime = now
 				prevFileInfo, _ = os.Stat(curFile)
 			}
+			i.saveOffset(curFile, cur.StartOffset)
 		case <-i.sync.StopChan:
 			i.logger.Debug("run:stop")
 			return
 		}
 	}
 }
+
+// savedOffset returns the saved offset if it's in file, else size.
+func (i *Iter) savedOffset(file string, size int64) int64 {
+	if i.store == nil {
+		return size
+	}
+	offset := Offset{}
+	found, err := i.store.Get(pct.STORE_OFFSETS, i.storeKey, &offset)
+	if err != nil {
+		i.logger.Warn(err)
+		return size
+	}
+	if !found || offset.Filename != file || offset.Offset > size {
+		return size
+	}
+	if offset.Offset < size {
+		i.logger.Info(fmt.Sprintf("Resuming %s at offset %d", file, offset.Offset))
+	}
+	return offset.Offset
+}
+
+func (i *Iter) saveOffset(file string, offset int64) {
+	if i.store == nil {
+		return
+	}
+	if err := i.store.Put(pct.STORE_OFFSETS, i.storeKey, Offset{Filename: file, Offset: offset}); err != nil {
+		i.logger.Warn(err)
+	}
+}
+
+// prevFiles returns the parts of rotated files to parse before the current
+// file: the rest of the file which was current at the start of the interval,
+// from offset, and all files rotated after it.  Files are oldest first.  If
+// the file is not found, e.g. because it was removed, nil is returned.
+func prevFiles(files []string, prevFileInfo os.FileInfo, offset int64) []qan.LogFile {
+	if prevFileInfo == nil {
+		return nil
+	}
+	var logFiles []qan.LogFile
+	for _, file := range files {
+		fileInfo, err := os.Stat(file)
+		if err != nil {
+			continue
+		}
+		if logFiles == nil {
+			if !os.SameFile(prevFileInfo, fileInfo) {
+				continue
+			}
+			logFiles = []qan.LogFile{{Filename: file, StartOffset: offset, EndOffset: fileInfo.Size()}}
+			continue
+		}
+		logFiles = append(logFiles, qan.LogFile{Filename: file, StartOffset: 0, EndOffset: fileInfo.Size()})
+	}
+	return logFiles
+}
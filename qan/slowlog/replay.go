@@ -0,0 +1,199 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package slowlog
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/percona/percona-agent/pct"
+	"github.com/percona/percona-agent/qan"
+)
+
+// A ReplayIter is an IntervalIter which walks an existing slow log instead
+// of waiting for clock ticks.  It sends an Interval for every interval between
+// begin and end which has events, so reports can be made retroactively, e.g.
+// for days of slow logs before the agent was installed.  Intervals are sent
+// as fast as they are received.  When done, the IntervalChan is closed.
+type ReplayIter struct {
+	logger    *pct.Logger
+	filename  string
+	begin     time.Time
+	end       time.Time
+	interval  time.Duration
+	utcOffset time.Duration
+	// --
+	intervalChan chan *qan.Interval
+	sync         *pct.SyncChan
+	doneChan     chan struct{}
+}
+
+// NewReplayIter returns a ReplayIter for the slow log filename.  begin and end
+// are UTC.  utcOffset is the MySQL timezone offset (see GetutcOffset) because
+// slow log times are MySQL local time.
+func NewReplayIter(logger *pct.Logger, filename string, begin, end time.Time, interval, utcOffset time.Duration) *ReplayIter {
+	i := &ReplayIter{
+		logger:    logger,
+		filename:  filename,
+		begin:     begin.UTC(),
+		end:       end.UTC(),
+		interval:  interval,
+		utcOffset: utcOffset,
+		// --
+		intervalChan: make(chan *qan.Interval, 1),
+		sync:         pct.NewSyncChan(),
+		doneChan:     make(chan struct{}),
+	}
+	return i
+}
+
+func (i *ReplayIter) Start() {
+	go i.run()
+}
+
+func (i *ReplayIter) Stop() {
+	// run() returns when done replaying, so it might not be running.
+	select {
+	case i.sync.StopChan <- true:
+		i.sync.Wait()
+	case <-i.doneChan:
+	}
+	return
+}
+
+func (i *ReplayIter) IntervalChan() chan *qan.Interval {
+	return i.intervalChan
+}
+
+// TickChan returns nil because a ReplayIter does not use the clock.
+func (i *ReplayIter) TickChan() chan time.Time {
+	return nil
+}
+
+// --------------------------------------------------------------------------
+
+func (i *ReplayIter) run() {
+	defer func() {
+		if err := recover(); err != nil {
+			i.logger.Error("slowlog.ReplayIter crashed: ", err)
+		} else {
+			i.sync.Graceful()
+		}
+		close(i.intervalChan)
+		close(i.doneChan)
+		i.sync.Done()
+	}()
+
+	file, err := os.Open(i.filename)
+	if err != nil {
+		i.logger.Error(err)
+		return
+	}
+	defer file.Close()
+
+	var cur *qan.Interval
+	intervalNo := 0
+	send := func(endOffset int64) bool {
+		cur.EndOffset = endOffset
+		if cur.EndOffset <= cur.StartOffset {
+			return true // no events
+		}
+		intervalNo++
+		cur.Number = intervalNo
+		select {
+		case i.intervalChan <- cur:
+			return true
+		case <-i.sync.StopChan:
+			return false
+		}
+	}
+
+	r := bufio.NewReader(file)
+	offset := int64(0)
+	for {
+		line, err := r.ReadString('\n')
+		lineOffset := offset
+		offset += int64(len(line))
+		if err != nil && err != io.EOF {
+			i.logger.Error(err)
+			return
+		}
+		if ts, ok := parseTimeLine(line, i.utcOffset); ok {
+			if !ts.Before(i.end) {
+				offset = lineOffset
+				break
+			}
+			if !ts.Before(i.begin) {
+				if cur == nil {
+					start := i.begin.Add(ts.Sub(i.begin) / i.interval * i.interval)
+					cur = &qan.Interval{
+						Filename:    i.filename,
+						StartTime:   start,
+						StopTime:    start.Add(i.interval),
+						StartOffset: lineOffset,
+					}
+				}
+				for !ts.Before(cur.StopTime) {
+					if !send(lineOffset) {
+						return
+					}
+					cur = &qan.Interval{
+						Filename:    i.filename,
+						StartTime:   cur.StopTime,
+						StopTime:    cur.StopTime.Add(i.interval),
+						StartOffset: lineOffset,
+					}
+				}
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+	}
+	if cur != nil {
+		send(offset)
+	}
+}
+
+// parseTimeLine parses the UTC time of a "# Time:" slow log line.  MySQL 5.7
+// uses ISO 8601 time with a timezone, e.g. 2015-05-20T10:00:00.123456Z; older
+// versions use MySQL local time, e.g. 150520 10:00:00 or 150520  9:00:00,
+// so utcOffset is added.
+func parseTimeLine(line string, utcOffset time.Duration) (time.Time, bool) {
+	if !strings.HasPrefix(line, "# Time: ") {
+		return time.Time{}, false
+	}
+	return ParseTs(line[len("# Time: "):], utcOffset)
+}
+
+// ParseTs parses the UTC time of a slow log "# Time:" value, e.g. log.Event.Ts,
+// like parseTimeLine.
+func ParseTs(v string, utcOffset time.Duration) (time.Time, bool) {
+	v = strings.TrimSpace(v)
+	if t, err := time.Parse(time.RFC3339Nano, v); err == nil {
+		return t.UTC(), true
+	}
+	v = strings.Join(strings.Fields(v), " ")
+	if t, err := time.Parse("060102 15:04:05", v); err == nil {
+		return t.Add(utcOffset), true
+	}
+	return time.Time{}, false
+}
@@ -0,0 +1,244 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package slowlog
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/percona/go-mysql/query"
+	"github.com/percona/percona-agent/pct"
+	"github.com/percona/percona-agent/qan"
+)
+
+// ReadSlice reads the raw events selected by req from the slow log filename,
+// see qan.SlowLogSliceRequest.  Only whole events are returned, so a byte range
+// that begins inside an event skips to the next event.  utcOffset is the MySQL
+// timezone offset (see GetutcOffset).
+func ReadSlice(filename string, req qan.SlowLogSliceRequest, utcOffset time.Duration) (*qan.SlowLogSlice, error) {
+	maxSize := req.MaxSize
+	if maxSize <= 0 {
+		maxSize = qan.SLOWLOG_SLICE_DEFAULT_SIZE
+	}
+	if maxSize > qan.SLOWLOG_SLICE_MAX_SIZE {
+		maxSize = qan.SLOWLOG_SLICE_MAX_SIZE
+	}
+	begin := req.Begin.UTC()
+	end := req.End.UTC()
+	timeRange := !req.Begin.IsZero() || !req.End.IsZero()
+	redacted := req.Redact || !pct.Collect(pct.DATA_QUERY_EXAMPLES)
+
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	// A "# User@Host:" line begins an event only if the previous line is not
+	// "# Time:", so get the line before Offset.  If Offset is inside a line,
+	// skip the rest of it.
+	offset := req.Offset
+	prevLine := ""
+	r := bufio.NewReader(file)
+	if offset > 0 {
+		n := offset
+		if n > 256 {
+			n = 256 // longer than any "# Time:" line
+		}
+		buf := make([]byte, n)
+		if _, err := file.ReadAt(buf, offset-n); err != nil {
+			return nil, err
+		}
+		if _, err := file.Seek(offset, os.SEEK_SET); err != nil {
+			return nil, err
+		}
+		lineStart := ""
+		if buf[n-1] == '\n' {
+			buf = buf[:n-1]
+		} else {
+			rest, err := r.ReadString('\n')
+			if err != nil && err != io.EOF {
+				return nil, err
+			}
+			offset += int64(len(rest))
+			lineStart = rest
+		}
+		prevLine = string(buf[bytes.LastIndex(buf, []byte("\n"))+1:]) + lineStart
+	}
+
+	slice := &qan.SlowLogSlice{
+		ServiceInstance: req.ServiceInstance,
+		Ts:              time.Now().UTC(),
+		Filename:        filename,
+		Begin:           req.Begin,
+		End:             req.End,
+		Offset:          req.Offset,
+		NextOffset:      offset,
+		Redacted:        redacted,
+	}
+	data := &bytes.Buffer{}
+
+	// Older MySQL only writes "# Time:" when the time changes, so an event
+	// without one has the time of the last one.
+	var lastTs time.Time
+	haveTs := false
+
+	var event []string
+	var eventOffset int64
+	done := false
+	addEvent := func(nextOffset int64) {
+		if len(event) == 0 {
+			return
+		}
+		if timeRange {
+			if haveTs && !end.IsZero() && !lastTs.Before(end) {
+				done = true // slow log is chronological
+				return
+			}
+			if !haveTs || lastTs.Before(begin) {
+				slice.NextOffset = nextOffset
+				return
+			}
+		}
+		text := strings.Join(event, "")
+		if redacted {
+			text = redact(event)
+		}
+		if int64(data.Len()+len(text)) > maxSize {
+			slice.Truncated = true
+			done = true
+			return
+		}
+		if slice.Events == 0 {
+			slice.Offset = eventOffset
+		}
+		data.WriteString(text)
+		slice.Events++
+		slice.NextOffset = nextOffset
+	}
+
+	for !done {
+		line, err := r.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		lineOffset := offset
+		offset += int64(len(line))
+
+		// A new event begins at its "# Time:" line, else at its "# User@Host:" line.
+		newEvent := strings.HasPrefix(line, "# Time: ") ||
+			(strings.HasPrefix(line, "# User@Host: ") && !strings.HasPrefix(prevLine, "# Time: "))
+		if newEvent || line == "" {
+			addEvent(lineOffset)
+			event = nil
+			eventOffset = lineOffset
+			if done || (req.Length > 0 && lineOffset >= req.Offset+req.Length) {
+				break
+			}
+		}
+		if ts, ok := parseTimeLine(line, utcOffset); ok {
+			lastTs = ts
+			haveTs = true
+		}
+		// Lines before the first event, e.g. the slow log header or the end
+		// of an event when Offset is inside it, are skipped.
+		if newEvent || event != nil {
+			event = append(event, excludeUserHost(line))
+		}
+		prevLine = line
+		if err == io.EOF {
+			addEvent(offset)
+			break
+		}
+	}
+
+	slice.Data = data.String()
+	return slice, nil
+}
+
+// redact replaces the query of a slow log event with its fingerprint, keeping
+// the header and the "use" and "SET timestamp" lines.
+func redact(event []string) string {
+	text := ""
+	q := ""
+	for _, line := range event {
+		if strings.HasPrefix(line, "#") || strings.HasPrefix(line, "SET timestamp=") || strings.HasPrefix(line, "use ") {
+			text += line
+		} else {
+			q += line
+		}
+	}
+	if f := fingerprint(q); f != "" {
+		text += f + ";\n"
+	}
+	return text
+}
+
+// excludeUserHost removes the user, host name, and IP from a "# User@Host:"
+// line like "# User@Host: root[root] @ web1 [10.0.0.1]  Id: 5" if excluded,
+// see pct.Collect.  Other lines are returned as is.
+func excludeUserHost(line string) string {
+	if !strings.HasPrefix(line, "# User@Host: ") {
+		return line
+	}
+	if pct.Collect(pct.DATA_USERNAMES) && pct.Collect(pct.DATA_HOSTNAMES) && pct.Collect(pct.DATA_IPS) {
+		return line
+	}
+	rest := strings.TrimPrefix(line, "# User@Host: ")
+	suffix := ""
+	if i := strings.Index(rest, "  Id:"); i >= 0 {
+		rest, suffix = rest[0:i], rest[i:]
+	} else if strings.HasSuffix(rest, "\n") {
+		rest, suffix = rest[0:len(rest)-1], "\n"
+	}
+	user, hostIP := rest, ""
+	if i := strings.Index(rest, " @ "); i >= 0 {
+		user, hostIP = rest[0:i], rest[i+3:]
+	}
+	host, ip := strings.TrimSpace(hostIP), ""
+	if i := strings.Index(hostIP, "["); i >= 0 {
+		host, ip = strings.TrimSpace(hostIP[0:i]), strings.Trim(hostIP[i:], "[] ")
+	}
+	if !pct.Collect(pct.DATA_USERNAMES) {
+		user = "excluded[excluded]"
+	}
+	if host != "" && !pct.CollectHost(host) {
+		host = "excluded"
+	}
+	if ip != "" && !pct.Collect(pct.DATA_IPS) {
+		ip = "excluded"
+	}
+	return "# User@Host: " + user + " @ " + host + " [" + ip + "]" + suffix
+}
+
+// fingerprint returns "" if query.Fingerprint() crashes so nothing is sent
+// unredacted.
+func fingerprint(q string) (f string) {
+	defer func() {
+		if err := recover(); err != nil {
+			f = ""
+		}
+	}()
+	if strings.TrimSpace(q) == "" {
+		return ""
+	}
+	return query.Fingerprint(q)
+}
@@ -618,8 +618,8 @@ func (s *IterTestSuite) SetUpSuite(t *C) {
 
 var fileName string
 
-func getFilename() (string, error) {
-	return fileName, nil
+func getFilename() ([]string, error) {
+	return []string{fileName}, nil
 }
 
 func (s *IterTestSuite) TestIterFile(t *C) {
@@ -710,3 +710,274 @@ func (s *IterTestSuite) TestIterFile(t *C) {
 
 	i.Stop()
 }
+
+func (s *IterTestSuite) TestIterRotatedFiles(t *C) {
+	tickChan := make(chan time.Time)
+
+	tmpFile, _ := ioutil.TempFile("/tmp", "interval_test.")
+	tmpFile.Close()
+	curFile := tmpFile.Name()
+	oldFile := curFile + ".1"
+	_ = ioutil.WriteFile(curFile, []byte("123"), 0777)
+	defer func() {
+		os.Remove(curFile)
+		os.Remove(oldFile)
+	}()
+
+	// Like logrotate: rotated file(s) first, current slow log last.
+	getFiles := func() ([]string, error) {
+		if pct.FileExists(oldFile) {
+			return []string{oldFile, curFile}, nil
+		}
+		return []string{curFile}, nil
+	}
+
+	i := slowlog.NewIter(s.logger, getFiles, tickChan)
+	i.Start()
+	defer i.Stop()
+
+	t1 := time.Now()
+	tickChan <- t1
+
+	// Write more data, then rotate the file and write data to the new file.
+	// The iter should finish the old file (3-6) before starting the new file.
+	_ = ioutil.WriteFile(curFile, []byte("123456"), 0777)
+	os.Rename(curFile, oldFile)
+	_ = ioutil.WriteFile(curFile, []byte("1234"), 0777)
+
+	t2 := time.Now()
+	tickChan <- t2
+
+	got := <-i.IntervalChan()
+	expect := &qan.Interval{
+		Number:      1,
+		Filename:    curFile,
+		StartTime:   t1,
+		StopTime:    t2,
+		StartOffset: 0,
+		EndOffset:   4,
+		PrevFiles: []qan.LogFile{
+			{Filename: oldFile, StartOffset: 3, EndOffset: 6},
+		},
+	}
+	t.Check(got, test.DeepEquals, expect)
+}
+
+func (s *IterTestSuite) TestIterResume(t *C) {
+	tmpFile, _ := ioutil.TempFile("/tmp", "interval_test.")
+	tmpFile.Close()
+	fileName = tmpFile.Name()
+	_ = ioutil.WriteFile(fileName, []byte("123"), 0777)
+	defer os.Remove(fileName)
+	storeFile := fileName + ".db"
+	defer os.Remove(storeFile)
+	store, err := pct.OpenStore(storeFile, "")
+	t.Assert(err, IsNil)
+	defer store.Close()
+
+	// The first iter saves the offset of each interval.
+	tickChan := make(chan time.Time)
+	i := slowlog.NewIter(s.logger, getFilename, tickChan)
+	i.SaveOffsets(store, "mysql-1")
+	i.Start()
+	tickChan <- time.Now()
+	_ = ioutil.WriteFile(fileName, []byte("123456"), 0777)
+	tickChan <- time.Now()
+	got := <-i.IntervalChan()
+	t.Check(got.StartOffset, Equals, int64(3))
+	t.Check(got.EndOffset, Equals, int64(6))
+	i.Stop()
+
+	// Queries are logged while the agent is stopped.  The next iter resumes
+	// at the saved offset, so they are not lost.
+	_ = ioutil.WriteFile(fileName, []byte("123456789"), 0777)
+	i = slowlog.NewIter(s.logger, getFilename, tickChan)
+	i.SaveOffsets(store, "mysql-1")
+	i.Start()
+	tickChan <- time.Now()
+	tickChan <- time.Now()
+	got = <-i.IntervalChan()
+	t.Check(got.StartOffset, Equals, int64(6))
+	t.Check(got.EndOffset, Equals, int64(9))
+	i.Stop()
+
+	offset := slowlog.Offset{}
+	found, err := store.Get(pct.STORE_OFFSETS, "mysql-1", &offset)
+	t.Assert(err, IsNil)
+	t.Check(found, Equals, true)
+	t.Check(offset, Equals, slowlog.Offset{Filename: fileName, Offset: 9})
+}
+
+func (s *IterTestSuite) TestReplayIter(t *C) {
+	tmpFile, _ := ioutil.TempFile("/tmp", "replay_test.")
+	tmpFile.Close()
+	defer os.Remove(tmpFile.Name())
+
+	// Events before begin and at/after end are not replayed, and no interval
+	// is sent for 10:01 because there are no events.
+	events := []string{
+		"# Time: 150520  9:59:00\nselect 0;\n",
+		"# Time: 150520 10:00:10\nselect 1;\n",
+		"# Time: 150520 10:00:50\nselect 2;\n",
+		"# Time: 2015-05-20T10:02:05.000001Z\nselect 3;\n",
+		"# Time: 150520 10:03:00\nselect 4;\n",
+	}
+	offsets := []int64{0}
+	for _, e := range events {
+		offsets = append(offsets, offsets[len(offsets)-1]+int64(len(e)))
+	}
+	_ = ioutil.WriteFile(tmpFile.Name(), []byte(strings.Join(events, "")), 0644)
+
+	begin := time.Date(2015, 5, 20, 10, 0, 0, 0, time.UTC)
+	end := begin.Add(3 * time.Minute)
+	i := slowlog.NewReplayIter(s.logger, tmpFile.Name(), begin, end, time.Minute, 0)
+	i.Start()
+	defer i.Stop()
+
+	got := []*qan.Interval{}
+	for interval := range i.IntervalChan() {
+		got = append(got, interval)
+	}
+	expect := []*qan.Interval{
+		{
+			Number:      1,
+			Filename:    tmpFile.Name(),
+			StartTime:   begin,
+			StopTime:    begin.Add(1 * time.Minute),
+			StartOffset: offsets[1],
+			EndOffset:   offsets[3],
+		},
+		{
+			Number:      2,
+			Filename:    tmpFile.Name(),
+			StartTime:   begin.Add(2 * time.Minute),
+			StopTime:    end,
+			StartOffset: offsets[3],
+			EndOffset:   offsets[4],
+		},
+	}
+	if same, diff := test.IsDeeply(got, expect); !same {
+		test.Dump(got)
+		t.Error(diff)
+	}
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Slice test suite
+/////////////////////////////////////////////////////////////////////////////
+
+type SliceTestSuite struct {
+	filename string
+	header   string
+	events   []string
+	offsets  []int64
+}
+
+var _ = Suite(&SliceTestSuite{})
+
+func (s *SliceTestSuite) SetUpSuite(t *C) {
+	s.header = "/usr/sbin/mysqld, Version: 5.6.24-log. started with:\n"
+	s.events = []string{
+		"# Time: 150520 10:00:00\n# User@Host: root[root] @ localhost []\n# Query_time: 1.0\nSET timestamp=1432116000;\nselect * from t where a = 'secret';\n",
+		"# User@Host: root[root] @ localhost []\n# Query_time: 2.0\nSET timestamp=1432116000;\nselect 2;\n", // same time
+		"# Time: 150520 10:01:00\n# User@Host: root[root] @ localhost []\n# Query_time: 3.0\nselect 3;\n",
+		"# Time: 150520 10:02:00\n# User@Host: root[root] @ localhost []\n# Query_time: 4.0\nselect 4;\n",
+	}
+	s.offsets = []int64{int64(len(s.header))}
+	for _, e := range s.events {
+		s.offsets = append(s.offsets, s.offsets[len(s.offsets)-1]+int64(len(e)))
+	}
+	tmpFile, err := ioutil.TempFile("/tmp", "slice_test.")
+	t.Assert(err, IsNil)
+	tmpFile.Close()
+	s.filename = tmpFile.Name()
+	err = ioutil.WriteFile(s.filename, []byte(s.header+strings.Join(s.events, "")), 0644)
+	t.Assert(err, IsNil)
+}
+
+func (s *SliceTestSuite) TearDownSuite(t *C) {
+	os.Remove(s.filename)
+}
+
+func (s *SliceTestSuite) TestTimeRange(t *C) {
+	// The 2nd event has no "# Time:" line, so it has the time of the 1st.
+	begin := time.Date(2015, 5, 20, 10, 0, 0, 0, time.UTC)
+	req := qan.SlowLogSliceRequest{
+		Begin: begin,
+		End:   begin.Add(90 * time.Second),
+	}
+	got, err := slowlog.ReadSlice(s.filename, req, 0)
+	t.Assert(err, IsNil)
+	t.Check(got.Filename, Equals, s.filename)
+	t.Check(got.Events, Equals, uint(3))
+	t.Check(got.Offset, Equals, s.offsets[0])
+	t.Check(got.NextOffset, Equals, s.offsets[3])
+	t.Check(got.Truncated, Equals, false)
+	t.Check(got.Data, Equals, strings.Join(s.events[0:3], ""))
+}
+
+func (s *SliceTestSuite) TestByteRange(t *C) {
+	// Offset is inside the 1st event, so the slice begins with the 2nd event,
+	// and the 3rd event begins after the range.
+	req := qan.SlowLogSliceRequest{
+		Offset: s.offsets[0] + 1,
+		Length: int64(len(s.events[0])),
+	}
+	got, err := slowlog.ReadSlice(s.filename, req, 0)
+	t.Assert(err, IsNil)
+	t.Check(got.Events, Equals, uint(1))
+	t.Check(got.Offset, Equals, s.offsets[1])
+	t.Check(got.NextOffset, Equals, s.offsets[2])
+	t.Check(got.Data, Equals, s.events[1])
+}
+
+func (s *SliceTestSuite) TestMaxSize(t *C) {
+	req := qan.SlowLogSliceRequest{
+		MaxSize: int64(len(s.events[0]) + len(s.events[1]) + 1),
+	}
+	got, err := slowlog.ReadSlice(s.filename, req, 0)
+	t.Assert(err, IsNil)
+	t.Check(got.Events, Equals, uint(2))
+	t.Check(got.Truncated, Equals, true)
+	t.Check(got.NextOffset, Equals, s.offsets[2])
+	t.Check(got.Data, Equals, s.events[0]+s.events[1])
+
+	// The rest begins at NextOffset.
+	req.Offset = got.NextOffset
+	got, err = slowlog.ReadSlice(s.filename, req, 0)
+	t.Assert(err, IsNil)
+	t.Check(got.Events, Equals, uint(2))
+	t.Check(got.Truncated, Equals, false)
+	t.Check(got.Data, Equals, s.events[2]+s.events[3])
+}
+
+func (s *SliceTestSuite) TestRedact(t *C) {
+	req := qan.SlowLogSliceRequest{
+		Length: s.offsets[1], // only the 1st event
+		Redact: true,
+	}
+	got, err := slowlog.ReadSlice(s.filename, req, 0)
+	t.Assert(err, IsNil)
+	t.Check(got.Events, Equals, uint(1))
+	t.Check(got.Redacted, Equals, true)
+	t.Check(strings.Contains(got.Data, "secret"), Equals, false)
+	t.Check(strings.HasPrefix(got.Data, "# Time: 150520 10:00:00\n# User@Host: root[root] @ localhost []\n# Query_time: 1.0\nSET timestamp=1432116000;\n"), Equals, true)
+	t.Check(strings.Contains(got.Data, "where a = ?"), Equals, true)
+}
+
+func (s *SliceTestSuite) TestExcludeData(t *C) {
+	t.Assert(pct.SetExcludeData([]string{pct.DATA_QUERY_EXAMPLES, pct.DATA_USERNAMES, pct.DATA_HOSTNAMES}), IsNil)
+	defer pct.SetExcludeData(nil)
+
+	// Excluding query examples redacts the slice even if not requested.
+	req := qan.SlowLogSliceRequest{
+		Length: s.offsets[1], // only the 1st event
+	}
+	got, err := slowlog.ReadSlice(s.filename, req, 0)
+	t.Assert(err, IsNil)
+	t.Check(got.Redacted, Equals, true)
+	t.Check(strings.Contains(got.Data, "secret"), Equals, false)
+	t.Check(strings.Contains(got.Data, "root"), Equals, false)
+	t.Check(strings.Contains(got.Data, "localhost"), Equals, false)
+	t.Check(strings.HasPrefix(got.Data, "# Time: 150520 10:00:00\n# User@Host: excluded[excluded] @ excluded []\n# Query_time: 1.0\n"), Equals, true)
+}
@@ -60,6 +60,9 @@ type Job struct {
 	StartOffset    int64
 	EndOffset      int64
 	ExampleQueries bool
+	PrevFiles      []qan.LogFile // parsed in order before SlowLogFile
+	StartTime      time.Time     // of interval, for buckets
+	StopTime       time.Time
 }
 
 func (j *Job) String() string {
@@ -84,6 +87,8 @@ type Worker struct {
 	sync            *pct.SyncChan
 	running         bool
 	logParser       log.LogParser
+	buckets         *qan.Buckets // nil unless config.BucketSize
+	lastTs          time.Time    // of last event, for buckets
 	// Diff against mysql tz and UTC. Used to calculate first_seen and last_seen
 	utcOffset time.Duration
 }
@@ -134,7 +139,10 @@ func (w *Worker) Setup(interval *qan.Interval) error {
 		StartOffset:    interval.StartOffset,
 		EndOffset:      interval.EndOffset,
 		RunTime:        time.Duration(w.config.WorkerRunTime) * time.Second,
-		ExampleQueries: w.config.ExampleQueries,
+		ExampleQueries: w.config.ExampleQueries && pct.Collect(pct.DATA_QUERY_EXAMPLES),
+		PrevFiles:      interval.PrevFiles,
+		StartTime:      interval.StartTime,
+		StopTime:       interval.StopTime,
 	}
 	w.logger.Debug("Setup:", w.job)
 
@@ -164,11 +172,104 @@ func (w *Worker) Run() (*qan.Result, error) {
 	}
 	defer file.Close()
 
+	result := &qan.Result{}
+
+	// Make an event aggregate to do all the heavy lifting: fingerprint
+	// queries, group, and aggregate.
+	a := event.NewEventAggregator(w.job.ExampleQueries, w.utcOffset)
+
+	// Do fingerprinting in a separate Go routine so we can recover in case
+	// query.Fingerprint() crashes. We don't want one bad fingerprint to stop
+	// parsing the entire interval. Also, we want to log crashes and hopefully
+	// fix the fingerprinter.
+	go w.fingerprinter()
+	defer func() { w.doneChan <- true }()
+
+	t0 := time.Now()
+	rate := &rateLimit{}
+
+	w.buckets = nil
+	if w.config.BucketSize > 0 {
+		w.buckets = qan.NewBuckets(w.job.StartTime, w.job.StopTime, time.Duration(w.config.BucketSize)*time.Second)
+		w.lastTs = w.job.StartTime
+	}
+
+	// Parse the rest of slow logs rotated by another program during the
+	// interval, in order, before the current slow log.
+	for _, f := range w.job.PrevFiles {
+		prevFile, err := os.Open(f.Filename)
+		if err != nil {
+			w.logger.Warn(err)
+			continue
+		}
+		_, stopped = w.parse(prevFile, f.StartOffset, f.EndOffset, a, t0, rate, result)
+		prevFile.Close()
+		if stopped || result.Error != "" {
+			break
+		}
+	}
+
+	if !stopped && result.Error == "" {
+		result.StopOffset, stopped = w.parse(file, w.job.StartOffset, w.job.EndOffset, a, t0, rate, result)
+	} else {
+		result.StopOffset = w.job.StartOffset // didn't parse current slow log
+	}
+
+	// Finalize the global and class metrics, i.e. calculate metric stats.
+	w.status.Update(w.name, "Finalizing job "+w.job.Id)
+	r := a.Finalize()
+
+	// The aggregator result is a map, but we need an array of classes for
+	// the query report, so convert it.
+	n := len(r.Class)
+	classes := make([]*event.QueryClass, n)
+	for _, class := range r.Class {
+		n-- // can't classes[--n] in Go
+		classes[n] = class
+	}
+	result.Global = r.Global
+	result.Class = classes
+	if w.buckets != nil {
+		result.Buckets = w.buckets.Buckets()
+	}
+
+	// Zero the runtime for testing.
+	if !w.ZeroRunTime {
+		result.RunTime = time.Now().Sub(t0).Seconds()
+	}
+
+	return result, nil
+}
+
+// addToBucket adds the event to its bucket if config.BucketSize.  MySQL logs
+// "# Time:" only when it changes, so an event without it ran in the same
+// second as the previous event.
+func (w *Worker) addToBucket(e *log.Event, id string) {
+	if w.buckets == nil {
+		return
+	}
+	if ts, ok := ParseTs(e.Ts, w.utcOffset); ok {
+		w.lastTs = ts
+	}
+	w.buckets.Add(w.lastTs, id, float64(e.TimeMetrics["Query_time"]))
+}
+
+// rateLimit is the slow log rate limit, which must be the same for all
+// events in all files parsed by a job.
+type rateLimit struct {
+	rateType  string
+	rateLimit uint
+}
+
+// parse parses file from startOffset to endOffset, adding events to a. It
+// returns the offset where parsing stopped and true if Stop() was called.
+// If parsing does not complete, result.Error is set.
+func (w *Worker) parse(file *os.File, startOffset, endOffset int64, a *event.EventAggregator, t0 time.Time, rate *rateLimit, result *qan.Result) (stopOffset int64, stopped bool) {
 	// Create a slow log parser and run it.  It sends log.Event via its channel.
 	// Be sure to stop it when done, else we'll leak goroutines.
-	result := &qan.Result{}
+	job := fmt.Sprintf("%s %d-%d", file.Name(), startOffset, endOffset)
 	opts := log.Options{
-		StartOffset: uint64(w.job.StartOffset),
+		StartOffset: uint64(startOffset),
 		FilterAdminCommand: map[string]bool{
 			"Binlog Dump":      true,
 			"Binlog Dump GTID": true,
@@ -178,7 +279,7 @@ func (w *Worker) Run() (*qan.Result, error) {
 	go func() {
 		defer func() {
 			if err := recover(); err != nil {
-				errMsg := fmt.Sprintf("Slow log parser for %s crashed: %s", w.job, err)
+				errMsg := fmt.Sprintf("Slow log parser for %s crashed: %s", job, err)
 				w.logger.Error(errMsg)
 				result.Error = errMsg
 			}
@@ -190,31 +291,17 @@ func (w *Worker) Run() (*qan.Result, error) {
 	}()
 	defer p.Stop()
 
-	// Make an event aggregate to do all the heavy lifting: fingerprint
-	// queries, group, and aggregate.
-	a := event.NewEventAggregator(w.job.ExampleQueries, w.utcOffset)
-
 	// Misc runtime meta data.
-	jobSize := w.job.EndOffset - w.job.StartOffset
+	jobSize := endOffset - startOffset
 	runtime := time.Duration(0)
 	progress := "Not started"
-	rateType := ""
-	rateLimit := uint(0)
-
-	// Do fingerprinting in a separate Go routine so we can recover in case
-	// query.Fingerprint() crashes. We don't want one bad fingerprint to stop
-	// parsing the entire interval. Also, we want to log crashes and hopefully
-	// fix the fingerprinter.
-	go w.fingerprinter()
-	defer func() { w.doneChan <- true }()
 
-	t0 := time.Now()
 EVENT_LOOP:
 	for event := range p.EventChan() {
 		runtime = time.Now().Sub(t0)
 		progress = fmt.Sprintf("%.1f%% %d/%d %d %.1fs",
-			float64(event.Offset)/float64(w.job.EndOffset)*100, event.Offset, w.job.EndOffset, jobSize, runtime.Seconds())
-		w.status.Update(w.name, fmt.Sprintf("Parsing %s: %s", w.job.SlowLogFile, progress))
+			float64(event.Offset)/float64(endOffset)*100, event.Offset, endOffset, jobSize, runtime.Seconds())
+		w.status.Update(w.name, fmt.Sprintf("Parsing %s: %s", file.Name(), progress))
 
 		// Stop if Stop() called.
 		select {
@@ -227,7 +314,7 @@ EVENT_LOOP:
 
 		// Stop if runtime exceeded.
 		if runtime >= w.job.RunTime {
-			errMsg := fmt.Sprintf("Timeout parsing %s: %s", w.job, progress)
+			errMsg := fmt.Sprintf("Timeout parsing %s: %s", job, progress)
 			w.logger.Warn(errMsg)
 			result.Error = errMsg
 			break EVENT_LOOP
@@ -238,8 +325,8 @@ EVENT_LOOP:
 		// so typical case is, for example, parsing from offset 100 to 5000
 		// but slow log is already 7000 bytes large and growing. So the first
 		// event with offset > 5000 marks the end (StopOffset) of this slice.
-		if int64(event.Offset) >= w.job.EndOffset {
-			result.StopOffset = int64(event.Offset)
+		if int64(event.Offset) >= endOffset {
+			stopOffset = int64(event.Offset)
 			break EVENT_LOOP
 		}
 
@@ -247,17 +334,17 @@ EVENT_LOOP:
 		// another program or person might have reconfigured the rate limit.
 		// We don't handle by design this because it's too much of an edge case.
 		if event.RateType != "" {
-			if rateType != "" {
-				if rateType != event.RateType || rateLimit != event.RateLimit {
+			if rate.rateType != "" {
+				if rate.rateType != event.RateType || rate.rateLimit != event.RateLimit {
 					errMsg := fmt.Sprintf("Slow log has mixed rate limits: %s/%d and %s/%d",
-						rateType, rateLimit, event.RateType, event.RateLimit)
+						rate.rateType, rate.rateLimit, event.RateType, event.RateLimit)
 					w.logger.Warn(errMsg)
 					result.Error = errMsg
 					break EVENT_LOOP
 				}
 			} else {
-				rateType = event.RateType
-				rateLimit = event.RateLimit
+				rate.rateType = event.RateType
+				rate.rateLimit = event.RateLimit
 			}
 		}
 
@@ -269,43 +356,24 @@ EVENT_LOOP:
 		case fingerprint = <-w.fingerprintChan:
 			id := query.Id(fingerprint)
 			a.AddEvent(event, id, fingerprint)
+			w.addToBucket(event, id)
 		case _ = <-w.errChan:
 			w.logger.Warn(fmt.Sprintf("Cannot fingerprint '%s'", event.Query))
 			go w.fingerprinter()
 		}
 	}
 
-	// If StopOffset isn't set above it means we reached the end of the slow log
+	// If stopOffset isn't set above it means we reached the end of the slow log
 	// file. This happens if MySQL isn't busy so the slow log didn't grow any,
 	// or we rotated the slow log in Setup() so we're finishing the rotated slow
-	// log file. So the StopOffset is the end of the file which we're already
+	// log file. So the stopOffset is the end of the file which we're already
 	// at, so use SEEK_CUR.
-	if result.StopOffset == 0 {
-		result.StopOffset, _ = file.Seek(0, os.SEEK_CUR)
-	}
-
-	// Finalize the global and class metrics, i.e. calculate metric stats.
-	w.status.Update(w.name, "Finalizing job "+w.job.Id)
-	r := a.Finalize()
-
-	// The aggregator result is a map, but we need an array of classes for
-	// the query report, so convert it.
-	n := len(r.Class)
-	classes := make([]*event.QueryClass, n)
-	for _, class := range r.Class {
-		n-- // can't classes[--n] in Go
-		classes[n] = class
+	if stopOffset == 0 {
+		stopOffset, _ = file.Seek(0, os.SEEK_CUR)
 	}
-	result.Global = r.Global
-	result.Class = classes
 
-	// Zero the runtime for testing.
-	if !w.ZeroRunTime {
-		result.RunTime = time.Now().Sub(t0).Seconds()
-	}
-
-	w.logger.Info(fmt.Sprintf("Parsed %s: %s", w.job, progress))
-	return result, nil
+	w.logger.Info(fmt.Sprintf("Parsed %s: %s", job, progress))
+	return stopOffset, stopped
 }
 
 func (w *Worker) Stop() error {
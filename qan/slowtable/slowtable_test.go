@@ -0,0 +1,109 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package slowtable_test
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/percona/percona-agent/mysql"
+	"github.com/percona/percona-agent/qan/slowtable"
+	. "gopkg.in/check.v1"
+)
+
+// Hook up gocheck into the "go test" runner.
+func Test(t *testing.T) { TestingT(t) }
+
+type WorkerTestSuite struct {
+	dsn string
+}
+
+var _ = Suite(&WorkerTestSuite{})
+
+func (s *WorkerTestSuite) SetUpSuite(t *C) {
+	s.dsn = os.Getenv("PCT_TEST_MYSQL_DSN")
+}
+
+// --------------------------------------------------------------------------
+
+func (s *WorkerTestSuite) TestParseUserHost(t *C) {
+	user, host := slowtable.ParseUserHost("app[app] @ web1 [10.0.0.1]")
+	t.Check(user, Equals, "app")
+	t.Check(host, Equals, "web1")
+
+	user, host = slowtable.ParseUserHost("root[root] @ localhost []")
+	t.Check(user, Equals, "root")
+	t.Check(host, Equals, "localhost")
+
+	user, host = slowtable.ParseUserHost("app[app] @  [10.0.0.1]")
+	t.Check(user, Equals, "app")
+	t.Check(host, Equals, "10.0.0.1")
+
+	user, host = slowtable.ParseUserHost("")
+	t.Check(user, Equals, "")
+	t.Check(host, Equals, "")
+}
+
+func (s *WorkerTestSuite) TestGetRows(t *C) {
+	if s.dsn == "" {
+		t.Fatal("PCT_TEST_MYSQL_DSN is not set")
+	}
+	conn := mysql.NewConnection(s.dsn)
+	if err := conn.Connect(1); err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	db := conn.DB()
+	db.SetMaxOpenConns(1) // for SET time_zone
+
+	// Can't insert into mysql.slow_log, so use a copy of it.
+	queries := []string{
+		"SET time_zone = '+00:00'",
+		"CREATE DATABASE IF NOT EXISTS percona_agent_test",
+		"DROP TABLE IF EXISTS percona_agent_test.slow_log",
+		"CREATE TABLE percona_agent_test.slow_log LIKE mysql.slow_log",
+		"INSERT INTO percona_agent_test.slow_log (start_time, user_host, query_time, lock_time, rows_sent, rows_examined, db, last_insert_id, insert_id, server_id, sql_text)" +
+			" VALUES ('2015-06-01 10:00:30', 'app[app] @ web1 [10.0.0.1]', '00:00:01.500000', '00:00:00.000100', 1, 1000, 'db1', 0, 0, 1, 'SELECT * FROM t WHERE id=1')," +
+			" ('2015-06-01 10:01:00', 'app[app] @ web1 [10.0.0.1]', '00:00:02', '00:00:00', 1, 1000, 'db1', 0, 0, 1, 'SELECT * FROM t WHERE id=2')",
+	}
+	for _, q := range queries {
+		if _, err := db.Exec(q); err != nil {
+			t.Fatal(q, err)
+		}
+	}
+	defer db.Exec("DROP TABLE IF EXISTS percona_agent_test.slow_log")
+
+	// [10:00, 10:01) has only the first row.
+	begin := time.Date(2015, 6, 1, 10, 0, 0, 0, time.UTC)
+	rows, err := slowtable.GetRows(db, "percona_agent_test.slow_log", begin, begin.Add(time.Minute))
+	t.Assert(err, IsNil)
+	defer rows.Close()
+	t.Assert(rows.Next(), Equals, true)
+	e, err := slowtable.ScanEvent(rows)
+	t.Assert(err, IsNil)
+	t.Check(e.Ts, Equals, "150601 10:00:30")
+	t.Check(e.User, Equals, "app")
+	t.Check(e.Host, Equals, "web1")
+	t.Check(e.Db, Equals, "db1")
+	t.Check(e.Query, Equals, "SELECT * FROM t WHERE id=1")
+	t.Check(e.TimeMetrics["Query_time"], Equals, float32(1.5))
+	t.Check(e.TimeMetrics["Lock_time"], Equals, float32(0.0001))
+	t.Check(e.NumberMetrics["Rows_examined"], Equals, uint64(1000))
+	t.Check(rows.Next(), Equals, false)
+}
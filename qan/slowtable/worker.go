@@ -0,0 +1,388 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package slowtable
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/percona/cloud-protocol/proto/v1"
+	"github.com/percona/go-mysql/event"
+	"github.com/percona/go-mysql/log"
+	"github.com/percona/go-mysql/query"
+	"github.com/percona/percona-agent/mysql"
+	"github.com/percona/percona-agent/pct"
+	"github.com/percona/percona-agent/qan"
+	"github.com/percona/percona-agent/qan/slowlog"
+)
+
+const (
+	SLOW_LOG        = "mysql.slow_log"
+	SLOW_LOG_BACKUP = "mysql.slow_log_backup" // rotated slow log table, like rds_rotate_slow_log
+)
+
+// Worker reads mysql.slow_log when slow logging is directed to a table
+// (log_output=TABLE), e.g. on managed platforms like Amazon RDS without access
+// to the slow log file.  Each interval reads the rows with start_time in the
+// interval.
+type WorkerFactory interface {
+	Make(name string, config qan.Config, mysqlConn mysql.Connector) *Worker
+}
+
+type RealWorkerFactory struct {
+	logChan chan *proto.LogEntry
+}
+
+func NewRealWorkerFactory(logChan chan *proto.LogEntry) *RealWorkerFactory {
+	f := &RealWorkerFactory{
+		logChan: logChan,
+	}
+	return f
+}
+
+func (f *RealWorkerFactory) Make(name string, config qan.Config, mysqlConn mysql.Connector) *Worker {
+	return NewWorker(pct.NewLogger(f.logChan, name), config, mysqlConn)
+}
+
+// --------------------------------------------------------------------------
+
+type Worker struct {
+	logger    *pct.Logger
+	config    qan.Config
+	mysqlConn mysql.Connector
+	// --
+	name      string
+	status    *pct.Status
+	interval  *qan.Interval
+	tables    []string // read by the current job
+	rotated   bool     // slow log table rotated in the previous job
+	sync      *pct.SyncChan
+	running   bool
+	utcOffset time.Duration
+}
+
+func NewWorker(logger *pct.Logger, config qan.Config, mysqlConn mysql.Connector) *Worker {
+	// By default replace numbers in words with ?
+	query.ReplaceNumbersInWords = true
+
+	utcOffset, err := slowlog.GetutcOffset(mysqlConn)
+	if err != nil {
+		logger.Warn(err.Error())
+	}
+
+	name := logger.Service()
+	w := &Worker{
+		logger:    logger,
+		config:    config,
+		mysqlConn: mysqlConn,
+		// --
+		name:      name,
+		status:    pct.NewStatus([]string{name}),
+		sync:      pct.NewSyncChan(),
+		utcOffset: utcOffset,
+	}
+	return w
+}
+
+func (w *Worker) Setup(interval *qan.Interval) error {
+	w.logger.Debug("Setup:call")
+	defer w.logger.Debug("Setup:return")
+	w.interval = interval
+
+	// Rows logged between the interval stop and a rotation are in the backup
+	// table, so read it in the job after a rotation, too.
+	w.tables = []string{SLOW_LOG}
+	if w.rotated {
+		w.tables = append(w.tables, SLOW_LOG_BACKUP)
+		w.rotated = false
+	}
+
+	if w.config.MaxSlowLogSize <= 0 {
+		return nil
+	}
+	if err := w.mysqlConn.Connect(2); err != nil {
+		return err
+	}
+	defer w.mysqlConn.Close()
+	size, err := TableSize(w.mysqlConn.DB())
+	if err != nil {
+		w.logger.Warn(err)
+		return nil
+	}
+	if size >= w.config.MaxSlowLogSize {
+		w.logger.Info(fmt.Sprintf("Rotating slow log table: %s >= %s",
+			pct.Bytes(uint64(size)), pct.Bytes(uint64(w.config.MaxSlowLogSize))))
+		w.status.Update(w.name, "Rotating slow log table")
+		if err := Rotate(w.mysqlConn.DB()); err != nil {
+			w.logger.Error(err)
+		} else {
+			// The rows of this interval are in the backup table now.
+			w.tables = []string{SLOW_LOG_BACKUP, SLOW_LOG}
+			w.rotated = true
+		}
+		w.status.Update(w.name, "Idle")
+	}
+	return nil
+}
+
+func (w *Worker) Run() (*qan.Result, error) {
+	w.logger.Debug("Run:call")
+	defer w.logger.Debug("Run:return")
+
+	// The first interval begins when QAN starts, so there's nothing to read:
+	// older rows are not part of any interval.
+	if w.interval.StartTime.IsZero() {
+		return nil, nil
+	}
+
+	jobId := fmt.Sprintf("%d", w.interval.Number)
+	w.status.Update(w.name, "Starting job "+jobId)
+	defer w.status.Update(w.name, "Idle")
+
+	stopped := false
+	w.running = true
+	defer func() {
+		if stopped {
+			w.sync.Done()
+		}
+		w.running = false
+	}()
+
+	if err := w.mysqlConn.Connect(2); err != nil {
+		return nil, err
+	}
+	defer w.mysqlConn.Close()
+
+	result := &qan.Result{}
+	a := event.NewEventAggregator(w.config.ExampleQueries && pct.Collect(pct.DATA_QUERY_EXAMPLES), w.utcOffset)
+	var buckets *qan.Buckets
+	if w.config.BucketSize > 0 {
+		buckets = qan.NewBuckets(w.interval.StartTime, w.interval.StopTime, time.Duration(w.config.BucketSize)*time.Second)
+	}
+	t0 := time.Now()
+	runTime := time.Duration(w.config.WorkerRunTime) * time.Second
+	n := 0
+
+TABLE_LOOP:
+	for _, table := range w.tables {
+		w.status.Update(w.name, fmt.Sprintf("Reading %s for job %s", table, jobId))
+		rows, err := GetRows(w.mysqlConn.DB(), table, w.interval.StartTime, w.interval.StopTime)
+		if err != nil {
+			if table == SLOW_LOG_BACKUP {
+				w.logger.Warn(err) // rotated by another program, or not yet
+				continue
+			}
+			return nil, err
+		}
+		for rows.Next() {
+			e, err := ScanEvent(rows)
+			if err != nil {
+				rows.Close()
+				return nil, err
+			}
+			n++
+
+			// Stop if Stop() called.
+			select {
+			case <-w.sync.StopChan:
+				w.logger.Debug("Run:stop")
+				stopped = true
+				rows.Close()
+				break TABLE_LOOP
+			default:
+			}
+
+			// Stop if runtime exceeded.
+			if time.Now().Sub(t0) >= runTime {
+				errMsg := fmt.Sprintf("Timeout reading %s for job %s after %d rows", table, jobId, n)
+				w.logger.Warn(errMsg)
+				result.Error = errMsg
+				rows.Close()
+				break TABLE_LOOP
+			}
+
+			fingerprint, err := fingerprint(e.Query)
+			if err != nil {
+				w.logger.Warn(fmt.Sprintf("Cannot fingerprint '%s': %s", e.Query, err))
+				continue
+			}
+			id := query.Id(fingerprint)
+			a.AddEvent(e, id, fingerprint)
+			if buckets != nil {
+				if ts, ok := slowlog.ParseTs(e.Ts, w.utcOffset); ok {
+					buckets.Add(ts, id, float64(e.TimeMetrics["Query_time"]))
+				}
+			}
+		}
+		err = rows.Err()
+		rows.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Finalize the global and class metrics, i.e. calculate metric stats.
+	w.status.Update(w.name, "Finalizing job "+jobId)
+	r := a.Finalize()
+	classes := make([]*event.QueryClass, 0, len(r.Class))
+	for _, class := range r.Class {
+		classes = append(classes, class)
+	}
+	result.Global = r.Global
+	result.Class = classes
+	if buckets != nil {
+		result.Buckets = buckets.Buckets()
+	}
+	result.RunTime = time.Now().Sub(t0).Seconds()
+	w.logger.Info(fmt.Sprintf("Read %d rows for job %s in %.1fs", n, jobId, result.RunTime))
+	return result, nil
+}
+
+func (w *Worker) Stop() error {
+	w.logger.Debug("Stop:call")
+	defer w.logger.Debug("Stop:return")
+	if w.running {
+		w.sync.Stop()
+		w.sync.Wait()
+	}
+	return nil
+}
+
+func (w *Worker) Cleanup() error {
+	return nil
+}
+
+func (w *Worker) Status() map[string]string {
+	return w.status.All()
+}
+
+// --------------------------------------------------------------------------
+
+// fingerprint returns the fingerprint of the query, or an error if
+// query.Fingerprint crashes, so one bad query does not stop the job.
+func fingerprint(q string) (f string, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%s", r)
+		}
+	}()
+	return query.Fingerprint(q), nil
+}
+
+// GetRows returns the rows in the slow log table with start_time in
+// [begin, end), UTC, for ScanEvent.  UNIX_TIMESTAMP converts start_time from
+// the session time zone.
+func GetRows(db *sql.DB, table string, begin, end time.Time) (*sql.Rows, error) {
+	return db.Query("SELECT DATE_FORMAT(start_time, '%y%m%d %H:%i:%s'), user_host,"+
+		" TIME_TO_SEC(query_time) + MICROSECOND(query_time) / 1000000,"+
+		" TIME_TO_SEC(lock_time) + MICROSECOND(lock_time) / 1000000,"+
+		" rows_sent, rows_examined, db, CONVERT(sql_text USING utf8)"+
+		" FROM "+table+
+		" WHERE UNIX_TIMESTAMP(start_time) >= ? AND UNIX_TIMESTAMP(start_time) < ?",
+		begin.Unix(), end.Unix())
+}
+
+// ScanEvent scans a row from GetRows into a slow log event.
+func ScanEvent(rows *sql.Rows) (*log.Event, error) {
+	var ts, userHost, db, sqlText string
+	var queryTime, lockTime float64
+	var rowsSent, rowsExamined uint64
+	if err := rows.Scan(&ts, &userHost, &queryTime, &lockTime, &rowsSent, &rowsExamined, &db, &sqlText); err != nil {
+		return nil, err
+	}
+	user, host := ParseUserHost(userHost)
+	e := &log.Event{
+		Ts:    ts,
+		Query: sqlText,
+		User:  user,
+		Host:  host,
+		Db:    db,
+		TimeMetrics: map[string]float32{
+			"Query_time": float32(queryTime),
+			"Lock_time":  float32(lockTime),
+		},
+		NumberMetrics: map[string]uint64{
+			"Rows_sent":     rowsSent,
+			"Rows_examined": rowsExamined,
+		},
+	}
+	return e, nil
+}
+
+// ParseUserHost returns the user and host from a slow_log.user_host value
+// like "app[app] @ web1 [10.0.0.1]".  Host is the host name if known, else
+// the IP.
+func ParseUserHost(userHost string) (user, host string) {
+	parts := strings.SplitN(userHost, "@", 2)
+	user = strings.TrimSpace(parts[0])
+	if i := strings.Index(user, "["); i >= 0 {
+		user = user[0:i]
+	}
+	if len(parts) < 2 {
+		return user, ""
+	}
+	host = strings.TrimSpace(parts[1])
+	if i := strings.Index(host, "["); i >= 0 {
+		ip := strings.Trim(host[i:], "[] ")
+		host = strings.TrimSpace(host[0:i])
+		if host == "" {
+			host = ip
+		}
+	}
+	return user, host
+}
+
+// TableSize returns the size of mysql.slow_log in bytes.
+func TableSize(db *sql.DB) (int64, error) {
+	var size int64
+	err := db.QueryRow("SELECT COALESCE(DATA_LENGTH, 0) FROM information_schema.TABLES" +
+		" WHERE TABLE_SCHEMA = 'mysql' AND TABLE_NAME = 'slow_log'").Scan(&size)
+	return size, err
+}
+
+// Rotate moves mysql.slow_log to mysql.slow_log_backup, replacing the previous
+// backup, and logging continues to a new, empty mysql.slow_log.  On Amazon RDS
+// it calls mysql.rds_rotate_slow_log which does the same.  A log table can be
+// renamed while logging is enabled only if a new table is renamed to it in the
+// same RENAME TABLE.
+func Rotate(db *sql.DB) error {
+	var rds int
+	err := db.QueryRow("SELECT COUNT(*) FROM information_schema.ROUTINES" +
+		" WHERE ROUTINE_SCHEMA = 'mysql' AND ROUTINE_NAME = 'rds_rotate_slow_log'").Scan(&rds)
+	if err != nil {
+		return err
+	}
+	if rds > 0 {
+		_, err := db.Exec("CALL mysql.rds_rotate_slow_log")
+		return err
+	}
+	queries := []string{
+		"DROP TABLE IF EXISTS mysql.slow_log_new",
+		"CREATE TABLE mysql.slow_log_new LIKE mysql.slow_log",
+		"DROP TABLE IF EXISTS " + SLOW_LOG_BACKUP,
+		"RENAME TABLE mysql.slow_log TO " + SLOW_LOG_BACKUP + ", mysql.slow_log_new TO mysql.slow_log",
+	}
+	for _, q := range queries {
+		if _, err := db.Exec(q); err != nil {
+			return fmt.Errorf("%s: %s", q, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,95 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package qan
+
+import (
+	"fmt"
+
+	"github.com/percona/percona-agent/mysql"
+)
+
+// The slow log safety valve does not raise long_query_time more than this,
+// seconds.  Queries slower than this are rare, so the slow log is small.
+const MAX_VALVE_LONG_QUERY_TIME = 10.0
+
+// SlowLogRate returns how fast the slow log grew during the interval, in
+// MB/minute.
+func SlowLogRate(interval *Interval) float64 {
+	minutes := interval.StopTime.Sub(interval.StartTime).Minutes()
+	if minutes <= 0 {
+		return 0
+	}
+	return float64(intervalLogSize(interval)) / (1024 * 1024) / minutes
+}
+
+// RaiseLongQueryTime returns the long_query_time to set when the slow log
+// grows too fast: double, at least 0.1s, at most MAX_VALVE_LONG_QUERY_TIME.
+func RaiseLongQueryTime(cur float64) float64 {
+	next := cur * 2
+	if next < 0.1 {
+		next = 0.1
+	}
+	if next > MAX_VALVE_LONG_QUERY_TIME {
+		next = MAX_VALVE_LONG_QUERY_TIME
+	}
+	return next
+}
+
+// slowLogValve raises long_query_time and disables log_slow_admin_statements
+// if the slow log grew faster than Config.MaxSlowLogRate during the interval,
+// protecting the server from I/O caused by QAN.  It returns true if the slow
+// log grew too fast.  If ramp is not nil, the ramp is stopped so it does not
+// lower long_query_time again.
+func (a *RealAnalyzer) slowLogValve(interval *Interval, ramp *ramp) bool {
+	rate := SlowLogRate(interval)
+	if a.config.MaxSlowLogRate <= 0 || rate <= a.config.MaxSlowLogRate {
+		return false
+	}
+	if err := a.mysqlConn.Connect(1); err != nil {
+		a.logger.Warn("Cannot connect to MySQL to raise long_query_time:", err)
+		return true
+	}
+	defer a.mysqlConn.Close()
+
+	cur := a.mysqlConn.GetGlobalVarNumber("long_query_time")
+	next := RaiseLongQueryTime(cur)
+	if ramp != nil {
+		ramp.cur = next
+		ramp.left = 0
+	}
+	queries := []mysql.Query{}
+	if next > cur {
+		queries = append(queries, longQueryTimeQuery(next))
+	}
+	switch a.mysqlConn.GetGlobalVarString("log_slow_admin_statements") {
+	case "ON", "1":
+		queries = append(queries, mysql.Query{Set: "SET GLOBAL log_slow_admin_statements = OFF"})
+	}
+	if len(queries) == 0 {
+		a.logger.Warn(fmt.Sprintf("Slow log grew %.1f MB/minute, more than MaxSlowLogRate %.1f, but long_query_time is already %.6f",
+			rate, a.config.MaxSlowLogRate, cur))
+		return true
+	}
+	if err := a.mysqlConn.Set(queries); err != nil {
+		a.logger.Warn("Cannot raise long_query_time:", err)
+		return true
+	}
+	a.logger.Warn(fmt.Sprintf("Slow log grew %.1f MB/minute, more than MaxSlowLogRate %.1f: raised long_query_time from %.6f to %.6f",
+		rate, a.config.MaxSlowLogRate, cur, next))
+	return true
+}
@@ -233,14 +233,13 @@ func (e *QueryExecutor) classicExplain(tx *sql.Tx, query string) (classicExplain
 }
 
 func (e *QueryExecutor) jsonExplain(tx *sql.Tx, query string) (string, error) {
-	// EXPLAIN in JSON format is introduced since MySQL 5.6.5
-	ok, err := e.conn.AtLeastVersion("5.6.5")
-	if !ok || err != nil {
-		return "", err
+	// EXPLAIN in JSON format is introduced since MySQL 5.6.5 and MariaDB 10.1.2
+	if !mysql.GetConnFeatures(e.conn).JSONExplain {
+		return "", nil
 	}
 
 	explain := ""
-	err = tx.QueryRow(fmt.Sprintf("EXPLAIN FORMAT=JSON %s", query)).Scan(&explain)
+	err := tx.QueryRow(fmt.Sprintf("EXPLAIN FORMAT=JSON %s", query)).Scan(&explain)
 	if err != nil {
 		return "", err
 	}
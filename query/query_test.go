@@ -30,6 +30,7 @@ import (
 	"github.com/percona/percona-agent/mysql"
 	"github.com/percona/percona-agent/pct"
 	"github.com/percona/percona-agent/query"
+	"github.com/percona/percona-agent/test"
 	"github.com/percona/percona-agent/test/mock"
 	. "gopkg.in/check.v1"
 )
@@ -99,6 +100,9 @@ func (s *ManagerTestSuite) SetUpTest(t *C) {
 			t.Fatal(err)
 		}
 	}
+	if err := test.ClearConfigs(); err != nil {
+		t.Fatal(err)
+	}
 }
 
 func (s *ManagerTestSuite) TearDownSuite(t *C) {
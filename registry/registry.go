@@ -0,0 +1,128 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+// Package registry lets services register with the agent.  Built-in services
+// are registered by bin/percona-agent.  Third-party services are compiled in
+// by importing their package in bin/percona-agent, e.g. in a plugins.go file:
+//
+//	import _ "example.com/percona-agent-foo"
+//
+// where the package registers itself on init:
+//
+//	func init() {
+//	    registry.Register(registry.Service{
+//	        Name:  "foo",
+//	        Make:  func(deps registry.Deps) (pct.ServiceManager, error) { ... },
+//	        Pause: true,
+//	    })
+//	}
+//
+// The agent makes and starts every registered service, then routes its cmds,
+// Status, and GetConfig like any built-in service.  Like built-in services,
+// a service loads its config from pct.Basedir on Start.
+package registry
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/percona/cloud-protocol/proto/v1"
+	"github.com/percona/percona-agent/bus"
+	"github.com/percona/percona-agent/data"
+	"github.com/percona/percona-agent/instance"
+	"github.com/percona/percona-agent/mrms"
+	"github.com/percona/percona-agent/mysql"
+	"github.com/percona/percona-agent/pct"
+	"github.com/percona/percona-agent/ticker"
+)
+
+// Deps are the agent objects shared by services.  They're created by the
+// agent before any registered service is made.
+type Deps struct {
+	LogChan      chan *proto.LogEntry // for pct.NewLogger
+	API          pct.APIConnector
+	Clock        ticker.Manager
+	Spool        data.Spooler
+	InstanceRepo *instance.Repo
+	MRMS         mrms.Monitor
+	ConnFactory  mysql.ConnectionFactory
+	Bus          *bus.Bus // events between services, e.g. bus.MYSQL_RESTART
+	Demo         bool     // make services that generate synthetic data, see package demo
+}
+
+// A Service is a named service manager factory.
+type Service struct {
+	Name  string                                      // cmd.Service, config file name, etc.; must be unique
+	Make  func(deps Deps) (pct.ServiceManager, error) // called once, before Start
+	Pause bool                                        // stop on Pause, start on Resume, see agent.PAUSE_SERVICES
+}
+
+var (
+	services = []Service{}
+	names    = map[string]bool{}
+	mux      = &sync.Mutex{}
+)
+
+// Register registers the service.  It panics if the name is empty, already
+// registered, or Make is nil, like database/sql.Register, because that's a
+// code bug.
+func Register(s Service) {
+	mux.Lock()
+	defer mux.Unlock()
+	if s.Name == "" {
+		panic("registry: service name is empty")
+	}
+	if s.Make == nil {
+		panic("registry: service " + s.Name + " Make is nil")
+	}
+	if names[s.Name] {
+		panic("registry: service " + s.Name + " is already registered")
+	}
+	names[s.Name] = true
+	services = append(services, s)
+}
+
+// Services returns the registered services in the order registered.
+func Services() []Service {
+	mux.Lock()
+	defer mux.Unlock()
+	s := make([]Service, len(services))
+	copy(s, services)
+	return s
+}
+
+// Start makes and starts the registered services, and returns them by name.
+// reserved are names of services the agent makes itself, e.g. log and data,
+// which registered services cannot use.  On error, services already started
+// are not stopped because the agent exits.
+func Start(deps Deps, reserved map[string]pct.ServiceManager) (map[string]pct.ServiceManager, error) {
+	started := make(map[string]pct.ServiceManager)
+	for _, s := range Services() {
+		if _, ok := reserved[s.Name]; ok {
+			return nil, fmt.Errorf("Service %s is reserved", s.Name)
+		}
+		m, err := s.Make(deps)
+		if err != nil {
+			return nil, fmt.Errorf("Error making %s manager: %s", s.Name, err)
+		}
+		if err := m.Start(); err != nil {
+			return nil, fmt.Errorf("Error starting %s manager: %s", s.Name, err)
+		}
+		started[s.Name] = m
+	}
+	return started, nil
+}
@@ -0,0 +1,97 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package registry_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/percona/percona-agent/pct"
+	"github.com/percona/percona-agent/registry"
+	"github.com/percona/percona-agent/test/mock"
+	. "gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) { TestingT(t) }
+
+type RegistryTestSuite struct {
+	readyChan chan bool
+	traceChan chan string
+}
+
+var _ = Suite(&RegistryTestSuite{})
+
+func (s *RegistryTestSuite) SetUpSuite(t *C) {
+	s.readyChan = make(chan bool, 2)
+	s.traceChan = make(chan string, 10)
+}
+
+// --------------------------------------------------------------------------
+
+func (s *RegistryTestSuite) TestRegisterAndStart(t *C) {
+	var gotDeps registry.Deps
+	for _, name := range []string{"foo", "bar"} {
+		m := mock.NewMockServiceManager(name, s.readyChan, s.traceChan)
+		registry.Register(registry.Service{
+			Name: name,
+			Make: func(deps registry.Deps) (pct.ServiceManager, error) {
+				gotDeps = deps
+				return m, nil
+			},
+		})
+	}
+	services := registry.Services()
+	t.Assert(services, HasLen, 2)
+	t.Check(services[0].Name, Equals, "foo")
+	t.Check(services[1].Name, Equals, "bar")
+
+	// Names are unique.
+	t.Check(func() {
+		registry.Register(registry.Service{
+			Name: "foo",
+			Make: func(deps registry.Deps) (pct.ServiceManager, error) { return nil, nil },
+		})
+	}, PanicMatches, "registry: service foo is already registered")
+
+	// Services are made with the deps and started in order.
+	s.readyChan <- true
+	s.readyChan <- true
+	deps := registry.Deps{LogChan: nil, Clock: mock.NewClock()}
+	started, err := registry.Start(deps, map[string]pct.ServiceManager{"log": nil})
+	t.Assert(err, IsNil)
+	t.Check(started, HasLen, 2)
+	t.Check(gotDeps.Clock, Equals, deps.Clock)
+	t.Check(<-s.traceChan, Equals, "Start foo")
+	t.Check(<-s.traceChan, Equals, "Start bar")
+
+	// Built-in service names are reserved.
+	_, err = registry.Start(deps, map[string]pct.ServiceManager{"bar": nil})
+	t.Check(err, ErrorMatches, "Service bar is reserved")
+
+	// Registries are global, so test this last.
+	registry.Register(registry.Service{
+		Name: "broken",
+		Make: func(deps registry.Deps) (pct.ServiceManager, error) { return nil, errors.New("no foo") },
+	})
+	s.readyChan <- true
+	s.readyChan <- true
+	_, err = registry.Start(deps, nil)
+	t.Check(err, ErrorMatches, "Error making broken manager: no foo")
+	<-s.traceChan
+	<-s.traceChan
+}
@@ -0,0 +1,55 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package sampler
+
+import (
+	"github.com/percona/cloud-protocol/proto/v1"
+	"github.com/percona/percona-agent/periodic"
+)
+
+const (
+	DEFAULT_INTERVAL  = 1  // seconds
+	DEFAULT_THRESHOLD = 10 // seconds
+	MAX_STATEMENTS    = 100
+)
+
+// Config is saved to config/sampler.conf by StartService.
+type Config struct {
+	periodic.Config
+	Threshold      float64 // seconds, sample statements running longer
+	ExampleQueries bool    // SQL_TEXT, else only the digest text
+}
+
+// A Statement is a statement still running when sampled.  It's reported
+// once, when first sampled, so Runtime is how long it had been running.
+type Statement struct {
+	ThreadId   uint64
+	EventId    uint64
+	Db         string `json:",omitempty"`
+	Digest     string `json:",omitempty"` // same as QAN perfschema query class id
+	DigestText string `json:",omitempty"`
+	SQLText    string `json:",omitempty"` // if Config.ExampleQueries
+	Runtime    float64
+}
+
+// A Report is sent only for samples with new long-running statements.
+type Report struct {
+	proto.ServiceInstance
+	Ts         int64 // UTC Unix timestamp
+	Statements []Statement
+}
@@ -0,0 +1,199 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package sampler
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/percona/percona-agent/data"
+	"github.com/percona/percona-agent/instance"
+	"github.com/percona/percona-agent/mysql"
+	"github.com/percona/percona-agent/pct"
+	"github.com/percona/percona-agent/periodic"
+	"github.com/percona/percona-agent/ticker"
+)
+
+const (
+	SERVICE_NAME = "sampler"
+)
+
+// Manager samples performance_schema.events_statements_current every few
+// seconds and reports statements running longer than the threshold, so
+// long-running queries are seen while they run, not after the QAN interval.
+type Manager struct {
+	*periodic.Manager
+}
+
+func NewManager(logger *pct.Logger, clock ticker.Manager, spool data.Spooler, instanceRepo *instance.Repo, connFactory mysql.ConnectionFactory) *Manager {
+	s := &statementSampler{
+		logger: logger,
+		spool:  spool,
+		status: pct.NewStatus([]string{SERVICE_NAME, SERVICE_NAME + "-mysql"}),
+	}
+	spec := periodic.Spec{
+		Name:            SERVICE_NAME,
+		DefaultInterval: DEFAULT_INTERVAL,
+		SyncTicks:       false,
+	}
+	m := &Manager{
+		Manager: periodic.NewManager(spec, s, logger, s.status, clock, instanceRepo, connFactory),
+	}
+	return m
+}
+
+// statementSampler is the periodic.Service of the Manager.
+type statementSampler struct {
+	logger *pct.Logger
+	spool  data.Spooler
+	status *pct.Status
+}
+
+func (s *statementSampler) NewConfig() interface{} {
+	return &Config{}
+}
+
+func (s *statementSampler) Validate(config interface{}) error {
+	cfg := config.(*Config)
+	if cfg.Threshold < 0 {
+		return fmt.Errorf("Invalid Threshold: %f: must not be negative", cfg.Threshold)
+	}
+	if cfg.Threshold == 0 {
+		cfg.Threshold = DEFAULT_THRESHOLD
+	}
+	return nil
+}
+
+// ConfigSchema describes Config.  The constraints must match Validate.
+func (s *statementSampler) ConfigSchema() pct.ConfigSchema {
+	schema := pct.NewConfigSchema(SERVICE_NAME, Config{Threshold: DEFAULT_THRESHOLD})
+	schema.Field("Threshold").Min = 0
+	return schema
+}
+
+// @goroutine[1]
+func (s *statementSampler) Run(config interface{}, conn mysql.Connector, tickChan chan time.Time, runSync *pct.SyncChan) {
+	cfg := config.(*Config)
+	connected := false
+	defer func() {
+		if connected {
+			conn.Close()
+		}
+		s.status.Update(SERVICE_NAME+"-mysql", "Disconnected")
+	}()
+
+	// Statements reported by the previous sample, to report each only once.
+	// Statements no longer running are forgotten on the next sample.
+	reported := make(map[string]bool)
+
+	for {
+		select {
+		case now := <-tickChan:
+			// Sampling is frequent, so stay connected between samples.
+			if !connected {
+				s.status.Update(SERVICE_NAME+"-mysql", "Connecting")
+				if err := conn.Connect(1); err != nil {
+					s.logger.Warn(err)
+					s.status.Update(SERVICE_NAME+"-mysql", "Error: "+err.Error())
+					continue
+				}
+				connected = true
+				s.status.Update(SERVICE_NAME+"-mysql", "Connected")
+				if !mysql.GetConnFeatures(conn).PerfSchemaDigests {
+					s.logger.Warn("MySQL does not have statement digests, the sampler requires MySQL 5.6 or newer")
+				}
+			}
+
+			examples := cfg.ExampleQueries && pct.Collect(pct.DATA_QUERY_EXAMPLES)
+			stmts, err := Sample(conn.DB(), cfg.Threshold, examples)
+			if err != nil {
+				// Reconnect on the next tick in case the connection was lost.
+				s.logger.Warn(err)
+				s.status.Update(SERVICE_NAME+"-mysql", "Error: "+err.Error())
+				conn.Close()
+				connected = false
+				continue
+			}
+
+			running := make(map[string]bool, len(stmts))
+			newStmts := []Statement{}
+			for _, stmt := range stmts {
+				key := fmt.Sprintf("%d:%d", stmt.ThreadId, stmt.EventId)
+				running[key] = true
+				if !reported[key] {
+					newStmts = append(newStmts, stmt)
+				}
+			}
+			reported = running
+
+			if len(newStmts) > 0 {
+				report := &Report{
+					ServiceInstance: cfg.ServiceInstance,
+					Ts:              now.UTC().Unix(),
+					Statements:      newStmts,
+				}
+				if err := s.spool.Write(SERVICE_NAME, report); err != nil {
+					s.logger.Warn("Lost report:", err)
+				}
+			}
+			s.status.Update(SERVICE_NAME, fmt.Sprintf("%d long-running statements at %s", len(stmts), pct.TimeString(now)))
+		case <-runSync.StopChan:
+			runSync.Graceful()
+			return
+		}
+	}
+}
+
+// Sample returns up to MAX_STATEMENTS statements running longer than the
+// threshold, in seconds, longest first.  The events_statements_current
+// consumer must be enabled, which it is by default.  SQL_TEXT is returned
+// only if sqlText is true.
+func Sample(conn *sql.DB, threshold float64, sqlText bool) ([]Statement, error) {
+	// TIMER_WAIT of a running statement is how long it has been running,
+	// in picoseconds.
+	rows, err := conn.Query("SELECT THREAD_ID, EVENT_ID, CURRENT_SCHEMA, DIGEST, DIGEST_TEXT, SQL_TEXT, TIMER_WAIT"+
+		" FROM performance_schema.events_statements_current"+
+		" WHERE END_EVENT_ID IS NULL AND TIMER_WAIT > ?"+
+		" ORDER BY TIMER_WAIT DESC"+
+		" LIMIT ?",
+		uint64(threshold*1e12), MAX_STATEMENTS)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	stmts := []Statement{}
+	for rows.Next() {
+		var db, digest, digestText, text sql.NullString
+		var timerWait uint64
+		s := Statement{}
+		if err := rows.Scan(&s.ThreadId, &s.EventId, &db, &digest, &digestText, &text, &timerWait); err != nil {
+			return nil, err
+		}
+		s.Db = db.String
+		s.Digest = digest.String
+		s.DigestText = digestText.String
+		if sqlText {
+			s.SQLText = text.String
+		}
+		s.Runtime = float64(timerWait) / 1e12
+		stmts = append(stmts, s)
+	}
+	return stmts, rows.Err()
+}
@@ -0,0 +1,206 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package sampler_test
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/percona/cloud-protocol/proto/v1"
+	"github.com/percona/percona-agent/instance"
+	"github.com/percona/percona-agent/pct"
+	"github.com/percona/percona-agent/periodic"
+	"github.com/percona/percona-agent/sampler"
+	"github.com/percona/percona-agent/test"
+	"github.com/percona/percona-agent/test/mock"
+	. "gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) { TestingT(t) }
+
+type ManagerTestSuite struct {
+	logChan       chan *proto.LogEntry
+	logger        *pct.Logger
+	tmpDir        string
+	repo          *instance.Repo
+	mysqlInstance proto.ServiceInstance
+}
+
+var _ = Suite(&ManagerTestSuite{})
+
+func (s *ManagerTestSuite) SetUpSuite(t *C) {
+	s.logChan = make(chan *proto.LogEntry, 100)
+	s.logger = pct.NewLogger(s.logChan, sampler.SERVICE_NAME+"-manager-test")
+
+	var err error
+	s.tmpDir, err = ioutil.TempDir("/tmp", "agent-test")
+	t.Assert(err, IsNil)
+	if err := pct.Basedir.Init(s.tmpDir); err != nil {
+		t.Fatal(err)
+	}
+
+	s.repo = instance.NewRepo(pct.NewLogger(s.logChan, "im-test"), pct.Basedir.Dir("config"), nil)
+	data, err := json.Marshal(&proto.MySQLInstance{
+		Hostname: "db1",
+		DSN:      "user:pass@tcp(127.0.0.1:3306)/",
+	})
+	t.Assert(err, IsNil)
+	s.repo.Add("mysql", 1, data, false)
+	s.mysqlInstance = proto.ServiceInstance{Service: "mysql", InstanceId: 1}
+}
+
+func (s *ManagerTestSuite) SetUpTest(t *C) {
+	pct.Basedir.RemoveConfig(sampler.SERVICE_NAME)
+}
+
+func (s *ManagerTestSuite) TearDownSuite(t *C) {
+	if err := os.RemoveAll(s.tmpDir); err != nil {
+		t.Error(err)
+	}
+}
+
+// --------------------------------------------------------------------------
+
+// events_statements_current columns selected by Sample.
+var sampleColumns = []string{"THREAD_ID", "EVENT_ID", "CURRENT_SCHEMA", "DIGEST", "DIGEST_TEXT", "SQL_TEXT", "TIMER_WAIT"}
+
+func (s *ManagerTestSuite) TestSample(t *C) {
+	fake := mock.NewFakeMySQL()
+	fake.OnQuery("FROM performance_schema.events_statements_current").Rows(
+		sampleColumns,
+		[][]interface{}{
+			{20, 7, "app", "abc123", "SELECT SLEEP (?)", "SELECT SLEEP(3)", 1500000000000},
+			{21, 3, nil, nil, nil, "SELECT 1", 1000000000000},
+		},
+	)
+	stmts, err := sampler.Sample(fake.DB(), 1, false)
+	t.Assert(err, IsNil)
+	t.Check(stmts, DeepEquals, []sampler.Statement{
+		{ThreadId: 20, EventId: 7, Db: "app", Digest: "abc123", DigestText: "SELECT SLEEP (?)", Runtime: 1.5},
+		{ThreadId: 21, EventId: 3, Runtime: 1},
+	})
+
+	// SQL_TEXT only if asked.
+	stmts, err = sampler.Sample(fake.DB(), 1, true)
+	t.Assert(err, IsNil)
+	t.Assert(stmts, HasLen, 2)
+	t.Check(stmts[0].SQLText, Equals, "SELECT SLEEP(3)")
+}
+
+func (s *ManagerTestSuite) TestStartService(t *C) {
+	fake := mock.NewFakeMySQL()
+	m := sampler.NewManager(s.logger, mock.NewClock(), mock.NewSpooler(nil), s.repo, &mock.ConnectionFactory{Conn: fake})
+	err := m.Start()
+	t.Assert(err, IsNil)
+	defer m.Stop()
+
+	// Threshold can't be negative.
+	config := &sampler.Config{
+		Config:    periodic.Config{ServiceInstance: s.mysqlInstance},
+		Threshold: -1,
+	}
+	data, _ := json.Marshal(config)
+	reply := m.Handle(&proto.Cmd{Service: sampler.SERVICE_NAME, Cmd: "StartService", Data: data})
+	t.Check(reply.Error, Not(Equals), "")
+
+	config.Threshold = 0
+	data, _ = json.Marshal(config)
+	reply = m.Handle(&proto.Cmd{Service: sampler.SERVICE_NAME, Cmd: "StartService", Data: data})
+	t.Assert(reply.Error, Equals, "")
+
+	// Config is saved with defaults.
+	saved := &sampler.Config{}
+	err = pct.Basedir.ReadConfig(sampler.SERVICE_NAME, saved)
+	t.Assert(err, IsNil)
+	t.Check(saved.Interval, Equals, uint(sampler.DEFAULT_INTERVAL))
+	t.Check(saved.Threshold, Equals, float64(sampler.DEFAULT_THRESHOLD))
+
+	configs, errs := m.GetConfig()
+	t.Check(errs, HasLen, 0)
+	t.Assert(configs, HasLen, 1)
+	t.Check(configs[0].Running, Equals, true)
+
+	reply = m.Handle(&proto.Cmd{Service: sampler.SERVICE_NAME, Cmd: "StopService"})
+	t.Check(reply.Error, Equals, "")
+	t.Check(pct.Basedir.ConfigExists(sampler.SERVICE_NAME), Equals, false)
+}
+
+func (s *ManagerTestSuite) TestReport(t *C) {
+	fake := mock.NewFakeMySQL()
+	sample := fake.OnQuery("FROM performance_schema.events_statements_current").Rows(
+		sampleColumns,
+		[][]interface{}{
+			{20, 7, "app", "abc123", "SELECT SLEEP (?)", "SELECT SLEEP(30)", 10500000000000},
+		},
+	)
+	clock := mock.NewClock()
+	dataChan := make(chan interface{}, 1)
+	m := sampler.NewManager(s.logger, clock, mock.NewSpooler(dataChan), s.repo, &mock.ConnectionFactory{Conn: fake})
+	err := m.Start()
+	t.Assert(err, IsNil)
+
+	config := &sampler.Config{
+		Config: periodic.Config{ServiceInstance: s.mysqlInstance},
+	}
+	data, _ := json.Marshal(config)
+	reply := m.Handle(&proto.Cmd{Service: sampler.SERVICE_NAME, Cmd: "StartService", Data: data})
+	t.Assert(reply.Error, Equals, "")
+	t.Check(clock.Added, DeepEquals, []uint{sampler.DEFAULT_INTERVAL})
+	t.Assert(clock.Chans, HasLen, 1)
+
+	now := time.Date(2015, 6, 1, 12, 0, 0, 0, time.UTC)
+	clock.Chans[0] <- now
+	got := test.WaitData(dataChan)
+	t.Assert(got, HasLen, 1)
+	t.Check(got[0], DeepEquals, &sampler.Report{
+		ServiceInstance: s.mysqlInstance,
+		Ts:              now.Unix(),
+		Statements: []sampler.Statement{
+			{ThreadId: 20, EventId: 7, Db: "app", Digest: "abc123", DigestText: "SELECT SLEEP (?)", Runtime: 10.5},
+		},
+	})
+
+	// A statement is reported once, and the connection is kept between
+	// samples.
+	clock.Chans[0] <- now.Add(time.Second)
+	ok := test.WaitStatusPrefix(1, m, sampler.SERVICE_NAME, "1 long-running statements at "+pct.TimeString(now.Add(time.Second)))
+	t.Assert(ok, Equals, true)
+	t.Check(dataChan, HasLen, 0)
+	t.Check(fake.Connected(), Equals, uint(1))
+
+	// On error, it reconnects on the next tick.
+	sample.Error(errors.New("MySQL server has gone away"))
+	clock.Chans[0] <- now.Add(2 * time.Second)
+	ok = test.WaitStatusPrefix(1, m, sampler.SERVICE_NAME+"-mysql", "Error: ")
+	t.Assert(ok, Equals, true)
+
+	sample.Error(nil)
+	clock.Chans[0] <- now.Add(3 * time.Second)
+	ok = test.WaitStatusPrefix(1, m, sampler.SERVICE_NAME, "1 long-running statements at "+pct.TimeString(now.Add(3*time.Second)))
+	t.Assert(ok, Equals, true)
+	t.Check(m.Status()[sampler.SERVICE_NAME+"-mysql"], Equals, "Connected")
+	t.Check(fake.Connected(), Equals, uint(1))
+
+	// The connection is closed when the service stops.
+	m.Stop()
+	t.Check(fake.Connected(), Equals, uint(0))
+}
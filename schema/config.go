@@ -0,0 +1,62 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package schema
+
+import (
+	"github.com/percona/cloud-protocol/proto/v1"
+	"github.com/percona/percona-agent/periodic"
+)
+
+const (
+	DEFAULT_INTERVAL = 3600 // seconds
+	MAX_TABLES       = 1000 // tables checked per interval
+)
+
+// Config is saved to config/schema.conf by StartService.  Only tables in
+// the Tables allowlist are checked because SHOW CREATE TABLE for every table
+// can be slow on servers with many tables.
+type Config struct {
+	periodic.Config
+	Tables []string // db.table, wildcards allowed like db.* or db.t_*
+}
+
+// Types of schema changes.
+const (
+	CHANGE_CREATE = "CREATE"
+	CHANGE_ALTER  = "ALTER"
+	CHANGE_DROP   = "DROP"
+)
+
+// A Change is a table created, altered, or dropped between two checks.
+// OldCreate and NewCreate are SHOW CREATE TABLE before and after; either is
+// empty for CREATE and DROP.
+type Change struct {
+	Db        string
+	Table     string
+	Type      string // CHANGE_CREATE, CHANGE_ALTER, or CHANGE_DROP
+	OldCreate string `json:",omitempty"`
+	NewCreate string `json:",omitempty"`
+}
+
+// A Report is sent only when there are changes.  Ts is when the change was
+// detected, so the change happened during the previous Interval.
+type Report struct {
+	proto.ServiceInstance
+	Ts      int64 // UTC Unix timestamp
+	Changes []Change
+}
@@ -0,0 +1,273 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package schema
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/percona/percona-agent/data"
+	"github.com/percona/percona-agent/instance"
+	"github.com/percona/percona-agent/mysql"
+	"github.com/percona/percona-agent/pct"
+	"github.com/percona/percona-agent/periodic"
+	"github.com/percona/percona-agent/ticker"
+)
+
+const (
+	SERVICE_NAME = "schema"
+)
+
+// AUTO_INCREMENT=N in SHOW CREATE TABLE changes with every insert, so it's
+// removed before checksumming.
+var autoIncRe = regexp.MustCompile(` AUTO_INCREMENT=\d+`)
+
+// Manager periodically checksums SHOW CREATE TABLE for the tables in the
+// config allowlist and reports tables created, altered, or dropped since the
+// previous check.  Reports have the same timestamps as QAN and mm reports, so
+// schema changes can be tied to changes in query performance.
+type Manager struct {
+	*periodic.Manager
+}
+
+func NewManager(logger *pct.Logger, clock ticker.Manager, spool data.Spooler, instanceRepo *instance.Repo, connFactory mysql.ConnectionFactory) *Manager {
+	d := &detector{
+		logger: logger,
+		spool:  spool,
+		status: pct.NewStatus([]string{SERVICE_NAME, SERVICE_NAME + "-mysql"}),
+	}
+	// Unsynchronized ticker like sysconfig: checks are slow and need not
+	// align with other reports.
+	spec := periodic.Spec{
+		Name:            SERVICE_NAME,
+		DefaultInterval: DEFAULT_INTERVAL,
+		SyncTicks:       false,
+	}
+	m := &Manager{
+		Manager: periodic.NewManager(spec, d, logger, d.status, clock, instanceRepo, connFactory),
+	}
+	return m
+}
+
+// detector is the periodic.Service of the Manager.  Restarting it with a new
+// config makes the first check the new baseline.
+type detector struct {
+	logger *pct.Logger
+	spool  data.Spooler
+	status *pct.Status
+}
+
+func (d *detector) NewConfig() interface{} {
+	return &Config{}
+}
+
+func (d *detector) Validate(config interface{}) error {
+	cfg := config.(*Config)
+	if len(cfg.Tables) == 0 {
+		return errors.New("No Tables, expected db.table or db.* for each table to check")
+	}
+	for _, t := range cfg.Tables {
+		db, table := splitTable(t)
+		if db == "" || table == "" {
+			return fmt.Errorf("Invalid table: %s: expected db.table or db.*", t)
+		}
+		if _, err := path.Match(t, ""); err != nil {
+			return fmt.Errorf("Invalid table: %s: %s", t, err)
+		}
+	}
+	return nil
+}
+
+// ConfigSchema describes Config.  The constraints must match Validate.
+func (d *detector) ConfigSchema() pct.ConfigSchema {
+	s := pct.NewConfigSchema(SERVICE_NAME, Config{})
+	s.Field("Tables").Required = true
+	return s
+}
+
+// @goroutine[1]
+func (d *detector) Run(config interface{}, conn mysql.Connector, tickChan chan time.Time, runSync *pct.SyncChan) {
+	cfg := config.(*Config)
+
+	// db.table => SHOW CREATE TABLE.  nil until the first check, which is the
+	// baseline, so no changes are reported when the service starts.
+	var tables map[string]string
+
+	last := "Idle" // the last result, shown between ticks
+	for {
+		d.status.Update(SERVICE_NAME, last)
+		select {
+		case now := <-tickChan:
+			d.status.Update(SERVICE_NAME, "Checking tables")
+			d.status.Update(SERVICE_NAME+"-mysql", "Connecting")
+			if err := conn.Connect(2); err != nil {
+				d.logger.Warn(err)
+				d.status.Update(SERVICE_NAME+"-mysql", "Error: "+err.Error())
+				continue
+			}
+			d.status.Update(SERVICE_NAME+"-mysql", "Connected")
+			newTables, err := GetTables(conn.DB(), cfg.Tables)
+			conn.Close()
+			d.status.Update(SERVICE_NAME+"-mysql", "Disconnected (OK)")
+			if err != nil {
+				d.logger.Warn(err)
+				continue
+			}
+			if len(newTables) >= MAX_TABLES {
+				d.logger.Warn(fmt.Sprintf("Checking only the first %d tables", MAX_TABLES))
+			}
+
+			if tables != nil {
+				changes := Changes(tables, newTables)
+				if len(changes) > 0 {
+					for _, c := range changes {
+						d.logger.Info(fmt.Sprintf("Schema change: %s %s.%s", c.Type, c.Db, c.Table))
+					}
+					report := &Report{
+						ServiceInstance: cfg.ServiceInstance,
+						Ts:              now.UTC().Unix(),
+						Changes:         changes,
+					}
+					if err := d.spool.Write(SERVICE_NAME, report); err != nil {
+						d.logger.Warn("Lost report:", err)
+					}
+				}
+			}
+			tables = newTables
+			last = fmt.Sprintf("Checked %d tables at %s", len(tables), pct.TimeString(now))
+		case <-runSync.StopChan:
+			runSync.Graceful()
+			return
+		}
+	}
+}
+
+// GetTables returns SHOW CREATE TABLE, without AUTO_INCREMENT, for up to
+// MAX_TABLES base tables matching the allowlist, keyed on db.table.
+func GetTables(conn *sql.DB, allowlist []string) (map[string]string, error) {
+	rows, err := conn.Query("SELECT TABLE_SCHEMA, TABLE_NAME FROM information_schema.TABLES" +
+		" WHERE TABLE_TYPE = 'BASE TABLE'" +
+		" AND TABLE_SCHEMA NOT IN ('mysql', 'information_schema', 'performance_schema', 'sys')" +
+		" ORDER BY TABLE_SCHEMA, TABLE_NAME")
+	if err != nil {
+		return nil, err
+	}
+	names := []string{}
+	for rows.Next() {
+		var db, table string
+		if err := rows.Scan(&db, &table); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		name := db + "." + table
+		if Allowed(allowlist, name) {
+			names = append(names, name)
+			if len(names) >= MAX_TABLES {
+				break
+			}
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	tables := make(map[string]string)
+	for _, name := range names {
+		db, table := splitTable(name)
+		var create string
+		err := conn.QueryRow(fmt.Sprintf("SHOW CREATE TABLE `%s`.`%s`", db, table)).Scan(&table, &create)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				continue // dropped since listed
+			}
+			return nil, err
+		}
+		tables[name] = autoIncRe.ReplaceAllString(create, "")
+	}
+	return tables, nil
+}
+
+// Changes returns the tables created, altered, or dropped between the old and
+// new tables from GetTables, sorted by db.table.  Tables are compared by
+// checksum.
+func Changes(oldTables, newTables map[string]string) []Change {
+	names := []string{}
+	for name := range oldTables {
+		names = append(names, name)
+	}
+	for name := range newTables {
+		if _, ok := oldTables[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	changes := []Change{}
+	for _, name := range names {
+		oldCreate, inOld := oldTables[name]
+		newCreate, inNew := newTables[name]
+		db, table := splitTable(name)
+		c := Change{Db: db, Table: table, OldCreate: oldCreate, NewCreate: newCreate}
+		switch {
+		case !inOld:
+			c.Type = CHANGE_CREATE
+		case !inNew:
+			c.Type = CHANGE_DROP
+		case Checksum(oldCreate) != Checksum(newCreate):
+			c.Type = CHANGE_ALTER
+		default:
+			continue
+		}
+		changes = append(changes, c)
+	}
+	return changes
+}
+
+// Checksum returns the hex SHA256 of SHOW CREATE TABLE.
+func Checksum(create string) string {
+	sum := sha256.Sum256([]byte(create))
+	return hex.EncodeToString(sum[:])
+}
+
+// Allowed returns true if db.table matches a pattern in the allowlist.
+// Patterns are matched like path.Match, e.g. db.* or db.t_*.
+func Allowed(allowlist []string, name string) bool {
+	for _, pattern := range allowlist {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func splitTable(name string) (string, string) {
+	parts := strings.SplitN(name, ".", 2)
+	if len(parts) != 2 {
+		return "", ""
+	}
+	return parts[0], parts[1]
+}
@@ -0,0 +1,245 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package schema_test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/percona/cloud-protocol/proto/v1"
+	"github.com/percona/percona-agent/instance"
+	"github.com/percona/percona-agent/pct"
+	"github.com/percona/percona-agent/periodic"
+	"github.com/percona/percona-agent/schema"
+	"github.com/percona/percona-agent/test"
+	"github.com/percona/percona-agent/test/mock"
+	. "gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) { TestingT(t) }
+
+type ManagerTestSuite struct {
+	logChan       chan *proto.LogEntry
+	logger        *pct.Logger
+	tmpDir        string
+	repo          *instance.Repo
+	mysqlInstance proto.ServiceInstance
+}
+
+var _ = Suite(&ManagerTestSuite{})
+
+func (s *ManagerTestSuite) SetUpSuite(t *C) {
+	s.logChan = make(chan *proto.LogEntry, 100)
+	s.logger = pct.NewLogger(s.logChan, schema.SERVICE_NAME+"-manager-test")
+
+	var err error
+	s.tmpDir, err = ioutil.TempDir("/tmp", "agent-test")
+	t.Assert(err, IsNil)
+	if err := pct.Basedir.Init(s.tmpDir); err != nil {
+		t.Fatal(err)
+	}
+
+	s.repo = instance.NewRepo(pct.NewLogger(s.logChan, "im-test"), pct.Basedir.Dir("config"), nil)
+	data, err := json.Marshal(&proto.MySQLInstance{
+		Hostname: "db1",
+		DSN:      "user:pass@tcp(127.0.0.1:3306)/",
+	})
+	t.Assert(err, IsNil)
+	s.repo.Add("mysql", 1, data, false)
+	s.mysqlInstance = proto.ServiceInstance{Service: "mysql", InstanceId: 1}
+}
+
+func (s *ManagerTestSuite) SetUpTest(t *C) {
+	pct.Basedir.RemoveConfig(schema.SERVICE_NAME)
+}
+
+func (s *ManagerTestSuite) TearDownSuite(t *C) {
+	if err := os.RemoveAll(s.tmpDir); err != nil {
+		t.Error(err)
+	}
+}
+
+func (s *ManagerTestSuite) startCmd(t *C, config *schema.Config) *proto.Cmd {
+	data, err := json.Marshal(config)
+	t.Assert(err, IsNil)
+	return &proto.Cmd{
+		Service: schema.SERVICE_NAME,
+		Cmd:     "StartService",
+		Data:    data,
+	}
+}
+
+// --------------------------------------------------------------------------
+
+func (s *ManagerTestSuite) TestAllowed(t *C) {
+	allowlist := []string{"app.users", "shop.*", "log.t_*"}
+	t.Check(schema.Allowed(allowlist, "app.users"), Equals, true)
+	t.Check(schema.Allowed(allowlist, "app.orders"), Equals, false)
+	t.Check(schema.Allowed(allowlist, "shop.orders"), Equals, true)
+	t.Check(schema.Allowed(allowlist, "log.t_2015"), Equals, true)
+	t.Check(schema.Allowed(allowlist, "log.x_2015"), Equals, false)
+}
+
+func (s *ManagerTestSuite) TestChanges(t *C) {
+	oldTables := map[string]string{
+		"app.a": "CREATE TABLE `a` (`id` int)",
+		"app.b": "CREATE TABLE `b` (`id` int)",
+		"app.c": "CREATE TABLE `c` (`id` int)",
+	}
+	newTables := map[string]string{
+		"app.a": "CREATE TABLE `a` (`id` int)",
+		"app.b": "CREATE TABLE `b` (`id` bigint)",
+		"app.d": "CREATE TABLE `d` (`id` int)",
+	}
+	t.Check(schema.Changes(oldTables, oldTables), DeepEquals, []schema.Change{})
+	t.Check(schema.Changes(oldTables, newTables), DeepEquals, []schema.Change{
+		{Db: "app", Table: "b", Type: schema.CHANGE_ALTER, OldCreate: oldTables["app.b"], NewCreate: newTables["app.b"]},
+		{Db: "app", Table: "c", Type: schema.CHANGE_DROP, OldCreate: oldTables["app.c"]},
+		{Db: "app", Table: "d", Type: schema.CHANGE_CREATE, NewCreate: newTables["app.d"]},
+	})
+}
+
+// fakeTables makes fake return the tables, db.table => SHOW CREATE TABLE.
+func fakeTables(fake *mock.FakeMySQL, tables [][]string) {
+	names := [][]interface{}{}
+	for _, t := range tables {
+		db, table := t[0], t[1]
+		names = append(names, []interface{}{db, table})
+		fake.OnQuery("SHOW CREATE TABLE `"+db+"`.`"+table+"`").Rows(
+			[]string{"Table", "Create Table"},
+			[][]interface{}{{table, t[2]}},
+		)
+	}
+	fake.OnQuery("FROM information_schema.TABLES").Rows([]string{"TABLE_SCHEMA", "TABLE_NAME"}, names)
+}
+
+func (s *ManagerTestSuite) TestGetTables(t *C) {
+	fake := mock.NewFakeMySQL()
+	fakeTables(fake, [][]string{
+		{"app", "t1", "CREATE TABLE `t1` (`id` int) ENGINE=InnoDB AUTO_INCREMENT=5 DEFAULT CHARSET=utf8"},
+		{"app", "t2", "CREATE TABLE `t2` (`id` int) ENGINE=InnoDB DEFAULT CHARSET=utf8"},
+		{"log", "t3", "CREATE TABLE `t3` (`id` int) ENGINE=InnoDB DEFAULT CHARSET=utf8"},
+	})
+
+	// Only allowed tables, and AUTO_INCREMENT is removed because inserts
+	// change it but not the table.
+	tables, err := schema.GetTables(fake.DB(), []string{"app.*"})
+	t.Assert(err, IsNil)
+	t.Check(tables, DeepEquals, map[string]string{
+		"app.t1": "CREATE TABLE `t1` (`id` int) ENGINE=InnoDB DEFAULT CHARSET=utf8",
+		"app.t2": "CREATE TABLE `t2` (`id` int) ENGINE=InnoDB DEFAULT CHARSET=utf8",
+	})
+	t.Check(fake.Queries(), HasLen, 3)
+}
+
+func (s *ManagerTestSuite) TestStartService(t *C) {
+	fake := mock.NewFakeMySQL()
+	m := schema.NewManager(s.logger, mock.NewClock(), mock.NewSpooler(nil), s.repo, &mock.ConnectionFactory{Conn: fake})
+	err := m.Start()
+	t.Assert(err, IsNil)
+	defer m.Stop()
+
+	// No config, so nothing to check.
+	configs, errs := m.GetConfig()
+	t.Check(errs, HasLen, 0)
+	t.Check(configs, HasLen, 0)
+
+	// Tables are required.
+	config := &schema.Config{
+		Config: periodic.Config{ServiceInstance: s.mysqlInstance},
+	}
+	reply := m.Handle(s.startCmd(t, config))
+	t.Check(reply.Error, Not(Equals), "")
+
+	config.Tables = []string{"app.*"}
+	reply = m.Handle(s.startCmd(t, config))
+	t.Assert(reply.Error, Equals, "")
+
+	// Config is saved with the default interval.
+	saved := &schema.Config{}
+	err = pct.Basedir.ReadConfig(schema.SERVICE_NAME, saved)
+	t.Assert(err, IsNil)
+	t.Check(saved.Interval, Equals, uint(schema.DEFAULT_INTERVAL))
+	t.Check(saved.Tables, DeepEquals, config.Tables)
+
+	configs, errs = m.GetConfig()
+	t.Check(errs, HasLen, 0)
+	t.Assert(configs, HasLen, 1)
+	t.Check(configs[0].Running, Equals, true)
+
+	reply = m.Handle(&proto.Cmd{Service: schema.SERVICE_NAME, Cmd: "StopService"})
+	t.Check(reply.Error, Equals, "")
+	t.Check(pct.Basedir.ConfigExists(schema.SERVICE_NAME), Equals, false)
+}
+
+func (s *ManagerTestSuite) TestReport(t *C) {
+	fake := mock.NewFakeMySQL()
+	names := fake.OnQuery("FROM information_schema.TABLES").Rows(
+		[]string{"TABLE_SCHEMA", "TABLE_NAME"},
+		[][]interface{}{{"app", "t1"}},
+	)
+	fake.OnQuery("SHOW CREATE TABLE `app`.`t1`").Rows(
+		[]string{"Table", "Create Table"},
+		[][]interface{}{{"t1", "CREATE TABLE `t1` (`id` int)"}},
+	)
+	fake.OnQuery("SHOW CREATE TABLE `app`.`t2`").Rows(
+		[]string{"Table", "Create Table"},
+		[][]interface{}{{"t2", "CREATE TABLE `t2` (`id` int)"}},
+	)
+	clock := mock.NewClock()
+	dataChan := make(chan interface{}, 1)
+	m := schema.NewManager(s.logger, clock, mock.NewSpooler(dataChan), s.repo, &mock.ConnectionFactory{Conn: fake})
+	err := m.Start()
+	t.Assert(err, IsNil)
+	defer m.Stop()
+
+	config := &schema.Config{
+		Config: periodic.Config{ServiceInstance: s.mysqlInstance},
+		Tables: []string{"app.*"},
+	}
+	reply := m.Handle(s.startCmd(t, config))
+	t.Assert(reply.Error, Equals, "")
+	t.Check(clock.Added, DeepEquals, []uint{schema.DEFAULT_INTERVAL})
+	t.Assert(clock.Chans, HasLen, 1)
+
+	// The first check is the baseline, so there's no report.
+	t0 := time.Date(2015, 6, 1, 12, 0, 0, 0, time.UTC)
+	clock.Chans[0] <- t0
+	ok := test.WaitStatusPrefix(1, m, schema.SERVICE_NAME, "Checked 1 tables")
+	t.Assert(ok, Equals, true)
+	t.Check(dataChan, HasLen, 0)
+
+	// A table created since the baseline is reported.
+	names.Rows(
+		[]string{"TABLE_SCHEMA", "TABLE_NAME"},
+		[][]interface{}{{"app", "t1"}, {"app", "t2"}},
+	)
+	clock.Chans[0] <- t0.Add(time.Hour)
+	got := test.WaitData(dataChan)
+	t.Assert(got, HasLen, 1)
+	t.Check(got[0], DeepEquals, &schema.Report{
+		ServiceInstance: s.mysqlInstance,
+		Ts:              t0.Add(time.Hour).Unix(),
+		Changes: []schema.Change{
+			{Db: "app", Table: "t2", Type: schema.CHANGE_CREATE, NewCreate: "CREATE TABLE `t2` (`id` int)"},
+		},
+	})
+}
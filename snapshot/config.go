@@ -0,0 +1,50 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package snapshot
+
+const (
+	LOCK_AUTO         = "auto"         // backup locks if available, else FTWRL
+	LOCK_FTWRL        = "ftwrl"        // FLUSH TABLES WITH READ LOCK
+	LOCK_BACKUP_LOCKS = "backup_locks" // LOCK TABLES FOR BACKUP, LOCK BINLOG FOR BACKUP
+	LOCK_NONE         = "none"         // do not quiesce MySQL
+)
+
+const (
+	DEFAULT_LOCK_TIMEOUT   = 30  // seconds
+	DEFAULT_SCRIPT_TIMEOUT = 300 // seconds
+)
+
+// Config is read only from the local config file (config/snapshot.conf),
+// never from the API, because Script is executed by the agent.
+type Config struct {
+	Script        string // called with the instance name and datadir while MySQL is locked
+	LockMethod    string // auto (default), ftwrl, backup_locks, none
+	LockTimeout   uint   // seconds, lock_wait_timeout when acquiring the lock
+	ScriptTimeout uint   // seconds, Script is killed if it runs longer
+}
+
+// Result of a Snapshot cmd.  Times are seconds.  The lock is always released,
+// even if Script fails, so UnlockTime is set whenever LockTime is.
+type Result struct {
+	LockMethod string
+	LockTime   float64 // acquiring the lock
+	ScriptTime float64
+	UnlockTime float64
+	LockedTime float64 // total time MySQL was locked
+	Output     string  // Script stdout
+}
@@ -0,0 +1,308 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package snapshot
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/percona/cloud-protocol/proto/v1"
+	"github.com/percona/percona-agent/instance"
+	"github.com/percona/percona-agent/mysql"
+	"github.com/percona/percona-agent/pct"
+	pctCmd "github.com/percona/percona-agent/pct/cmd"
+)
+
+const (
+	SERVICE_NAME = "snapshot"
+)
+
+// Manager coordinates filesystem snapshots (LVM, EBS, etc.) of a MySQL
+// instance: it quiesces MySQL, runs the user-provided snapshot script,
+// then releases MySQL, reporting how long each step took.
+type Manager struct {
+	logger       *pct.Logger
+	instanceRepo *instance.Repo
+	connFactory  mysql.ConnectionFactory
+	// --
+	config  *Config
+	running bool
+	sync.Mutex
+	status *pct.Status
+}
+
+func NewManager(logger *pct.Logger, instanceRepo *instance.Repo, connFactory mysql.ConnectionFactory) *Manager {
+	m := &Manager{
+		logger:       logger,
+		instanceRepo: instanceRepo,
+		connFactory:  connFactory,
+		// --
+		config: &Config{},
+		status: pct.NewStatus([]string{SERVICE_NAME}),
+	}
+	return m
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Interface
+/////////////////////////////////////////////////////////////////////////////
+
+func (m *Manager) Start() error {
+	m.Lock()
+	defer m.Unlock()
+	if m.running {
+		return pct.ServiceIsRunningError{Service: SERVICE_NAME}
+	}
+
+	// Load config from disk.  It's ok if there's no config: the service
+	// runs but Snapshot cmds fail until a script is configured.
+	config := &Config{}
+	if err := pct.Basedir.ReadConfig(SERVICE_NAME, config); err != nil {
+		if !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if err := validateConfig(config); err != nil {
+		return err
+	}
+	m.config = config
+
+	m.running = true
+	m.logger.Info("Started")
+	m.status.Update(SERVICE_NAME, "Idle")
+	return nil
+}
+
+func (m *Manager) Stop() error {
+	m.Lock()
+	defer m.Unlock()
+	if !m.running {
+		return nil
+	}
+	m.running = false
+	m.logger.Info("Stopped")
+	m.status.Update(SERVICE_NAME, "Stopped")
+	return nil
+}
+
+func (m *Manager) Handle(cmd *proto.Cmd) *proto.Reply {
+	// The lock also serializes snapshots: only one at a time.
+	m.Lock()
+	defer m.Unlock()
+
+	if !m.running {
+		return cmd.Reply(nil, pct.ServiceIsNotRunningError{Service: SERVICE_NAME})
+	}
+
+	m.status.UpdateRe(SERVICE_NAME, "Handling", cmd)
+	defer m.status.Update(SERVICE_NAME, "Idle")
+
+	switch cmd.Cmd {
+	case "Snapshot":
+		return m.snapshot(cmd)
+	default:
+		return cmd.Reply(nil, pct.UnknownCmdError{Cmd: cmd.Cmd})
+	}
+}
+
+func (m *Manager) Status() map[string]string {
+	return m.status.All()
+}
+
+func (m *Manager) GetConfig() ([]proto.AgentConfig, []error) {
+	m.Lock()
+	defer m.Unlock()
+	bytes, err := json.Marshal(m.config)
+	if err != nil {
+		return nil, []error{err}
+	}
+	config := proto.AgentConfig{
+		InternalService: SERVICE_NAME,
+		Config:          string(bytes),
+		Running:         m.running,
+	}
+	return []proto.AgentConfig{config}, nil
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Implementation
+/////////////////////////////////////////////////////////////////////////////
+
+func validateConfig(config *Config) error {
+	switch config.LockMethod {
+	case "":
+		config.LockMethod = LOCK_AUTO
+	case LOCK_AUTO, LOCK_FTWRL, LOCK_BACKUP_LOCKS, LOCK_NONE:
+	default:
+		return fmt.Errorf("Invalid LockMethod: %s; expected %s, %s, %s, or %s",
+			config.LockMethod, LOCK_AUTO, LOCK_FTWRL, LOCK_BACKUP_LOCKS, LOCK_NONE)
+	}
+	if config.LockTimeout == 0 {
+		config.LockTimeout = DEFAULT_LOCK_TIMEOUT
+	}
+	if config.ScriptTimeout == 0 {
+		config.ScriptTimeout = DEFAULT_SCRIPT_TIMEOUT
+	}
+	return nil
+}
+
+func (m *Manager) snapshot(cmd *proto.Cmd) *proto.Reply {
+	m.logger.Debug("snapshot:call")
+	defer m.logger.Debug("snapshot:return")
+
+	if m.config.Script == "" {
+		return cmd.Reply(nil, fmt.Errorf("No snapshot script, set Script in %s", pct.Basedir.ConfigFile(SERVICE_NAME)))
+	}
+
+	si := &proto.ServiceInstance{}
+	if err := json.Unmarshal(cmd.Data, si); err != nil {
+		return cmd.Reply(nil, err)
+	}
+	if si.Service != "mysql" {
+		return cmd.Reply(nil, pct.UnknownServiceInstanceError{Service: si.Service, Id: si.InstanceId})
+	}
+
+	// Connect to MySQL.
+	mysqlIt := &proto.MySQLInstance{}
+	if err := m.instanceRepo.Get(si.Service, si.InstanceId, mysqlIt); err != nil {
+		return cmd.Reply(nil, err)
+	}
+	conn := m.connFactory.Make(mysqlIt.DSN)
+	if err := conn.Connect(1); err != nil {
+		return cmd.Reply(nil, fmt.Errorf("Cannot connect to MySQL: %s", err))
+	}
+	// Closing the connection releases the lock if unlocking fails.
+	defer conn.Close()
+
+	// Locks belong to the session, so lock, unlock, and everything between
+	// must use the same connection, not any connection in the pool.
+	db := conn.DB()
+	db.SetMaxOpenConns(1)
+
+	name := m.instanceRepo.Name(si.Service, si.InstanceId)
+	dataDir := conn.GetGlobalVarString("datadir")
+
+	result := &Result{
+		LockMethod: m.config.LockMethod,
+	}
+	if result.LockMethod == LOCK_AUTO {
+		if conn.GetGlobalVarString("have_backup_locks") == "YES" {
+			result.LockMethod = LOCK_BACKUP_LOCKS
+		} else {
+			result.LockMethod = LOCK_FTWRL
+		}
+	}
+
+	m.status.Update(SERVICE_NAME, fmt.Sprintf("Locking %s (%s)", name, result.LockMethod))
+	t0 := time.Now()
+	if err := lock(db, result.LockMethod, m.config.LockTimeout); err != nil {
+		unlock(db, result.LockMethod) // release partial lock, e.g. tables but not binlog
+		return cmd.Reply(result, fmt.Errorf("Cannot lock MySQL: %s", err))
+	}
+	t1 := time.Now()
+	result.LockTime = t1.Sub(t0).Seconds()
+
+	m.status.Update(SERVICE_NAME, fmt.Sprintf("Running %s for %s", m.config.Script, name))
+	script := pctCmd.NewRealCmd(m.config.Script, name, dataDir)
+	script.Timeout = time.Duration(m.config.ScriptTimeout) * time.Second
+	output, scriptErr := script.Run()
+	t2 := time.Now()
+	result.ScriptTime = t2.Sub(t1).Seconds()
+	result.Output = output
+
+	// Always unlock, even if the script failed.
+	m.status.Update(SERVICE_NAME, fmt.Sprintf("Unlocking %s (%s)", name, result.LockMethod))
+	unlockErr := unlock(db, result.LockMethod)
+	t3 := time.Now()
+	result.UnlockTime = t3.Sub(t2).Seconds()
+	result.LockedTime = t3.Sub(t1).Seconds()
+
+	errs := []error{}
+	if scriptErr != nil {
+		errs = append(errs, fmt.Errorf("%s failed: %s", m.config.Script, scriptErr))
+	}
+	if unlockErr != nil {
+		errs = append(errs, fmt.Errorf("Cannot unlock MySQL: %s", unlockErr))
+	}
+
+	msg := fmt.Sprintf("Snapshot of %s: lock %.3fs, script %.3fs, unlock %.3fs, locked %.3fs",
+		name, result.LockTime, result.ScriptTime, result.UnlockTime, result.LockedTime)
+	if len(errs) > 0 {
+		m.logger.Warn(fmt.Sprintf("%s, errors: %v", msg, errs))
+	} else {
+		m.logger.Info(msg)
+	}
+
+	return cmd.Reply(result, errs...)
+}
+
+func lock(db *sql.DB, method string, timeout uint) error {
+	var queries []string
+	switch method {
+	case LOCK_FTWRL:
+		queries = []string{
+			"FLUSH TABLES WITH READ LOCK",
+		}
+	case LOCK_BACKUP_LOCKS:
+		queries = []string{
+			"LOCK TABLES FOR BACKUP",
+			"LOCK BINLOG FOR BACKUP",
+		}
+	default:
+		return nil
+	}
+	// Don't wait forever on long-running queries or DDL.
+	if _, err := db.Exec(fmt.Sprintf("SET SESSION lock_wait_timeout=%d", timeout)); err != nil {
+		return err
+	}
+	for _, query := range queries {
+		if _, err := db.Exec(query); err != nil {
+			return fmt.Errorf("%s: %s", query, err)
+		}
+	}
+	return nil
+}
+
+func unlock(db *sql.DB, method string) error {
+	var queries []string
+	switch method {
+	case LOCK_FTWRL:
+		queries = []string{
+			"UNLOCK TABLES",
+		}
+	case LOCK_BACKUP_LOCKS:
+		queries = []string{
+			"UNLOCK BINLOG",
+			"UNLOCK TABLES",
+		}
+	default:
+		return nil
+	}
+	// Try every query so as much as possible is unlocked.
+	var firstErr error
+	for _, query := range queries {
+		if _, err := db.Exec(query); err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("%s: %s", query, err)
+		}
+	}
+	return firstErr
+}
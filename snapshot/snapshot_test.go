@@ -0,0 +1,180 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package snapshot_test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/percona/cloud-protocol/proto/v1"
+	"github.com/percona/percona-agent/instance"
+	"github.com/percona/percona-agent/mysql"
+	"github.com/percona/percona-agent/pct"
+	"github.com/percona/percona-agent/snapshot"
+	. "gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) { TestingT(t) }
+
+type ManagerTestSuite struct {
+	logChan       chan *proto.LogEntry
+	logger        *pct.Logger
+	tmpDir        string
+	dsn           string
+	repo          *instance.Repo
+	mysqlInstance proto.ServiceInstance
+}
+
+var _ = Suite(&ManagerTestSuite{})
+
+func (s *ManagerTestSuite) SetUpSuite(t *C) {
+	s.dsn = os.Getenv("PCT_TEST_MYSQL_DSN")
+	if s.dsn == "" {
+		t.Fatal("PCT_TEST_MYSQL_DSN is not set")
+	}
+
+	s.logChan = make(chan *proto.LogEntry, 100)
+	s.logger = pct.NewLogger(s.logChan, snapshot.SERVICE_NAME+"-manager-test")
+
+	var err error
+	s.tmpDir, err = ioutil.TempDir("/tmp", "agent-test")
+	t.Assert(err, IsNil)
+
+	if err := pct.Basedir.Init(s.tmpDir); err != nil {
+		t.Fatal(err)
+	}
+
+	s.repo = instance.NewRepo(pct.NewLogger(s.logChan, "im-test"), pct.Basedir.Dir("config"), nil)
+	data, err := json.Marshal(&proto.MySQLInstance{
+		Hostname: "db1",
+		DSN:      s.dsn,
+	})
+	t.Assert(err, IsNil)
+	s.repo.Add("mysql", 1, data, false)
+	s.mysqlInstance = proto.ServiceInstance{Service: "mysql", InstanceId: 1}
+}
+
+func (s *ManagerTestSuite) SetUpTest(t *C) {
+	pct.Basedir.RemoveConfig(snapshot.SERVICE_NAME)
+}
+
+func (s *ManagerTestSuite) TearDownSuite(t *C) {
+	if err := os.RemoveAll(s.tmpDir); err != nil {
+		t.Error(err)
+	}
+}
+
+func (s *ManagerTestSuite) writeScript(t *C, content string) string {
+	script := filepath.Join(s.tmpDir, "snapshot.sh")
+	err := ioutil.WriteFile(script, []byte("#!/bin/sh\n"+content+"\n"), 0755)
+	t.Assert(err, IsNil)
+	return script
+}
+
+func (s *ManagerTestSuite) snapshotCmd(t *C) *proto.Cmd {
+	data, err := json.Marshal(s.mysqlInstance)
+	t.Assert(err, IsNil)
+	return &proto.Cmd{
+		Service: snapshot.SERVICE_NAME,
+		Cmd:     "Snapshot",
+		Data:    data,
+	}
+}
+
+// --------------------------------------------------------------------------
+
+func (s *ManagerTestSuite) TestInvalidConfig(t *C) {
+	err := pct.Basedir.WriteConfig(snapshot.SERVICE_NAME, &snapshot.Config{LockMethod: "foo"})
+	t.Assert(err, IsNil)
+
+	m := snapshot.NewManager(s.logger, s.repo, &mysql.RealConnectionFactory{})
+	err = m.Start()
+	t.Check(err, NotNil)
+}
+
+func (s *ManagerTestSuite) TestNoScript(t *C) {
+	m := snapshot.NewManager(s.logger, s.repo, &mysql.RealConnectionFactory{})
+	err := m.Start()
+	t.Assert(err, IsNil)
+	defer m.Stop()
+
+	reply := m.Handle(s.snapshotCmd(t))
+	t.Check(reply.Error, Not(Equals), "")
+}
+
+func (s *ManagerTestSuite) TestSnapshot(t *C) {
+	script := s.writeScript(t, `echo "$1 $2"`)
+	config := &snapshot.Config{
+		Script:     script,
+		LockMethod: snapshot.LOCK_FTWRL,
+	}
+	err := pct.Basedir.WriteConfig(snapshot.SERVICE_NAME, config)
+	t.Assert(err, IsNil)
+
+	m := snapshot.NewManager(s.logger, s.repo, &mysql.RealConnectionFactory{})
+	err = m.Start()
+	t.Assert(err, IsNil)
+	defer m.Stop()
+
+	reply := m.Handle(s.snapshotCmd(t))
+	t.Assert(reply.Error, Equals, "")
+
+	result := &snapshot.Result{}
+	err = json.Unmarshal(reply.Data, result)
+	t.Assert(err, IsNil)
+	t.Check(result.LockMethod, Equals, snapshot.LOCK_FTWRL)
+	t.Check(strings.HasPrefix(result.Output, "mysql-1 /"), Equals, true)
+	t.Check(result.LockedTime >= result.ScriptTime, Equals, true)
+
+	status := m.Status()
+	t.Check(status[snapshot.SERVICE_NAME], Equals, "Idle")
+}
+
+func (s *ManagerTestSuite) TestScriptFails(t *C) {
+	script := s.writeScript(t, "exit 1")
+	err := pct.Basedir.WriteConfig(snapshot.SERVICE_NAME, &snapshot.Config{Script: script})
+	t.Assert(err, IsNil)
+
+	m := snapshot.NewManager(s.logger, s.repo, &mysql.RealConnectionFactory{})
+	err = m.Start()
+	t.Assert(err, IsNil)
+	defer m.Stop()
+
+	// The error is reported but MySQL is still locked and unlocked.
+	reply := m.Handle(s.snapshotCmd(t))
+	t.Check(reply.Error, Not(Equals), "")
+
+	result := &snapshot.Result{}
+	err = json.Unmarshal(reply.Data, result)
+	t.Assert(err, IsNil)
+	t.Check(result.LockMethod, Not(Equals), snapshot.LOCK_AUTO)
+	t.Check(result.LockedTime > 0, Equals, true)
+
+	// And another snapshot can be taken.
+	err = pct.Basedir.WriteConfig(snapshot.SERVICE_NAME, &snapshot.Config{Script: s.writeScript(t, "true")})
+	t.Assert(err, IsNil)
+	m.Stop()
+	err = m.Start()
+	t.Assert(err, IsNil)
+	reply = m.Handle(s.snapshotCmd(t))
+	t.Check(reply.Error, Equals, "")
+}
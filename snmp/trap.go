@@ -0,0 +1,373 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+// Package snmp sends SNMPv2c traps for a few critical agent events, e.g. MySQL
+// restarts, for NOC tooling that is SNMP-based.  Like webhook.Sink, a Sender
+// subscribes to bus topics and sends a trap for each event.
+package snmp
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/percona/percona-agent/bus"
+	"github.com/percona/percona-agent/pct"
+)
+
+const (
+	DEFAULT_PORT      = "162"
+	DEFAULT_COMMUNITY = "public"
+	SEND_TIMEOUT      = 5 * time.Second
+)
+
+// DEFAULT_ENTERPRISE_OID is the default Config.EnterpriseOID.  Set it to the
+// OID of the NOC's MIB for the agent.
+const DEFAULT_ENTERPRISE_OID = "1.3.6.1.4.1.20328.1"
+
+// Traps are EnterpriseOID.0.N where N is the trap number of the event topic.
+// Only these topics are critical enough for a trap.
+var TRAPS = map[string]int{
+	bus.MYSQL_RESTART:       1, // MySQL restart detected
+	bus.REPLICATION_STOPPED: 2, // replica IO or SQL thread stopped
+	bus.SERVICE_RESTART:     3, // agent degraded: a crashed service was restarted
+}
+
+// Trap objects are EnterpriseOID.1.N, all OCTET STRING.
+const (
+	OBJECT_HOSTNAME   = 1
+	OBJECT_AGENT_UUID = 2
+	OBJECT_SOURCE     = 3
+	OBJECT_MESSAGE    = 4 // event data as text
+)
+
+// Standard SNMPv2-MIB objects in every trap.
+const (
+	OID_SYS_UPTIME    = "1.3.6.1.2.1.1.3.0"
+	OID_SNMP_TRAP_OID = "1.3.6.1.6.3.1.1.4.1.0"
+)
+
+type Config struct {
+	Target        string   // host[:port], default port DEFAULT_PORT
+	Community     string   `json:",omitempty"` // default DEFAULT_COMMUNITY
+	EnterpriseOID string   `json:",omitempty"` // default DEFAULT_ENTERPRISE_OID
+	Topics        []string `json:",omitempty"` // bus topics in TRAPS to send, default all
+}
+
+type Sender struct {
+	logger    *pct.Logger
+	config    Config
+	hostname  string
+	agentUuid string
+	// --
+	started   time.Time // sysUpTime is relative to this
+	requestId int32
+	mux       *sync.Mutex // guards requestId
+}
+
+func NewSender(logger *pct.Logger, config Config, hostname, agentUuid string) (*Sender, error) {
+	if err := ValidateConfig(&config); err != nil {
+		return nil, err
+	}
+	s := &Sender{
+		logger:    logger,
+		config:    config,
+		hostname:  hostname,
+		agentUuid: agentUuid,
+		// --
+		started: time.Now(),
+		mux:     &sync.Mutex{},
+	}
+	return s, nil
+}
+
+// ValidateConfig returns an error if the Target, EnterpriseOID, or Topics are
+// invalid, and sets the defaults.
+func ValidateConfig(config *Config) error {
+	if config.Target == "" {
+		return errors.New("SNMP trap target is not set")
+	}
+	if _, _, err := net.SplitHostPort(config.Target); err != nil {
+		config.Target = net.JoinHostPort(config.Target, DEFAULT_PORT)
+	}
+	if config.Community == "" {
+		config.Community = DEFAULT_COMMUNITY
+	}
+	if config.EnterpriseOID == "" {
+		config.EnterpriseOID = DEFAULT_ENTERPRISE_OID
+	}
+	if _, err := encodeOID(config.EnterpriseOID); err != nil {
+		return fmt.Errorf("Invalid SNMP enterprise OID: %s", err)
+	}
+	if len(config.Topics) == 0 {
+		for topic := range TRAPS {
+			config.Topics = append(config.Topics, topic)
+		}
+	}
+	for _, topic := range config.Topics {
+		if _, ok := TRAPS[topic]; !ok {
+			return fmt.Errorf("Invalid SNMP trap topic: %s", topic)
+		}
+	}
+	return nil
+}
+
+// Run sends traps for events of the topics until stopChan is closed.
+func (s *Sender) Run(b *bus.Bus, stopChan chan struct{}) {
+	defer func() {
+		if err := recover(); err != nil {
+			s.logger.Error("SNMP trap sender crashed: ", err)
+		}
+	}()
+	events := make(chan bus.Event, bus.SUBSCRIPTION_SIZE)
+	for _, topic := range s.config.Topics {
+		sub := b.Subscribe(topic, 0)
+		defer sub.Cancel()
+		go func(sub *bus.Subscription) {
+			for {
+				select {
+				case e := <-sub.C:
+					select {
+					case events <- e:
+					default:
+						s.logger.Warn("SNMP trap sender busy, dropped " + e.Topic + " event")
+					}
+				case <-stopChan:
+					return
+				}
+			}
+		}(sub)
+	}
+	for {
+		select {
+		case e := <-events:
+			if err := s.Send(e); err != nil {
+				s.logger.Warn("SNMP trap:", err)
+			}
+		case <-stopChan:
+			return
+		}
+	}
+}
+
+// Send sends a trap for the event.  Traps are UDP, so there's no error if
+// the target doesn't receive it.
+func (s *Sender) Send(e bus.Event) error {
+	packet, err := s.Packet(e)
+	if err != nil {
+		return err
+	}
+	conn, err := net.DialTimeout("udp", s.config.Target, SEND_TIMEOUT)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetWriteDeadline(time.Now().Add(SEND_TIMEOUT))
+	if _, err := conn.Write(packet); err != nil {
+		return err
+	}
+	s.logger.Debug("Sent " + e.Topic + " trap")
+	return nil
+}
+
+// Packet returns the SNMPv2c Trap message for the event.
+func (s *Sender) Packet(e bus.Event) ([]byte, error) {
+	trap, ok := TRAPS[e.Topic]
+	if !ok {
+		return nil, fmt.Errorf("No SNMP trap for %s events", e.Topic)
+	}
+	s.mux.Lock()
+	s.requestId++
+	if s.requestId < 0 {
+		s.requestId = 1
+	}
+	requestId := s.requestId
+	s.mux.Unlock()
+
+	enterprise := s.config.EnterpriseOID
+	uptime := uint32(time.Since(s.started) / (10 * time.Millisecond)) // TimeTicks are 1/100 s
+	varbinds := []varbind{
+		{OID_SYS_UPTIME, timeTicks(uptime)},
+		{OID_SNMP_TRAP_OID, oid(fmt.Sprintf("%s.0.%d", enterprise, trap))},
+		{objectOID(enterprise, OBJECT_HOSTNAME), octetString(s.hostname)},
+		{objectOID(enterprise, OBJECT_AGENT_UUID), octetString(s.agentUuid)},
+		{objectOID(enterprise, OBJECT_SOURCE), octetString(e.Source)},
+		{objectOID(enterprise, OBJECT_MESSAGE), octetString(message(e.Data))},
+	}
+	var vbs []byte
+	for _, vb := range varbinds {
+		name, err := encodeOID(vb.oid)
+		if err != nil {
+			return nil, err
+		}
+		value, err := vb.value.encode()
+		if err != nil {
+			return nil, err
+		}
+		vbs = append(vbs, tlv(TAG_SEQUENCE, append(name, value...))...)
+	}
+
+	var pdu []byte
+	pdu = append(pdu, encodeInteger(int64(requestId))...)
+	pdu = append(pdu, encodeInteger(0)...) // error-status
+	pdu = append(pdu, encodeInteger(0)...) // error-index
+	pdu = append(pdu, tlv(TAG_SEQUENCE, vbs)...)
+
+	var msg []byte
+	msg = append(msg, encodeInteger(VERSION_2C)...)
+	msg = append(msg, tlv(TAG_OCTET_STRING, []byte(s.config.Community))...)
+	msg = append(msg, tlv(TAG_TRAP_V2, pdu)...)
+	return tlv(TAG_SEQUENCE, msg), nil
+}
+
+// message returns the event data as text: strings and fmt.Stringers as is,
+// else as JSON.
+func message(data interface{}) string {
+	switch v := data.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case fmt.Stringer:
+		return v.String()
+	}
+	bytes, err := json.Marshal(data)
+	if err != nil {
+		return fmt.Sprintf("%v", data)
+	}
+	return string(bytes)
+}
+
+func objectOID(enterprise string, object int) string {
+	return enterprise + ".1." + strconv.Itoa(object)
+}
+
+// --------------------------------------------------------------------------
+// BER encoding, only what traps need
+// --------------------------------------------------------------------------
+
+const VERSION_2C = 1
+
+const (
+	TAG_INTEGER      = 0x02
+	TAG_OCTET_STRING = 0x04
+	TAG_OID          = 0x06
+	TAG_SEQUENCE     = 0x30
+	TAG_TIMETICKS    = 0x43
+	TAG_TRAP_V2      = 0xA7
+)
+
+type varbind struct {
+	oid   string
+	value value
+}
+
+type value interface {
+	encode() ([]byte, error)
+}
+
+type octetString string
+
+func (v octetString) encode() ([]byte, error) {
+	return tlv(TAG_OCTET_STRING, []byte(v)), nil
+}
+
+type oid string
+
+func (v oid) encode() ([]byte, error) {
+	return encodeOID(string(v))
+}
+
+type timeTicks uint32
+
+func (v timeTicks) encode() ([]byte, error) {
+	// Unsigned, so add a leading zero if the high bit is set.
+	b := []byte{byte(v >> 24), byte(v >> 16), byte(v >> 8), byte(v)}
+	for len(b) > 1 && b[0] == 0 && b[1]&0x80 == 0 {
+		b = b[1:]
+	}
+	if b[0]&0x80 != 0 {
+		b = append([]byte{0}, b...)
+	}
+	return tlv(TAG_TIMETICKS, b), nil
+}
+
+func tlv(tag byte, value []byte) []byte {
+	b := []byte{tag}
+	b = append(b, encodeLength(len(value))...)
+	return append(b, value...)
+}
+
+func encodeLength(n int) []byte {
+	if n < 0x80 {
+		return []byte{byte(n)}
+	}
+	var b []byte
+	for ; n > 0; n >>= 8 {
+		b = append([]byte{byte(n)}, b...)
+	}
+	return append([]byte{0x80 | byte(len(b))}, b...)
+}
+
+func encodeInteger(n int64) []byte {
+	// Minimal two's complement.
+	b := []byte{}
+	for i := 7; i >= 0; i-- {
+		b = append(b, byte(n>>(uint(i)*8)))
+	}
+	for len(b) > 1 && ((b[0] == 0 && b[1]&0x80 == 0) || (b[0] == 0xFF && b[1]&0x80 != 0)) {
+		b = b[1:]
+	}
+	return tlv(TAG_INTEGER, b)
+}
+
+func encodeOID(s string) ([]byte, error) {
+	parts := strings.Split(strings.TrimPrefix(s, "."), ".")
+	if len(parts) < 2 {
+		return nil, fmt.Errorf("%s: expected at least 2 numbers", s)
+	}
+	ids := make([]uint64, len(parts))
+	for i, p := range parts {
+		id, err := strconv.ParseUint(p, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", s, err)
+		}
+		ids[i] = id
+	}
+	if ids[0] > 2 || (ids[0] < 2 && ids[1] > 39) {
+		return nil, fmt.Errorf("%s: invalid first numbers", s)
+	}
+	b := encodeSubId(ids[0]*40 + ids[1])
+	for _, id := range ids[2:] {
+		b = append(b, encodeSubId(id)...)
+	}
+	return tlv(TAG_OID, b), nil
+}
+
+// encodeSubId encodes base 128, high bit set on all but the last byte.
+func encodeSubId(id uint64) []byte {
+	b := []byte{byte(id & 0x7F)}
+	for id >>= 7; id > 0; id >>= 7 {
+		b = append([]byte{byte(id&0x7F) | 0x80}, b...)
+	}
+	return b
+}
@@ -0,0 +1,117 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package snmp_test
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/percona/cloud-protocol/proto/v1"
+	"github.com/percona/percona-agent/bus"
+	"github.com/percona/percona-agent/pct"
+	"github.com/percona/percona-agent/snmp"
+	. "gopkg.in/check.v1"
+)
+
+// Hook up gocheck into the "go test" runner.
+func Test(t *testing.T) { TestingT(t) }
+
+type SnmpTestSuite struct {
+	logChan chan *proto.LogEntry
+	logger  *pct.Logger
+}
+
+var _ = Suite(&SnmpTestSuite{})
+
+func (s *SnmpTestSuite) SetUpSuite(t *C) {
+	s.logChan = make(chan *proto.LogEntry, 100)
+	s.logger = pct.NewLogger(s.logChan, "snmp-test")
+}
+
+func (s *SnmpTestSuite) TestValidateConfig(t *C) {
+	config := snmp.Config{}
+	t.Check(snmp.ValidateConfig(&config), NotNil)
+
+	config = snmp.Config{Target: "nms.example.com"}
+	t.Assert(snmp.ValidateConfig(&config), IsNil)
+	t.Check(config.Target, Equals, "nms.example.com:162")
+	t.Check(config.Community, Equals, snmp.DEFAULT_COMMUNITY)
+	t.Check(config.EnterpriseOID, Equals, snmp.DEFAULT_ENTERPRISE_OID)
+	t.Check(config.Topics, HasLen, len(snmp.TRAPS))
+
+	config = snmp.Config{Target: "10.0.0.1:1162", EnterpriseOID: "1.3.6.x"}
+	t.Check(snmp.ValidateConfig(&config), NotNil)
+
+	config = snmp.Config{Target: "10.0.0.1:1162", Topics: []string{bus.CONFIG_CHANGED}}
+	t.Check(snmp.ValidateConfig(&config), NotNil)
+}
+
+func (s *SnmpTestSuite) TestSend(t *C) {
+	udp, err := net.ListenPacket("udp", "127.0.0.1:0")
+	t.Assert(err, IsNil)
+	defer udp.Close()
+
+	config := snmp.Config{
+		Target:    udp.LocalAddr().String(),
+		Community: "noc",
+	}
+	sender, err := snmp.NewSender(s.logger, config, "db1", "123")
+	t.Assert(err, IsNil)
+
+	b := bus.New()
+	stopChan := make(chan struct{})
+	defer close(stopChan)
+	go sender.Run(b, stopChan)
+	time.Sleep(100 * time.Millisecond) // subscribe
+
+	// Not a trap topic.
+	b.Publish(bus.Event{Topic: bus.CONFIG_CHANGED, Source: "agent", Data: "qan"})
+	b.Publish(bus.Event{Topic: bus.MYSQL_RESTART, Source: "mrms", Data: "user@tcp(localhost:3306)/"})
+
+	udp.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buf := make([]byte, 1500)
+	n, _, err := udp.ReadFrom(buf)
+	t.Assert(err, IsNil)
+	packet := buf[0:n]
+
+	// SEQUENCE { INTEGER 1 (v2c), OCTET STRING "noc", SNMPv2-Trap-PDU ...
+	t.Check(packet[0], Equals, byte(0x30))
+	t.Check(bytes.Contains(packet, []byte{0x02, 0x01, 0x01, 0x04, 0x03, 'n', 'o', 'c', 0xA7}), Equals, true)
+
+	// sysUpTime.0 = TimeTicks
+	sysUpTime := []byte{0x06, 0x08, 0x2B, 0x06, 0x01, 0x02, 0x01, 0x01, 0x03, 0x00, 0x43}
+	t.Check(bytes.Contains(packet, sysUpTime), Equals, true)
+
+	// snmpTrapOID.0 = 1.3.6.1.4.1.20328.1.0.1 (MySQL restart)
+	trapOID := []byte{
+		0x06, 0x0A, 0x2B, 0x06, 0x01, 0x06, 0x03, 0x01, 0x01, 0x04, 0x01, 0x00,
+		0x06, 0x0B, 0x2B, 0x06, 0x01, 0x04, 0x01, 0x81, 0x9E, 0x68, 0x01, 0x00, 0x01,
+	}
+	t.Check(bytes.Contains(packet, trapOID), Equals, true)
+
+	for _, value := range []string{"db1", "123", "mrms", "user@tcp(localhost:3306)/"} {
+		t.Check(bytes.Contains(packet, append([]byte{0x04, byte(len(value))}, value...)), Equals, true, Commentf(value))
+	}
+
+	// The config change wasn't sent.
+	udp.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	_, _, err = udp.ReadFrom(buf)
+	t.Check(err, NotNil)
+}
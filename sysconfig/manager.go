@@ -31,8 +31,6 @@ import (
 	"github.com/percona/percona-agent/instance"
 	"github.com/percona/percona-agent/pct"
 	"github.com/percona/percona-agent/ticker"
-	"io/ioutil"
-	"path/filepath"
 	"sync"
 	"time"
 )
@@ -83,21 +81,20 @@ func (m *Manager) Start() error {
 	}
 
 	// Start all sysconfig monitors.
-	glob := filepath.Join(pct.Basedir.Dir("config"), "sysconfig-*.conf")
-	configFiles, err := filepath.Glob(glob)
+	names, err := pct.Basedir.ConfigNames("sysconfig-*")
 	if err != nil {
 		return err
 	}
 
-	for _, configFile := range configFiles {
-		data, err := ioutil.ReadFile(configFile)
+	for _, name := range names {
+		data, err := pct.Basedir.ConfigData(name)
 		if err != nil {
-			m.logger.Error("Read " + configFile + ": " + err.Error())
+			m.logger.Error("Read " + name + ": " + err.Error())
 			continue
 		}
 		config := &Config{}
 		if err := json.Unmarshal(data, config); err != nil {
-			m.logger.Error("Decode " + configFile + ": " + err.Error())
+			m.logger.Error("Decode " + name + ": " + err.Error())
 			continue
 		}
 		cmd := &proto.Cmd{
@@ -107,10 +104,10 @@ func (m *Manager) Start() error {
 		}
 		reply := m.Handle(cmd)
 		if reply.Error != "" {
-			m.logger.Error("Start " + configFile + ": " + err.Error())
+			m.logger.Error("Start " + name + ": " + err.Error())
 			continue
 		}
-		m.logger.Info("Started " + configFile)
+		m.logger.Info("Started " + name)
 	}
 
 	m.running = true
@@ -289,12 +286,36 @@ func (m *Manager) spooler() {
 	}()
 	m.status.Update("sysconfig-spooler", "Running")
 	for s := range m.reportChan {
+		if a := pct.Anonymize(); a != nil {
+			anonymize(a, s)
+		}
 		if err := m.spool.Write("sysconfig", s); err != nil {
 			m.logger.Warn("Lost report:", err)
 		}
 	}
 }
 
+// Settings with lists of schema and table names, or a user name, as values.
+var anonymizeLists = map[string]bool{
+	"replicate_do_db":             true,
+	"replicate_ignore_db":         true,
+	"replicate_do_table":          true,
+	"replicate_ignore_table":      true,
+	"replicate_wild_do_table":     true,
+	"replicate_wild_ignore_table": true,
+	"report_user":                 true,
+}
+
+// anonymize hashes schema, table, and user names in the settings, see
+// pct.Anonymizer.
+func anonymize(a *pct.Anonymizer, report *Report) {
+	for i, setting := range report.Settings {
+		if anonymizeLists[setting[0]] {
+			report.Settings[i][1] = a.List(setting[1])
+		}
+	}
+}
+
 func (m *Manager) getMonitorConfig(cmd *proto.Cmd) (*Config, string, error) {
 	/**
 	 * cmd.Data is a monitor-specific config, e.g. mysql.Config.  But monitor-specific
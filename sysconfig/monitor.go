@@ -19,6 +19,7 @@ package sysconfig
 
 import (
 	"github.com/percona/cloud-protocol/proto/v1"
+	"github.com/percona/percona-agent/pct"
 	"time"
 )
 
@@ -39,7 +40,11 @@ type Setting [2]string
 
 type Report struct {
 	proto.ServiceInstance
-	Ts       int64 // UTC Unix timestamp
-	System   string
-	Settings []Setting
+	Ts          int64 // UTC Unix timestamp
+	System      string
+	Settings    []Setting
+	Timezone    string             // agent local timezone, e.g. America/New_York
+	UtcOffset   int                // seconds, agent local timezone offset from UTC
+	Cloud       *pct.CloudMetadata `json:",omitempty"` // nil if not in a cloud
+	ClockOffset int                `json:",omitempty"` // seconds, API clock minus agent clock, see pct.ClockOffset
 }
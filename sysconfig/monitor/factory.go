@@ -18,7 +18,6 @@
 package factory
 
 import (
-	"encoding/json"
 	"errors"
 	"github.com/percona/cloud-protocol/proto/v1"
 	"github.com/percona/percona-agent/instance"
@@ -53,7 +52,7 @@ func (f *Factory) Make(service string, instanceId uint, data []byte) (sysconfig.
 
 		// Parse the MySQL sysconfig config.
 		config := &mysql.Config{}
-		if err := json.Unmarshal(data, config); err != nil {
+		if err := pct.UnmarshalConfig(data, config); err != nil {
 			return nil, err
 		}
 
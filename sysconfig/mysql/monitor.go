@@ -148,6 +148,9 @@ func (m *Monitor) run() {
 				System:   "mysql global variables",
 				Settings: []sysconfig.Setting{},
 			}
+			c.Timezone, c.UtcOffset = pct.Timezone()
+			c.ClockOffset = int(pct.ClockOffset() / time.Second)
+			c.Cloud = pct.CloudInstance()
 
 			// Get SHOW GLOBAL VARIABLES.
 			if err := m.GetGlobalVariables(m.conn.DB(), c); err != nil {
@@ -102,6 +102,9 @@ func (s *ManagerTestSuite) SetUpTest(t *C) {
 			t.Fatal(err)
 		}
 	}
+	if err := test.ClearConfigs(); err != nil {
+		t.Fatal(err)
+	}
 }
 
 func (s *ManagerTestSuite) TearDownSuite(t *C) {
@@ -207,10 +210,9 @@ func (s *ManagerTestSuite) TestStartStopMonitor(t *C) {
 		t.Errorf("Make 3600s ticker for collect interval\n%s", diff)
 	}
 
-	// After starting a monitor, sysconfig should write its config to the dir
-	// it learned when sysconfig.LoadConfig() was called.  Next time agent starts,
-	// it will have sysconfig start the monitor with this config.
-	data, err := ioutil.ReadFile(s.configDir + "/sysconfig-mysql-1.conf")
+	// After starting a monitor, sysconfig should save its config.  Next time
+	// agent starts, it will have sysconfig start the monitor with this config.
+	data, err := pct.Basedir.ConfigData("sysconfig-mysql-1")
 	t.Check(err, IsNil)
 	gotConfig := &mysql.Config{}
 	err = json.Unmarshal(data, gotConfig)
@@ -246,11 +248,10 @@ func (s *ManagerTestSuite) TestStartStopMonitor(t *C) {
 		t.Error("Remove's monitor's tickChan from clock")
 	}
 
-	// After stopping a monitor, sysconfig should remove its config file so agent
+	// After stopping a monitor, sysconfig should remove its config so agent
 	// doesn't start it on restart.
-	file := s.configDir + "/sysconfig-mysql-1.conf"
-	if pct.FileExists(file) {
-		t.Error("Stopping monitor removes its config; ", file, " exists")
+	if pct.Basedir.ConfigExists("sysconfig-mysql-1") {
+		t.Error("Stopping monitor removes its config; sysconfig-mysql-1 exists")
 	}
 
 	/**
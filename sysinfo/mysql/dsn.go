@@ -3,6 +3,7 @@ package mysql
 import (
 	"errors"
 	"fmt"
+	"net"
 	"net/url"
 	"strings"
 	"time"
@@ -116,17 +117,20 @@ func NewDSN(dsn string) (cfg *DSN, err error) {
 		case "tcp":
 			cfg.addr = "127.0.0.1:3306"
 		case "unix":
-			cfg.addr = "/tmp/mysql.sock"
+			// No --socket, so pt-mysql-summary uses the default socket.
 		default:
 			return nil, errors.New("Default addr for network '" + cfg.net + "' unknown")
 		}
 
 	}
 
-	if strings.Contains(cfg.addr, ":") {
-		parts := strings.Split(cfg.addr, ":")
-		cfg.addr = parts[0]
-		cfg.port = parts[1]
+	// Only TCP addresses have a port; a socket file path may contain ":".
+	// SplitHostPort handles IPv6 addresses like [::1]:3306.
+	if cfg.net == "tcp" {
+		if host, port, err := net.SplitHostPort(cfg.addr); err == nil {
+			cfg.addr = host
+			cfg.port = port
+		}
 	}
 
 	// Set default location if empty
@@ -24,6 +24,8 @@ import (
 	"github.com/percona/percona-agent/instance"
 	"github.com/percona/percona-agent/pct"
 	"github.com/percona/percona-agent/pct/cmd"
+	"net"
+	"strings"
 )
 
 const (
@@ -79,6 +81,11 @@ func (m *MySQL) Handle(protoCmd *proto.Cmd) *proto.Reply {
 		m.logger.Error(fmt.Sprintf("%s: %s", m.CmdName, err))
 	}
 
+	output = ExcludeSummaryData(output)
+	if a := pct.Anonymize(); a != nil {
+		output = AnonymizeSummary(a, output)
+	}
+
 	result := &proto.SysinfoResult{
 		Raw: output,
 	}
@@ -102,6 +109,85 @@ func getServiceInstance(protoCmd *proto.Cmd) (serviceInstance *proto.ServiceInst
 	return serviceInstance, nil
 }
 
+// AnonymizeSummary hashes user and schema names in pt-mysql-summary output,
+// see pct.Anonymizer and rewriteSummary.
+func AnonymizeSummary(a *pct.Anonymizer, summary string) string {
+	return rewriteSummary(summary, func(kind, name string) string {
+		if kind == "host" {
+			return name
+		}
+		return a.Name(name)
+	})
+}
+
+// ExcludeSummaryData removes user names, host names, and IPs from
+// pt-mysql-summary output if excluded, see pct.Collect and rewriteSummary.
+func ExcludeSummaryData(summary string) string {
+	return rewriteSummary(summary, func(kind, name string) string {
+		switch kind {
+		case "user":
+			if !pct.Collect(pct.DATA_USERNAMES) {
+				return "excluded"
+			}
+		case "host":
+			host := name
+			if h, _, err := net.SplitHostPort(name); err == nil {
+				host = h
+			}
+			if host != "%" && !pct.CollectHost(host) {
+				return "excluded"
+			}
+		}
+		return name
+	})
+}
+
+// rewriteSummary replaces the names in pt-mysql-summary output with the
+// return value of rewrite: the user and host of the User line of the report,
+// and the names in the User (user), Host (host), and db tables of the
+// Processlist section.
+func rewriteSummary(summary string, rewrite func(kind, name string) string) string {
+	lines := strings.Split(summary, "\n")
+	table := ""
+	for i, line := range lines {
+		fields := strings.Fields(line)
+		switch {
+		case len(fields) == 0 || strings.HasPrefix(line, "#"):
+			table = ""
+		case len(fields) > 1 && fields[1] == "COUNT(*)":
+			table = fields[0] // e.g. User COUNT(*) Working SUM(Time) MAX(Time)
+		case strings.HasPrefix(fields[0], "---"):
+		case table == "User" || table == "Host" || table == "db":
+			if fields[0] != "NULL" {
+				lines[i] = replaceField(line, fields[0], rewrite(strings.ToLower(table), fields[0]))
+			}
+		case len(fields) == 3 && fields[0] == "User" && fields[1] == "|":
+			// User | user@host
+			if j := strings.LastIndex(fields[2], "@"); j > 0 {
+				user, host := fields[2][0:j], fields[2][j+1:]
+				lines[i] = replaceField(line, fields[2], rewrite("user", user)+"@"+rewrite("host", host))
+			}
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// replaceField replaces the first old in line with new, keeping the columns
+// after it aligned if there are enough spaces.
+func replaceField(line, old, new string) string {
+	i := strings.Index(line, old)
+	if i < 0 {
+		return line
+	}
+	rest := line[i+len(old):]
+	if n := len(new) - len(old); n < 0 {
+		new += strings.Repeat(" ", -n)
+	} else if n < len(rest) && strings.TrimLeft(rest[0:n+1], " ") == "" {
+		rest = rest[n:]
+	}
+	return line[0:i] + new + rest
+}
+
 func CreateParamsForPtMySQLSummary(dsn *DSN) (args []string) {
 	args = append(args, "--sleep", PT_SLEEP_SECONDS)
 	if dsn.user != "" {
@@ -111,9 +197,15 @@ func CreateParamsForPtMySQLSummary(dsn *DSN) (args []string) {
 		args = append(args, "--password", dsn.passwd)
 	}
 	if dsn.net == "unix" {
-		args = append(args, "--socket", dsn.addr)
-	} else {
 		if dsn.addr != "" {
+			args = append(args, "--socket", dsn.addr)
+		}
+	} else {
+		// The mysql client connects to localhost through the socket, but the
+		// DSN is TCP, so use the loopback address to connect the same way.
+		if dsn.addr == "localhost" {
+			args = append(args, "--host", "127.0.0.1")
+		} else if dsn.addr != "" {
 			args = append(args, "--host", dsn.addr)
 		}
 		if dsn.port != "" {
@@ -23,12 +23,14 @@ import (
 	"github.com/percona/percona-agent/instance"
 	"github.com/percona/percona-agent/pct"
 	"github.com/percona/percona-agent/sysinfo/mysql"
+	"github.com/percona/percona-agent/test"
 	. "github.com/percona/percona-agent/test/checkers"
 	"github.com/percona/percona-agent/test/mock"
 	. "gopkg.in/check.v1"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 )
@@ -101,6 +103,9 @@ func (s *TestSuite) SetUpTest(t *C) {
 			t.Fatal(err)
 		}
 	}
+	if err := test.ClearConfigs(); err != nil {
+		t.Fatal(err)
+	}
 }
 
 func (s *TestSuite) TearDownSuite(t *C) {
@@ -274,3 +279,84 @@ func (s *TestSuite) TestParsingParamsWithoutUser(t *C) {
 	gotArgs = mysql.CreateParamsForPtMySQLSummary(dsn)
 	t.Assert(gotArgs, DeepEquals, expectedArgs)
 }
+
+func (s *TestSuite) TestParsingParamsWithSocketColon(t *C) {
+	// Only TCP addresses have a port, so a socket path with ":" must not be split.
+	dsn, err := mysql.NewDSN("pt-agent@unix(/var/run/mysqld:1/mysqld.sock)/")
+	t.Assert(err, IsNil)
+	expectedArgs := []string{
+		"--sleep", mysql.PT_SLEEP_SECONDS,
+		"--user", "pt-agent",
+		"--socket", "/var/run/mysqld:1/mysqld.sock",
+	}
+	gotArgs := mysql.CreateParamsForPtMySQLSummary(dsn)
+	t.Assert(gotArgs, DeepEquals, expectedArgs)
+}
+
+func (s *TestSuite) TestParsingParamsWithDefaultSocket(t *C) {
+	// No socket path, so pt-mysql-summary uses the default socket.
+	dsn, err := mysql.NewDSN("pt-agent@unix/")
+	t.Assert(err, IsNil)
+	expectedArgs := []string{
+		"--sleep", mysql.PT_SLEEP_SECONDS,
+		"--user", "pt-agent",
+	}
+	gotArgs := mysql.CreateParamsForPtMySQLSummary(dsn)
+	t.Assert(gotArgs, DeepEquals, expectedArgs)
+}
+
+func (s *TestSuite) TestParsingParamsWithTCPLocalhost(t *C) {
+	// localhost would make the mysql client use the socket.
+	dsn, err := mysql.NewDSN("pt-agent@tcp(localhost:3306)/")
+	t.Assert(err, IsNil)
+	expectedArgs := []string{
+		"--sleep", mysql.PT_SLEEP_SECONDS,
+		"--user", "pt-agent",
+		"--host", "127.0.0.1",
+		"--port", "3306",
+	}
+	gotArgs := mysql.CreateParamsForPtMySQLSummary(dsn)
+	t.Assert(gotArgs, DeepEquals, expectedArgs)
+}
+
+func (s *TestSuite) TestParsingParamsWithIPv6(t *C) {
+	dsn, err := mysql.NewDSN("pt-agent@tcp([::1]:7777)/")
+	t.Assert(err, IsNil)
+	expectedArgs := []string{
+		"--sleep", mysql.PT_SLEEP_SECONDS,
+		"--user", "pt-agent",
+		"--host", "::1",
+		"--port", "7777",
+	}
+	gotArgs := mysql.CreateParamsForPtMySQLSummary(dsn)
+	t.Assert(gotArgs, DeepEquals, expectedArgs)
+}
+
+func (s *TestSuite) TestAnonymizeSummary(t *C) {
+	a := pct.NewAnonymizer([]byte("key"))
+	summary := `# Report On Port 3306 #######################################
+                     User | msandbox@%
+# Processlist ################################################
+
+  Command                        COUNT(*) Working SUM(Time) MAX(Time)
+  ------------------------------ -------- ------- --------- ---------
+  Query                                 1       1         0         0
+
+  User                           COUNT(*) Working SUM(Time) MAX(Time)
+  ------------------------------ -------- ------- --------- ---------
+  msandbox                              2       2         0         0
+
+  db                             COUNT(*) Working SUM(Time) MAX(Time)
+  ------------------------------ -------- ------- --------- ---------
+  NULL                                  1       1         0         0
+  sales                                 1       1         0         0
+`
+	got := mysql.AnonymizeSummary(a, summary)
+	t.Check(strings.Contains(got, "msandbox"), Equals, false)
+	t.Check(strings.Contains(got, "sales"), Equals, false)
+	t.Check(strings.Contains(got, "User | "+a.Name("msandbox")+"@%\n"), Equals, true)
+	// Columns stay aligned.
+	t.Check(strings.Contains(got, "\n  "+a.Name("sales")+strings.Repeat(" ", 21)+"1       1"), Equals, true)
+	t.Check(strings.Contains(got, "  NULL                                  1"), Equals, true)
+	t.Check(strings.Contains(got, "  Query                                 1"), Equals, true)
+}
@@ -19,6 +19,9 @@ package system
 
 import (
 	"fmt"
+	"strings"
+	"time"
+
 	"github.com/percona/cloud-protocol/proto/v1"
 	"github.com/percona/percona-agent/pct"
 	"github.com/percona/percona-agent/pct/cmd"
@@ -31,12 +34,16 @@ const (
 
 type System struct {
 	CmdName string
+	ProcDir string // /proc, for testing
+	SysDir  string // /sys, for testing
 	logger  *pct.Logger
 }
 
 func NewSystem(logger *pct.Logger) *System {
 	return &System{
 		CmdName: "pt-summary",
+		ProcDir: "/proc",
+		SysDir:  "/sys",
 		logger:  logger,
 	}
 }
@@ -53,6 +60,14 @@ func (s *System) Handle(protoCmd *proto.Cmd) *proto.Reply {
 	output, err := ptSummary.Run()
 	if err != nil {
 		s.logger.Error(fmt.Sprintf("%s: %s", s.CmdName, err))
+	} else {
+		// Add our sections before pt-summary's last section.
+		virt := s.VirtSummary(1 * time.Second)
+		if i := strings.LastIndex(output, "# The End #"); i >= 0 {
+			output = output[:i] + virt + output[i:]
+		} else {
+			output += virt
+		}
 	}
 
 	result := &proto.SysinfoResult{
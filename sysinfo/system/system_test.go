@@ -22,6 +22,7 @@ import (
 	"github.com/percona/cloud-protocol/proto/v1"
 	"github.com/percona/percona-agent/pct"
 	"github.com/percona/percona-agent/sysinfo/system"
+	"github.com/percona/percona-agent/test"
 	. "github.com/percona/percona-agent/test/checkers"
 	"github.com/percona/percona-agent/test/mock"
 	. "gopkg.in/check.v1"
@@ -77,6 +78,9 @@ func (s *TestSuite) SetUpTest(t *C) {
 			t.Fatal(err)
 		}
 	}
+	if err := test.ClearConfigs(); err != nil {
+		t.Fatal(err)
+	}
 }
 
 func (s *TestSuite) TearDownSuite(t *C) {
@@ -144,3 +148,26 @@ func (s *TestSuite) TestExecutableNotFound(t *C) {
 	// changing this string means breaking contract between agent/api and web-app
 	t.Assert(gotReply.Error, Equals, "Executable file not found in $PATH")
 }
+
+func (s *TestSuite) TestVirtSummary(t *C) {
+	service := system.NewSystem(s.logger)
+	service.ProcDir = test.RootDir + "/sysinfo/ec2/proc"
+	service.SysDir = test.RootDir + "/sysinfo/ec2/sys"
+
+	got := service.VirtSummary(0)
+	expect := "# Virtualization ############################################\n" +
+		"  Hypervisor | KVM (Amazon EC2)\n" +
+		"   CPU steal | 0.0%\n" +
+		"# Network Storage ###########################################\n" +
+		"     nvme0n1 | EBS (NVMe)\n" +
+		"     nvme1n1 | EBS (NVMe)\n" +
+		"/var/lib/mysql-backup | nfs4 fs-1.efs.us-east-1.amazonaws.com:/\n"
+	t.Check(got, Equals, expect)
+
+	// Not virtualized.
+	service.ProcDir = "/nonexistent/proc"
+	service.SysDir = "/nonexistent/sys"
+	got = service.VirtSummary(0)
+	t.Check(got, Matches, "(?s).*Hypervisor \\| none\n.*")
+	t.Check(got, Matches, "(?s).*Devices \\| none\n")
+}
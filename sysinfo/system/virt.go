@@ -0,0 +1,202 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package system
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Network and cloud filesystem types in /proc/mounts.
+var networkFsTypes = map[string]bool{
+	"nfs":       true,
+	"nfs4":      true,
+	"cifs":      true,
+	"smbfs":     true,
+	"glusterfs": true,
+	"ceph":      true,
+	"ocfs2":     true,
+	"gfs2":      true,
+}
+
+// VirtSummary returns the Virtualization and Network Storage sections which
+// pt-summary does not report: hypervisor type, CPU steal time, and network
+// storage like EBS volumes and NFS mounts.  These often explain MySQL
+// performance anomalies.  CPU steal is sampled for the given duration.
+func (s *System) VirtSummary(sample time.Duration) string {
+	out := header("Virtualization")
+	out += nameVal("Hypervisor", s.hypervisor())
+	if steal, err := s.cpuSteal(sample); err != nil {
+		out += nameVal("CPU steal", err.Error())
+	} else {
+		out += nameVal("CPU steal", fmt.Sprintf("%.1f%%", steal))
+	}
+
+	out += header("Network Storage")
+	storage := s.networkStorage()
+	if len(storage) == 0 {
+		out += nameVal("Devices", "none")
+	}
+	for _, nv := range storage {
+		out += nameVal(nv[0], nv[1])
+	}
+	return out
+}
+
+func header(title string) string {
+	h := "# " + title + " "
+	return h + strings.Repeat("#", 61-len(h)) + "\n"
+}
+
+func nameVal(name, val string) string {
+	return fmt.Sprintf("%12s | %s\n", name, val)
+}
+
+func (s *System) readFile(path string) string {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
+
+func (s *System) hypervisor() string {
+	// Xen, including older EC2 instances.
+	if t := s.readFile(filepath.Join(s.SysDir, "hypervisor/type")); t != "" {
+		return strings.Title(t)
+	}
+	vendor := s.readFile(filepath.Join(s.SysDir, "class/dmi/id/sys_vendor"))
+	product := s.readFile(filepath.Join(s.SysDir, "class/dmi/id/product_name"))
+	dmi := vendor + " " + product
+	switch {
+	case strings.Contains(dmi, "Amazon EC2"):
+		return "KVM (Amazon EC2)"
+	case strings.Contains(dmi, "Google"):
+		return "KVM (Google Compute Engine)"
+	case strings.Contains(dmi, "VMware"):
+		return "VMware"
+	case strings.Contains(dmi, "VirtualBox"):
+		return "VirtualBox"
+	case strings.Contains(dmi, "Microsoft Corporation") && strings.Contains(product, "Virtual Machine"):
+		return "Hyper-V"
+	case strings.Contains(dmi, "QEMU"), strings.Contains(dmi, "KVM"):
+		return "KVM"
+	case strings.Contains(dmi, "Xen"):
+		return "Xen"
+	}
+	// The CPU reports a hypervisor but the type is unknown.
+	cpuinfo := s.readFile(filepath.Join(s.ProcDir, "cpuinfo"))
+	for _, line := range strings.Split(cpuinfo, "\n") {
+		if strings.HasPrefix(line, "flags") && strings.Contains(line, " hypervisor") {
+			return "unknown"
+		}
+	}
+	return "none"
+}
+
+// cpuSteal returns the percentage of CPU time stolen by the hypervisor
+// during the sample.
+func (s *System) cpuSteal(sample time.Duration) (float64, error) {
+	steal0, total0, err := s.cpuStat()
+	if err != nil {
+		return 0, err
+	}
+	time.Sleep(sample)
+	steal1, total1, err := s.cpuStat()
+	if err != nil {
+		return 0, err
+	}
+	if total1 <= total0 {
+		return 0, nil
+	}
+	return float64(steal1-steal0) / float64(total1-total0) * 100, nil
+}
+
+func (s *System) cpuStat() (steal, total uint64, err error) {
+	file, err := os.Open(filepath.Join(s.ProcDir, "stat"))
+	if err != nil {
+		return 0, 0, err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		// cpu  user nice system idle iowait irq softirq steal guest guest_nice
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || fields[0] != "cpu" {
+			continue
+		}
+		// Guest time is included in user time, so don't count it twice.
+		for i, f := range fields[1:] {
+			if i > 7 {
+				break
+			}
+			n, err := strconv.ParseUint(f, 10, 64)
+			if err != nil {
+				return 0, 0, err
+			}
+			total += n
+			if i == 7 {
+				steal = n
+			}
+		}
+		return steal, total, nil
+	}
+	return 0, 0, fmt.Errorf("No cpu line in %s", file.Name())
+}
+
+// networkStorage returns name-value pairs of network block devices and
+// network filesystem mounts.
+func (s *System) networkStorage() [][2]string {
+	nv := [][2]string{}
+
+	devices, _ := filepath.Glob(filepath.Join(s.SysDir, "block/*"))
+	for _, dev := range devices {
+		name := filepath.Base(dev)
+		model := s.readFile(filepath.Join(dev, "device/model"))
+		switch {
+		case strings.Contains(model, "Elastic Block Store"):
+			nv = append(nv, [2]string{name, "EBS (NVMe)"})
+		case strings.HasPrefix(name, "xvd"):
+			nv = append(nv, [2]string{name, "Xen virtual disk (EBS on EC2)"})
+		case strings.HasPrefix(name, "rbd"):
+			nv = append(nv, [2]string{name, "Ceph RBD"})
+		case strings.HasPrefix(name, "nbd") && s.readFile(filepath.Join(dev, "size")) != "0":
+			nv = append(nv, [2]string{name, "Network block device"})
+		case model == "PersistentDisk":
+			nv = append(nv, [2]string{name, "Google Persistent Disk"})
+		}
+	}
+
+	mounts := s.readFile(filepath.Join(s.ProcDir, "mounts"))
+	for _, line := range strings.Split(mounts, "\n") {
+		// device mountpoint fstype options dump pass
+		fields := strings.Fields(line)
+		if len(fields) < 3 || !networkFsTypes[fields[2]] {
+			continue
+		}
+		nv = append(nv, [2]string{fields[1], fields[2] + " " + fields[0]})
+	}
+
+	return nv
+}
@@ -58,6 +58,10 @@ func (a *API) Connect(hostname, apiKey, agentUuid string) error {
 	return nil
 }
 
+func (a *API) Failover() error {
+	return nil
+}
+
 func (a *API) AgentLink(resource string) string {
 	return a.links[resource]
 }
@@ -109,6 +113,10 @@ func (a *API) Put(apiKey, url string, data []byte) (*http.Response, []byte, erro
 	return nil, nil, nil
 }
 
+func (a *API) Delete(apiKey, url string) (*http.Response, []byte, error) {
+	return nil, nil, nil
+}
+
 func (a *API) URL(paths ...string) string {
 	return ""
 }
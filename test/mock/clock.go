@@ -23,6 +23,7 @@ import (
 
 type Clock struct {
 	Added   []uint
+	Chans   []chan time.Time // added, to send ticks
 	Removed []chan time.Time
 	Eta     float64
 }
@@ -30,6 +31,7 @@ type Clock struct {
 func NewClock() *Clock {
 	m := &Clock{
 		Added:   []uint{},
+		Chans:   []chan time.Time{},
 		Removed: []chan time.Time{},
 	}
 	return m
@@ -37,6 +39,7 @@ func NewClock() *Clock {
 
 func (m *Clock) Add(c chan time.Time, t uint, sync bool) {
 	m.Added = append(m.Added, t)
+	m.Chans = append(m.Chans, c)
 }
 
 func (m *Clock) Remove(c chan time.Time) {
@@ -134,6 +134,9 @@ func (c *DataClient) SetConnectChan(connectChan chan bool) {
 	c.testConnectChan = connectChan
 }
 
+func (c *DataClient) SetCompression(minSize int) {
+}
+
 func (c *DataClient) Status() map[string]string {
 	return map[string]string{
 		"data-client": "ok",
@@ -0,0 +1,402 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package mock
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/percona/percona-agent/mysql"
+	"github.com/percona/percona-agent/pct"
+)
+
+// FakeMySQL is a mysql.Connector with scripted responses, so collectors can be
+// tested without PCT_TEST_MYSQL_DSN.  DB() returns a real *sql.DB using a fake
+// driver: queries are matched to the scripted responses (see OnQuery), in the
+// order they were added, and queries without a response fail.  Execs without
+// a response, e.g. SET GLOBAL, succeed.  All queries and execs are recorded:
+//
+//	fake := mock.NewFakeMySQL()
+//	fake.OnQuery("INFORMATION_SCHEMA.ENGINES").Rows(
+//		[]string{"ENGINE", "SUPPORT"},
+//		[][]interface{}{{"InnoDB", "DEFAULT"}},
+//	)
+//	engines, err := mysql.GetEngines(fake.DB())
+type FakeMySQL struct {
+	name       string
+	db         *sql.DB
+	responses  []*FakeQuery
+	queries    []string
+	delay      time.Duration
+	connectErr error
+	connected  uint
+	uptime     int64
+	vars       map[string]string
+	set        []mysql.Query
+	mux        *sync.Mutex
+}
+
+// A FakeQuery is the scripted response to queries that contain a substring.
+type FakeQuery struct {
+	substr  string
+	columns []string
+	rows    [][]driver.Value
+	err     error
+	delay   time.Duration
+	count   int
+}
+
+var (
+	fakeMySQLs   = map[string]*FakeMySQL{}
+	fakeMySQLMux = &sync.Mutex{}
+	fakeMySQLN   = 0
+)
+
+func init() {
+	sql.Register("fake-mysql", &fakeDriver{})
+}
+
+func NewFakeMySQL() *FakeMySQL {
+	fakeMySQLMux.Lock()
+	fakeMySQLN++
+	name := fmt.Sprintf("fake-mysql-%d", fakeMySQLN)
+	fakeMySQLMux.Unlock()
+
+	db, _ := sql.Open("fake-mysql", name) // doesn't connect
+	f := &FakeMySQL{
+		name:      name,
+		db:        db,
+		responses: []*FakeQuery{},
+		queries:   []string{},
+		vars:      map[string]string{},
+		set:       []mysql.Query{},
+		mux:       &sync.Mutex{},
+	}
+
+	fakeMySQLMux.Lock()
+	fakeMySQLs[name] = f
+	fakeMySQLMux.Unlock()
+	return f
+}
+
+// OnQuery returns the response to queries and execs that contain substr.
+func (f *FakeMySQL) OnQuery(substr string) *FakeQuery {
+	q := &FakeQuery{
+		substr: substr,
+	}
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	f.responses = append(f.responses, q)
+	return q
+}
+
+// Rows sets the result set.  Values are like database/sql driver.Value; ints
+// and uints are converted to int64, and float32 to float64.
+func (q *FakeQuery) Rows(columns []string, rows [][]interface{}) *FakeQuery {
+	q.columns = columns
+	q.rows = make([][]driver.Value, len(rows))
+	for i, row := range rows {
+		q.rows[i] = make([]driver.Value, len(row))
+		for j, v := range row {
+			q.rows[i][j] = fakeValue(v)
+		}
+	}
+	return q
+}
+
+// Error makes the query fail, e.g. with a *mysql.MySQLError.
+func (q *FakeQuery) Error(err error) *FakeQuery {
+	q.err = err
+	return q
+}
+
+// Delay makes the query slow, in addition to SetDelay.
+func (q *FakeQuery) Delay(d time.Duration) *FakeQuery {
+	q.delay = d
+	return q
+}
+
+// Count returns how many times the query ran.
+func (q *FakeQuery) Count() int {
+	return q.count
+}
+
+// SetDelay makes every query and exec slow, like SlowMySQL.
+func (f *FakeMySQL) SetDelay(d time.Duration) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	f.delay = d
+}
+
+// SetConnectError makes Connect fail.
+func (f *FakeMySQL) SetConnectError(err error) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	f.connectErr = err
+}
+
+// SetGlobalVar sets a global variable, e.g. version, for GetGlobalVarString,
+// GetGlobalVarNumber, and AtLeastVersion.
+func (f *FakeMySQL) SetGlobalVar(name string, value interface{}) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	f.vars[name] = fmt.Sprintf("%v", value)
+}
+
+func (f *FakeMySQL) SetUptime(uptime int64) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	f.uptime = uptime
+}
+
+// Queries returns the queries and execs run, oldest first.
+func (f *FakeMySQL) Queries() []string {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	return append([]string{}, f.queries...)
+}
+
+// GetSet returns the queries passed to Set.
+func (f *FakeMySQL) GetSet() []mysql.Query {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	return f.set
+}
+
+// Connected returns the number of open connections, Connect minus Close.
+func (f *FakeMySQL) Connected() uint {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	return f.connected
+}
+
+// --------------------------------------------------------------------------
+// mysql.Connector interface
+// --------------------------------------------------------------------------
+
+func (f *FakeMySQL) DB() *sql.DB {
+	return f.db
+}
+
+func (f *FakeMySQL) DSN() string {
+	return "fake:fake@tcp(127.0.0.1:3306)/?parseTime=true&fake=" + f.name
+}
+
+func (f *FakeMySQL) Connect(tries uint) error {
+	if tries == 0 {
+		return nil
+	}
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	if f.connectErr != nil {
+		return f.connectErr
+	}
+	f.connected++
+	return nil
+}
+
+func (f *FakeMySQL) Close() {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	if f.connected > 0 {
+		f.connected--
+	}
+}
+
+func (f *FakeMySQL) Set(queries []mysql.Query) error {
+	for _, q := range queries {
+		if q.Set != "" {
+			if _, err := f.db.Exec(q.Set); err != nil {
+				return err
+			}
+		}
+		if q.Verify != "" {
+			if got := f.GetGlobalVarString(q.Verify); got != q.Expect {
+				return fmt.Errorf("Global variable '%s' is set to '%s' but needs to be '%s'", q.Verify, got, q.Expect)
+			}
+		}
+	}
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	f.set = append(f.set, queries...)
+	return nil
+}
+
+func (f *FakeMySQL) GetGlobalVarString(varName string) string {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	return f.vars[varName]
+}
+
+func (f *FakeMySQL) GetGlobalVarNumber(varName string) float64 {
+	var n float64
+	fmt.Sscanf(f.GetGlobalVarString(varName), "%g", &n)
+	return n
+}
+
+func (f *FakeMySQL) Uptime() (int64, error) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	return f.uptime, nil
+}
+
+func (f *FakeMySQL) AtLeastVersion(minVersion string) (bool, error) {
+	return pct.AtLeastVersion(f.GetGlobalVarString("version"), minVersion)
+}
+
+// --------------------------------------------------------------------------
+
+// run records the query, waits for the delay, and returns its response, or
+// nil if it has none.
+func (f *FakeMySQL) run(query string) *FakeQuery {
+	f.mux.Lock()
+	f.queries = append(f.queries, query)
+	delay := f.delay
+	var response *FakeQuery
+	for _, q := range f.responses {
+		if strings.Contains(query, q.substr) {
+			q.count++
+			response = q
+			delay += q.delay
+			break
+		}
+	}
+	f.mux.Unlock()
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+	return response
+}
+
+func fakeValue(v interface{}) driver.Value {
+	switch n := v.(type) {
+	case int:
+		return int64(n)
+	case int32:
+		return int64(n)
+	case uint:
+		return int64(n)
+	case uint32:
+		return int64(n)
+	case uint64:
+		return int64(n)
+	case float32:
+		return float64(n)
+	}
+	return v
+}
+
+type fakeDriver struct{}
+
+func (d *fakeDriver) Open(name string) (driver.Conn, error) {
+	fakeMySQLMux.Lock()
+	defer fakeMySQLMux.Unlock()
+	f, ok := fakeMySQLs[name]
+	if !ok {
+		return nil, errors.New("mock: unknown FakeMySQL: " + name)
+	}
+	return &fakeConn{f: f}, nil
+}
+
+type fakeConn struct {
+	f *FakeMySQL
+}
+
+func (c *fakeConn) Prepare(query string) (driver.Stmt, error) {
+	return &fakeStmt{f: c.f, query: query}, nil
+}
+
+func (c *fakeConn) Close() error {
+	return nil
+}
+
+// Begin returns a transaction that does nothing: its queries and execs run
+// like any other, e.g. USE and EXPLAIN in query/mysql.
+func (c *fakeConn) Begin() (driver.Tx, error) {
+	return fakeTx{}, nil
+}
+
+type fakeTx struct{}
+
+func (fakeTx) Commit() error {
+	return nil
+}
+
+func (fakeTx) Rollback() error {
+	return nil
+}
+
+type fakeStmt struct {
+	f     *FakeMySQL
+	query string
+}
+
+func (s *fakeStmt) Close() error {
+	return nil
+}
+
+func (s *fakeStmt) NumInput() int {
+	return -1 // don't check
+}
+
+func (s *fakeStmt) Exec(args []driver.Value) (driver.Result, error) {
+	if q := s.f.run(s.query); q != nil && q.err != nil {
+		return nil, q.err
+	}
+	return driver.RowsAffected(0), nil
+}
+
+func (s *fakeStmt) Query(args []driver.Value) (driver.Rows, error) {
+	q := s.f.run(s.query)
+	if q == nil {
+		return nil, errors.New("mock: FakeMySQL has no response for query: " + s.query)
+	}
+	if q.err != nil {
+		return nil, q.err
+	}
+	return &fakeRows{columns: q.columns, rows: q.rows}, nil
+}
+
+type fakeRows struct {
+	columns []string
+	rows    [][]driver.Value
+	n       int
+}
+
+func (r *fakeRows) Columns() []string {
+	return r.columns
+}
+
+func (r *fakeRows) Close() error {
+	return nil
+}
+
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if r.n >= len(r.rows) {
+		return io.EOF
+	}
+	copy(dest, r.rows[r.n])
+	r.n++
+	return nil
+}
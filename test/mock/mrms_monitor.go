@@ -18,27 +18,44 @@
 package mock
 
 import (
+	"sync"
 	"time"
+
+	"github.com/percona/percona-agent/bus"
+	"github.com/percona/percona-agent/mysql"
 )
 
 type MrmsMonitor struct {
-	c          chan bool
-	globalChan chan string
+	// Bus receives the restarts simulated by SimulateMySQLRestart.
+	Bus *bus.Bus
+	// --
+	dsns map[string]int
+	mux  *sync.Mutex
 }
 
 func NewMrmsMonitor() *MrmsMonitor {
 	m := &MrmsMonitor{
-		globalChan: make(chan string, 100),
+		Bus:  bus.New(),
+		dsns: make(map[string]int),
+		mux:  &sync.Mutex{},
 	}
 	return m
 }
 
-func (m *MrmsMonitor) Add(dsn string) (<-chan bool, error) {
-	m.c = make(chan bool, 10)
-	return m.c, nil
+func (m *MrmsMonitor) Add(dsn string) error {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	m.dsns[dsn]++
+	return nil
 }
 
-func (m *MrmsMonitor) Remove(dsn string, c <-chan bool) {
+func (m *MrmsMonitor) Remove(dsn string) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	m.dsns[dsn]--
+	if m.dsns[dsn] <= 0 {
+		delete(m.dsns, dsn)
+	}
 }
 
 func (m *MrmsMonitor) Check() {
@@ -58,14 +75,16 @@ func (m *MrmsMonitor) Status() (status map[string]string) {
 	}
 }
 
-// The restartChan in the real MrmsMonitor is read only.
-// To be consistent with that, instead of returning the channel just for
-// testing purposes, we have this method to simulate a MySQL restart
+// SimulateMySQLRestart publishes a restart of every added instance on Bus,
+// like the real MrmsMonitor.
 func (m *MrmsMonitor) SimulateMySQLRestart() {
-	m.c <- true
-}
-
-func (m *MrmsMonitor) GlobalSubscribe() (chan string, error) {
-	return m.globalChan, nil
-
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	for dsn := range m.dsns {
+		m.Bus.Publish(bus.Event{
+			Topic:  bus.MYSQL_RESTART,
+			Source: "mrms-monitor-mock",
+			Data:   mysql.HideDSNPassword(dsn),
+		})
+	}
 }
@@ -20,6 +20,7 @@ package mock
 import (
 	"time"
 
+	"github.com/percona/percona-agent/bus"
 	"github.com/percona/percona-agent/mysql"
 	"github.com/percona/percona-agent/qan"
 )
@@ -95,14 +96,19 @@ type AnalyzerArgs struct {
 	Config      qan.Config
 	Name        string
 	MysqlConn   mysql.Connector
-	RestartChan <-chan bool
+	RestartChan <-chan bus.Event
 	TickChan    chan time.Time
+	Begin       time.Time // backfill
+	End         time.Time // backfill
 }
 
 type QanAnalyzerFactory struct {
-	Args      []AnalyzerArgs
-	analyzers []qan.Analyzer
-	n         int
+	Args         []AnalyzerArgs
+	SlowLogSlice *qan.SlowLogSlice
+	SlowLogErr   error
+	SlowLogReqs  []qan.SlowLogSliceRequest
+	analyzers    []qan.Analyzer
+	n            int
 }
 
 func NewQanAnalyzerFactory(a ...qan.Analyzer) *QanAnalyzerFactory {
@@ -117,7 +123,7 @@ func (f *QanAnalyzerFactory) Make(
 	config qan.Config,
 	name string,
 	mysqlConn mysql.Connector,
-	restartChan <-chan bool,
+	restartChan <-chan bus.Event,
 	tickChan chan time.Time,
 ) qan.Analyzer {
 	if f.n < len(f.analyzers) {
@@ -140,3 +146,33 @@ func (f *QanAnalyzerFactory) Make(
 	}
 	panic("Need more analyzers")
 }
+
+func (f *QanAnalyzerFactory) MakeBackfill(
+	config qan.Config,
+	name string,
+	mysqlConn mysql.Connector,
+	begin, end time.Time,
+) (qan.Analyzer, error) {
+	if f.n < len(f.analyzers) {
+		a := f.analyzers[f.n]
+		a.SetConfig(config)
+		f.n++
+		args := AnalyzerArgs{
+			Config:    config,
+			Name:      name,
+			MysqlConn: mysqlConn,
+			Begin:     begin,
+			End:       end,
+		}
+		f.Args = append(f.Args, args)
+		return a, nil
+	}
+	panic("Need more analyzers")
+}
+
+// ShipSlowLog returns SlowLogSlice, or SlowLogErr, and saves the request
+// in SlowLogReqs.
+func (f *QanAnalyzerFactory) ShipSlowLog(mysqlConn mysql.Connector, req qan.SlowLogSliceRequest) (*qan.SlowLogSlice, error) {
+	f.SlowLogReqs = append(f.SlowLogReqs, req)
+	return f.SlowLogSlice, f.SlowLogErr
+}
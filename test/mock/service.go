@@ -32,6 +32,7 @@ type MockServiceManager struct {
 	IsRunningVal bool
 	status       *pct.Status
 	Cmds         []*proto.Cmd
+	HandleChan   chan bool // if set, Handle returns when it receives, to simulate slow cmds
 }
 
 func NewMockServiceManager(name string, readyChan chan bool, traceChan chan string) *MockServiceManager {
@@ -88,9 +89,17 @@ func (m *MockServiceManager) IsRunning() bool {
 
 func (m *MockServiceManager) Handle(cmd *proto.Cmd) *proto.Reply {
 	m.Cmds = append(m.Cmds, cmd)
+	if m.HandleChan != nil {
+		<-m.HandleChan
+	}
 	return cmd.Reply(nil)
 }
 
+// SetStatus sets the service status, e.g. "Crashed".
+func (m *MockServiceManager) SetStatus(status string) {
+	m.status.Update(m.name, status)
+}
+
 func (m *MockServiceManager) Reset() {
 	m.status.Update(m.name, "")
 }
@@ -41,6 +41,8 @@ type WebsocketClient struct {
 	started          bool
 	RecvBytes        chan []byte
 	TraceChan        chan string
+	HandshakeChan    chan *proto.Reply // agent handshakes, not relayed to test recvChan
+	compressMinSize  int
 	mux              *sync.Mutex
 	mux2             *sync.Mutex
 }
@@ -59,6 +61,7 @@ func NewWebsocketClient(sendChan chan *proto.Cmd, recvChan chan *proto.Reply, se
 		connectChan:      make(chan bool, 1),
 		RecvBytes:        make(chan []byte, 1),
 		TraceChan:        make(chan string, 100),
+		HandshakeChan:    make(chan *proto.Reply, 10),
 		mux:              &sync.Mutex{},
 		mux2:             &sync.Mutex{},
 	}
@@ -124,6 +127,14 @@ func (c *WebsocketClient) Start() {
 
 	go func() {
 		for reply := range c.userSendChan { // user sends reply
+			if reply.Cmd == "Handshake" {
+				// Sent on every connect, so keep it out of tests' way.
+				select {
+				case c.HandshakeChan <- reply:
+				default:
+				}
+				continue
+			}
 			c.testRecvChan <- reply // test receives reply
 		}
 	}()
@@ -187,6 +198,18 @@ func (c *WebsocketClient) SetConnectChan(connectChan chan bool) {
 	c.testConnectChan = connectChan
 }
 
+func (c *WebsocketClient) SetCompression(minSize int) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	c.compressMinSize = minSize
+}
+
+func (c *WebsocketClient) CompressMinSize() int {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	return c.compressMinSize
+}
+
 func (c *WebsocketClient) Status() map[string]string {
 	c.mux.Lock()
 	defer c.mux.Unlock()
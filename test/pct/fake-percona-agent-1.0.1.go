@@ -23,10 +23,11 @@ import (
 )
 
 func main() {
-	if len(os.Args) != 2 {
+	// -version, or -self-check [-basedir dir] like pct.Updater runs.
+	if len(os.Args) < 2 {
 		os.Exit(1)
 	}
-	if os.Args[1] != "-version" {
+	if os.Args[1] != "-version" && os.Args[1] != "-self-check" {
 		os.Exit(1)
 	}
 	fmt.Println("percona-agent 1.0.1 rev 19b6b2ede12bfd2a012d40ac572a660be7aff1e7")
@@ -20,6 +20,8 @@ package test
 import (
 	"os"
 	"path/filepath"
+
+	"github.com/percona/percona-agent/pct"
 )
 
 func ClearDir(path ...string) error {
@@ -35,3 +37,17 @@ func ClearDir(path ...string) error {
 	}
 	return nil
 }
+
+// ClearConfigs removes all configs, in the store and config files.
+func ClearConfigs() error {
+	names, err := pct.Basedir.ConfigNames("*")
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		if err := pct.Basedir.RemoveConfig(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
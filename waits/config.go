@@ -0,0 +1,54 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package waits
+
+import (
+	"github.com/percona/cloud-protocol/proto/v1"
+	"github.com/percona/percona-agent/periodic"
+)
+
+const (
+	DEFAULT_INTERVAL = 60 // seconds
+	DEFAULT_LIMIT    = 20 // top waits per report
+)
+
+// Config is saved to config/waits.conf by StartService.  Reports are
+// synchronized like mm reports.
+type Config struct {
+	periodic.Config
+	Limit uint // top waits by time per report
+}
+
+// A Wait is one wait event's counters for an interval, e.g. Event
+// wait/io/file/innodb/innodb_data_file.
+type Wait struct {
+	Event string
+	Count uint64  // COUNT_STAR delta
+	Time  float64 // seconds, SUM_TIMER_WAIT delta
+}
+
+// A Report is the top waits by Time during the interval that began at Ts.
+// The first interval is the baseline, so the first report is sent after two
+// intervals.
+type Report struct {
+	proto.ServiceInstance
+	Ts       int64   // UTC Unix timestamp, interval start
+	Duration uint    // seconds, interval length
+	Total    float64 // seconds, Time of all waits, not only the top Limit
+	Waits    []Wait
+}
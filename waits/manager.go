@@ -0,0 +1,198 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package waits
+
+import (
+	"database/sql"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/percona/percona-agent/data"
+	"github.com/percona/percona-agent/instance"
+	"github.com/percona/percona-agent/mysql"
+	"github.com/percona/percona-agent/pct"
+	"github.com/percona/percona-agent/periodic"
+	"github.com/percona/percona-agent/ticker"
+)
+
+const (
+	SERVICE_NAME = "waits"
+)
+
+// Manager reports the top wait events from performance_schema every
+// interval: what MySQL waits on, e.g. I/O, locks, and mutexes, which
+// complements the per-query view of QAN.
+type Manager struct {
+	*periodic.Manager
+}
+
+func NewManager(logger *pct.Logger, clock ticker.Manager, spool data.Spooler, instanceRepo *instance.Repo, connFactory mysql.ConnectionFactory) *Manager {
+	c := &collector{
+		logger: logger,
+		spool:  spool,
+		status: pct.NewStatus([]string{SERVICE_NAME, SERVICE_NAME + "-mysql"}),
+	}
+	spec := periodic.Spec{
+		Name:            SERVICE_NAME,
+		DefaultInterval: DEFAULT_INTERVAL,
+		SyncTicks:       true,
+	}
+	m := &Manager{
+		Manager: periodic.NewManager(spec, c, logger, c.status, clock, instanceRepo, connFactory),
+	}
+	return m
+}
+
+// collector is the periodic.Service of the Manager.
+type collector struct {
+	logger *pct.Logger
+	spool  data.Spooler
+	status *pct.Status
+}
+
+func (c *collector) NewConfig() interface{} {
+	return &Config{}
+}
+
+func (c *collector) Validate(config interface{}) error {
+	if cfg := config.(*Config); cfg.Limit == 0 {
+		cfg.Limit = DEFAULT_LIMIT
+	}
+	return nil
+}
+
+// ConfigSchema describes Config.  The constraints must match Validate.
+func (c *collector) ConfigSchema() pct.ConfigSchema {
+	return pct.NewConfigSchema(SERVICE_NAME, Config{Limit: DEFAULT_LIMIT})
+}
+
+// @goroutine[1]
+func (c *collector) Run(config interface{}, conn mysql.Connector, tickChan chan time.Time, runSync *pct.SyncChan) {
+	cfg := config.(*Config)
+
+	// Totals at the start of the current interval, nil until the first tick.
+	var prev map[string]Wait
+	var prevTs time.Time
+
+	last := "Idle" // the last result, shown between ticks
+	for {
+		c.status.Update(SERVICE_NAME, last)
+		select {
+		case now := <-tickChan:
+			c.status.Update(SERVICE_NAME, "Collecting waits")
+			c.status.Update(SERVICE_NAME+"-mysql", "Connecting")
+			if err := conn.Connect(2); err != nil {
+				c.logger.Warn(err)
+				c.status.Update(SERVICE_NAME+"-mysql", "Error: "+err.Error())
+				prev = nil // interval is incomplete
+				continue
+			}
+			c.status.Update(SERVICE_NAME+"-mysql", "Connected")
+			cur, err := GetWaits(conn.DB())
+			conn.Close()
+			c.status.Update(SERVICE_NAME+"-mysql", "Disconnected (OK)")
+			if err != nil {
+				c.logger.Warn(err)
+				prev = nil
+				continue
+			}
+
+			if prev != nil {
+				total, top := Deltas(prev, cur, cfg.Limit)
+				report := &Report{
+					ServiceInstance: cfg.ServiceInstance,
+					Ts:              prevTs.UTC().Unix(),
+					Duration:        uint(now.Sub(prevTs).Seconds()),
+					Total:           total,
+					Waits:           top,
+				}
+				if err := c.spool.Write(SERVICE_NAME, report); err != nil {
+					c.logger.Warn("Lost report:", err)
+				}
+			}
+			prev = cur
+			prevTs = now
+			last = fmt.Sprintf("Collected %d wait events at %s", len(cur), pct.TimeString(now))
+		case <-runSync.StopChan:
+			runSync.Graceful()
+			return
+		}
+	}
+}
+
+// GetWaits returns the total counters of instrumented wait events, keyed on
+// event name.  The idle event is excluded: it's time spent waiting for
+// clients, not waiting in MySQL.
+func GetWaits(conn *sql.DB) (map[string]Wait, error) {
+	rows, err := conn.Query("SELECT EVENT_NAME, COUNT_STAR, SUM_TIMER_WAIT" +
+		" FROM performance_schema.events_waits_summary_global_by_event_name" +
+		" WHERE COUNT_STAR > 0 AND EVENT_NAME != 'idle'")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	waits := make(map[string]Wait)
+	for rows.Next() {
+		var w Wait
+		var timerWait uint64 // picoseconds
+		if err := rows.Scan(&w.Event, &w.Count, &timerWait); err != nil {
+			return nil, err
+		}
+		w.Time = float64(timerWait) / 1e12
+		waits[w.Event] = w
+	}
+	return waits, rows.Err()
+}
+
+// Deltas returns the total wait time between the prev and cur totals from
+// GetWaits, and the top limit waits by time, most time first.  If a counter
+// decreased, e.g. the table was truncated or MySQL restarted, cur is the delta.
+func Deltas(prev, cur map[string]Wait, limit uint) (float64, []Wait) {
+	total := 0.0
+	deltas := []Wait{}
+	for event, c := range cur {
+		d := c
+		if p, ok := prev[event]; ok && c.Count >= p.Count && c.Time >= p.Time {
+			d.Count = c.Count - p.Count
+			d.Time = c.Time - p.Time
+		}
+		if d.Count == 0 {
+			continue
+		}
+		total += d.Time
+		deltas = append(deltas, d)
+	}
+	sort.Sort(ByTime(deltas))
+	if uint(len(deltas)) > limit {
+		deltas = deltas[0:limit]
+	}
+	return total, deltas
+}
+
+// ByTime sorts waits by Time, most first, then by Event.
+type ByTime []Wait
+
+func (w ByTime) Len() int      { return len(w) }
+func (w ByTime) Swap(i, j int) { w[i], w[j] = w[j], w[i] }
+func (w ByTime) Less(i, j int) bool {
+	if w[i].Time == w[j].Time {
+		return w[i].Event < w[j].Event
+	}
+	return w[i].Time > w[j].Time
+}
@@ -0,0 +1,221 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package waits_test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/percona/cloud-protocol/proto/v1"
+	"github.com/percona/percona-agent/instance"
+	"github.com/percona/percona-agent/pct"
+	"github.com/percona/percona-agent/periodic"
+	"github.com/percona/percona-agent/test"
+	"github.com/percona/percona-agent/test/mock"
+	"github.com/percona/percona-agent/waits"
+	. "gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) { TestingT(t) }
+
+type ManagerTestSuite struct {
+	logChan       chan *proto.LogEntry
+	logger        *pct.Logger
+	tmpDir        string
+	repo          *instance.Repo
+	mysqlInstance proto.ServiceInstance
+}
+
+var _ = Suite(&ManagerTestSuite{})
+
+func (s *ManagerTestSuite) SetUpSuite(t *C) {
+	s.logChan = make(chan *proto.LogEntry, 100)
+	s.logger = pct.NewLogger(s.logChan, waits.SERVICE_NAME+"-manager-test")
+
+	var err error
+	s.tmpDir, err = ioutil.TempDir("/tmp", "agent-test")
+	t.Assert(err, IsNil)
+	if err := pct.Basedir.Init(s.tmpDir); err != nil {
+		t.Fatal(err)
+	}
+
+	s.repo = instance.NewRepo(pct.NewLogger(s.logChan, "im-test"), pct.Basedir.Dir("config"), nil)
+	data, err := json.Marshal(&proto.MySQLInstance{
+		Hostname: "db1",
+		DSN:      "user:pass@tcp(127.0.0.1:3306)/",
+	})
+	t.Assert(err, IsNil)
+	s.repo.Add("mysql", 1, data, false)
+	s.mysqlInstance = proto.ServiceInstance{Service: "mysql", InstanceId: 1}
+}
+
+func (s *ManagerTestSuite) SetUpTest(t *C) {
+	pct.Basedir.RemoveConfig(waits.SERVICE_NAME)
+}
+
+func (s *ManagerTestSuite) TearDownSuite(t *C) {
+	if err := os.RemoveAll(s.tmpDir); err != nil {
+		t.Error(err)
+	}
+}
+
+// --------------------------------------------------------------------------
+
+func (s *ManagerTestSuite) TestDeltas(t *C) {
+	prev := map[string]waits.Wait{
+		"wait/io/file/innodb/innodb_data_file": {Event: "wait/io/file/innodb/innodb_data_file", Count: 100, Time: 2.0},
+		"wait/io/table/sql/handler":            {Event: "wait/io/table/sql/handler", Count: 1000, Time: 1.0},
+		"wait/lock/table/sql/handler":          {Event: "wait/lock/table/sql/handler", Count: 10, Time: 0.5},
+	}
+	cur := map[string]waits.Wait{
+		"wait/io/file/innodb/innodb_data_file": {Event: "wait/io/file/innodb/innodb_data_file", Count: 150, Time: 2.5},
+		"wait/io/table/sql/handler":            {Event: "wait/io/table/sql/handler", Count: 3000, Time: 4.0},
+		"wait/lock/table/sql/handler":          {Event: "wait/lock/table/sql/handler", Count: 10, Time: 0.5},
+		"wait/synch/mutex/sql/LOCK_open":       {Event: "wait/synch/mutex/sql/LOCK_open", Count: 5, Time: 0.25},
+	}
+
+	// Events without new waits are not reported.  New events are reported
+	// as is.
+	total, top := waits.Deltas(prev, cur, 2)
+	t.Check(total, Equals, 3.75)
+	t.Check(top, DeepEquals, []waits.Wait{
+		{Event: "wait/io/table/sql/handler", Count: 2000, Time: 3.0},
+		{Event: "wait/io/file/innodb/innodb_data_file", Count: 50, Time: 0.5},
+	})
+
+	// Counters reset, e.g. MySQL restarted: totals are the deltas.
+	total, top = waits.Deltas(cur, prev, 10)
+	t.Check(total, Equals, 3.0)
+	t.Check(top, HasLen, 2)
+}
+
+func (s *ManagerTestSuite) TestGetWaits(t *C) {
+	fake := mock.NewFakeMySQL()
+	fake.OnQuery("events_waits_summary_global_by_event_name").Rows(
+		[]string{"EVENT_NAME", "COUNT_STAR", "SUM_TIMER_WAIT"},
+		[][]interface{}{
+			{"wait/io/table/sql/handler", 1000, 2500000000000},
+			{"wait/synch/mutex/sql/LOCK_open", 5, 250000000},
+		},
+	)
+	got, err := waits.GetWaits(fake.DB())
+	t.Assert(err, IsNil)
+	t.Check(got, DeepEquals, map[string]waits.Wait{
+		"wait/io/table/sql/handler":      {Event: "wait/io/table/sql/handler", Count: 1000, Time: 2.5},
+		"wait/synch/mutex/sql/LOCK_open": {Event: "wait/synch/mutex/sql/LOCK_open", Count: 5, Time: 0.00025},
+	})
+	t.Assert(fake.Queries(), HasLen, 1)
+	t.Check(fake.Queries()[0], Matches, ".*EVENT_NAME != 'idle'.*")
+}
+
+func (s *ManagerTestSuite) TestStartService(t *C) {
+	fake := mock.NewFakeMySQL()
+	clock := mock.NewClock()
+	m := waits.NewManager(s.logger, clock, mock.NewSpooler(nil), s.repo, &mock.ConnectionFactory{Conn: fake})
+	err := m.Start()
+	t.Assert(err, IsNil)
+	defer m.Stop()
+
+	// Only MySQL instances.
+	config := &waits.Config{
+		Config: periodic.Config{ServiceInstance: proto.ServiceInstance{Service: "server", InstanceId: 1}},
+	}
+	data, _ := json.Marshal(config)
+	reply := m.Handle(&proto.Cmd{Service: waits.SERVICE_NAME, Cmd: "StartService", Data: data})
+	t.Check(reply.Error, Not(Equals), "")
+
+	config = &waits.Config{
+		Config: periodic.Config{ServiceInstance: s.mysqlInstance},
+	}
+	data, _ = json.Marshal(config)
+	reply = m.Handle(&proto.Cmd{Service: waits.SERVICE_NAME, Cmd: "StartService", Data: data})
+	t.Assert(reply.Error, Equals, "")
+	t.Check(clock.Added, DeepEquals, []uint{waits.DEFAULT_INTERVAL})
+
+	// Config is saved with defaults.
+	saved := &waits.Config{}
+	err = pct.Basedir.ReadConfig(waits.SERVICE_NAME, saved)
+	t.Assert(err, IsNil)
+	t.Check(saved.Interval, Equals, uint(waits.DEFAULT_INTERVAL))
+	t.Check(saved.Limit, Equals, uint(waits.DEFAULT_LIMIT))
+
+	configs, errs := m.GetConfig()
+	t.Check(errs, HasLen, 0)
+	t.Assert(configs, HasLen, 1)
+	t.Check(configs[0].Running, Equals, true)
+
+	reply = m.Handle(&proto.Cmd{Service: waits.SERVICE_NAME, Cmd: "StopService"})
+	t.Check(reply.Error, Equals, "")
+	t.Check(pct.Basedir.ConfigExists(waits.SERVICE_NAME), Equals, false)
+}
+
+func (s *ManagerTestSuite) TestReport(t *C) {
+	fake := mock.NewFakeMySQL()
+	q := fake.OnQuery("events_waits_summary_global_by_event_name").Rows(
+		[]string{"EVENT_NAME", "COUNT_STAR", "SUM_TIMER_WAIT"},
+		[][]interface{}{
+			{"wait/io/table/sql/handler", 1000, 1000000000000},
+		},
+	)
+	clock := mock.NewClock()
+	dataChan := make(chan interface{}, 1)
+	m := waits.NewManager(s.logger, clock, mock.NewSpooler(dataChan), s.repo, &mock.ConnectionFactory{Conn: fake})
+	err := m.Start()
+	t.Assert(err, IsNil)
+	defer m.Stop()
+
+	config := &waits.Config{
+		Config: periodic.Config{ServiceInstance: s.mysqlInstance},
+	}
+	data, _ := json.Marshal(config)
+	reply := m.Handle(&proto.Cmd{Service: waits.SERVICE_NAME, Cmd: "StartService", Data: data})
+	t.Assert(reply.Error, Equals, "")
+	t.Assert(clock.Chans, HasLen, 1)
+
+	// The first tick starts the interval, so there's no report.
+	t0 := time.Date(2015, 6, 1, 12, 0, 0, 0, time.UTC)
+	clock.Chans[0] <- t0
+	ok := test.WaitStatusPrefix(1, m, waits.SERVICE_NAME, "Collected 1 wait events")
+	t.Assert(ok, Equals, true)
+	t.Check(dataChan, HasLen, 0)
+	t.Check(fake.Connected(), Equals, uint(0))
+
+	// The second tick ends it.
+	q.Rows(
+		[]string{"EVENT_NAME", "COUNT_STAR", "SUM_TIMER_WAIT"},
+		[][]interface{}{
+			{"wait/io/table/sql/handler", 3000, 4000000000000},
+		},
+	)
+	clock.Chans[0] <- t0.Add(time.Duration(waits.DEFAULT_INTERVAL) * time.Second)
+	got := test.WaitData(dataChan)
+	t.Assert(got, HasLen, 1)
+	t.Check(got[0], DeepEquals, &waits.Report{
+		ServiceInstance: s.mysqlInstance,
+		Ts:              t0.Unix(),
+		Duration:        waits.DEFAULT_INTERVAL,
+		Total:           3.0,
+		Waits: []waits.Wait{
+			{Event: "wait/io/table/sql/handler", Count: 2000, Time: 3.0},
+		},
+	})
+	t.Check(fake.Connected(), Equals, uint(0))
+}
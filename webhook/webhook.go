@@ -0,0 +1,213 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+// Package webhook posts local agent events, e.g. MySQL and service restarts,
+// alerts, and config changes, to HTTP endpoints like a PagerDuty or Slack
+// incoming webhook.  A Sink subscribes to bus topics and posts each event as
+// JSON or with a template.
+package webhook
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"text/template"
+	"time"
+
+	"github.com/percona/percona-agent/bus"
+	"github.com/percona/percona-agent/pct"
+)
+
+const WEBHOOK_TIMEOUT = 10 * time.Second
+
+// DEFAULT_TOPICS are posted if Config.Topics is empty.
+var DEFAULT_TOPICS = []string{bus.MYSQL_RESTART, bus.SERVICE_RESTART, bus.ALERT, bus.CONFIG_CHANGED}
+
+type Config struct {
+	URL      string
+	Headers  map[string]string `json:",omitempty"` // e.g. Authorization
+	Template string            `json:",omitempty"` // text/template of the body with a Payload, default Payload as JSON
+	Topics   []string          `json:",omitempty"` // bus topics to post, default DEFAULT_TOPICS
+}
+
+// A Payload is a bus event from this agent.  In a Template, {{json .Data}}
+// encodes a value as JSON, e.g. for a Slack message:
+//
+//	{"text": {{json (printf "%s on %s: %v" .Topic .Hostname .Data)}}}
+type Payload struct {
+	Topic     string
+	Ts        time.Time // UTC
+	Source    string
+	Data      interface{}
+	Hostname  string
+	AgentUuid string
+}
+
+type Sink struct {
+	logger    *pct.Logger
+	config    Config
+	hostname  string
+	agentUuid string
+	// --
+	tmpl   *template.Template
+	client *http.Client
+}
+
+func NewSink(logger *pct.Logger, config Config, hostname, agentUuid string) (*Sink, error) {
+	if err := ValidateConfig(&config); err != nil {
+		return nil, err
+	}
+	s := &Sink{
+		logger:    logger,
+		config:    config,
+		hostname:  hostname,
+		agentUuid: agentUuid,
+		// --
+		client: &http.Client{
+			Timeout:   WEBHOOK_TIMEOUT,
+			Transport: &http.Transport{Proxy: http.ProxyFromEnvironment},
+		},
+	}
+	if config.Template != "" {
+		s.tmpl = template.Must(newTemplate(config.Template)) // validated
+	}
+	return s, nil
+}
+
+// ValidateConfig returns an error if the URL or Template is invalid, and sets
+// the default Topics.
+func ValidateConfig(config *Config) error {
+	if config.URL == "" {
+		return errors.New("Webhook URL is not set")
+	}
+	u, err := url.Parse(config.URL)
+	if err != nil {
+		return fmt.Errorf("Invalid webhook URL: %s", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("Invalid webhook URL: %s: expected http or https", config.URL)
+	}
+	if config.Template != "" {
+		if _, err := newTemplate(config.Template); err != nil {
+			return fmt.Errorf("Invalid webhook template: %s", err)
+		}
+	}
+	if len(config.Topics) == 0 {
+		config.Topics = DEFAULT_TOPICS
+	}
+	return nil
+}
+
+// Run posts events of the topics until stopChan is closed.  Posting is
+// serialized, so a slow endpoint drops events (see bus.Subscription) instead
+// of piling up requests.
+func (s *Sink) Run(b *bus.Bus, stopChan chan struct{}) {
+	defer func() {
+		if err := recover(); err != nil {
+			s.logger.Error("Webhook crashed: ", err)
+		}
+	}()
+	events := make(chan bus.Event, bus.SUBSCRIPTION_SIZE)
+	for _, topic := range s.config.Topics {
+		sub := b.Subscribe(topic, 0)
+		defer sub.Cancel()
+		go func(sub *bus.Subscription) {
+			for {
+				select {
+				case e := <-sub.C:
+					select {
+					case events <- e:
+					default:
+						s.logger.Warn("Webhook busy, dropped " + e.Topic + " event")
+					}
+				case <-stopChan:
+					return
+				}
+			}
+		}(sub)
+	}
+	for {
+		select {
+		case e := <-events:
+			if err := s.Post(e); err != nil {
+				s.logger.Warn("Webhook:", err)
+			}
+		case <-stopChan:
+			return
+		}
+	}
+}
+
+// Post posts the event.
+func (s *Sink) Post(e bus.Event) error {
+	body, err := s.Body(e)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", s.config.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "percona-agent")
+	for name, value := range s.config.Headers {
+		req.Header.Set(name, value)
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("POST %s returned %d, expected 2xx", s.config.URL, resp.StatusCode)
+	}
+	s.logger.Debug("Posted " + e.Topic + " event")
+	return nil
+}
+
+// Body returns the body posted for the event.
+func (s *Sink) Body(e bus.Event) ([]byte, error) {
+	payload := Payload{
+		Topic:     e.Topic,
+		Ts:        e.Ts,
+		Source:    e.Source,
+		Data:      e.Data,
+		Hostname:  s.hostname,
+		AgentUuid: s.agentUuid,
+	}
+	if s.tmpl == nil {
+		return json.Marshal(payload)
+	}
+	var buf bytes.Buffer
+	if err := s.tmpl.Execute(&buf, payload); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func newTemplate(text string) (*template.Template, error) {
+	funcs := template.FuncMap{
+		"json": func(v interface{}) (string, error) {
+			data, err := json.Marshal(v)
+			return string(data), err
+		},
+	}
+	return template.New("webhook").Funcs(funcs).Parse(text)
+}
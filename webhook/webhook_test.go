@@ -0,0 +1,115 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package webhook_test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/percona/cloud-protocol/proto/v1"
+	"github.com/percona/percona-agent/bus"
+	"github.com/percona/percona-agent/pct"
+	"github.com/percona/percona-agent/webhook"
+	. "gopkg.in/check.v1"
+)
+
+// Hook up gocheck into the "go test" runner.
+func Test(t *testing.T) { TestingT(t) }
+
+type WebhookTestSuite struct {
+	logChan chan *proto.LogEntry
+	logger  *pct.Logger
+}
+
+var _ = Suite(&WebhookTestSuite{})
+
+func (s *WebhookTestSuite) SetUpSuite(t *C) {
+	s.logChan = make(chan *proto.LogEntry, 100)
+	s.logger = pct.NewLogger(s.logChan, "webhook-test")
+}
+
+type request struct {
+	header http.Header
+	body   []byte
+}
+
+func (s *WebhookTestSuite) TestPost(t *C) {
+	reqChan := make(chan request, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		reqChan <- request{header: r.Header, body: body}
+	}))
+	defer server.Close()
+
+	config := webhook.Config{
+		URL:     server.URL,
+		Headers: map[string]string{"Authorization": "Token abc"},
+	}
+	sink, err := webhook.NewSink(s.logger, config, "db1", "123")
+	t.Assert(err, IsNil)
+
+	b := bus.New()
+	stopChan := make(chan struct{})
+	defer close(stopChan)
+	go sink.Run(b, stopChan)
+	time.Sleep(100 * time.Millisecond) // subscribe
+
+	// Not a default topic.
+	b.Publish(bus.Event{Topic: bus.API_CONNECTED, Source: "agent"})
+	b.Publish(bus.Event{Topic: bus.MYSQL_RESTART, Source: "mrms", Data: "user@tcp(localhost:3306)/"})
+
+	var req request
+	select {
+	case req = <-reqChan:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Timeout waiting for webhook")
+	}
+	t.Check(req.header.Get("Authorization"), Equals, "Token abc")
+	t.Check(req.header.Get("Content-Type"), Equals, "application/json")
+	got := webhook.Payload{}
+	err = json.Unmarshal(req.body, &got)
+	t.Assert(err, IsNil)
+	t.Check(got.Topic, Equals, bus.MYSQL_RESTART)
+	t.Check(got.Source, Equals, "mrms")
+	t.Check(got.Data, Equals, "user@tcp(localhost:3306)/")
+	t.Check(got.Hostname, Equals, "db1")
+	t.Check(got.AgentUuid, Equals, "123")
+	t.Check(got.Ts.IsZero(), Equals, false)
+}
+
+func (s *WebhookTestSuite) TestTemplate(t *C) {
+	config := webhook.Config{
+		URL:      "https://hooks.slack.com/services/x",
+		Template: `{"text": {{json (printf "%s on %s: %v" .Topic .Hostname .Data)}}}`,
+	}
+	sink, err := webhook.NewSink(s.logger, config, "db1", "123")
+	t.Assert(err, IsNil)
+	body, err := sink.Body(bus.Event{Topic: bus.CONFIG_CHANGED, Data: "qan"})
+	t.Assert(err, IsNil)
+	t.Check(string(body), Equals, `{"text": "config-changed on db1: qan"}`)
+
+	// Invalid configs.
+	_, err = webhook.NewSink(s.logger, webhook.Config{URL: "ftp://example.com"}, "db1", "123")
+	t.Check(err, NotNil)
+	_, err = webhook.NewSink(s.logger, webhook.Config{URL: "http://example.com", Template: "{{"}, "db1", "123")
+	t.Check(err, NotNil)
+}